@@ -0,0 +1,356 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package backup exports the state managed by external-ips, its DNS records,
+// security groups and external IPs, to a snapshot, and imports it into another
+// cluster or account under the ownership of the importing instance, so that a
+// rebuilt cluster serves its services without waiting for them to converge.
+package backup
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/ghodss/yaml"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/extip/extip"
+	eipplan "github.com/openfresh/external-ips/extip/plan"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+// Version is the version of the format of the snapshots written by Write.
+const Version = 1
+
+// RuleRegistry lists and changes the inbound rules, e.g. the firewall registry.
+type RuleRegistry interface {
+	Rules() ([]*inbound.InboundRules, error)
+	ApplyChanges(changes *fwplan.Changes) error
+}
+
+// ExtIPRegistry lists and changes the external IPs of the services, e.g. the external IPs registry.
+type ExtIPRegistry interface {
+	ExtIPs() ([]*extip.ExtIP, error)
+	ApplyChanges(changes *eipplan.Changes) error
+}
+
+// Snapshot is the state managed by an instance of external-ips at some point in time.
+type Snapshot struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// The owner id of the exporting instance
+	Owner       string   `json:"owner"`
+	Records     []Record `json:"records,omitempty"`
+	Rules       []Rules  `json:"rules,omitempty"`
+	ExternalIPs []ExtIPs `json:"externalIPs,omitempty"`
+}
+
+// Record is an owned DNS record, with its TTL and labels.
+type Record struct {
+	Name             string            `json:"name"`
+	Type             string            `json:"type"`
+	TTL              int64             `json:"ttl,omitempty"`
+	Targets          []string          `json:"targets"`
+	PrivateTargets   []string          `json:"privateTargets,omitempty"`
+	Labels           map[string]string `json:"labels,omitempty"`
+	ProviderSpecific map[string]string `json:"providerSpecific,omitempty"`
+}
+
+// Rules are the inbound rules of an owned security group. The instances it's
+// assigned to aren't kept, they're assigned by the next synchronization.
+type Rules struct {
+	Name     string `json:"name"`
+	Resource string `json:"resource,omitempty"`
+	Rules    []Rule `json:"rules"`
+}
+
+// Rule is an inbound rule of a security group.
+type Rule struct {
+	Protocol            string   `json:"protocol"`
+	Port                int      `json:"port"`
+	ToPort              int      `json:"toPort,omitempty"`
+	Description         string   `json:"description,omitempty"`
+	SourceCIDRs         []string `json:"sourceCIDRs,omitempty"`
+	SourceSecurityGroup string   `json:"sourceSecurityGroup,omitempty"`
+}
+
+// ExtIPs are the managed external IPs of a service.
+type ExtIPs struct {
+	Namespace string   `json:"namespace"`
+	Service   string   `json:"service"`
+	IPs       []string `json:"ips"`
+}
+
+// Backup exports and imports the state managed by an instance of external-ips.
+type Backup struct {
+	Registry registry.Registry
+	Rules    RuleRegistry
+	ExtIPs   ExtIPRegistry
+	// The owner id of the instance, the records owned by it are exported
+	OwnerID string
+}
+
+// Report counts the changes made by an import.
+type Report struct {
+	Records     int
+	Rules       int
+	ExternalIPs int
+}
+
+// Print writes the number of changes made by the import.
+func (r *Report) Print(w io.Writer) {
+	fmt.Fprintf(w, "%-12s %d changes\n", "records", r.Records)
+	fmt.Fprintf(w, "%-12s %d changes\n", "rules", r.Rules)
+	fmt.Fprintf(w, "%-12s %d changes\n", "externalIPs", r.ExternalIPs)
+}
+
+// Export returns the snapshot of the records owned by the instance, the inbound
+// rules of its security groups and the managed external IPs of the services.
+func (b *Backup) Export(t time.Time) (*Snapshot, error) {
+	snapshot := &Snapshot{
+		Version: Version,
+		Time:    t.UTC(),
+		Owner:   b.OwnerID,
+	}
+
+	records, err := b.Registry.Records()
+	if err != nil {
+		return nil, err
+	}
+	for _, ep := range records {
+		if ep.Labels[endpoint.OwnerLabelKey] != b.OwnerID {
+			continue
+		}
+		snapshot.Records = append(snapshot.Records, newRecord(ep))
+	}
+	sort.Slice(snapshot.Records, func(i, j int) bool {
+		if snapshot.Records[i].Name != snapshot.Records[j].Name {
+			return snapshot.Records[i].Name < snapshot.Records[j].Name
+		}
+		return snapshot.Records[i].Type < snapshot.Records[j].Type
+	})
+
+	rules, err := b.Rules.Rules()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rules {
+		snapshot.Rules = append(snapshot.Rules, newRules(r))
+	}
+	sort.Slice(snapshot.Rules, func(i, j int) bool {
+		return snapshot.Rules[i].Name < snapshot.Rules[j].Name
+	})
+
+	extIPs, err := b.ExtIPs.ExtIPs()
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(extip.BySvcName(extIPs))
+	for _, e := range extIPs {
+		if !e.Managed {
+			continue
+		}
+		snapshot.ExternalIPs = append(snapshot.ExternalIPs, ExtIPs{
+			Namespace: e.Namespace,
+			Service:   e.SvcName,
+			IPs:       append([]string(nil), e.ExtIPs...),
+		})
+	}
+
+	return snapshot, nil
+}
+
+// Import creates or updates the records, security groups and external IPs of the
+// snapshot under the ownership of the instance, whatever their owner in the
+// snapshot. Nothing is deleted: the records owned by others are left alone, as
+// are the external IPs of the services missing from the cluster.
+func (b *Backup) Import(s *Snapshot) (*Report, error) {
+	if s.Version != Version {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", s.Version)
+	}
+	report := &Report{}
+
+	records, err := b.Registry.Records()
+	if err != nil {
+		return nil, err
+	}
+	desired := make([]*endpoint.Endpoint, 0, len(s.Records))
+	for _, r := range s.Records {
+		desired = append(desired, r.endpoint())
+	}
+	changes := (&plan.Plan{
+		Policies: []plan.Policy{&plan.UpsertOnlyPolicy{}},
+		Current:  records,
+		Desired:  desired,
+	}).Calculate().Changes
+	if err := b.Registry.ApplyChanges(changes); err != nil {
+		return nil, fmt.Errorf("failed to import the records: %v", err)
+	}
+	report.Records = len(changes.Create) + len(changes.UpdateNew)
+
+	rules, err := b.Rules.Rules()
+	if err != nil {
+		return nil, err
+	}
+	desiredRules := make([]*inbound.InboundRules, 0, len(s.Rules))
+	for _, r := range s.Rules {
+		desiredRules = append(desiredRules, r.inboundRules())
+	}
+	ruleChanges := (&fwplan.Plan{
+		Current: rules,
+		Desired: desiredRules,
+	}).Calculate().Changes
+	// the security groups are only created or updated, their instances are left to the synchronizations
+	ruleChanges = &fwplan.Changes{
+		Create:    ruleChanges.Create,
+		UpdateOld: ruleChanges.UpdateOld,
+		UpdateNew: ruleChanges.UpdateNew,
+	}
+	if err := b.Rules.ApplyChanges(ruleChanges); err != nil {
+		return nil, fmt.Errorf("failed to import the inbound rules: %v", err)
+	}
+	report.Rules = len(ruleChanges.Create) + len(ruleChanges.UpdateNew)
+
+	extIPs, err := b.ExtIPs.ExtIPs()
+	if err != nil {
+		return nil, err
+	}
+	desiredExtIPs := make([]*extip.ExtIP, 0, len(s.ExternalIPs))
+	for _, e := range s.ExternalIPs {
+		desiredExtIPs = append(desiredExtIPs, &extip.ExtIP{
+			Namespace: e.Namespace,
+			SvcName:   e.Service,
+			ExtIPs:    e.IPs,
+		})
+	}
+	// the services missing from the cluster have no current external IPs and are skipped by the plan
+	extIPChanges := (&eipplan.Plan{
+		Current: extIPs,
+		Desired: desiredExtIPs,
+	}).Calculate().Changes
+	extIPChanges.Delete = nil
+	if err := b.ExtIPs.ApplyChanges(extIPChanges); err != nil {
+		return nil, fmt.Errorf("failed to import the external IPs: %v", err)
+	}
+	report.ExternalIPs = len(extIPChanges.Create) + len(extIPChanges.UpdateNew)
+
+	return report, nil
+}
+
+// Write writes the snapshot as YAML.
+func Write(w io.Writer, s *Snapshot) error {
+	data, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// Read reads a snapshot written by Write.
+func Read(r io.Reader) (*Snapshot, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{}
+	if err := yaml.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("invalid snapshot: %v", err)
+	}
+	return s, nil
+}
+
+func newRecord(ep *endpoint.Endpoint) Record {
+	r := Record{
+		Name:           ep.DNSName,
+		Type:           ep.RecordType,
+		TTL:            int64(ep.RecordTTL),
+		Targets:        append([]string(nil), ep.Targets...),
+		PrivateTargets: append([]string(nil), ep.PrivateTargets...),
+	}
+	for k, v := range ep.Labels {
+		// the records are owned by the importing instance
+		if k == endpoint.OwnerLabelKey {
+			continue
+		}
+		if r.Labels == nil {
+			r.Labels = map[string]string{}
+		}
+		r.Labels[k] = v
+	}
+	for _, p := range ep.ProviderSpecific {
+		// the zone a record was read from isn't desired, the importing provider finding its own
+		if p.Name == provider.ZoneProperty {
+			continue
+		}
+		if r.ProviderSpecific == nil {
+			r.ProviderSpecific = map[string]string{}
+		}
+		r.ProviderSpecific[p.Name] = p.Value
+	}
+	return r
+}
+
+// endpoint returns the desired record, without owner.
+func (r Record) endpoint() *endpoint.Endpoint {
+	ep := endpoint.NewEndpointWithTTL(r.Name, r.Type, endpoint.TTL(r.TTL), r.Targets...)
+	ep.PrivateTargets = r.PrivateTargets
+	for k, v := range r.Labels {
+		ep.Labels[k] = v
+	}
+	names := make([]string, 0, len(r.ProviderSpecific))
+	for name := range r.ProviderSpecific {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ep.WithProviderSpecific(name, r.ProviderSpecific[name])
+	}
+	return ep
+}
+
+func newRules(ir *inbound.InboundRules) Rules {
+	r := Rules{
+		Name:     ir.Name,
+		Resource: ir.Resource,
+		Rules:    make([]Rule, 0, len(ir.Rules)),
+	}
+	for _, rule := range ir.Rules {
+		r.Rules = append(r.Rules, Rule{
+			Protocol:            rule.Protocol,
+			Port:                rule.Port,
+			ToPort:              rule.ToPort,
+			Description:         rule.Description,
+			SourceCIDRs:         rule.SourceCIDRs,
+			SourceSecurityGroup: rule.SourceSecurityGroup,
+		})
+	}
+	return r
+}
+
+// inboundRules returns the desired rules, assigned to no instance.
+func (r Rules) inboundRules() *inbound.InboundRules {
+	ir := &inbound.InboundRules{
+		Name:     r.Name,
+		Resource: r.Resource,
+		Rules:    make([]inbound.InboundRule, 0, len(r.Rules)),
+	}
+	for _, rule := range r.Rules {
+		ir.Rules = append(ir.Rules, inbound.InboundRule{
+			Protocol:            rule.Protocol,
+			Port:                rule.Port,
+			ToPort:              rule.ToPort,
+			Description:         rule.Description,
+			SourceCIDRs:         rule.SourceCIDRs,
+			SourceSecurityGroup: rule.SourceSecurityGroup,
+		})
+	}
+	return ir
+}
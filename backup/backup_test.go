@@ -0,0 +1,146 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package backup
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/extip/extip"
+	eipplan "github.com/openfresh/external-ips/extip/plan"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+// ruleRegistry holds the rules and records the changes applied to them.
+type ruleRegistry struct {
+	rules   []*inbound.InboundRules
+	changes *fwplan.Changes
+}
+
+func (r *ruleRegistry) Rules() ([]*inbound.InboundRules, error) {
+	return r.rules, nil
+}
+
+func (r *ruleRegistry) ApplyChanges(changes *fwplan.Changes) error {
+	r.changes = changes
+	return nil
+}
+
+// extIPRegistry holds the external IPs and records the changes applied to them.
+type extIPRegistry struct {
+	extIPs  []*extip.ExtIP
+	changes *eipplan.Changes
+}
+
+func (r *extIPRegistry) ExtIPs() ([]*extip.ExtIP, error) {
+	return r.extIPs, nil
+}
+
+func (r *extIPRegistry) ApplyChanges(changes *eipplan.Changes) error {
+	r.changes = changes
+	return nil
+}
+
+func newTXTRegistry(t *testing.T, p provider.Provider, ownerID string) registry.Registry {
+	r, err := registry.NewTXTRegistry(p, "txt.", ownerID, nil, 0, nil, "")
+	require.NoError(t, err)
+	return r
+}
+
+func TestExportImport(t *testing.T) {
+	source := provider.NewInMemoryProvider()
+	require.NoError(t, source.CreateZone("example.org"))
+	owned := endpoint.NewEndpointWithTTL("foo.example.org", endpoint.RecordTypeA, 60, "1.2.3.4")
+	owned.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+	owned.WithProviderSpecific(provider.ZoneVisibilityProperty, provider.ZoneVisibilityPublic)
+	require.NoError(t, newTXTRegistry(t, source, "old").ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{owned}}))
+	require.NoError(t, newTXTRegistry(t, source, "other").ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "1.2.3.5")},
+	}))
+
+	exporter := &Backup{
+		Registry: newTXTRegistry(t, source, "old"),
+		Rules: &ruleRegistry{rules: []*inbound.InboundRules{{
+			Name:        "foo.default.cluster",
+			Resource:    "default/foo",
+			Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80, SourceCIDRs: []string{"10.0.0.0/8"}}},
+			ProviderIDs: inbound.NewProviderIDs("aws:///us-east-1a/i-1"),
+		}}},
+		ExtIPs: &extIPRegistry{extIPs: []*extip.ExtIP{
+			{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}, Managed: true},
+			{Namespace: "default", SvcName: "unmanaged", ExtIPs: endpoint.Targets{"1.2.3.6"}},
+		}},
+		OwnerID: "old",
+	}
+	snapshot, err := exporter.Export(time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, snapshot))
+	for _, line := range []string{
+		"owner: old\n",
+		"- labels:\n    resource: service/default/foo\n  name: foo.example.org\n",
+		"  providerSpecific:\n    zone-visibility: public\n",
+		"  ttl: 60\n",
+		"  resource: default/foo\n",
+		"- ips:\n  - 1.2.3.4\n  namespace: default\n  service: foo\n",
+		"version: 1\n",
+	} {
+		assert.Contains(t, buf.String(), line)
+	}
+	// neither the records of other owners, nor the instances, nor the unmanaged external IPs are exported
+	assert.NotContains(t, buf.String(), "bar.example.org")
+	assert.NotContains(t, buf.String(), "i-1")
+	assert.NotContains(t, buf.String(), "unmanaged")
+
+	read, err := Read(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, snapshot, read)
+
+	// the snapshot is imported under the ownership of the new instance
+	target := provider.NewInMemoryProvider()
+	require.NoError(t, target.CreateZone("example.org"))
+	rules := &ruleRegistry{}
+	extIPs := &extIPRegistry{extIPs: []*extip.ExtIP{{Namespace: "default", SvcName: "foo"}}}
+	importer := &Backup{
+		Registry: newTXTRegistry(t, target, "new"),
+		Rules:    rules,
+		ExtIPs:   extIPs,
+		OwnerID:  "new",
+	}
+	report, err := importer.Import(read)
+	require.NoError(t, err)
+	assert.Equal(t, &Report{Records: 1, Rules: 1, ExternalIPs: 1}, report)
+
+	records, err := newTXTRegistry(t, target, "new").Records()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "foo.example.org", records[0].DNSName)
+	assert.Equal(t, endpoint.TTL(60), records[0].RecordTTL)
+	assert.Equal(t, "new", records[0].Labels[endpoint.OwnerLabelKey])
+	assert.Equal(t, "service/default/foo", records[0].Labels[endpoint.ResourceLabelKey])
+
+	// the security group is created without its former instances
+	require.Len(t, rules.changes.Create, 1)
+	assert.Equal(t, "default/foo", rules.changes.Create[0].Resource)
+	assert.Empty(t, rules.changes.Create[0].ProviderIDs)
+	assert.Empty(t, rules.changes.Set)
+
+	require.Len(t, extIPs.changes.Create, 1)
+	assert.Equal(t, endpoint.Targets{"1.2.3.4"}, extIPs.changes.Create[0].ExtIPs)
+}
+
+func TestImportVersion(t *testing.T) {
+	_, err := (&Backup{}).Import(&Snapshot{Version: 2})
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package canary exercises the DNS and firewall providers end to end, so that
+// a lost permission or a broken propagation is noticed before the services are.
+package canary
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+	fwprovider "github.com/openfresh/external-ips/firewall/provider"
+)
+
+const (
+	// Target is the address the canary record points to, reserved for documentation by RFC 5737
+	Target = "192.0.2.1"
+	// GroupPrefix is prepended to the name of the cluster to name the canary security group
+	GroupPrefix = "external-ips-canary."
+)
+
+// the error codes of the AWS API calls denied by the IAM policy
+var permissionErrorCodes = map[string]bool{
+	"AccessDenied":          true,
+	"AccessDeniedException": true,
+	"UnauthorizedOperation": true,
+}
+
+// Resolver looks up the addresses of a host.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// NewResolver returns a resolver querying the given name server, host:port, or
+// the system resolver if empty.
+func NewResolver(address string) Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Canary creates, resolves and deletes a canary record, then creates and deletes a
+// canary security group, timing every step.
+type Canary struct {
+	Registry registry.Registry
+	// The firewall provider, nil skips the security group
+	Firewall fwprovider.Provider
+	Resolver Resolver
+	// The DNS name of the canary record, in a zone of the DNS provider
+	Hostname string
+	// How long the record may take to resolve
+	Timeout time.Duration
+	// How often the record is looked up until it resolves
+	PollInterval time.Duration
+}
+
+// Step is the outcome of a step of the canary.
+type Step struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// Report is the outcome of a canary run.
+type Report struct {
+	Steps []Step
+}
+
+// Failed returns whether any step failed.
+func (r *Report) Failed() bool {
+	for _, s := range r.Steps {
+		if s.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes the outcome and the duration of every step.
+func (r *Report) Print(w io.Writer) {
+	var total time.Duration
+	for _, s := range r.Steps {
+		total += s.Duration
+		status := "OK"
+		if s.Err != nil {
+			status = fmt.Sprintf("FAILED: %v", s.Err)
+			if isPermissionError(s.Err) {
+				status += " (permission denied, see `external-ips permissions`)"
+			}
+		}
+		fmt.Fprintf(w, "%-16s %10s  %s\n", s.Name, s.Duration.Round(time.Millisecond), status)
+	}
+	fmt.Fprintf(w, "%-16s %10s\n", "total", total.Round(time.Millisecond))
+}
+
+// Run runs every step of the canary. The canary resources are deleted whenever
+// they were created, even if a later step failed.
+func (c *Canary) Run() *Report {
+	report := &Report{}
+	step := func(name string, f func() error) error {
+		start := time.Now()
+		err := f()
+		report.Steps = append(report.Steps, Step{Name: name, Duration: time.Since(start), Err: err})
+		if err != nil {
+			log.Errorf("Canary step %s failed: %v", name, err)
+		}
+		return err
+	}
+
+	record := endpoint.NewEndpoint(c.Hostname, endpoint.RecordTypeA, Target)
+	if err := step("dns create", func() error {
+		return c.Registry.ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{record}})
+	}); err == nil {
+		step("dns resolve", c.resolve)
+		step("dns delete", func() error {
+			return c.Registry.ApplyChanges(&plan.Changes{Delete: []*endpoint.Endpoint{record}})
+		})
+	}
+
+	if c.Firewall == nil {
+		return report
+	}
+	var rules *inbound.InboundRules
+	err := step("firewall create", func() error {
+		clusterName, err := c.Firewall.GetClusterName()
+		if err != nil {
+			return err
+		}
+		rules = inbound.NewInboundRules()
+		rules.Name = GroupPrefix + clusterName
+		rules.Rules = []inbound.InboundRule{{Protocol: "tcp", Port: 9, Description: "external-ips canary"}}
+		return c.Firewall.ApplyChanges(&fwplan.Changes{Create: []*inbound.InboundRules{rules}})
+	})
+	if err == nil {
+		step("firewall delete", func() error {
+			return c.Firewall.ApplyChanges(&fwplan.Changes{Delete: []*inbound.InboundRules{rules}})
+		})
+	}
+
+	return report
+}
+
+// resolve looks up the canary record until it resolves to its target or the timeout expires.
+func (c *Canary) resolve() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	var lastErr error
+	for {
+		addrs, err := c.Resolver.LookupHost(ctx, c.Hostname)
+		if err == nil {
+			for _, addr := range addrs {
+				if addr == Target {
+					return nil
+				}
+			}
+			err = fmt.Errorf("%s resolves to %v", c.Hostname, addrs)
+		}
+		lastErr = err
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s didn't resolve to %s within %s: %v", c.Hostname, Target, c.Timeout, lastErr)
+		case <-time.After(c.PollInterval):
+		}
+	}
+}
+
+func isPermissionError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && permissionErrorCodes[aerr.Code()]
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package canary
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+// fakeRegistry records the applied changes and fails them with err.
+type fakeRegistry struct {
+	err     error
+	changes []*plan.Changes
+}
+
+func (r *fakeRegistry) Records() ([]*endpoint.Endpoint, error) {
+	return nil, nil
+}
+
+func (r *fakeRegistry) ApplyChanges(changes *plan.Changes) error {
+	r.changes = append(r.changes, changes)
+	return r.err
+}
+
+// fakeFWProvider records the applied changes and fails them with err.
+type fakeFWProvider struct {
+	err     error
+	changes []*fwplan.Changes
+}
+
+func (p *fakeFWProvider) GetClusterName() (string, error) {
+	return "kube.openfresh.io", nil
+}
+
+func (p *fakeFWProvider) Rules() ([]*inbound.InboundRules, error) {
+	return nil, nil
+}
+
+func (p *fakeFWProvider) ApplyChanges(changes *fwplan.Changes) error {
+	p.changes = append(p.changes, changes)
+	return p.err
+}
+
+// fakeResolver resolves every host to addrs.
+type fakeResolver struct {
+	addrs []string
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	return r.addrs, nil
+}
+
+func stepNames(report *Report) []string {
+	names := make([]string, 0, len(report.Steps))
+	for _, s := range report.Steps {
+		names = append(names, s.Name)
+	}
+	return names
+}
+
+func TestCanaryRun(t *testing.T) {
+	r := &fakeRegistry{}
+	p := &fakeFWProvider{}
+	c := &Canary{
+		Registry:     r,
+		Firewall:     p,
+		Resolver:     &fakeResolver{addrs: []string{Target}},
+		Hostname:     "canary.example.org",
+		Timeout:      time.Second,
+		PollInterval: time.Millisecond,
+	}
+
+	report := c.Run()
+	assert.False(t, report.Failed())
+	assert.Equal(t, []string{"dns create", "dns resolve", "dns delete", "firewall create", "firewall delete"}, stepNames(report))
+
+	require.Len(t, r.changes, 2)
+	require.Len(t, r.changes[0].Create, 1)
+	assert.Equal(t, "canary.example.org", r.changes[0].Create[0].DNSName)
+	assert.Equal(t, endpoint.Targets{Target}, r.changes[0].Create[0].Targets)
+	assert.Equal(t, r.changes[0].Create, r.changes[1].Delete)
+
+	require.Len(t, p.changes, 2)
+	require.Len(t, p.changes[0].Create, 1)
+	assert.Equal(t, "external-ips-canary.kube.openfresh.io", p.changes[0].Create[0].Name)
+	assert.Equal(t, p.changes[0].Create, p.changes[1].Delete)
+}
+
+func TestCanaryRunResolveTimeout(t *testing.T) {
+	r := &fakeRegistry{}
+	c := &Canary{
+		Registry:     r,
+		Resolver:     &fakeResolver{addrs: []string{"192.0.2.2"}},
+		Hostname:     "canary.example.org",
+		Timeout:      10 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+
+	report := c.Run()
+	assert.True(t, report.Failed())
+	assert.Equal(t, []string{"dns create", "dns resolve", "dns delete"}, stepNames(report))
+	assert.Error(t, report.Steps[1].Err)
+
+	// the record is deleted even if it didn't resolve
+	require.Len(t, r.changes, 2)
+	assert.Len(t, r.changes[1].Delete, 1)
+}
+
+func TestCanaryRunCreateFailure(t *testing.T) {
+	r := &fakeRegistry{err: errors.New("throttled")}
+	p := &fakeFWProvider{err: awserr.New("UnauthorizedOperation", "You are not authorized to perform this operation.", nil)}
+	c := &Canary{
+		Registry: r,
+		Firewall: p,
+		Resolver: &fakeResolver{},
+		Hostname: "canary.example.org",
+		Timeout:  time.Second,
+	}
+
+	report := c.Run()
+	assert.True(t, report.Failed())
+	assert.Equal(t, []string{"dns create", "firewall create"}, stepNames(report))
+	assert.Len(t, r.changes, 1)
+	assert.Len(t, p.changes, 1)
+
+	var b bytes.Buffer
+	report.Print(&b)
+	assert.Contains(t, b.String(), "FAILED: throttled\n")
+	assert.Contains(t, b.String(), "(permission denied, see `external-ips permissions`)")
+}
@@ -0,0 +1,390 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	"github.com/openfresh/external-ips/backup"
+	"github.com/openfresh/external-ips/canary"
+	"github.com/openfresh/external-ips/controller"
+	"github.com/openfresh/external-ips/diagram"
+	"github.com/openfresh/external-ips/firewall/history"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	"github.com/openfresh/external-ips/pkg/apis/externalips/validation"
+	"github.com/openfresh/external-ips/pkg/operator"
+	"github.com/openfresh/external-ips/preflight"
+)
+
+func main() {
+	cfg := externalips.NewConfig()
+	if err := cfg.ParseFlags(os.Args[1:]); err != nil {
+		log.Fatalf("flag parsing error: %v", err)
+	}
+	if cfg.ListProviders {
+		printProviders()
+		os.Exit(0)
+	}
+	log.Infof("config: %s", cfg)
+
+	if err := validation.ValidateConfig(cfg); err != nil {
+		log.Fatalf("config validation failed: %v", err)
+	}
+
+	if cfg.LogFormat == "json" {
+		log.SetFormatter(&log.JSONFormatter{})
+	}
+	if cfg.DryRun {
+		log.Info("running in dry-run mode. The changes to DNS records, firewall rules and external IPs will be logged but not made.")
+	}
+	if cfg.MonitorOnly {
+		log.Info("running in monitor-only mode. Changes will be recorded as metrics and events but never applied.")
+	}
+
+	ll, err := log.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		log.Fatalf("failed to parse log level: %v", err)
+	}
+	log.SetLevel(ll)
+
+	if cfg.Command == "permissions" {
+		if err := printPermissions(cfg); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	stopChan := make(chan struct{}, 1)
+
+	tlsConfig, err := metricsTLSConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var state *controller.StateRecorder
+	if cfg.DebugState {
+		state = controller.NewStateRecorder()
+	}
+	go serveMetrics(cfg.MetricsAddress, tlsConfig, state)
+	go handleSigterm(stopChan)
+
+	ctrl, err := operator.NewController(
+		operator.WithConfig(cfg),
+		operator.WithStop(stopChan),
+		operator.WithStateRecorder(state),
+	)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	switch cfg.Command {
+	case "firewall-history":
+		if err := printFirewallHistory(ctrl.History, cfg.FirewallHistoryAt); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case "validate":
+		p := preflight.Preflight{
+			Source:   ctrl.Source,
+			Registry: ctrl.Registry,
+			Policy:   ctrl.Policy,
+			Rules:    ctrl.Firewall,
+			Quotas: preflight.Quotas{
+				RecordsPerZone:        cfg.QuotaRecordsPerZone,
+				SecurityGroups:        cfg.QuotaSecurityGroups,
+				RulesPerGroup:         cfg.QuotaRulesPerGroup,
+				ExternalIPsPerService: cfg.QuotaExtIPsPerService,
+			},
+		}
+		if projector, ok := ctrl.DNSProvider.(preflight.RecordProjector); ok {
+			p.Records = projector
+		}
+		if counter, ok := ctrl.Firewall.(preflight.GroupCounter); ok {
+			p.Groups = counter
+		}
+		report, err := p.Run()
+		if err != nil {
+			log.Fatal(err)
+		}
+		report.Print(os.Stdout)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "canary":
+		c := canary.Canary{
+			Registry:     ctrl.Registry,
+			Firewall:     ctrl.Firewall,
+			Resolver:     canary.NewResolver(cfg.CanaryResolver),
+			Hostname:     cfg.CanaryHostname,
+			Timeout:      cfg.CanaryTimeout,
+			PollInterval: 5 * time.Second,
+		}
+		report := c.Run()
+		report.Print(os.Stdout)
+		if report.Failed() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	case "plan":
+		d := diagram.Diagram{
+			Source:   ctrl.Source,
+			Registry: ctrl.Registry,
+			Policy:   ctrl.Policy,
+		}
+		// the subsystems not managed are left out of the diagram
+		if ctrl.FwRegistry != nil {
+			d.Rules = ctrl.FwRegistry
+		}
+		g, err := d.Run()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := g.Render(os.Stdout, cfg.PlanFormat); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	case "export", "import":
+		b := &backup.Backup{
+			Registry: ctrl.Registry,
+			Rules:    ctrl.FwRegistry,
+			ExtIPs:   ctrl.EipRegistry,
+			OwnerID:  cfg.TXTOwnerID,
+		}
+		if cfg.Command == "export" {
+			err = exportSnapshot(b, cfg.SnapshotFile)
+		} else {
+			err = importSnapshot(b, cfg.SnapshotFile)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.Once {
+		if err := ctrl.RunOnce(); err != nil {
+			log.Fatal(err)
+		}
+
+		os.Exit(0)
+	}
+	ctrl.Run(stopChan)
+}
+
+// printPermissions prints the IAM policy required by the configured providers, one
+// per role preceded by the role when the DNS and the firewall roles differ.
+func printPermissions(cfg *externalips.Config) error {
+	roles := operator.Permissions(cfg)
+	for i, r := range roles {
+		policy, err := permissions.NewPolicy(r.Statements...).JSON()
+		if err != nil {
+			return err
+		}
+		if len(roles) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("# %s\n", roleName(r.Role))
+		}
+		fmt.Println(policy)
+	}
+	return nil
+}
+
+// roleName returns the name of the role in the output of printPermissions.
+func roleName(role string) string {
+	if role == "" {
+		return "credentials of the pod"
+	}
+	return role
+}
+
+// printProviders prints the names of the registered providers.
+func printProviders() {
+	fmt.Printf("dns: %s\n", strings.Join(operator.DNSProviders(), ", "))
+	fmt.Printf("firewall: %s\n", strings.Join(operator.FirewallProviders(), ", "))
+	fmt.Printf("extip: %s\n", strings.Join(operator.ExtIPProviders(), ", "))
+}
+
+// printFirewallHistory prints the snapshot of the desired inbound rules in effect at the given time, now if empty.
+func printFirewallHistory(store history.Store, at string) error {
+	t := time.Now()
+	if at != "" {
+		var err error
+		if t, err = time.Parse(time.RFC3339, at); err != nil {
+			return err
+		}
+	}
+
+	snapshot, err := store.At(t)
+	if err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(snapshot, "", " ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(b))
+	return nil
+}
+
+// exportSnapshot writes the snapshot of the managed state to the file, or to the standard output for -.
+func exportSnapshot(b *backup.Backup, file string) error {
+	snapshot, err := b.Export(time.Now())
+	if err != nil {
+		return err
+	}
+	if file == "-" {
+		return backup.Write(os.Stdout, snapshot)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if err := backup.Write(f, snapshot); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// importSnapshot imports the snapshot read from the file, or from the standard input for -, and prints the changes.
+func importSnapshot(b *backup.Backup, file string) error {
+	in := os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	snapshot, err := backup.Read(in)
+	if err != nil {
+		return err
+	}
+	log.Infof("Importing the snapshot of %s taken at %s", snapshot.Owner, snapshot.Time.Format(time.RFC3339))
+	report, err := b.Import(snapshot)
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+	return nil
+}
+
+func handleSigterm(stopChan chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM)
+	<-signals
+	log.Info("Received SIGTERM. Terminating...")
+	close(stopChan)
+}
+
+// metricsTLSConfig returns the TLS configuration of the metrics endpoint, nil to serve it over plain HTTP.
+func metricsTLSConfig(cfg *externalips.Config) (*tls.Config, error) {
+	if !cfg.MetricsTLS {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.TLSClientCert, cfg.TLSClientCertKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the metrics certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	// only the clients with a certificate signed by the CA may scrape the metrics, the
+	// certificate is only verified if given for the health check to remain reachable
+	if cfg.TLSCA != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the metrics client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.TLSCA)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+func serveMetrics(address string, tlsConfig *tls.Config, state *controller.StateRecorder) {
+	server := &http.Server{
+		Addr:      address,
+		Handler:   metricsHandler(tlsConfig, state),
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		// the certificate is already loaded in the TLS configuration
+		log.Fatal(server.ListenAndServeTLS("", ""))
+	}
+	log.Fatal(server.ListenAndServe())
+}
+
+// metricsHandler returns the handler of the metrics endpoint. The metrics and the state
+// require a client certificate when the TLS configuration verifies them, not the health check.
+func metricsHandler(tlsConfig *tls.Config, state *controller.StateRecorder) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	mux.Handle("/metrics", requireClientCert(tlsConfig, promhttp.Handler()))
+	if state != nil {
+		mux.Handle("/debug/state", requireClientCert(tlsConfig, state))
+	}
+	return mux
+}
+
+// requireClientCert rejects the requests without a verified client certificate when the
+// TLS configuration has client CAs, the certificates given being verified by the handshake.
+func requireClientCert(tlsConfig *tls.Config, h http.Handler) http.Handler {
+	if tlsConfig == nil || tlsConfig.ClientCAs == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			http.Error(w, "a client certificate signed by --tls-ca is required", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,148 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+// testCert is a certificate and its key, signed by the parent if any.
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestMetricsTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "metrics-tls")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, ioutil.WriteFile(path, data, 0600))
+		return path
+	}
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "external-ips", ca)
+	client := newTestCert(t, "prometheus", ca)
+
+	cfg := externalips.NewConfig()
+	config, err := metricsTLSConfig(cfg)
+	require.NoError(t, err)
+	assert.Nil(t, config)
+
+	cfg.MetricsTLS = true
+	cfg.TLSClientCert = write("tls.crt", server.certPEM)
+	cfg.TLSClientCertKey = write("tls.key", server.keyPEM)
+	config, err = metricsTLSConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+
+	cfg.TLSCA = write("ca.crt", []byte("not a certificate"))
+	_, err = metricsTLSConfig(cfg)
+	assert.Error(t, err)
+
+	cfg.TLSCA = write("ca.crt", ca.certPEM)
+	config, err = metricsTLSConfig(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, tls.VerifyClientCertIfGiven, config.ClientAuth)
+
+	ts := httptest.NewUnstartedServer(metricsHandler(config, nil))
+	ts.TLS = config
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(path string, cert *testCert) (int, error) {
+		config := &tls.Config{RootCAs: roots}
+		// the certificate is sent whatever the CAs accepted by the server
+		config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			if cert == nil {
+				return &tls.Certificate{}, nil
+			}
+			c, err := tls.X509KeyPair(cert.certPEM, cert.keyPEM)
+			return &c, err
+		}
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+		resp, err := c.Get(ts.URL + path)
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		return resp.StatusCode, nil
+	}
+
+	// the health check doesn't require a client certificate, the metrics do
+	status, err := get("/healthz", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+	status, err = get("/metrics", nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, err = get("/metrics", client)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, status)
+
+	// a certificate signed by another CA fails the handshake
+	other := newTestCert(t, "other", newTestCert(t, "other-ca", nil))
+	_, err = get("/healthz", other)
+	assert.Error(t, err)
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"time"
+)
+
+// breaker pauses a subsystem after a number of consecutive failures, so that
+// a consistently failing provider is not hammered on every synchronization.
+type breaker struct {
+	// the number of consecutive failures opening the breaker, 0 disables it
+	threshold int
+	// how long the breaker stays open
+	pause time.Duration
+
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns whether the subsystem may be synchronized at the given time.
+func (b *breaker) allow(now time.Time) bool {
+	return !now.Before(b.openUntil)
+}
+
+// success resets the count of consecutive failures.
+func (b *breaker) success() {
+	b.failures = 0
+}
+
+// failure records a failure and returns true if it opened the breaker.
+func (b *breaker) failure(now time.Time) bool {
+	b.failures++
+	if b.threshold <= 0 || b.failures < b.threshold {
+		return false
+	}
+	b.failures = 0
+	b.openUntil = now.Add(b.pause)
+	return true
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := &breaker{threshold: 2, pause: time.Minute}
+
+	assert.True(t, b.allow(now))
+	assert.False(t, b.failure(now))
+	assert.True(t, b.allow(now))
+
+	// a success in between resets the count
+	b.success()
+	assert.False(t, b.failure(now))
+	assert.True(t, b.failure(now))
+	assert.False(t, b.allow(now))
+	assert.False(t, b.allow(now.Add(30*time.Second)))
+	assert.True(t, b.allow(now.Add(time.Minute)))
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	now := time.Now()
+	b := &breaker{}
+
+	for i := 0; i < 10; i++ {
+		assert.False(t, b.failure(now))
+	}
+	assert.True(t, b.allow(now))
+}
@@ -20,107 +20,647 @@ limitations under the License.
 package controller
 
 import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
 	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/dns/verify"
 	eipplan "github.com/openfresh/external-ips/extip/plan"
 	eipregistry "github.com/openfresh/external-ips/extip/registry"
 	fwplan "github.com/openfresh/external-ips/firewall/plan"
 	fwregistry "github.com/openfresh/external-ips/firewall/registry"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/notify"
+	"github.com/openfresh/external-ips/setting"
 	"github.com/openfresh/external-ips/source"
+	"github.com/openfresh/external-ips/trace"
+)
+
+var (
+	syncDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "external_ips",
+			Subsystem: "controller",
+			Name:      "sync_duration_seconds",
+			Help:      "Duration of the steps of a synchronization by subsystem.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"subsystem", "operation"},
+	)
+	syncFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "controller",
+			Name:      "sync_failures_total",
+			Help:      "Number of failed synchronizations, including panics, by subsystem.",
+		},
+		[]string{"subsystem"},
+	)
+	appliedChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "controller",
+			Name:      "applied_changes_total",
+			Help:      "Number of applied DNS record changes, including the ones applied before a partial failure, by subsystem.",
+		},
+		[]string{"subsystem"},
+	)
+	stalePlans = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "controller",
+			Name:      "stale_plans_total",
+			Help:      "Number of plans rejected by the DNS provider as the records changed since they were read, by subsystem.",
+		},
+		[]string{"subsystem"},
+	)
 )
 
+func init() {
+	prometheus.MustRegister(syncDuration)
+	prometheus.MustRegister(syncFailures)
+	prometheus.MustRegister(appliedChanges)
+	prometheus.MustRegister(stalePlans)
+}
+
+// observeSince records the time elapsed since start for the given step.
+func observeSince(subsystem, operation string, start time.Time) {
+	syncDuration.WithLabelValues(subsystem, operation).Observe(time.Since(start).Seconds())
+}
+
 // Controller is responsible for orchestrating the different components.
 // It works in the following way:
-// * Ask the DNS provider for current list of endpoints.
-// * Ask the Source for the desired list of endpoints.
-// * Take both lists and calculate a Plan to move current towards desired state.
-// * Tell the DNS provider to apply the changes calucated by the Plan.
+// * Ask the Source for the desired state of the exposed services.
+// * For each of the external IPs, firewall, DNS and optional internal DNS subsystems, ask the registry for the current state.
+// * Take both and calculate a Plan to move current towards desired state.
+// * Tell the registry to apply the changes calucated by the Plan, unless MonitorOnly or DryRun is set.
+// A subsystem failing FailureThreshold times in a row is paused for FailurePause
+// while the others keep synchronizing, and a zone or a security group failing with
+// the same error StuckThreshold times in a row is left out for StuckPause while the
+// others keep being applied. The subsystems don't depend on the changes
+// of each other, so that with Concurrent set they are synchronized in parallel,
+// which requires their registries and providers to be safe for concurrent use.
 type Controller struct {
-	Source      source.Source
-	Registry    registry.Registry
-	FwRegistry  *fwregistry.Registry
+	Source source.Source
+	// The registry of the records, nil disables the dns and internal-dns subsystems
+	Registry registry.Registry
+	// The registry publishing records on the internal IPs of the nodes, nil disables them
+	InternalRegistry registry.Registry
+	// The registry of the security groups, nil disables the firewall subsystem
+	FwRegistry *fwregistry.Registry
+	// The registry of the external IPs of the services, nil disables the extip subsystem
 	EipRegistry *eipregistry.Registry
+	// The node cache shared by the source and the firewall provider, refreshed once per synchronization
+	Nodes *node.Cache
+	// Returns the reason of the exclusion of the nodes never exposed by providerID, the
+	// security groups are never assigned to them; nil excludes none
+	ExcludedNodes func() (map[string]string, error)
 	// The policy that defines which changes to DNS records are allowed
 	Policy plan.Policy
 	// The interval between individual synchronizations
 	Interval time.Duration
+	// Triggers a synchronization before the next interval
+	Resync <-chan struct{}
+	// Receives the namespace/name of the services to synchronize on their own
+	Priority <-chan string
+	// The number of consecutive failures after which a subsystem is paused, 0 never pauses
+	FailureThreshold int
+	// How long a failing subsystem is paused
+	FailurePause time.Duration
+	// The number of consecutive identical failures of a zone or a security group after which its changes are backed off, 0 never backs off
+	StuckThreshold int
+	// How long the changes of a stuck zone or security group are backed off
+	StuckPause time.Duration
+	// How long records whose targets are entirely replaced keep their old targets, 0 replaces them at once
+	CutoverDelay time.Duration
+	// The interval between two garbage collections of the orphaned security groups, 0 disables them
+	FirewallGCInterval time.Duration
+	// How long an orphaned security group is kept before being deleted
+	FirewallGCGracePeriod time.Duration
+	// Restores the ownership of the records desired by a resource which lost it, e.g. as their TXT record was deleted
+	RepairOwnership bool
+	// Reads the records again and plans the changes once more when the provider rejects them as the records changed since they were read
+	ReplanStale bool
+	// Synchronizes the subsystems in parallel rather than one after the other
+	Concurrent bool
+	// Computes the changes without applying them
+	MonitorOnly bool
+	// Logs the changes the registries would send to the providers without applying them
+	DryRun bool
+	// Checks that the applied records end up served by their name servers, nil disables it
+	Verifier *verify.Verifier
+	// Records the changes planned in monitor-only mode and the records failing verification as events on their service, may be nil
+	Events record.EventRecorder
+	// Records the state and the plans of the full synchronizations for debugging, nil disables it
+	State *StateRecorder
+	// Notifies the applied changes, the large plans and the paused subsystems, nil disables it
+	Notifier notify.Notifier
+	// The number of changes from which a plan is notified before being applied, 0 disables it
+	LargePlan int
+	// Traces the synchronizations down to the provider calls, nil disables it
+	Tracer *trace.Tracer
+
+	breakersMu sync.Mutex
+	breakers   map[string]*breaker
+	stuck      *stuckTracker
+	deleted    *deletionTracker
+	// the in-progress cutovers by subsystem and record
+	transitionsMu sync.Mutex
+	transitions   map[string]map[string]*transition
+	// the time of the last garbage collection and since when the security groups are orphaned
+	lastGC  time.Time
+	orphans map[string]time.Time
+	// the earliest deadline of the services exposed for a limited time, found by the last full synchronization
+	nextExpiry time.Time
+	// the spans of the synchronization being traced and of its subsystems
+	spansMu sync.Mutex
+	root    *trace.Span
+	spans   map[string]*trace.Span
+}
+
+// subsystem is a part of the synchronization which can fail independently.
+type subsystem struct {
+	name string
+	sync func(*setting.ExternalIPSetting) error
 }
 
 // RunOnce runs a single iteration of a reconciliation loop.
-func (c *Controller) RunOnce() error {
-	records, err := c.Registry.Records()
+func (c *Controller) RunOnce() (err error) {
+	c.startTrace("sync")
+	defer func() { c.endTrace(err) }()
+
+	if c.Nodes != nil {
+		if err := c.Nodes.Refresh(); err != nil {
+			return err
+		}
+	}
+
+	var setting *setting.ExternalIPSetting
+	err = c.safely("source", func() error {
+		var err error
+		start := time.Now()
+		setting, err = c.Source.ExternalIPSetting()
+		c.observe("source", "extract", start, err)
+		return err
+	})
 	if err != nil {
 		return err
 	}
+	c.nextExpiry = setting.NextExpiry
+	c.State.desired(setting, time.Now())
 
-	rules, err := c.FwRegistry.Rules()
-	if err != nil {
+	if err := c.syncAll(setting, nil); err != nil {
 		return err
 	}
+	return c.finalize(setting)
+}
 
-	extips, err := c.EipRegistry.ExtIPs()
+// syncAll synchronizes every subsystem, limited to the given scope if not nil.
+func (c *Controller) syncAll(desired *setting.ExternalIPSetting, scope *serviceScope) error {
+	// the disabled subsystems are neither read nor planned
+	var subsystems []subsystem
+	if c.EipRegistry != nil {
+		subsystems = append(subsystems, subsystem{"extip", func(s *setting.ExternalIPSetting) error { return c.syncExtIPs(s, scope) }})
+	}
+	if c.FwRegistry != nil {
+		subsystems = append(subsystems, subsystem{"firewall", func(s *setting.ExternalIPSetting) error { return c.syncFirewall(s, scope) }})
+	}
+	if c.Registry != nil {
+		subsystems = append(subsystems, subsystem{"dns", func(s *setting.ExternalIPSetting) error { return c.syncDNS(s, scope) }})
+		if c.InternalRegistry != nil {
+			subsystems = append(subsystems, subsystem{"internal-dns", func(s *setting.ExternalIPSetting) error { return c.syncInternalDNS(s, scope) }})
+		}
+	}
+
+	results := make([]error, len(subsystems))
+	if c.Concurrent {
+		var wg sync.WaitGroup
+		for i, s := range subsystems {
+			wg.Add(1)
+			go func(i int, s subsystem) {
+				defer wg.Done()
+				results[i] = c.syncSubsystem(s, desired)
+			}(i, s)
+		}
+		wg.Wait()
+	} else {
+		for i, s := range subsystems {
+			results[i] = c.syncSubsystem(s, desired)
+		}
+	}
+
+	var errs []string
+	for _, err := range results {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// syncSubsystem synchronizes a single subsystem unless its breaker is open.
+func (c *Controller) syncSubsystem(s subsystem, setting *setting.ExternalIPSetting) error {
+	b := c.breaker(s.name)
+	now := time.Now()
+	if !b.allow(now) {
+		log.Warnf("Skipping %s synchronization, paused after consecutive failures until %s", s.name, b.openUntil.Format(time.RFC3339))
+		return nil
+	}
+
+	c.startSubsystem(s.name)
+	err := c.safely(s.name, func() error {
+		return s.sync(setting)
+	})
+	c.endSubsystem(s.name, err)
 	if err != nil {
-		return err
+		if b.failure(now) {
+			log.Errorf("Pausing %s synchronization for %s after %d consecutive failures", s.name, c.FailurePause, c.FailureThreshold)
+			c.notifyFailing(s.name, err)
+		}
+		return fmt.Errorf("%s: %v", s.name, err)
+	}
+	b.success()
+
+	return nil
+}
+
+// safely runs f, turning a panic into an error, and counts the failures of the subsystem.
+func (c *Controller) safely(name string, f func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorf("Recovered from panic in %s synchronization: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			syncFailures.WithLabelValues(name).Inc()
+		}
+	}()
+
+	return f()
+}
+
+// paused returns the name of a subsystem whose synchronization is paused, empty if none.
+func (c *Controller) paused(now time.Time) string {
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+
+	for name, b := range c.breakers {
+		if !b.allow(now) {
+			return name
+		}
 	}
+	return ""
+}
+
+// breaker returns the breaker of the given subsystem, creating it if needed.
+func (c *Controller) breaker(name string) *breaker {
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
 
-	setting, err := c.Source.ExternalIPSetting()
+	if c.breakers == nil {
+		c.breakers = map[string]*breaker{}
+	}
+	b, ok := c.breakers[name]
+	if !ok {
+		b = &breaker{threshold: c.FailureThreshold, pause: c.FailurePause}
+		c.breakers[name] = b
+	}
+	return b
+}
+
+// tracker returns the tracker of the stuck zones and security groups, creating it if needed.
+func (c *Controller) tracker() *stuckTracker {
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+
+	if c.stuck == nil {
+		c.stuck = &stuckTracker{threshold: c.StuckThreshold, pause: c.StuckPause}
+	}
+	return c.stuck
+}
+
+// finalize manages the finalizer of the services once every subsystem is in sync,
+// so that a deleted service is only released after its records and inbound rules
+// are removed.
+func (c *Controller) finalize(setting *setting.ExternalIPSetting) error {
+	if c.MonitorOnly || c.DryRun || c.EipRegistry == nil {
+		return nil
+	}
+	// a paused subsystem may still hold the records or rules of a deleted service
+	if paused := c.paused(time.Now()); paused != "" {
+		log.Debugf("Not releasing the deleted services while the %s synchronization is paused", paused)
+		return nil
+	}
+	return c.safely("extip", func() error {
+		start := time.Now()
+		err := c.EipRegistry.Finalize(setting.ExtIPs)
+		c.observe("extip", "finalize", start, err)
+		return err
+	})
+}
+
+func (c *Controller) syncExtIPs(setting *setting.ExternalIPSetting, scope *serviceScope) error {
+	start := time.Now()
+	extips, err := c.EipRegistry.ExtIPs()
+	c.observe("extip", "extips", start, err)
 	if err != nil {
 		return err
 	}
 
 	eipplan := &eipplan.Plan{
-		Current: extips,
+		Current: scope.extIPs(extips),
 		Desired: setting.ExtIPs,
 	}
 
+	start = time.Now()
 	eipplan = eipplan.Calculate()
+	c.observe("extip", "plan", start, nil)
+	if scope == nil {
+		c.State.planned("extip", extips, eipplan.Changes, time.Now())
+	}
+	if !c.planned("extip", scope, extIPChanges(eipplan.Changes)) {
+		return nil
+	}
+	// the registry applies the changes as they are
+	if c.DryRun {
+		c.dryRun("extip", extIPChanges(eipplan.Changes))
+		return nil
+	}
+
+	changes, skipped := eipplan.Changes.Split(dryRunExtIPs(setting.ExtIPs))
+	c.dryRunServices("extip", extIPChanges(skipped))
 
-	err = c.EipRegistry.ApplyChanges(eipplan.Changes)
+	start = time.Now()
+	err = c.EipRegistry.ApplyChanges(changes)
+	c.observe("extip", "apply", start, err)
+	if err == nil {
+		c.notifyChanges(notify.KindApplied, "extip", extIPChanges(changes))
+	}
+	return err
+}
+
+func (c *Controller) syncFirewall(setting *setting.ExternalIPSetting, scope *serviceScope) error {
+	start := time.Now()
+	rules, err := c.FwRegistry.Rules()
+	c.observe("firewall", "rules", start, err)
 	if err != nil {
 		return err
 	}
 
+	var vanished map[string]knownResource
+	if scope == nil {
+		vanished = c.deletions().observe("firewall", groupNames(rules), start)
+	}
+
+	// the security groups are named after their current name, e.g. the name they were
+	// given before the firewall name template changed
+	// the rules of the protocols the provider doesn't support are left out, not to fail their security group
+	desired := fwplan.AdoptCurrentNames(rules, c.supportedRules(setting.InboundRules, c.FwRegistry.Protocols()))
+
+	// the nodes excluded from the exposure are never assigned a security group, even if desired
+	var excluded map[string]string
+	if c.ExcludedNodes != nil {
+		excluded, err = c.ExcludedNodes()
+		if err != nil {
+			return err
+		}
+	}
+
 	fwplan := &fwplan.Plan{
-		Current: rules,
-		Desired: setting.InboundRules,
+		Current:  scope.rules(rules, desired),
+		Desired:  desired,
+		Excluded: excluded,
 	}
 
+	start = time.Now()
 	fwplan = fwplan.Calculate()
+	c.observe("firewall", "plan", start, nil)
+	if scope == nil {
+		c.State.planned("firewall", rules, fwplan.Changes, time.Now())
+	}
+	if !c.planned("firewall", scope, ruleChanges(fwplan.Changes)) {
+		return nil
+	}
+	// the registry applies the changes as they are
+	if c.DryRun {
+		c.dryRun("firewall", ruleChanges(fwplan.Changes))
+		return nil
+	}
+
+	changes, skipped := fwplan.Changes.Split(dryRunRules(desired))
+	c.dryRunServices("firewall", ruleChanges(skipped))
+
+	// the changes of the stuck security groups are left out until they are retried
+	tracker := c.tracker()
+	changes, held := changes.Split(tracker.stuckRules("firewall", start))
+	if n := len(ruleChanges(held)); n > 0 {
+		log.Debugf("Holding back %d firewall changes of stuck security groups", n)
+	}
+
+	start = time.Now()
+	c.recreatedGroups(vanished, changes.Create, start)
+	err = c.FwRegistry.ApplyChanges(changes)
+	c.observe("firewall", "apply", start, err)
+	if failed, ok := groupErrors(err); ok && scope == nil {
+		tracker.logStuck("firewall", tracker.record("firewall", failed, start))
+	}
+	// the security groups of a failed apply are known again once found
+	if err == nil && scope == nil {
+		var deleted []string
+		for _, r := range changes.Delete {
+			deleted = append(deleted, r.Name)
+		}
+		c.deletions().applied("firewall", groupNames(changes.Create), deleted, start)
+	}
+	if err == nil {
+		c.notifyChanges(notify.KindApplied, "firewall", ruleChanges(changes))
+	}
+	if err != nil || scope != nil {
+		return err
+	}
+	// the history is only for audits, failing to record it doesn't fail the synchronization
+	if err := c.FwRegistry.Record(desired, time.Now()); err != nil {
+		log.Warnf("Failed to record the firewall history: %v", err)
+	}
+	// the listeners are only synchronized once the security groups let their traffic in
+	start = time.Now()
+	err = c.FwRegistry.Accelerate(desired)
+	c.observe("firewall", "accelerate", start, err)
+	if err != nil {
+		return err
+	}
+	return c.collectGarbage(desired, time.Now())
+}
+
+func (c *Controller) syncDNS(setting *setting.ExternalIPSetting, scope *serviceScope) error {
+	return c.syncRecords("dns", c.Registry, setting.Endpoints, scope)
+}
 
-	err = c.FwRegistry.ApplyChanges(fwplan.Changes)
+func (c *Controller) syncInternalDNS(setting *setting.ExternalIPSetting, scope *serviceScope) error {
+	return c.syncRecords("internal-dns", c.InternalRegistry, setting.InternalEndpoints, scope)
+}
+
+// syncRecords plans and applies the changes bringing the records of the registry to the desired endpoints.
+// The changes rejected as planned from stale records are planned once more if ReplanStale is set.
+func (c *Controller) syncRecords(subsystem string, r registry.Registry, desired []*endpoint.Endpoint, scope *serviceScope) error {
+	err := c.applyRecords(subsystem, r, desired, scope)
+	if provider.IsStale(err) {
+		stalePlans.WithLabelValues(subsystem).Inc()
+		if c.ReplanStale {
+			log.Warnf("The %s records changed since they were read, planning the changes again: %v", subsystem, err)
+			err = c.applyRecords(subsystem, r, desired, scope)
+		}
+	}
+	return err
+}
+
+// applyRecords plans and applies the changes once.
+func (c *Controller) applyRecords(subsystem string, r registry.Registry, desired []*endpoint.Endpoint, scope *serviceScope) error {
+	start := time.Now()
+	records, err := r.Records()
+	c.observe(subsystem, "records", start, err)
 	if err != nil {
 		return err
 	}
+	var vanished map[string]knownResource
+	if scope == nil {
+		c.repairOwnership(subsystem, r, records, desired)
+		vanished = c.deletions().observe(subsystem, recordZones(records), start)
+	}
+	records = scope.records(records, desired)
+	desired = scope.endpoints(desired)
 
 	plan := &plan.Plan{
 		Policies: []plan.Policy{c.Policy},
 		Current:  records,
-		Desired:  setting.Endpoints,
+		Desired:  c.cutover(subsystem, records, desired, time.Now(), scope != nil),
 	}
 
+	start = time.Now()
 	plan = plan.Calculate()
+	c.observe(subsystem, "plan", start, nil)
+	if scope == nil {
+		c.State.planned(subsystem, records, plan.Changes, time.Now())
+	}
+	if !c.planned(subsystem, scope, recordChanges(plan.Changes)) {
+		return nil
+	}
+	if c.DryRun {
+		c.dryRun(subsystem, recordChanges(providerChanges(r, plan.Changes)))
+		return nil
+	}
+
+	changes, skipped := plan.Changes.Split(dryRunRecords(desired))
+	c.dryRunServices(subsystem, recordChanges(providerChanges(r, skipped)))
+
+	// the changes of the stuck zones are left out until they are retried
+	tracker := c.tracker()
+	changes, held := changes.Split(tracker.stuckRecords(subsystem, start))
+	if n := len(recordChanges(held)); n > 0 {
+		log.Debugf("Holding back %d %s changes of stuck zones", n, subsystem)
+	}
+
+	start = time.Now()
+	c.recreatedRecords(subsystem, vanished, changes.Create, start)
+	err = r.ApplyChanges(changes)
+	c.observe(subsystem, "apply", start, err)
+	if failed, ok := zoneErrors(err); ok && scope == nil {
+		tracker.logStuck(subsystem, tracker.record(subsystem, failed, start))
+	}
+	if scope == nil {
+		created, deleted := appliedRecords(applied(changes, err))
+		c.deletions().applied(subsystem, created, deleted, start)
+	}
+	countApplied(subsystem, changes, err)
+	if done := applied(changes, err); done != nil {
+		c.notifyChanges(notify.KindApplied, subsystem, recordChanges(done))
+	}
+	// the internal records may be published in zones not resolvable from here
+	if subsystem == "dns" {
+		c.verify(applied(changes, err))
+	}
+	return err
+}
 
-	return c.Registry.ApplyChanges(plan.Changes)
+// applied returns the record changes applied by ApplyChanges, which may be some
+// of them only when it returns a partial error, or nil if none was.
+func applied(changes *plan.Changes, err error) *plan.Changes {
+	if perr, ok := err.(*plan.PartialError); ok && perr.Applied != nil {
+		return perr.Applied
+	} else if err != nil {
+		return nil
+	}
+	return changes
+}
+
+// countApplied counts the record changes applied by ApplyChanges.
+func countApplied(subsystem string, changes *plan.Changes, err error) {
+	if changes = applied(changes, err); changes == nil {
+		return
+	}
+	appliedChanges.WithLabelValues(subsystem).Add(float64(len(changes.Create) + len(changes.UpdateNew) + len(changes.Delete)))
 }
 
 // Run runs RunOnce in a loop with a delay until stopChan receives a value.
+// The services received from Priority are synchronized on their own in between.
 func (c *Controller) Run(stopChan <-chan struct{}) {
 	ticker := time.NewTicker(c.Interval)
 	defer ticker.Stop()
 	for {
-		err := c.RunOnce()
+		err := c.safely("controller", c.RunOnce)
 		if err != nil {
 			log.Error(err)
 		}
-		select {
-		case <-ticker.C:
-		case <-stopChan:
+		if !c.wait(ticker.C, stopChan) {
 			log.Info("Terminating main controller loop")
 			return
 		}
 	}
 }
+
+// wait synchronizes the priority services until the next full synchronization is due,
+// at the latest when a service exposed for a limited time expires.
+// It returns false when stopChan receives a value.
+func (c *Controller) wait(tick <-chan time.Time, stopChan <-chan struct{}) bool {
+	var expiry <-chan time.Time
+	if !c.nextExpiry.IsZero() {
+		timer := time.NewTimer(time.Until(c.nextExpiry))
+		defer timer.Stop()
+		expiry = timer.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			return true
+		case <-expiry:
+			return true
+		case <-c.Resync:
+			return true
+		case key := <-c.Priority:
+			err := c.safely("controller", func() error {
+				return c.RunService(key)
+			})
+			if err != nil {
+				log.Error(err)
+			}
+		case <-stopChan:
+			return false
+		}
+	}
+}
@@ -20,11 +20,16 @@ limitations under the License.
 package controller
 
 import (
+	"bytes"
 	"errors"
 	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/firewall/inbound"
+	"os"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
@@ -39,8 +44,12 @@ import (
 	"github.com/openfresh/external-ips/internal/testutils"
 	"github.com/openfresh/external-ips/setting"
 
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/tools/record"
 )
 
 // mockProvider returns mock endpoints and validates changes.
@@ -185,6 +194,7 @@ func newMockFWProvider(rules []*inbound.InboundRules, changes *fwplan.Changes) f
 type mockEipProvider struct {
 	ExtIPsStore   []*extip.ExtIP
 	ExpectChanges *eipplan.Changes
+	Finalized     [][]*extip.ExtIP
 }
 
 // Records returns the desired mock endpoints.
@@ -194,6 +204,29 @@ func (p *mockEipProvider) ExtIPs() ([]*extip.ExtIP, error) {
 
 // ApplyChanges validates that the passed in changes satisfy the assumtions.
 func (p *mockEipProvider) ApplyChanges(changes *eipplan.Changes) error {
+	if len(changes.Create) != len(p.ExpectChanges.Create) {
+		return errors.New("number of created eips is wrong")
+	}
+	sort.Sort(extip.BySvcName(changes.Create))
+	sort.Sort(extip.BySvcName(p.ExpectChanges.Create))
+	for i := range changes.Create {
+		if changes.Create[i].SvcName != p.ExpectChanges.Create[i].SvcName ||
+			!changes.Create[i].ExtIPs.Same(p.ExpectChanges.Create[i].ExtIPs) {
+			return errors.New("created eips is wrong")
+		}
+	}
+
+	if len(changes.Delete) != len(p.ExpectChanges.Delete) {
+		return errors.New("number of deleted eips is wrong")
+	}
+	sort.Sort(extip.BySvcName(changes.Delete))
+	sort.Sort(extip.BySvcName(p.ExpectChanges.Delete))
+	for i := range changes.Delete {
+		if changes.Delete[i].SvcName != p.ExpectChanges.Delete[i].SvcName {
+			return errors.New("deleted eips is wrong")
+		}
+	}
+
 	sort.Sort(extip.BySvcName(changes.UpdateNew))
 	sort.Sort(extip.BySvcName(p.ExpectChanges.UpdateNew))
 	for i := range changes.UpdateNew {
@@ -215,6 +248,12 @@ func (p *mockEipProvider) ApplyChanges(changes *eipplan.Changes) error {
 	return nil
 }
 
+// Finalize records the managed external IPs it is called with.
+func (p *mockEipProvider) Finalize(managed []*extip.ExtIP) error {
+	p.Finalized = append(p.Finalized, managed)
+	return nil
+}
+
 // newMockProvider creates a new mockProvider returning the given endpoints and validating the desired changes.
 func newMockEipProvider(extips []*extip.ExtIP, changes *eipplan.Changes) eipprovider.Provider {
 	eipProvider := &mockEipProvider{
@@ -225,6 +264,25 @@ func newMockEipProvider(extips []*extip.ExtIP, changes *eipplan.Changes) eipprov
 	return eipProvider
 }
 
+// syncSteps are the subsystem and operation of every timed step of a synchronization.
+var syncSteps = [][2]string{
+	{"dns", "records"},
+	{"dns", "apply"},
+	{"firewall", "rules"},
+	{"firewall", "apply"},
+	{"extip", "extips"},
+	{"extip", "apply"},
+	{"extip", "finalize"},
+	{"source", "extract"},
+}
+
+// sampleCount returns the number of observations of the given step.
+func sampleCount(t *testing.T, step [2]string) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, syncDuration.WithLabelValues(step[0], step[1]).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
 // TestRunOnce tests that RunOnce correctly orchestrates the different components.
 func TestRunOnce(t *testing.T) {
 	// Fake some desired endpoints coming from our source.
@@ -257,6 +315,10 @@ func TestRunOnce(t *testing.T) {
 			},
 		},
 		ExtIPs: []*extip.ExtIP{
+			{
+				SvcName: "create-svc",
+				ExtIPs:  endpoint.Targets{"1.2.3.4"},
+			},
 			{
 				SvcName: "update-svc",
 				ExtIPs:  endpoint.Targets{"3.2.5.4"},
@@ -359,22 +421,36 @@ func TestRunOnce(t *testing.T) {
 
 	eipprovider := newMockEipProvider(
 		[]*extip.ExtIP{
+			{
+				SvcName: "create-svc",
+				ExtIPs:  endpoint.Targets{"1.1.1.1"},
+			},
 			{
 				SvcName: "update-svc",
 				ExtIPs:  endpoint.Targets{"8.8.8.8"},
+				Managed: true,
 			},
 			{
 				SvcName: "delete-svc",
 				ExtIPs:  endpoint.Targets{"4.3.2.1"},
+				Managed: true,
+			},
+			{
+				SvcName: "unmanaged-svc",
+				ExtIPs:  endpoint.Targets{"5.6.7.8"},
 			},
 		},
 		&eipplan.Changes{
+			Create: []*extip.ExtIP{
+				{SvcName: "create-svc", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+			},
 			UpdateNew: []*extip.ExtIP{
 				{SvcName: "update-svc", ExtIPs: endpoint.Targets{"3.2.5.4"}},
-				{SvcName: "delete-svc", ExtIPs: endpoint.Targets{}},
 			},
 			UpdateOld: []*extip.ExtIP{
 				{SvcName: "update-svc", ExtIPs: endpoint.Targets{"8.8.8.8"}},
+			},
+			Delete: []*extip.ExtIP{
 				{SvcName: "delete-svc", ExtIPs: endpoint.Targets{"4.3.2.1"}},
 			},
 		},
@@ -383,7 +459,7 @@ func TestRunOnce(t *testing.T) {
 	r, err := registry.NewNoopRegistry(provider)
 	require.NoError(t, err)
 
-	fwr, err := fwregistry.NewRegistry(fwprovider)
+	fwr, err := fwregistry.NewRegistry(fwprovider, 0)
 	require.NoError(t, err)
 
 	eipr, err := eipregistry.NewRegistry(eipprovider)
@@ -397,8 +473,656 @@ func TestRunOnce(t *testing.T) {
 		Policy:      &plan.SyncPolicy{},
 	}
 
+	before := map[[2]string]uint64{}
+	for _, step := range syncSteps {
+		before[step] = sampleCount(t, step)
+	}
+
 	assert.NoError(t, ctrl.RunOnce())
 
 	// Validate that the mock source was called.
 	source.AssertExpectations(t)
+
+	// Validate that every step of the synchronization was timed.
+	for _, step := range syncSteps {
+		assert.Equal(t, before[step]+1, sampleCount(t, step), "%s %s", step[0], step[1])
+	}
+}
+
+// panicFWProvider panics when the rules are requested.
+type panicFWProvider struct {
+	calls int
+}
+
+func (p *panicFWProvider) GetClusterName() (string, error) {
+	return "kube.openfresh.io", nil
+}
+
+func (p *panicFWProvider) Rules() ([]*inbound.InboundRules, error) {
+	p.calls++
+	panic("boom")
+}
+
+func (p *panicFWProvider) ApplyChanges(changes *fwplan.Changes) error {
+	return nil
+}
+
+// countingProvider counts the calls to ApplyChanges.
+type countingProvider struct {
+	applied int
+}
+
+func (p *countingProvider) Records() ([]*endpoint.Endpoint, error) {
+	return nil, nil
+}
+
+func (p *countingProvider) ApplyChanges(changes *plan.Changes) error {
+	p.applied++
+	return nil
+}
+
+// TestRunOnceIsolatesFailingSubsystem tests that a panicking subsystem is recovered,
+// paused after consecutive failures and doesn't prevent the others from syncing.
+func TestRunOnceIsolatesFailingSubsystem(t *testing.T) {
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{}, nil)
+
+	dnsProvider := &countingProvider{}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	fwProvider := &panicFWProvider{}
+	fwr, err := fwregistry.NewRegistry(fwProvider, 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{}))
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:           source,
+		Registry:         r,
+		FwRegistry:       fwr,
+		EipRegistry:      eipr,
+		Policy:           &plan.SyncPolicy{},
+		FailureThreshold: 1,
+		FailurePause:     time.Hour,
+	}
+
+	err = ctrl.RunOnce()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "firewall: panic: boom")
+	assert.Equal(t, 1, fwProvider.calls)
+	assert.Equal(t, 1, dnsProvider.applied)
+
+	// the firewall is paused while the other subsystems keep syncing
+	require.NoError(t, ctrl.RunOnce())
+	assert.Equal(t, 1, fwProvider.calls)
+	assert.Equal(t, 2, dnsProvider.applied)
+}
+
+// TestRunOnceDisabledSubsystems tests that the subsystems without a registry are skipped.
+func TestRunOnceDisabledSubsystems(t *testing.T) {
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			{DNSName: "create-record", Targets: endpoint.Targets{"8.8.8.8"}},
+		},
+	}, nil)
+
+	dnsProvider := &countingProvider{}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	// the internal records are disabled along with the dns subsystem
+	internalProvider := &countingProvider{}
+	ir, err := registry.NewNoopRegistry(internalProvider)
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:   source,
+		Registry: r,
+		Policy:   &plan.SyncPolicy{},
+	}
+	require.NoError(t, ctrl.RunOnce())
+	assert.Equal(t, 1, dnsProvider.applied)
+
+	fwProvider := &panicFWProvider{}
+	fwr, err := fwregistry.NewRegistry(fwProvider, 0)
+	require.NoError(t, err)
+	ctrl = &Controller{
+		Source:           source,
+		InternalRegistry: ir,
+		FwRegistry:       fwr,
+		Policy:           &plan.SyncPolicy{},
+	}
+	err = ctrl.RunOnce()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "firewall: panic: boom")
+	assert.Equal(t, 1, fwProvider.calls)
+	assert.Equal(t, 0, internalProvider.applied)
+}
+
+// TestRunOnceInternalRegistry tests that the internal endpoints are planned against the internal registry.
+func TestRunOnceInternalRegistry(t *testing.T) {
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			{DNSName: "create-record", Targets: endpoint.Targets{"8.8.8.8"}},
+		},
+		InternalEndpoints: []*endpoint.Endpoint{
+			{DNSName: "create-record", Targets: endpoint.Targets{"10.0.0.1"}},
+		},
+	}, nil)
+
+	r, err := registry.NewNoopRegistry(newMockProvider(nil, &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "create-record", Targets: endpoint.Targets{"8.8.8.8"}},
+		},
+	}))
+	require.NoError(t, err)
+
+	ir, err := registry.NewNoopRegistry(newMockProvider(nil, &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			{DNSName: "create-record", Targets: endpoint.Targets{"10.0.0.1"}},
+		},
+	}))
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{}))
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:           source,
+		Registry:         r,
+		InternalRegistry: ir,
+		FwRegistry:       fwr,
+		EipRegistry:      eipr,
+		Policy:           &plan.SyncPolicy{},
+	}
+
+	assert.NoError(t, ctrl.RunOnce())
+}
+
+// barrierProvider only returns its records once every provider sharing its
+// barrier was asked for theirs, failing after a second otherwise.
+type barrierProvider struct {
+	barrier *sync.WaitGroup
+}
+
+func (p *barrierProvider) Records() ([]*endpoint.Endpoint, error) {
+	p.barrier.Done()
+	done := make(chan struct{})
+	go func() {
+		p.barrier.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil, nil
+	case <-time.After(time.Second):
+		return nil, errors.New("not synchronized concurrently")
+	}
+}
+
+func (p *barrierProvider) ApplyChanges(changes *plan.Changes) error {
+	return nil
+}
+
+// TestRunOnceConcurrent tests that the subsystems are synchronized in parallel.
+func TestRunOnceConcurrent(t *testing.T) {
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{}, nil)
+
+	barrier := &sync.WaitGroup{}
+	barrier.Add(2)
+	r, err := registry.NewNoopRegistry(&barrierProvider{barrier})
+	require.NoError(t, err)
+	ir, err := registry.NewNoopRegistry(&barrierProvider{barrier})
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{}))
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:           source,
+		Registry:         r,
+		InternalRegistry: ir,
+		FwRegistry:       fwr,
+		EipRegistry:      eipr,
+		Policy:           &plan.SyncPolicy{},
+		Concurrent:       true,
+	}
+
+	assert.NoError(t, ctrl.RunOnce())
+}
+
+// targetedSource returns a fixed setting for any single service.
+type targetedSource struct {
+	testutils.MockSource
+	service *setting.ExternalIPSetting
+	keys    []string
+}
+
+func (s *targetedSource) ServiceSetting(namespace, name string) (*setting.ExternalIPSetting, error) {
+	s.keys = append(s.keys, namespace+"/"+name)
+	return s.service, nil
+}
+
+// recordingProvider returns fixed records and records the applied changes.
+type recordingProvider struct {
+	records []*endpoint.Endpoint
+	changes *plan.Changes
+}
+
+func (p *recordingProvider) Records() ([]*endpoint.Endpoint, error) {
+	return p.records, nil
+}
+
+func (p *recordingProvider) ApplyChanges(changes *plan.Changes) error {
+	p.changes = changes
+	return nil
+}
+
+// TestRunService tests that a single service is synchronized without touching the others.
+func TestRunService(t *testing.T) {
+	source := &targetedSource{
+		service: &setting.ExternalIPSetting{
+			Endpoints: []*endpoint.Endpoint{
+				{DNSName: "foo.example.org", Targets: endpoint.Targets{"3.3.3.3"}},
+			},
+			InboundRules: []*inbound.InboundRules{
+				{
+					Name:        "foo.kube.openfresh.io",
+					Rules:       []inbound.InboundRule{{Protocol: "udp", Port: 9900}},
+					ProviderIDs: inbound.ProviderIDs{"ghi"},
+				},
+			},
+			ExtIPs: []*extip.ExtIP{
+				{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"10.0.0.3"}},
+			},
+		},
+	}
+
+	newRecord := func(name, target, resource string) *endpoint.Endpoint {
+		ep := endpoint.NewEndpoint(name, endpoint.RecordTypeA, target)
+		ep.Labels[endpoint.ResourceLabelKey] = resource
+		return ep
+	}
+	dnsProvider := &recordingProvider{
+		records: []*endpoint.Endpoint{
+			newRecord("foo.example.org", "1.1.1.1", "service/default/foo"),
+			newRecord("old-foo.example.org", "1.1.1.1", "service/default/foo"),
+			newRecord("bar.example.org", "2.2.2.2", "service/default/bar"),
+		},
+	}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(
+		[]*inbound.InboundRules{
+			{
+				Name:        "foo.kube.openfresh.io",
+				Rules:       []inbound.InboundRule{{Protocol: "udp", Port: 9900}},
+				ProviderIDs: inbound.ProviderIDs{"abc"},
+			},
+			{
+				Name:        "bar.kube.openfresh.io",
+				Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80}},
+				ProviderIDs: inbound.ProviderIDs{"def"},
+			},
+		},
+		&fwplan.Changes{
+			Set: []*fwplan.InstanceRule{
+				{ProviderID: "ghi", RulesName: "foo.kube.openfresh.io"},
+			},
+			Unset: []*fwplan.InstanceRule{
+				{ProviderID: "abc", RulesName: "foo.kube.openfresh.io"},
+			},
+		},
+	), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(
+		[]*extip.ExtIP{
+			{SvcName: "foo", ExtIPs: endpoint.Targets{"10.0.0.1"}, Managed: true},
+			{SvcName: "bar", ExtIPs: endpoint.Targets{"10.0.0.2"}, Managed: true},
+		},
+		&eipplan.Changes{
+			UpdateNew: []*extip.ExtIP{
+				{SvcName: "foo", ExtIPs: endpoint.Targets{"10.0.0.3"}},
+			},
+			UpdateOld: []*extip.ExtIP{
+				{SvcName: "foo", ExtIPs: endpoint.Targets{"10.0.0.1"}},
+			},
+		},
+	))
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:      source,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Policy:      &plan.SyncPolicy{},
+	}
+
+	require.NoError(t, ctrl.RunService("default/foo"))
+	assert.Equal(t, []string{"default/foo"}, source.keys)
+
+	// the records of the other services are left untouched
+	require.NotNil(t, dnsProvider.changes)
+	assert.Empty(t, dnsProvider.changes.Create)
+	require.Len(t, dnsProvider.changes.UpdateNew, 1)
+	assert.Equal(t, "foo.example.org", dnsProvider.changes.UpdateNew[0].DNSName)
+	assert.Equal(t, endpoint.Targets{"3.3.3.3"}, dnsProvider.changes.UpdateNew[0].Targets)
+	require.Len(t, dnsProvider.changes.Delete, 1)
+	assert.Equal(t, "old-foo.example.org", dnsProvider.changes.Delete[0].DNSName)
+
+	assert.Error(t, ctrl.RunService("foo"))
+}
+
+// TestServiceScopeSlots tests that the synchronization of a single service leaves the
+// names of the inactive slots of the blue/green pairs to the full synchronizations.
+func TestServiceScopeSlots(t *testing.T) {
+	newRecord := func(resource, slot, activeSlot string) *endpoint.Endpoint {
+		ep := endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.1.1.1")
+		ep.Labels[endpoint.ResourceLabelKey] = resource
+		ep.Labels[endpoint.SlotLabelKey] = slot
+		ep.Labels[endpoint.ActiveSlotLabelKey] = activeSlot
+		return ep
+	}
+	current := []*endpoint.Endpoint{newRecord("service/default/foo-green", "green", "green")}
+
+	blue := &serviceScope{namespace: "default", name: "foo-blue"}
+	desired := []*endpoint.Endpoint{newRecord("service/default/foo-blue", "blue", "green")}
+	assert.Empty(t, blue.records(current, desired))
+	assert.Empty(t, blue.endpoints(desired))
+
+	green := &serviceScope{namespace: "default", name: "foo-green"}
+	desired = []*endpoint.Endpoint{newRecord("service/default/foo-green", "green", "green")}
+	assert.Equal(t, current, green.records(current, desired))
+	assert.Equal(t, desired, green.endpoints(desired))
+
+	var full *serviceScope
+	desired = []*endpoint.Endpoint{newRecord("service/default/foo-blue", "blue", "green")}
+	assert.Equal(t, current, full.records(current, desired))
+	assert.Equal(t, desired, full.endpoints(desired))
+}
+
+// TestRunOnceMonitorOnly tests that the planned changes are exported and recorded but never applied.
+func TestRunOnceMonitorOnly(t *testing.T) {
+	created := endpoint.NewEndpoint("create-record", endpoint.RecordTypeA, "1.2.3.4")
+	created.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{created},
+	}, nil)
+
+	dnsProvider := &recordingProvider{
+		records: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("delete-record", endpoint.RecordTypeA, "4.3.2.1"),
+		},
+	}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{}))
+	require.NoError(t, err)
+
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &Controller{
+		Source:      source,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Policy:      &plan.SyncPolicy{},
+		MonitorOnly: true,
+		Events:      recorder,
+	}
+
+	require.NoError(t, ctrl.RunOnce())
+	assert.Nil(t, dnsProvider.changes)
+
+	m := &dto.Metric{}
+	require.NoError(t, driftChanges.WithLabelValues("dns").Write(m))
+	assert.Equal(t, float64(2), m.GetGauge().GetValue())
+
+	// only the change attributed to a service is recorded as an event
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "PlannedChange dns: CREATE create-record")
+}
+
+// TestRunOnceDryRun tests that the changes the registries would send to the providers
+// are logged but never applied.
+func TestRunOnceDryRun(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("create-record", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+		InboundRules: []*inbound.InboundRules{
+			{Name: "foo.kube.openfresh.io", Rules: []inbound.InboundRule{{Protocol: "tcp", Port: 80}}},
+		},
+	}, nil)
+
+	// the record isn't owned, so the registry doesn't delete it
+	dnsProvider := &recordingProvider{
+		records: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("delete-record", endpoint.RecordTypeA, "4.3.2.1"),
+		},
+	}
+	r, err := registry.NewTXTRegistry(dnsProvider, "txt-", "owner", nil, 0, nil, "")
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipProvider := &mockEipProvider{ExpectChanges: &eipplan.Changes{}}
+	eipr, err := eipregistry.NewRegistry(eipProvider)
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:      source,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Policy:      &plan.SyncPolicy{},
+		DryRun:      true,
+	}
+
+	require.NoError(t, ctrl.RunOnce())
+	assert.Nil(t, dnsProvider.changes)
+	assert.Empty(t, eipProvider.Finalized)
+
+	assert.Contains(t, logs.String(), "Dry run, not applying dns change: CREATE create-record 0 IN A [1.2.3.4]")
+	assert.Contains(t, logs.String(), "Dry run, not applying dns change: CREATE txt-create-record 0 IN TXT")
+	assert.NotContains(t, logs.String(), "delete-record")
+	assert.Contains(t, logs.String(), "Dry run, not applying firewall change: CREATE")
+}
+
+// TestRunOnceDryRunService tests that the changes of the services in dry-run are recorded
+// but not applied, while the changes of the other services are.
+func TestRunOnceDryRunService(t *testing.T) {
+	applied := endpoint.NewEndpoint("applied-record", endpoint.RecordTypeA, "1.2.3.4")
+	applied.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+	dry := endpoint.NewEndpoint("dry-record", endpoint.RecordTypeA, "1.2.3.4")
+	dry.Labels[endpoint.ResourceLabelKey] = "service/default/bar"
+	dry.DryRun = true
+	// the record the service in dry-run doesn't request anymore
+	removed := endpoint.NewEndpoint("removed-record", endpoint.RecordTypeA, "4.3.2.1")
+	removed.Labels[endpoint.ResourceLabelKey] = "service/default/bar"
+
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{applied, dry},
+		ExtIPs: []*extip.ExtIP{
+			{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+			{Namespace: "default", SvcName: "bar", ExtIPs: endpoint.Targets{"1.2.3.4"}, DryRun: true},
+		},
+	}, nil)
+
+	dnsProvider := &recordingProvider{records: []*endpoint.Endpoint{removed}}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{
+		Create: []*extip.ExtIP{{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}}},
+	}))
+	require.NoError(t, err)
+
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &Controller{
+		Source:      source,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Policy:      &plan.SyncPolicy{},
+		Events:      recorder,
+	}
+
+	require.NoError(t, ctrl.RunOnce())
+	require.NotNil(t, dnsProvider.changes)
+	assert.Equal(t, []*endpoint.Endpoint{applied}, dnsProvider.changes.Create)
+	assert.Empty(t, dnsProvider.changes.Delete)
+
+	var events []string
+	for len(recorder.Events) > 0 {
+		events = append(events, <-recorder.Events)
+	}
+	assert.Len(t, events, 3)
+	assert.Contains(t, strings.Join(events, "\n"), "DryRunChange dns: CREATE dry-record")
+	assert.Contains(t, strings.Join(events, "\n"), "DryRunChange dns: DELETE removed-record")
+	assert.Contains(t, strings.Join(events, "\n"), "DryRunChange extip: CREATE ExternalIPs 1.2.3.4")
+}
+
+// TestRunOnceFinalize tests that the services are only finalized once every subsystem is in sync.
+func TestRunOnceFinalize(t *testing.T) {
+	extIPs := []*extip.ExtIP{{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}}}
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{ExtIPs: extIPs}, nil)
+
+	r, err := registry.NewNoopRegistry(&countingProvider{})
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(&panicFWProvider{}, 0)
+	require.NoError(t, err)
+
+	eipProvider := &mockEipProvider{
+		ExtIPsStore:   extIPs,
+		ExpectChanges: &eipplan.Changes{},
+	}
+	eipr, err := eipregistry.NewRegistry(eipProvider)
+	require.NoError(t, err)
+
+	ctrl := &Controller{
+		Source:           source,
+		Registry:         r,
+		FwRegistry:       fwr,
+		EipRegistry:      eipr,
+		Policy:           &plan.SyncPolicy{},
+		FailureThreshold: 1,
+		FailurePause:     time.Hour,
+	}
+
+	// the firewall fails, then is paused: the deleted services may still have rules
+	require.Error(t, ctrl.RunOnce())
+	require.NoError(t, ctrl.RunOnce())
+	assert.Empty(t, eipProvider.Finalized)
+
+	ctrl.FwRegistry, err = fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+	ctrl.breakers = nil
+
+	require.NoError(t, ctrl.RunOnce())
+	assert.Equal(t, [][]*extip.ExtIP{extIPs}, eipProvider.Finalized)
+
+	// nothing is finalized in monitor-only mode
+	ctrl.MonitorOnly = true
+	require.NoError(t, ctrl.RunOnce())
+	assert.Len(t, eipProvider.Finalized, 1)
+}
+
+// TestCountApplied tests that the changes applied before a partial failure are counted.
+// TestSyncRecordsReplanStale tests that the changes planned from the cached records
+// are planned again when the records were changed by someone else in between.
+func TestSyncRecordsReplanStale(t *testing.T) {
+	for _, replan := range []bool{false, true} {
+		dnsProvider := provider.NewInMemoryProvider()
+		require.NoError(t, dnsProvider.CreateZone("example.org"))
+		r, err := registry.NewTXTRegistry(dnsProvider, "txt-", "owner", nil, time.Hour, nil, "")
+		require.NoError(t, err)
+
+		desired := []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}
+		ctrl := &Controller{Policy: &plan.SyncPolicy{}, ReplanStale: replan}
+		require.NoError(t, ctrl.syncRecords("internal-dns", r, desired, nil))
+
+		// another instance deletes the record while it's cached
+		require.NoError(t, dnsProvider.ApplyChanges(&plan.Changes{
+			Delete: []*endpoint.Endpoint{
+				endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+				endpoint.NewEndpoint("txt-foo.example.org", endpoint.RecordTypeTXT, "\"heritage=external-ips,external-ips/owner=owner\""),
+			},
+		}))
+
+		err = ctrl.syncRecords("internal-dns", r, []*endpoint.Endpoint{}, nil)
+		if !replan {
+			assert.True(t, provider.IsStale(err))
+			continue
+		}
+		assert.NoError(t, err)
+		records, err := dnsProvider.Records()
+		require.NoError(t, err)
+		assert.Empty(t, records)
+	}
+}
+
+func TestCountApplied(t *testing.T) {
+	count := func() float64 {
+		m := &dto.Metric{}
+		require.NoError(t, appliedChanges.WithLabelValues("dns").Write(m))
+		return m.GetCounter().GetValue()
+	}
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{{DNSName: "create-record"}},
+		Delete: []*endpoint.Endpoint{{DNSName: "delete-record"}},
+	}
+	before := count()
+
+	countApplied("dns", changes, nil)
+	assert.Equal(t, before+2, count())
+
+	countApplied("dns", changes, errors.New("apply failed"))
+	assert.Equal(t, before+2, count())
+
+	countApplied("dns", changes, &plan.PartialError{
+		Applied: &plan.Changes{Create: changes.Create},
+	})
+	assert.Equal(t, before+3, count())
+}
+
+// TestWaitExpiry tests that the next full synchronization happens when a service expires.
+func TestWaitExpiry(t *testing.T) {
+	ctrl := &Controller{nextExpiry: time.Now().Add(10 * time.Millisecond)}
+	stopChan := make(chan struct{})
+
+	start := time.Now()
+	assert.True(t, ctrl.wait(nil, stopChan))
+	assert.True(t, time.Since(start) >= 10*time.Millisecond)
 }
@@ -0,0 +1,129 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"sort"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// transition is an in-progress cutover of a record to an entirely new set of targets.
+type transition struct {
+	// the targets of the record before the cutover
+	old endpoint.Targets
+	// the targets of the record after the cutover
+	targets endpoint.Targets
+	since   time.Time
+}
+
+// cutover returns the desired endpoints of the subsystem, where the records whose targets
+// are entirely replaced keep their current targets alongside the new ones for the
+// cutover delay, or the TTL of the record if longer. This gives the resolvers time to
+// pick up the new targets before the old ones go away.
+// When partial, current and desired only hold some of the records and the
+// transitions of the others are kept.
+func (c *Controller) cutover(subsystem string, current, desired []*endpoint.Endpoint, now time.Time, partial bool) []*endpoint.Endpoint {
+	if c.CutoverDelay <= 0 {
+		return desired
+	}
+	c.transitionsMu.Lock()
+	defer c.transitionsMu.Unlock()
+	if c.transitions == nil {
+		c.transitions = map[string]map[string]*transition{}
+	}
+
+	currentByKey := make(map[string]*endpoint.Endpoint, len(current))
+	for _, ep := range current {
+		currentByKey[recordKey(ep)] = ep
+	}
+
+	previous := c.transitions[subsystem]
+	transitions := map[string]*transition{}
+	if partial {
+		for key, t := range previous {
+			if _, ok := currentByKey[key]; !ok {
+				transitions[key] = t
+			}
+		}
+		for _, ep := range desired {
+			delete(transitions, recordKey(ep))
+		}
+	}
+	result := make([]*endpoint.Endpoint, 0, len(desired))
+
+	for _, ep := range desired {
+		key := recordKey(ep)
+
+		t, ok := previous[key]
+		if ok && !t.targets.Same(ep.Targets) {
+			// the desired targets changed again, start over from the current ones
+			ok = false
+		}
+		if !ok {
+			cur, exists := currentByKey[key]
+			if !exists || len(cur.Targets) == 0 || overlap(cur.Targets, ep.Targets) {
+				result = append(result, ep)
+				continue
+			}
+			t = &transition{old: cur.Targets, targets: ep.Targets, since: now}
+			log.Infof("Starting the cutover of %s from %s to %s", ep.DNSName, t.old, t.targets)
+		}
+
+		delay := c.CutoverDelay
+		if ttl := time.Duration(ep.RecordTTL) * time.Second; ttl > delay {
+			delay = ttl
+		}
+		if now.Sub(t.since) >= delay {
+			log.Infof("Completing the cutover of %s to %s", ep.DNSName, t.targets)
+			result = append(result, ep)
+			continue
+		}
+
+		transitions[key] = t
+		merged := *ep
+		merged.Targets = union(t.old, ep.Targets)
+		result = append(result, &merged)
+	}
+
+	c.transitions[subsystem] = transitions
+	return result
+}
+
+func recordKey(ep *endpoint.Endpoint) string {
+	return ep.DNSName + "/" + ep.RecordType
+}
+
+// overlap returns whether a and b have a target in common.
+func overlap(a, b endpoint.Targets) bool {
+	seen := make(map[string]bool, len(a))
+	for _, t := range a {
+		seen[t] = true
+	}
+	for _, t := range b {
+		if seen[t] {
+			return true
+		}
+	}
+	return false
+}
+
+// union returns the sorted targets of a and b, without duplicates.
+func union(a, b endpoint.Targets) endpoint.Targets {
+	seen := make(map[string]bool, len(a)+len(b))
+	result := make(endpoint.Targets, 0, len(a)+len(b))
+	for _, targets := range []endpoint.Targets{a, b} {
+		for _, t := range targets {
+			if !seen[t] {
+				seen[t] = true
+				result = append(result, t)
+			}
+		}
+	}
+	sort.Sort(result)
+	return result
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+func TestCutover(t *testing.T) {
+	now := time.Now()
+	c := &Controller{CutoverDelay: time.Minute}
+
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "1.1.1.1", "2.2.2.2"),
+		endpoint.NewEndpoint("updated.example.org", endpoint.RecordTypeA, "3.3.3.3"),
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "5.5.5.5"),
+		endpoint.NewEndpoint("updated.example.org", endpoint.RecordTypeA, "3.3.3.3", "4.4.4.4"),
+		endpoint.NewEndpoint("created.example.org", endpoint.RecordTypeA, "6.6.6.6"),
+	}
+
+	// first phase: the old targets are kept alongside the new ones
+	result := c.cutover("dns", current, desired, now, false)
+	require.Len(t, result, 3)
+	assert.Equal(t, endpoint.Targets{"1.1.1.1", "2.2.2.2", "5.5.5.5"}, result[0].Targets)
+	assert.Equal(t, endpoint.Targets{"3.3.3.3", "4.4.4.4"}, result[1].Targets)
+	assert.Equal(t, endpoint.Targets{"6.6.6.6"}, result[2].Targets)
+
+	// the desired endpoints are left untouched
+	assert.Equal(t, endpoint.Targets{"5.5.5.5"}, desired[0].Targets)
+
+	current[0] = result[0]
+	result = c.cutover("dns", current, desired, now.Add(30*time.Second), false)
+	assert.Equal(t, endpoint.Targets{"1.1.1.1", "2.2.2.2", "5.5.5.5"}, result[0].Targets)
+
+	// second phase: the old targets are removed after the delay
+	result = c.cutover("dns", current, desired, now.Add(time.Minute), false)
+	assert.Equal(t, endpoint.Targets{"5.5.5.5"}, result[0].Targets)
+	assert.Empty(t, c.transitions["dns"])
+}
+
+func TestCutoverWaitsForTTL(t *testing.T) {
+	now := time.Now()
+	c := &Controller{CutoverDelay: time.Minute}
+
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("replaced.example.org", endpoint.RecordTypeA, endpoint.TTL(300), "1.1.1.1"),
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("replaced.example.org", endpoint.RecordTypeA, endpoint.TTL(300), "2.2.2.2"),
+	}
+
+	c.cutover("dns", current, desired, now, false)
+	result := c.cutover("dns", current, desired, now.Add(time.Minute), false)
+	assert.Equal(t, endpoint.Targets{"1.1.1.1", "2.2.2.2"}, result[0].Targets)
+
+	result = c.cutover("dns", current, desired, now.Add(5*time.Minute), false)
+	assert.Equal(t, endpoint.Targets{"2.2.2.2"}, result[0].Targets)
+}
+
+func TestCutoverRestartsOnNewTargets(t *testing.T) {
+	now := time.Now()
+	c := &Controller{CutoverDelay: time.Minute}
+
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "1.1.1.1"),
+	}
+
+	c.cutover("dns", current, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "2.2.2.2"),
+	}, now, false)
+
+	// the selection changed again before the end of the cutover
+	result := c.cutover("dns", current, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "3.3.3.3"),
+	}, now.Add(time.Minute), false)
+	assert.Equal(t, endpoint.Targets{"1.1.1.1", "3.3.3.3"}, result[0].Targets)
+}
+
+func TestCutoverDisabled(t *testing.T) {
+	c := &Controller{}
+
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "1.1.1.1"),
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("replaced.example.org", endpoint.RecordTypeA, "2.2.2.2"),
+	}
+
+	assert.Equal(t, desired, c.cutover("dns", current, desired, time.Now(), false))
+}
+
+func TestCutoverPartial(t *testing.T) {
+	now := time.Now()
+	c := &Controller{CutoverDelay: time.Minute}
+
+	c.cutover("dns", []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.1.1.1"),
+		endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "2.2.2.2"),
+	}, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "3.3.3.3"),
+		endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "4.4.4.4"),
+	}, now, false)
+	require.Len(t, c.transitions["dns"], 2)
+
+	// synchronizing foo on its own keeps the cutover of bar
+	c.cutover("dns", []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.1.1.1", "3.3.3.3"),
+	}, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "3.3.3.3"),
+	}, now.Add(time.Minute), true)
+	assert.Len(t, c.transitions["dns"], 1)
+	assert.Contains(t, c.transitions["dns"], "bar.example.org/A")
+}
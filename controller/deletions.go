@@ -0,0 +1,200 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// reasonExternallyDeleted is the reason of the events recorded for the records and
+// security groups re-created after being deleted outside of external-ips
+const reasonExternallyDeleted = "ExternallyDeleted"
+
+var externalDeletions = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "external_ips",
+		Subsystem: "controller",
+		Name:      "external_deletions_total",
+		Help:      "Number of records and security groups re-created after being deleted outside of external-ips, by subsystem.",
+	},
+	[]string{"subsystem"},
+)
+
+func init() {
+	prometheus.MustRegister(externalDeletions)
+}
+
+// knownResource is a record or a security group found or applied by a full synchronization.
+type knownResource struct {
+	// the zone of the record, or the name of the security group, empty if unknown
+	zone string
+	// when the resource was last found or applied
+	seen time.Time
+}
+
+// deletionTracker keeps the records and security groups of the last full synchronization
+// of each subsystem, so that the ones which vanished from the provider since then and
+// are re-created are reported as deleted outside of external-ips, e.g. by some other
+// automation or by hand.
+type deletionTracker struct {
+	mu        sync.Mutex
+	resources map[string]map[string]knownResource
+}
+
+// observe replaces the known resources of the subsystem with the current ones and
+// returns the known resources missing from them, none on the first synchronization.
+func (t *deletionTracker) observe(subsystem string, current map[string]string, now time.Time) map[string]knownResource {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.resources == nil {
+		t.resources = map[string]map[string]knownResource{}
+	}
+	vanished := map[string]knownResource{}
+	for key, r := range t.resources[subsystem] {
+		if _, ok := current[key]; !ok {
+			vanished[key] = r
+		}
+	}
+	known := make(map[string]knownResource, len(current))
+	for key, zone := range current {
+		known[key] = knownResource{zone: zone, seen: now}
+	}
+	t.resources[subsystem] = known
+	return vanished
+}
+
+// applied adds the resources created or updated by the subsystem to its known
+// resources and removes the ones it deleted.
+func (t *deletionTracker) applied(subsystem string, created map[string]string, deleted []string, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	known := t.resources[subsystem]
+	if known == nil {
+		return
+	}
+	for key, zone := range created {
+		// the desired records don't tell their zone, kept from when they were found
+		if zone == "" {
+			zone = known[key].zone
+		}
+		known[key] = knownResource{zone: zone, seen: now}
+	}
+	for _, key := range deleted {
+		delete(known, key)
+	}
+}
+
+// deletions returns the tracker of the records and security groups, creating it if needed.
+func (c *Controller) deletions() *deletionTracker {
+	c.breakersMu.Lock()
+	defer c.breakersMu.Unlock()
+
+	if c.deleted == nil {
+		c.deleted = &deletionTracker{}
+	}
+	return c.deleted
+}
+
+// deletionKey identifies a record by its hostname and type.
+func deletionKey(ep *endpoint.Endpoint) string {
+	return strings.TrimSuffix(ep.DNSName, ".") + " " + ep.RecordType
+}
+
+// recordZones returns the zones of the records by key, empty if the provider doesn't tell them.
+func recordZones(records ...[]*endpoint.Endpoint) map[string]string {
+	result := map[string]string{}
+	for _, eps := range records {
+		for _, ep := range eps {
+			zone, _ := ep.ProviderSpecific.Get(provider.ZoneProperty)
+			result[deletionKey(ep)] = zone.Value
+		}
+	}
+	return result
+}
+
+// groupNames returns the names of the security groups, by name.
+func groupNames(rules ...[]*inbound.InboundRules) map[string]string {
+	result := map[string]string{}
+	for _, rs := range rules {
+		for _, r := range rs {
+			result[r.Name] = r.Name
+		}
+	}
+	return result
+}
+
+// recreatedRecords reports the records about to be created which vanished since the
+// last full synchronization.
+func (c *Controller) recreatedRecords(subsystem string, vanished map[string]knownResource, created []*endpoint.Endpoint, now time.Time) {
+	for _, ep := range created {
+		r, ok := vanished[deletionKey(ep)]
+		if !ok {
+			continue
+		}
+		zone := r.zone
+		if zone == "" {
+			zone = "unknown zone"
+		}
+		ch := recordChange("CREATE", ep)
+		c.externallyDeleted(subsystem, ch.namespace, ch.name, "record "+deletionKey(ep)+" of "+zone, now.Sub(r.seen))
+	}
+}
+
+// recreatedGroups reports the security groups about to be created which vanished
+// since the last full synchronization.
+func (c *Controller) recreatedGroups(vanished map[string]knownResource, created []*inbound.InboundRules, now time.Time) {
+	for _, r := range created {
+		known, ok := vanished[r.Name]
+		if !ok {
+			continue
+		}
+		var namespace, name string
+		if parts := strings.SplitN(r.Resource, "/", 2); len(parts) == 2 {
+			namespace, name = parts[0], parts[1]
+		}
+		c.externallyDeleted("firewall", namespace, name, "security group "+r.Name, now.Sub(known.seen))
+	}
+}
+
+// externallyDeleted logs the re-creation of a resource deleted outside of external-ips
+// and records it as a warning event on its service, if attributed to one.
+func (c *Controller) externallyDeleted(subsystem, namespace, name, resource string, since time.Duration) {
+	since = since.Round(time.Second)
+	externalDeletions.WithLabelValues(subsystem).Inc()
+	log.Warnf("Re-creating %s %s, deleted outside of external-ips within %s after it was last seen", subsystem, resource, since)
+	if c.Events == nil || namespace == "" || name == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "Service",
+		Namespace: namespace,
+		Name:      name,
+	}
+	c.Events.Eventf(ref, v1.EventTypeWarning, reasonExternallyDeleted, "%s: %s was deleted outside of external-ips within %s after it was last seen, re-creating it", subsystem, resource, since)
+}
+
+// appliedRecords returns the records created or updated and the ones deleted by the changes applied.
+func appliedRecords(changes *plan.Changes) (map[string]string, []string) {
+	if changes == nil {
+		return nil, nil
+	}
+	var deleted []string
+	for _, ep := range changes.Delete {
+		deleted = append(deleted, deletionKey(ep))
+	}
+	return recordZones(changes.Create, changes.UpdateNew), deleted
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+func TestDeletionTracker(t *testing.T) {
+	now := time.Now()
+	tracker := &deletionTracker{}
+
+	// nothing vanished on the first synchronization
+	assert.Empty(t, tracker.observe("dns", map[string]string{"foo.example.org A": "example.org"}, now))
+
+	// the created records are known from then on, with the zone they were found in
+	tracker.applied("dns", map[string]string{"bar.example.org A": "", "foo.example.org A": ""}, nil, now.Add(time.Minute))
+	vanished := tracker.observe("dns", map[string]string{}, now.Add(2*time.Minute))
+	assert.Equal(t, map[string]knownResource{
+		"foo.example.org A": {zone: "example.org", seen: now.Add(time.Minute)},
+		"bar.example.org A": {seen: now.Add(time.Minute)},
+	}, vanished)
+
+	// the deleted records are forgotten
+	tracker.observe("dns", map[string]string{"foo.example.org A": "example.org"}, now)
+	tracker.applied("dns", nil, []string{"foo.example.org A"}, now)
+	assert.Empty(t, tracker.observe("dns", map[string]string{}, now))
+}
+
+// TestRecreatedRecordsEvent tests that the records and security groups re-created after
+// vanishing are recorded as events on their service.
+func TestRecreatedRecordsEvent(t *testing.T) {
+	now := time.Now()
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &Controller{Events: recorder}
+
+	found := endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4").WithProviderSpecific(provider.ZoneProperty, "example.org")
+	ctrl.deletions().observe("dns", recordZones([]*endpoint.Endpoint{found}), now.Add(-5*time.Minute))
+	ctrl.deletions().observe("firewall", groupNames([]*inbound.InboundRules{{Name: "foo.default.kube"}}), now.Add(-5*time.Minute))
+
+	created := endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")
+	created.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+	ctrl.recreatedRecords("dns", ctrl.deletions().observe("dns", nil, now), []*endpoint.Endpoint{
+		created,
+		// the records which never existed aren't reported
+		endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+	}, now)
+	ctrl.recreatedGroups(ctrl.deletions().observe("firewall", nil, now), []*inbound.InboundRules{
+		{Name: "foo.default.kube", Resource: "default/foo"},
+	}, now)
+
+	require.Len(t, recorder.Events, 2)
+	assert.Contains(t, <-recorder.Events, "Warning ExternallyDeleted dns: record foo.example.org A of example.org was deleted outside of external-ips within 5m0s after it was last seen")
+	assert.Contains(t, <-recorder.Events, "Warning ExternallyDeleted firewall: security group foo.default.kube was deleted outside of external-ips within 5m0s after it was last seen")
+
+	upserted, deleted := appliedRecords(&plan.Changes{Create: []*endpoint.Endpoint{created}, Delete: []*endpoint.Endpoint{found}})
+	assert.Equal(t, map[string]string{"foo.example.org A": ""}, upserted)
+	assert.Equal(t, []string{"foo.example.org A"}, deleted)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/extip/extip"
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+const (
+	// reasonDryRunChange is the reason of the events recorded for the changes of the services in dry-run
+	reasonDryRunChange = "DryRunChange"
+)
+
+// dryRun logs the changes which would be sent to the provider of the subsystem
+// in place of applying them.
+func (c *Controller) dryRun(subsystem string, changes []change) {
+	if len(changes) == 0 {
+		log.Debugf("Dry run, no %s change", subsystem)
+	}
+	for _, ch := range changes {
+		log.Infof("Dry run, not applying %s change: %s", subsystem, ch.description)
+	}
+}
+
+// providerChanges returns the changes the registry would send to its provider,
+// e.g. without the records it doesn't own and with their TXT records.
+func providerChanges(r registry.Registry, changes *plan.Changes) *plan.Changes {
+	if p, ok := r.(registry.Previewer); ok {
+		return p.Preview(changes)
+	}
+	return changes
+}
+
+// dryRunServices logs the changes of the services in dry-run and records them as
+// events on their service, in place of applying them.
+func (c *Controller) dryRunServices(subsystem string, changes []change) {
+	for _, ch := range changes {
+		log.Infof("Service in dry-run, not applying %s change: %s", subsystem, ch.description)
+		c.event(ch, reasonDryRunChange, subsystem)
+	}
+}
+
+// dryRunRecords returns whether a change of the record is in dry-run: the desired
+// records of the services in dry-run are marked, the current ones are attributed
+// to them by their resource label.
+func dryRunRecords(desired []*endpoint.Endpoint) func(*endpoint.Endpoint) bool {
+	resources := map[string]bool{}
+	for _, ep := range desired {
+		if ep.DryRun && ep.Labels[endpoint.ResourceLabelKey] != "" {
+			resources[ep.Labels[endpoint.ResourceLabelKey]] = true
+		}
+	}
+	return func(ep *endpoint.Endpoint) bool {
+		return ep.DryRun || resources[ep.Labels[endpoint.ResourceLabelKey]]
+	}
+}
+
+// dryRunRules returns whether a change of the rules, given by their name, is in dry-run.
+func dryRunRules(desired []*inbound.InboundRules) func(string) bool {
+	names := map[string]bool{}
+	for _, r := range desired {
+		if r.DryRun {
+			names[r.Name] = true
+		}
+	}
+	return func(name string) bool {
+		return names[name]
+	}
+}
+
+// dryRunExtIPs returns whether a change of the external IPs of a service is in dry-run.
+func dryRunExtIPs(desired []*extip.ExtIP) func(*extip.ExtIP) bool {
+	services := map[string]bool{}
+	for _, e := range desired {
+		if e.DryRun {
+			services[e.Namespace+"/"+e.SvcName] = true
+		}
+	}
+	return func(e *extip.ExtIP) bool {
+		return e.DryRun || services[e.Namespace+"/"+e.SvcName]
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+var collectedGroups = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "external_ips",
+		Subsystem: "controller",
+		Name:      "collected_security_groups_total",
+		Help:      "Number of orphaned security groups deleted by the garbage collection.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(collectedGroups)
+}
+
+// collectGarbage deletes the owned security groups which have been neither desired
+// nor attached to any instance for FirewallGCGracePeriod. Such groups are left
+// behind when their deletion fails, and are no longer planned once their rules
+// are gone from the current state. It runs every FirewallGCInterval, never if 0.
+func (c *Controller) collectGarbage(desired []*inbound.InboundRules, now time.Time) error {
+	if c.FirewallGCInterval <= 0 || now.Sub(c.lastGC) < c.FirewallGCInterval {
+		return nil
+	}
+	c.lastGC = now
+
+	start := time.Now()
+	orphans, err := c.FwRegistry.Orphans()
+	c.observe("firewall", "orphans", start, err)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(desired))
+	for _, r := range desired {
+		names[r.Name] = true
+	}
+
+	var errs []string
+	seen := make(map[string]time.Time, len(orphans))
+	for _, name := range orphans {
+		if names[name] {
+			continue
+		}
+		since, ok := c.orphans[name]
+		if !ok {
+			since = now
+		}
+		if now.Sub(since) < c.FirewallGCGracePeriod {
+			log.Debugf("Security group %s is orphaned since %s", name, since.Format(time.RFC3339))
+			seen[name] = since
+			continue
+		}
+
+		log.Infof("Deleting security group %s, orphaned since %s", name, since.Format(time.RFC3339))
+		if err := c.FwRegistry.DeleteOrphan(name); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			seen[name] = since
+			continue
+		}
+		collectedGroups.Inc()
+	}
+	c.orphans = seen
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to delete orphaned security groups: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+	fwregistry "github.com/openfresh/external-ips/firewall/registry"
+)
+
+// collectingFWProvider reports the given orphans and records their deletion.
+type collectingFWProvider struct {
+	orphans []string
+	failing map[string]bool
+	deleted []string
+}
+
+func (p *collectingFWProvider) GetClusterName() (string, error) {
+	return "kube.openfresh.io", nil
+}
+
+func (p *collectingFWProvider) Rules() ([]*inbound.InboundRules, error) {
+	return nil, nil
+}
+
+func (p *collectingFWProvider) ApplyChanges(changes *fwplan.Changes) error {
+	return nil
+}
+
+func (p *collectingFWProvider) Orphans() ([]string, error) {
+	return p.orphans, nil
+}
+
+func (p *collectingFWProvider) DeleteOrphan(name string) error {
+	if p.failing[name] {
+		return errors.New("still in use")
+	}
+	p.deleted = append(p.deleted, name)
+	return nil
+}
+
+func TestCollectGarbage(t *testing.T) {
+	now := time.Now()
+	p := &collectingFWProvider{
+		orphans: []string{"foo.kube.openfresh.io", "bar.kube.openfresh.io"},
+	}
+	fwr, err := fwregistry.NewRegistry(p, 0)
+	require.NoError(t, err)
+
+	c := &Controller{
+		FwRegistry:            fwr,
+		FirewallGCInterval:    time.Minute,
+		FirewallGCGracePeriod: 10 * time.Minute,
+	}
+	// bar is about to be attached to its instances
+	desired := []*inbound.InboundRules{{Name: "bar.kube.openfresh.io"}}
+
+	require.NoError(t, c.collectGarbage(desired, now))
+	assert.Empty(t, p.deleted)
+
+	// nothing happens before the next interval, even after the grace period
+	c.lastGC = now.Add(10 * time.Minute)
+	require.NoError(t, c.collectGarbage(desired, now.Add(10*time.Minute+30*time.Second)))
+	assert.Empty(t, p.deleted)
+
+	require.NoError(t, c.collectGarbage(desired, now.Add(11*time.Minute)))
+	assert.Equal(t, []string{"foo.kube.openfresh.io"}, p.deleted)
+	assert.Empty(t, c.orphans)
+}
+
+func TestCollectGarbageRestartsGracePeriod(t *testing.T) {
+	now := time.Now()
+	p := &collectingFWProvider{
+		orphans: []string{"foo.kube.openfresh.io"},
+	}
+	fwr, err := fwregistry.NewRegistry(p, 0)
+	require.NoError(t, err)
+
+	c := &Controller{
+		FwRegistry:            fwr,
+		FirewallGCInterval:    time.Minute,
+		FirewallGCGracePeriod: 10 * time.Minute,
+	}
+
+	require.NoError(t, c.collectGarbage(nil, now))
+
+	// the group was attached again in the meantime
+	p.orphans = nil
+	require.NoError(t, c.collectGarbage(nil, now.Add(5*time.Minute)))
+
+	p.orphans = []string{"foo.kube.openfresh.io"}
+	require.NoError(t, c.collectGarbage(nil, now.Add(10*time.Minute)))
+	assert.Empty(t, p.deleted)
+	assert.Equal(t, now.Add(10*time.Minute), c.orphans["foo.kube.openfresh.io"])
+}
+
+func TestCollectGarbageFailure(t *testing.T) {
+	now := time.Now()
+	p := &collectingFWProvider{
+		orphans: []string{"foo.kube.openfresh.io"},
+		failing: map[string]bool{"foo.kube.openfresh.io": true},
+	}
+	fwr, err := fwregistry.NewRegistry(p, 0)
+	require.NoError(t, err)
+
+	c := &Controller{
+		FwRegistry:         fwr,
+		FirewallGCInterval: time.Minute,
+	}
+
+	err = c.collectGarbage(nil, now)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "foo.kube.openfresh.io: still in use")
+
+	// the group is retried on the next collection
+	assert.Equal(t, now, c.orphans["foo.kube.openfresh.io"])
+}
+
+func TestCollectGarbageDisabled(t *testing.T) {
+	p := &collectingFWProvider{
+		orphans: []string{"foo.kube.openfresh.io"},
+	}
+	fwr, err := fwregistry.NewRegistry(p, 0)
+	require.NoError(t, err)
+
+	c := &Controller{FwRegistry: fwr}
+	require.NoError(t, c.collectGarbage(nil, time.Now()))
+	assert.Empty(t, p.deleted)
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	eipplan "github.com/openfresh/external-ips/extip/plan"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+const (
+	// reasonPlannedChange is the reason of the events recorded in monitor-only mode
+	reasonPlannedChange = "PlannedChange"
+)
+
+var driftChanges = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "external_ips",
+		Subsystem: "controller",
+		Name:      "drift_changes",
+		Help:      "Number of changes planned by the last full synchronization, applied or not, by subsystem.",
+	},
+	[]string{"subsystem"},
+)
+
+func init() {
+	prometheus.MustRegister(driftChanges)
+}
+
+// change is a planned change, described for the logs and events of monitor-only mode.
+type change struct {
+	// the service the change is made for, empty if unknown
+	namespace string
+	name      string
+
+	description string
+}
+
+// planned exports the number of changes planned for the subsystem, notifies them
+// if they make a large plan, and returns whether they may be applied. In monitor-only
+// mode, the changes are logged and recorded as events on their service instead.
+func (c *Controller) planned(subsystem string, scope *serviceScope, changes []change) bool {
+	// a single service doesn't tell the drift of the whole subsystem
+	if scope == nil {
+		driftChanges.WithLabelValues(subsystem).Set(float64(len(changes)))
+	}
+	c.tracePlan(subsystem, changes)
+	c.largePlan(subsystem, changes)
+	if !c.MonitorOnly {
+		return true
+	}
+
+	for _, ch := range changes {
+		log.Infof("Monitor-only, not applying %s change: %s", subsystem, ch.description)
+		c.event(ch, reasonPlannedChange, subsystem)
+	}
+	return false
+}
+
+// event records the change as an event on its service, if attributed to one.
+func (c *Controller) event(ch change, reason, subsystem string) {
+	if c.Events == nil || ch.namespace == "" || ch.name == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "Service",
+		Namespace: ch.namespace,
+		Name:      ch.name,
+	}
+	c.Events.Eventf(ref, v1.EventTypeNormal, reason, "%s: %s", subsystem, ch.description)
+}
+
+// recordChanges describes the changes of a DNS plan, attributed to the service of their resource label.
+func recordChanges(changes *plan.Changes) []change {
+	var result []change
+	for _, ep := range changes.Create {
+		result = append(result, recordChange("CREATE", ep))
+	}
+	for _, ep := range changes.UpdateNew {
+		result = append(result, recordChange("UPDATE", ep))
+	}
+	for _, ep := range changes.Delete {
+		result = append(result, recordChange("DELETE", ep))
+	}
+	return result
+}
+
+func recordChange(action string, ep *endpoint.Endpoint) change {
+	ch := change{description: fmt.Sprintf("%s %s", action, ep)}
+	parts := strings.SplitN(ep.Labels[endpoint.ResourceLabelKey], "/", 3)
+	if len(parts) == 3 && parts[0] == "service" {
+		ch.namespace, ch.name = parts[1], parts[2]
+	}
+	return ch
+}
+
+// ruleChanges describes the changes of a firewall plan. The inbound rules only
+// carry the name of their security group, so the changes aren't attributed.
+func ruleChanges(changes *fwplan.Changes) []change {
+	var result []change
+	for _, r := range changes.Create {
+		result = append(result, change{description: fmt.Sprintf("CREATE %s", r)})
+	}
+	for _, r := range changes.UpdateNew {
+		result = append(result, change{description: fmt.Sprintf("UPDATE %s", r)})
+	}
+	for _, r := range changes.Delete {
+		result = append(result, change{description: fmt.Sprintf("DELETE %s", r)})
+	}
+	for _, i := range changes.Set {
+		result = append(result, change{description: fmt.Sprintf("SET %s on %s", i.RulesName, i.ProviderID)})
+	}
+	for _, i := range changes.Unset {
+		result = append(result, change{description: fmt.Sprintf("UNSET %s on %s", i.RulesName, i.ProviderID)})
+	}
+	return result
+}
+
+// extIPChanges describes the changes of an external IPs plan.
+func extIPChanges(changes *eipplan.Changes) []change {
+	var result []change
+	for _, e := range changes.Create {
+		result = append(result, change{
+			namespace:   e.Namespace,
+			name:        e.SvcName,
+			description: fmt.Sprintf("CREATE ExternalIPs %s", strings.Join(e.ExtIPs, ";")),
+		})
+	}
+	for _, e := range changes.UpdateNew {
+		result = append(result, change{
+			namespace:   e.Namespace,
+			name:        e.SvcName,
+			description: fmt.Sprintf("UPDATE ExternalIPs %s", strings.Join(e.ExtIPs, ";")),
+		})
+	}
+	for _, e := range changes.Delete {
+		result = append(result, change{
+			namespace:   e.Namespace,
+			name:        e.SvcName,
+			description: "DELETE ExternalIPs",
+		})
+	}
+	return result
+}
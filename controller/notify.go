@@ -0,0 +1,52 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/notify"
+)
+
+// notifyChanges notifies the changes of the subsystem, if any, and if a notifier is configured.
+func (c *Controller) notifyChanges(kind, subsystem string, changes []change) {
+	if c.Notifier == nil || len(changes) == 0 {
+		return
+	}
+	descriptions := make([]string, 0, len(changes))
+	for _, ch := range changes {
+		descriptions = append(descriptions, ch.description)
+	}
+	c.notify(notify.NewEvent(kind, subsystem, descriptions, time.Now()))
+}
+
+// notifyFailing notifies that the subsystem was paused after consecutive failures.
+func (c *Controller) notifyFailing(subsystem string, err error) {
+	if c.Notifier == nil {
+		return
+	}
+	c.notify(&notify.Event{
+		Kind:      notify.KindFailing,
+		Subsystem: subsystem,
+		Time:      time.Now(),
+		Error:     err.Error(),
+		Failures:  c.FailureThreshold,
+	})
+}
+
+// notify sends the event, the failures are only logged as they don't fail the synchronization.
+func (c *Controller) notify(e *notify.Event) {
+	if err := c.Notifier.Notify(e); err != nil {
+		log.Warnf("Failed to notify the %s %s event: %v", e.Subsystem, e.Kind, err)
+	}
+}
+
+// largePlan notifies the changes if they're at least LargePlan.
+func (c *Controller) largePlan(subsystem string, changes []change) {
+	if c.LargePlan > 0 && len(changes) >= c.LargePlan {
+		c.notifyChanges(notify.KindLargePlan, subsystem, changes)
+	}
+}
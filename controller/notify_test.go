@@ -0,0 +1,83 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/notify"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// recordingNotifier records the notified events.
+type recordingNotifier struct {
+	mu     sync.Mutex
+	events []*notify.Event
+}
+
+func (n *recordingNotifier) Notify(e *notify.Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.events = append(n.events, e)
+	return nil
+}
+
+func TestNotifyApplied(t *testing.T) {
+	dnsProvider := provider.NewInMemoryProvider()
+	require.NoError(t, dnsProvider.CreateZone("example.org"))
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	notifier := &recordingNotifier{}
+	ctrl := &Controller{Policy: &plan.SyncPolicy{}, Notifier: notifier, LargePlan: 2}
+
+	desired := []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}
+	require.NoError(t, ctrl.syncRecords("dns", r, desired, nil))
+	require.Len(t, notifier.events, 1)
+	assert.Equal(t, notify.KindApplied, notifier.events[0].Kind)
+	assert.Equal(t, "dns", notifier.events[0].Subsystem)
+	assert.Equal(t, "1 CREATE", notifier.events[0].Summary)
+
+	// nothing changes, nothing is notified
+	require.NoError(t, ctrl.syncRecords("dns", r, desired, nil))
+	require.Len(t, notifier.events, 1)
+
+	// the large plans are notified before being applied
+	desired = []*endpoint.Endpoint{
+		endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+		endpoint.NewEndpoint("baz.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+	}
+	require.NoError(t, ctrl.syncRecords("dns", r, desired, nil))
+	require.Len(t, notifier.events, 3)
+	assert.Equal(t, notify.KindLargePlan, notifier.events[1].Kind)
+	assert.Equal(t, "2 CREATE, 1 DELETE", notifier.events[1].Summary)
+	assert.Equal(t, notify.KindApplied, notifier.events[2].Kind)
+	assert.Len(t, notifier.events[2].Changes, 3)
+}
+
+func TestNotifyFailing(t *testing.T) {
+	notifier := &recordingNotifier{}
+	ctrl := &Controller{Notifier: notifier, FailureThreshold: 2, FailurePause: time.Hour}
+	s := subsystem{"dns", func(*setting.ExternalIPSetting) error { return errors.New("throttled") }}
+
+	assert.Error(t, ctrl.syncSubsystem(s, &setting.ExternalIPSetting{}))
+	assert.Empty(t, notifier.events)
+
+	// the subsystem is notified once paused
+	assert.Error(t, ctrl.syncSubsystem(s, &setting.ExternalIPSetting{}))
+	require.Len(t, notifier.events, 1)
+	assert.Equal(t, notify.KindFailing, notifier.events[0].Kind)
+	assert.Equal(t, "throttled", notifier.events[0].Error)
+	assert.Equal(t, 2, notifier.events[0].Failures)
+}
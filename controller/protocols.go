@@ -0,0 +1,64 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// reasonUnsupportedProtocol is the reason of the events recorded for the ports not
+// opened as the firewall provider doesn't support their protocol
+const reasonUnsupportedProtocol = "UnsupportedProtocol"
+
+// supportedRules returns the desired rules without the ones of the protocols the
+// firewall provider doesn't support, which would fail their whole security group,
+// reporting them on their service. The desired rules aren't modified.
+func (c *Controller) supportedRules(desired []*inbound.InboundRules, protocols []string) []*inbound.InboundRules {
+	result := make([]*inbound.InboundRules, 0, len(desired))
+	for _, r := range desired {
+		var unsupported []inbound.InboundRule
+		for _, rule := range r.Rules {
+			if !inbound.SupportsProtocol(protocols, rule.Protocol) {
+				unsupported = append(unsupported, rule)
+			}
+		}
+		if len(unsupported) == 0 {
+			result = append(result, r)
+			continue
+		}
+
+		supported := *r
+		supported.Rules = make([]inbound.InboundRule, 0, len(r.Rules)-len(unsupported))
+		for _, rule := range r.Rules {
+			if inbound.SupportsProtocol(protocols, rule.Protocol) {
+				supported.Rules = append(supported.Rules, rule)
+			}
+		}
+		for _, rule := range unsupported {
+			log.Errorf("Not opening %s of security group %s, the firewall provider doesn't support protocol %s, only %s", rule.Description, r.Name, rule.Protocol, strings.Join(protocols, ", "))
+			c.unsupportedProtocol(r.Resource, rule, protocols)
+		}
+		result = append(result, &supported)
+	}
+	return result
+}
+
+// unsupportedProtocol records a warning event on the service of the rule.
+func (c *Controller) unsupportedProtocol(resource string, rule inbound.InboundRule, protocols []string) {
+	parts := strings.SplitN(resource, "/", 2)
+	if c.Events == nil || len(parts) != 2 {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "Service",
+		Namespace: parts[0],
+		Name:      parts[1],
+	}
+	c.Events.Eventf(ref, v1.EventTypeWarning, reasonUnsupportedProtocol, "%s isn't opened, the firewall provider doesn't support protocol %s, only %s", rule.Description, rule.Protocol, strings.Join(protocols, ", "))
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// TestSupportedRules tests that the rules of the protocols the firewall provider doesn't
+// support are left out and recorded as events on their service.
+func TestSupportedRules(t *testing.T) {
+	desired := []*inbound.InboundRules{
+		{Name: "foo", Resource: "default/foo", Rules: []inbound.InboundRule{
+			{Protocol: inbound.ProtocolTCP, Port: 80, Description: "default/foo/http"},
+			{Protocol: inbound.ProtocolSCTP, Port: 3868, Description: "default/foo/diameter"},
+		}},
+		{Name: "bar", Resource: "default/bar", Rules: []inbound.InboundRule{
+			{Protocol: inbound.ProtocolUDP, Port: 53, Description: "default/bar/dns"},
+		}},
+	}
+
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &Controller{Events: recorder}
+	supported := ctrl.supportedRules(desired, inbound.DefaultProtocols)
+
+	require.Len(t, supported, 2)
+	assert.Equal(t, []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 80, Description: "default/foo/http"}}, supported[0].Rules)
+	assert.True(t, desired[1] == supported[1])
+	// the desired rules are left alone
+	assert.Len(t, desired[0].Rules, 2)
+
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning UnsupportedProtocol default/foo/diameter isn't opened, the firewall provider doesn't support protocol sctp, only tcp, udp")
+
+	// a provider supporting SCTP opens them all
+	supported = ctrl.supportedRules(desired, []string{inbound.ProtocolTCP, inbound.ProtocolUDP, inbound.ProtocolSCTP})
+	assert.Len(t, supported[0].Rules, 2)
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/registry"
+)
+
+var repairedRecords = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "external_ips",
+		Subsystem: "controller",
+		Name:      "repaired_records_total",
+		Help:      "Number of records whose ownership was restored, by subsystem.",
+	},
+	[]string{"subsystem"},
+)
+
+func init() {
+	prometheus.MustRegister(repairedRecords)
+}
+
+// repairOwnership restores the ownership of the current records desired by the
+// resources of the full synchronization, when RepairOwnership is set and the
+// registry supports it, so that the plan manages them again. Nothing is repaired
+// while the changes aren't applied. A failed repair leaves the records unowned
+// until the next full synchronization rather than failing this one.
+func (c *Controller) repairOwnership(subsystem string, r registry.Registry, records, desired []*endpoint.Endpoint) {
+	repairer, ok := r.(registry.Repairer)
+	if !c.RepairOwnership || !ok || c.MonitorOnly || c.DryRun {
+		return
+	}
+	start := time.Now()
+	repaired, err := repairer.RepairOwnership(records, desired)
+	c.observe(subsystem, "repair", start, err)
+	if err != nil {
+		log.Errorf("Failed to repair the ownership of the %s records: %v", subsystem, err)
+		return
+	}
+	repairedRecords.WithLabelValues(subsystem).Add(float64(len(repaired)))
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+// repairingRegistry records the records it's asked to repair.
+type repairingRegistry struct {
+	calls int
+	err   error
+}
+
+func (r *repairingRegistry) Records() ([]*endpoint.Endpoint, error) {
+	return nil, nil
+}
+
+func (r *repairingRegistry) ApplyChanges(changes *plan.Changes) error {
+	return nil
+}
+
+func (r *repairingRegistry) RepairOwnership(records, desired []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	r.calls++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return records, nil
+}
+
+func TestRepairOwnership(t *testing.T) {
+	records := []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}
+
+	for _, tc := range []struct {
+		title      string
+		controller *Controller
+		calls      int
+	}{
+		{"disabled", &Controller{}, 0},
+		{"enabled", &Controller{RepairOwnership: true}, 1},
+		{"monitor-only", &Controller{RepairOwnership: true, MonitorOnly: true}, 0},
+		{"dry-run", &Controller{RepairOwnership: true, DryRun: true}, 0},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			r := &repairingRegistry{}
+			tc.controller.repairOwnership("dns", r, records, records)
+			assert.Equal(t, tc.calls, r.calls)
+		})
+	}
+
+	// a failed repair doesn't fail the synchronization
+	r := &repairingRegistry{err: errors.New("throttled")}
+	(&Controller{RepairOwnership: true}).repairOwnership("dns", r, records, records)
+	assert.Equal(t, 1, r.calls)
+}
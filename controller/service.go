@@ -0,0 +1,152 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/setting"
+	"github.com/openfresh/external-ips/source"
+)
+
+// RunService synchronizes a single service, given as namespace/name, leaving the
+// others untouched. It runs a full synchronization instead when the source can't
+// return the setting of a single service.
+func (c *Controller) RunService(key string) (err error) {
+	ts, ok := c.Source.(source.TargetedSource)
+	if !ok {
+		return c.RunOnce()
+	}
+	parts := strings.SplitN(key, "/", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid service key %q, expected namespace/name", key)
+	}
+	scope := &serviceScope{namespace: parts[0], name: parts[1]}
+
+	c.startTrace("sync-service").SetAttribute("service", key)
+	defer func() { c.endTrace(err) }()
+
+	if c.Nodes != nil {
+		if err := c.Nodes.Refresh(); err != nil {
+			return err
+		}
+	}
+
+	var setting *setting.ExternalIPSetting
+	err = c.safely("source", func() error {
+		var err error
+		start := time.Now()
+		setting, err = ts.ServiceSetting(scope.namespace, scope.name)
+		c.observe("source", "service", start, err)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Debugf("Synchronizing service %s", key)
+	return c.syncAll(setting, scope)
+}
+
+// serviceScope limits a synchronization to the records, inbound rules and external
+// IPs of a single service. A nil scope doesn't limit anything.
+type serviceScope struct {
+	namespace string
+	name      string
+}
+
+// records returns the current records labeled with the service or named after its desired
+// endpoints, but the ones named after its endpoints in the inactive slot of a blue/green pair.
+func (s *serviceScope) records(current, desired []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if s == nil {
+		return current
+	}
+
+	resource := fmt.Sprintf("service/%s/%s", s.namespace, s.name)
+	names := make(map[string]bool, len(desired))
+	inactive := map[string]bool{}
+	for _, ep := range desired {
+		names[ep.DNSName] = true
+		if inactiveSlot(ep) {
+			inactive[ep.DNSName] = true
+		}
+	}
+
+	var result []*endpoint.Endpoint
+	for _, ep := range current {
+		if inactive[ep.DNSName] {
+			continue
+		}
+		if ep.Labels[endpoint.ResourceLabelKey] == resource || names[ep.DNSName] {
+			result = append(result, ep)
+		}
+	}
+	return result
+}
+
+// endpoints returns the desired endpoints but the ones in the inactive slot of a
+// blue/green pair. Whether they're published depends on the other slot, which
+// only the full synchronizations see.
+func (s *serviceScope) endpoints(desired []*endpoint.Endpoint) []*endpoint.Endpoint {
+	if s == nil {
+		return desired
+	}
+
+	result := make([]*endpoint.Endpoint, 0, len(desired))
+	for _, ep := range desired {
+		if !inactiveSlot(ep) {
+			result = append(result, ep)
+		}
+	}
+	return result
+}
+
+// inactiveSlot returns true if the endpoint is in the inactive slot of a blue/green pair.
+func inactiveSlot(ep *endpoint.Endpoint) bool {
+	slot := ep.Labels[endpoint.SlotLabelKey]
+	return slot != "" && slot != ep.Labels[endpoint.ActiveSlotLabelKey]
+}
+
+// rules returns the current rules named after the desired ones. The rules of a
+// service which went away are left to the next full synchronization.
+func (s *serviceScope) rules(current, desired []*inbound.InboundRules) []*inbound.InboundRules {
+	if s == nil {
+		return current
+	}
+
+	names := make(map[string]bool, len(desired))
+	for _, r := range desired {
+		names[r.Name] = true
+	}
+
+	var result []*inbound.InboundRules
+	for _, r := range current {
+		if names[r.Name] {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+// extIPs returns the current external IPs of the service.
+func (s *serviceScope) extIPs(current []*extip.ExtIP) []*extip.ExtIP {
+	if s == nil {
+		return current
+	}
+
+	var result []*extip.ExtIP
+	for _, e := range current {
+		if e.SvcName == s.name {
+			result = append(result, e)
+		}
+	}
+	return result
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/setting"
+)
+
+// StateRecorder keeps the desired setting, and the current state and plan of
+// each subsystem, of the latest full synchronization, to be served as JSON when
+// diagnosing e.g. why a record doesn't appear. They're marshaled as they're
+// recorded, as the plans and the next synchronizations modify them afterwards.
+// A nil StateRecorder records nothing.
+type StateRecorder struct {
+	mu    sync.Mutex
+	state State
+}
+
+// State is the snapshot served by a StateRecorder.
+type State struct {
+	// The desired setting extracted from the source, with its time
+	Desired *RecordedState
+	// The current state and the planned changes by subsystem, with their time
+	Subsystems map[string]*SubsystemState
+}
+
+// RecordedState is a part of the state as recorded at Time.
+type RecordedState struct {
+	Time  time.Time
+	State json.RawMessage
+}
+
+// SubsystemState is the current state and the planned changes of a subsystem as
+// computed at Time. The changes are planned, whether they're applied or not, e.g.
+// in monitor-only mode.
+type SubsystemState struct {
+	Time    time.Time
+	Current json.RawMessage
+	Changes json.RawMessage
+}
+
+// NewStateRecorder returns a StateRecorder without recorded state.
+func NewStateRecorder() *StateRecorder {
+	return &StateRecorder{state: State{Subsystems: map[string]*SubsystemState{}}}
+}
+
+// desired records the desired setting extracted at t.
+func (s *StateRecorder) desired(desired *setting.ExternalIPSetting, t time.Time) {
+	if s == nil {
+		return
+	}
+	b, err := json.Marshal(desired)
+	if err != nil {
+		log.Warnf("Failed to record the desired setting: %v", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Desired = &RecordedState{Time: t.UTC(), State: b}
+}
+
+// planned records the current state and the changes of the subsystem planned at t.
+func (s *StateRecorder) planned(subsystem string, current, changes interface{}, t time.Time) {
+	if s == nil {
+		return
+	}
+	c, err := json.Marshal(current)
+	if err != nil {
+		log.Warnf("Failed to record the current %s state: %v", subsystem, err)
+		return
+	}
+	p, err := json.Marshal(changes)
+	if err != nil {
+		log.Warnf("Failed to record the %s plan: %v", subsystem, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.Subsystems[subsystem] = &SubsystemState{Time: t.UTC(), Current: c, Changes: p}
+}
+
+// ServeHTTP writes the recorded state as JSON.
+func (s *StateRecorder) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	s.mu.Lock()
+	b, err := json.MarshalIndent(s.state, "", " ")
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
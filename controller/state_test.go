@@ -0,0 +1,98 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/registry"
+	eipplan "github.com/openfresh/external-ips/extip/plan"
+	eipregistry "github.com/openfresh/external-ips/extip/registry"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+	fwregistry "github.com/openfresh/external-ips/firewall/registry"
+	"github.com/openfresh/external-ips/internal/testutils"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// TestStateRecorder tests that the state of a full synchronization is served,
+// including the changes planned in monitor-only mode.
+func TestStateRecorder(t *testing.T) {
+	source := new(testutils.MockSource)
+	source.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("create-record", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+	}, nil)
+
+	dnsProvider := &recordingProvider{
+		records: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("current-record", endpoint.RecordTypeA, "4.3.2.1"),
+		},
+	}
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(newMockFWProvider(nil, &fwplan.Changes{}), 0)
+	require.NoError(t, err)
+
+	eipr, err := eipregistry.NewRegistry(newMockEipProvider(nil, &eipplan.Changes{}))
+	require.NoError(t, err)
+
+	state := NewStateRecorder()
+	ctrl := &Controller{
+		Source:      source,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Policy:      &plan.SyncPolicy{},
+		MonitorOnly: true,
+		State:       state,
+	}
+	require.NoError(t, ctrl.RunOnce())
+
+	rec := httptest.NewRecorder()
+	state.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/state", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+	var served struct {
+		Desired struct {
+			State setting.ExternalIPSetting
+		}
+		Subsystems map[string]struct {
+			Current []*endpoint.Endpoint
+			Changes plan.Changes
+		}
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &served))
+
+	require.Len(t, served.Desired.State.Endpoints, 1)
+	assert.Equal(t, "create-record", served.Desired.State.Endpoints[0].DNSName)
+
+	assert.Contains(t, served.Subsystems, "extip")
+	assert.Contains(t, served.Subsystems, "firewall")
+	dns := served.Subsystems["dns"]
+	require.Len(t, dns.Current, 1)
+	assert.Equal(t, "current-record", dns.Current[0].DNSName)
+	require.Len(t, dns.Changes.Create, 1)
+	assert.Equal(t, "create-record", dns.Changes.Create[0].DNSName)
+	require.Len(t, dns.Changes.Delete, 1)
+	assert.Equal(t, "current-record", dns.Changes.Delete[0].DNSName)
+}
+
+// TestStateRecorderNil tests that a nil StateRecorder records nothing.
+func TestStateRecorderNil(t *testing.T) {
+	var state *StateRecorder
+	state.desired(&setting.ExternalIPSetting{}, time.Now())
+	state.planned("dns", nil, &plan.Changes{}, time.Now())
+}
@@ -0,0 +1,178 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+var stuckResources = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "external_ips",
+		Subsystem: "controller",
+		Name:      "stuck_resources",
+		Help:      "Zones and security groups whose changes are backed off after failing repeatedly with the same error, by subsystem.",
+	},
+	[]string{"subsystem", "resource"},
+)
+
+func init() {
+	prometheus.MustRegister(stuckResources)
+}
+
+// stuckResource counts the consecutive identical failures of a zone or a security group.
+type stuckResource struct {
+	err      string
+	failures int
+	// the changes of the resource are left out until then
+	until time.Time
+}
+
+// stuckTracker backs off the zones and security groups failing with the same error
+// a number of times in a row, so that a persistent misconfiguration of a single
+// resource, e.g. an AccessDenied on a zone, doesn't fail its whole subsystem on
+// every synchronization. The other resources of the subsystem keep being applied.
+type stuckTracker struct {
+	// the number of consecutive identical failures backing off a resource, 0 disables it
+	threshold int
+	// how long a resource is backed off
+	pause time.Duration
+
+	mu        sync.Mutex
+	resources map[string]map[string]*stuckResource
+}
+
+// stuck returns whether the changes of the resource of the subsystem are backed off at the given time.
+func (t *stuckTracker) stuck(subsystem, resource string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.resources[subsystem][resource]
+	return ok && now.Before(r.until)
+}
+
+// record accounts for an attempt to apply the changes of the subsystem, failed lists
+// the errors of the resources which failed by resource. The resources which didn't fail
+// are cleared, and the resources backed off by this failure are returned.
+func (t *stuckTracker) record(subsystem string, failed map[string]error, now time.Time) []string {
+	if t.threshold <= 0 {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.resources == nil {
+		t.resources = map[string]map[string]*stuckResource{}
+	}
+	resources := t.resources[subsystem]
+	if resources == nil {
+		resources = map[string]*stuckResource{}
+		t.resources[subsystem] = resources
+	}
+
+	for resource, r := range resources {
+		if _, ok := failed[resource]; ok || now.Before(r.until) {
+			continue
+		}
+		delete(resources, resource)
+		stuckResources.DeleteLabelValues(subsystem, resource)
+	}
+
+	var backedOff []string
+	for resource, err := range failed {
+		r, ok := resources[resource]
+		if !ok || r.err != err.Error() {
+			r = &stuckResource{err: err.Error()}
+			resources[resource] = r
+		}
+		r.failures++
+		if r.failures < t.threshold {
+			continue
+		}
+		r.failures = 0
+		r.until = now.Add(t.pause)
+		stuckResources.WithLabelValues(subsystem, resource).Set(1)
+		backedOff = append(backedOff, resource)
+	}
+	return backedOff
+}
+
+// zoneErrors returns the errors of the zones which failed by zone name without trailing
+// dot, and false if the changes failed without telling which zones did.
+func zoneErrors(err error) (map[string]error, bool) {
+	failed := map[string]error{}
+	if err == nil {
+		return failed, true
+	}
+	perr, ok := err.(*plan.PartialError)
+	if !ok {
+		return nil, false
+	}
+	for _, f := range perr.Failed {
+		failed[strings.TrimSuffix(f.Zone, ".")] = f.Err
+	}
+	return failed, true
+}
+
+// groupErrors returns the error of the security group which failed, and false if the
+// changes failed without telling which group did.
+func groupErrors(err error) (map[string]error, bool) {
+	failed := map[string]error{}
+	if err == nil {
+		return failed, true
+	}
+	gerr, ok := err.(*fwplan.GroupError)
+	if !ok {
+		return nil, false
+	}
+	failed[gerr.Group] = gerr.Err
+	return failed, true
+}
+
+// stuckRecords returns whether the change of a record is backed off, as its hostname
+// belongs to one of the zones of the subsystem which are.
+func (t *stuckTracker) stuckRecords(subsystem string, now time.Time) func(*endpoint.Endpoint) bool {
+	t.mu.Lock()
+	var zones []string
+	for zone, r := range t.resources[subsystem] {
+		if now.Before(r.until) {
+			zones = append(zones, zone)
+		}
+	}
+	t.mu.Unlock()
+
+	return func(ep *endpoint.Endpoint) bool {
+		name := strings.TrimSuffix(ep.DNSName, ".")
+		for _, zone := range zones {
+			if name == zone || strings.HasSuffix(name, "."+zone) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// stuckRules returns whether the change of a security group, given by its name, is backed off.
+func (t *stuckTracker) stuckRules(subsystem string, now time.Time) func(string) bool {
+	return func(name string) bool {
+		return t.stuck(subsystem, name, now)
+	}
+}
+
+// logStuck logs the resources backed off after their repeated failures.
+func (t *stuckTracker) logStuck(subsystem string, backedOff []string) {
+	for _, resource := range backedOff {
+		log.Errorf("Backing off the %s changes of %s for %s after %d consecutive identical failures", subsystem, resource, t.pause, t.threshold)
+	}
+}
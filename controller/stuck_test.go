@@ -0,0 +1,66 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+)
+
+func TestStuckTracker(t *testing.T) {
+	now := time.Now()
+	tracker := &stuckTracker{threshold: 2, pause: time.Minute}
+	denied := map[string]error{"example.org": errors.New("AccessDenied")}
+
+	assert.Empty(t, tracker.record("dns", denied, now))
+	// a different error starts the count over
+	assert.Empty(t, tracker.record("dns", map[string]error{"example.org": errors.New("Throttling")}, now))
+	assert.Empty(t, tracker.record("dns", denied, now))
+	assert.Equal(t, []string{"example.org"}, tracker.record("dns", denied, now))
+
+	stuck := tracker.stuckRecords("dns", now)
+	assert.True(t, stuck(endpoint.NewEndpoint("foo.example.org.", endpoint.RecordTypeA, "1.2.3.4")))
+	assert.True(t, stuck(endpoint.NewEndpoint("example.org", endpoint.RecordTypeA, "1.2.3.4")))
+	assert.False(t, stuck(endpoint.NewEndpoint("fooexample.org", endpoint.RecordTypeA, "1.2.3.4")))
+	assert.False(t, tracker.stuckRecords("internal-dns", now)(endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")))
+
+	// the zone is retried once the pause is over, and cleared when it succeeds
+	later := now.Add(time.Minute)
+	assert.False(t, tracker.stuckRecords("dns", later)(endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")))
+	assert.Empty(t, tracker.record("dns", map[string]error{}, later))
+	assert.Empty(t, tracker.resources["dns"])
+}
+
+func TestStuckTrackerDisabled(t *testing.T) {
+	now := time.Now()
+	tracker := &stuckTracker{}
+	for i := 0; i < 10; i++ {
+		assert.Empty(t, tracker.record("firewall", map[string]error{"sg": errors.New("failed")}, now))
+	}
+	assert.False(t, tracker.stuckRules("firewall", now)("sg"))
+}
+
+func TestResourceErrors(t *testing.T) {
+	failed, ok := zoneErrors(&plan.PartialError{Failed: []plan.ZoneError{{Zone: "example.org.", Err: errors.New("AccessDenied")}}})
+	assert.True(t, ok)
+	assert.Contains(t, failed, "example.org")
+	_, ok = zoneErrors(errors.New("failed"))
+	assert.False(t, ok)
+
+	failed, ok = groupErrors(fwplan.WrapGroupError("sg", errors.New("AccessDenied")))
+	assert.True(t, ok)
+	assert.Contains(t, failed, "sg")
+	failed, ok = groupErrors(nil)
+	assert.True(t, ok)
+	assert.Empty(t, failed)
+	_, ok = groupErrors(errors.New("failed"))
+	assert.False(t, ok)
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/openfresh/external-ips/trace"
+)
+
+// startTrace starts the trace of a synchronization, whose steps are traced under
+// it until endTrace.
+func (c *Controller) startTrace(name string) *trace.Span {
+	c.spansMu.Lock()
+	defer c.spansMu.Unlock()
+
+	c.root = c.Tracer.Start(name, time.Now())
+	c.spans = map[string]*trace.Span{}
+	return c.root
+}
+
+// endTrace ends the trace of the synchronization and exports it.
+func (c *Controller) endTrace(err error) {
+	c.spansMu.Lock()
+	root := c.root
+	c.root = nil
+	c.spans = nil
+	c.spansMu.Unlock()
+
+	root.End(err)
+}
+
+// startSubsystem starts the span of a subsystem, under which its steps are traced.
+func (c *Controller) startSubsystem(subsystem string) *trace.Span {
+	c.spansMu.Lock()
+	defer c.spansMu.Unlock()
+
+	span := c.root.Child(subsystem, time.Now())
+	if span != nil {
+		c.spans[subsystem] = span
+	}
+	return span
+}
+
+// endSubsystem ends the span of a subsystem, its later steps being traced under
+// the synchronization.
+func (c *Controller) endSubsystem(subsystem string, err error) {
+	c.spansMu.Lock()
+	span := c.spans[subsystem]
+	delete(c.spans, subsystem)
+	c.spansMu.Unlock()
+
+	span.End(err)
+}
+
+// span returns the span of the subsystem, or of the synchronization when the
+// subsystem isn't being synchronized, nil when nothing is traced.
+func (c *Controller) span(subsystem string) *trace.Span {
+	c.spansMu.Lock()
+	defer c.spansMu.Unlock()
+
+	if span, ok := c.spans[subsystem]; ok {
+		return span
+	}
+	return c.root
+}
+
+// observe records the time elapsed since start for the given step, and traces it
+// under its subsystem.
+func (c *Controller) observe(subsystem, operation string, start time.Time, err error) {
+	observeSince(subsystem, operation, start)
+	c.span(subsystem).Child(subsystem+"."+operation, start).End(err)
+}
+
+// tracePlan sets the number of changes planned on the span of the subsystem.
+func (c *Controller) tracePlan(subsystem string, changes []change) {
+	c.span(subsystem).SetAttribute("changes", strconv.Itoa(len(changes)))
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/setting"
+	"github.com/openfresh/external-ips/trace"
+)
+
+// tracedSpan is the part of the exported spans checked by the tests.
+type tracedSpan struct {
+	SpanID       string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId"`
+	Name         string `json:"name"`
+}
+
+func TestTraceSync(t *testing.T) {
+	var spans []tracedSpan
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []tracedSpan `json:"spans"`
+				} `json:"scopeSpans"`
+			} `json:"resourceSpans"`
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		spans = req.ResourceSpans[0].ScopeSpans[0].Spans
+	}))
+	defer server.Close()
+
+	dnsProvider := provider.NewInMemoryProvider()
+	require.NoError(t, dnsProvider.CreateZone("example.org"))
+	r, err := registry.NewNoopRegistry(dnsProvider)
+	require.NoError(t, err)
+	tracer, err := trace.NewTracer(server.URL, "external-ips", nil)
+	require.NoError(t, err)
+	ctrl := &Controller{Policy: &plan.SyncPolicy{}, Tracer: tracer}
+
+	desired := []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}
+	s := subsystem{"dns", func(*setting.ExternalIPSetting) error { return ctrl.syncRecords("dns", r, desired, nil) }}
+	ctrl.startTrace("sync")
+	require.NoError(t, ctrl.syncSubsystem(s, &setting.ExternalIPSetting{}))
+	ctrl.endTrace(nil)
+
+	names := make([]string, len(spans))
+	byName := map[string]tracedSpan{}
+	for i, s := range spans {
+		names[i] = s.Name
+		byName[s.Name] = s
+	}
+	assert.Equal(t, []string{"dns.records", "dns.plan", "dns.apply", "dns", "sync"}, names)
+	assert.Equal(t, byName["sync"].SpanID, byName["dns"].ParentSpanID)
+	for _, name := range []string{"dns.records", "dns.plan", "dns.apply"} {
+		assert.Equal(t, byName["dns"].SpanID, byName[name].ParentSpanID, name)
+	}
+}
+
+func TestTraceDisabled(t *testing.T) {
+	ctrl := &Controller{}
+	ctrl.startTrace("sync")
+	ctrl.startSubsystem("dns")
+	assert.Nil(t, ctrl.span("dns"))
+	ctrl.tracePlan("dns", nil)
+	ctrl.endSubsystem("dns", nil)
+	ctrl.endTrace(nil)
+}
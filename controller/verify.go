@@ -0,0 +1,38 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+// reasonPropagationFailed is the reason of the events recorded for the records
+// not served as desired after being applied
+const reasonPropagationFailed = "PropagationFailed"
+
+// verify checks in the background that the created and updated records end up
+// served by their name servers, if a verifier is configured.
+func (c *Controller) verify(changes *plan.Changes) {
+	if c.Verifier == nil || changes == nil {
+		return
+	}
+	c.Verifier.Verify(append(append([]*endpoint.Endpoint{}, changes.Create...), changes.UpdateNew...), c.propagationFailed)
+}
+
+// propagationFailed records a warning event on the service of the record.
+func (c *Controller) propagationFailed(ep *endpoint.Endpoint, err error) {
+	ch := recordChange("APPLY", ep)
+	if c.Events == nil || ch.namespace == "" || ch.name == "" {
+		return
+	}
+	ref := &v1.ObjectReference{
+		Kind:      "Service",
+		Namespace: ch.namespace,
+		Name:      ch.name,
+	}
+	c.Events.Eventf(ref, v1.EventTypeWarning, reasonPropagationFailed, "%s isn't served as desired: %v", ep, err)
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package controller
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/verify"
+)
+
+// TestVerifyRecordsEvent tests that the applied records which aren't served as
+// desired are recorded as events on their service.
+func TestVerifyRecordsEvent(t *testing.T) {
+	created := endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")
+	created.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+
+	recorder := record.NewFakeRecorder(10)
+	ctrl := &Controller{
+		Verifier: &verify.Verifier{
+			NameServers: func(ctx context.Context, host string) ([]string, error) {
+				return nil, errors.New("no name server found")
+			},
+		},
+		Events: recorder,
+	}
+
+	ctrl.verify(&plan.Changes{
+		Create: []*endpoint.Endpoint{created},
+		// only the A records are verified
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeTXT, "heritage=external-ips")},
+	})
+
+	ctrl.Verifier.Wait()
+	require.Len(t, recorder.Events, 1)
+	assert.Contains(t, <-recorder.Events, "Warning PropagationFailed foo.example.org 0 IN A 1.2.3.4 isn't served as desired: no name server found")
+
+	// nothing is verified without a verifier
+	ctrl.Verifier = nil
+	ctrl.verify(&plan.Changes{Create: []*endpoint.Endpoint{created}})
+}
@@ -0,0 +1,374 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package diagram renders the relationships of the exposed services with the
+// nodes they're selected on, their security groups and their DNS records, along
+// with the changes pending on them, as a diagram reviewed before applying them.
+package diagram
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/source"
+)
+
+// The formats of the diagrams.
+const (
+	FormatMermaid = "mermaid"
+	FormatDot     = "dot"
+)
+
+// The kinds of the elements of a diagram.
+const (
+	KindService = "service"
+	KindNode    = "node"
+	KindGroup   = "group"
+	KindRecord  = "record"
+)
+
+// The pending changes of the elements, none if unchanged.
+const (
+	ChangeNone   = ""
+	ChangeCreate = "create"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// RuleLister lists the current inbound rules, e.g. the firewall registry.
+type RuleLister interface {
+	Rules() ([]*inbound.InboundRules, error)
+}
+
+// Diagram plans the changes of the records and of the security groups from the
+// desired setting, like a synchronization does, without applying them.
+type Diagram struct {
+	Source source.Source
+	// The registry of the records, nil leaves the records out
+	Registry registry.Registry
+	// The policy that defines which changes to DNS records are allowed
+	Policy plan.Policy
+	// The current inbound rules, nil leaves the security groups out
+	Rules RuleLister
+}
+
+// Element is a service, a node, a security group or a record of a graph.
+type Element struct {
+	Kind   string
+	Name   string
+	Change string
+}
+
+// id returns the identifier of the element in the rendered diagrams.
+func (e *Element) id() string {
+	return e.Kind + "_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, e.Name)
+}
+
+// label returns the text of the element, along with its pending change.
+func (e *Element) label() string {
+	if e.Change == ChangeNone {
+		return e.Name
+	}
+	return fmt.Sprintf("%s (%s)", e.Name, strings.ToUpper(e.Change))
+}
+
+// Edge links two elements of a graph.
+type Edge struct {
+	From, To *Element
+}
+
+// Graph holds the elements and their links, services to their records and
+// security groups, and security groups to their nodes.
+type Graph struct {
+	elements map[string]*Element
+	edges    map[[2]string]Edge
+}
+
+func newGraph() *Graph {
+	return &Graph{elements: map[string]*Element{}, edges: map[[2]string]Edge{}}
+}
+
+// element returns the element of the given kind and name, adding it if needed.
+func (g *Graph) element(kind, name string) *Element {
+	e := &Element{Kind: kind, Name: name}
+	if existing, ok := g.elements[e.id()]; ok {
+		return existing
+	}
+	g.elements[e.id()] = e
+	return e
+}
+
+func (g *Graph) link(from, to *Element) {
+	g.edges[[2]string{from.id(), to.id()}] = Edge{From: from, To: to}
+}
+
+// Elements returns the elements sorted by kind and name.
+func (g *Graph) Elements() []*Element {
+	result := make([]*Element, 0, len(g.elements))
+	for _, e := range g.elements {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Kind != result[j].Kind {
+			return result[i].Kind < result[j].Kind
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Edges returns the edges sorted by their elements.
+func (g *Graph) Edges() []Edge {
+	keys := make([][2]string, 0, len(g.edges))
+	for k := range g.edges {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	result := make([]Edge, 0, len(keys))
+	for _, k := range keys {
+		result = append(result, g.edges[k])
+	}
+	return result
+}
+
+// Run plans the changes and returns the graph of the desired and current elements.
+func (d *Diagram) Run() (*Graph, error) {
+	desired, err := d.Source.ExternalIPSetting()
+	if err != nil {
+		return nil, err
+	}
+	g := newGraph()
+
+	if d.Rules != nil {
+		current, err := d.Rules.Rules()
+		if err != nil {
+			return nil, err
+		}
+		desiredRules := fwplan.AdoptCurrentNames(current, desired.InboundRules)
+		changes := (&fwplan.Plan{Current: current, Desired: desiredRules}).Calculate().Changes
+		g.addRules(desiredRules, current, changes)
+	}
+
+	if d.Registry != nil {
+		current, err := d.Registry.Records()
+		if err != nil {
+			return nil, err
+		}
+		changes := (&plan.Plan{
+			Policies: []plan.Policy{d.Policy},
+			Current:  current,
+			Desired:  desired.Endpoints,
+		}).Calculate().Changes
+		g.addRecords(desired.Endpoints, changes)
+	}
+
+	return g, nil
+}
+
+// addRules adds the security groups of the services, linked to their nodes.
+func (g *Graph) addRules(desired, current []*inbound.InboundRules, changes *fwplan.Changes) {
+	change := map[string]string{}
+	for _, r := range changes.Create {
+		change[r.Name] = ChangeCreate
+	}
+	for _, r := range changes.UpdateNew {
+		change[r.Name] = ChangeUpdate
+	}
+	for _, r := range changes.Delete {
+		change[r.Name] = ChangeDelete
+	}
+	// the nodes joining or leaving a security group change its membership
+	membership := map[[2]string]string{}
+	for _, r := range changes.Set {
+		membership[[2]string{r.RulesName, r.ProviderID}] = ChangeCreate
+	}
+	for _, r := range changes.Unset {
+		membership[[2]string{r.RulesName, r.ProviderID}] = ChangeDelete
+	}
+
+	add := func(r *inbound.InboundRules) {
+		group := g.element(KindGroup, r.Name)
+		group.Change = change[r.Name]
+		if r.Resource != "" {
+			g.link(g.element(KindService, r.Resource), group)
+		}
+		for _, providerID := range r.ProviderIDs {
+			g.linkNode(group, providerID, membership[[2]string{r.Name, providerID}])
+		}
+	}
+	for _, r := range desired {
+		add(r)
+	}
+	for _, r := range current {
+		if change[r.Name] == ChangeDelete {
+			add(r)
+		}
+	}
+	// the nodes leaving a group are linked to it even if it's desired without them
+	for key, c := range membership {
+		if c == ChangeDelete {
+			g.linkNode(g.element(KindGroup, key[0]), key[1], c)
+		}
+	}
+}
+
+// linkNode links the security group to the node, the change of the membership of
+// the node being carried by the edge rather than by the node, which may be in
+// several groups.
+func (g *Graph) linkNode(group *Element, providerID, change string) {
+	n := g.element(KindNode, providerID)
+	if change != ChangeNone {
+		n = &Element{Kind: KindNode, Name: providerID, Change: change}
+	}
+	g.link(group, n)
+}
+
+// addRecords adds the records of the services, and the records deleted.
+func (g *Graph) addRecords(desired []*endpoint.Endpoint, changes *plan.Changes) {
+	change := map[string]string{}
+	for _, ep := range changes.Create {
+		change[recordName(ep)] = ChangeCreate
+	}
+	for _, ep := range changes.UpdateNew {
+		change[recordName(ep)] = ChangeUpdate
+	}
+	for _, ep := range changes.Delete {
+		change[recordName(ep)] = ChangeDelete
+	}
+
+	add := func(ep *endpoint.Endpoint) {
+		record := g.element(KindRecord, recordName(ep))
+		record.Change = change[record.Name]
+		if resource := ep.Labels[endpoint.ResourceLabelKey]; resource != "" {
+			g.link(g.element(KindService, strings.TrimPrefix(resource, "service/")), record)
+		}
+	}
+	for _, ep := range desired {
+		add(ep)
+	}
+	for _, ep := range changes.Delete {
+		add(ep)
+	}
+}
+
+// recordName returns the name of the element of the record, its hostname and type.
+func recordName(ep *endpoint.Endpoint) string {
+	return strings.TrimSuffix(ep.DNSName, ".") + " " + ep.RecordType
+}
+
+// Render writes the graph in the given format.
+func (g *Graph) Render(w io.Writer, format string) error {
+	switch format {
+	case FormatMermaid:
+		g.mermaid(w)
+	case FormatDot:
+		g.dot(w)
+	default:
+		return fmt.Errorf("unknown diagram format %q", format)
+	}
+	return nil
+}
+
+// mermaid writes the graph as a Mermaid flowchart, the pending changes styled by class.
+func (g *Graph) mermaid(w io.Writer) {
+	fmt.Fprintln(w, "flowchart LR")
+	for _, e := range g.Elements() {
+		fmt.Fprintf(w, "  %s%s\n", e.id(), mermaidShape(e))
+	}
+	for _, edge := range g.Edges() {
+		to := edge.To
+		if to.Change != ChangeNone && to.Kind == KindNode {
+			// the membership changes are drawn as labelled edges to the node
+			fmt.Fprintf(w, "  %s -. %s .-> %s\n", edge.From.id(), to.Change, to.id())
+			continue
+		}
+		fmt.Fprintf(w, "  %s --> %s\n", edge.From.id(), to.id())
+	}
+	fmt.Fprintln(w, "  classDef create fill:#d4f7d4,stroke:#2e7d32")
+	fmt.Fprintln(w, "  classDef update fill:#fff4c2,stroke:#f9a825")
+	fmt.Fprintln(w, "  classDef delete fill:#fbd5d5,stroke:#c62828,stroke-dasharray:4")
+	for _, e := range g.Elements() {
+		if e.Change != ChangeNone {
+			fmt.Fprintf(w, "  class %s %s\n", e.id(), e.Change)
+		}
+	}
+}
+
+func mermaidShape(e *Element) string {
+	label := strings.Replace(e.label(), "\"", "'", -1)
+	switch e.Kind {
+	case KindService:
+		return fmt.Sprintf("([\"%s\"])", label)
+	case KindGroup:
+		return fmt.Sprintf("{{\"%s\"}}", label)
+	case KindRecord:
+		return fmt.Sprintf("[/\"%s\"/]", label)
+	}
+	return fmt.Sprintf("[\"%s\"]", label)
+}
+
+// dot writes the graph in the Graphviz DOT language, the pending changes colored.
+func (g *Graph) dot(w io.Writer) {
+	fmt.Fprintln(w, "digraph plan {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, e := range g.Elements() {
+		fmt.Fprintf(w, "  %s [label=%q, shape=%s%s];\n", e.id(), e.label(), dotShape(e.Kind), dotStyle(e.Change))
+	}
+	for _, edge := range g.Edges() {
+		to := edge.To
+		if to.Change != ChangeNone && to.Kind == KindNode {
+			fmt.Fprintf(w, "  %s -> %s [label=%q, style=dashed%s];\n", edge.From.id(), to.id(), to.Change, dotColor(to.Change))
+			continue
+		}
+		fmt.Fprintf(w, "  %s -> %s;\n", edge.From.id(), to.id())
+	}
+	fmt.Fprintln(w, "}")
+}
+
+func dotShape(kind string) string {
+	switch kind {
+	case KindService:
+		return "ellipse"
+	case KindGroup:
+		return "hexagon"
+	case KindRecord:
+		return "note"
+	}
+	return "box"
+}
+
+func dotStyle(change string) string {
+	if change == ChangeNone {
+		return ""
+	}
+	return ", style=filled, fillcolor=" + map[string]string{
+		ChangeCreate: "palegreen",
+		ChangeUpdate: "lightgoldenrod1",
+		ChangeDelete: "lightpink",
+	}[change]
+}
+
+func dotColor(change string) string {
+	return ", color=" + map[string]string{
+		ChangeCreate: "darkgreen",
+		ChangeUpdate: "goldenrod",
+		ChangeDelete: "red3",
+	}[change]
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package diagram
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/internal/testutils"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// fakeRegistry returns the given records.
+type fakeRegistry struct {
+	records []*endpoint.Endpoint
+}
+
+func (r *fakeRegistry) Records() ([]*endpoint.Endpoint, error) {
+	return r.records, nil
+}
+
+func (r *fakeRegistry) ApplyChanges(changes *plan.Changes) error {
+	panic("the diagram applies nothing")
+}
+
+// fakeFirewall returns the given rules.
+type fakeFirewall struct {
+	rules []*inbound.InboundRules
+}
+
+func (f *fakeFirewall) Rules() ([]*inbound.InboundRules, error) {
+	return f.rules, nil
+}
+
+func newEndpoint(dnsName, resource string) *endpoint.Endpoint {
+	ep := endpoint.NewEndpoint(dnsName, endpoint.RecordTypeA, "1.2.3.4")
+	ep.Labels[endpoint.ResourceLabelKey] = "service/" + resource
+	return ep
+}
+
+func newDiagram() *Diagram {
+	src := new(testutils.MockSource)
+	src.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			newEndpoint("foo.example.org", "default/foo"),
+			newEndpoint("bar.example.org", "default/bar"),
+		},
+		InboundRules: []*inbound.InboundRules{
+			{Name: "foo.kube.openfresh.io", Resource: "default/foo", ProviderIDs: inbound.NewProviderIDs("i-1")},
+			{Name: "bar.kube.openfresh.io", Resource: "default/bar", ProviderIDs: inbound.NewProviderIDs("i-1", "i-3")},
+		},
+	}, nil)
+
+	return &Diagram{
+		Source: src,
+		Registry: &fakeRegistry{records: []*endpoint.Endpoint{
+			newEndpoint("bar.example.org", "default/bar"),
+			newEndpoint("baz.example.org", "default/baz"),
+		}},
+		Policy: &plan.SyncPolicy{},
+		Rules: &fakeFirewall{rules: []*inbound.InboundRules{
+			{Name: "bar.kube.openfresh.io", Resource: "default/bar", ProviderIDs: inbound.NewProviderIDs("i-1", "i-2")},
+		}},
+	}
+}
+
+func TestDiagram(t *testing.T) {
+	g, err := newDiagram().Run()
+	require.NoError(t, err)
+
+	changes := map[string]string{}
+	for _, e := range g.Elements() {
+		changes[e.Kind+" "+e.Name] = e.Change
+	}
+	assert.Equal(t, map[string]string{
+		"group bar.kube.openfresh.io": ChangeNone,
+		"group foo.kube.openfresh.io": ChangeCreate,
+		"node i-1":                    ChangeNone,
+		"node i-2":                    ChangeNone,
+		"node i-3":                    ChangeNone,
+		"record bar.example.org A":    ChangeNone,
+		"record baz.example.org A":    ChangeDelete,
+		"record foo.example.org A":    ChangeCreate,
+		"service default/bar":         ChangeNone,
+		"service default/baz":         ChangeNone,
+		"service default/foo":         ChangeNone,
+	}, changes)
+
+	var out bytes.Buffer
+	require.NoError(t, g.Render(&out, FormatMermaid))
+	mermaid := out.String()
+	assert.Contains(t, mermaid, "flowchart LR\n")
+	assert.Contains(t, mermaid, "  service_default_foo --> group_foo_kube_openfresh_io\n")
+	assert.Contains(t, mermaid, "  group_bar_kube_openfresh_io -. create .-> node_i_3\n")
+	assert.Contains(t, mermaid, "  group_bar_kube_openfresh_io -. delete .-> node_i_2\n")
+	assert.Contains(t, mermaid, "  record_baz_example_org_A[/\"baz.example.org A (DELETE)\"/]\n")
+	assert.Contains(t, mermaid, "  class record_foo_example_org_A create\n")
+
+	out.Reset()
+	require.NoError(t, g.Render(&out, FormatDot))
+	assert.Contains(t, out.String(), "  group_foo_kube_openfresh_io [label=\"foo.kube.openfresh.io (CREATE)\", shape=hexagon, style=filled, fillcolor=palegreen];\n")
+
+	assert.Error(t, g.Render(&out, "svg"))
+}
@@ -44,10 +44,12 @@ func (ttl TTL) IsConfigured() bool {
 // Targets is a representation of a list of targets for an endpoint.
 type Targets []string
 
-// NewTargets is a convenience method to create a new Targets object from a vararg of strings
+// NewTargets is a convenience method to create a new Targets object from a vararg of strings,
+// sorted so that comparing them doesn't need to sort them
 func NewTargets(target ...string) Targets {
 	t := make(Targets, 0, len(target))
 	t = append(t, target...)
+	sort.Sort(t)
 	return t
 }
 
@@ -67,14 +69,21 @@ func (t Targets) Swap(i, j int) {
 	t[i], t[j] = t[j], t[i]
 }
 
-// Same compares to Targets and returns true if they are completely identical
+// Same compares to Targets and returns true if they are completely identical.
+// Neither of them is modified, the targets are compared in their canonical form.
 func (t Targets) Same(o Targets) bool {
 	if len(t) != len(o) {
 		return false
 	}
-	sort.Stable(t)
-	sort.Stable(o)
+	// most targets are listed in the same order, which spares sorting them
+	if t.inOrder(o) {
+		return true
+	}
+	return t.Canonical().inOrder(o.Canonical())
+}
 
+// inOrder returns true if both targets list the same targets in the same order.
+func (t Targets) inOrder(o Targets) bool {
 	for i, e := range t {
 		if e != o[i] {
 			return false
@@ -83,6 +92,20 @@ func (t Targets) Same(o Targets) bool {
 	return true
 }
 
+// Canonical returns the targets sorted. The targets are returned as they are if
+// already sorted, as the targets of NewTargets and of normalized endpoints are,
+// and copied otherwise, so that the targets shared by several endpoints aren't
+// reordered under them.
+func (t Targets) Canonical() Targets {
+	if sort.IsSorted(t) {
+		return t
+	}
+	sorted := make(Targets, len(t))
+	copy(sorted, t)
+	sort.Sort(sorted)
+	return sorted
+}
+
 // IsLess should fulfill the requirement to compare two targets and chosse the 'lesser' one.
 // In the past target was a simple string so simple string comparison could be used. Now we define 'less'
 // as either being the shorter list of targets or where the first entry is less.
@@ -96,9 +119,7 @@ func (t Targets) IsLess(o Targets) bool {
 		return false
 	}
 
-	sort.Sort(t)
-	sort.Sort(o)
-
+	t, o = t.Canonical(), o.Canonical()
 	for i, e := range t {
 		if e != o[i] {
 			return e < o[i]
@@ -107,18 +128,46 @@ func (t Targets) IsLess(o Targets) bool {
 	return false
 }
 
+// ProviderSpecificProperty holds the name and value of a configuration which is specific to individual DNS providers
+type ProviderSpecificProperty struct {
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// ProviderSpecific holds configuration which is specific to individual DNS providers
+type ProviderSpecific []ProviderSpecificProperty
+
+// Get returns the property of the given name, if any.
+func (p ProviderSpecific) Get(name string) (ProviderSpecificProperty, bool) {
+	for _, property := range p {
+		if property.Name == name {
+			return property, true
+		}
+	}
+	return ProviderSpecificProperty{}, false
+}
+
 // Endpoint is a high-level way of a connection between a service and an IP
 type Endpoint struct {
 	// The hostname of the DNS record
 	DNSName string
 	// The targets the DNS record points to
 	Targets Targets
+	// The targets the DNS record points to in the private zones, Targets if empty
+	PrivateTargets Targets
 	// RecordType type of record, e.g. CNAME, A, TXT etc
 	RecordType string
 	// TTL for the record
 	RecordTTL TTL
 	// Labels stores labels defined for the Endpoint
 	Labels Labels
+	// The properties of the record specific to the DNS provider, e.g. its routing policy
+	ProviderSpecific ProviderSpecific
+	// The unknown external-ips annotations of the service, by key without their prefix, for the
+	// providers to interpret or ignore, not stored in the registry
+	Extensions map[string]string
+	// The changes of the record are computed and reported but not applied, not stored in the registry
+	DryRun bool
 }
 
 // NewEndpoint initialization method to be used to create an endpoint
@@ -126,20 +175,37 @@ func NewEndpoint(dnsName, recordType string, targets ...string) *Endpoint {
 	return NewEndpointWithTTL(dnsName, recordType, TTL(0), targets...)
 }
 
-// NewEndpointWithTTL initialization method to be used to create an endpoint with a TTL struct
+// NewEndpointWithTTL initialization method to be used to create an endpoint with a TTL struct,
+// the endpoint is normalized
 func NewEndpointWithTTL(dnsName, recordType string, ttl TTL, targets ...string) *Endpoint {
-	cleanTargets := make([]string, len(targets))
-	for idx, target := range targets {
-		cleanTargets[idx] = strings.TrimSuffix(target, ".")
-	}
-
-	return &Endpoint{
-		DNSName:    strings.TrimSuffix(dnsName, "."),
-		Targets:    cleanTargets,
+	e := &Endpoint{
+		DNSName:    dnsName,
+		Targets:    targets,
 		RecordType: recordType,
 		Labels:     NewLabels(),
 		RecordTTL:  ttl,
 	}
+	return e.Normalize()
+}
+
+// PrivateZoneTargets returns the targets the DNS record points to in the private zones.
+func (e *Endpoint) PrivateZoneTargets() Targets {
+	if len(e.PrivateTargets) > 0 {
+		return e.PrivateTargets
+	}
+	return e.Targets
+}
+
+// WithProviderSpecific sets the property of the given name and returns the endpoint.
+func (e *Endpoint) WithProviderSpecific(name, value string) *Endpoint {
+	for i, property := range e.ProviderSpecific {
+		if property.Name == name {
+			e.ProviderSpecific[i].Value = value
+			return e
+		}
+	}
+	e.ProviderSpecific = append(e.ProviderSpecific, ProviderSpecificProperty{Name: name, Value: value})
+	return e
 }
 
 func (e *Endpoint) String() string {
@@ -35,6 +35,23 @@ func TestNewEndpoint(t *testing.T) {
 	}
 }
 
+func TestProviderSpecific(t *testing.T) {
+	e := NewEndpoint("example.org", RecordTypeA, "1.2.3.4")
+	if _, ok := e.ProviderSpecific.Get("alias"); ok {
+		t.Error("property is found on an endpoint without properties")
+	}
+
+	e.WithProviderSpecific("alias", "true").WithProviderSpecific("weight", "10").WithProviderSpecific("alias", "false")
+	if len(e.ProviderSpecific) != 2 {
+		t.Errorf("expected 2 properties, got %v", e.ProviderSpecific)
+	}
+	for name, value := range map[string]string{"alias": "false", "weight": "10"} {
+		if property, ok := e.ProviderSpecific.Get(name); !ok || property.Value != value {
+			t.Errorf("expected property %s to be %s, got %v", name, value, e.ProviderSpecific)
+		}
+	}
+}
+
 func TestTargetsSame(t *testing.T) {
 	tests := []Targets{
 		{""},
@@ -49,6 +66,44 @@ func TestTargetsSame(t *testing.T) {
 	}
 }
 
+func TestTargetsSameDoesNotMutate(t *testing.T) {
+	a := Targets{"8.8.8.8", "8.8.4.4"}
+	b := Targets{"8.8.4.4", "8.8.8.8"}
+
+	if !a.Same(b) || !b.Same(a) {
+		t.Errorf("%#v should equal %#v", a, b)
+	}
+	if a.IsLess(b) || b.IsLess(a) {
+		t.Errorf("%#v should not be less than %#v", a, b)
+	}
+	if a[0] != "8.8.8.8" || a[1] != "8.8.4.4" {
+		t.Errorf("%#v was reordered", a)
+	}
+	if b[0] != "8.8.4.4" || b[1] != "8.8.8.8" {
+		t.Errorf("%#v was reordered", b)
+	}
+}
+
+func TestTargetsCanonical(t *testing.T) {
+	sorted := NewTargets("8.8.8.8", "8.8.4.4")
+	if sorted[0] != "8.8.4.4" || sorted[1] != "8.8.8.8" {
+		t.Errorf("%#v is not sorted", sorted)
+	}
+	// sorted targets aren't copied
+	if canonical := sorted.Canonical(); &canonical[0] != &sorted[0] {
+		t.Errorf("%#v was copied", sorted)
+	}
+
+	unsorted := Targets{"8.8.8.8", "8.8.4.4"}
+	canonical := unsorted.Canonical()
+	if canonical[0] != "8.8.4.4" || canonical[1] != "8.8.8.8" {
+		t.Errorf("%#v is not sorted", canonical)
+	}
+	if unsorted[0] != "8.8.8.8" {
+		t.Errorf("%#v was reordered", unsorted)
+	}
+}
+
 func TestSameFailures(t *testing.T) {
 	tests := []struct {
 		a Targets
@@ -37,6 +37,12 @@ const (
 	OwnerLabelKey = "owner"
 	// ResourceLabelKey is the name of the label that identifies k8s resource which wants to acquire the DNS name
 	ResourceLabelKey = "resource"
+	// SlotLabelKey is the name of the label that identifies the slot of the blue/green pair the k8s resource belongs to
+	SlotLabelKey = "slot"
+	// ActiveSlotLabelKey is the name of the label that identifies the slot of the blue/green pair which acquires the DNS name
+	ActiveSlotLabelKey = "active-slot"
+	// ServiceLabelKeyPrefix prefixes the labels of the k8s resource copied to the Endpoint
+	ServiceLabelKeyPrefix = "service-label/"
 
 	// AWSSDDescriptionLabel label responsible for storing raw owner/resource combination information in the Labels
 	// supposed to be inserted by AWS SD Provider, and parsed into OwnerLabelKey and ResourceLabelKey key by AWS SD Registry
@@ -0,0 +1,76 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package endpoint
+
+import (
+	"sort"
+	"strings"
+)
+
+// NormalizeDNSName returns the canonical form of a DNS name: lower case,
+// without surrounding spaces nor trailing dot. DNS names are case insensitive,
+// so names only differing in case are the same record.
+func NormalizeDNSName(name string) string {
+	return strings.TrimSuffix(strings.TrimSpace(strings.ToLower(name)), ".")
+}
+
+// Normalize returns a copy of the targets without trailing dots nor duplicates,
+// sorted, so that targets only differing in order or repetition are equal.
+func (t Targets) Normalize() Targets {
+	seen := make(map[string]bool, len(t))
+	normalized := make(Targets, 0, len(t))
+	for _, target := range t {
+		target = strings.TrimSuffix(target, ".")
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		normalized = append(normalized, target)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+// SameNormalized returns true if both targets are the same once normalized. The
+// targets listed the same way, as they mostly are, are compared without being
+// normalized, which saves the allocations of Normalize.
+func (t Targets) SameNormalized(o Targets) bool {
+	if len(t) == len(o) {
+		same := true
+		for i := range t {
+			if strings.TrimSuffix(t[i], ".") != strings.TrimSuffix(o[i], ".") {
+				same = false
+				break
+			}
+		}
+		if same {
+			return true
+		}
+	}
+	return t.Normalize().Same(o.Normalize())
+}
+
+// Normalize normalizes the name and the targets of the endpoint in place and
+// returns it. The targets of TXT records keep their case, they're opaque values
+// rather than names.
+func (e *Endpoint) Normalize() *Endpoint {
+	e.DNSName = NormalizeDNSName(e.DNSName)
+	e.Targets = e.normalizeTargets(e.Targets)
+	if len(e.PrivateTargets) > 0 {
+		e.PrivateTargets = e.normalizeTargets(e.PrivateTargets)
+	}
+	return e
+}
+
+func (e *Endpoint) normalizeTargets(targets Targets) Targets {
+	targets = targets.Normalize()
+	if e.RecordType != RecordTypeTXT {
+		for i, target := range targets {
+			targets[i] = strings.ToLower(target)
+		}
+		// lower casing may have made targets equal
+		targets = targets.Normalize()
+	}
+	return targets
+}
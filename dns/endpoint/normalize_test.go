@@ -0,0 +1,57 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeDNSName(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		expect string
+	}{
+		{"foo.example.org", "foo.example.org"},
+		{"Foo.Example.ORG.", "foo.example.org"},
+		{"  foo.example.org.  ", "foo.example.org"},
+	} {
+		if got := NormalizeDNSName(tc.name); got != tc.expect {
+			t.Errorf("NormalizeDNSName(%q) = %q, expected %q", tc.name, got, tc.expect)
+		}
+	}
+}
+
+func TestTargetsNormalize(t *testing.T) {
+	targets := Targets{"8.8.8.8", "lb.example.org.", "8.8.4.4", "8.8.8.8", "lb.example.org"}
+	expect := Targets{"8.8.4.4", "8.8.8.8", "lb.example.org"}
+	if got := targets.Normalize(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("expected %v, got %v", expect, got)
+	}
+	// the targets themselves are left untouched
+	if targets[0] != "8.8.8.8" || len(targets) != 5 {
+		t.Errorf("targets were modified: %v", targets)
+	}
+}
+
+func TestEndpointNormalize(t *testing.T) {
+	e := (&Endpoint{
+		DNSName:    "Foo.Example.org.",
+		RecordType: RecordTypeCNAME,
+		Targets:    Targets{"LB.example.org.", "lb.example.org"},
+	}).Normalize()
+	if e.DNSName != "foo.example.org" || !reflect.DeepEqual(e.Targets, Targets{"lb.example.org"}) {
+		t.Errorf("endpoint is not normalized: %s", e)
+	}
+
+	// TXT records keep the case of their values
+	txt := (&Endpoint{
+		DNSName:    "Foo.Example.org",
+		RecordType: RecordTypeTXT,
+		Targets:    Targets{"heritage=external-ips,external-ips/owner=Default"},
+	}).Normalize()
+	if txt.DNSName != "foo.example.org" || txt.Targets[0] != "heritage=external-ips,external-ips/owner=Default" {
+		t.Errorf("TXT endpoint is not normalized correctly: %s", txt)
+	}
+}
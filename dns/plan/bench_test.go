@@ -0,0 +1,57 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// benchmarkEndpoints returns the current and desired records of a sync where one
+// record in a hundred changes its targets, one is created and one deleted.
+func benchmarkEndpoints(n int) (current, desired []*endpoint.Endpoint) {
+	current = make([]*endpoint.Endpoint, 0, n)
+	desired = make([]*endpoint.Endpoint, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("svc-%d.kube.openfresh.io", i)
+		targets := endpoint.Targets{fmt.Sprintf("10.0.%d.%d", i/250%250, i%250), "10.1.0.1", "10.1.0.2"}
+		resource := fmt.Sprintf("service/default/svc-%d", i)
+
+		cur := endpoint.NewEndpoint(name, endpoint.RecordTypeA, targets...)
+		cur.Labels[endpoint.OwnerLabelKey] = "owner"
+		cur.Labels[endpoint.ResourceLabelKey] = resource
+		current = append(current, cur)
+
+		if i == 0 {
+			continue
+		}
+		des := endpoint.NewEndpoint(name, endpoint.RecordTypeA, targets...)
+		if i%100 == 0 {
+			des.Targets = endpoint.Targets{"10.2.0.1", "10.1.0.1", "10.1.0.2"}
+		}
+		des.Labels[endpoint.ResourceLabelKey] = resource
+		desired = append(desired, des)
+	}
+	desired = append(desired, endpoint.NewEndpoint("new.kube.openfresh.io", endpoint.RecordTypeA, "10.3.0.1"))
+	return current, desired
+}
+
+func benchmarkCalculate(b *testing.B, n int) {
+	current, desired := benchmarkEndpoints(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &Plan{
+			Policies: []Policy{&SyncPolicy{}},
+			Current:  current,
+			Desired:  desired,
+		}
+		p.Calculate()
+	}
+}
+
+func BenchmarkCalculate10k(b *testing.B)  { benchmarkCalculate(b, 10000) }
+func BenchmarkCalculate100k(b *testing.B) { benchmarkCalculate(b, 100000) }
@@ -38,6 +38,7 @@ type PerResource struct{}
 // ResolveCreate is invoked when dns name is not owned by any resource
 // ResolveCreate takes "minimal" (string comparison of Target) endpoint to acquire the DNS record
 func (s PerResource) ResolveCreate(candidates []*endpoint.Endpoint) *endpoint.Endpoint {
+	candidates = activeCandidates(candidates)
 	var min *endpoint.Endpoint
 	for _, ep := range candidates {
 		if min == nil || s.less(ep, min) {
@@ -52,6 +53,8 @@ func (s PerResource) ResolveCreate(candidates []*endpoint.Endpoint) *endpoint.En
 // if it doesn't exist then pick min
 func (s PerResource) ResolveUpdate(current *endpoint.Endpoint, candidates []*endpoint.Endpoint) *endpoint.Endpoint {
 	currentResource := current.Labels[endpoint.ResourceLabelKey] // resource which has already acquired the DNS
+	// the resource in the active slot of a blue/green pair takes over the DNS from the other slot
+	candidates = activeCandidates(candidates)
 	// TODO: sort candidates only needed because we can still have two endpoints from same resource here. We sort for consistency
 	// TODO: remove once single endpoint can have multiple targets
 	sort.SliceStable(candidates, func(i, j int) bool {
@@ -70,4 +73,35 @@ func (s PerResource) less(x, y *endpoint.Endpoint) bool {
 	return x.Targets.IsLess(y.Targets)
 }
 
+// activeCandidates leaves out the candidates in the inactive slot of a blue/green pair,
+// unless none is in its active slot, e.g. before the first deployment to that slot
+func activeCandidates(candidates []*endpoint.Endpoint) []*endpoint.Endpoint {
+	slotted := false
+	for _, ep := range candidates {
+		if ep.Labels[endpoint.SlotLabelKey] != "" {
+			slotted = true
+			break
+		}
+	}
+	if !slotted {
+		return candidates
+	}
+
+	active := make([]*endpoint.Endpoint, 0, len(candidates))
+	found := false
+	for _, ep := range candidates {
+		slot := ep.Labels[endpoint.SlotLabelKey]
+		if slot == "" {
+			active = append(active, ep)
+		} else if slot == ep.Labels[endpoint.ActiveSlotLabelKey] {
+			active = append(active, ep)
+			found = true
+		}
+	}
+	if !found {
+		return candidates
+	}
+	return active
+}
+
 // TODO: with cross-resource/cross-cluster setup alternative variations of ConflictResolver can be used
@@ -135,6 +135,29 @@ func (suite *ResolverSuite) TestStrictResolver() {
 	suite.Equal(suite.bar127A, suite.perResource.ResolveUpdate(suite.legacyBar192A, []*endpoint.Endpoint{suite.bar127A, suite.bar192A}), " legacy record's resource value will not match, should pick minimum")
 }
 
+func (suite *ResolverSuite) TestSlotResolver() {
+	slotted := func(resource, target, slot, activeSlot string) *endpoint.Endpoint {
+		return &endpoint.Endpoint{
+			DNSName:    "foo",
+			Targets:    endpoint.Targets{target},
+			RecordType: "A",
+			Labels: map[string]string{
+				endpoint.ResourceLabelKey:   resource,
+				endpoint.SlotLabelKey:       slot,
+				endpoint.ActiveSlotLabelKey: activeSlot,
+			},
+		}
+	}
+	blue := slotted("service/default/foo-blue", "1.1.1.1", "blue", "green")
+	green := slotted("service/default/foo-green", "2.2.2.2", "green", "green")
+
+	suite.Equal(green, suite.perResource.ResolveCreate([]*endpoint.Endpoint{blue, green}), "should pick the active slot rather than min")
+	suite.Equal(green, suite.perResource.ResolveUpdate(blue, []*endpoint.Endpoint{blue, green}), "should switch to the active slot")
+	suite.Equal(green, suite.perResource.ResolveUpdate(green, []*endpoint.Endpoint{blue, green}), "should keep the active slot")
+	suite.Equal(blue, suite.perResource.ResolveUpdate(blue, []*endpoint.Endpoint{blue}), "should keep the inactive slot until the active one exists")
+	suite.Equal(suite.fooA5, suite.perResource.ResolveUpdate(suite.fooA5, []*endpoint.Endpoint{blue, green, suite.fooA5}), "should leave the resources outside of the pair alone")
+}
+
 func TestConflictResolver(t *testing.T) {
 	suite.Run(t, new(ResolverSuite))
 }
@@ -0,0 +1,39 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// Split separates the changes of the records in dry-run, as told by dryRun, from
+// the changes to apply. An update is in dry-run when its current or its desired
+// record is, so that its pair is never broken up.
+func (c *Changes) Split(dryRun func(*endpoint.Endpoint) bool) (apply, skipped *Changes) {
+	apply, skipped = &Changes{}, &Changes{}
+	for _, ep := range c.Create {
+		if dryRun(ep) {
+			skipped.Create = append(skipped.Create, ep)
+		} else {
+			apply.Create = append(apply.Create, ep)
+		}
+	}
+	for i := range c.UpdateNew {
+		if dryRun(c.UpdateOld[i]) || dryRun(c.UpdateNew[i]) {
+			skipped.UpdateOld = append(skipped.UpdateOld, c.UpdateOld[i])
+			skipped.UpdateNew = append(skipped.UpdateNew, c.UpdateNew[i])
+		} else {
+			apply.UpdateOld = append(apply.UpdateOld, c.UpdateOld[i])
+			apply.UpdateNew = append(apply.UpdateNew, c.UpdateNew[i])
+		}
+	}
+	for _, ep := range c.Delete {
+		if dryRun(ep) {
+			skipped.Delete = append(skipped.Delete, ep)
+		} else {
+			apply.Delete = append(apply.Delete, ep)
+		}
+	}
+	return apply, skipped
+}
@@ -0,0 +1,47 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+func TestChangesSplit(t *testing.T) {
+	created := &endpoint.Endpoint{DNSName: "created", Targets: endpoint.Targets{"1.2.3.4"}}
+	dryCreated := &endpoint.Endpoint{DNSName: "dry-created", Targets: endpoint.Targets{"1.2.3.4"}, DryRun: true}
+	oldUpdated := &endpoint.Endpoint{DNSName: "updated", Targets: endpoint.Targets{"1.2.3.4"}}
+	newUpdated := &endpoint.Endpoint{DNSName: "updated", Targets: endpoint.Targets{"1.2.3.5"}}
+	oldDryUpdated := &endpoint.Endpoint{DNSName: "dry-updated", Targets: endpoint.Targets{"1.2.3.4"}}
+	newDryUpdated := &endpoint.Endpoint{DNSName: "dry-updated", Targets: endpoint.Targets{"1.2.3.5"}, DryRun: true}
+	deleted := &endpoint.Endpoint{DNSName: "deleted", Targets: endpoint.Targets{"1.2.3.4"}}
+	// a current record is attributed to a service in dry-run by its resource label
+	dryDeleted := &endpoint.Endpoint{DNSName: "dry-deleted", Targets: endpoint.Targets{"1.2.3.4"}, Labels: endpoint.Labels{endpoint.ResourceLabelKey: "service/default/dry"}}
+
+	changes := &Changes{
+		Create:    []*endpoint.Endpoint{created, dryCreated},
+		UpdateOld: []*endpoint.Endpoint{oldDryUpdated, oldUpdated},
+		UpdateNew: []*endpoint.Endpoint{newDryUpdated, newUpdated},
+		Delete:    []*endpoint.Endpoint{dryDeleted, deleted},
+	}
+	apply, skipped := changes.Split(func(ep *endpoint.Endpoint) bool {
+		return ep.DryRun || ep.Labels[endpoint.ResourceLabelKey] == "service/default/dry"
+	})
+
+	assert.Equal(t, &Changes{
+		Create:    []*endpoint.Endpoint{created},
+		UpdateOld: []*endpoint.Endpoint{oldUpdated},
+		UpdateNew: []*endpoint.Endpoint{newUpdated},
+		Delete:    []*endpoint.Endpoint{deleted},
+	}, apply)
+	assert.Equal(t, &Changes{
+		Create:    []*endpoint.Endpoint{dryCreated},
+		UpdateOld: []*endpoint.Endpoint{oldDryUpdated},
+		UpdateNew: []*endpoint.Endpoint{newDryUpdated},
+		Delete:    []*endpoint.Endpoint{dryDeleted},
+	}, skipped)
+}
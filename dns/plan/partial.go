@@ -0,0 +1,32 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ZoneError is the failure to apply the changes of a single zone.
+type ZoneError struct {
+	Zone string
+	Err  error
+}
+
+// PartialError is returned by ApplyChanges when the changes could be applied to
+// some of the zones only. Applied holds the changes known to have been applied,
+// so that the registries and metrics can account for them while the others are
+// retried on the next synchronization.
+type PartialError struct {
+	Applied *Changes
+	Failed  []ZoneError
+}
+
+func (e *PartialError) Error() string {
+	failures := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%s: %v", f.Zone, f.Err))
+	}
+	return fmt.Sprintf("failed to apply the changes of %d zones: %s", len(e.Failed), strings.Join(failures, "; "))
+}
@@ -20,8 +20,6 @@ limitations under the License.
 package plan
 
 import (
-	"strings"
-
 	"github.com/openfresh/external-ips/dns/endpoint"
 )
 
@@ -67,10 +65,18 @@ bar.com |                | [->191.1.1.1, ->190.1.1.1]  |  = create (bar.com -> 1
 type planTable struct {
 	rows     map[string]*planTableRow
 	resolver ConflictResolver
+	// the rows, and the first candidates of the rows, are allocated together rather than one by one
+	slab       []planTableRow
+	candidates []*endpoint.Endpoint
 }
 
-func newPlanTable() planTable { //TODO: make resolver configurable
-	return planTable{map[string]*planTableRow{}, PerResource{}}
+func newPlanTable(current, desired int) *planTable { //TODO: make resolver configurable
+	return &planTable{
+		rows:       make(map[string]*planTableRow, current+desired),
+		resolver:   PerResource{},
+		slab:       make([]planTableRow, 0, current+desired),
+		candidates: make([]*endpoint.Endpoint, 0, desired),
+	}
 }
 
 // planTableRow
@@ -81,29 +87,40 @@ type planTableRow struct {
 	candidates []*endpoint.Endpoint
 }
 
-func (t planTable) addCurrent(e *endpoint.Endpoint) {
-	dnsName := sanitizeDNSName(e.DNSName)
-	if _, ok := t.rows[dnsName]; !ok {
-		t.rows[dnsName] = &planTableRow{}
+func (t *planTable) row(dnsName string) *planTableRow {
+	row, ok := t.rows[dnsName]
+	if !ok {
+		t.slab = append(t.slab, planTableRow{})
+		row = &t.slab[len(t.slab)-1]
+		t.rows[dnsName] = row
 	}
-	t.rows[dnsName].current = e
+	return row
+}
+
+func (t *planTable) addCurrent(e *endpoint.Endpoint) {
+	t.row(sanitizeDNSName(e.DNSName)).current = e
 }
 
-func (t planTable) addCandidate(e *endpoint.Endpoint) {
-	dnsName := sanitizeDNSName(e.DNSName)
-	if _, ok := t.rows[dnsName]; !ok {
-		t.rows[dnsName] = &planTableRow{}
+func (t *planTable) addCandidate(e *endpoint.Endpoint) {
+	row := t.row(sanitizeDNSName(e.DNSName))
+	if row.candidates == nil {
+		// most names have a single candidate, the capacity of its slice makes
+		// another candidate reallocate it rather than overwrite the next row's
+		t.candidates = append(t.candidates, e)
+		n := len(t.candidates)
+		row.candidates = t.candidates[n-1 : n : n]
+		return
 	}
-	t.rows[dnsName].candidates = append(t.rows[dnsName].candidates, e)
+	row.candidates = append(row.candidates, e)
 }
 
 // TODO: allows record type change, which might not be supported by all dns providers
-func (t planTable) getUpdates() (updateNew []*endpoint.Endpoint, updateOld []*endpoint.Endpoint) {
+func (t *planTable) getUpdates() (updateNew []*endpoint.Endpoint, updateOld []*endpoint.Endpoint) {
 	for _, row := range t.rows {
 		if row.current != nil && len(row.candidates) > 0 { //dns name is taken
 			update := t.resolver.ResolveUpdate(row.current, row.candidates)
 			// compare "update" to "current" to figure out if actual update is required
-			if shouldUpdateTTL(update, row.current) || targetChanged(update, row.current) {
+			if shouldUpdateTTL(update, row.current) || targetChanged(update, row.current) || shouldUpdateProviderSpecific(update, row.current) {
 				inheritOwner(row.current, update)
 				updateNew = append(updateNew, update)
 				updateOld = append(updateOld, row.current)
@@ -114,7 +131,7 @@ func (t planTable) getUpdates() (updateNew []*endpoint.Endpoint, updateOld []*en
 	return
 }
 
-func (t planTable) getCreates() (createList []*endpoint.Endpoint) {
+func (t *planTable) getCreates() (createList []*endpoint.Endpoint) {
 	for _, row := range t.rows {
 		if row.current == nil { //dns name not taken
 			createList = append(createList, t.resolver.ResolveCreate(row.candidates))
@@ -123,7 +140,7 @@ func (t planTable) getCreates() (createList []*endpoint.Endpoint) {
 	return
 }
 
-func (t planTable) getDeletes() (deleteList []*endpoint.Endpoint) {
+func (t *planTable) getDeletes() (deleteList []*endpoint.Endpoint) {
 	for _, row := range t.rows {
 		if row.current != nil && len(row.candidates) == 0 {
 			deleteList = append(deleteList, row.current)
@@ -136,7 +153,7 @@ func (t planTable) getDeletes() (deleteList []*endpoint.Endpoint) {
 // state. It then passes those changes to the current policy for further
 // processing. It returns a copy of Plan with the changes populated.
 func (p *Plan) Calculate() *Plan {
-	t := newPlanTable()
+	t := newPlanTable(len(p.Current), len(p.Desired))
 
 	for _, current := range p.Current {
 		t.addCurrent(current)
@@ -172,8 +189,11 @@ func inheritOwner(from, to *endpoint.Endpoint) {
 	to.Labels[endpoint.OwnerLabelKey] = from.Labels[endpoint.OwnerLabelKey]
 }
 
+// targetChanged ignores the order and the repetition of the targets, the records
+// published before they were normalized would otherwise all be updated
 func targetChanged(desired, current *endpoint.Endpoint) bool {
-	return !desired.Targets.Same(current.Targets)
+	return !desired.Targets.SameNormalized(current.Targets) ||
+		!desired.PrivateZoneTargets().SameNormalized(current.PrivateZoneTargets())
 }
 
 func shouldUpdateTTL(desired, current *endpoint.Endpoint) bool {
@@ -183,8 +203,19 @@ func shouldUpdateTTL(desired, current *endpoint.Endpoint) bool {
 	return desired.RecordTTL != current.RecordTTL
 }
 
-// sanitizeDNSName checks if the DNS name is correct
-// for now it only removes space and lower case
+// shouldUpdateProviderSpecific only compares the properties set on both endpoints, the
+// providers only reading back the properties they support
+func shouldUpdateProviderSpecific(desired, current *endpoint.Endpoint) bool {
+	for _, c := range current.ProviderSpecific {
+		if d, ok := desired.ProviderSpecific.Get(c.Name); ok && d.Value != c.Value {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeDNSName normalizes the DNS name, so that the rows of the plan table
+// match the records whatever their case or trailing dot
 func sanitizeDNSName(dnsName string) string {
-	return strings.TrimSpace(strings.ToLower(dnsName))
+	return endpoint.NormalizeDNSName(dnsName)
 }
@@ -413,3 +413,91 @@ func TestSanitizeDNSName(t *testing.T) {
 		assert.Equal(t, r.expect, gotName)
 	}
 }
+
+// TestCalculateNormalizedRecords tests that the records published before the
+// endpoints were normalized, e.g. with upper case names, trailing dots or
+// unsorted duplicate targets, aren't updated for those differences only.
+func TestCalculateNormalizedRecords(t *testing.T) {
+	current := []*endpoint.Endpoint{
+		{
+			DNSName:    "Foo.Example.org.",
+			Targets:    endpoint.Targets{"8.8.8.8", "8.8.4.4", "8.8.8.8"},
+			RecordType: endpoint.RecordTypeA,
+			Labels:     endpoint.Labels{endpoint.OwnerLabelKey: "pwner"},
+		},
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "8.8.4.4", "8.8.8.8"),
+	}
+
+	p := &Plan{
+		Current:  current,
+		Desired:  desired,
+		Policies: []Policy{&SyncPolicy{}},
+	}
+	changes := p.Calculate().Changes
+	assert.Empty(t, changes.Create)
+	assert.Empty(t, changes.UpdateNew)
+	assert.Empty(t, changes.UpdateOld)
+	assert.Empty(t, changes.Delete)
+
+	// an actual change of the targets is still updated
+	desired[0].Targets = endpoint.Targets{"1.1.1.1"}
+	changes = p.Calculate().Changes
+	assert.Len(t, changes.UpdateNew, 1)
+	assert.Len(t, changes.UpdateOld, 1)
+}
+
+func TestCalculatePrivateTargets(t *testing.T) {
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "8.8.8.8"),
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "8.8.8.8"),
+	}
+	p := &Plan{
+		Current:  current,
+		Desired:  desired,
+		Policies: []Policy{&SyncPolicy{}},
+	}
+
+	// the private targets default to the targets
+	desired[0].PrivateTargets = endpoint.Targets{"8.8.8.8"}
+	assert.Empty(t, p.Calculate().Changes.UpdateNew)
+
+	// other private targets are updated
+	desired[0].PrivateTargets = endpoint.Targets{"10.0.0.1"}
+	assert.Len(t, p.Calculate().Changes.UpdateNew, 1)
+
+	current[0].PrivateTargets = endpoint.Targets{"10.0.0.1"}
+	assert.Empty(t, p.Calculate().Changes.UpdateNew)
+}
+
+func TestCalculateProviderSpecific(t *testing.T) {
+	current := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "8.8.8.8").WithProviderSpecific("alias", "false"),
+	}
+	desired := []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "8.8.8.8"),
+	}
+	p := &Plan{
+		Current:  current,
+		Desired:  desired,
+		Policies: []Policy{&SyncPolicy{}},
+	}
+
+	// the properties the desired record doesn't set are left as they are
+	assert.Empty(t, p.Calculate().Changes.UpdateNew)
+
+	desired[0].WithProviderSpecific("alias", "false")
+	assert.Empty(t, p.Calculate().Changes.UpdateNew)
+
+	desired[0].WithProviderSpecific("alias", "true")
+	changes := p.Calculate().Changes
+	assert.Equal(t, desired, changes.UpdateNew)
+	assert.Equal(t, current, changes.UpdateOld)
+
+	// the properties the provider doesn't read back aren't compared
+	current[0].ProviderSpecific = nil
+	assert.Empty(t, p.Calculate().Changes.UpdateNew)
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// records is a list of A records with distinct names, drawn from a small pool so
+// that the current and desired records overlap.
+type records []*endpoint.Endpoint
+
+func (records) Generate(rand *rand.Rand, size int) reflect.Value {
+	var rs records
+	for _, name := range []string{"foo", "bar", "baz", "qux", "quux"} {
+		if rand.Intn(3) == 0 {
+			continue
+		}
+		if rand.Intn(4) == 0 {
+			name = strings.ToUpper(name[:1]) + name[1:]
+		}
+		var targets endpoint.Targets
+		for i := rand.Intn(3); i >= 0; i-- {
+			targets = append(targets, fmt.Sprintf("10.0.0.%d", rand.Intn(4)))
+		}
+		rs = append(rs, &endpoint.Endpoint{
+			DNSName:    name + ".example.org",
+			Targets:    targets,
+			RecordType: endpoint.RecordTypeA,
+			RecordTTL:  endpoint.TTL(rand.Intn(3) * 300),
+			Labels:     map[string]string{endpoint.ResourceLabelKey: "service/default/" + strings.ToLower(name)},
+		})
+	}
+	return reflect.ValueOf(rs)
+}
+
+func calculate(current, desired records) *Changes {
+	p := &Plan{
+		Current:  current,
+		Desired:  desired,
+		Policies: []Policy{&SyncPolicy{}},
+	}
+	return p.Calculate().Changes
+}
+
+// apply returns the records after the changes were applied to current, failing
+// on changes which don't match current.
+func apply(current records, changes *Changes) (records, error) {
+	state := map[string]*endpoint.Endpoint{}
+	for _, r := range current {
+		state[sanitizeDNSName(r.DNSName)] = r
+	}
+	for _, r := range changes.Delete {
+		if state[sanitizeDNSName(r.DNSName)] != r {
+			return nil, fmt.Errorf("deleting %s which isn't current", r)
+		}
+		delete(state, sanitizeDNSName(r.DNSName))
+	}
+	if len(changes.UpdateOld) != len(changes.UpdateNew) {
+		return nil, fmt.Errorf("%d old records for %d new ones", len(changes.UpdateOld), len(changes.UpdateNew))
+	}
+	for i, r := range changes.UpdateOld {
+		if state[sanitizeDNSName(r.DNSName)] != r {
+			return nil, fmt.Errorf("updating %s which isn't current", r)
+		}
+		state[sanitizeDNSName(r.DNSName)] = changes.UpdateNew[i]
+	}
+	for _, r := range changes.Create {
+		if _, ok := state[sanitizeDNSName(r.DNSName)]; ok {
+			return nil, fmt.Errorf("creating %s which already exists", r)
+		}
+		state[sanitizeDNSName(r.DNSName)] = r
+	}
+
+	var result records
+	for _, r := range state {
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+func TestCalculateReachesDesired(t *testing.T) {
+	f := func(current, desired records) bool {
+		result, err := apply(current, calculate(current, desired))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		if len(result) != len(desired) {
+			return false
+		}
+		state := map[string]*endpoint.Endpoint{}
+		for _, r := range result {
+			state[sanitizeDNSName(r.DNSName)] = r
+		}
+		for _, d := range desired {
+			r, ok := state[sanitizeDNSName(d.DNSName)]
+			if !ok || !r.Targets.Normalize().Same(d.Targets.Normalize()) {
+				return false
+			}
+			if d.RecordTTL.IsConfigured() && r.RecordTTL != d.RecordTTL {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateIsIdempotent(t *testing.T) {
+	f := func(current, desired records) bool {
+		result, err := apply(current, calculate(current, desired))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		changes := calculate(result, desired)
+		return len(changes.Create)+len(changes.UpdateOld)+len(changes.UpdateNew)+len(changes.Delete) == 0
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateChangesAreDisjoint(t *testing.T) {
+	f := func(current, desired records) bool {
+		changes := calculate(current, desired)
+		names := map[string]bool{}
+		for _, list := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateNew, changes.Delete} {
+			for _, r := range list {
+				if names[sanitizeDNSName(r.DNSName)] {
+					return false
+				}
+				names[sanitizeDNSName(r.DNSName)] = true
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
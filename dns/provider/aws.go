@@ -20,21 +20,39 @@ limitations under the License.
 package provider
 
 import (
+	"fmt"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/linki/instrumented_http"
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
 const (
 	recordTTL = 300
+
+	// DefaultRecordsPageSize is the maximum number of record sets Route53 returns in a page.
+	DefaultRecordsPageSize = 300
+
+	// BatchChangeStrategyByName fills the batches in the order of the names of the records.
+	BatchChangeStrategyByName = "by-name"
+	// BatchChangeStrategyDeletesLast fills the batches with the creations and updates
+	// first, and defers the deletions until they have all been submitted, so that a
+	// record replaced by another one isn't deleted before its replacement exists.
+	BatchChangeStrategyDeletesLast = "deletes-last"
 )
 
 var (
@@ -76,27 +94,127 @@ var (
 	}
 )
 
+var (
+	changeBatchSize = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "route53_change_batch_size",
+			Help:      "Number of changes in the last batch submitted to the hosted zone.",
+		},
+		[]string{"zone"},
+	)
+	changeBatchRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "route53_change_batch_remaining",
+			Help:      "Number of changes the last batch submitted to the hosted zone could still have taken before reaching --aws-max-change-count.",
+		},
+		[]string{"zone"},
+	)
+	crossZoneRecords = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "route53_cross_zone_records",
+			Help:      "Number of records served by both a private and a public hosted zone, as of the last listing.",
+		},
+	)
+	limitedChangeBatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "route53_limited_change_batches_total",
+			Help:      "Number of batches of the hosted zone which exceeded --aws-max-change-count, the changes left out being submitted on the next run.",
+		},
+		[]string{"zone"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(changeBatchSize)
+	prometheus.MustRegister(changeBatchRemaining)
+	prometheus.MustRegister(limitedChangeBatches)
+	prometheus.MustRegister(crossZoneRecords)
+
+	Register("aws", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewAWSProvider(
+				AWSConfig{
+					DomainFilter:        zones.DomainFilter,
+					ZoneIDFilter:        zones.ZoneIDFilter,
+					ZoneTypeFilter:      zones.ZoneTypeFilter,
+					VPCFilter:           NewVPCFilter(zones.VPCIDs),
+					MaxChangeCount:      cfg.AWSMaxChangeCount,
+					BatchChangeStrategy: cfg.AWSBatchChangeStrategy,
+					RecordsPageSize:     cfg.AWSRecordsPageSize,
+					ZoneConcurrency:     cfg.AWSZoneConcurrency,
+					RecordsCacheTTL:     cfg.AWSRecordsCacheTTL,
+					ZoneVPCsCacheTTL:    cfg.Interval,
+					AssumeRole:          cfg.DNSAssumeRole(),
+					Region:              cfg.AWSRegion,
+					DryRun:              cfg.DryRun,
+				},
+			)
+		},
+		Permissions: func(zoneIDs []string) []permissions.Statement {
+			return AWSPermissions(NewZoneIDFilter(zoneIDs))
+		},
+	})
+}
+
 // Route53API is the subset of the AWS Route53 API that we actually use.  Add methods as required. Signatures must match exactly.
 // mostly taken from: https://github.com/kubernetes/kubernetes/blob/853167624edb6bc0cfdcdfb88e746e178f5db36c/federation/pkg/dnsprovider/providers/aws/route53/stubs/route53api.go
 type Route53API interface {
 	ListResourceRecordSetsPages(input *route53.ListResourceRecordSetsInput, fn func(resp *route53.ListResourceRecordSetsOutput, lastPage bool) (shouldContinue bool)) error
 	ChangeResourceRecordSets(*route53.ChangeResourceRecordSetsInput) (*route53.ChangeResourceRecordSetsOutput, error)
 	CreateHostedZone(*route53.CreateHostedZoneInput) (*route53.CreateHostedZoneOutput, error)
+	GetHostedZone(*route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error)
 	ListHostedZonesPages(input *route53.ListHostedZonesInput, fn func(resp *route53.ListHostedZonesOutput, lastPage bool) (shouldContinue bool)) error
 }
 
-// AWSProvider is an implementation of Provider for AWS Route53.
+// AWSProvider is an implementation of Provider for AWS Route53. It holds no
+// state besides its configuration and the cached records of the hosted zones,
+// and is safe for concurrent use.
 type AWSProvider struct {
 	client               Route53API
 	dryRun               bool
 	maxChangeCount       int
+	batchChangeStrategy  string
 	evaluateTargetHealth bool
+	recordsPageSize      int
+	zoneConcurrency      int
+	recordsCacheTTL      time.Duration
 	// only consider hosted zones managing domains ending in this suffix
 	domainFilter DomainFilter
 	// filter hosted zones by id
 	zoneIDFilter ZoneIDFilter
 	// filter hosted zones by type (e.g. private or public)
 	zoneTypeFilter ZoneTypeFilter
+	// filter private hosted zones by the VPCs they're associated with
+	vpcFilter VPCFilter
+
+	// how long the VPCs of a private hosted zone are reused, fetched on every listing if 0
+	zoneVPCsCacheTTL time.Duration
+
+	cacheMu      sync.Mutex
+	recordsCache map[string]zoneRecords
+	zoneVPCs     map[string]zoneVPCs
+}
+
+// zoneRecords holds the record sets of a hosted zone as listed when the zone had
+// the given number of record sets.
+type zoneRecords struct {
+	recordSetCount int64
+	listed         time.Time
+	recordSets     []*route53.ResourceRecordSet
+}
+
+// zoneVPCs holds the VPCs a private hosted zone was associated with when fetched.
+type zoneVPCs struct {
+	fetched time.Time
+	vpcs    []*route53.VPC
 }
 
 // AWSConfig contains configuration to create a new AWS provider.
@@ -104,15 +222,37 @@ type AWSConfig struct {
 	DomainFilter         DomainFilter
 	ZoneIDFilter         ZoneIDFilter
 	ZoneTypeFilter       ZoneTypeFilter
+	VPCFilter            VPCFilter
 	MaxChangeCount       int
+	BatchChangeStrategy  string
 	EvaluateTargetHealth bool
-	AssumeRole           string
-	DryRun               bool
+	// The maximum number of record sets listed per request, DefaultRecordsPageSize if 0
+	RecordsPageSize int
+	// The number of hosted zones listed at the same time, 1 if 0
+	ZoneConcurrency int
+	// How long the records of a hosted zone are reused while its number of record
+	// sets doesn't change, the records aren't cached if 0
+	RecordsCacheTTL time.Duration
+	// How long the VPCs of a private hosted zone are reused by the VPC filter, fetched
+	// on every listing if 0
+	ZoneVPCsCacheTTL time.Duration
+	AssumeRole       string
+	// Overrides the region of the AWS configuration
+	Region string
+	// Overrides the Route53 endpoint, e.g. to run against localstack
+	Endpoint string
+	DryRun   bool
 }
 
 // NewAWSProvider initializes a new AWS Route53 based Provider.
 func NewAWSProvider(awsConfig AWSConfig) (*AWSProvider, error) {
 	config := aws.NewConfig()
+	if awsConfig.Endpoint != "" {
+		config.WithEndpoint(awsConfig.Endpoint)
+	}
+	if awsConfig.Region != "" {
+		config.WithRegion(awsConfig.Region)
+	}
 
 	config.WithHTTPClient(
 		instrumented_http.NewClient(config.HTTPClient, &instrumented_http.Callbacks{
@@ -141,8 +281,14 @@ func NewAWSProvider(awsConfig AWSConfig) (*AWSProvider, error) {
 		domainFilter:         awsConfig.DomainFilter,
 		zoneIDFilter:         awsConfig.ZoneIDFilter,
 		zoneTypeFilter:       awsConfig.ZoneTypeFilter,
+		vpcFilter:            awsConfig.VPCFilter,
 		maxChangeCount:       awsConfig.MaxChangeCount,
+		batchChangeStrategy:  awsConfig.BatchChangeStrategy,
 		evaluateTargetHealth: awsConfig.EvaluateTargetHealth,
+		recordsPageSize:      awsConfig.RecordsPageSize,
+		zoneConcurrency:      awsConfig.ZoneConcurrency,
+		recordsCacheTTL:      awsConfig.RecordsCacheTTL,
+		zoneVPCsCacheTTL:     awsConfig.ZoneVPCsCacheTTL,
 		dryRun:               awsConfig.DryRun,
 	}
 
@@ -178,6 +324,30 @@ func (p *AWSProvider) Zones() (map[string]*route53.HostedZone, error) {
 		return nil, err
 	}
 
+	if p.vpcFilter.IsConfigured() {
+		p.cacheMu.Lock()
+		for id := range p.zoneVPCs {
+			if _, ok := zones[id]; !ok {
+				delete(p.zoneVPCs, id)
+			}
+		}
+		p.cacheMu.Unlock()
+
+		for id, zone := range zones {
+			if zone.Config == nil || !aws.BoolValue(zone.Config.PrivateZone) {
+				continue
+			}
+			vpcs, err := p.privateZoneVPCs(zone)
+			if err != nil {
+				return nil, err
+			}
+			if !p.vpcFilter.Match(vpcs) {
+				log.Debugf("Ignoring private zone %s (domain: %s), it isn't associated with the VPCs of the cluster", id, aws.StringValue(zone.Name))
+				delete(zones, id)
+			}
+		}
+	}
+
 	for _, zone := range zones {
 		log.Debugf("Considering zone: %s (domain: %s)", aws.StringValue(zone.Id), aws.StringValue(zone.Name))
 	}
@@ -185,6 +355,30 @@ func (p *AWSProvider) Zones() (map[string]*route53.HostedZone, error) {
 	return zones, nil
 }
 
+// privateZoneVPCs returns the VPCs the private hosted zone is associated with, which are
+// only returned by GetHostedZone, reusing those fetched less than zoneVPCsCacheTTL ago.
+func (p *AWSProvider) privateZoneVPCs(zone *route53.HostedZone) ([]*route53.VPC, error) {
+	id := aws.StringValue(zone.Id)
+	p.cacheMu.Lock()
+	cached, ok := p.zoneVPCs[id]
+	p.cacheMu.Unlock()
+	if ok && time.Since(cached.fetched) < p.zoneVPCsCacheTTL {
+		return cached.vpcs, nil
+	}
+
+	resp, err := p.client.GetHostedZone(&route53.GetHostedZoneInput{Id: zone.Id})
+	if err != nil {
+		return nil, err
+	}
+	p.cacheMu.Lock()
+	if p.zoneVPCs == nil {
+		p.zoneVPCs = make(map[string]zoneVPCs)
+	}
+	p.zoneVPCs[id] = zoneVPCs{fetched: time.Now(), vpcs: resp.VPCs}
+	p.cacheMu.Unlock()
+	return resp.VPCs, nil
+}
+
 // wildcardUnescape converts \\052.abc back to *.abc
 // Route53 stores wildcards escaped: http://docs.aws.amazon.com/Route53/latest/DeveloperGuide/DomainNameFormat.html?shortFooter=true#domain-name-format-asterisk
 func wildcardUnescape(s string) string {
@@ -195,125 +389,527 @@ func wildcardUnescape(s string) string {
 }
 
 // Records returns the list of records in a given hosted zone.
+// The records of the private zones pointing to other targets than the records of
+// the same name in the public zones are returned as the private targets of the latter.
+// The records whose name matches both private and public zones carry the kinds of
+// zones they're served by as their ZoneVisibilityProperty.
+// Up to ZoneConcurrency hosted zones are listed at the same time.
 func (p *AWSProvider) Records() (endpoints []*endpoint.Endpoint, _ error) {
 	zones, err := p.Zones()
 	if err != nil {
 		return nil, err
 	}
 
+	ids := make([]string, 0, len(zones))
+	for id := range zones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	workers := p.zoneConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(ids) {
+		workers = len(ids)
+	}
+
+	recordSets := make([][]*route53.ResourceRecordSet, len(ids))
+	errs := make([]error, len(ids))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				recordSets[i], errs[i] = p.zoneRecordSets(zones[ids[i]])
+			}
+		}()
+	}
+	for i := range ids {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	var privateEndpoints []*endpoint.Endpoint
+	for i, id := range ids {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		zoneEndpoints := newEndpoints(recordSets[i])
+		for _, ep := range zoneEndpoints {
+			ep.WithProviderSpecific(ZoneProperty, strings.TrimSuffix(aws.StringValue(zones[id].Name), "."))
+		}
+		if isPrivateZone(zones[id]) {
+			privateEndpoints = append(privateEndpoints, zoneEndpoints...)
+		} else {
+			endpoints = append(endpoints, zoneEndpoints...)
+		}
+	}
+
+	// the records of the excluded domains are left alone, even though their zone matches
+	endpoints = p.domainFilter.MatchEndpoints(mergePrivateEndpoints(endpoints, privateEndpoints, zones))
+	crossZone := 0
+	for _, ep := range endpoints {
+		if zoneVisibility(ep) == ZoneVisibilityBoth {
+			log.Debugf("Record %s %s is served by both private and public zones", ep.DNSName, ep.RecordType)
+			crossZone++
+		}
+	}
+	crossZoneRecords.Set(float64(crossZone))
+	return endpoints, nil
+}
+
+// zoneRecordSets returns the record sets of the supported types in the given
+// hosted zone, from the cache if the zone still has as many record sets as when
+// they were listed within RecordsCacheTTL.
+func (p *AWSProvider) zoneRecordSets(z *route53.HostedZone) ([]*route53.ResourceRecordSet, error) {
+	id := aws.StringValue(z.Id)
+	count := aws.Int64Value(z.ResourceRecordSetCount)
+	if p.recordsCacheTTL > 0 {
+		p.cacheMu.Lock()
+		cached, ok := p.recordsCache[id]
+		p.cacheMu.Unlock()
+		if ok && cached.recordSetCount == count && time.Since(cached.listed) < p.recordsCacheTTL {
+			log.Debugf("Using the cached records of zone %s", aws.StringValue(z.Name))
+			return cached.recordSets, nil
+		}
+	}
+
+	pageSize := p.recordsPageSize
+	if pageSize <= 0 {
+		pageSize = DefaultRecordsPageSize
+	}
+	params := &route53.ListResourceRecordSetsInput{
+		HostedZoneId: z.Id,
+		MaxItems:     aws.String(strconv.Itoa(pageSize)),
+	}
+
+	listed := time.Now()
+	var recordSets []*route53.ResourceRecordSet
 	f := func(resp *route53.ListResourceRecordSetsOutput, lastPage bool) (shouldContinue bool) {
+		// Route53 can't filter the record sets by type, the unsupported ones are
+		// dropped as the pages come in so that they aren't kept around
 		for _, r := range resp.ResourceRecordSets {
 			// TODO(linki, ownership): Remove once ownership system is in place.
 			// See: https://github.com/kubernetes-incubator/external-dns/pull/122/files/74e2c3d3e237411e619aefc5aab694742001cdec#r109863370
 
-			if !supportedRecordType(aws.StringValue(r.Type)) {
-				continue
+			if supportedRecordType(aws.StringValue(r.Type)) {
+				recordSets = append(recordSets, r)
 			}
+		}
+		return true
+	}
+	if err := p.client.ListResourceRecordSetsPages(params, f); err != nil {
+		return nil, err
+	}
 
-			var ttl endpoint.TTL
-			if r.TTL != nil {
-				ttl = endpoint.TTL(*r.TTL)
-			}
+	if p.recordsCacheTTL > 0 {
+		p.cacheMu.Lock()
+		if p.recordsCache == nil {
+			p.recordsCache = make(map[string]zoneRecords)
+		}
+		p.recordsCache[id] = zoneRecords{recordSetCount: count, listed: listed, recordSets: recordSets}
+		p.cacheMu.Unlock()
+	}
+	return recordSets, nil
+}
 
-			if len(r.ResourceRecords) > 0 {
-				targets := make([]string, len(r.ResourceRecords))
-				for idx, rr := range r.ResourceRecords {
-					targets[idx] = aws.StringValue(rr.Value)
-				}
+// invalidateRecords drops the cached records of the given hosted zone.
+func (p *AWSProvider) invalidateRecords(zoneID string) {
+	p.cacheMu.Lock()
+	delete(p.recordsCache, zoneID)
+	p.cacheMu.Unlock()
+}
 
-				endpoints = append(endpoints, endpoint.NewEndpointWithTTL(wildcardUnescape(aws.StringValue(r.Name)), aws.StringValue(r.Type), ttl, targets...))
+// newEndpoints returns the records of the given record sets.
+func newEndpoints(recordSets []*route53.ResourceRecordSet) []*endpoint.Endpoint {
+	var endpoints []*endpoint.Endpoint
+	for _, r := range recordSets {
+		var ttl endpoint.TTL
+		if r.TTL != nil {
+			ttl = endpoint.TTL(*r.TTL)
+		}
+
+		if len(r.ResourceRecords) > 0 {
+			targets := make([]string, len(r.ResourceRecords))
+			for idx, rr := range r.ResourceRecords {
+				targets[idx] = aws.StringValue(rr.Value)
 			}
 
-			if r.AliasTarget != nil {
-				endpoints = append(endpoints, endpoint.NewEndpointWithTTL(wildcardUnescape(aws.StringValue(r.Name)), endpoint.RecordTypeCNAME, ttl, aws.StringValue(r.AliasTarget.DNSName)))
+			endpoints = append(endpoints, endpoint.NewEndpointWithTTL(wildcardUnescape(aws.StringValue(r.Name)), aws.StringValue(r.Type), ttl, targets...))
+		}
+
+		if r.AliasTarget != nil {
+			ep := endpoint.NewEndpointWithTTL(wildcardUnescape(aws.StringValue(r.Name)), endpoint.RecordTypeCNAME, ttl, aws.StringValue(r.AliasTarget.DNSName))
+			// the aliases of anything but a load balancer are aliases of the records of their zone
+			if canonicalHostedZone(strings.TrimSuffix(aws.StringValue(r.AliasTarget.DNSName), ".")) == "" {
+				ep.WithProviderSpecific(AliasProperty, "true")
 			}
+			endpoints = append(endpoints, ep)
 		}
+	}
+	return endpoints
+}
 
-		return true
+// mergePrivateEndpoints adds the records of the private zones to the records of
+// the public zones, as the private targets of the public records of the same name
+// and type when they point to other targets. The records whose name matches both
+// private and public zones are given the visibility of the zones serving them.
+func mergePrivateEndpoints(public, private []*endpoint.Endpoint, zones map[string]*route53.HostedZone) []*endpoint.Endpoint {
+	byKey := make(map[string]*endpoint.Endpoint, len(public))
+	for _, ep := range public {
+		key := ep.DNSName + "/" + ep.RecordType
+		if _, ok := byKey[key]; !ok {
+			byKey[key] = ep
+		}
 	}
 
-	for _, z := range zones {
-		params := &route53.ListResourceRecordSetsInput{
-			HostedZoneId: z.Id,
+	merged := map[*endpoint.Endpoint]bool{}
+	var privateOnly []*endpoint.Endpoint
+	for _, ep := range private {
+		pub, ok := byKey[ep.DNSName+"/"+ep.RecordType]
+		if !ok {
+			privateOnly = append(privateOnly, ep)
+			continue
 		}
+		merged[pub] = true
+		if !pub.Targets.Same(ep.Targets) {
+			pub.PrivateTargets = ep.Targets
+		}
+	}
 
-		if err := p.client.ListResourceRecordSetsPages(params, f); err != nil {
-			return nil, err
+	for _, ep := range public {
+		if !crossZone(ep.DNSName, zones) {
+			continue
+		}
+		if merged[ep] {
+			ep.WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityBoth)
+		} else {
+			ep.WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityPublic)
+		}
+	}
+	for _, ep := range privateOnly {
+		if crossZone(ep.DNSName, zones) {
+			ep.WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityPrivate)
 		}
 	}
+	return append(public, privateOnly...)
+}
 
-	return endpoints, nil
+// crossZone returns true if the name matches both private and public zones.
+func crossZone(name string, zones map[string]*route53.HostedZone) bool {
+	var private, public bool
+	for _, z := range suitableZones(ensureTrailingDot(name), zones) {
+		if isPrivateZone(z) {
+			private = true
+		} else {
+			public = true
+		}
+	}
+	return private && public
+}
+
+// zoneVisibility returns the ZoneVisibilityProperty of the record, empty if it has none.
+func zoneVisibility(ep *endpoint.Endpoint) string {
+	property, _ := ep.ProviderSpecific.Get(ZoneVisibilityProperty)
+	return property.Value
+}
+
+// visibleZones keeps the zones of the given visibility among the suitable zones of
+// a record. The visibility only chooses between private and public zones, all the
+// zones are kept when none of them has the given visibility.
+func visibleZones(zones []*route53.HostedZone, visibility string) []*route53.HostedZone {
+	if visibility != ZoneVisibilityPublic && visibility != ZoneVisibilityPrivate {
+		return zones
+	}
+	var visible []*route53.HostedZone
+	for _, z := range zones {
+		if isPrivateZone(z) == (visibility == ZoneVisibilityPrivate) {
+			visible = append(visible, z)
+		}
+	}
+	if len(visible) == 0 {
+		return zones
+	}
+	return visible
+}
+
+// isPrivateZone returns true if the zone is a private hosted zone.
+func isPrivateZone(z *route53.HostedZone) bool {
+	return z.Config != nil && aws.BoolValue(z.Config.PrivateZone)
 }
 
 // CreateRecords creates a given set of DNS records in the given hosted zone.
 func (p *AWSProvider) CreateRecords(endpoints []*endpoint.Endpoint) error {
-	return p.submitChanges(p.newChanges(route53.ChangeActionCreate, endpoints))
+	cs := p.newChanges(route53.ChangeActionCreate, endpoints)
+	_, err := p.submitChanges(cs, p.privateChanges(route53.ChangeActionCreate, endpoints, cs), visibilities(endpoints, cs))
+	return err
 }
 
 // UpdateRecords updates a given set of old records to a new set of records in a given hosted zone.
 func (p *AWSProvider) UpdateRecords(endpoints, _ []*endpoint.Endpoint) error {
-	return p.submitChanges(p.newChanges(route53.ChangeActionUpsert, endpoints))
+	cs := p.newChanges(route53.ChangeActionUpsert, endpoints)
+	_, err := p.submitChanges(cs, p.privateChanges(route53.ChangeActionUpsert, endpoints, cs), visibilities(endpoints, cs))
+	return err
 }
 
 // DeleteRecords deletes a given set of DNS records in a given zone.
 func (p *AWSProvider) DeleteRecords(endpoints []*endpoint.Endpoint) error {
-	return p.submitChanges(p.newChanges(route53.ChangeActionDelete, endpoints))
+	cs := p.newChanges(route53.ChangeActionDelete, endpoints)
+	_, err := p.submitChanges(cs, p.privateChanges(route53.ChangeActionDelete, endpoints, cs), visibilities(endpoints, cs))
+	return err
+}
+
+// ProjectRecords returns the number of record sets of each hosted zone, by name and
+// ID, once the changes are applied, including the record sets managed by others.
+func (p *AWSProvider) ProjectRecords(changes *plan.Changes) (map[string]int, error) {
+	zones, err := p.Zones()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(zones))
+	for id, z := range zones {
+		counts[zoneKey(id, z)] = int(aws.Int64Value(z.ResourceRecordSetCount))
+	}
+	count := func(endpoints []*endpoint.Endpoint, delta int) {
+		for _, ep := range endpoints {
+			for _, z := range visibleZones(suitableZones(ensureTrailingDot(ep.DNSName), zones), zoneVisibility(ep)) {
+				counts[zoneKey(aws.StringValue(z.Id), z)] += delta
+			}
+		}
+	}
+	count(changes.Create, 1)
+	count(changes.Delete, -1)
+	return counts, nil
+}
+
+// zoneKey names a hosted zone in the projections, the private and public zones of a domain sharing their name.
+func zoneKey(id string, z *route53.HostedZone) string {
+	return fmt.Sprintf("%s (%s)", aws.StringValue(z.Name), id)
+}
+
+// isStaleChangeBatch returns whether Route53 rejected a change batch as it deleted
+// or updated a record set which wasn't found, e.g.
+// "Tried to delete resource record set [name='foo.example.org.', type='A'] but it was not found".
+func isStaleChangeBatch(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == route53.ErrCodeInvalidChangeBatch && strings.Contains(aerr.Message(), "but it was not found")
 }
 
 // ApplyChanges applies a given set of changes in a given zone.
+// When the changes of some zones fail, it returns a *plan.PartialError holding the changes which were applied.
+// The changes of unsupported record types, e.g. MX or NS, are never applied.
 func (p *AWSProvider) ApplyChanges(changes *plan.Changes) error {
-	combinedChanges := make([]*route53.Change, 0, len(changes.Create)+len(changes.UpdateNew)+len(changes.Delete))
+	changes = p.domainFilter.MatchChanges(managedChanges(changes))
 
-	combinedChanges = append(combinedChanges, p.newChanges(route53.ChangeActionCreate, changes.Create)...)
-	combinedChanges = append(combinedChanges, p.newChanges(route53.ChangeActionUpsert, changes.UpdateNew)...)
-	combinedChanges = append(combinedChanges, p.newChanges(route53.ChangeActionDelete, changes.Delete)...)
+	creates := p.newChanges(route53.ChangeActionCreate, changes.Create)
+	upserts := p.newChanges(route53.ChangeActionUpsert, changes.UpdateNew)
+	deletes := p.newChanges(route53.ChangeActionDelete, changes.Delete)
 
-	return p.submitChanges(combinedChanges)
+	withdrawals, withdrawn := p.withdrawals(changes.UpdateOld, changes.UpdateNew)
+
+	combinedChanges := make([]*route53.Change, 0, len(creates)+len(upserts)+len(deletes)+len(withdrawals))
+	combinedChanges = append(combinedChanges, creates...)
+	combinedChanges = append(combinedChanges, upserts...)
+	combinedChanges = append(combinedChanges, deletes...)
+	combinedChanges = append(combinedChanges, withdrawals...)
+
+	private := p.privateChanges(route53.ChangeActionCreate, changes.Create, creates)
+	for c, pc := range p.privateChanges(route53.ChangeActionUpsert, changes.UpdateNew, upserts) {
+		private[c] = pc
+	}
+	for c, pc := range p.privateChanges(route53.ChangeActionDelete, changes.Delete, deletes) {
+		private[c] = pc
+	}
+
+	visibility := visibilities(changes.Create, creates)
+	for c, v := range visibilities(changes.UpdateNew, upserts) {
+		visibility[c] = v
+	}
+	for c, v := range visibilities(changes.Delete, deletes) {
+		visibility[c] = v
+	}
+	for c, v := range withdrawn {
+		visibility[c] = v
+	}
+
+	applied, err := p.submitChanges(combinedChanges, private, visibility)
+	if perr, ok := err.(*plan.PartialError); ok {
+		perr.Applied = &plan.Changes{}
+		for i, c := range creates {
+			if applied[c] {
+				perr.Applied.Create = append(perr.Applied.Create, changes.Create[i])
+			}
+		}
+		for i, c := range upserts {
+			if applied[c] {
+				perr.Applied.UpdateNew = append(perr.Applied.UpdateNew, changes.UpdateNew[i])
+				if i < len(changes.UpdateOld) {
+					perr.Applied.UpdateOld = append(perr.Applied.UpdateOld, changes.UpdateOld[i])
+				}
+			}
+		}
+		for i, c := range deletes {
+			if applied[c] {
+				perr.Applied.Delete = append(perr.Applied.Delete, changes.Delete[i])
+			}
+		}
+	}
+	return err
 }
 
-// submitChanges takes a zone and a collection of Changes and sends them as a single transaction.
-func (p *AWSProvider) submitChanges(changes []*route53.Change) error {
+// visibilities returns the zone visibilities of the records, keyed by their changes returned by newChanges.
+func visibilities(endpoints []*endpoint.Endpoint, changes []*route53.Change) map[*route53.Change]string {
+	visibility := map[*route53.Change]string{}
+	for i, ep := range endpoints {
+		if v := zoneVisibility(ep); v != "" {
+			visibility[changes[i]] = v
+		}
+	}
+	return visibility
+}
+
+// withdrawals returns the deletions of the updated records from the kind of zones their
+// new visibility leaves out, along with the visibility of the zones they're deleted from.
+func (p *AWSProvider) withdrawals(updateOld, updateNew []*endpoint.Endpoint) ([]*route53.Change, map[*route53.Change]string) {
+	var changes []*route53.Change
+	visibility := map[*route53.Change]string{}
+	for i, ep := range updateNew {
+		if i >= len(updateOld) {
+			break
+		}
+		old := updateOld[i]
+		var left string
+		switch zoneVisibility(ep) {
+		case ZoneVisibilityPublic:
+			left = ZoneVisibilityPrivate
+		case ZoneVisibilityPrivate:
+			left = ZoneVisibilityPublic
+		default:
+			continue
+		}
+		if v := zoneVisibility(old); v != ZoneVisibilityBoth && v != left {
+			continue
+		}
+		// the record is deleted as it's served by the zones it leaves
+		deleted := *old
+		if left == ZoneVisibilityPrivate && len(old.PrivateTargets) > 0 {
+			deleted.Targets = old.PrivateTargets
+		}
+		c := p.newChange(route53.ChangeActionDelete, &deleted)
+		changes = append(changes, c)
+		visibility[c] = left
+	}
+	return changes, visibility
+}
+
+// submitChanges takes a zone and a collection of Changes and sends them as a single transaction per zone.
+// It returns the changes which were applied to all of their zones. If the changes of some zones failed,
+// the error is a *plan.PartialError listing them. The changes left out of a batch by the change limit
+// are not applied, and are submitted again on the next run. The changes of private are submitted
+// to the private zones in place of the changes they're keyed by, which may be nil. The changes
+// of visibility are only submitted to the zones of their visibility, see visibleZones.
+func (p *AWSProvider) submitChanges(changes []*route53.Change, private map[*route53.Change]*route53.Change, visibility map[*route53.Change]string) (map[*route53.Change]bool, error) {
 	// return early if there is nothing to change
 	if len(changes) == 0 {
 		log.Info("All records are already up to date")
-		return nil
+		return nil, nil
 	}
 
 	zones, err := p.Zones()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// separate into per-zone change sets to be passed to the API.
-	changesByZone := changesByZone(zones, changes)
+	changesByZone := changesByZone(zones, changes, visibility)
 	if len(changesByZone) == 0 {
 		log.Info("All records are already up to date, there are no changes for the matching hosted zones")
 	}
 
+	// the records only served by private zones keep their targets, as they're read back from them
+	public := map[*route53.Change]bool{}
 	for z, cs := range changesByZone {
-		limCs := limitChangeSet(cs, p.maxChangeCount)
+		if !isPrivateZone(zones[z]) {
+			for _, c := range cs {
+				public[c] = true
+			}
+		}
+	}
 
-		for _, c := range limCs {
+	submitted := map[*route53.Change]bool{}
+	notApplied := map[*route53.Change]bool{}
+	var failed []plan.ZoneError
+
+	for z, cs := range changesByZone {
+		limCs := p.limitChangeSet(cs)
+
+		zoneName := aws.StringValue(zones[z].Name)
+		changeBatchSize.WithLabelValues(zoneName).Set(float64(len(limCs)))
+		changeBatchRemaining.WithLabelValues(zoneName).Set(float64(p.maxChangeCount - len(limCs)))
+		if len(limCs) < len(cs) {
+			limitedChangeBatches.WithLabelValues(zoneName).Inc()
+		}
+
+		batch := limCs
+		if isPrivateZone(zones[z]) {
+			batch = privateBatch(limCs, private, public)
+		}
+
+		for _, c := range batch {
 			log.Infof("Desired change: %s %s %s", *c.Action, *c.ResourceRecordSet.Name, *c.ResourceRecordSet.Type)
 		}
 
+		inBatch := make(map[*route53.Change]bool, len(limCs))
+		for _, c := range limCs {
+			inBatch[c] = true
+		}
+		for _, c := range cs {
+			submitted[c] = true
+			if !inBatch[c] {
+				notApplied[c] = true
+			}
+		}
+
 		if !p.dryRun {
+			// the records of the zone are listed again once changed, whether the
+			// changes succeeded or not
+			p.invalidateRecords(z)
+
 			params := &route53.ChangeResourceRecordSetsInput{
 				HostedZoneId: aws.String(z),
 				ChangeBatch: &route53.ChangeBatch{
-					Changes: limCs,
+					Changes: aliasBatch(batch, z),
 				},
 			}
 
 			if _, err := p.client.ChangeResourceRecordSets(params); err != nil {
-				log.Error(err) //TODO(ideahitme): consider changing the interface in cases when this error might be a concern for other components
+				log.Errorf("Failed to update records in zone %s: %v", zoneName, err)
+				failed = append(failed, plan.ZoneError{Zone: zoneName, Err: err})
+				for _, c := range limCs {
+					notApplied[c] = true
+				}
 				continue
 			}
-			log.Infof("Record in zone %s were successfully updated", aws.StringValue(zones[z].Name))
+			log.Infof("Record in zone %s were successfully updated", zoneName)
+		}
+	}
+
+	applied := make(map[*route53.Change]bool, len(submitted))
+	for c := range submitted {
+		if !notApplied[c] {
+			applied[c] = true
 		}
 	}
 
-	return nil
+	if len(failed) > 0 {
+		return applied, &plan.PartialError{Failed: failed}
+	}
+	return applied, nil
 }
 
 // newChanges returns a collection of Changes based on the given records and action.
@@ -327,6 +923,38 @@ func (p *AWSProvider) newChanges(action string, endpoints []*endpoint.Endpoint)
 	return changes
 }
 
+// privateChanges returns the changes of the records pointing to other targets in the
+// private zones, keyed by the changes of the records returned by newChanges.
+func (p *AWSProvider) privateChanges(action string, endpoints []*endpoint.Endpoint, changes []*route53.Change) map[*route53.Change]*route53.Change {
+	private := map[*route53.Change]*route53.Change{}
+	for i, ep := range endpoints {
+		if len(ep.PrivateTargets) == 0 {
+			continue
+		}
+		privateEndpoint := *ep
+		privateEndpoint.Targets = ep.PrivateTargets
+		private[changes[i]] = p.newChange(action, &privateEndpoint)
+	}
+	return private
+}
+
+// privateBatch returns the batch of a private zone, where the changes pointing to
+// other targets in the private zones are replaced, provided they're also submitted
+// to a public zone.
+func privateBatch(cs []*route53.Change, private map[*route53.Change]*route53.Change, public map[*route53.Change]bool) []*route53.Change {
+	if len(private) == 0 {
+		return cs
+	}
+	batch := make([]*route53.Change, 0, len(cs))
+	for _, c := range cs {
+		if pc, ok := private[c]; ok && public[c] {
+			c = pc
+		}
+		batch = append(batch, c)
+	}
+	return batch
+}
+
 // newChange returns a Change of the given record by the given action, e.g.
 // action=ChangeActionCreate returns a change for creation of the record and
 // action=ChangeActionDelete returns a change for deletion of the record.
@@ -345,6 +973,13 @@ func (p *AWSProvider) newChange(action string, endpoint *endpoint.Endpoint) *rou
 			HostedZoneId:         aws.String(canonicalHostedZone(endpoint.Targets[0])),
 			EvaluateTargetHealth: aws.Bool(p.evaluateTargetHealth),
 		}
+	} else if isRecordAlias(endpoint) {
+		// the zone of the alias is only known once the change is submitted to it, see aliasBatch
+		change.ResourceRecordSet.Type = aws.String(route53.RRTypeA)
+		change.ResourceRecordSet.AliasTarget = &route53.AliasTarget{
+			DNSName:              aws.String(endpoint.Targets[0]),
+			EvaluateTargetHealth: aws.Bool(p.evaluateTargetHealth),
+		}
 	} else {
 		change.ResourceRecordSet.Type = aws.String(endpoint.RecordType)
 		if !endpoint.RecordTTL.IsConfigured() {
@@ -363,6 +998,15 @@ func (p *AWSProvider) newChange(action string, endpoint *endpoint.Endpoint) *rou
 	return change
 }
 
+// limitChangeSet limits the changes of a batch to the maximum change count, with
+// the batch change strategy of the provider.
+func (p *AWSProvider) limitChangeSet(cs []*route53.Change) []*route53.Change {
+	if p.batchChangeStrategy == BatchChangeStrategyDeletesLast {
+		return limitChangeSetDeletesLast(cs, p.maxChangeCount)
+	}
+	return limitChangeSet(cs, p.maxChangeCount)
+}
+
 func limitChangeSet(cs []*route53.Change, limit int) []*route53.Change {
 	if len(cs) <= limit {
 		return cs
@@ -370,22 +1014,60 @@ func limitChangeSet(cs []*route53.Change, limit int) []*route53.Change {
 
 	log.Warningf("Initial change batch count is %d", len(cs))
 
-	changesByName := make(map[string][]*route53.Change, 0)
-	for _, v := range cs {
-		changesByName[*v.ResourceRecordSet.Name] = append(changesByName[*v.ResourceRecordSet.Name], v)
+	changesByName, names := changesByRecordName(cs)
+
+	limCs := make([]*route53.Change, 0)
+	for i := 0; i < len(names); i++ {
+		changes := changesByName[names[i]]
+		if (limit - len(limCs)) >= len(changes) {
+			limCs = append(limCs, changes...)
+		}
 	}
+	limCs = sortChangesByActionNameType(limCs)
 
-	names := make([]string, 0)
-	for v := range changesByName {
-		names = append(names, v)
+	log.Warningf("Limited change batch count to %d", len(limCs))
+
+	return limCs
+}
+
+// limitChangeSetDeletesLast limits the changes like limitChangeSet, but takes the
+// names without deletions first and only takes the names with deletions once all
+// the others fit in the batch. The changes of a name, e.g. a record and its TXT
+// record, are still kept together.
+func limitChangeSetDeletesLast(cs []*route53.Change, limit int) []*route53.Change {
+	if len(cs) <= limit {
+		return cs
+	}
+
+	log.Warningf("Initial change batch count is %d", len(cs))
+
+	changesByName, names := changesByRecordName(cs)
+
+	var upserts, deletes []string
+	for _, name := range names {
+		if hasDelete(changesByName[name]) {
+			deletes = append(deletes, name)
+		} else {
+			upserts = append(upserts, name)
+		}
 	}
-	sort.Strings(names)
 
 	limCs := make([]*route53.Change, 0)
-	for i := 0; i < len(names); i++ {
-		changes := changesByName[names[i]]
+	deferred := false
+	for _, name := range upserts {
+		changes := changesByName[name]
 		if (limit - len(limCs)) >= len(changes) {
 			limCs = append(limCs, changes...)
+		} else {
+			deferred = true
+		}
+	}
+	if !deferred {
+		for _, name := range deletes {
+			changes := changesByName[name]
+			if (limit - len(limCs)) >= len(changes) {
+				limCs = append(limCs, changes...)
+			}
 		}
 	}
 	limCs = sortChangesByActionNameType(limCs)
@@ -395,6 +1077,31 @@ func limitChangeSet(cs []*route53.Change, limit int) []*route53.Change {
 	return limCs
 }
 
+// changesByRecordName groups the changes by the name of their record, and returns
+// the sorted names.
+func changesByRecordName(cs []*route53.Change) (map[string][]*route53.Change, []string) {
+	changesByName := make(map[string][]*route53.Change, 0)
+	for _, v := range cs {
+		changesByName[*v.ResourceRecordSet.Name] = append(changesByName[*v.ResourceRecordSet.Name], v)
+	}
+
+	names := make([]string, 0)
+	for v := range changesByName {
+		names = append(names, v)
+	}
+	sort.Strings(names)
+	return changesByName, names
+}
+
+func hasDelete(cs []*route53.Change) bool {
+	for _, c := range cs {
+		if aws.StringValue(c.Action) == route53.ChangeActionDelete {
+			return true
+		}
+	}
+	return false
+}
+
 func sortChangesByActionNameType(cs []*route53.Change) []*route53.Change {
 	sort.SliceStable(cs, func(i, j int) bool {
 		if *cs[i].Action < *cs[j].Action {
@@ -415,8 +1122,9 @@ func sortChangesByActionNameType(cs []*route53.Change) []*route53.Change {
 	return cs
 }
 
-// changesByZone separates a multi-zone change into a single change per zone.
-func changesByZone(zones map[string]*route53.HostedZone, changeSet []*route53.Change) map[string][]*route53.Change {
+// changesByZone separates a multi-zone change into a single change per zone, the
+// changes of visibility being limited to the zones of their visibility.
+func changesByZone(zones map[string]*route53.HostedZone, changeSet []*route53.Change, visibility map[*route53.Change]string) map[string][]*route53.Change {
 	changes := make(map[string][]*route53.Change)
 
 	for _, z := range zones {
@@ -426,7 +1134,7 @@ func changesByZone(zones map[string]*route53.HostedZone, changeSet []*route53.Ch
 	for _, c := range changeSet {
 		hostname := ensureTrailingDot(aws.StringValue(c.ResourceRecordSet.Name))
 
-		zones := suitableZones(hostname, zones)
+		zones := visibleZones(suitableZones(hostname, zones), visibility[c])
 		if len(zones) == 0 {
 			log.Debugf("Skipping record %s because no hosted zone matching record DNS Name was detected ", c.String())
 			continue
@@ -483,6 +1191,42 @@ func isAWSLoadBalancer(ep *endpoint.Endpoint) bool {
 	return false
 }
 
+// isRecordAlias determines if a given CNAME record is published as an alias of the
+// record of its target.
+func isRecordAlias(ep *endpoint.Endpoint) bool {
+	if ep.RecordType != endpoint.RecordTypeCNAME || len(ep.Targets) == 0 {
+		return false
+	}
+	property, _ := ep.ProviderSpecific.Get(AliasProperty)
+	return property.Value == "true"
+}
+
+// aliasBatch returns the batch submitted to the given zone, the aliases of records
+// pointing to the records of this zone. Their changes are copied rather than
+// modified, as they're shared by the batches of the other zones.
+func aliasBatch(cs []*route53.Change, zoneID string) []*route53.Change {
+	var batch []*route53.Change
+	for i, c := range cs {
+		alias := c.ResourceRecordSet.AliasTarget
+		if alias == nil || alias.HostedZoneId != nil {
+			continue
+		}
+		if batch == nil {
+			batch = make([]*route53.Change, len(cs))
+			copy(batch, cs)
+		}
+		target := *alias
+		target.HostedZoneId = aws.String(strings.TrimPrefix(zoneID, "/hostedzone/"))
+		recordSet := *c.ResourceRecordSet
+		recordSet.AliasTarget = &target
+		batch[i] = &route53.Change{Action: c.Action, ResourceRecordSet: &recordSet}
+	}
+	if batch == nil {
+		return cs
+	}
+	return batch
+}
+
 // canonicalHostedZone returns the matching canonical zone for a given hostname.
 func canonicalHostedZone(hostname string) string {
 	for suffix, zone := range canonicalHostedZones {
@@ -493,3 +1237,36 @@ func canonicalHostedZone(hostname string) string {
 
 	return ""
 }
+
+// AWSPermissions returns the IAM policy statements required by the AWS provider.
+// Reading and changing record sets is restricted to the hosted zones of the
+// zone id filter, if any.
+func AWSPermissions(zoneIDFilter ZoneIDFilter) []permissions.Statement {
+	// CreateHostedZone is only used by the tests to set up zones
+	actions := permissions.Actions("route53", (*Route53API)(nil), "CreateHostedZone")
+	zoneActions, otherActions := permissions.Partition(actions, "route53:ChangeResourceRecordSets", "route53:GetHostedZone", "route53:ListResourceRecordSets")
+
+	zoneResources := []string{}
+	for _, id := range zoneIDFilter.zoneIDs {
+		if id == "" {
+			continue
+		}
+		zoneResources = append(zoneResources, "arn:aws:route53:::hostedzone/"+strings.TrimPrefix(id, "/hostedzone/"))
+	}
+	if len(zoneResources) == 0 {
+		zoneResources = append(zoneResources, "arn:aws:route53:::hostedzone/*")
+	}
+
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   zoneActions,
+			Resource: zoneResources,
+		},
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   otherActions,
+			Resource: []string{permissions.AnyResource},
+		},
+	}
+}
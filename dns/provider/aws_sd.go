@@ -32,6 +32,7 @@ import (
 	"github.com/linki/instrumented_http"
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/permissions"
 	"github.com/openfresh/external-ips/pkg/apis/externalips"
 	log "github.com/sirupsen/logrus"
 )
@@ -48,6 +49,17 @@ const (
 	sdInstanceAttrAlias = "AWS_ALIAS_DNS_NAME"
 )
 
+func init() {
+	Register("aws-sd", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewAWSSDProvider(zones.DomainFilter, zones.ZoneType, cfg.AWSRegion, cfg.DryRun)
+		},
+		Permissions: func([]string) []permissions.Statement {
+			return AWSSDPermissions()
+		},
+	})
+}
+
 // AWSSDClient is the subset of the AWS Route53 Auto Naming API that we actually use. Add methods as required.
 // Signatures must match exactly. Taken from https://github.com/aws/aws-sdk-go/blob/master/service/servicediscovery/api.go
 type AWSSDClient interface {
@@ -61,6 +73,17 @@ type AWSSDClient interface {
 	UpdateService(input *sd.UpdateServiceInput) (*sd.UpdateServiceOutput, error)
 }
 
+// AWSSDPermissions returns the IAM policy statements required by the AWS ServiceDiscovery provider.
+func AWSSDPermissions() []permissions.Statement {
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   permissions.Actions("servicediscovery", (*AWSSDClient)(nil)),
+			Resource: []string{permissions.AnyResource},
+		},
+	}
+}
+
 // AWSSDProvider is an implementation of Provider for AWS Route53 Auto Naming.
 type AWSSDProvider struct {
 	client AWSSDClient
@@ -71,9 +94,13 @@ type AWSSDProvider struct {
 	namespaceTypeFilter *sd.NamespaceFilter
 }
 
-// NewAWSSDProvider initializes a new AWS Route53 Auto Naming based Provider.
-func NewAWSSDProvider(domainFilter DomainFilter, namespaceType string, dryRun bool) (*AWSSDProvider, error) {
+// NewAWSSDProvider initializes a new AWS Route53 Auto Naming based Provider, in the
+// given region, the region of the AWS configuration if empty.
+func NewAWSSDProvider(domainFilter DomainFilter, namespaceType string, region string, dryRun bool) (*AWSSDProvider, error) {
 	config := aws.NewConfig()
+	if region != "" {
+		config = config.WithRegion(region)
+	}
 
 	config = config.WithHTTPClient(
 		instrumented_http.NewClient(config.HTTPClient, &instrumented_http.Callbacks{
@@ -184,7 +211,7 @@ func (p *AWSSDProvider) instancesToEndpoint(ns *sd.NamespaceSummary, srv *sd.Ser
 		}
 	}
 
-	return newEndpoint
+	return newEndpoint.Normalize()
 }
 
 // ApplyChanges applies Kubernetes changes in endpoints to AWS API
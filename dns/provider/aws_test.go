@@ -23,14 +23,18 @@ import (
 	"fmt"
 	"net"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
 	"github.com/openfresh/external-ips/internal/testutils"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -49,33 +53,60 @@ var _ Route53API = &Route53APIStub{}
 // mostly taken from: https://github.com/kubernetes/kubernetes/blob/853167624edb6bc0cfdcdfb88e746e178f5db36c/federation/pkg/dnsprovider/providers/aws/route53/stubs/route53api.go
 type Route53APIStub struct {
 	zones      map[string]*route53.HostedZone
+	vpcs       map[string][]*route53.VPC
 	recordSets map[string]map[string][]*route53.ResourceRecordSet
+
+	mu    sync.Mutex
+	pages int
 }
 
 // NewRoute53APIStub returns an initialized Route53APIStub
 func NewRoute53APIStub() *Route53APIStub {
 	return &Route53APIStub{
 		zones:      make(map[string]*route53.HostedZone),
+		vpcs:       make(map[string][]*route53.VPC),
 		recordSets: make(map[string]map[string][]*route53.ResourceRecordSet),
 	}
 }
 
 func (r *Route53APIStub) ListResourceRecordSetsPages(input *route53.ListResourceRecordSetsInput, fn func(p *route53.ListResourceRecordSetsOutput, lastPage bool) (shouldContinue bool)) error {
-	output := route53.ListResourceRecordSetsOutput{} // TODO: Support optional input args.
-	if len(r.recordSets) <= 0 {
-		output.ResourceRecordSets = []*route53.ResourceRecordSet{}
-	} else if _, ok := r.recordSets[aws.StringValue(input.HostedZoneId)]; !ok {
-		output.ResourceRecordSets = []*route53.ResourceRecordSet{}
-	} else {
-		for _, rrsets := range r.recordSets[aws.StringValue(input.HostedZoneId)] {
-			for _, rrset := range rrsets {
-				output.ResourceRecordSets = append(output.ResourceRecordSets, rrset)
-			}
+	rrsets := []*route53.ResourceRecordSet{} // TODO: Support the start record name and type.
+	for _, sets := range r.recordSets[aws.StringValue(input.HostedZoneId)] {
+		rrsets = append(rrsets, sets...)
+	}
+
+	maxItems := len(rrsets)
+	if input.MaxItems != nil {
+		n, err := strconv.Atoi(aws.StringValue(input.MaxItems))
+		if err != nil {
+			return err
+		}
+		maxItems = n
+	}
+
+	for {
+		page := rrsets
+		if len(page) > maxItems {
+			page = page[:maxItems]
+		}
+		rrsets = rrsets[len(page):]
+
+		r.mu.Lock()
+		r.pages++
+		r.mu.Unlock()
+
+		lastPage := len(rrsets) == 0
+		if !fn(&route53.ListResourceRecordSetsOutput{ResourceRecordSets: page}, lastPage) || lastPage {
+			return nil
 		}
 	}
-	lastPage := true
-	fn(&output, lastPage)
-	return nil
+}
+
+// listedPages returns the number of pages of record sets listed so far.
+func (r *Route53APIStub) listedPages() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pages
 }
 
 // Route53 stores wildcards escaped: http://docs.aws.amazon.com/Route53/latest/DeveloperGuide/DomainNameFormat.html?shortFooter=true#domain-name-format-asterisk
@@ -134,6 +165,7 @@ func (r *Route53APIStub) ChangeResourceRecordSets(input *route53.ChangeResourceR
 		}
 	}
 	r.recordSets[aws.StringValue(input.HostedZoneId)] = recordSets
+	r.zones[aws.StringValue(input.HostedZoneId)].ResourceRecordSetCount = aws.Int64(int64(len(recordSets)))
 	return output, nil // TODO: We should ideally return status etc, but we don't' use that yet.
 }
 
@@ -158,9 +190,21 @@ func (r *Route53APIStub) CreateHostedZone(input *route53.CreateHostedZoneInput)
 		Name:   aws.String(name),
 		Config: input.HostedZoneConfig,
 	}
+	if input.VPC != nil {
+		r.vpcs[id] = []*route53.VPC{input.VPC}
+	}
 	return &route53.CreateHostedZoneOutput{HostedZone: r.zones[id]}, nil
 }
 
+func (r *Route53APIStub) GetHostedZone(input *route53.GetHostedZoneInput) (*route53.GetHostedZoneOutput, error) {
+	id := aws.StringValue(input.Id)
+	zone, ok := r.zones[id]
+	if !ok {
+		return nil, fmt.Errorf("Hosted zone doesn't exist: %s", id)
+	}
+	return &route53.GetHostedZoneOutput{HostedZone: zone, VPCs: r.vpcs[id]}, nil
+}
+
 func TestAWSZones(t *testing.T) {
 	publicZones := map[string]*route53.HostedZone{
 		"/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do.": {
@@ -211,6 +255,234 @@ func TestAWSZones(t *testing.T) {
 	}
 }
 
+func TestAWSZonesVPCFilter(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	provider.vpcFilter = NewVPCFilter([]string{"vpc-cluster"})
+
+	// private zones of the same domain, in the VPC of the cluster and in another one
+	for name, vpcID := range map[string]string{
+		"zone-5.ext-dns-test-2.teapot.zalan.do.": "vpc-cluster",
+		"zone-6.ext-dns-test-2.teapot.zalan.do.": "vpc-other",
+	} {
+		_, err := provider.client.CreateHostedZone(&route53.CreateHostedZoneInput{
+			CallerReference:  aws.String("external-dns.alpha.kubernetes.io/test-zone"),
+			Name:             aws.String(name),
+			HostedZoneConfig: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+			VPC:              &route53.VPC{VPCId: aws.String(vpcID), VPCRegion: aws.String("us-east-1")},
+		})
+		require.NoError(t, err)
+	}
+
+	zones, err := provider.Zones()
+	require.NoError(t, err)
+
+	// the public zones are kept, zone-3 isn't associated with any VPC
+	validateAWSZones(t, zones, map[string]*route53.HostedZone{
+		"/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do.": {
+			Id:   aws.String("/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do."),
+			Name: aws.String("zone-1.ext-dns-test-2.teapot.zalan.do."),
+		},
+		"/hostedzone/zone-2.ext-dns-test-2.teapot.zalan.do.": {
+			Id:   aws.String("/hostedzone/zone-2.ext-dns-test-2.teapot.zalan.do."),
+			Name: aws.String("zone-2.ext-dns-test-2.teapot.zalan.do."),
+		},
+		"/hostedzone/zone-5.ext-dns-test-2.teapot.zalan.do.": {
+			Id:   aws.String("/hostedzone/zone-5.ext-dns-test-2.teapot.zalan.do."),
+			Name: aws.String("zone-5.ext-dns-test-2.teapot.zalan.do."),
+		},
+	})
+}
+
+func TestAWSZonesVPCFilterCache(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter("private"), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	provider.vpcFilter = NewVPCFilter([]string{"vpc-cluster"})
+	provider.zoneVPCsCacheTTL = time.Hour
+	stub := provider.client.(*Route53APIStub)
+
+	_, err := provider.client.CreateHostedZone(&route53.CreateHostedZoneInput{
+		CallerReference:  aws.String("external-dns.alpha.kubernetes.io/test-zone"),
+		Name:             aws.String("zone-5.ext-dns-test-2.teapot.zalan.do."),
+		HostedZoneConfig: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+		VPC:              &route53.VPC{VPCId: aws.String("vpc-other"), VPCRegion: aws.String("us-east-1")},
+	})
+	require.NoError(t, err)
+	id := "/hostedzone/zone-5.ext-dns-test-2.teapot.zalan.do."
+
+	zones, err := provider.Zones()
+	require.NoError(t, err)
+	assert.NotContains(t, zones, id)
+
+	// the association with the VPC of the cluster is only seen once the cached VPCs expire
+	stub.vpcs[id] = []*route53.VPC{{VPCId: aws.String("vpc-cluster"), VPCRegion: aws.String("us-east-1")}}
+	zones, err = provider.Zones()
+	require.NoError(t, err)
+	assert.NotContains(t, zones, id)
+
+	cached := provider.zoneVPCs[id]
+	cached.fetched = cached.fetched.Add(-time.Hour)
+	provider.zoneVPCs[id] = cached
+	zones, err = provider.Zones()
+	require.NoError(t, err)
+	assert.Contains(t, zones, id)
+
+	// the VPCs of the zones which aren't listed anymore are dropped
+	delete(stub.zones, id)
+	_, err = provider.Zones()
+	require.NoError(t, err)
+	assert.NotContains(t, provider.zoneVPCs, id)
+}
+
+func TestAWSSplitHorizon(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	createAWSZone(t, provider, &route53.HostedZone{
+		Name:   aws.String("ext-dns-test-2.teapot.zalan.do."),
+		Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+	})
+	stub := provider.client.(*Route53APIStub)
+	key := "split-test.zone-1.ext-dns-test-2.teapot.zalan.do.::A"
+	values := func(zone string) []string {
+		var result []string
+		for _, rrs := range stub.recordSets[zone][key] {
+			for _, rr := range rrs.ResourceRecords {
+				result = append(result, aws.StringValue(rr.Value))
+			}
+		}
+		return result
+	}
+
+	ep := endpoint.NewEndpoint("split-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4")
+	ep.PrivateTargets = endpoint.Targets{"10.0.0.1"}
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{ep}}))
+
+	// the public zone gets the targets, the private zone the private targets
+	assert.Equal(t, []string{"1.2.3.4"}, values("/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do."))
+	assert.Equal(t, []string{"10.0.0.1"}, values("/hostedzone/ext-dns-test-2.teapot.zalan.do."))
+
+	// both records are read back as one
+	records, err := provider.Records()
+	require.NoError(t, err)
+	var split []*endpoint.Endpoint
+	for _, r := range records {
+		if r.DNSName == "split-test.zone-1.ext-dns-test-2.teapot.zalan.do" {
+			split = append(split, r)
+		}
+	}
+	require.Len(t, split, 1)
+	assert.Equal(t, endpoint.Targets{"1.2.3.4"}, split[0].Targets)
+	assert.Equal(t, endpoint.Targets{"10.0.0.1"}, split[0].PrivateTargets)
+
+	// and deleted from both zones
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Delete: split}))
+	assert.Empty(t, values("/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do."))
+	assert.Empty(t, values("/hostedzone/ext-dns-test-2.teapot.zalan.do."))
+
+	// a hostname only served by private zones keeps its targets
+	key = "private-test.zone-3.ext-dns-test-2.teapot.zalan.do.::A"
+	ep = endpoint.NewEndpoint("private-test.zone-3.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4")
+	ep.PrivateTargets = endpoint.Targets{"10.0.0.1"}
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{ep}}))
+	assert.Equal(t, []string{"1.2.3.4"}, values("/hostedzone/zone-3.ext-dns-test-2.teapot.zalan.do."))
+	assert.Equal(t, []string{"1.2.3.4"}, values("/hostedzone/ext-dns-test-2.teapot.zalan.do."))
+}
+
+func TestAWSZoneVisibility(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	createAWSZone(t, provider, &route53.HostedZone{
+		Name:   aws.String("ext-dns-test-2.teapot.zalan.do."),
+		Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(true)},
+	})
+	stub := provider.client.(*Route53APIStub)
+	key := "visibility-test.zone-1.ext-dns-test-2.teapot.zalan.do.::A"
+	served := func(zone string) bool {
+		return len(stub.recordSets[zone][key]) > 0
+	}
+	const public, private = "/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do.", "/hostedzone/ext-dns-test-2.teapot.zalan.do."
+	record := func() *endpoint.Endpoint {
+		records, err := provider.Records()
+		require.NoError(t, err)
+		for _, r := range records {
+			if r.DNSName == "visibility-test.zone-1.ext-dns-test-2.teapot.zalan.do" {
+				return r
+			}
+		}
+		t.Fatal("record not found")
+		return nil
+	}
+
+	ep := endpoint.NewEndpoint("visibility-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4").
+		WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityPublic)
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{ep}}))
+	assert.True(t, served(public))
+	assert.False(t, served(private))
+	current := record()
+	assert.Equal(t, ZoneVisibilityPublic, zoneVisibility(current))
+
+	// the record is published in the private zone as well
+	desired := endpoint.NewEndpoint("visibility-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4").
+		WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityBoth)
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{UpdateOld: []*endpoint.Endpoint{current}, UpdateNew: []*endpoint.Endpoint{desired}}))
+	assert.True(t, served(public))
+	assert.True(t, served(private))
+	current = record()
+	assert.Equal(t, ZoneVisibilityBoth, zoneVisibility(current))
+
+	// and withdrawn from the public zone
+	desired = endpoint.NewEndpoint("visibility-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4").
+		WithProviderSpecific(ZoneVisibilityProperty, ZoneVisibilityPrivate)
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{UpdateOld: []*endpoint.Endpoint{current}, UpdateNew: []*endpoint.Endpoint{desired}}))
+	assert.False(t, served(public))
+	assert.True(t, served(private))
+	current = record()
+	assert.Equal(t, ZoneVisibilityPrivate, zoneVisibility(current))
+
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Delete: []*endpoint.Endpoint{current}}))
+	assert.False(t, served(public))
+	assert.False(t, served(private))
+}
+
+func TestAWSRecordAlias(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	stub := provider.client.(*Route53APIStub)
+
+	require.NoError(t, provider.ApplyChanges(&plan.Changes{Create: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("app.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4"),
+		endpoint.NewEndpoint("www.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeCNAME, "app.zone-1.ext-dns-test-2.teapot.zalan.do").
+			WithProviderSpecific(AliasProperty, "true"),
+	}}))
+
+	// the alias points to the record of its zone, without resolving it
+	recordSets := stub.recordSets["/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do."]["www.zone-1.ext-dns-test-2.teapot.zalan.do.::A"]
+	require.Len(t, recordSets, 1)
+	require.NotNil(t, recordSets[0].AliasTarget)
+	assert.Equal(t, "app.zone-1.ext-dns-test-2.teapot.zalan.do.", aws.StringValue(recordSets[0].AliasTarget.DNSName))
+	assert.Equal(t, "zone-1.ext-dns-test-2.teapot.zalan.do.", aws.StringValue(recordSets[0].AliasTarget.HostedZoneId))
+	assert.Empty(t, recordSets[0].ResourceRecords)
+
+	records, err := provider.Records()
+	require.NoError(t, err)
+	var alias *endpoint.Endpoint
+	for _, r := range records {
+		if r.DNSName == "www.zone-1.ext-dns-test-2.teapot.zalan.do" {
+			alias = r
+		}
+	}
+	require.NotNil(t, alias)
+	assert.Equal(t, endpoint.RecordTypeCNAME, alias.RecordType)
+	assert.True(t, isRecordAlias(alias))
+
+	// the aliases of load balancers aren't aliases of records
+	elb := newEndpoints([]*route53.ResourceRecordSet{{
+		Name: aws.String("lb.zone-1.ext-dns-test-2.teapot.zalan.do."),
+		Type: aws.String(route53.RRTypeA),
+		AliasTarget: &route53.AliasTarget{
+			DNSName:      aws.String("foo.eu-central-1.elb.amazonaws.com."),
+			HostedZoneId: aws.String("Z215JYRZR1TBD5"),
+		},
+	}})
+	require.Len(t, elb, 1)
+	assert.False(t, isRecordAlias(elb[0]))
+}
+
 func TestAWSRecords(t *testing.T) {
 	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{
 		endpoint.NewEndpointWithTTL("list-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.2.3.4"),
@@ -234,6 +506,73 @@ func TestAWSRecords(t *testing.T) {
 	})
 }
 
+func TestAWSRecordsPagedConcurrently(t *testing.T) {
+	var records []*endpoint.Endpoint
+	for i := 0; i < 5; i++ {
+		records = append(records,
+			endpoint.NewEndpointWithTTL(fmt.Sprintf("list-test-%d.zone-1.ext-dns-test-2.teapot.zalan.do", i), endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.2.3.4"),
+			endpoint.NewEndpointWithTTL(fmt.Sprintf("list-test-%d.zone-2.ext-dns-test-2.teapot.zalan.do", i), endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
+		)
+	}
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, records)
+	provider.recordsPageSize = 2
+	provider.zoneConcurrency = 2
+	pages := provider.client.(*Route53APIStub).listedPages()
+
+	listed, err := provider.Records()
+	require.NoError(t, err)
+	validateEndpoints(t, listed, records)
+
+	// 3 pages of zone-1 and zone-2 each, 1 empty page of zone-3
+	assert.Equal(t, pages+7, provider.client.(*Route53APIStub).listedPages())
+}
+
+func TestAWSRecordsCache(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("list-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("list-test.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
+	})
+	provider.recordsCacheTTL = time.Hour
+	stub := provider.client.(*Route53APIStub)
+
+	_, err := provider.Records()
+	require.NoError(t, err)
+	pages := stub.listedPages()
+
+	// the zones are unchanged, their records are cached
+	_, err = provider.Records()
+	require.NoError(t, err)
+	assert.Equal(t, pages, stub.listedPages())
+
+	// a record added behind the back of the provider changes the number of record sets of the zone
+	_, err = stub.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String("/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do."),
+		ChangeBatch: &route53.ChangeBatch{
+			Changes: provider.newChanges(route53.ChangeActionCreate, []*endpoint.Endpoint{
+				endpoint.NewEndpointWithTTL("other.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.1.1.1"),
+			}),
+		},
+	})
+	require.NoError(t, err)
+	records, err := provider.Records()
+	require.NoError(t, err)
+	assert.Equal(t, pages+1, stub.listedPages())
+	assert.Len(t, records, 3)
+
+	// the zones changed by the provider are listed again, even with as many record sets
+	require.NoError(t, provider.UpdateRecords([]*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("list-test.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.4.4"),
+	}, nil))
+	records, err = provider.Records()
+	require.NoError(t, err)
+	assert.Equal(t, pages+2, stub.listedPages())
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("list-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.2.3.4"),
+		endpoint.NewEndpointWithTTL("other.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "1.1.1.1"),
+		endpoint.NewEndpointWithTTL("list-test.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.4.4"),
+	})
+}
+
 func TestAWSCreateRecords(t *testing.T) {
 	customTTL := endpoint.TTL(60)
 	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
@@ -386,6 +725,30 @@ func TestAWSApplyChanges(t *testing.T) {
 	})
 }
 
+func TestAWSProjectRecords(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("foo.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
+		endpoint.NewEndpointWithTTL("bar.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
+		endpoint.NewEndpointWithTTL("foo.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.4.4"),
+	})
+
+	counts, err := provider.ProjectRecords(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("baz.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("foo.zone-3.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.8.8")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "1.2.3.4")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("foo.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.4.4")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{
+		"zone-1.ext-dns-test-2.teapot.zalan.do. (/hostedzone/zone-1.ext-dns-test-2.teapot.zalan.do.)": 3,
+		"zone-2.ext-dns-test-2.teapot.zalan.do. (/hostedzone/zone-2.ext-dns-test-2.teapot.zalan.do.)": 0,
+		"zone-3.ext-dns-test-2.teapot.zalan.do. (/hostedzone/zone-3.ext-dns-test-2.teapot.zalan.do.)": 1,
+	}, counts)
+}
+
 func TestAWSApplyChangesDryRun(t *testing.T) {
 	originalEndpoints := []*endpoint.Endpoint{
 		endpoint.NewEndpointWithTTL("update-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
@@ -496,7 +859,7 @@ func TestAWSChangesByZones(t *testing.T) {
 		},
 	}
 
-	changesByZone := changesByZone(zones, changes)
+	changesByZone := changesByZone(zones, changes, nil)
 	require.Len(t, changesByZone, 3)
 
 	validateAWSChangeRecords(t, changesByZone["foo-example-org"], []*route53.Change{
@@ -563,7 +926,9 @@ func TestAWSsubmitChanges(t *testing.T) {
 	cs := make([]*route53.Change, 0, len(endpoints))
 	cs = append(cs, provider.newChanges(route53.ChangeActionCreate, endpoints)...)
 
-	require.NoError(t, provider.submitChanges(cs))
+	applied, err := provider.submitChanges(cs, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(cs))
 
 	records, err := provider.Records()
 	require.NoError(t, err)
@@ -571,6 +936,64 @@ func TestAWSsubmitChanges(t *testing.T) {
 	validateEndpoints(t, records, endpoints)
 }
 
+func TestAWSsubmitChangesBatchMetrics(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+	provider.maxChangeCount = 2
+	const zone = "zone-1.ext-dns-test-2.teapot.zalan.do."
+
+	m := &dto.Metric{}
+	require.NoError(t, limitedChangeBatches.WithLabelValues(zone).Write(m))
+	before := m.GetCounter().GetValue()
+
+	cs := provider.newChanges(route53.ChangeActionCreate, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.8.8"),
+		endpoint.NewEndpoint("b.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.8.8"),
+		endpoint.NewEndpoint("c.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.8.8"),
+	})
+	_, err := provider.submitChanges(cs, nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, changeBatchSize.WithLabelValues(zone).Write(m))
+	assert.Equal(t, float64(2), m.GetGauge().GetValue())
+	require.NoError(t, changeBatchRemaining.WithLabelValues(zone).Write(m))
+	assert.Equal(t, float64(0), m.GetGauge().GetValue())
+	require.NoError(t, limitedChangeBatches.WithLabelValues(zone).Write(m))
+	assert.Equal(t, before+1, m.GetCounter().GetValue())
+
+	// the change left out fits in the next batch
+	_, err = provider.submitChanges(cs[2:], nil, nil)
+	require.NoError(t, err)
+	require.NoError(t, changeBatchRemaining.WithLabelValues(zone).Write(m))
+	assert.Equal(t, float64(1), m.GetGauge().GetValue())
+	require.NoError(t, limitedChangeBatches.WithLabelValues(zone).Write(m))
+	assert.Equal(t, before+1, m.GetCounter().GetValue())
+}
+
+func TestAWSApplyChangesPartialFailure(t *testing.T) {
+	provider := newAWSProvider(t, NewDomainFilter([]string{"ext-dns-test-2.teapot.zalan.do."}), NewZoneIDFilter([]string{}), NewZoneTypeFilter(""), defaultEvaluateTargetHealth, false, []*endpoint.Endpoint{})
+
+	applied := endpoint.NewEndpoint("create-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "8.8.8.8")
+	// the stub refuses A records not pointing to IPs, failing the whole batch of zone-2
+	invalid := endpoint.NewEndpoint("create-test.zone-2.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, "not-an-ip")
+
+	err := provider.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{applied, invalid},
+	})
+	require.Error(t, err)
+
+	perr, ok := err.(*plan.PartialError)
+	require.True(t, ok)
+	require.Len(t, perr.Failed, 1)
+	assert.Equal(t, "zone-2.ext-dns-test-2.teapot.zalan.do.", perr.Failed[0].Zone)
+	assert.Equal(t, []*endpoint.Endpoint{applied}, perr.Applied.Create)
+
+	records, err := provider.Records()
+	require.NoError(t, err)
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("create-test.zone-1.ext-dns-test-2.teapot.zalan.do", endpoint.RecordTypeA, endpoint.TTL(recordTTL), "8.8.8.8"),
+	})
+}
+
 func TestAWSLimitChangeSet(t *testing.T) {
 	var cs []*route53.Change
 
@@ -626,6 +1049,40 @@ func TestAWSLimitChangeSetExceeding(t *testing.T) {
 	validateAWSChangeRecords(t, limCs, sortChangesByActionNameType(cs)[0:expectedCount])
 }
 
+func TestAWSLimitChangeSetDeletesLast(t *testing.T) {
+	newChanges := func(action string, names ...string) []*route53.Change {
+		var cs []*route53.Change
+		for _, name := range names {
+			for _, recordType := range []string{"A", "TXT"} {
+				cs = append(cs, &route53.Change{
+					Action: aws.String(action),
+					ResourceRecordSet: &route53.ResourceRecordSet{
+						Name: aws.String(name),
+						Type: aws.String(recordType),
+					},
+				})
+			}
+		}
+		return cs
+	}
+	// a-old is replaced by b-new and c-new
+	deletes := newChanges(route53.ChangeActionDelete, "a-old")
+	creates := newChanges(route53.ChangeActionCreate, "b-new", "c-new")
+	cs := append(append([]*route53.Change{}, deletes...), creates...)
+
+	// by name, the deletion is submitted before one of the creations
+	validateAWSChangeRecords(t, limitChangeSet(cs, 4), sortChangesByActionNameType(append(append([]*route53.Change{}, deletes...), creates[:2]...)))
+
+	// the deletion waits for all the creations
+	validateAWSChangeRecords(t, limitChangeSetDeletesLast(cs, 4), creates)
+	validateAWSChangeRecords(t, limitChangeSetDeletesLast(cs, 3), creates[:2])
+	validateAWSChangeRecords(t, limitChangeSetDeletesLast(cs, 6), cs)
+
+	// the strategy is selected by the provider
+	provider := &AWSProvider{maxChangeCount: 4, batchChangeStrategy: BatchChangeStrategyDeletesLast}
+	validateAWSChangeRecords(t, provider.limitChangeSet(cs), creates)
+}
+
 func validateEndpoints(t *testing.T, endpoints []*endpoint.Endpoint, expected []*endpoint.Endpoint) {
 	assert.True(t, testutils.SameEndpoints(endpoints, expected), "expected and actual endpoints don't match. %s:%s", endpoints, expected)
 }
@@ -924,6 +1381,18 @@ func newAWSProvider(t *testing.T, domainFilter DomainFilter, zoneIDFilter ZoneID
 	return provider
 }
 
+func TestAWSPermissions(t *testing.T) {
+	statements := AWSPermissions(NewZoneIDFilter([]string{""}))
+	require.Len(t, statements, 2)
+	assert.Equal(t, []string{"route53:ChangeResourceRecordSets", "route53:GetHostedZone", "route53:ListResourceRecordSets"}, statements[0].Action)
+	assert.Equal(t, []string{"arn:aws:route53:::hostedzone/*"}, statements[0].Resource)
+	assert.Equal(t, []string{"route53:ListHostedZones"}, statements[1].Action)
+	assert.Equal(t, []string{"*"}, statements[1].Resource)
+
+	statements = AWSPermissions(NewZoneIDFilter([]string{"/hostedzone/ZTST1", "ZTST2"}))
+	assert.Equal(t, []string{"arn:aws:route53:::hostedzone/ZTST1", "arn:aws:route53:::hostedzone/ZTST2"}, statements[0].Resource)
+}
+
 func validateRecords(t *testing.T, records []*route53.ResourceRecordSet, expected []*route53.ResourceRecordSet) {
 	assert.Equal(t, expected, records)
 }
@@ -0,0 +1,94 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+// CachedProvider is a Provider reading the records of another provider at most
+// once per interval, whatever the registry on top of it. The records are read
+// again after any change is applied, whether it succeeded or not.
+type CachedProvider struct {
+	Provider
+	interval time.Duration
+
+	mu        sync.Mutex
+	records   []*endpoint.Endpoint
+	refreshed time.Time
+}
+
+// NewCachedProvider returns a CachedProvider caching the records of provider
+// for interval.
+func NewCachedProvider(provider Provider, interval time.Duration) *CachedProvider {
+	return &CachedProvider{
+		Provider: provider,
+		interval: interval,
+	}
+}
+
+// Records returns the cached records, read from the provider once the interval
+// has expired or the cache was invalidated. The callers are given their own
+// copies of the records, which they may modify.
+func (p *CachedProvider) Records() ([]*endpoint.Endpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.refreshed.IsZero() || time.Since(p.refreshed) >= p.interval {
+		records, err := p.Provider.Records()
+		if err != nil {
+			return nil, err
+		}
+		p.records = records
+		p.refreshed = time.Now()
+	} else {
+		log.Debug("Using cached records.")
+	}
+
+	return copyEndpoints(p.records), nil
+}
+
+// ApplyChanges applies the changes to the provider and invalidates the cache
+// unless there was nothing to change.
+func (p *CachedProvider) ApplyChanges(changes *plan.Changes) error {
+	if len(changes.Create)+len(changes.UpdateNew)+len(changes.UpdateOld)+len(changes.Delete) > 0 {
+		defer p.Invalidate()
+	}
+	return p.Provider.ApplyChanges(changes)
+}
+
+// Invalidate drops the cache so that the next call to Records reads the provider.
+func (p *CachedProvider) Invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.records = nil
+	p.refreshed = time.Time{}
+}
+
+func copyEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	copies := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, ep := range endpoints {
+		c := *ep
+		c.Targets = append(endpoint.Targets(nil), ep.Targets...)
+		if ep.PrivateTargets != nil {
+			c.PrivateTargets = append(endpoint.Targets(nil), ep.PrivateTargets...)
+		}
+		c.Labels = endpoint.NewLabels()
+		for k, v := range ep.Labels {
+			c.Labels[k] = v
+		}
+		if ep.ProviderSpecific != nil {
+			c.ProviderSpecific = append(endpoint.ProviderSpecific(nil), ep.ProviderSpecific...)
+		}
+		copies = append(copies, &c)
+	}
+	return copies
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+var _ Provider = &CachedProvider{}
+
+func TestCachedProvider(t *testing.T) {
+	reads := 0
+	im := NewInMemoryProvider()
+	im.OnRecords = func() { reads++ }
+	require.NoError(t, im.CreateZone("example.org"))
+	p := NewCachedProvider(im, time.Hour)
+
+	records, err := p.Records()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+	assert.Equal(t, 1, reads)
+
+	// applying nothing keeps the cache
+	require.NoError(t, p.ApplyChanges(&plan.Changes{}))
+	_, err = p.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 1, reads)
+
+	// applying changes invalidates it
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")},
+	}))
+	records, err = p.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 2, reads)
+	require.Len(t, records, 1)
+
+	// the callers may modify their records without altering the cache
+	records[0].Labels[endpoint.OwnerLabelKey] = "owner"
+	records[0].Targets[0] = "5.6.7.8"
+	records, err = p.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 2, reads)
+	assert.Empty(t, records[0].Labels[endpoint.OwnerLabelKey])
+	assert.Equal(t, endpoint.Targets{"1.2.3.4"}, records[0].Targets)
+
+	// a failed apply invalidates it too
+	assert.Error(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")},
+	}))
+	_, err = p.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 3, reads)
+}
+
+func TestCachedProviderExpires(t *testing.T) {
+	reads := 0
+	im := NewInMemoryProvider()
+	im.OnRecords = func() { reads++ }
+	p := NewCachedProvider(im, 0)
+
+	for i := 0; i < 2; i++ {
+		_, err := p.Records()
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, reads)
+}
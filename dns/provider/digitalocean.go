@@ -0,0 +1,438 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+const (
+	// digitalOceanEndpoint is the base URL of the DigitalOcean API
+	digitalOceanEndpoint = "https://api.digitalocean.com/v2"
+	// digitalOceanDefaultTTL is the ttl of the records whose ttl is not set, the default of DigitalOcean
+	digitalOceanDefaultTTL = 1800
+	// digitalOceanPageSize is the largest page of domains and records the API returns
+	digitalOceanPageSize = 200
+	// digitalOceanApex is the name of the records at the apex of their domain
+	digitalOceanApex = "@"
+)
+
+func init() {
+	Register("digitalocean", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewDigitalOceanProvider(
+				DigitalOceanConfig{
+					DomainFilter: zones.DomainFilter,
+					ZoneIDFilter: zones.ZoneIDFilter,
+					DryRun:       cfg.DryRun,
+				},
+			)
+		},
+	})
+}
+
+// DigitalOceanDomain is a domain of the DigitalOcean API, which has no id other than its name.
+type DigitalOceanDomain struct {
+	Name string `json:"name"`
+}
+
+// DigitalOceanRecord is a record of the DigitalOcean API, named relative to its domain.
+type DigitalOceanRecord struct {
+	ID       int    `json:"id,omitempty"`
+	Type     string `json:"type"`
+	Name     string `json:"name"`
+	Data     string `json:"data"`
+	Priority int    `json:"priority"`
+	Port     int    `json:"port"`
+	Weight   int    `json:"weight"`
+	TTL      int    `json:"ttl,omitempty"`
+}
+
+// DigitalOceanDomainClient is a subset of the DigitalOcean API the provider uses, to ease testing.
+// The updates and deletions of records which don't exist fail with ErrRecordNotFound.
+type DigitalOceanDomainClient interface {
+	ListDomains() ([]DigitalOceanDomain, error)
+	ListRecords(domain string) ([]DigitalOceanRecord, error)
+	CreateRecord(domain string, record *DigitalOceanRecord) error
+	EditRecord(domain string, id int, record *DigitalOceanRecord) error
+	DeleteRecord(domain string, id int) error
+}
+
+// DigitalOceanDomainService calls the DigitalOcean API and fulfills the DigitalOceanDomainClient interface
+type DigitalOceanDomainService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// digitalOceanLinks are the links of a page of a list, without a next page on the last one.
+type digitalOceanLinks struct {
+	Pages struct {
+		Next string `json:"next"`
+	} `json:"pages"`
+}
+
+// ListDomains lists all the pages of the domains
+func (d DigitalOceanDomainService) ListDomains() ([]DigitalOceanDomain, error) {
+	result := []DigitalOceanDomain{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Domains []DigitalOceanDomain `json:"domains"`
+			Links   digitalOceanLinks    `json:"links"`
+		}
+		if err := d.do(http.MethodGet, "/domains?"+digitalOceanPage(page), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Domains...)
+		if resp.Links.Pages.Next == "" {
+			return result, nil
+		}
+	}
+}
+
+// ListRecords lists all the pages of the records of the domain
+func (d DigitalOceanDomainService) ListRecords(domain string) ([]DigitalOceanRecord, error) {
+	result := []DigitalOceanRecord{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Records []DigitalOceanRecord `json:"domain_records"`
+			Links   digitalOceanLinks    `json:"links"`
+		}
+		if err := d.do(http.MethodGet, digitalOceanRecordsPath(domain)+"?"+digitalOceanPage(page), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Records...)
+		if resp.Links.Pages.Next == "" {
+			return result, nil
+		}
+	}
+}
+
+// CreateRecord creates a record in the domain
+func (d DigitalOceanDomainService) CreateRecord(domain string, record *DigitalOceanRecord) error {
+	return d.do(http.MethodPost, digitalOceanRecordsPath(domain), record, nil)
+}
+
+// EditRecord replaces the record of the given id
+func (d DigitalOceanDomainService) EditRecord(domain string, id int, record *DigitalOceanRecord) error {
+	return d.do(http.MethodPut, fmt.Sprintf("%s/%d", digitalOceanRecordsPath(domain), id), record, nil)
+}
+
+// DeleteRecord deletes the record of the given id
+func (d DigitalOceanDomainService) DeleteRecord(domain string, id int) error {
+	return d.do(http.MethodDelete, fmt.Sprintf("%s/%d", digitalOceanRecordsPath(domain), id), nil, nil)
+}
+
+func digitalOceanRecordsPath(domain string) string {
+	return "/domains/" + url.PathEscape(domain) + "/records"
+}
+
+func digitalOceanPage(page int) string {
+	query := url.Values{}
+	query.Set("page", fmt.Sprint(page))
+	query.Set("per_page", fmt.Sprint(digitalOceanPageSize))
+	return query.Encode()
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (d DigitalOceanDomainService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, d.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+d.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodGet {
+		return ErrRecordNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("digitalocean: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// DigitalOceanConfig contains configuration to create a new DigitalOcean provider.
+type DigitalOceanConfig struct {
+	DomainFilter DomainFilter
+	ZoneIDFilter ZoneIDFilter
+	DryRun       bool
+}
+
+// DigitalOceanProvider is an implementation of Provider for DigitalOcean DNS.
+//
+// The domains have no id other than their name, which the zone id filter matches.
+// An endpoint with several targets is stored as one record per target.
+type DigitalOceanProvider struct {
+	client DigitalOceanDomainClient
+	dryRun bool
+	// only consider zones managing domains ending in this suffix
+	domainFilter DomainFilter
+	// filter zones by name
+	zoneIDFilter ZoneIDFilter
+}
+
+// NewDigitalOceanProvider initializes a new DigitalOcean DNS based Provider.
+// The API token is read from the DO_TOKEN environment variable.
+func NewDigitalOceanProvider(digitalOceanConfig DigitalOceanConfig) (*DigitalOceanProvider, error) {
+	token, ok := os.LookupEnv("DO_TOKEN")
+	if !ok || token == "" {
+		return nil, errors.New("DigitalOcean token cannot be empty, set DO_TOKEN")
+	}
+	provider := &DigitalOceanProvider{
+		client:       DigitalOceanDomainService{client: http.DefaultClient, endpoint: digitalOceanEndpoint, token: token},
+		domainFilter: digitalOceanConfig.DomainFilter,
+		zoneIDFilter: digitalOceanConfig.ZoneIDFilter,
+		dryRun:       digitalOceanConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+// Records returns the list of records in all matching zones.
+func (p *DigitalOceanProvider) Records() ([]*endpoint.Endpoint, error) {
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint.Endpoint
+
+	for _, zone := range zones {
+		records, err := p.client.ListRecords(zone.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		// the records of the same name and type are the targets of a single endpoint
+		index := map[string]*endpoint.Endpoint{}
+		for _, record := range records {
+			if !supportedRecordType(record.Type) {
+				continue
+			}
+
+			name := digitalOceanDNSName(record.Name, zone.Name)
+			key := name + "/" + record.Type
+			ep, ok := index[key]
+			if !ok {
+				ep = endpoint.NewEndpointWithTTL(name, record.Type, endpoint.TTL(record.TTL)).WithProviderSpecific(ZoneProperty, zone.Name)
+				index[key] = ep
+				endpoints = append(endpoints, ep)
+			}
+			ep.Targets = append(ep.Targets, digitalOceanTarget(record))
+		}
+	}
+
+	return p.domainFilter.MatchEndpoints(endpoints), nil
+}
+
+// ApplyChanges applies a given set of changes zone by zone.
+// When the changes of some zones fail, it returns a *plan.PartialError holding the changes which were applied.
+func (p *DigitalOceanProvider) ApplyChanges(changes *plan.Changes) error {
+	changes = p.domainFilter.MatchChanges(managedChanges(changes))
+
+	// return early if there is nothing to change
+	if len(changes.Create) == 0 && len(changes.UpdateNew) == 0 && len(changes.Delete) == 0 {
+		log.Info("All records are already up to date")
+		return nil
+	}
+
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return err
+	}
+
+	// the domains are identified by their names
+	zoneNames := zoneIDName{}
+	for _, z := range zones {
+		zoneNames.Add(z.Name, z.Name)
+	}
+	return applyByZone(zoneNames, changes, func(_, zoneName string, changes *plan.Changes) error {
+		return p.submitChanges(zoneName, changes)
+	})
+}
+
+// submitChanges applies the changes of a zone record by record, editing the records in
+// place when the targets of an endpoint are updated.
+func (p *DigitalOceanProvider) submitChanges(zoneName string, changes *plan.Changes) error {
+	logChanges(changes)
+	if p.dryRun {
+		return nil
+	}
+
+	records, err := p.client.ListRecords(zoneName)
+	if err != nil {
+		return err
+	}
+	current := map[string][]DigitalOceanRecord{}
+	for _, record := range records {
+		key := digitalOceanDNSName(record.Name, zoneName) + "/" + record.Type
+		current[key] = append(current[key], record)
+	}
+
+	for _, ep := range changes.Create {
+		for _, target := range ep.Targets {
+			if err := p.client.CreateRecord(zoneName, newDigitalOceanRecord(zoneName, ep, target)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.UpdateNew {
+		existing := current[digitalOceanKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for i, target := range ep.Targets {
+			request := newDigitalOceanRecord(zoneName, ep, target)
+			if i < len(existing) {
+				err = p.client.EditRecord(zoneName, existing[i].ID, request)
+			} else {
+				err = p.client.CreateRecord(zoneName, request)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i := len(ep.Targets); i < len(existing); i++ {
+			if err := p.client.DeleteRecord(zoneName, existing[i].ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.Delete {
+		existing := current[digitalOceanKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for _, record := range existing {
+			if err := p.client.DeleteRecord(zoneName, record.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// zonesFiltered returns the list of zones matching the domain and zone id filters.
+func (p *DigitalOceanProvider) zonesFiltered() ([]DigitalOceanDomain, error) {
+	domains, err := p.client.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []DigitalOceanDomain{}
+	for _, d := range domains {
+		if !p.zoneIDFilter.Match(d.Name) {
+			continue
+		}
+
+		if !p.domainFilter.Match(d.Name) {
+			continue
+		}
+
+		log.Debugf("Considering zone: %s", d.Name)
+		filtered = append(filtered, d)
+	}
+
+	return filtered, nil
+}
+
+// digitalOceanDNSName returns the hostname of a record named relative to its zone.
+func digitalOceanDNSName(name, zoneName string) string {
+	if name == digitalOceanApex || name == "" {
+		return zoneName
+	}
+	return name + "." + zoneName
+}
+
+// digitalOceanRecordName returns the name of the record of the hostname relative to its zone.
+func digitalOceanRecordName(dnsName, zoneName string) string {
+	dnsName = strings.TrimSuffix(dnsName, ".")
+	if dnsName == zoneName {
+		return digitalOceanApex
+	}
+	return strings.TrimSuffix(dnsName, "."+zoneName)
+}
+
+func digitalOceanKey(ep *endpoint.Endpoint) string {
+	return strings.TrimSuffix(ep.DNSName, ".") + "/" + ep.RecordType
+}
+
+// digitalOceanTarget returns the target of a record as the registries and the plan expect it.
+// DigitalOcean returns the TXT values without the quotes the txt registry writes them with,
+// and stores the priority, weight and port of the SRV records apart from their target.
+func digitalOceanTarget(record DigitalOceanRecord) string {
+	switch record.Type {
+	case endpoint.RecordTypeTXT:
+		return quoteTXT(record.Data)
+	case endpoint.RecordTypeSRV:
+		return fmt.Sprintf("%d %d %d %s", record.Priority, record.Weight, record.Port, strings.TrimSuffix(record.Data, "."))
+	case endpoint.RecordTypeCNAME:
+		return strings.TrimSuffix(record.Data, ".")
+	}
+	return record.Data
+}
+
+// newDigitalOceanRecord returns a DigitalOcean record of one of the targets of the endpoint in the given zone.
+func newDigitalOceanRecord(zoneName string, ep *endpoint.Endpoint, target string) *DigitalOceanRecord {
+	record := &DigitalOceanRecord{
+		Type: ep.RecordType,
+		Name: digitalOceanRecordName(ep.DNSName, zoneName),
+		Data: target,
+		TTL:  digitalOceanDefaultTTL,
+	}
+	if ep.RecordTTL.IsConfigured() {
+		record.TTL = int(ep.RecordTTL)
+	}
+
+	switch ep.RecordType {
+	case endpoint.RecordTypeTXT:
+		record.Data = unquoteTXT(target)
+	case endpoint.RecordTypeSRV:
+		// priority weight port target
+		fields := strings.Fields(target)
+		if len(fields) == 4 {
+			record.Priority, _ = strconv.Atoi(fields[0])
+			record.Weight, _ = strconv.Atoi(fields[1])
+			record.Port, _ = strconv.Atoi(fields[2])
+			record.Data = ensureTrailingDot(fields[3])
+		}
+	case endpoint.RecordTypeCNAME:
+		record.Data = ensureTrailingDot(target)
+	}
+
+	return record
+}
@@ -0,0 +1,203 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ Provider = &DigitalOceanProvider{}
+)
+
+// mockDigitalOceanDomainClient keeps the records of the domains in memory.
+type mockDigitalOceanDomainClient struct {
+	domains []DigitalOceanDomain
+	records map[string][]DigitalOceanRecord
+	nextID  int
+	edited  int
+}
+
+func newMockDigitalOceanDomainClient(records map[string][]DigitalOceanRecord) *mockDigitalOceanDomainClient {
+	m := &mockDigitalOceanDomainClient{records: records, nextID: 100}
+	for name := range records {
+		m.domains = append(m.domains, DigitalOceanDomain{Name: name})
+	}
+	return m
+}
+
+func (m *mockDigitalOceanDomainClient) ListDomains() ([]DigitalOceanDomain, error) {
+	return m.domains, nil
+}
+
+func (m *mockDigitalOceanDomainClient) ListRecords(domain string) ([]DigitalOceanRecord, error) {
+	return append([]DigitalOceanRecord{}, m.records[domain]...), nil
+}
+
+func (m *mockDigitalOceanDomainClient) CreateRecord(domain string, record *DigitalOceanRecord) error {
+	m.nextID++
+	m.records[domain] = append(m.records[domain], newMockDigitalOceanRecord(m.nextID, record))
+	return nil
+}
+
+func (m *mockDigitalOceanDomainClient) EditRecord(domain string, id int, record *DigitalOceanRecord) error {
+	m.edited++
+	for i, r := range m.records[domain] {
+		if r.ID == id {
+			m.records[domain][i] = newMockDigitalOceanRecord(id, record)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m *mockDigitalOceanDomainClient) DeleteRecord(domain string, id int) error {
+	for i, r := range m.records[domain] {
+		if r.ID == id {
+			m.records[domain] = append(m.records[domain][:i], m.records[domain][i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func newMockDigitalOceanRecord(id int, record *DigitalOceanRecord) DigitalOceanRecord {
+	created := *record
+	created.ID = id
+	return created
+}
+
+func TestDigitalOceanRecords(t *testing.T) {
+	client := newMockDigitalOceanDomainClient(map[string][]DigitalOceanRecord{
+		"foo.com": {
+			{ID: 1, Type: "A", Name: "test", Data: "1.1.1.1", TTL: 300},
+			{ID: 2, Type: "A", Name: "test", Data: "2.2.2.2", TTL: 300},
+			{ID: 3, Type: "CNAME", Name: "www", Data: "test.foo.com.", TTL: 1800},
+			{ID: 4, Type: "TXT", Name: "@", Data: "heritage=external-dns,external-dns/owner=default", TTL: 1800},
+			{ID: 5, Type: "SRV", Name: "_sip._tcp", Data: "sip.foo.com.", Priority: 10, Weight: 20, Port: 5060, TTL: 1800},
+			{ID: 6, Type: "NS", Name: "@", Data: "ns1.digitalocean.com", TTL: 1800},
+		},
+		"bar.com": {
+			{ID: 7, Type: "A", Name: "test", Data: "3.3.3.3", TTL: 300},
+		},
+	})
+	p := &DigitalOceanProvider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{"foo.com"}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	records, err := p.Records()
+	require.NoError(t, err)
+
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 300, "1.1.1.1", "2.2.2.2"),
+		endpoint.NewEndpointWithTTL("www.foo.com", endpoint.RecordTypeCNAME, 1800, "test.foo.com"),
+		endpoint.NewEndpointWithTTL("foo.com", endpoint.RecordTypeTXT, 1800, "\"heritage=external-dns,external-dns/owner=default\""),
+		endpoint.NewEndpointWithTTL("_sip._tcp.foo.com", endpoint.RecordTypeSRV, 1800, "10 20 5060 sip.foo.com"),
+	})
+}
+
+func TestDigitalOceanApplyChanges(t *testing.T) {
+	client := newMockDigitalOceanDomainClient(map[string][]DigitalOceanRecord{
+		"foo.com": {
+			{ID: 1, Type: "A", Name: "test", Data: "1.1.1.1", TTL: 300},
+			{ID: 2, Type: "A", Name: "test", Data: "2.2.2.2", TTL: 300},
+			{ID: 3, Type: "A", Name: "old", Data: "3.3.3.3", TTL: 300},
+		},
+	})
+	p := &DigitalOceanProvider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	err := p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("foo.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+			endpoint.NewEndpoint("new.bar.com", endpoint.RecordTypeA, "5.5.5.5"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "1.1.1.1", "2.2.2.2")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 60, "4.4.4.4")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("old.foo.com", endpoint.RecordTypeA, "3.3.3.3")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.edited)
+
+	records, err := p.Records()
+	require.NoError(t, err)
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 60, "4.4.4.4"),
+		endpoint.NewEndpointWithTTL("foo.com", endpoint.RecordTypeTXT, digitalOceanDefaultTTL, "\"heritage=external-dns,external-dns/owner=default\""),
+	})
+	assert.Equal(t, "heritage=external-dns,external-dns/owner=default", client.records["foo.com"][1].Data)
+	assert.Equal(t, "@", client.records["foo.com"][1].Name)
+}
+
+func TestDigitalOceanApplyChangesStale(t *testing.T) {
+	client := newMockDigitalOceanDomainClient(map[string][]DigitalOceanRecord{
+		"foo.com": {},
+	})
+	p := &DigitalOceanProvider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	err := p.ApplyChanges(&plan.Changes{
+		Delete: []*endpoint.Endpoint{endpoint.NewEndpoint("gone.foo.com", endpoint.RecordTypeA, "3.3.3.3")},
+	})
+	require.Error(t, err)
+	assert.True(t, IsStale(err))
+}
+
+func TestDigitalOceanDomainService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /domains":
+			fmt.Fprint(w, `{"domains":[{"name":"foo.com"}],"links":{}}`)
+		case "GET /domains/foo.com/records":
+			// the records are listed page by page until there is no next page
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, `{"domain_records":[{"id":1,"type":"A","name":"test","data":"1.1.1.1","ttl":300}],"links":{"pages":{"next":"page=2"}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"domain_records":[{"id":2,"type":"SRV","name":"_sip._tcp","data":"sip.foo.com.","priority":0,"port":5060,"weight":10}],"links":{}}`)
+		case "PUT /domains/foo.com/records/1":
+			var record map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+			assert.Equal(t, "2.2.2.2", record["data"])
+			assert.Nil(t, record["id"])
+			fmt.Fprint(w, `{"domain_record":{"id":1}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	d := DigitalOceanDomainService{client: server.Client(), endpoint: server.URL, token: "token"}
+
+	domains, err := d.ListDomains()
+	require.NoError(t, err)
+	assert.Equal(t, []DigitalOceanDomain{{Name: "foo.com"}}, domains)
+
+	records, err := d.ListRecords("foo.com")
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, 5060, records[1].Port)
+
+	require.NoError(t, d.EditRecord("foo.com", 1, &DigitalOceanRecord{Type: "A", Name: "test", Data: "2.2.2.2"}))
+	// the records which don't exist anymore are reported as such
+	assert.Equal(t, ErrRecordNotFound, d.DeleteRecord("foo.com", 3))
+}
@@ -18,28 +18,48 @@ package provider
 
 import (
 	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
 )
 
 // DomainFilter holds a lists of valid domain names
 type DomainFilter struct {
 	filters []string
+	// the domains never matching, even when they're subdomains of a filter
+	exclude []string
 }
 
 // NewDomainFilter returns a new DomainFilter given a comma separated list of domains
 func NewDomainFilter(domainFilters []string) DomainFilter {
-	filters := make([]string, len(domainFilters))
+	return NewDomainFilterWithExclusions(domainFilters, nil)
+}
 
+// NewDomainFilterWithExclusions returns a new DomainFilter given a list of domains
+// and a list of domains excluded from them along with their subdomains
+func NewDomainFilterWithExclusions(domainFilters, excludeDomains []string) DomainFilter {
 	// user can define filter domains either with trailing dot or without, we remove all trailing periods from
 	// the internal representation
-	for i, domain := range domainFilters {
-		filters[i] = strings.TrimSuffix(strings.TrimSpace(domain), ".")
-	}
+	return DomainFilter{trimDomains(domainFilters), trimDomains(excludeDomains)}
+}
 
-	return DomainFilter{filters}
+// trimDomains removes the spaces and the trailing periods of the domains.
+func trimDomains(domains []string) []string {
+	trimmed := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		trimmed = append(trimmed, strings.TrimSuffix(strings.TrimSpace(domain), "."))
+	}
+	return trimmed
 }
 
-// Match checks whether a domain can be found in the DomainFilter.
+// Match checks whether a domain can be found in the DomainFilter and isn't excluded from it.
 func (df DomainFilter) Match(domain string) bool {
+	return df.matchFilters(domain) && !df.Excluded(domain)
+}
+
+func (df DomainFilter) matchFilters(domain string) bool {
 	// return always true, if not filter is specified
 	if len(df.filters) == 0 {
 		return true
@@ -55,6 +75,73 @@ func (df DomainFilter) Match(domain string) bool {
 	return false
 }
 
+// Excluded checks whether a domain is one of the excluded domains or a subdomain of them.
+func (df DomainFilter) Excluded(domain string) bool {
+	domain = strings.TrimSuffix(domain, ".")
+	for _, exclude := range df.exclude {
+		if exclude == "" {
+			continue
+		}
+		if domain == exclude || strings.HasSuffix(domain, "."+exclude) {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchEndpoints returns the endpoints whose name matches the filter.
+func (df DomainFilter) MatchEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	var result []*endpoint.Endpoint
+	for _, ep := range endpoints {
+		if !df.Match(ep.DNSName) {
+			log.Debugf("Skipping record %v not matching the domain filter", ep)
+			continue
+		}
+		result = append(result, ep)
+	}
+	return result
+}
+
+// MatchChanges returns the changes of the records whose name matches the filter, so
+// that the records of the excluded domains are never modified, even though their
+// zone matches. The updates are kept or dropped along with their old version.
+func (df DomainFilter) MatchChanges(changes *plan.Changes) *plan.Changes {
+	if len(df.exclude) == 0 {
+		return changes
+	}
+	matching := &plan.Changes{
+		Create: df.MatchEndpoints(changes.Create),
+		Delete: df.MatchEndpoints(changes.Delete),
+	}
+	for i, ep := range changes.UpdateNew {
+		if !df.Match(ep.DNSName) {
+			log.Warnf("Skipping update of record %v of an excluded domain", ep)
+			continue
+		}
+		matching.UpdateNew = append(matching.UpdateNew, ep)
+		if i < len(changes.UpdateOld) {
+			matching.UpdateOld = append(matching.UpdateOld, changes.UpdateOld[i])
+		}
+	}
+	return matching
+}
+
+// MatchingDomain returns the longest domain of the filter the given domain is
+// equal to or a subdomain of, empty if none.
+func (df DomainFilter) MatchingDomain(domain string) string {
+	domain = strings.TrimSuffix(domain, ".")
+	matching := ""
+	for _, filter := range df.filters {
+		if filter == "" || len(filter) <= len(matching) {
+			continue
+		}
+		if domain == filter || strings.HasSuffix(domain, "."+filter) {
+			matching = filter
+		}
+	}
+	return matching
+}
+
 // IsConfigured returns true if DomainFilter is configured, false otherwise
 func (df DomainFilter) IsConfigured() bool {
 	if len(df.filters) == 1 {
@@ -20,6 +20,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
 )
 
 type domainFilterTest struct {
@@ -120,3 +123,54 @@ func TestDomainFilterMatchWithEmptyFilter(t *testing.T) {
 		}
 	}
 }
+
+func TestDomainFilterMatchingDomain(t *testing.T) {
+	domainFilter := NewDomainFilter([]string{"example.org", "sub.example.org.", ""})
+
+	assert.Equal(t, "example.org", domainFilter.MatchingDomain("foo.example.org"))
+	assert.Equal(t, "example.org", domainFilter.MatchingDomain("example.org."))
+	assert.Equal(t, "sub.example.org", domainFilter.MatchingDomain("foo.sub.example.org"))
+	assert.Equal(t, "", domainFilter.MatchingDomain("fooexample.org"))
+	assert.Equal(t, "", DomainFilter{}.MatchingDomain("foo.example.org"))
+}
+
+func TestDomainFilterMatchWithExclusions(t *testing.T) {
+	domainFilter := NewDomainFilterWithExclusions([]string{"example.com"}, []string{" internal.example.com.", ""})
+
+	assert.True(t, domainFilter.Match("example.com."))
+	assert.True(t, domainFilter.Match("foo.example.com"))
+	assert.True(t, domainFilter.Match("fooexternal.example.com"))
+	assert.False(t, domainFilter.Match("internal.example.com."))
+	assert.False(t, domainFilter.Match("foo.internal.example.com"))
+	assert.False(t, domainFilter.Match("foo.example.org"))
+
+	// the exclusions apply without a domain filter too
+	domainFilter = NewDomainFilterWithExclusions([]string{""}, []string{"internal.example.com"})
+	assert.True(t, domainFilter.Match("foo.example.org"))
+	assert.False(t, domainFilter.Match("foo.internal.example.com"))
+	assert.True(t, domainFilter.Excluded("internal.example.com."))
+	assert.False(t, domainFilter.Excluded("example.com"))
+}
+
+func TestDomainFilterMatchChanges(t *testing.T) {
+	domainFilter := NewDomainFilterWithExclusions([]string{"example.com"}, []string{"internal.example.com"})
+	kept := endpoint.NewEndpoint("foo.example.com", endpoint.RecordTypeA, "1.2.3.4")
+	excluded := endpoint.NewEndpoint("foo.internal.example.com", endpoint.RecordTypeA, "1.2.3.4")
+
+	assert.Equal(t, []*endpoint.Endpoint{kept}, domainFilter.MatchEndpoints([]*endpoint.Endpoint{excluded, kept}))
+	assert.Equal(t, &plan.Changes{
+		Create:    []*endpoint.Endpoint{kept},
+		UpdateOld: []*endpoint.Endpoint{kept},
+		UpdateNew: []*endpoint.Endpoint{kept},
+		Delete:    []*endpoint.Endpoint{kept},
+	}, domainFilter.MatchChanges(&plan.Changes{
+		Create:    []*endpoint.Endpoint{kept, excluded},
+		UpdateOld: []*endpoint.Endpoint{excluded, kept},
+		UpdateNew: []*endpoint.Endpoint{excluded, kept},
+		Delete:    []*endpoint.Endpoint{excluded, kept},
+	}))
+
+	// the changes are left as they are without exclusions
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{excluded}}
+	assert.Equal(t, changes, NewDomainFilter([]string{"internal.example.com"}).MatchChanges(changes))
+}
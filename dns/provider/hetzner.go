@@ -0,0 +1,397 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+const (
+	hetznerDNSEndpoint = "https://dns.hetzner.com/api/v1"
+	// the name of the records at the apex of their zone
+	hetznerApexName = "@"
+	hetznerPerPage  = 100
+)
+
+func init() {
+	Register("hetzner", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewHetznerProvider(
+				HetznerConfig{
+					DomainFilter: zones.DomainFilter,
+					ZoneIDFilter: zones.ZoneIDFilter,
+					DryRun:       cfg.DryRun,
+				},
+			)
+		},
+	})
+}
+
+// HetznerZone is a zone of the Hetzner DNS API.
+type HetznerZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// HetznerRecord is a record of the Hetzner DNS API, named relative to its zone.
+type HetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+// HetznerDNSClient is a subset of the Hetzner DNS API the provider uses, to ease testing.
+// The updates and deletions of records which don't exist fail with ErrRecordNotFound.
+type HetznerDNSClient interface {
+	ListZones() ([]HetznerZone, error)
+	ListRecords(zoneID string) ([]HetznerRecord, error)
+	CreateRecord(record HetznerRecord) error
+	UpdateRecord(id string, record HetznerRecord) error
+	DeleteRecord(id string) error
+}
+
+// HetznerDNSService calls the Hetzner DNS API and fulfills the HetznerDNSClient interface.
+type HetznerDNSService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// ListZones lists all the pages of the zones
+func (s HetznerDNSService) ListZones() ([]HetznerZone, error) {
+	var zones []HetznerZone
+	for page := 1; ; page++ {
+		var resp struct {
+			Zones []HetznerZone `json:"zones"`
+			Meta  struct {
+				Pagination struct {
+					LastPage int `json:"last_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		query := url.Values{}
+		query.Set("page", fmt.Sprint(page))
+		query.Set("per_page", fmt.Sprint(hetznerPerPage))
+		if err := s.do(http.MethodGet, "/zones?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		zones = append(zones, resp.Zones...)
+		if page >= resp.Meta.Pagination.LastPage {
+			return zones, nil
+		}
+	}
+}
+
+// ListRecords lists the records of the zone
+func (s HetznerDNSService) ListRecords(zoneID string) ([]HetznerRecord, error) {
+	var resp struct {
+		Records []HetznerRecord `json:"records"`
+	}
+	query := url.Values{}
+	query.Set("zone_id", zoneID)
+	if err := s.do(http.MethodGet, "/records?"+query.Encode(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Records, nil
+}
+
+// CreateRecord creates a record in the zone of the record
+func (s HetznerDNSService) CreateRecord(record HetznerRecord) error {
+	return s.do(http.MethodPost, "/records", record, nil)
+}
+
+// UpdateRecord replaces the record of the given id
+func (s HetznerDNSService) UpdateRecord(id string, record HetznerRecord) error {
+	return s.do(http.MethodPut, "/records/"+url.PathEscape(id), record, nil)
+}
+
+// DeleteRecord deletes the record of the given id
+func (s HetznerDNSService) DeleteRecord(id string) error {
+	return s.do(http.MethodDelete, "/records/"+url.PathEscape(id), nil, nil)
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (s HetznerDNSService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Auth-API-Token", s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodGet {
+		return ErrRecordNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("hetzner dns: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// HetznerConfig contains configuration to create a new Hetzner provider.
+type HetznerConfig struct {
+	DomainFilter DomainFilter
+	ZoneIDFilter ZoneIDFilter
+	DryRun       bool
+}
+
+// HetznerProvider is an implementation of Provider for Hetzner DNS.
+//
+// An endpoint with several targets is stored as one record per target.
+type HetznerProvider struct {
+	client HetznerDNSClient
+	dryRun bool
+	// only consider zones managing domains ending in this suffix
+	domainFilter DomainFilter
+	// filter zones by id
+	zoneIDFilter ZoneIDFilter
+}
+
+// NewHetznerProvider initializes a new Hetzner DNS based Provider.
+// The API token is read from the HETZNER_DNS_TOKEN environment variable.
+func NewHetznerProvider(hetznerConfig HetznerConfig) (*HetznerProvider, error) {
+	token, ok := os.LookupEnv("HETZNER_DNS_TOKEN")
+	if !ok || token == "" {
+		return nil, errors.New("Hetzner DNS token cannot be empty, set HETZNER_DNS_TOKEN")
+	}
+
+	provider := &HetznerProvider{
+		client:       HetznerDNSService{client: http.DefaultClient, endpoint: hetznerDNSEndpoint, token: token},
+		domainFilter: hetznerConfig.DomainFilter,
+		zoneIDFilter: hetznerConfig.ZoneIDFilter,
+		dryRun:       hetznerConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+// Records returns the list of records in all matching zones.
+func (p *HetznerProvider) Records() ([]*endpoint.Endpoint, error) {
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint.Endpoint
+
+	for _, zone := range zones {
+		records, err := p.client.ListRecords(zone.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		// the records of the same name and type are the targets of a single endpoint
+		index := map[string]*endpoint.Endpoint{}
+		for _, record := range records {
+			if !supportedRecordType(record.Type) {
+				continue
+			}
+
+			name := hetznerDNSName(record.Name, zone.Name)
+			key := name + "/" + record.Type
+			ep, ok := index[key]
+			if !ok {
+				ep = endpoint.NewEndpointWithTTL(name, record.Type, endpoint.TTL(record.TTL)).WithProviderSpecific(ZoneProperty, zone.Name)
+				index[key] = ep
+				endpoints = append(endpoints, ep)
+			}
+			ep.Targets = append(ep.Targets, hetznerTarget(record))
+		}
+	}
+
+	return p.domainFilter.MatchEndpoints(endpoints), nil
+}
+
+// ApplyChanges applies a given set of changes zone by zone.
+// When the changes of some zones fail, it returns a *plan.PartialError holding the changes which were applied.
+func (p *HetznerProvider) ApplyChanges(changes *plan.Changes) error {
+	changes = p.domainFilter.MatchChanges(managedChanges(changes))
+
+	// return early if there is nothing to change
+	if len(changes.Create) == 0 && len(changes.UpdateNew) == 0 && len(changes.Delete) == 0 {
+		log.Info("All records are already up to date")
+		return nil
+	}
+
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return err
+	}
+	zoneNames := zoneIDName{}
+	for _, z := range zones {
+		zoneNames.Add(z.ID, z.Name)
+	}
+	return applyByZone(zoneNames, changes, p.submitChanges)
+}
+
+// submitChanges applies the changes of a zone record by record, updating the records in
+// place when the targets of an endpoint are updated.
+func (p *HetznerProvider) submitChanges(zoneID, zoneName string, changes *plan.Changes) error {
+	logChanges(changes)
+	if p.dryRun {
+		return nil
+	}
+
+	records, err := p.client.ListRecords(zoneID)
+	if err != nil {
+		return err
+	}
+	current := map[string][]HetznerRecord{}
+	for _, record := range records {
+		key := hetznerDNSName(record.Name, zoneName) + "/" + record.Type
+		current[key] = append(current[key], record)
+	}
+
+	for _, ep := range changes.Create {
+		for _, target := range ep.Targets {
+			if err := p.client.CreateRecord(newHetznerRecord(zoneID, zoneName, ep, target)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.UpdateNew {
+		existing := current[hetznerKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for i, target := range ep.Targets {
+			record := newHetznerRecord(zoneID, zoneName, ep, target)
+			if i < len(existing) {
+				err = p.client.UpdateRecord(existing[i].ID, record)
+			} else {
+				err = p.client.CreateRecord(record)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i := len(ep.Targets); i < len(existing); i++ {
+			if err := p.client.DeleteRecord(existing[i].ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.Delete {
+		existing := current[hetznerKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for _, record := range existing {
+			if err := p.client.DeleteRecord(record.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// zonesFiltered returns the list of zones matching the domain and zone id filters.
+func (p *HetznerProvider) zonesFiltered() ([]HetznerZone, error) {
+	zones, err := p.client.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []HetznerZone{}
+	for _, z := range zones {
+		if !p.zoneIDFilter.Match(z.ID) {
+			continue
+		}
+
+		if !p.domainFilter.Match(z.Name) {
+			continue
+		}
+
+		log.Debugf("Considering zone: %s (id: %s)", z.Name, z.ID)
+		filtered = append(filtered, z)
+	}
+
+	return filtered, nil
+}
+
+// hetznerDNSName returns the hostname of a record named relative to its zone, @ at the apex.
+func hetznerDNSName(name, zoneName string) string {
+	if name == hetznerApexName || name == "" {
+		return zoneName
+	}
+	return name + "." + zoneName
+}
+
+// hetznerRecordName returns the name of the record of the hostname relative to its zone.
+func hetznerRecordName(dnsName, zoneName string) string {
+	dnsName = strings.TrimSuffix(dnsName, ".")
+	if dnsName == zoneName {
+		return hetznerApexName
+	}
+	return strings.TrimSuffix(dnsName, "."+zoneName)
+}
+
+func hetznerKey(ep *endpoint.Endpoint) string {
+	return strings.TrimSuffix(ep.DNSName, ".") + "/" + ep.RecordType
+}
+
+// hetznerTarget returns the target of a record as the registries and the plan expect it.
+func hetznerTarget(record HetznerRecord) string {
+	if record.Type == endpoint.RecordTypeTXT {
+		return quoteTXT(record.Value)
+	}
+	return strings.TrimSuffix(record.Value, ".")
+}
+
+// newHetznerRecord returns a Hetzner record of one of the targets of the endpoint in the given zone.
+// The hostnames of the CNAME and SRV targets are made absolute, Hetzner reading them relative to
+// the zone otherwise.
+func newHetznerRecord(zoneID, zoneName string, ep *endpoint.Endpoint, target string) HetznerRecord {
+	record := HetznerRecord{
+		ZoneID: zoneID,
+		Type:   ep.RecordType,
+		Name:   hetznerRecordName(ep.DNSName, zoneName),
+		Value:  target,
+	}
+	// the default ttl of the zone applies when not set
+	if ep.RecordTTL.IsConfigured() {
+		record.TTL = int(ep.RecordTTL)
+	}
+	switch ep.RecordType {
+	case endpoint.RecordTypeCNAME, endpoint.RecordTypeSRV:
+		if !strings.HasSuffix(target, ".") {
+			record.Value = target + "."
+		}
+	}
+	return record
+}
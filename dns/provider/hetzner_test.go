@@ -0,0 +1,167 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ Provider = &HetznerProvider{}
+)
+
+// mockHetznerDNSClient keeps the records of the zones in memory.
+type mockHetznerDNSClient struct {
+	zones   []HetznerZone
+	records []HetznerRecord
+	nextID  int
+	updated int
+}
+
+func (m *mockHetznerDNSClient) ListZones() ([]HetznerZone, error) {
+	return m.zones, nil
+}
+
+func (m *mockHetznerDNSClient) ListRecords(zoneID string) ([]HetznerRecord, error) {
+	var result []HetznerRecord
+	for _, r := range m.records {
+		if r.ZoneID == zoneID {
+			result = append(result, r)
+		}
+	}
+	return result, nil
+}
+
+func (m *mockHetznerDNSClient) CreateRecord(record HetznerRecord) error {
+	m.nextID++
+	record.ID = fmt.Sprint(m.nextID)
+	m.records = append(m.records, record)
+	return nil
+}
+
+func (m *mockHetznerDNSClient) UpdateRecord(id string, record HetznerRecord) error {
+	m.updated++
+	for i, r := range m.records {
+		if r.ID == id {
+			record.ID = id
+			m.records[i] = record
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m *mockHetznerDNSClient) DeleteRecord(id string) error {
+	for i, r := range m.records {
+		if r.ID == id {
+			m.records = append(m.records[:i], m.records[i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func newMockHetznerDNSClient() *mockHetznerDNSClient {
+	return &mockHetznerDNSClient{
+		zones: []HetznerZone{{ID: "z1", Name: "foo.com"}, {ID: "z2", Name: "bar.com"}},
+		records: []HetznerRecord{
+			{ID: "10", ZoneID: "z1", Type: "A", Name: "test", Value: "1.1.1.1", TTL: 300},
+			{ID: "11", ZoneID: "z1", Type: "A", Name: "test", Value: "2.2.2.2", TTL: 300},
+			{ID: "12", ZoneID: "z1", Type: "TXT", Name: "@", Value: "\"heritage=external-dns,external-dns/owner=default\""},
+			{ID: "13", ZoneID: "z1", Type: "NS", Name: "@", Value: "hydrogen.ns.hetzner.com."},
+			{ID: "20", ZoneID: "z2", Type: "CNAME", Name: "www", Value: "test.foo.com."},
+		},
+		nextID: 100,
+	}
+}
+
+func TestHetznerRecords(t *testing.T) {
+	p := &HetznerProvider{
+		client:       newMockHetznerDNSClient(),
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	records, err := p.Records()
+	require.NoError(t, err)
+
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 300, "1.1.1.1", "2.2.2.2"),
+		endpoint.NewEndpoint("foo.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+		endpoint.NewEndpoint("www.bar.com", endpoint.RecordTypeCNAME, "test.foo.com"),
+	})
+}
+
+func TestHetznerApplyChanges(t *testing.T) {
+	client := newMockHetznerDNSClient()
+	p := &HetznerProvider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	err := p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("bar.com", endpoint.RecordTypeA, "4.4.4.4"),
+			endpoint.NewEndpoint("_http._tcp.bar.com", endpoint.RecordTypeSRV, "0 50 80 new.bar.com"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "1.1.1.1", "2.2.2.2")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "3.3.3.3")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("www.bar.com", endpoint.RecordTypeCNAME, "test.foo.com")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.updated)
+
+	created, err := client.ListRecords("z2")
+	require.NoError(t, err)
+	require.Len(t, created, 2)
+	assert.Equal(t, "@", created[0].Name)
+	assert.Equal(t, "0 50 80 new.bar.com.", created[1].Value)
+
+	records, err := p.Records()
+	require.NoError(t, err)
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 0, "3.3.3.3"),
+		endpoint.NewEndpoint("foo.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+		endpoint.NewEndpoint("bar.com", endpoint.RecordTypeA, "4.4.4.4"),
+		endpoint.NewEndpoint("_http._tcp.bar.com", endpoint.RecordTypeSRV, "0 50 80 new.bar.com"),
+	})
+}
+
+func TestHetznerDNSService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token", r.Header.Get("Auth-API-Token"))
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/zones":
+			page := r.URL.Query().Get("page")
+			fmt.Fprintf(w, `{"zones":[{"id":"z%s","name":"zone%s.com"}],"meta":{"pagination":{"last_page":2}}}`, page, page)
+		case r.Method == http.MethodPost && r.URL.Path == "/records":
+			var record HetznerRecord
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+			assert.Equal(t, "z1", record.ZoneID)
+			w.WriteHeader(http.StatusOK)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	s := HetznerDNSService{client: server.Client(), endpoint: server.URL, token: "token"}
+	zones, err := s.ListZones()
+	require.NoError(t, err)
+	assert.Equal(t, []HetznerZone{{ID: "z1", Name: "zone1.com"}, {ID: "z2", Name: "zone2.com"}}, zones)
+
+	assert.NoError(t, s.CreateRecord(HetznerRecord{ZoneID: "z1", Type: "A", Name: "test", Value: "1.1.1.1"}))
+	assert.Equal(t, ErrRecordNotFound, s.DeleteRecord("missing"))
+}
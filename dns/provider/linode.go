@@ -0,0 +1,439 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+const (
+	// linodeEndpoint is the base URL of the Linode API
+	linodeEndpoint = "https://api.linode.com/v4"
+	// linodePageSize is the largest page of domains and records the API returns
+	linodePageSize = 500
+)
+
+func init() {
+	Register("linode", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewLinodeProvider(
+				LinodeConfig{
+					DomainFilter: zones.DomainFilter,
+					ZoneIDFilter: zones.ZoneIDFilter,
+					DryRun:       cfg.DryRun,
+				},
+			)
+		},
+	})
+}
+
+// LinodeDomain is a domain of the Linode DNS Manager.
+type LinodeDomain struct {
+	ID     int    `json:"id"`
+	Domain string `json:"domain"`
+}
+
+// LinodeDomainRecord is a record of the Linode DNS Manager, named relative to its domain.
+type LinodeDomainRecord struct {
+	ID     int    `json:"id,omitempty"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	TTLSec int    `json:"ttl_sec,omitempty"`
+}
+
+// LinodeDomainClient is a subset of the Linode API the provider uses, to ease testing.
+// The updates and deletions of records which don't exist fail with ErrRecordNotFound.
+type LinodeDomainClient interface {
+	ListDomains() ([]LinodeDomain, error)
+	ListDomainRecords(domainID int) ([]LinodeDomainRecord, error)
+	CreateDomainRecord(domainID int, record LinodeDomainRecord) error
+	UpdateDomainRecord(domainID int, id int, record LinodeDomainRecord) error
+	DeleteDomainRecord(domainID int, id int) error
+}
+
+// LinodeDomainService calls the Linode API and fulfills the LinodeDomainClient interface
+type LinodeDomainService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// ListDomains lists all the pages of the domains
+func (l LinodeDomainService) ListDomains() ([]LinodeDomain, error) {
+	result := []LinodeDomain{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Data  []LinodeDomain `json:"data"`
+			Pages int            `json:"pages"`
+		}
+		if err := l.do(http.MethodGet, "/domains?"+linodePage(page), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Data...)
+		if page >= resp.Pages {
+			return result, nil
+		}
+	}
+}
+
+// ListDomainRecords lists all the pages of the records of the domain
+func (l LinodeDomainService) ListDomainRecords(domainID int) ([]LinodeDomainRecord, error) {
+	result := []LinodeDomainRecord{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Data  []LinodeDomainRecord `json:"data"`
+			Pages int                  `json:"pages"`
+		}
+		if err := l.do(http.MethodGet, fmt.Sprintf("/domains/%d/records?%s", domainID, linodePage(page)), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Data...)
+		if page >= resp.Pages {
+			return result, nil
+		}
+	}
+}
+
+// CreateDomainRecord creates a record in the domain
+func (l LinodeDomainService) CreateDomainRecord(domainID int, record LinodeDomainRecord) error {
+	return l.do(http.MethodPost, fmt.Sprintf("/domains/%d/records", domainID), record, nil)
+}
+
+// UpdateDomainRecord replaces the record of the given id
+func (l LinodeDomainService) UpdateDomainRecord(domainID int, id int, record LinodeDomainRecord) error {
+	return l.do(http.MethodPut, fmt.Sprintf("/domains/%d/records/%d", domainID, id), record, nil)
+}
+
+// DeleteDomainRecord deletes the record of the given id
+func (l LinodeDomainService) DeleteDomainRecord(domainID int, id int) error {
+	return l.do(http.MethodDelete, fmt.Sprintf("/domains/%d/records/%d", domainID, id), nil, nil)
+}
+
+func linodePage(page int) string {
+	query := url.Values{}
+	query.Set("page", fmt.Sprint(page))
+	query.Set("page_size", fmt.Sprint(linodePageSize))
+	return query.Encode()
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (l LinodeDomainService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, l.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound && method != http.MethodGet {
+		return ErrRecordNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("linode: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// LinodeConfig contains configuration to create a new Linode provider.
+type LinodeConfig struct {
+	DomainFilter DomainFilter
+	ZoneIDFilter ZoneIDFilter
+	DryRun       bool
+}
+
+// LinodeProvider is an implementation of Provider for Linode DNS Manager.
+//
+// An endpoint with several targets is stored as one record per target. The SRV
+// records, whose service and protocol Linode stores apart, aren't managed.
+type LinodeProvider struct {
+	client LinodeDomainClient
+	dryRun bool
+	// only consider zones managing domains ending in this suffix
+	domainFilter DomainFilter
+	// filter zones by id
+	zoneIDFilter ZoneIDFilter
+}
+
+// NewLinodeProvider initializes a new Linode DNS based Provider.
+// The API token is read from the LINODE_TOKEN environment variable.
+func NewLinodeProvider(linodeConfig LinodeConfig) (*LinodeProvider, error) {
+	token, ok := os.LookupEnv("LINODE_TOKEN")
+	if !ok || token == "" {
+		return nil, errors.New("Linode token cannot be empty, set LINODE_TOKEN")
+	}
+
+	provider := &LinodeProvider{
+		client:       LinodeDomainService{client: http.DefaultClient, endpoint: linodeEndpoint, token: token},
+		domainFilter: linodeConfig.DomainFilter,
+		zoneIDFilter: linodeConfig.ZoneIDFilter,
+		dryRun:       linodeConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+// linodeRecordType returns true for the record types the provider manages.
+func linodeRecordType(recordType string) bool {
+	return supportedRecordType(recordType) && recordType != endpoint.RecordTypeSRV
+}
+
+// Records returns the list of records in all matching zones.
+func (p *LinodeProvider) Records() ([]*endpoint.Endpoint, error) {
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint.Endpoint
+
+	for _, zone := range zones {
+		records, err := p.client.ListDomainRecords(zone.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		// the records of the same name and type are the targets of a single endpoint
+		index := map[string]*endpoint.Endpoint{}
+		for _, record := range records {
+			recordType := record.Type
+			if !linodeRecordType(recordType) {
+				continue
+			}
+
+			name := linodeDNSName(record.Name, zone.Domain)
+			key := name + "/" + recordType
+			ep, ok := index[key]
+			if !ok {
+				ep = endpoint.NewEndpointWithTTL(name, recordType, endpoint.TTL(record.TTLSec)).WithProviderSpecific(ZoneProperty, zone.Domain)
+				index[key] = ep
+				endpoints = append(endpoints, ep)
+			}
+			ep.Targets = append(ep.Targets, linodeTarget(record))
+		}
+	}
+
+	return p.domainFilter.MatchEndpoints(endpoints), nil
+}
+
+// ApplyChanges applies a given set of changes zone by zone.
+// When the changes of some zones fail, it returns a *plan.PartialError holding the changes which were applied.
+func (p *LinodeProvider) ApplyChanges(changes *plan.Changes) error {
+	changes = p.domainFilter.MatchChanges(linodeChanges(managedChanges(changes)))
+
+	// return early if there is nothing to change
+	if len(changes.Create) == 0 && len(changes.UpdateNew) == 0 && len(changes.Delete) == 0 {
+		log.Info("All records are already up to date")
+		return nil
+	}
+
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return err
+	}
+	zoneNames := zoneIDName{}
+	for _, z := range zones {
+		zoneNames.Add(strconv.Itoa(z.ID), z.Domain)
+	}
+	return applyByZone(zoneNames, changes, p.submitChanges)
+}
+
+// submitChanges applies the changes of a zone record by record, updating the records in
+// place when the targets of an endpoint are updated.
+func (p *LinodeProvider) submitChanges(zoneID, zoneName string, changes *plan.Changes) error {
+	logChanges(changes)
+	if p.dryRun {
+		return nil
+	}
+
+	domainID, err := strconv.Atoi(zoneID)
+	if err != nil {
+		return err
+	}
+	records, err := p.client.ListDomainRecords(domainID)
+	if err != nil {
+		return err
+	}
+	current := map[string][]LinodeDomainRecord{}
+	for _, record := range records {
+		key := linodeDNSName(record.Name, zoneName) + "/" + record.Type
+		current[key] = append(current[key], record)
+	}
+
+	for _, ep := range changes.Create {
+		for _, target := range ep.Targets {
+			if err := p.client.CreateDomainRecord(domainID, newLinodeRecord(zoneName, ep, target)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.UpdateNew {
+		existing := current[linodeKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for i, target := range ep.Targets {
+			record := newLinodeRecord(zoneName, ep, target)
+			if i < len(existing) {
+				err = p.client.UpdateDomainRecord(domainID, existing[i].ID, record)
+			} else {
+				err = p.client.CreateDomainRecord(domainID, record)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		for i := len(ep.Targets); i < len(existing); i++ {
+			if err := p.client.DeleteDomainRecord(domainID, existing[i].ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, ep := range changes.Delete {
+		existing := current[linodeKey(ep)]
+		if len(existing) == 0 {
+			return ErrRecordNotFound
+		}
+		for _, record := range existing {
+			if err := p.client.DeleteDomainRecord(domainID, record.ID); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// zonesFiltered returns the list of zones matching the domain and zone id filters.
+func (p *LinodeProvider) zonesFiltered() ([]LinodeDomain, error) {
+	domains, err := p.client.ListDomains()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []LinodeDomain{}
+	for _, d := range domains {
+		if !p.zoneIDFilter.Match(strconv.Itoa(d.ID)) {
+			continue
+		}
+
+		if !p.domainFilter.Match(d.Domain) {
+			continue
+		}
+
+		log.Debugf("Considering zone: %s (id: %d)", d.Domain, d.ID)
+		filtered = append(filtered, d)
+	}
+
+	return filtered, nil
+}
+
+// linodeChanges drops the changes of the SRV records, which the provider doesn't manage.
+func linodeChanges(changes *plan.Changes) *plan.Changes {
+	managed := &plan.Changes{
+		Create: linodeEndpoints(changes.Create),
+		Delete: linodeEndpoints(changes.Delete),
+	}
+	for i, ep := range changes.UpdateNew {
+		if !linodeRecordType(ep.RecordType) {
+			log.Warnf("Skipping update of unmanaged record %v", ep)
+			continue
+		}
+		managed.UpdateNew = append(managed.UpdateNew, ep)
+		if i < len(changes.UpdateOld) {
+			managed.UpdateOld = append(managed.UpdateOld, changes.UpdateOld[i])
+		}
+	}
+	return managed
+}
+
+func linodeEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	var result []*endpoint.Endpoint
+	for _, ep := range endpoints {
+		if !linodeRecordType(ep.RecordType) {
+			log.Warnf("Skipping unmanaged record %v", ep)
+			continue
+		}
+		result = append(result, ep)
+	}
+	return result
+}
+
+// linodeDNSName returns the hostname of a record named relative to its zone, empty at the apex.
+func linodeDNSName(name, zoneName string) string {
+	if name == "" {
+		return zoneName
+	}
+	return name + "." + zoneName
+}
+
+// linodeRecordName returns the name of the record of the hostname relative to its zone.
+func linodeRecordName(dnsName, zoneName string) string {
+	dnsName = strings.TrimSuffix(dnsName, ".")
+	if dnsName == zoneName {
+		return ""
+	}
+	return strings.TrimSuffix(dnsName, "."+zoneName)
+}
+
+func linodeKey(ep *endpoint.Endpoint) string {
+	return strings.TrimSuffix(ep.DNSName, ".") + "/" + ep.RecordType
+}
+
+// linodeTarget returns the target of a record as the registries and the plan expect it.
+// Linode returns the TXT values without the quotes the txt registry writes them with.
+func linodeTarget(record LinodeDomainRecord) string {
+	if record.Type == endpoint.RecordTypeTXT {
+		return quoteTXT(record.Target)
+	}
+	return strings.TrimSuffix(record.Target, ".")
+}
+
+// newLinodeRecord returns a Linode record of one of the targets of the endpoint in the given zone.
+func newLinodeRecord(zoneName string, ep *endpoint.Endpoint, target string) LinodeDomainRecord {
+	record := LinodeDomainRecord{
+		Type:   ep.RecordType,
+		Name:   linodeRecordName(ep.DNSName, zoneName),
+		Target: target,
+	}
+	// the default ttl of the domain applies when not set
+	if ep.RecordTTL.IsConfigured() {
+		record.TTLSec = int(ep.RecordTTL)
+	}
+	if ep.RecordType == endpoint.RecordTypeTXT {
+		record.Target = unquoteTXT(target)
+	}
+	return record
+}
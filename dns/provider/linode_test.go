@@ -0,0 +1,170 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ Provider = &LinodeProvider{}
+)
+
+// mockLinodeDomainClient keeps the records of the domains in memory.
+type mockLinodeDomainClient struct {
+	domains []LinodeDomain
+	records map[int][]LinodeDomainRecord
+	nextID  int
+	updated int
+}
+
+func (m *mockLinodeDomainClient) ListDomains() ([]LinodeDomain, error) {
+	return m.domains, nil
+}
+
+func (m *mockLinodeDomainClient) ListDomainRecords(domainID int) ([]LinodeDomainRecord, error) {
+	return append([]LinodeDomainRecord{}, m.records[domainID]...), nil
+}
+
+func (m *mockLinodeDomainClient) CreateDomainRecord(domainID int, record LinodeDomainRecord) error {
+	m.nextID++
+	record.ID = m.nextID
+	m.records[domainID] = append(m.records[domainID], record)
+	return nil
+}
+
+func (m *mockLinodeDomainClient) UpdateDomainRecord(domainID int, id int, record LinodeDomainRecord) error {
+	m.updated++
+	for i, r := range m.records[domainID] {
+		if r.ID == id {
+			record.ID = id
+			m.records[domainID][i] = record
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func (m *mockLinodeDomainClient) DeleteDomainRecord(domainID int, id int) error {
+	for i, r := range m.records[domainID] {
+		if r.ID == id {
+			m.records[domainID] = append(m.records[domainID][:i], m.records[domainID][i+1:]...)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+func newMockLinodeDomainClient() *mockLinodeDomainClient {
+	return &mockLinodeDomainClient{
+		domains: []LinodeDomain{{ID: 1, Domain: "foo.com"}, {ID: 2, Domain: "bar.com"}},
+		records: map[int][]LinodeDomainRecord{
+			1: {
+				{ID: 10, Type: "A", Name: "test", Target: "1.1.1.1", TTLSec: 300},
+				{ID: 11, Type: "A", Name: "test", Target: "2.2.2.2", TTLSec: 300},
+				{ID: 12, Type: "TXT", Name: "", Target: "heritage=external-dns,external-dns/owner=default"},
+				{ID: 13, Type: "SRV", Name: "_sip._tcp", Target: "sip.foo.com"},
+			},
+			2: {
+				{ID: 20, Type: "CNAME", Name: "www", Target: "test.foo.com"},
+			},
+		},
+		nextID: 100,
+	}
+}
+
+func TestLinodeRecords(t *testing.T) {
+	p := &LinodeProvider{
+		client:       newMockLinodeDomainClient(),
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{"1"}),
+	}
+
+	records, err := p.Records()
+	require.NoError(t, err)
+
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 300, "1.1.1.1", "2.2.2.2"),
+		endpoint.NewEndpoint("foo.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+	})
+}
+
+func TestLinodeApplyChanges(t *testing.T) {
+	client := newMockLinodeDomainClient()
+	p := &LinodeProvider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{""}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+	}
+
+	err := p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("new.bar.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+			endpoint.NewEndpoint("_http._tcp.bar.com", endpoint.RecordTypeSRV, "0 50 80 new.bar.com"),
+		},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "1.1.1.1", "2.2.2.2")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "3.3.3.3")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("www.bar.com", endpoint.RecordTypeCNAME, "test.foo.com")},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.updated)
+
+	// the SRV record is left alone
+	require.Len(t, client.records[2], 1)
+	assert.Equal(t, "new", client.records[2][0].Name)
+	assert.Equal(t, "heritage=external-dns,external-dns/owner=default", client.records[2][0].Target)
+
+	records, err := p.Records()
+	require.NoError(t, err)
+	validateEndpoints(t, records, []*endpoint.Endpoint{
+		endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, 0, "3.3.3.3"),
+		endpoint.NewEndpoint("foo.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+		endpoint.NewEndpoint("new.bar.com", endpoint.RecordTypeTXT, "\"heritage=external-dns,external-dns/owner=default\""),
+	})
+}
+
+func TestLinodeDomainService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /domains":
+			page := r.URL.Query().Get("page")
+			fmt.Fprintf(w, `{"data":[{"id":%s,"domain":"foo%s.com"}],"page":%s,"pages":2}`, page, page, page)
+		case "GET /domains/1/records":
+			fmt.Fprint(w, `{"data":[{"id":10,"type":"A","name":"test","target":"1.1.1.1","ttl_sec":300}],"page":1,"pages":1}`)
+		case "POST /domains/1/records":
+			var record LinodeDomainRecord
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&record))
+			assert.Equal(t, LinodeDomainRecord{Type: "A", Name: "new", Target: "2.2.2.2"}, record)
+			fmt.Fprint(w, `{"id":11,"type":"A","name":"new","target":"2.2.2.2"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	s := LinodeDomainService{client: server.Client(), endpoint: server.URL, token: "token"}
+
+	domains, err := s.ListDomains()
+	require.NoError(t, err)
+	assert.Equal(t, []LinodeDomain{{ID: 1, Domain: "foo1.com"}, {ID: 2, Domain: "foo2.com"}}, domains)
+
+	records, err := s.ListDomainRecords(1)
+	require.NoError(t, err)
+	assert.Equal(t, []LinodeDomainRecord{{ID: 10, Type: "A", Name: "test", Target: "1.1.1.1", TTLSec: 300}}, records)
+
+	require.NoError(t, s.CreateDomainRecord(1, LinodeDomainRecord{Type: "A", Name: "new", Target: "2.2.2.2"}))
+	assert.Equal(t, ErrRecordNotFound, s.DeleteDomainRecord(1, 12))
+	_, err = s.ListDomainRecords(3)
+	assert.EqualError(t, err, "linode: GET /domains/3/records?page=1&page_size=500: 404 Not Found")
+}
@@ -0,0 +1,370 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	api "gopkg.in/ns1/ns1-go.v2/rest"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+const (
+	// ns1Create is a ChangeAction enum value
+	ns1Create = "CREATE"
+	// ns1Delete is a ChangeAction enum value
+	ns1Delete = "DELETE"
+	// ns1Update is a ChangeAction enum value
+	ns1Update = "UPDATE"
+	// ns1DefaultTTL is the default ttl for ttls that are not set
+	ns1DefaultTTL = 10
+)
+
+func init() {
+	Register("ns1", Registration{
+		New: func(cfg *externalips.Config, zones Zones) (Provider, error) {
+			return NewNS1Provider(
+				NS1Config{
+					DomainFilter: zones.DomainFilter,
+					ZoneIDFilter: zones.ZoneIDFilter,
+					APIKey:       cfg.NS1APIKey,
+					Endpoint:     cfg.NS1Endpoint,
+					IgnoreSSL:    cfg.NS1IgnoreSSL,
+					DryRun:       cfg.DryRun,
+				},
+			)
+		},
+	})
+}
+
+// NS1DomainClient is a subset of the NS1 API the the provider uses, to ease testing
+type NS1DomainClient interface {
+	CreateRecord(r *dns.Record) (*http.Response, error)
+	DeleteRecord(zone string, domain string, t string) (*http.Response, error)
+	UpdateRecord(r *dns.Record) (*http.Response, error)
+	GetRecord(zone string, domain string, t string) (*dns.Record, *http.Response, error)
+	GetZone(zone string) (*dns.Zone, *http.Response, error)
+	ListZones() ([]*dns.Zone, *http.Response, error)
+}
+
+// NS1DomainService wraps the API and fulfills the NS1DomainClient interface
+type NS1DomainService struct {
+	service *api.Client
+}
+
+// CreateRecord wraps the Create method of the API's Record service
+func (n NS1DomainService) CreateRecord(r *dns.Record) (*http.Response, error) {
+	return n.service.Records.Create(r)
+}
+
+// DeleteRecord wraps the Delete method of the API's Record service
+func (n NS1DomainService) DeleteRecord(zone string, domain string, t string) (*http.Response, error) {
+	return n.service.Records.Delete(zone, domain, t)
+}
+
+// UpdateRecord wraps the Update method of the API's Record service
+func (n NS1DomainService) UpdateRecord(r *dns.Record) (*http.Response, error) {
+	return n.service.Records.Update(r)
+}
+
+// GetRecord wraps the Get method of the API's Record service
+func (n NS1DomainService) GetRecord(zone string, domain string, t string) (*dns.Record, *http.Response, error) {
+	return n.service.Records.Get(zone, domain, t)
+}
+
+// GetZone wraps the Get method of the API's Zones service
+func (n NS1DomainService) GetZone(zone string) (*dns.Zone, *http.Response, error) {
+	return n.service.Zones.Get(zone)
+}
+
+// ListZones wraps the List method of the API's Zones service
+func (n NS1DomainService) ListZones() ([]*dns.Zone, *http.Response, error) {
+	return n.service.Zones.List()
+}
+
+// NS1Config contains configuration to create a new NS1 provider.
+type NS1Config struct {
+	DomainFilter DomainFilter
+	ZoneIDFilter ZoneIDFilter
+	APIKey       string
+	Endpoint     string
+	IgnoreSSL    bool
+	DryRun       bool
+}
+
+// NS1Provider is an implementation of Provider for NS1.
+type NS1Provider struct {
+	client NS1DomainClient
+	dryRun bool
+	// only consider zones managing domains ending in this suffix
+	domainFilter DomainFilter
+	// filter zones by id
+	zoneIDFilter ZoneIDFilter
+}
+
+// NewNS1Provider initializes a new NS1 based Provider.
+func NewNS1Provider(ns1Config NS1Config) (*NS1Provider, error) {
+	return newNS1ProviderWithHTTPClient(ns1Config, http.DefaultClient)
+}
+
+func newNS1ProviderWithHTTPClient(ns1Config NS1Config, client *http.Client) (*NS1Provider, error) {
+	if ns1Config.APIKey == "" {
+		return nil, errors.New("NS1 API key cannot be empty")
+	}
+
+	clientArgs := []func(*api.Client){api.SetAPIKey(ns1Config.APIKey)}
+	if ns1Config.Endpoint != "" {
+		log.Infof("Targeting NS1 endpoint at %s", ns1Config.Endpoint)
+		clientArgs = append(clientArgs, api.SetEndpoint(ns1Config.Endpoint))
+	}
+
+	if ns1Config.IgnoreSSL {
+		log.Info("Skipping SSL verification for NS1 endpoint")
+		client = &http.Client{
+			Transport: &http.Transport{
+				Proxy:           http.ProxyFromEnvironment,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		}
+	}
+
+	provider := &NS1Provider{
+		client:       NS1DomainService{api.NewClient(client, clientArgs...)},
+		domainFilter: ns1Config.DomainFilter,
+		zoneIDFilter: ns1Config.ZoneIDFilter,
+		dryRun:       ns1Config.DryRun,
+	}
+
+	return provider, nil
+}
+
+// Records returns the list of records in all matching zones.
+func (p *NS1Provider) Records() ([]*endpoint.Endpoint, error) {
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*endpoint.Endpoint
+
+	for _, zone := range zones {
+		zoneData, _, err := p.client.GetZone(zone.String())
+		if err != nil {
+			return nil, err
+		}
+
+		for _, record := range zoneData.Records {
+			if !supportedRecordType(record.Type) {
+				continue
+			}
+
+			endpoints = append(endpoints, endpoint.NewEndpointWithTTL(
+				record.Domain,
+				record.Type,
+				endpoint.TTL(record.TTL),
+				record.ShortAns...,
+			))
+		}
+	}
+
+	return p.domainFilter.MatchEndpoints(endpoints), nil
+}
+
+// ApplyChanges applies a given set of changes in a given zone.
+func (p *NS1Provider) ApplyChanges(changes *plan.Changes) error {
+	changes = p.domainFilter.MatchChanges(changes)
+
+	combinedChanges := make([]*ns1Change, 0, len(changes.Create)+len(changes.UpdateNew)+len(changes.Delete))
+
+	combinedChanges = append(combinedChanges, newNS1Changes(ns1Create, changes.Create)...)
+	combinedChanges = append(combinedChanges, newNS1Changes(ns1Update, changes.UpdateNew)...)
+	combinedChanges = append(combinedChanges, newNS1Changes(ns1Delete, changes.Delete)...)
+
+	return p.submitChanges(combinedChanges)
+}
+
+// ns1Change differentiates between ChangeActions
+type ns1Change struct {
+	Action   string
+	Endpoint *endpoint.Endpoint
+}
+
+// submitChanges takes a collection of changes and sends them to NS1 zone by zone.
+func (p *NS1Provider) submitChanges(changes []*ns1Change) error {
+	// return early if there is nothing to change
+	if len(changes) == 0 {
+		log.Info("All records are already up to date")
+		return nil
+	}
+
+	zones, err := p.zonesFiltered()
+	if err != nil {
+		return err
+	}
+
+	// separate into per-zone change sets to be passed to the API.
+	changesByZone := ns1ChangesByZone(zones, changes)
+	for zoneName, changes := range changesByZone {
+		for _, change := range changes {
+			record := newNS1Record(zoneName, change.Endpoint)
+			log.Infof("Desired change: %s %s %s", change.Action, record.Domain, record.Type)
+
+			if p.dryRun {
+				continue
+			}
+
+			switch change.Action {
+			case ns1Create:
+				if _, err := p.client.CreateRecord(record); err != nil {
+					return err
+				}
+			case ns1Update:
+				if err := p.inheritAnswerMeta(record); err != nil {
+					return err
+				}
+				if _, err := p.client.UpdateRecord(record); err != nil {
+					return err
+				}
+			case ns1Delete:
+				if _, err := p.client.DeleteRecord(zoneName, record.Domain, record.Type); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// inheritAnswerMeta copies the metadata of the answers currently stored at NS1
+// onto the matching answers of the given record. Answer metadata drives NS1's
+// filter chains (e.g. latency based routing) and is configured outside of this
+// controller, so an update must not wipe it.
+func (p *NS1Provider) inheritAnswerMeta(record *dns.Record) error {
+	current, _, err := p.client.GetRecord(record.Zone, record.Domain, record.Type)
+	if err != nil {
+		return err
+	}
+
+	metaByRdata := make(map[string]*dns.Answer, len(current.Answers))
+	for _, ans := range current.Answers {
+		metaByRdata[strings.Join(ans.Rdata, " ")] = ans
+	}
+
+	for _, ans := range record.Answers {
+		if cur, ok := metaByRdata[strings.Join(ans.Rdata, " ")]; ok {
+			ans.Meta = cur.Meta
+			ans.RegionName = cur.RegionName
+		}
+	}
+	record.Filters = current.Filters
+	record.Regions = current.Regions
+
+	return nil
+}
+
+// zonesFiltered returns the list of zones matching the domain and zone id filters.
+func (p *NS1Provider) zonesFiltered() ([]*dns.Zone, error) {
+	zones, _, err := p.client.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []*dns.Zone{}
+	for _, z := range zones {
+		if !p.zoneIDFilter.Match(z.ID) {
+			continue
+		}
+
+		if !p.domainFilter.Match(z.Zone) {
+			continue
+		}
+
+		log.Debugf("Considering zone: %s (id: %s)", z.Zone, z.ID)
+		filtered = append(filtered, z)
+	}
+
+	return filtered, nil
+}
+
+// newNS1Record returns a NS1 record for the given endpoint in the given zone.
+func newNS1Record(zoneName string, ep *endpoint.Endpoint) *dns.Record {
+	record := dns.NewRecord(zoneName, ep.DNSName, ep.RecordType)
+	for _, target := range ep.Targets {
+		record.AddAnswer(dns.NewAnswer(strings.Split(target, " ")))
+	}
+
+	record.TTL = ns1DefaultTTL
+	if ep.RecordTTL.IsConfigured() {
+		record.TTL = int(ep.RecordTTL)
+	}
+
+	return record
+}
+
+// newNS1Changes returns a collection of changes based on the given records and action.
+func newNS1Changes(action string, endpoints []*endpoint.Endpoint) []*ns1Change {
+	changes := make([]*ns1Change, 0, len(endpoints))
+
+	for _, ep := range endpoints {
+		changes = append(changes, &ns1Change{
+			Action:   action,
+			Endpoint: ep,
+		})
+	}
+
+	return changes
+}
+
+// ns1ChangesByZone separates a multi-zone change into a single change per zone.
+func ns1ChangesByZone(zones []*dns.Zone, changeSet []*ns1Change) map[string][]*ns1Change {
+	changes := make(map[string][]*ns1Change)
+	zoneNameIDMapper := zoneIDName{}
+	for _, z := range zones {
+		zoneNameIDMapper.Add(z.Zone, z.Zone)
+		changes[z.Zone] = []*ns1Change{}
+	}
+
+	for _, c := range changeSet {
+		zone, _ := zoneNameIDMapper.FindZone(c.Endpoint.DNSName)
+		if zone == "" {
+			log.Debugf("Skipping record %s because no hosted zone matching record DNS Name was detected ", c.Endpoint.DNSName)
+			continue
+		}
+		changes[zone] = append(changes[zone], c)
+	}
+
+	// separating a change could lead to empty sub changes, remove them here.
+	for zone, change := range changes {
+		if len(change) == 0 {
+			delete(changes, zone)
+		}
+	}
+
+	return changes
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"gopkg.in/ns1/ns1-go.v2/rest/model/data"
+	"gopkg.in/ns1/ns1-go.v2/rest/model/dns"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	_ Provider = &NS1Provider{}
+)
+
+type mockNS1DomainClient struct {
+	records map[string]*dns.Record
+	updated []*dns.Record
+	created []*dns.Record
+	deleted []string
+}
+
+func newMockNS1DomainClient() *mockNS1DomainClient {
+	return &mockNS1DomainClient{records: map[string]*dns.Record{}}
+}
+
+func (m *mockNS1DomainClient) CreateRecord(r *dns.Record) (*http.Response, error) {
+	m.created = append(m.created, r)
+	return nil, nil
+}
+
+func (m *mockNS1DomainClient) DeleteRecord(zone string, domain string, t string) (*http.Response, error) {
+	m.deleted = append(m.deleted, domain+"/"+t)
+	return nil, nil
+}
+
+func (m *mockNS1DomainClient) UpdateRecord(r *dns.Record) (*http.Response, error) {
+	m.updated = append(m.updated, r)
+	return nil, nil
+}
+
+func (m *mockNS1DomainClient) GetRecord(zone string, domain string, t string) (*dns.Record, *http.Response, error) {
+	r, ok := m.records[domain+"/"+t]
+	if !ok {
+		return nil, nil, errors.New("record not found")
+	}
+	return r, nil, nil
+}
+
+func (m *mockNS1DomainClient) GetZone(zone string) (*dns.Zone, *http.Response, error) {
+	return &dns.Zone{
+		Zone: "foo.com",
+		Records: []*dns.ZoneRecord{
+			{Domain: "test.foo.com", ShortAns: []string{"2.2.2.2"}, TTL: 3600, Type: "A"},
+			{Domain: "foo.com", ShortAns: []string{"ns1.ns1.com"}, TTL: 3600, Type: "NS"},
+		},
+	}, nil, nil
+}
+
+func (m *mockNS1DomainClient) ListZones() ([]*dns.Zone, *http.Response, error) {
+	return []*dns.Zone{
+		{Zone: "foo.com", ID: "12345678910111213141516a"},
+		{Zone: "bar.com", ID: "12345678910111213141516b"},
+	}, nil, nil
+}
+
+func newNS1ProviderWithClient(client NS1DomainClient, dryRun bool) *NS1Provider {
+	return &NS1Provider{
+		client:       client,
+		domainFilter: NewDomainFilter([]string{"foo.com."}),
+		zoneIDFilter: NewZoneIDFilter([]string{""}),
+		dryRun:       dryRun,
+	}
+}
+
+func TestNewNS1Provider(t *testing.T) {
+	_, err := newNS1ProviderWithHTTPClient(NS1Config{}, http.DefaultClient)
+	assert.Error(t, err)
+
+	_, err = newNS1ProviderWithHTTPClient(NS1Config{APIKey: "xxxxxxxxxxxxxxxxx"}, http.DefaultClient)
+	assert.NoError(t, err)
+}
+
+func TestNS1Records(t *testing.T) {
+	provider := newNS1ProviderWithClient(newMockNS1DomainClient(), false)
+
+	records, err := provider.Records()
+	require.NoError(t, err)
+
+	require.Len(t, records, 1)
+	assert.Equal(t, "test.foo.com", records[0].DNSName)
+	assert.Equal(t, endpoint.RecordTypeA, records[0].RecordType)
+	assert.Equal(t, endpoint.TTL(3600), records[0].RecordTTL)
+	assert.Equal(t, endpoint.Targets{"2.2.2.2"}, records[0].Targets)
+}
+
+func TestNS1ApplyChanges(t *testing.T) {
+	client := newMockNS1DomainClient()
+	client.records["test.foo.com/A"] = &dns.Record{
+		Zone:   "foo.com",
+		Domain: "test.foo.com",
+		Type:   "A",
+		Answers: []*dns.Answer{
+			{Rdata: []string{"2.2.2.2"}, Meta: &data.Meta{Up: true}},
+		},
+	}
+	provider := newNS1ProviderWithClient(client, false)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("new.foo.com", endpoint.RecordTypeA, "1.1.1.1"),
+			endpoint.NewEndpoint("new.bar.com", endpoint.RecordTypeA, "1.1.1.1"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpointWithTTL("test.foo.com", endpoint.RecordTypeA, endpoint.TTL(60), "2.2.2.2", "3.3.3.3"),
+		},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("old.foo.com", endpoint.RecordTypeA, "4.4.4.4"),
+		},
+	}
+	require.NoError(t, provider.ApplyChanges(changes))
+
+	require.Len(t, client.created, 1)
+	assert.Equal(t, "new.foo.com", client.created[0].Domain)
+	assert.Equal(t, ns1DefaultTTL, client.created[0].TTL)
+
+	require.Len(t, client.updated, 1)
+	assert.Equal(t, 60, client.updated[0].TTL)
+	require.Len(t, client.updated[0].Answers, 2)
+	assert.Equal(t, &data.Meta{Up: true}, client.updated[0].Answers[0].Meta)
+	assert.Nil(t, client.updated[0].Answers[1].Meta)
+
+	assert.Equal(t, []string{"old.foo.com/A"}, client.deleted)
+}
+
+func TestNS1ApplyChangesDryRun(t *testing.T) {
+	client := newMockNS1DomainClient()
+	provider := newNS1ProviderWithClient(client, true)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("new.foo.com", endpoint.RecordTypeA, "1.1.1.1"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("test.foo.com", endpoint.RecordTypeA, "2.2.2.2"),
+		},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("old.foo.com", endpoint.RecordTypeA, "4.4.4.4"),
+		},
+	}
+	require.NoError(t, provider.ApplyChanges(changes))
+
+	assert.Empty(t, client.created)
+	assert.Empty(t, client.updated)
+	assert.Empty(t, client.deleted)
+}
+
+func TestNS1ChangesByZone(t *testing.T) {
+	zones := []*dns.Zone{
+		{Zone: "foo.com"},
+		{Zone: "bar.com"},
+	}
+	changes := newNS1Changes(ns1Create, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.foo.com", endpoint.RecordTypeA, "1.1.1.1"),
+		endpoint.NewEndpoint("b.bar.com", endpoint.RecordTypeA, "1.1.1.1"),
+		endpoint.NewEndpoint("c.baz.com", endpoint.RecordTypeA, "1.1.1.1"),
+	})
+
+	byZone := ns1ChangesByZone(zones, changes)
+	require.Len(t, byZone, 2)
+	assert.Equal(t, "a.foo.com", byZone["foo.com"][0].Endpoint.DNSName)
+	assert.Equal(t, "b.bar.com", byZone["bar.com"][0].Endpoint.DNSName)
+}
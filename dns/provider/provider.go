@@ -28,11 +28,47 @@ import (
 )
 
 // Provider defines the interface DNS providers should implement.
+// Implementations must be safe for concurrent use.
 type Provider interface {
 	Records() ([]*endpoint.Endpoint, error)
 	ApplyChanges(changes *plan.Changes) error
 }
 
+// The provider-specific property choosing the kinds of zones a record is published
+// in when its name matches both private and public zones, all of them by default.
+const (
+	ZoneVisibilityProperty = "zone-visibility"
+	ZoneVisibilityPublic   = "public"
+	ZoneVisibilityPrivate  = "private"
+	ZoneVisibilityBoth     = "both"
+)
+
+// AliasProperty is the provider-specific property of the CNAME records published as
+// aliases of the record of their target, in the same zone, by the providers supporting
+// them, true or false. The other providers publish them as CNAME records.
+const AliasProperty = "alias"
+
+// ZoneProperty is the provider-specific property of the records read from the providers
+// supporting it, naming the zone serving them, e.g. so that the controller tells which
+// zone a record deleted outside of external-ips was deleted from. It isn't desired.
+const ZoneProperty = "zone"
+
+// IsStale returns whether ApplyChanges failed, in some zones at least, as the changes
+// targeted records which don't exist anymore, or not as they were read, i.e. they were
+// planned from records changed in between. Planning them again from the records read
+// afresh may succeed.
+func IsStale(err error) bool {
+	if perr, ok := err.(*plan.PartialError); ok {
+		for _, f := range perr.Failed {
+			if IsStale(f.Err) {
+				return true
+			}
+		}
+		return false
+	}
+	return err == ErrRecordNotFound || isStaleChangeBatch(err)
+}
+
 // ensureTrailingDot ensures that the hostname receives a trailing dot if it hasn't already.
 func ensureTrailingDot(hostname string) string {
 	if net.ParseIP(hostname) != nil {
@@ -17,7 +17,13 @@ limitations under the License.
 package provider
 
 import (
+	"errors"
 	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/openfresh/external-ips/dns/plan"
 )
 
 func TestEnsureTrailingDot(t *testing.T) {
@@ -35,3 +41,24 @@ func TestEnsureTrailingDot(t *testing.T) {
 		}
 	}
 }
+
+func TestIsStale(t *testing.T) {
+	notFound := awserr.New(route53.ErrCodeInvalidChangeBatch, "Tried to delete resource record set [name='foo.example.org.', type='A'] but it was not found", nil)
+	exists := awserr.New(route53.ErrCodeInvalidChangeBatch, "Tried to create resource record set [name='foo.example.org.', type='A'] but it already exists", nil)
+	for _, tc := range []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("failed"), false},
+		{ErrRecordNotFound, true},
+		{notFound, true},
+		{exists, false},
+		{&plan.PartialError{Failed: []plan.ZoneError{{Zone: "a.", Err: exists}, {Zone: "b.", Err: notFound}}}, true},
+		{&plan.PartialError{Failed: []plan.ZoneError{{Zone: "a.", Err: exists}}}, false},
+	} {
+		if stale := IsStale(tc.err); stale != tc.expected {
+			t.Errorf("expected %v to be stale: %v, got %v", tc.err, tc.expected, stale)
+		}
+	}
+}
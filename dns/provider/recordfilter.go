@@ -16,6 +16,13 @@ limitations under the License.
 
 package provider
 
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
 // supportedRecordType returns true only for supported record types.
 // Currently A, CNAME, SRV, and TXT record types are supported.
 func supportedRecordType(recordType string) bool {
@@ -26,3 +33,36 @@ func supportedRecordType(recordType string) bool {
 		return false
 	}
 }
+
+// managedChanges returns the changes of the supported record types only, so that
+// the records a provider doesn't manage are never modified, even if asked to.
+// The updates are kept or dropped along with their old version.
+func managedChanges(changes *plan.Changes) *plan.Changes {
+	managed := &plan.Changes{
+		Create: managedEndpoints(changes.Create),
+		Delete: managedEndpoints(changes.Delete),
+	}
+	for i, ep := range changes.UpdateNew {
+		if !supportedRecordType(ep.RecordType) || (i < len(changes.UpdateOld) && !supportedRecordType(changes.UpdateOld[i].RecordType)) {
+			log.Warnf("Skipping update of unmanaged record %v", ep)
+			continue
+		}
+		managed.UpdateNew = append(managed.UpdateNew, ep)
+		if i < len(changes.UpdateOld) {
+			managed.UpdateOld = append(managed.UpdateOld, changes.UpdateOld[i])
+		}
+	}
+	return managed
+}
+
+func managedEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	var result []*endpoint.Endpoint
+	for _, ep := range endpoints {
+		if !supportedRecordType(ep.RecordType) {
+			log.Warnf("Skipping unmanaged record %v", ep)
+			continue
+		}
+		result = append(result, ep)
+	}
+	return result
+}
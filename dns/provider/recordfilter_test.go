@@ -16,7 +16,14 @@ limitations under the License.
 
 package provider
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
 
 func TestRecordTypeFilter(t *testing.T) {
 	var records = []struct {
@@ -48,3 +55,28 @@ func TestRecordTypeFilter(t *testing.T) {
 
 	}
 }
+
+func TestManagedChanges(t *testing.T) {
+	changes := managedChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("foo.example.org", "MX", "10 mail.example.org"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("bar.example.org", "NS", "ns2.example.org"),
+			endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeTXT, "\"heritage=external-ips\""),
+		},
+		UpdateOld: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("bar.example.org", "NS", "ns1.example.org"),
+			endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeTXT, "\"v=spf1 ~all\""),
+		},
+		Delete: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("example.org", "SOA", "ns1.example.org"),
+		},
+	})
+
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}, changes.Create)
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeTXT, "\"heritage=external-ips\"")}, changes.UpdateNew)
+	assert.Equal(t, []*endpoint.Endpoint{endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeTXT, "\"v=spf1 ~all\"")}, changes.UpdateOld)
+	assert.Empty(t, changes.Delete)
+}
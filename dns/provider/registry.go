@@ -0,0 +1,75 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+// Zones are the zones a provider is limited to.
+type Zones struct {
+	DomainFilter   DomainFilter
+	ZoneIDFilter   ZoneIDFilter
+	ZoneTypeFilter ZoneTypeFilter
+	// The zone type as configured, e.g. the namespace type of AWS Cloud Map
+	ZoneType string
+	// The VPCs of the private zones to manage, empty for any
+	VPCIDs []string
+}
+
+// Registration binds the configuration to a provider registered by name.
+type Registration struct {
+	// New creates the provider limited to the zones
+	New func(cfg *externalips.Config, zones Zones) (Provider, error)
+	// Permissions returns the IAM policy statements the provider requires on the
+	// zones of the IDs, empty for all of them. Nil if it doesn't need any.
+	Permissions func(zoneIDs []string) []permissions.Statement
+}
+
+var (
+	registrationsMu sync.RWMutex
+	registrations   = map[string]Registration{}
+)
+
+// Register makes a provider available by name to the provider settings of the
+// configuration, usually from the init function of its file. It panics if the
+// name is already registered.
+func Register(name string, r Registration) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	if r.New == nil {
+		panic("provider: Register without New for " + name)
+	}
+	if _, dup := registrations[name]; dup {
+		panic("provider: Register called twice for " + name)
+	}
+	registrations[name] = r
+}
+
+// Lookup returns the registration of the provider of the name.
+func Lookup(name string) (Registration, bool) {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	r, ok := registrations[name]
+	return r, ok
+}
+
+// Names returns the sorted names of the registered providers.
+func Names() []string {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	names := make([]string, 0, len(registrations))
+	for name := range registrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// VPCFilter holds a list of VPC ids the private zones must be associated with
+type VPCFilter struct {
+	vpcIDs []string
+}
+
+// NewVPCFilter returns a new VPCFilter given a list of VPC ids
+func NewVPCFilter(vpcIDs []string) VPCFilter {
+	filtered := make([]string, 0, len(vpcIDs))
+	for _, id := range vpcIDs {
+		if id != "" {
+			filtered = append(filtered, id)
+		}
+	}
+	return VPCFilter{filtered}
+}
+
+// IsConfigured returns true if the private zones are filtered by their VPCs
+func (f VPCFilter) IsConfigured() bool {
+	return len(f.vpcIDs) > 0
+}
+
+// Match checks whether one of the VPCs a private zone is associated with is one
+// of the provided VPC ids
+func (f VPCFilter) Match(vpcs []*route53.VPC) bool {
+	// An empty filter includes all zones.
+	if !f.IsConfigured() {
+		return true
+	}
+
+	for _, vpc := range vpcs {
+		for _, id := range f.vpcIDs {
+			if aws.StringValue(vpc.VPCId) == id {
+				return true
+			}
+		}
+	}
+
+	return false
+}
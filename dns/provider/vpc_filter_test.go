@@ -0,0 +1,48 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVPCFilterMatch(t *testing.T) {
+	vpcs := []*route53.VPC{
+		{VPCId: aws.String("vpc-1"), VPCRegion: aws.String("us-east-1")},
+		{VPCId: aws.String("vpc-2"), VPCRegion: aws.String("us-east-1")},
+	}
+
+	for _, tc := range []struct {
+		vpcFilter []string
+		vpcs      []*route53.VPC
+		matches   bool
+	}{
+		{
+			[]string{}, vpcs, true,
+		},
+		{
+			[]string{""}, nil, true,
+		},
+		{
+			[]string{"vpc-2"}, vpcs, true,
+		},
+		{
+			[]string{"vpc-3", "vpc-1"}, vpcs, true,
+		},
+		{
+			[]string{"vpc-3"}, vpcs, false,
+		},
+		{
+			[]string{"vpc-1"}, nil, false,
+		},
+	} {
+		vpcFilter := NewVPCFilter(tc.vpcFilter)
+		assert.Equal(t, tc.matches, vpcFilter.Match(tc.vpcs))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+// splitChanges separates a multi-zone change into a single change per zone, keyed by
+// zone id, for the providers applying the changes of each zone with calls of their own.
+// The changes of the hostnames matching no zone are skipped.
+func splitChanges(zones zoneIDName, changes *plan.Changes) map[string]*plan.Changes {
+	result := map[string]*plan.Changes{}
+	zoneChanges := func(ep *endpoint.Endpoint) *plan.Changes {
+		zoneID, _ := zones.FindZone(strings.TrimSuffix(ep.DNSName, "."))
+		if zoneID == "" {
+			log.Debugf("Skipping record %s because no hosted zone matching record DNS Name was detected ", ep.DNSName)
+			return nil
+		}
+		if _, ok := result[zoneID]; !ok {
+			result[zoneID] = &plan.Changes{}
+		}
+		return result[zoneID]
+	}
+
+	for _, ep := range changes.Create {
+		if c := zoneChanges(ep); c != nil {
+			c.Create = append(c.Create, ep)
+		}
+	}
+	for i, ep := range changes.UpdateNew {
+		if c := zoneChanges(ep); c != nil {
+			c.UpdateNew = append(c.UpdateNew, ep)
+			if i < len(changes.UpdateOld) {
+				c.UpdateOld = append(c.UpdateOld, changes.UpdateOld[i])
+			}
+		}
+	}
+	for _, ep := range changes.Delete {
+		if c := zoneChanges(ep); c != nil {
+			c.Delete = append(c.Delete, ep)
+		}
+	}
+
+	return result
+}
+
+// applyByZone applies the changes of each zone of zones with apply, going on with the
+// other zones when the changes of a zone fail. It returns a *plan.PartialError holding
+// the changes of the zones which were applied if some failed.
+func applyByZone(zones zoneIDName, changes *plan.Changes, apply func(zoneID, zoneName string, changes *plan.Changes) error) error {
+	applied := &plan.Changes{}
+	var failed []plan.ZoneError
+	for zoneID, zoneChanges := range splitChanges(zones, changes) {
+		zoneName := zones[zoneID]
+		if err := apply(zoneID, zoneName, zoneChanges); err != nil {
+			log.Errorf("Failed to update records in zone %s: %v", zoneName, err)
+			failed = append(failed, plan.ZoneError{Zone: zoneName, Err: err})
+			continue
+		}
+		applied.Create = append(applied.Create, zoneChanges.Create...)
+		applied.UpdateOld = append(applied.UpdateOld, zoneChanges.UpdateOld...)
+		applied.UpdateNew = append(applied.UpdateNew, zoneChanges.UpdateNew...)
+		applied.Delete = append(applied.Delete, zoneChanges.Delete...)
+	}
+
+	if len(failed) > 0 {
+		return &plan.PartialError{Applied: applied, Failed: failed}
+	}
+	return nil
+}
+
+// logChanges logs the changes about to be applied, one line per record.
+func logChanges(changes *plan.Changes) {
+	for _, ep := range changes.Create {
+		log.Infof("Desired change: %s %s %s", "CREATE", ep.DNSName, ep.RecordType)
+	}
+	for _, ep := range changes.UpdateNew {
+		log.Infof("Desired change: %s %s %s", "UPDATE", ep.DNSName, ep.RecordType)
+	}
+	for _, ep := range changes.Delete {
+		log.Infof("Desired change: %s %s %s", "DELETE", ep.DNSName, ep.RecordType)
+	}
+}
+
+// quoteTXT returns the value of a TXT record stored without quotes by its provider
+// quoted, as the txt registry writes it and the plan compares it.
+func quoteTXT(value string) string {
+	if strings.HasPrefix(value, "\"") {
+		return value
+	}
+	return strconv.Quote(value)
+}
+
+// unquoteTXT returns the value of a TXT target without its quotes, for the providers
+// storing them without.
+func unquoteTXT(target string) string {
+	if unquoted, err := strconv.Unquote(target); err == nil {
+		return unquoted
+	}
+	return target
+}
@@ -0,0 +1,57 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+)
+
+func TestApplyByZone(t *testing.T) {
+	zones := zoneIDName{}
+	zones.Add("1", "foo.com")
+	zones.Add("2", "bar.com")
+
+	changes := &plan.Changes{
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpoint("a.foo.com", endpoint.RecordTypeA, "1.1.1.1"), endpoint.NewEndpoint("a.qux.com", endpoint.RecordTypeA, "1.1.1.1")},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("b.bar.com.", endpoint.RecordTypeA, "1.1.1.1")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("b.bar.com.", endpoint.RecordTypeA, "2.2.2.2")},
+		Delete:    []*endpoint.Endpoint{endpoint.NewEndpoint("c.foo.com", endpoint.RecordTypeA, "1.1.1.1")},
+	}
+
+	split := splitChanges(zones, changes)
+	require.Len(t, split, 2)
+	assert.Len(t, split["1"].Create, 1)
+	assert.Len(t, split["1"].Delete, 1)
+	assert.Equal(t, changes.UpdateOld, split["2"].UpdateOld)
+
+	// the changes of the other zones are applied when a zone fails
+	err := applyByZone(zones, changes, func(zoneID, zoneName string, changes *plan.Changes) error {
+		if zoneName == "foo.com" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	perr, ok := err.(*plan.PartialError)
+	require.True(t, ok)
+	require.Len(t, perr.Failed, 1)
+	assert.Equal(t, "foo.com", perr.Failed[0].Zone)
+	assert.Equal(t, changes.UpdateNew, perr.Applied.UpdateNew)
+	assert.Empty(t, perr.Applied.Create)
+
+	assert.NoError(t, applyByZone(zones, changes, func(string, string, *plan.Changes) error { return nil }))
+}
+
+func TestQuoteTXT(t *testing.T) {
+	assert.Equal(t, "\"heritage=external-dns\"", quoteTXT("heritage=external-dns"))
+	assert.Equal(t, "\"heritage=external-dns\"", quoteTXT("\"heritage=external-dns\""))
+	assert.Equal(t, "heritage=external-dns", unquoteTXT("\"heritage=external-dns\""))
+	assert.Equal(t, "heritage=external-dns", unquoteTXT("heritage=external-dns"))
+}
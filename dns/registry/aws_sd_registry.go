@@ -68,6 +68,11 @@ func (sdr *AWSSDRegistry) Records() ([]*endpoint.Endpoint, error) {
 // ApplyChanges filters out records not owned the External-DNS, additionally it adds the required label
 // inserted in the AWS SD instance as a CreateID field
 func (sdr *AWSSDRegistry) ApplyChanges(changes *plan.Changes) error {
+	return sdr.provider.ApplyChanges(sdr.Preview(changes))
+}
+
+// Preview returns the owned changes labeled with their owner.
+func (sdr *AWSSDRegistry) Preview(changes *plan.Changes) *plan.Changes {
 	filteredChanges := &plan.Changes{
 		Create:    changes.Create,
 		UpdateNew: filterOwnedRecords(sdr.ownerID, changes.UpdateNew),
@@ -80,7 +85,7 @@ func (sdr *AWSSDRegistry) ApplyChanges(changes *plan.Changes) error {
 	sdr.updateLabels(filteredChanges.UpdateOld)
 	sdr.updateLabels(filteredChanges.Delete)
 
-	return sdr.provider.ApplyChanges(filteredChanges)
+	return filteredChanges
 }
 
 func (sdr *AWSSDRegistry) updateLabels(endpoints []*endpoint.Endpoint) {
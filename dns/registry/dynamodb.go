@@ -0,0 +1,382 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package registry
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/permissions"
+)
+
+const (
+	// the attributes of the items of the ownership table, keyed by owner and name
+	dynamoDBOwnerAttribute  = "Owner"
+	dynamoDBNameAttribute   = "Name"
+	dynamoDBLabelsAttribute = "Labels"
+)
+
+// DynamoDBAPI is the subset of the DynamoDB API that we actually use.  Add methods as required. Signatures must match exactly.
+// mostly taken from: https://github.com/aws/aws-sdk-go/blob/master/service/dynamodb/dynamodbiface/interface.go
+type DynamoDBAPI interface {
+	QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+}
+
+// DynamoDBPermissions returns the IAM policy statements required by the DynamoDB registry, restricted to its table.
+func DynamoDBPermissions(table string) []permissions.Statement {
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   permissions.Actions("dynamodb", (*DynamoDBAPI)(nil)),
+			Resource: []string{"arn:aws:dynamodb:*:*:table/" + table},
+		},
+	}
+}
+
+// DynamoDBConfig contains the settings of the DynamoDB registry.
+type DynamoDBConfig struct {
+	// The table holding the ownership, with the string hash key Owner and range key Name
+	Table      string
+	Region     string
+	AssumeRole string
+	OwnerID    string
+	// The prefix of the TXT records of the TXT registry, adopted when there is no item
+	TXTPrefix string
+	// Keeps the TXT records of the TXT registry along with the items, to switch back to it
+	MirrorTXT bool
+	DryRun    bool
+}
+
+// DynamoDBRegistry implements registry interface with ownership kept in the items of a DynamoDB table,
+// leaving the zones free of TXT records. The owned records found with a TXT record of the TXT registry
+// and no item are adopted, and with MirrorTXT their TXT records are kept up to date as well.
+type DynamoDBRegistry struct {
+	provider  provider.Provider
+	client    DynamoDBAPI
+	table     string
+	ownerID   string
+	mapper    nameMapper
+	mirrorTXT bool
+	dryRun    bool
+
+	// the TXT records of the TXT registry found by the last call to Records, by the name of their record
+	txtRecords map[string]*endpoint.Endpoint
+}
+
+// NewDynamoDBRegistry returns a new DynamoDBRegistry keeping the ownership of the records of provider in the configured table.
+func NewDynamoDBRegistry(provider provider.Provider, config DynamoDBConfig) (*DynamoDBRegistry, error) {
+	if config.OwnerID == "" {
+		return nil, errors.New("owner id cannot be empty")
+	}
+	if config.Table == "" {
+		return nil, errors.New("table cannot be empty")
+	}
+
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRole != "" {
+		log.Infof("Assuming role: %s", config.AssumeRole)
+		session.Config.WithCredentials(stscreds.NewCredentials(session, config.AssumeRole))
+	}
+
+	return newDynamoDBRegistry(provider, dynamodb.New(session), config), nil
+}
+
+func newDynamoDBRegistry(provider provider.Provider, client DynamoDBAPI, config DynamoDBConfig) *DynamoDBRegistry {
+	return &DynamoDBRegistry{
+		provider:  provider,
+		client:    client,
+		table:     config.Table,
+		ownerID:   config.OwnerID,
+		mapper:    newPrefixNameMapper(config.TXTPrefix),
+		mirrorTXT: config.MirrorTXT,
+		dryRun:    config.DryRun,
+	}
+}
+
+// Records returns the current records from the provider, labelled with the items of the table.
+// The TXT records of the TXT registry are left out, and their labels used for the records without
+// item, the owned ones being adopted into the table.
+func (im *DynamoDBRegistry) Records() ([]*endpoint.Endpoint, error) {
+	records, err := im.provider.Records()
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := im.items()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := []*endpoint.Endpoint{}
+	// TXT records which aren't part of the TXT registry, e.g. managed by the user
+	unmanaged := []*endpoint.Endpoint{}
+
+	txtRecords := map[string]*endpoint.Endpoint{}
+	txtLabels := map[string]endpoint.Labels{}
+
+	for _, record := range records {
+		if record.RecordType != endpoint.RecordTypeTXT {
+			endpoints = append(endpoints, record)
+			continue
+		}
+		labels, err := endpoint.NewLabelsFromString(record.Targets[0])
+		if err == endpoint.ErrInvalidHeritage {
+			unmanaged = append(unmanaged, record)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		endpointDNSName := im.mapper.toEndpointName(record.DNSName)
+		txtRecords[endpointDNSName] = record
+		txtLabels[endpointDNSName] = labels
+	}
+
+	adopted := map[string]endpoint.Labels{}
+	mirrored := map[string]endpoint.Labels{}
+	for _, ep := range endpoints {
+		if labels, ok := items[ep.DNSName]; ok {
+			ep.Labels = copyLabels(labels)
+			if _, ok := txtRecords[ep.DNSName]; !ok && im.mirrorTXT {
+				mirrored[ep.DNSName] = labels
+			}
+			continue
+		}
+		if labels, ok := txtLabels[ep.DNSName]; ok {
+			// the records of the other owners keep the ownership of their TXT records
+			ep.Labels = copyLabels(labels)
+			if labels[endpoint.OwnerLabelKey] == im.ownerID {
+				adopted[ep.DNSName] = labels
+			}
+			continue
+		}
+		//this indicates that owner could not be identified, as there is neither an item nor a TXT record
+		ep.Labels = endpoint.NewLabels()
+	}
+
+	for _, ep := range unmanaged {
+		ep.Labels = endpoint.NewLabels()
+	}
+	endpoints = append(unmanaged, endpoints...)
+
+	im.txtRecords = txtRecords
+	im.migrate(adopted, mirrored)
+
+	return endpoints, nil
+}
+
+// ApplyChanges updates dns provider with the owned changes, creating the items of the created
+// records beforehand and deleting the ones of the deleted records afterwards, so that a record
+// never exists without its item. The items of the records failing to be created are removed again.
+func (im *DynamoDBRegistry) ApplyChanges(changes *plan.Changes) error {
+	filteredChanges, records := im.providerChanges(changes)
+
+	for _, r := range records.Create {
+		if err := im.putItem(r.DNSName, r.Labels); err != nil {
+			return err
+		}
+	}
+
+	applied := records
+	err := im.provider.ApplyChanges(filteredChanges)
+	if err != nil {
+		applied = &plan.Changes{}
+		perr, ok := err.(*plan.PartialError)
+		if ok && perr.Applied != nil {
+			applied = appliedRecords(records, perr.Applied)
+			err = &plan.PartialError{Applied: applied, Failed: perr.Failed}
+		}
+	}
+
+	created := map[*endpoint.Endpoint]bool{}
+	for _, r := range applied.Create {
+		created[r] = true
+	}
+	for _, r := range records.Create {
+		if !created[r] {
+			im.deleteItem(r.DNSName)
+		}
+	}
+	for _, r := range applied.UpdateNew {
+		if putErr := im.putItem(r.DNSName, r.Labels); putErr != nil {
+			log.Warnf("Failed to update the ownership of %s: %v", r.DNSName, putErr)
+		}
+	}
+	for _, r := range applied.Delete {
+		im.deleteItem(r.DNSName)
+	}
+
+	return err
+}
+
+// Preview returns the owned changes along with the changes to their TXT records.
+func (im *DynamoDBRegistry) Preview(changes *plan.Changes) *plan.Changes {
+	filteredChanges, _ := im.providerChanges(changes)
+	return filteredChanges
+}
+
+// providerChanges returns the owned changes along with the changes to their TXT records, and the
+// owned changes alone. The TXT records of the TXT registry are only kept up to date with MirrorTXT,
+// otherwise they are removed along with their records.
+func (im *DynamoDBRegistry) providerChanges(changes *plan.Changes) (*plan.Changes, *plan.Changes) {
+	filteredChanges := &plan.Changes{
+		Create:    changes.Create,
+		UpdateNew: filterOwnedRecords(im.ownerID, changes.UpdateNew),
+		UpdateOld: filterOwnedRecords(im.ownerID, changes.UpdateOld),
+		Delete:    filterOwnedRecords(im.ownerID, changes.Delete),
+	}
+	// the changes to the records themselves, without their TXT records
+	records := *filteredChanges
+
+	for _, r := range filteredChanges.Create {
+		r.Labels[endpoint.OwnerLabelKey] = im.ownerID
+		if im.mirrorTXT {
+			filteredChanges.Create = append(filteredChanges.Create, im.txtRecord(r))
+		}
+	}
+
+	for _, r := range filteredChanges.Delete {
+		if txt, ok := im.txtRecords[r.DNSName]; ok {
+			filteredChanges.Delete = append(filteredChanges.Delete, txt)
+		}
+	}
+
+	for _, r := range filteredChanges.UpdateNew {
+		txt, ok := im.txtRecords[r.DNSName]
+		switch {
+		case ok && im.mirrorTXT:
+			filteredChanges.UpdateOld = append(filteredChanges.UpdateOld, txt)
+			filteredChanges.UpdateNew = append(filteredChanges.UpdateNew, im.txtRecord(r))
+		case ok:
+			filteredChanges.Delete = append(filteredChanges.Delete, txt)
+		case im.mirrorTXT:
+			filteredChanges.Create = append(filteredChanges.Create, im.txtRecord(r))
+		}
+	}
+
+	return filteredChanges, &records
+}
+
+// migrate adopts the TXT records of the TXT registry owned by this instance into the table and,
+// with MirrorTXT, creates the missing TXT records of the records found in the table. Failures are
+// only logged, the migration being retried on the next call to Records.
+func (im *DynamoDBRegistry) migrate(adopted, mirrored map[string]endpoint.Labels) {
+	for name, labels := range adopted {
+		log.Infof("Adopting the ownership of %s from its TXT record.", name)
+		if err := im.putItem(name, labels); err != nil {
+			log.Warnf("Failed to adopt the ownership of %s: %v", name, err)
+		}
+	}
+
+	if len(mirrored) == 0 {
+		return
+	}
+	changes := &plan.Changes{}
+	for name, labels := range mirrored {
+		log.Infof("Creating the TXT record of %s.", name)
+		changes.Create = append(changes.Create, endpoint.NewEndpoint(im.mapper.toTXTName(name), endpoint.RecordTypeTXT, labels.Serialize(true)))
+	}
+	if err := im.provider.ApplyChanges(changes); err != nil {
+		log.Warnf("Failed to create the TXT records: %v", err)
+	}
+}
+
+// items returns the labels of the items of this instance, by the name of their record.
+func (im *DynamoDBRegistry) items() (map[string]endpoint.Labels, error) {
+	items := map[string]endpoint.Labels{}
+	err := im.client.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(im.table),
+		KeyConditionExpression: aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]*string{
+			"#owner": aws.String(dynamoDBOwnerAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":owner": {S: aws.String(im.ownerID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(resp *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range resp.Items {
+			if item[dynamoDBNameAttribute] == nil || item[dynamoDBLabelsAttribute] == nil {
+				continue
+			}
+			name := aws.StringValue(item[dynamoDBNameAttribute].S)
+			labels, err := endpoint.NewLabelsFromString(aws.StringValue(item[dynamoDBLabelsAttribute].S))
+			if err != nil {
+				log.Warnf("Skipping the ownership of %s with invalid labels: %v", name, err)
+				continue
+			}
+			items[name] = labels
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (im *DynamoDBRegistry) putItem(name string, labels endpoint.Labels) error {
+	if im.dryRun {
+		return nil
+	}
+	_, err := im.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(im.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			dynamoDBOwnerAttribute:  {S: aws.String(im.ownerID)},
+			dynamoDBNameAttribute:   {S: aws.String(name)},
+			dynamoDBLabelsAttribute: {S: aws.String(labels.Serialize(false))},
+		},
+	})
+	return err
+}
+
+// deleteItem deletes the item of the record of the given name. A failure is only logged, the
+// item being left over without consequences as long as no record of that name is created.
+func (im *DynamoDBRegistry) deleteItem(name string) {
+	if im.dryRun {
+		return
+	}
+	_, err := im.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(im.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			dynamoDBOwnerAttribute: {S: aws.String(im.ownerID)},
+			dynamoDBNameAttribute:  {S: aws.String(name)},
+		},
+	})
+	if err != nil {
+		log.Warnf("Failed to delete the ownership of %s: %v", name, err)
+	}
+}
+
+func (im *DynamoDBRegistry) txtRecord(r *endpoint.Endpoint) *endpoint.Endpoint {
+	return endpoint.NewEndpoint(im.mapper.toTXTName(r.DNSName), endpoint.RecordTypeTXT, r.Labels.Serialize(true))
+}
+
+func copyLabels(labels endpoint.Labels) endpoint.Labels {
+	c := endpoint.NewLabels()
+	for k, v := range labels {
+		c[k] = v
+	}
+	return c
+}
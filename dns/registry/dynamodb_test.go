@@ -0,0 +1,226 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+)
+
+var _ Registry = &DynamoDBRegistry{}
+var _ Previewer = &DynamoDBRegistry{}
+
+// DynamoDBAPIStub keeps the items of a single table in memory, by owner and name.
+type DynamoDBAPIStub struct {
+	items map[string]map[string]string
+}
+
+func NewDynamoDBAPIStub() *DynamoDBAPIStub {
+	return &DynamoDBAPIStub{items: map[string]map[string]string{}}
+}
+
+func (s *DynamoDBAPIStub) QueryPages(input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool) error {
+	owner := aws.StringValue(input.ExpressionAttributeValues[":owner"].S)
+	output := &dynamodb.QueryOutput{}
+	for name, labels := range s.items[owner] {
+		output.Items = append(output.Items, map[string]*dynamodb.AttributeValue{
+			dynamoDBOwnerAttribute:  {S: aws.String(owner)},
+			dynamoDBNameAttribute:   {S: aws.String(name)},
+			dynamoDBLabelsAttribute: {S: aws.String(labels)},
+		})
+	}
+	fn(output, true)
+	return nil
+}
+
+func (s *DynamoDBAPIStub) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	owner := aws.StringValue(input.Item[dynamoDBOwnerAttribute].S)
+	if s.items[owner] == nil {
+		s.items[owner] = map[string]string{}
+	}
+	s.items[owner][aws.StringValue(input.Item[dynamoDBNameAttribute].S)] = aws.StringValue(input.Item[dynamoDBLabelsAttribute].S)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (s *DynamoDBAPIStub) DeleteItem(input *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+	delete(s.items[aws.StringValue(input.Key[dynamoDBOwnerAttribute].S)], aws.StringValue(input.Key[dynamoDBNameAttribute].S))
+	return &dynamodb.DeleteItemOutput{}, nil
+}
+
+func newTestDynamoDBRegistry(t *testing.T, mirrorTXT bool) (*DynamoDBRegistry, *provider.InMemoryProvider, *DynamoDBAPIStub) {
+	p := provider.NewInMemoryProvider()
+	require.NoError(t, p.CreateZone(testZone))
+	stub := NewDynamoDBAPIStub()
+	r := newDynamoDBRegistry(p, stub, DynamoDBConfig{
+		Table:     "ownership",
+		OwnerID:   "owner",
+		TXTPrefix: "txt.",
+		MirrorTXT: mirrorTXT,
+	})
+	return r, p, stub
+}
+
+func TestNewDynamoDBRegistry(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	_, err := NewDynamoDBRegistry(p, DynamoDBConfig{Table: "ownership"})
+	assert.Error(t, err)
+	_, err = NewDynamoDBRegistry(p, DynamoDBConfig{OwnerID: "owner"})
+	assert.Error(t, err)
+}
+
+func TestDynamoDBPermissions(t *testing.T) {
+	statements := DynamoDBPermissions("ownership")
+	require.Len(t, statements, 1)
+	assert.Equal(t, []string{"dynamodb:DeleteItem", "dynamodb:PutItem", "dynamodb:Query"}, statements[0].Action)
+	assert.Equal(t, []string{"arn:aws:dynamodb:*:*:table/ownership"}, statements[0].Resource)
+}
+
+func TestDynamoDBRegistryRecords(t *testing.T) {
+	r, p, stub := newTestDynamoDBRegistry(t, false)
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("bar.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.bar.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+			newEndpointWithOwner("baz.test-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.baz.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=other\"", endpoint.RecordTypeTXT, ""),
+			newEndpointWithOwner("qux.test-zone.example.org", "1.2.3.7", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("unmanaged.test-zone.example.org", "\"some text\"", endpoint.RecordTypeTXT, ""),
+		},
+	}))
+	stub.items["owner"] = map[string]string{"foo.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner"}
+
+	records, err := r.Records()
+	require.NoError(t, err)
+
+	owners := map[string]string{}
+	for _, ep := range records {
+		owners[ep.DNSName] = ep.Labels[endpoint.OwnerLabelKey]
+	}
+	assert.Equal(t, map[string]string{
+		"foo.test-zone.example.org":       "owner",
+		"bar.test-zone.example.org":       "owner",
+		"baz.test-zone.example.org":       "other",
+		"qux.test-zone.example.org":       "",
+		"unmanaged.test-zone.example.org": "",
+	}, owners)
+
+	// the owned TXT records are adopted, those of the other owners left alone
+	assert.Equal(t, map[string]string{
+		"foo.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner",
+		"bar.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner",
+	}, stub.items["owner"])
+}
+
+func TestDynamoDBRegistryApplyChanges(t *testing.T) {
+	r, p, stub := newTestDynamoDBRegistry(t, false)
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("bar.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.bar.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		},
+	}))
+	records, err := r.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	// the records are created without TXT record, and the adopted ones deleted with theirs
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+		},
+		Delete: records,
+	}))
+	current, err := p.Records()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.Equal(t, "foo.test-zone.example.org", current[0].DNSName)
+	assert.Equal(t, map[string]string{
+		"foo.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner",
+	}, stub.items["owner"])
+
+	// the records of the other owners are left alone
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Delete: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, "other"),
+		},
+	}))
+	current, err = p.Records()
+	require.NoError(t, err)
+	assert.Len(t, current, 1)
+	assert.Len(t, stub.items["owner"], 1)
+}
+
+func TestDynamoDBRegistryFailedCreate(t *testing.T) {
+	stub := NewDynamoDBAPIStub()
+	r := newDynamoDBRegistry(&countingProvider{err: errors.New("apply failed")}, stub, DynamoDBConfig{
+		Table:   "ownership",
+		OwnerID: "owner",
+	})
+	_, err := r.Records()
+	require.NoError(t, err)
+
+	// the item is removed again, so that it never labels a record created by someone else
+	require.Error(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+		},
+	}))
+	assert.Empty(t, stub.items["owner"])
+}
+
+func TestDynamoDBRegistryMirrorTXT(t *testing.T) {
+	r, p, stub := newTestDynamoDBRegistry(t, true)
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+		},
+	}))
+	stub.items["owner"] = map[string]string{"foo.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner"}
+
+	// the missing TXT records are created, so that the TXT registry may take over
+	records, err := r.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	current, err := p.Records()
+	require.NoError(t, err)
+	assert.Len(t, current, 2)
+
+	records, err = r.Records()
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+
+	update := newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, "owner")
+	update.Labels[endpoint.ResourceLabelKey] = "service/default/foo"
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("bar.test-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, ""),
+		},
+		UpdateOld: records,
+		UpdateNew: []*endpoint.Endpoint{update},
+	}))
+
+	txt, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, nil, "")
+	require.NoError(t, err)
+	records, err = txt.Records()
+	require.NoError(t, err)
+	owners := map[string]string{}
+	for _, ep := range records {
+		owners[ep.DNSName] = ep.Labels.Serialize(false)
+	}
+	assert.Equal(t, map[string]string{
+		"foo.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner,external-ips/resource=service/default/foo",
+		"bar.test-zone.example.org": "heritage=external-ips,external-ips/owner=owner",
+	}, owners)
+	assert.Equal(t, owners, stub.items["owner"])
+}
@@ -20,6 +20,8 @@ limitations under the License.
 package registry
 
 import (
+	"strings"
+
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/dns/plan"
 	log "github.com/sirupsen/logrus"
@@ -34,15 +36,45 @@ type Registry interface {
 	ApplyChanges(changes *plan.Changes) error
 }
 
+// Previewer is implemented by the registries which filter or complete the changes
+// before propagating them. Preview returns the changes ApplyChanges would send to
+// the DNS provider, without applying them.
+type Previewer interface {
+	Preview(changes *plan.Changes) *plan.Changes
+}
+
+// Repairer is implemented by the registries able to restore the ownership of the
+// records which lost it, e.g. as their ownership record was deleted or edited.
+// RepairOwnership takes over the unowned records among records desired by an
+// endpoint of the same resource, updating their labels in place, and returns them.
+type Repairer interface {
+	RepairOwnership(records, desired []*endpoint.Endpoint) ([]*endpoint.Endpoint, error)
+}
+
 //TODO(ideahitme): consider moving this to Plan
 func filterOwnedRecords(ownerID string, eps []*endpoint.Endpoint) []*endpoint.Endpoint {
+	return filterRecordsOwnedBy([]string{ownerID}, eps)
+}
+
+// filterRecordsOwnedBy keeps the records owned by any of ownerIDs
+func filterRecordsOwnedBy(ownerIDs []string, eps []*endpoint.Endpoint) []*endpoint.Endpoint {
 	filtered := []*endpoint.Endpoint{}
 	for _, ep := range eps {
-		if endpointOwner, ok := ep.Labels[endpoint.OwnerLabelKey]; !ok || endpointOwner != ownerID {
-			log.Debugf(`Skipping endpoint %v because owner id does not match, found: "%s", required: "%s"`, ep, endpointOwner, ownerID)
+		endpointOwner, ok := ep.Labels[endpoint.OwnerLabelKey]
+		if !ok || !containsOwner(ownerIDs, endpointOwner) {
+			log.Debugf(`Skipping endpoint %v because owner id does not match, found: "%s", required: "%s"`, ep, endpointOwner, strings.Join(ownerIDs, `" or "`))
 			continue
 		}
 		filtered = append(filtered, ep)
 	}
 	return filtered
 }
+
+func containsOwner(ownerIDs []string, ownerID string) bool {
+	for _, id := range ownerIDs {
+		if id == ownerID {
+			return true
+		}
+	}
+	return false
+}
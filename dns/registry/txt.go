@@ -21,6 +21,7 @@ package registry
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"strings"
@@ -31,11 +32,63 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// The formats of the TXT records. The TXT record of the v1 format is named after its
+// record, and shared by the records of any type of this name. The v2 format adds the
+// record type to the first label of the name, so that each record has its own.
+const (
+	TXTFormatV1 = "v1"
+	TXTFormatV2 = "v2"
+	// TXTFormatBoth writes the TXT records of both formats, e.g. for the instances only reading the v1 format
+	TXTFormatBoth = "both"
+)
+
+const (
+	// the first label of the wildcard names in the names of the TXT records of the v2 format,
+	// as the wildcard has to be the whole first label of a name
+	txtWildcardLabel = "_wildcard"
+)
+
+// typedRecordTypes are the record types recognized in the names of the TXT records of the v2 format.
+var typedRecordTypes = map[string]bool{
+	endpoint.RecordTypeA:     true,
+	"AAAA":                   true,
+	endpoint.RecordTypeCNAME: true,
+	endpoint.RecordTypeTXT:   true,
+	endpoint.RecordTypeSRV:   true,
+	"MX":                     true,
+	"NS":                     true,
+	"PTR":                    true,
+}
+
+// currentTXT is a TXT record a record was read with.
+type currentTXT struct {
+	format    string
+	encrypted bool
+}
+
+// txtLabels are the labels read from a TXT record.
+type txtLabels struct {
+	labels    endpoint.Labels
+	encrypted bool
+}
+
 // TXTRegistry implements registry interface with ownership implemented via associated TXT records
 type TXTRegistry struct {
 	provider provider.Provider
 	ownerID  string //refers to the owner id of the current instance
 	mapper   nameMapper
+	// the other owner ids of the records managed by the current instance, e.g. its
+	// former owner ids, which are replaced with its own as the records are updated
+	readOwnerIDs []string
+	// encrypts the labels of the TXT records written, nil to write them in plain text
+	encryption *labelCipher
+	// the formats of the TXT records written
+	formats []string
+	// the TXT records the records were read with, by name and type, so that they're
+	// reconstructed as they were read to be updated or deleted
+	current map[string][]currentTXT
+	// the number of records only read with each TXT record of the v1 format, by name
+	v1Readers map[string]int
 
 	// cache the records in memory and update on an interval instead.
 	recordsCache            []*endpoint.Endpoint
@@ -44,17 +97,52 @@ type TXTRegistry struct {
 }
 
 // NewTXTRegistry returns new TXTRegistry object
-func NewTXTRegistry(provider provider.Provider, txtPrefix, ownerID string, cacheInterval time.Duration) (*TXTRegistry, error) {
+// The records owned by one of readOwnerIDs are managed as if they were owned by ownerID.
+// The labels of the TXT records are encrypted with encryptionKey unless it's empty.
+// The TXT records are written in the given format, v1 if empty, and read in both.
+func NewTXTRegistry(provider provider.Provider, txtPrefix, ownerID string, readOwnerIDs []string, cacheInterval time.Duration, encryptionKey []byte, format string) (*TXTRegistry, error) {
 	if ownerID == "" {
 		return nil, errors.New("owner id cannot be empty")
 	}
 
+	var formats []string
+	switch format {
+	case "", TXTFormatV1:
+		formats = []string{TXTFormatV1}
+	case TXTFormatV2:
+		formats = []string{TXTFormatV2}
+	case TXTFormatBoth:
+		formats = []string{TXTFormatV1, TXTFormatV2}
+	default:
+		return nil, fmt.Errorf("unknown TXT format: %s", format)
+	}
+
+	var encryption *labelCipher
+	if len(encryptionKey) > 0 {
+		var err error
+		encryption, err = newLabelCipher(encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	mapper := newPrefixNameMapper(txtPrefix)
 
+	var readOwners []string
+	for _, id := range readOwnerIDs {
+		if id != "" && id != ownerID {
+			readOwners = append(readOwners, id)
+		}
+	}
+
 	return &TXTRegistry{
 		provider:      provider,
 		ownerID:       ownerID,
 		mapper:        mapper,
+		readOwnerIDs:  readOwners,
+		encryption:    encryption,
+		formats:       formats,
+		current:       map[string][]currentTXT{},
 		cacheInterval: cacheInterval,
 	}, nil
 }
@@ -76,8 +164,11 @@ func (im *TXTRegistry) Records() ([]*endpoint.Endpoint, error) {
 	}
 
 	endpoints := []*endpoint.Endpoint{}
+	// TXT records which aren't part of the registry, e.g. managed by the user
+	unmanaged := []*endpoint.Endpoint{}
 
-	labelMap := map[string]endpoint.Labels{}
+	// the labels of the TXT records of each format, by name for v1 and by name and type for v2
+	labelMaps := map[string]map[string]txtLabels{TXTFormatV1: {}, TXTFormatV2: {}}
 
 	for _, record := range records {
 		if record.RecordType != endpoint.RecordTypeTXT {
@@ -90,24 +181,65 @@ func (im *TXTRegistry) Records() ([]*endpoint.Endpoint, error) {
 			//if no heritage is found or it is invalid
 			//case when value of txt record cannot be identified
 			//record will not be removed as it will have empty owner
-			endpoints = append(endpoints, record)
+			unmanaged = append(unmanaged, record)
 			continue
 		}
 		if err != nil {
 			return nil, err
 		}
-		endpointDNSName := im.mapper.toEndpointName(record.DNSName)
-		labelMap[endpointDNSName] = labels
+		_, encrypted := labels[encryptedLabelKey]
+		if encrypted {
+			// the records whose owner can't be told are left alone, as if they had no TXT record
+			if im.encryption == nil {
+				log.Warnf("TXT record %s is encrypted, not managing it without the encryption key", record.DNSName)
+				unmanaged = append(unmanaged, record)
+				continue
+			}
+			labels, err = im.encryption.decrypt(labels)
+			if err != nil {
+				log.Warnf("Failed to decrypt TXT record %s, not managing it: %v", record.DNSName, err)
+				unmanaged = append(unmanaged, record)
+				continue
+			}
+		}
+		// the name of a TXT record of the v2 format is also a valid name of the v1 format,
+		// the records of its name and type tell which one it is
+		read := txtLabels{labels: labels, encrypted: encrypted}
+		labelMaps[TXTFormatV1][im.mapper.toEndpointName(record.DNSName)] = read
+		if name, recordType := im.mapper.toTypedEndpointName(record.DNSName); name != "" {
+			labelMaps[TXTFormatV2][txtKey(TXTFormatV2, name, recordType)] = read
+		}
 	}
 
+	current := map[string][]currentTXT{}
+	v1Readers := map[string]int{}
 	for _, ep := range endpoints {
-		if labels, ok := labelMap[ep.DNSName]; ok {
-			ep.Labels = labels
-		} else {
-			//this indicates that owner could not be identified, as there is no corresponding TXT record
-			ep.Labels = endpoint.NewLabels()
+		//this indicates that owner could not be identified, as there is no corresponding TXT record
+		ep.Labels = endpoint.NewLabels()
+		// the v2 format comes last as it prevails, its TXT record being specific to the record
+		for _, format := range []string{TXTFormatV1, TXTFormatV2} {
+			read, ok := labelMaps[format][txtKey(format, ep.DNSName, ep.RecordType)]
+			if !ok {
+				continue
+			}
+			ep.Labels = read.labels
+			key := recordKey(ep)
+			current[key] = append(current[key], currentTXT{format: format, encrypted: read.encrypted})
 		}
+		if v1Only(current[recordKey(ep)]) {
+			v1Readers[ep.DNSName]++
+		}
+	}
+	im.current = current
+	im.v1Readers = v1Readers
+
+	// unmanaged TXT records never inherit the owner of a record sharing their name,
+	// so that they are never updated nor deleted along with it. They come first so
+	// that the plan, which keeps a single current record per name, retains the owned one.
+	for _, ep := range unmanaged {
+		ep.Labels = endpoint.NewLabels()
 	}
+	endpoints = append(unmanaged, endpoints...)
 
 	// Update the cache.
 	if im.cacheInterval > 0 {
@@ -120,64 +252,318 @@ func (im *TXTRegistry) Records() ([]*endpoint.Endpoint, error) {
 
 // ApplyChanges updates dns provider with the changes
 // for each created/deleted record it will also take into account TXT records for creation/deletion
+// The cache is only updated with the changes the provider applied, and dropped if it failed
+// without telling which ones were, or as the changes were planned from stale records.
 func (im *TXTRegistry) ApplyChanges(changes *plan.Changes) error {
+	filteredChanges, records := im.providerChanges(changes)
+
+	if err := im.provider.ApplyChanges(filteredChanges); err != nil {
+		perr, ok := err.(*plan.PartialError)
+		if !ok || perr.Applied == nil {
+			im.invalidateCache()
+			return err
+		}
+		// keep track of the records which made it, the others are retried on the next run
+		applied := appliedRecords(records, perr.Applied)
+		if provider.IsStale(err) {
+			// the records were changed by someone else since they were cached
+			im.invalidateCache()
+		} else if im.cacheInterval > 0 {
+			im.updateCache(applied)
+		}
+		return &plan.PartialError{Applied: applied, Failed: perr.Failed}
+	}
+
+	if im.cacheInterval > 0 {
+		im.updateCache(records)
+	}
+	return nil
+}
+
+// Preview returns the owned changes along with the changes to their TXT records.
+func (im *TXTRegistry) Preview(changes *plan.Changes) *plan.Changes {
+	filteredChanges, _ := im.providerChanges(changes)
+	return filteredChanges
+}
+
+// providerChanges returns the owned changes along with the changes to their TXT
+// records, and the owned changes alone.
+func (im *TXTRegistry) providerChanges(changes *plan.Changes) (*plan.Changes, *plan.Changes) {
+	ownerIDs := append([]string{im.ownerID}, im.readOwnerIDs...)
 	filteredChanges := &plan.Changes{
 		Create:    changes.Create,
-		UpdateNew: filterOwnedRecords(im.ownerID, changes.UpdateNew),
-		UpdateOld: filterOwnedRecords(im.ownerID, changes.UpdateOld),
-		Delete:    filterOwnedRecords(im.ownerID, changes.Delete),
+		UpdateNew: filterRecordsOwnedBy(ownerIDs, changes.UpdateNew),
+		UpdateOld: filterRecordsOwnedBy(ownerIDs, changes.UpdateOld),
+		Delete:    filterRecordsOwnedBy(ownerIDs, changes.Delete),
 	}
+	// the changes to the records themselves, without their TXT records
+	records := *filteredChanges
+	released := map[string]int{}
+
 	for _, r := range filteredChanges.Create {
 		r.Labels[endpoint.OwnerLabelKey] = im.ownerID
-		txt := endpoint.NewEndpoint(im.mapper.toTXTName(r.DNSName), endpoint.RecordTypeTXT, r.Labels.Serialize(true))
-		filteredChanges.Create = append(filteredChanges.Create, txt)
-
-		if im.cacheInterval > 0 {
-			im.addToCache(r)
+		for _, format := range im.formats {
+			filteredChanges.Create = append(filteredChanges.Create, im.newTXT(r, format))
 		}
 	}
 
 	for _, r := range filteredChanges.Delete {
-		txt := endpoint.NewEndpoint(im.mapper.toTXTName(r.DNSName), endpoint.RecordTypeTXT, r.Labels.Serialize(true))
-
 		// when we delete TXT records for which value has changed (due to new label) this would still work because
 		// !!! TXT record value is uniquely generated from the Labels of the endpoint. Hence old TXT record can be uniquely reconstructed
-		filteredChanges.Delete = append(filteredChanges.Delete, txt)
-
-		if im.cacheInterval > 0 {
-			im.removeFromCache(r)
+		for _, current := range im.readTXT(r) {
+			if im.release(released, r, current.format) {
+				filteredChanges.Delete = append(filteredChanges.Delete, im.oldTXT(r, current))
+			}
 		}
 	}
 
 	// make sure TXT records are consistently updated as well
 	for _, r := range filteredChanges.UpdateOld {
-		txt := endpoint.NewEndpoint(im.mapper.toTXTName(r.DNSName), endpoint.RecordTypeTXT, r.Labels.Serialize(true))
 		// when we updateOld TXT records for which value has changed (due to new label) this would still work because
 		// !!! TXT record value is uniquely generated from the Labels of the endpoint. Hence old TXT record can be uniquely reconstructed
-		filteredChanges.UpdateOld = append(filteredChanges.UpdateOld, txt)
-		// remove old version of record from cache
-		if im.cacheInterval > 0 {
-			im.removeFromCache(r)
-		}
+		im.addOldTXT(filteredChanges, r, released)
 	}
 
-	// make sure TXT records are consistently updated as well
+	// make sure TXT records are consistently updated as well, the records of the
+	// other owner ids being taken over by the current instance
 	for _, r := range filteredChanges.UpdateNew {
-		txt := endpoint.NewEndpoint(im.mapper.toTXTName(r.DNSName), endpoint.RecordTypeTXT, r.Labels.Serialize(true))
-		filteredChanges.UpdateNew = append(filteredChanges.UpdateNew, txt)
-		// add new version of record to cache
-		if im.cacheInterval > 0 {
-			im.addToCache(r)
+		r.Labels[endpoint.OwnerLabelKey] = im.ownerID
+		im.addNewTXT(filteredChanges, r)
+	}
+
+	return filteredChanges, &records
+}
+
+// RepairOwnership restores the TXT records of the unowned records desired by a single
+// resource, as long as they don't carry the resource label of another one. The TXT
+// records left without owner are updated, and the missing ones created unless a TXT
+// record outside of the registry, e.g. managed by the user, already holds their name.
+func (im *TXTRegistry) RepairOwnership(records, desired []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	resources := map[string]map[string]bool{}
+	for _, ep := range desired {
+		resource := ep.Labels[endpoint.ResourceLabelKey]
+		if resource == "" {
+			continue
+		}
+		key := ep.DNSName + "/" + ep.RecordType
+		if resources[key] == nil {
+			resources[key] = map[string]bool{}
+		}
+		resources[key][resource] = true
+	}
+	// the TXT records outside of the registry, without labels
+	unmanaged := map[string]bool{}
+	for _, r := range records {
+		if r.RecordType == endpoint.RecordTypeTXT && len(r.Labels) == 0 {
+			unmanaged[r.DNSName] = true
 		}
 	}
 
-	return im.provider.ApplyChanges(filteredChanges)
+	changes := &plan.Changes{}
+	var repaired []*endpoint.Endpoint
+	labels := map[*endpoint.Endpoint]endpoint.Labels{}
+	for _, r := range records {
+		if r.RecordType == endpoint.RecordTypeTXT || r.Labels[endpoint.OwnerLabelKey] != "" {
+			continue
+		}
+		resource, ok := repairedResource(resources[r.DNSName+"/"+r.RecordType], r.Labels[endpoint.ResourceLabelKey])
+		if !ok {
+			continue
+		}
+		repairedLabels := endpoint.NewLabels()
+		for k, v := range r.Labels {
+			repairedLabels[k] = v
+		}
+		repairedLabels[endpoint.OwnerLabelKey] = im.ownerID
+		repairedLabels[endpoint.ResourceLabelKey] = resource
+		repairedRecord := *r
+		repairedRecord.Labels = repairedLabels
+
+		if len(r.Labels) == 0 {
+			txtName := ""
+			for _, format := range im.formats {
+				if name := im.txtName(r, format); unmanaged[name] {
+					txtName = name
+				}
+			}
+			if txtName != "" {
+				log.Warnf("Not repairing the ownership of %s, the TXT record %s isn't a registry record", r.DNSName, txtName)
+				continue
+			}
+			for _, format := range im.formats {
+				changes.Create = append(changes.Create, im.newTXT(&repairedRecord, format))
+			}
+		} else {
+			// the TXT records are reconstructed from the labels they were read into
+			im.addOldTXT(changes, r, map[string]int{})
+			im.addNewTXT(changes, &repairedRecord)
+		}
+		labels[r] = repairedLabels
+		repaired = append(repaired, r)
+	}
+	if len(repaired) == 0 {
+		return nil, nil
+	}
+
+	if err := im.provider.ApplyChanges(changes); err != nil {
+		im.invalidateCache()
+		return nil, err
+	}
+	for _, r := range repaired {
+		log.Infof("Repaired the ownership of %s for %s", r.DNSName, labels[r][endpoint.ResourceLabelKey])
+		r.Labels = labels[r]
+		im.current[recordKey(r)] = im.written()
+	}
+	return repaired, nil
+}
+
+// repairedResource returns the resource taking over a record, the single resource
+// desiring it, or the resource of its label if it's one of them.
+func repairedResource(resources map[string]bool, label string) (string, bool) {
+	if label != "" {
+		return label, resources[label]
+	}
+	if len(resources) != 1 {
+		return "", false
+	}
+	for resource := range resources {
+		return resource, true
+	}
+	return "", false
 }
 
 /**
   TXT registry specific private methods
 */
 
+// txtValue returns the value of the TXT record of the labels, encrypted if the
+// registry has an encryption key.
+func (im *TXTRegistry) txtValue(labels endpoint.Labels) string {
+	if im.encryption != nil {
+		labels = im.encryption.encrypt(labels)
+	}
+	return labels.Serialize(true)
+}
+
+// txtName returns the name of the TXT record of the record in the given format.
+func (im *TXTRegistry) txtName(r *endpoint.Endpoint, format string) string {
+	if format == TXTFormatV2 {
+		return im.mapper.toTypedTXTName(r.DNSName, r.RecordType)
+	}
+	return im.mapper.toTXTName(r.DNSName)
+}
+
+// newTXT returns the TXT record of the record written in the given format.
+func (im *TXTRegistry) newTXT(r *endpoint.Endpoint, format string) *endpoint.Endpoint {
+	return endpoint.NewEndpoint(im.txtName(r, format), endpoint.RecordTypeTXT, im.txtValue(r.Labels))
+}
+
+// oldTXT returns the current TXT record of the record, in plain text if it was read
+// so, as its value has to match to be updated or deleted.
+func (im *TXTRegistry) oldTXT(r *endpoint.Endpoint, current currentTXT) *endpoint.Endpoint {
+	value := r.Labels.Serialize(true)
+	if current.encrypted {
+		value = im.txtValue(r.Labels)
+	}
+	return endpoint.NewEndpoint(im.txtName(r, current.format), endpoint.RecordTypeTXT, value)
+}
+
+// readTXT returns the TXT records the record was read with, the TXT records written
+// if it wasn't read.
+func (im *TXTRegistry) readTXT(r *endpoint.Endpoint) []currentTXT {
+	if current, ok := im.current[recordKey(r)]; ok {
+		return current
+	}
+	return im.written()
+}
+
+// written returns the TXT records written for a record.
+func (im *TXTRegistry) written() []currentTXT {
+	written := make([]currentTXT, 0, len(im.formats))
+	for _, format := range im.formats {
+		written = append(written, currentTXT{format: format, encrypted: im.encryption != nil})
+	}
+	return written
+}
+
+// addOldTXT adds the changes of the TXT records of a record updated from r, the ones
+// of the formats no longer written being deleted once released.
+func (im *TXTRegistry) addOldTXT(changes *plan.Changes, r *endpoint.Endpoint, released map[string]int) {
+	for _, current := range im.readTXT(r) {
+		txt := im.oldTXT(r, current)
+		if im.writes(current.format) {
+			changes.UpdateOld = append(changes.UpdateOld, txt)
+		} else if im.release(released, r, current.format) {
+			changes.Delete = append(changes.Delete, txt)
+		}
+	}
+}
+
+// release returns true if the TXT record of the record in the given format can be
+// deleted as the record no longer needs it. The TXT record of the v1 format is shared
+// by the records of any type of its name, it's only deleted once none of the records
+// only read with it need it anymore, counted in released along the changes.
+func (im *TXTRegistry) release(released map[string]int, r *endpoint.Endpoint, format string) bool {
+	if format != TXTFormatV1 {
+		return true
+	}
+	if v1Only(im.readTXT(r)) {
+		released[r.DNSName]++
+	}
+	return released[r.DNSName] >= im.v1Readers[r.DNSName]
+}
+
+// v1Only returns true if the TXT records of a record are only of the v1 format.
+func v1Only(current []currentTXT) bool {
+	for _, c := range current {
+		if c.format != TXTFormatV1 {
+			return false
+		}
+	}
+	return len(current) > 0
+}
+
+// addNewTXT adds the changes of the TXT records of a record updated to r, the ones of
+// the formats it wasn't read with being created.
+func (im *TXTRegistry) addNewTXT(changes *plan.Changes, r *endpoint.Endpoint) {
+	read := map[string]bool{}
+	for _, current := range im.readTXT(r) {
+		read[current.format] = true
+	}
+	for _, format := range im.formats {
+		txt := im.newTXT(r, format)
+		if read[format] {
+			changes.UpdateNew = append(changes.UpdateNew, txt)
+		} else {
+			changes.Create = append(changes.Create, txt)
+		}
+	}
+}
+
+// writes returns true if the TXT records of the given format are written.
+func (im *TXTRegistry) writes(format string) bool {
+	for _, f := range im.formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// recordKey returns the key of the record in the current TXT records.
+func recordKey(r *endpoint.Endpoint) string {
+	return r.DNSName + "/" + r.RecordType
+}
+
+// txtKey returns the key of the labels of a TXT record of the given format, the
+// name of its record for v1 and along with its type for v2.
+func txtKey(format, name, recordType string) string {
+	if format == TXTFormatV2 {
+		return name + "/" + recordType
+	}
+	return name
+}
+
 /**
   nameMapper defines interface which maps the dns name defined for the source
   to the dns name which TXT record will be created with
@@ -186,6 +572,8 @@ func (im *TXTRegistry) ApplyChanges(changes *plan.Changes) error {
 type nameMapper interface {
 	toEndpointName(string) string
 	toTXTName(string) string
+	toTypedEndpointName(string) (string, string)
+	toTypedTXTName(string, string) string
 }
 
 type prefixNameMapper struct {
@@ -194,8 +582,10 @@ type prefixNameMapper struct {
 
 var _ nameMapper = prefixNameMapper{}
 
+// newPrefixNameMapper lower cases the prefix, as the names of the records
+// are normalized
 func newPrefixNameMapper(prefix string) prefixNameMapper {
-	return prefixNameMapper{prefix: prefix}
+	return prefixNameMapper{prefix: strings.ToLower(prefix)}
 }
 
 func (pr prefixNameMapper) toEndpointName(txtDNSName string) string {
@@ -209,6 +599,116 @@ func (pr prefixNameMapper) toTXTName(endpointDNSName string) string {
 	return pr.prefix + endpointDNSName
 }
 
+// toTypedEndpointName returns the name and type of the record of a TXT record of
+// the v2 format, empty if it isn't one.
+func (pr prefixNameMapper) toTypedEndpointName(txtDNSName string) (string, string) {
+	if !strings.HasPrefix(txtDNSName, pr.prefix) {
+		return "", ""
+	}
+	labels := strings.SplitN(strings.TrimPrefix(txtDNSName, pr.prefix), ".", 2)
+	i := strings.Index(labels[0], "-")
+	if i < 0 {
+		return "", ""
+	}
+	recordType, first := strings.ToUpper(labels[0][:i]), labels[0][i+1:]
+	if !typedRecordTypes[recordType] || first == "" {
+		return "", ""
+	}
+	if first == txtWildcardLabel {
+		first = "*"
+	}
+	if len(labels) == 1 {
+		return first, recordType
+	}
+	return first + "." + labels[1], recordType
+}
+
+// toTypedTXTName returns the name of the TXT record of the v2 format, the lower cased
+// record type prefixing the first label of the name of the record, e.g. a-foo.example.org.
+func (pr prefixNameMapper) toTypedTXTName(endpointDNSName, recordType string) string {
+	labels := strings.SplitN(endpointDNSName, ".", 2)
+	first := labels[0]
+	if first == "*" {
+		first = txtWildcardLabel
+	}
+	name := pr.prefix + strings.ToLower(recordType) + "-" + first
+	if len(labels) == 1 {
+		return name
+	}
+	return name + "." + labels[1]
+}
+
+// updateCache brings the cache in line with the applied changes.
+func (im *TXTRegistry) updateCache(changes *plan.Changes) {
+	// the records changed have the TXT records written, the records deleted or no longer
+	// written in the v1 format releasing their TXT record of the v1 format
+	for _, r := range changes.Delete {
+		im.releaseV1(r)
+		delete(im.current, recordKey(r))
+	}
+	if !im.writes(TXTFormatV1) {
+		for _, r := range changes.UpdateNew {
+			im.releaseV1(r)
+		}
+	}
+	for _, records := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateNew} {
+		for _, r := range records {
+			im.current[recordKey(r)] = im.written()
+		}
+	}
+	for _, r := range changes.Delete {
+		im.removeFromCache(r)
+	}
+	// remove old version of record from cache
+	for _, r := range changes.UpdateOld {
+		im.removeFromCache(r)
+	}
+	for _, r := range changes.Create {
+		im.addToCache(r)
+	}
+	// add new version of record to cache
+	for _, r := range changes.UpdateNew {
+		im.addToCache(r)
+	}
+}
+
+// appliedRecords returns the changes to the records, without their TXT records, found in applied.
+func appliedRecords(records, applied *plan.Changes) *plan.Changes {
+	filter := func(endpoints, applied []*endpoint.Endpoint) []*endpoint.Endpoint {
+		found := make(map[*endpoint.Endpoint]bool, len(applied))
+		for _, ep := range applied {
+			found[ep] = true
+		}
+		var result []*endpoint.Endpoint
+		for _, ep := range endpoints {
+			if found[ep] {
+				result = append(result, ep)
+			}
+		}
+		return result
+	}
+
+	return &plan.Changes{
+		Create:    filter(records.Create, applied.Create),
+		UpdateNew: filter(records.UpdateNew, applied.UpdateNew),
+		UpdateOld: filter(records.UpdateOld, applied.UpdateOld),
+		Delete:    filter(records.Delete, applied.Delete),
+	}
+}
+
+// releaseV1 no longer counts the record among the readers of its TXT record of the v1 format.
+func (im *TXTRegistry) releaseV1(r *endpoint.Endpoint) {
+	if v1Only(im.current[recordKey(r)]) && im.v1Readers[r.DNSName] > 0 {
+		im.v1Readers[r.DNSName]--
+	}
+}
+
+// invalidateCache drops the cache so that the next call to Records queries the provider.
+func (im *TXTRegistry) invalidateCache() {
+	im.recordsCache = nil
+	im.recordsCacheRefreshTime = time.Time{}
+}
+
 func (im *TXTRegistry) addToCache(ep *endpoint.Endpoint) {
 	if im.recordsCache != nil {
 		im.recordsCache = append(im.recordsCache, ep)
@@ -0,0 +1,78 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package registry
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// encryptedLabelKey is the label of the TXT records holding their other labels encrypted.
+const encryptedLabelKey = "encrypted"
+
+// labelCipher encrypts the labels of the TXT records with AES-GCM, so that they don't
+// disclose the resources publishing the records. The nonce is derived from the labels,
+// so that the TXT record of some labels is always the same, and can be reconstructed
+// from them to be updated or deleted like the plain text ones.
+type labelCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// newLabelCipher returns the cipher of the given key, which can be of any length.
+func newLabelCipher(key []byte) (*labelCipher, error) {
+	if len(key) == 0 {
+		return nil, errors.New("encryption key cannot be empty")
+	}
+	block, err := aes.NewCipher(deriveKey(key, "encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &labelCipher{aead: aead, nonceKey: deriveKey(key, "nonce")}, nil
+}
+
+// deriveKey derives a 256-bit key for the given purpose from the key.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("external-ips/txt-" + purpose))
+	return mac.Sum(nil)
+}
+
+// encrypt returns the labels holding the given labels encrypted.
+func (c *labelCipher) encrypt(labels endpoint.Labels) endpoint.Labels {
+	plaintext := []byte(labels.Serialize(false))
+	mac := hmac.New(sha256.New, c.nonceKey)
+	mac.Write(plaintext)
+	nonce := make([]byte, c.aead.NonceSize())
+	copy(nonce, mac.Sum(nil))
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return endpoint.Labels{encryptedLabelKey: base64.RawURLEncoding.EncodeToString(sealed)}
+}
+
+// decrypt returns the labels held by the labels returned by encrypt.
+func (c *labelCipher) decrypt(labels endpoint.Labels) (endpoint.Labels, error) {
+	sealed, err := base64.RawURLEncoding.DecodeString(labels[encryptedLabelKey])
+	if err != nil {
+		return nil, err
+	}
+	size := c.aead.NonceSize()
+	if len(sealed) < size {
+		return nil, errors.New("encrypted labels are truncated")
+	}
+	plaintext, err := c.aead.Open(nil, sealed[:size], sealed[size:], nil)
+	if err != nil {
+		return nil, err
+	}
+	return endpoint.NewLabelsFromString(string(plaintext))
+}
@@ -20,6 +20,7 @@ limitations under the License.
 package registry
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -45,10 +46,10 @@ func TestTXTRegistry(t *testing.T) {
 
 func testTXTRegistryNew(t *testing.T) {
 	p := provider.NewInMemoryProvider()
-	_, err := NewTXTRegistry(p, "txt", "", time.Hour)
+	_, err := NewTXTRegistry(p, "txt", "", nil, time.Hour, nil, "")
 	require.Error(t, err)
 
-	r, err := NewTXTRegistry(p, "txt", "owner", time.Hour)
+	r, err := NewTXTRegistry(p, "txt", "owner", nil, time.Hour, nil, "")
 	require.NoError(t, err)
 
 	_, ok := r.mapper.(prefixNameMapper)
@@ -56,7 +57,7 @@ func testTXTRegistryNew(t *testing.T) {
 	assert.Equal(t, "owner", r.ownerID)
 	assert.Equal(t, p, r.provider)
 
-	r, err = NewTXTRegistry(p, "", "owner", time.Hour)
+	r, err = NewTXTRegistry(p, "", "owner", nil, time.Hour, nil, "")
 	require.NoError(t, err)
 
 	_, ok = r.mapper.(prefixNameMapper)
@@ -135,7 +136,7 @@ func testTXTRegistryRecordsPrefixed(t *testing.T) {
 		},
 	}
 
-	r, _ := NewTXTRegistry(p, "txt.", "owner", time.Hour)
+	r, _ := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
 	records, _ := r.Records()
 
 	assert.True(t, testutils.SameEndpoints(records, expectedRecords))
@@ -209,7 +210,7 @@ func testTXTRegistryRecordsNoPrefix(t *testing.T) {
 		},
 	}
 
-	r, _ := NewTXTRegistry(p, "", "owner", time.Hour)
+	r, _ := NewTXTRegistry(p, "", "owner", nil, time.Hour, nil, "")
 	records, _ := r.Records()
 
 	assert.True(t, testutils.SameEndpoints(records, expectedRecords))
@@ -236,7 +237,7 @@ func testTXTRegistryApplyChangesWithPrefix(t *testing.T) {
 			newEndpointWithOwner("txt.foobar.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
 		},
 	})
-	r, _ := NewTXTRegistry(p, "txt.", "owner", time.Hour)
+	r, _ := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
 
 	changes := &plan.Changes{
 		Create: []*endpoint.Endpoint{
@@ -305,7 +306,7 @@ func testTXTRegistryApplyChangesNoPrefix(t *testing.T) {
 			newEndpointWithOwner("foobar.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
 		},
 	})
-	r, _ := NewTXTRegistry(p, "", "owner", time.Hour)
+	r, _ := NewTXTRegistry(p, "", "owner", nil, time.Hour, nil, "")
 
 	changes := &plan.Changes{
 		Create: []*endpoint.Endpoint{
@@ -413,12 +414,547 @@ func TestCacheMethods(t *testing.T) {
 	}
 }
 
+// countingProvider counts the calls to Records and fails to apply the changes when err is set.
+type countingProvider struct {
+	records []*endpoint.Endpoint
+	calls   int
+	err     error
+}
+
+func (p *countingProvider) Records() ([]*endpoint.Endpoint, error) {
+	p.calls++
+	return p.records, nil
+}
+
+func (p *countingProvider) ApplyChanges(changes *plan.Changes) error {
+	return p.err
+}
+
+func TestApplyChangesCache(t *testing.T) {
+	p := &countingProvider{
+		records: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+		},
+	}
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
+	require.NoError(t, err)
+
+	_, err = r.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.calls)
+
+	// a successful apply updates the cache
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("new.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, ""),
+		},
+	}))
+	records, err := r.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.calls)
+	assert.Len(t, records, 2)
+
+	// a failed apply drops the cache rather than recording changes which didn't happen
+	p.err = errors.New("apply failed")
+	require.Error(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("failed.test-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, ""),
+		},
+	}))
+	assert.Nil(t, r.recordsCache)
+
+	records, err = r.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.calls)
+	assert.Len(t, records, 1)
+}
+
+// partialProvider applies the changes of the given names only, failing the others with err if set.
+type partialProvider struct {
+	countingProvider
+	names map[string]bool
+}
+
+func (p *partialProvider) ApplyChanges(changes *plan.Changes) error {
+	applied := &plan.Changes{}
+	for _, ep := range changes.Create {
+		if p.names[ep.DNSName] {
+			applied.Create = append(applied.Create, ep)
+		}
+	}
+	err := p.err
+	if err == nil {
+		err = errors.New("apply failed")
+	}
+	return &plan.PartialError{
+		Applied: applied,
+		Failed:  []plan.ZoneError{{Zone: "failed-zone.example.org.", Err: err}},
+	}
+}
+
+func TestApplyChangesPartialCache(t *testing.T) {
+	p := &partialProvider{
+		names: map[string]bool{
+			"new.test-zone.example.org":     true,
+			"txt.new.test-zone.example.org": true,
+		},
+	}
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
+	require.NoError(t, err)
+
+	_, err = r.Records()
+	require.NoError(t, err)
+
+	created := newEndpointWithOwner("new.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, "")
+	err = r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			created,
+			newEndpointWithOwner("failed.failed-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, ""),
+		},
+	})
+	require.Error(t, err)
+
+	// the applied records are reported without their TXT records
+	perr, ok := err.(*plan.PartialError)
+	require.True(t, ok)
+	assert.Equal(t, []*endpoint.Endpoint{created}, perr.Applied.Create)
+
+	// only the applied record is cached, the failed one is retried on the next run
+	records, err := r.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.calls)
+	assert.Equal(t, []*endpoint.Endpoint{created}, records)
+}
+
+func TestApplyChangesStaleCache(t *testing.T) {
+	p := &partialProvider{
+		countingProvider: countingProvider{err: provider.ErrRecordNotFound},
+		names: map[string]bool{
+			"new.test-zone.example.org":     true,
+			"txt.new.test-zone.example.org": true,
+		},
+	}
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
+	require.NoError(t, err)
+
+	_, err = r.Records()
+	require.NoError(t, err)
+
+	err = r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("new.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, ""),
+		},
+		Delete: []*endpoint.Endpoint{
+			newEndpointWithOwner("gone.failed-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, "owner"),
+		},
+	})
+	require.Error(t, err)
+	assert.True(t, provider.IsStale(err))
+
+	// the changes were planned from stale records: they're read again
+	assert.Nil(t, r.recordsCache)
+	_, err = r.Records()
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.calls)
+}
+
+func TestUnmanagedTXTRecords(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "foo.loadbalancer.com", endpoint.RecordTypeCNAME, ""),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+			// user managed TXT records, one of them sharing its name with an owned record
+			newEndpointWithOwner("foo.test-zone.example.org", "\"v=spf1 include:example.org ~all\"", endpoint.RecordTypeTXT, ""),
+			newEndpointWithOwner("bar.test-zone.example.org", "\"google-site-verification=abc\"", endpoint.RecordTypeTXT, ""),
+		},
+	})
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
+	require.NoError(t, err)
+
+	records, err := r.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		newEndpointWithOwner("foo.test-zone.example.org", "\"v=spf1 include:example.org ~all\"", endpoint.RecordTypeTXT, ""),
+		newEndpointWithOwner("bar.test-zone.example.org", "\"google-site-verification=abc\"", endpoint.RecordTypeTXT, ""),
+		newEndpointWithOwner("foo.test-zone.example.org", "foo.loadbalancer.com", endpoint.RecordTypeCNAME, "owner"),
+	}))
+
+	// nothing is desired anymore: the owned record goes away, the user TXT records stay
+	p.OnApplyChanges = func(got *plan.Changes) {
+		assert.True(t, testutils.SameEndpoints(got.Delete, []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "foo.loadbalancer.com", endpoint.RecordTypeCNAME, "owner"),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		}))
+	}
+	changes := (&plan.Plan{
+		Current:  records,
+		Policies: []plan.Policy{&plan.SyncPolicy{}},
+	}).Calculate().Changes
+	require.NoError(t, r.ApplyChanges(changes))
+
+	p.OnApplyChanges = func(*plan.Changes) {}
+	records, err = p.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.test-zone.example.org", endpoint.RecordTypeTXT, "\"v=spf1 include:example.org ~all\""),
+		endpoint.NewEndpoint("bar.test-zone.example.org", endpoint.RecordTypeTXT, "\"google-site-verification=abc\""),
+	}))
+}
+
+func TestTXTRegistryRepairOwnership(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			// lost its TXT record
+			newEndpointWithOwner("deleted.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+			// its TXT record lost the owner
+			newEndpointWithOwner("edited.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.edited.test-zone.example.org", "\"heritage=external-ips,external-ips/resource=service/default/edited\"", endpoint.RecordTypeTXT, ""),
+			// owned by another resource
+			newEndpointWithOwner("stolen.test-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.stolen.test-zone.example.org", "\"heritage=external-ips,external-ips/resource=service/default/other\"", endpoint.RecordTypeTXT, ""),
+			// owned by another instance
+			newEndpointWithOwner("other.test-zone.example.org", "1.2.3.7", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.other.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=other-owner\"", endpoint.RecordTypeTXT, ""),
+			// its TXT name is taken by a user managed TXT record
+			newEndpointWithOwner("user.test-zone.example.org", "1.2.3.8", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.user.test-zone.example.org", "\"v=spf1 include:example.org ~all\"", endpoint.RecordTypeTXT, ""),
+			// not desired
+			newEndpointWithOwner("undesired.test-zone.example.org", "1.2.3.9", endpoint.RecordTypeA, ""),
+		},
+	})
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, nil, "")
+	require.NoError(t, err)
+
+	desired := []*endpoint.Endpoint{
+		newEndpointWithOwnerResource("deleted.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, "", "service/default/deleted"),
+		newEndpointWithOwnerResource("edited.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, "", "service/default/edited"),
+		newEndpointWithOwnerResource("stolen.test-zone.example.org", "1.2.3.6", endpoint.RecordTypeA, "", "service/default/stolen"),
+		newEndpointWithOwnerResource("other.test-zone.example.org", "1.2.3.7", endpoint.RecordTypeA, "", "service/default/other"),
+		newEndpointWithOwnerResource("user.test-zone.example.org", "1.2.3.8", endpoint.RecordTypeA, "", "service/default/user"),
+	}
+	p.OnApplyChanges = func(got *plan.Changes) {
+		assert.True(t, testutils.SamePlanChanges(map[string][]*endpoint.Endpoint{
+			"Create":    got.Create,
+			"UpdateNew": got.UpdateNew,
+			"UpdateOld": got.UpdateOld,
+			"Delete":    got.Delete,
+		}, map[string][]*endpoint.Endpoint{
+			"Create": {
+				newEndpointWithOwner("txt.deleted.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner,external-ips/resource=service/default/deleted\"", endpoint.RecordTypeTXT, ""),
+			},
+			"UpdateNew": {
+				newEndpointWithOwner("txt.edited.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner,external-ips/resource=service/default/edited\"", endpoint.RecordTypeTXT, ""),
+			},
+			"UpdateOld": {
+				newEndpointWithOwner("txt.edited.test-zone.example.org", "\"heritage=external-ips,external-ips/resource=service/default/edited\"", endpoint.RecordTypeTXT, ""),
+			},
+			"Delete": {},
+		}))
+	}
+
+	records, err := r.Records()
+	require.NoError(t, err)
+	repaired, err := r.RepairOwnership(records, desired)
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(repaired, []*endpoint.Endpoint{
+		newEndpointWithOwnerResource("deleted.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, "owner", "service/default/deleted"),
+		newEndpointWithOwnerResource("edited.test-zone.example.org", "1.2.3.5", endpoint.RecordTypeA, "owner", "service/default/edited"),
+	}))
+
+	// the records are owned from then on, the plan manages them again
+	p.OnApplyChanges = func(*plan.Changes) {}
+	records, err = r.Records()
+	require.NoError(t, err)
+	owners := map[string]string{}
+	for _, ep := range records {
+		if ep.RecordType == endpoint.RecordTypeA {
+			owners[ep.DNSName] = ep.Labels[endpoint.OwnerLabelKey]
+		}
+	}
+	assert.Equal(t, map[string]string{
+		"deleted.test-zone.example.org":   "owner",
+		"edited.test-zone.example.org":    "owner",
+		"stolen.test-zone.example.org":    "",
+		"other.test-zone.example.org":     "other-owner",
+		"user.test-zone.example.org":      "",
+		"undesired.test-zone.example.org": "",
+	}, owners)
+
+	repaired, err = r.RepairOwnership(records, desired)
+	require.NoError(t, err)
+	assert.Empty(t, repaired)
+}
+
 /**
 
 helper methods
 
 */
 
+func TestTXTRegistryPreview(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	p.OnApplyChanges = func(got *plan.Changes) {
+		t.Error("the changes must not be applied")
+	}
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, time.Hour, nil, "")
+	require.NoError(t, err)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("new-record-1.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, ""),
+		},
+		Delete: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "4.3.2.1", endpoint.RecordTypeA, "owner"),
+			newEndpointWithOwner("bar.test-zone.example.org", "4.3.2.2", endpoint.RecordTypeA, ""),
+		},
+	}
+	expected := map[string][]*endpoint.Endpoint{
+		"Create": {
+			newEndpointWithOwner("new-record-1.test-zone.example.org", "1.2.3.4", endpoint.RecordTypeA, "owner"),
+			newEndpointWithOwner("txt.new-record-1.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		},
+		"UpdateNew": {},
+		"UpdateOld": {},
+		"Delete": {
+			newEndpointWithOwner("foo.test-zone.example.org", "4.3.2.1", endpoint.RecordTypeA, "owner"),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		},
+	}
+
+	got := r.Preview(changes)
+	assert.True(t, testutils.SamePlanChanges(map[string][]*endpoint.Endpoint{
+		"Create":    got.Create,
+		"UpdateNew": got.UpdateNew,
+		"UpdateOld": got.UpdateOld,
+		"Delete":    got.Delete,
+	}, expected))
+}
+
+func TestTXTRegistryReadOwnerIDs(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	r, err := NewTXTRegistry(p, "txt.", "owner", []string{"", "owner", "former-owner"}, 0, nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"former-owner"}, r.readOwnerIDs)
+
+	changes := &plan.Changes{
+		Delete: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "4.3.2.1", endpoint.RecordTypeA, "former-owner"),
+			newEndpointWithOwner("bar.test-zone.example.org", "4.3.2.2", endpoint.RecordTypeA, "other-owner"),
+		},
+		UpdateNew: []*endpoint.Endpoint{
+			newEndpointWithOwner("baz.test-zone.example.org", "1.1.1.2", endpoint.RecordTypeA, "former-owner"),
+		},
+		UpdateOld: []*endpoint.Endpoint{
+			newEndpointWithOwner("baz.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, "former-owner"),
+		},
+	}
+	// the records of the former owner are managed and taken over, the ones of the others are left alone
+	expected := map[string][]*endpoint.Endpoint{
+		"Create": {},
+		"UpdateNew": {
+			newEndpointWithOwner("baz.test-zone.example.org", "1.1.1.2", endpoint.RecordTypeA, "owner"),
+			newEndpointWithOwner("txt.baz.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		},
+		"UpdateOld": {
+			newEndpointWithOwner("baz.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, "former-owner"),
+			newEndpointWithOwner("txt.baz.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=former-owner\"", endpoint.RecordTypeTXT, ""),
+		},
+		"Delete": {
+			newEndpointWithOwner("foo.test-zone.example.org", "4.3.2.1", endpoint.RecordTypeA, "former-owner"),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=former-owner\"", endpoint.RecordTypeTXT, ""),
+		},
+	}
+
+	got := r.Preview(changes)
+	assert.True(t, testutils.SamePlanChanges(map[string][]*endpoint.Endpoint{
+		"Create":    got.Create,
+		"UpdateNew": got.UpdateNew,
+		"UpdateOld": got.UpdateOld,
+		"Delete":    got.Delete,
+	}, expected))
+}
+
+func TestTXTRegistryEncryption(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	// written before the encryption was enabled
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner,external-ips/resource=service/default/foo\"", endpoint.RecordTypeTXT, ""),
+		},
+	}))
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, []byte("secret"), "")
+	require.NoError(t, err)
+	txtValue := func(name string) string {
+		records, err := p.Records()
+		require.NoError(t, err)
+		for _, record := range records {
+			if record.DNSName == "txt."+name && record.RecordType == endpoint.RecordTypeTXT {
+				return record.Targets[0]
+			}
+		}
+		return ""
+	}
+
+	// the plain text records are still read
+	records, err := r.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		newEndpointWithOwnerResource("foo.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, "owner", "service/default/foo"),
+	}))
+
+	// and encrypted as they're updated, the new ones being encrypted
+	bar := newEndpointWithOwnerResource("bar.test-zone.example.org", "2.2.2.2", endpoint.RecordTypeA, "", "service/default/bar")
+	foo := newEndpointWithOwnerResource("foo.test-zone.example.org", "1.1.1.2", endpoint.RecordTypeA, "owner", "service/default/foo")
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Create:    []*endpoint.Endpoint{bar},
+		UpdateOld: records,
+		UpdateNew: []*endpoint.Endpoint{foo},
+	}))
+	for _, name := range []string{"foo.test-zone.example.org", "bar.test-zone.example.org"} {
+		value := txtValue(name)
+		assert.Contains(t, value, "heritage=external-ips,external-ips/encrypted=")
+		assert.NotContains(t, value, "service/default")
+	}
+	// the TXT record of the same labels is always the same
+	assert.Equal(t, r.txtValue(foo.Labels), txtValue("foo.test-zone.example.org"))
+
+	records, err = r.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		newEndpointWithOwnerResource("foo.test-zone.example.org", "1.1.1.2", endpoint.RecordTypeA, "owner", "service/default/foo"),
+		newEndpointWithOwnerResource("bar.test-zone.example.org", "2.2.2.2", endpoint.RecordTypeA, "owner", "service/default/bar"),
+	}))
+
+	// the encrypted records can't be told apart without the key, they're left alone
+	for _, key := range [][]byte{nil, []byte("other")} {
+		other, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, key, "")
+		require.NoError(t, err)
+		unowned, err := other.Records()
+		require.NoError(t, err)
+		for _, record := range unowned {
+			assert.Empty(t, record.Labels[endpoint.OwnerLabelKey], record.DNSName)
+		}
+	}
+
+	// the encrypted TXT records are deleted along with their records
+	require.NoError(t, r.ApplyChanges(&plan.Changes{Delete: records}))
+	records, err = p.Records()
+	require.NoError(t, err)
+	assert.Empty(t, records)
+}
+
+func TestPrefixNameMapperTyped(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, name, recordType, txtName string
+	}{
+		{"", "foo.example.org", endpoint.RecordTypeA, "a-foo.example.org"},
+		{"txt.", "foo.example.org", endpoint.RecordTypeCNAME, "txt.cname-foo.example.org"},
+		{"txt-", "foo-bar.example.org", "AAAA", "txt-aaaa-foo-bar.example.org"},
+		{"", "*.example.org", endpoint.RecordTypeA, "a-_wildcard.example.org"},
+		{"", "example", endpoint.RecordTypeA, "a-example"},
+	} {
+		mapper := newPrefixNameMapper(tc.prefix)
+		assert.Equal(t, tc.txtName, mapper.toTypedTXTName(tc.name, tc.recordType))
+		name, recordType := mapper.toTypedEndpointName(tc.txtName)
+		assert.Equal(t, tc.name, name)
+		assert.Equal(t, tc.recordType, recordType)
+	}
+
+	// the names of another prefix or without a known record type aren't of the v2 format
+	mapper := newPrefixNameMapper("txt.")
+	for _, txtName := range []string{"a-foo.example.org", "txt.foo.example.org", "txt.foo-bar.example.org", "txt.a-.example.org"} {
+		name, _ := mapper.toTypedEndpointName(txtName)
+		assert.Empty(t, name, txtName)
+	}
+}
+
+func TestTXTRegistryFormatV2(t *testing.T) {
+	p := provider.NewInMemoryProvider()
+	p.CreateZone(testZone)
+	// the records of both types share their TXT record of the v1 format
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{
+			newEndpointWithOwner("foo.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, ""),
+			newEndpointWithOwner("foo.test-zone.example.org", "::1", "AAAA", ""),
+			newEndpointWithOwner("txt.foo.test-zone.example.org", "\"heritage=external-ips,external-ips/owner=owner\"", endpoint.RecordTypeTXT, ""),
+		},
+	}))
+	_, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, nil, "v3")
+	require.Error(t, err)
+	r, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, nil, TXTFormatV2)
+	require.NoError(t, err)
+	txtNames := func() []string {
+		records, err := p.Records()
+		require.NoError(t, err)
+		var names []string
+		for _, record := range records {
+			if record.RecordType == endpoint.RecordTypeTXT {
+				names = append(names, record.DNSName)
+			}
+		}
+		return names
+	}
+	update := func(recordType, target string) {
+		records, err := r.Records()
+		require.NoError(t, err)
+		for _, record := range records {
+			if record.RecordType == recordType {
+				require.NoError(t, r.ApplyChanges(&plan.Changes{
+					UpdateOld: []*endpoint.Endpoint{record},
+					UpdateNew: []*endpoint.Endpoint{newEndpointWithOwner(record.DNSName, target, recordType, "owner")},
+				}))
+				return
+			}
+		}
+		t.Fatalf("no %s record", recordType)
+	}
+
+	// the TXT records of the v1 format are still read
+	records, err := r.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		newEndpointWithOwner("foo.test-zone.example.org", "1.1.1.1", endpoint.RecordTypeA, "owner"),
+		newEndpointWithOwner("foo.test-zone.example.org", "::1", "AAAA", "owner"),
+	}))
+
+	// the updated records get their own TXT record, the shared one being kept for the other records
+	update(endpoint.RecordTypeA, "1.1.1.2")
+	assert.ElementsMatch(t, []string{"txt.foo.test-zone.example.org", "txt.a-foo.test-zone.example.org"}, txtNames())
+	// and deleted along with the last of them
+	update("AAAA", "::2")
+	assert.ElementsMatch(t, []string{"txt.a-foo.test-zone.example.org", "txt.aaaa-foo.test-zone.example.org"}, txtNames())
+
+	// the wildcards are named after a label of their own
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Create: []*endpoint.Endpoint{newEndpointWithOwner("*.test-zone.example.org", "1.1.1.3", endpoint.RecordTypeA, "")},
+	}))
+	assert.Contains(t, txtNames(), "txt.a-_wildcard.test-zone.example.org")
+
+	records, err = r.Records()
+	require.NoError(t, err)
+	assert.True(t, testutils.SameEndpoints(records, []*endpoint.Endpoint{
+		newEndpointWithOwner("foo.test-zone.example.org", "1.1.1.2", endpoint.RecordTypeA, "owner"),
+		newEndpointWithOwner("foo.test-zone.example.org", "::2", "AAAA", "owner"),
+		newEndpointWithOwner("*.test-zone.example.org", "1.1.1.3", endpoint.RecordTypeA, "owner"),
+	}))
+
+	// the records of both formats are deleted
+	both, err := NewTXTRegistry(p, "txt.", "owner", nil, 0, nil, TXTFormatBoth)
+	require.NoError(t, err)
+	records, err = both.Records()
+	require.NoError(t, err)
+	require.NoError(t, both.ApplyChanges(&plan.Changes{Delete: records}))
+	assert.Empty(t, txtNames())
+}
+
 func newEndpointWithOwner(dnsName, target, recordType, ownerID string) *endpoint.Endpoint {
 	e := endpoint.NewEndpoint(dnsName, recordType, target)
 	e.Labels[endpoint.OwnerLabelKey] = ownerID
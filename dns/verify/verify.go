@@ -0,0 +1,181 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package verify
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+var (
+	propagatedRecords = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "propagated_records_total",
+			Help:      "Number of applied records served as desired by their authoritative name servers within the propagation timeout.",
+		},
+	)
+	unpropagatedRecords = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "dns",
+			Name:      "unpropagated_records_total",
+			Help:      "Number of applied records not served as desired by their authoritative name servers within the propagation timeout.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(propagatedRecords)
+	prometheus.MustRegister(unpropagatedRecords)
+}
+
+// Resolver looks up the addresses of a host.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Verifier checks that the records applied to the provider end up served by
+// their authoritative name servers, catching the changes the provider accepted
+// but didn't publish.
+type Verifier struct {
+	// Returns the authoritative name servers of a host as host:port, AuthoritativeNameServers if nil
+	NameServers func(ctx context.Context, host string) ([]string, error)
+	// Returns a resolver querying the given name server, NewResolver if nil
+	NewResolver func(address string) Resolver
+	// How long the records may take to be served as desired
+	Timeout time.Duration
+	// The interval between two queries of the records not served as desired yet
+	PollInterval time.Duration
+
+	wg sync.WaitGroup
+}
+
+// FailureFunc is called with the records still not served as desired after the timeout.
+type FailureFunc func(ep *endpoint.Endpoint, err error)
+
+// NewResolver returns a resolver querying the given name server, host:port.
+func NewResolver(address string) Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// AuthoritativeNameServers returns the name servers of the closest zone
+// delegated on the way up from the host.
+func AuthoritativeNameServers(ctx context.Context, host string) ([]string, error) {
+	for name := host; strings.Contains(name, "."); name = name[strings.Index(name, ".")+1:] {
+		nss, err := net.DefaultResolver.LookupNS(ctx, name)
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+		addresses := make([]string, 0, len(nss))
+		for _, ns := range nss {
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(ns.Host, "."), "53"))
+		}
+		return addresses, nil
+	}
+	return nil, fmt.Errorf("no name server found for %s", host)
+}
+
+// Verify checks the A records among the given endpoints in the background.
+// onFailure may be nil.
+func (v *Verifier) Verify(endpoints []*endpoint.Endpoint, onFailure FailureFunc) {
+	var records []*endpoint.Endpoint
+	for _, ep := range endpoints {
+		if ep.RecordType == endpoint.RecordTypeA {
+			records = append(records, ep)
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		v.Run(records, onFailure)
+	}()
+}
+
+// Wait waits for the verifications in the background to complete.
+func (v *Verifier) Wait() {
+	v.wg.Wait()
+}
+
+// Run queries the records until all of them are served as desired or Timeout
+// expires, reporting the records left.
+func (v *Verifier) Run(records []*endpoint.Endpoint, onFailure FailureFunc) {
+	deadline := time.Now().Add(v.Timeout)
+	pending := records
+	errs := map[*endpoint.Endpoint]error{}
+	for {
+		var left []*endpoint.Endpoint
+		for _, ep := range pending {
+			if err := v.check(ep, deadline); err != nil {
+				errs[ep] = err
+				left = append(left, ep)
+				continue
+			}
+			propagatedRecords.Inc()
+		}
+		pending = left
+		if len(pending) == 0 || !time.Now().Add(v.PollInterval).Before(deadline) {
+			break
+		}
+		time.Sleep(v.PollInterval)
+	}
+
+	for _, ep := range pending {
+		unpropagatedRecords.Inc()
+		log.Warnf("Record %s isn't served as desired %s after being applied: %v", ep, v.Timeout, errs[ep])
+		if onFailure != nil {
+			onFailure(ep, errs[ep])
+		}
+	}
+}
+
+// check returns an error unless every authoritative name server of the record
+// serves its targets.
+func (v *Verifier) check(ep *endpoint.Endpoint, deadline time.Time) error {
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	nameServers := v.NameServers
+	if nameServers == nil {
+		nameServers = AuthoritativeNameServers
+	}
+	newResolver := v.NewResolver
+	if newResolver == nil {
+		newResolver = NewResolver
+	}
+
+	nss, err := nameServers(ctx, ep.DNSName)
+	if err != nil {
+		return err
+	}
+	for _, ns := range nss {
+		addrs, err := newResolver(ns).LookupHost(ctx, ep.DNSName)
+		if err != nil {
+			return fmt.Errorf("%s: %v", ns, err)
+		}
+		if !endpoint.Targets(addrs).Normalize().Same(ep.Targets.Normalize()) {
+			return fmt.Errorf("%s serves %s", ns, strings.Join(addrs, ";"))
+		}
+	}
+	return nil
+}
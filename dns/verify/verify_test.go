@@ -0,0 +1,102 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package verify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// fakeNameServers serves the addresses of the hosts by name server, each lookup
+// moving to the next answer until the last one.
+type fakeNameServers struct {
+	mu      sync.Mutex
+	answers map[string]map[string][][]string
+}
+
+func (f *fakeNameServers) nameServers(ctx context.Context, host string) ([]string, error) {
+	var nss []string
+	for ns := range f.answers {
+		nss = append(nss, ns)
+	}
+	return nss, nil
+}
+
+func (f *fakeNameServers) resolver(address string) Resolver {
+	return fakeResolver{f, address}
+}
+
+type fakeResolver struct {
+	servers *fakeNameServers
+	address string
+}
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.servers.mu.Lock()
+	defer r.servers.mu.Unlock()
+	answers := r.servers.answers[r.address][host]
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no such host")
+	}
+	if len(answers) > 1 {
+		r.servers.answers[r.address][host] = answers[1:]
+	}
+	return answers[0], nil
+}
+
+func TestVerifierRun(t *testing.T) {
+	servers := &fakeNameServers{answers: map[string]map[string][][]string{
+		"ns1:53": {
+			"foo.example.org": {{"1.1.1.1"}, {"1.1.1.1", "2.2.2.2"}},
+			"bar.example.org": {{"1.1.1.1"}},
+		},
+		"ns2:53": {
+			"foo.example.org": {{"2.2.2.2", "1.1.1.1"}},
+			"bar.example.org": {{"3.3.3.3"}},
+		},
+	}}
+
+	var failed []string
+	v := &Verifier{
+		NameServers:  servers.nameServers,
+		NewResolver:  servers.resolver,
+		Timeout:      50 * time.Millisecond,
+		PollInterval: 10 * time.Millisecond,
+	}
+
+	// foo is served by both name servers after a while, bar is never served as desired by ns2
+	v.Run([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.1.1.1", "2.2.2.2"),
+		endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "1.1.1.1"),
+	}, func(ep *endpoint.Endpoint, err error) {
+		failed = append(failed, ep.DNSName)
+	})
+	assert.Equal(t, []string{"bar.example.org"}, failed)
+}
+
+func TestVerifierNoNameServer(t *testing.T) {
+	var errs []error
+	v := &Verifier{
+		NameServers: func(ctx context.Context, host string) ([]string, error) {
+			return nil, fmt.Errorf("no name server found for %s", host)
+		},
+	}
+
+	// the records are verified in the background, only the A records
+	v.Verify([]*endpoint.Endpoint{
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.1.1.1"),
+		endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeTXT, "heritage=external-ips"),
+	}, func(ep *endpoint.Endpoint, err error) {
+		errs = append(errs, err)
+	})
+	v.Wait()
+	assert.Len(t, errs, 1)
+}
@@ -11,6 +11,10 @@ type ExtIP struct {
 	Namespace string
 	SvcName   string
 	ExtIPs    endpoint.Targets
+	// The external IPs are managed, as marked on the service once they were set
+	Managed bool
+	// The changes of the desired external IPs are computed and reported but not applied
+	DryRun bool
 }
 
 type BySvcName []*ExtIP
@@ -0,0 +1,45 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
+)
+
+// benchmarkExtIPs returns the current and desired external IPs of a sync where
+// the external IPs of one service in a hundred change.
+func benchmarkExtIPs(n int) (current, desired []*extip.ExtIP) {
+	current = make([]*extip.ExtIP, 0, n)
+	desired = make([]*extip.ExtIP, 0, n)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("svc-%d", i)
+		ips := endpoint.Targets{fmt.Sprintf("10.0.%d.%d", i/250%250, i%250), "10.1.0.1"}
+		current = append(current, &extip.ExtIP{Namespace: "default", SvcName: name, ExtIPs: ips, Managed: true})
+		if i%100 == 0 {
+			ips = endpoint.Targets{"10.2.0.1", "10.1.0.1"}
+		}
+		desired = append(desired, &extip.ExtIP{Namespace: "default", SvcName: name, ExtIPs: ips})
+	}
+	return current, desired
+}
+
+func benchmarkCalculate(b *testing.B, n int) {
+	current, desired := benchmarkExtIPs(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &Plan{
+			Current: current,
+			Desired: desired,
+		}
+		p.Calculate()
+	}
+}
+
+func BenchmarkCalculate10k(b *testing.B)  { benchmarkCalculate(b, 10000) }
+func BenchmarkCalculate100k(b *testing.B) { benchmarkCalculate(b, 100000) }
@@ -0,0 +1,39 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"github.com/openfresh/external-ips/extip/extip"
+)
+
+// Split separates the changes of the external IPs in dry-run, as told by dryRun,
+// from the changes to apply. An update is in dry-run when its current or its
+// desired external IPs are, so that its pair is never broken up.
+func (c *Changes) Split(dryRun func(*extip.ExtIP) bool) (apply, skipped *Changes) {
+	apply, skipped = &Changes{}, &Changes{}
+	for _, e := range c.Create {
+		if dryRun(e) {
+			skipped.Create = append(skipped.Create, e)
+		} else {
+			apply.Create = append(apply.Create, e)
+		}
+	}
+	for i := range c.UpdateNew {
+		if dryRun(c.UpdateOld[i]) || dryRun(c.UpdateNew[i]) {
+			skipped.UpdateOld = append(skipped.UpdateOld, c.UpdateOld[i])
+			skipped.UpdateNew = append(skipped.UpdateNew, c.UpdateNew[i])
+		} else {
+			apply.UpdateOld = append(apply.UpdateOld, c.UpdateOld[i])
+			apply.UpdateNew = append(apply.UpdateNew, c.UpdateNew[i])
+		}
+	}
+	for _, e := range c.Delete {
+		if dryRun(e) {
+			skipped.Delete = append(skipped.Delete, e)
+		} else {
+			apply.Delete = append(apply.Delete, e)
+		}
+	}
+	return apply, skipped
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
+)
+
+func TestChangesSplit(t *testing.T) {
+	applied := &extip.ExtIP{Namespace: "default", SvcName: "applied", ExtIPs: endpoint.Targets{"1.2.3.4"}}
+	dry := &extip.ExtIP{Namespace: "default", SvcName: "dry", ExtIPs: endpoint.Targets{"1.2.3.4"}, DryRun: true}
+	oldDry := &extip.ExtIP{Namespace: "default", SvcName: "dry-updated", ExtIPs: endpoint.Targets{"1.2.3.4"}, Managed: true}
+	newDry := &extip.ExtIP{Namespace: "default", SvcName: "dry-updated", ExtIPs: endpoint.Targets{"1.2.3.5"}, DryRun: true}
+
+	changes := &Changes{
+		Create:    []*extip.ExtIP{applied, dry},
+		UpdateOld: []*extip.ExtIP{oldDry},
+		UpdateNew: []*extip.ExtIP{newDry},
+	}
+	apply, skipped := changes.Split(func(e *extip.ExtIP) bool { return e.DryRun })
+
+	assert.Equal(t, &Changes{Create: []*extip.ExtIP{applied}}, apply)
+	assert.Equal(t, &Changes{
+		Create:    []*extip.ExtIP{dry},
+		UpdateOld: []*extip.ExtIP{oldDry},
+		UpdateNew: []*extip.ExtIP{newDry},
+	}, skipped)
+}
@@ -4,7 +4,6 @@
 package plan
 
 import (
-	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/extip/extip"
 )
 
@@ -20,18 +19,33 @@ type Plan struct {
 
 // Changes holds lists of actions to be executed by dns providers
 type Changes struct {
+	// ExternalIPs that need to be managed, replacing the ones set by others
+	Create []*extip.ExtIP
 	// ExternaIPs that need to be updated (current data)
 	UpdateOld []*extip.ExtIP
 	// ExternaIPs that need to be updated (desired data)
 	UpdateNew []*extip.ExtIP
+	// ExternalIPs that are no longer managed and need to be cleared
+	Delete []*extip.ExtIP
 }
 
 type planTable struct {
-	rows map[string]*planTableRow
+	rows map[serviceKey]*planTableRow
+	// the rows are allocated together rather than one by one
+	slab []planTableRow
 }
 
-func newPlanTable() planTable { //TODO: make resolver configurable
-	return planTable{map[string]*planTableRow{}}
+// serviceKey identifies a service without concatenating its namespace and name.
+type serviceKey struct {
+	namespace string
+	name      string
+}
+
+func newPlanTable(size int) *planTable { //TODO: make resolver configurable
+	return &planTable{
+		rows: make(map[serviceKey]*planTableRow, size),
+		slab: make([]planTableRow, 0, size),
+	}
 }
 
 // planTableRow
@@ -42,33 +56,42 @@ type planTableRow struct {
 	candidate *extip.ExtIP
 }
 
-func (t planTable) addCurrent(e *extip.ExtIP) {
-	if _, ok := t.rows[e.SvcName]; !ok {
-		t.rows[e.SvcName] = &planTableRow{}
+func (t *planTable) row(e *extip.ExtIP) *planTableRow {
+	key := serviceKey{e.Namespace, e.SvcName}
+	row, ok := t.rows[key]
+	if !ok {
+		t.slab = append(t.slab, planTableRow{})
+		row = &t.slab[len(t.slab)-1]
+		t.rows[key] = row
 	}
-	t.rows[e.SvcName].current = e
+	return row
+}
+
+func (t *planTable) addCurrent(e *extip.ExtIP) {
+	t.row(e).current = e
 }
 
-func (t planTable) addCandidate(e *extip.ExtIP) {
-	if _, ok := t.rows[e.SvcName]; !ok {
-		t.rows[e.SvcName] = &planTableRow{}
+func (t *planTable) addCandidate(e *extip.ExtIP) {
+	t.row(e).candidate = e
+}
+
+// getCreates returns the desired services whose external IPs aren't managed yet.
+func (t *planTable) getCreates() (createList []*extip.ExtIP) {
+	for _, row := range t.rows {
+		if row.current != nil && !row.current.Managed && row.candidate != nil {
+			createList = append(createList, row.candidate)
+		}
 	}
-	t.rows[e.SvcName].candidate = e
+	return
 }
 
 // TODO: allows record type change, which might not be supported by all dns providers
-func (t planTable) getUpdates() (updateNew []*extip.ExtIP, updateOld []*extip.ExtIP) {
+func (t *planTable) getUpdates() (updateNew []*extip.ExtIP, updateOld []*extip.ExtIP) {
 	for _, row := range t.rows {
 		// compare "update" to "current" to figure out if actual update is required
-		if row.current == nil {
+		if row.current == nil || !row.current.Managed || row.candidate == nil {
 			continue
 		}
-		if row.candidate == nil {
-			row.candidate = &extip.ExtIP{
-				SvcName: row.current.SvcName,
-				ExtIPs:  endpoint.Targets{},
-			}
-		}
 		if extipChanged(row.candidate, row.current) {
 			updateNew = append(updateNew, row.candidate)
 			updateOld = append(updateOld, row.current)
@@ -77,11 +100,22 @@ func (t planTable) getUpdates() (updateNew []*extip.ExtIP, updateOld []*extip.Ex
 	return
 }
 
+// getDeletes returns the services whose external IPs are managed but no longer
+// desired. The services whose external IPs were never managed are left untouched.
+func (t *planTable) getDeletes() (deleteList []*extip.ExtIP) {
+	for _, row := range t.rows {
+		if row.current != nil && row.current.Managed && row.candidate == nil {
+			deleteList = append(deleteList, row.current)
+		}
+	}
+	return
+}
+
 // Calculate computes the actions needed to move current state towards desired
 // state. It then passes those changes to the current policy for further
 // processing. It returns a copy of Plan with the changes populated.
 func (p *Plan) Calculate() *Plan {
-	t := newPlanTable()
+	t := newPlanTable(len(p.Current) + len(p.Desired))
 
 	for _, current := range p.Current {
 		t.addCurrent(current)
@@ -91,7 +125,9 @@ func (p *Plan) Calculate() *Plan {
 	}
 
 	changes := &Changes{}
+	changes.Create = t.getCreates()
 	changes.UpdateNew, changes.UpdateOld = t.getUpdates()
+	changes.Delete = t.getDeletes()
 
 	plan := &Plan{
 		Current: p.Current,
@@ -103,5 +139,5 @@ func (p *Plan) Calculate() *Plan {
 }
 
 func extipChanged(desired, current *extip.ExtIP) bool {
-	return !desired.ExtIPs.Same(current.ExtIPs)
+	return !desired.ExtIPs.SameNormalized(current.ExtIPs)
 }
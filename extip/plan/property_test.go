@@ -0,0 +1,159 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
+)
+
+// extIPs is a list of services with distinct names, drawn from a small pool so
+// that the current and desired services overlap, including services of the
+// same name in different namespaces. Some of them are managed.
+type extIPs []*extip.ExtIP
+
+func (extIPs) Generate(rand *rand.Rand, size int) reflect.Value {
+	var es extIPs
+	for _, namespace := range []string{"default", "kube-system"} {
+		for _, name := range []string{"foo", "bar", "baz"} {
+			if rand.Intn(3) == 0 {
+				continue
+			}
+			targets := endpoint.Targets{}
+			for i := rand.Intn(3); i > 0; i-- {
+				targets = append(targets, fmt.Sprintf("10.0.0.%d", rand.Intn(4)))
+			}
+			es = append(es, &extip.ExtIP{Namespace: namespace, SvcName: name, ExtIPs: targets, Managed: rand.Intn(2) == 0})
+		}
+	}
+	return reflect.ValueOf(es)
+}
+
+func calculate(current, desired extIPs) *Changes {
+	p := &Plan{
+		Current: current,
+		Desired: desired,
+	}
+	return p.Calculate().Changes
+}
+
+func key(e *extip.ExtIP) string {
+	return e.Namespace + "/" + e.SvcName
+}
+
+// apply returns the services after the changes were applied to current,
+// failing on changes which don't match current.
+func apply(current extIPs, changes *Changes) (map[string]*extip.ExtIP, error) {
+	state := map[string]*extip.ExtIP{}
+	for _, e := range current {
+		state[key(e)] = e
+	}
+	for _, e := range changes.Create {
+		if cur, ok := state[key(e)]; !ok || cur.Managed {
+			return nil, fmt.Errorf("creating %s which is missing or already managed", key(e))
+		}
+		state[key(e)] = &extip.ExtIP{Namespace: e.Namespace, SvcName: e.SvcName, ExtIPs: e.ExtIPs, Managed: true}
+	}
+	if len(changes.UpdateOld) != len(changes.UpdateNew) {
+		return nil, fmt.Errorf("%d old services for %d new ones", len(changes.UpdateOld), len(changes.UpdateNew))
+	}
+	for i, e := range changes.UpdateOld {
+		if state[key(e)] != e || !e.Managed {
+			return nil, fmt.Errorf("updating %s which isn't current and managed", key(e))
+		}
+		if key(changes.UpdateNew[i]) != key(e) {
+			return nil, fmt.Errorf("updating %s with %s", key(e), key(changes.UpdateNew[i]))
+		}
+		state[key(e)] = &extip.ExtIP{Namespace: e.Namespace, SvcName: e.SvcName, ExtIPs: changes.UpdateNew[i].ExtIPs, Managed: true}
+	}
+	for _, e := range changes.Delete {
+		if state[key(e)] != e || !e.Managed {
+			return nil, fmt.Errorf("deleting %s which isn't current and managed", key(e))
+		}
+		state[key(e)] = &extip.ExtIP{Namespace: e.Namespace, SvcName: e.SvcName, ExtIPs: endpoint.Targets{}}
+	}
+	return state, nil
+}
+
+func TestCalculateReachesDesired(t *testing.T) {
+	f := func(current, desired extIPs) bool {
+		result, err := apply(current, calculate(current, desired))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		// the desired services end up managed, the managed services which aren't
+		// desired lose their external IPs, the others are left untouched and the
+		// desired services which don't exist are ignored
+		want := map[string]*extip.ExtIP{}
+		for _, e := range current {
+			if e.Managed {
+				want[key(e)] = &extip.ExtIP{ExtIPs: endpoint.Targets{}}
+			} else {
+				want[key(e)] = e
+			}
+		}
+		for _, e := range desired {
+			if _, ok := want[key(e)]; ok {
+				want[key(e)] = &extip.ExtIP{ExtIPs: e.ExtIPs, Managed: true}
+			}
+		}
+		if len(result) != len(want) {
+			return false
+		}
+		for k, w := range want {
+			if !result[k].ExtIPs.Normalize().Same(w.ExtIPs.Normalize()) || result[k].Managed != w.Managed {
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateIsIdempotent(t *testing.T) {
+	f := func(current, desired extIPs) bool {
+		result, err := apply(current, calculate(current, desired))
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		var applied extIPs
+		for _, e := range result {
+			applied = append(applied, e)
+		}
+		changes := calculate(applied, desired)
+		return len(changes.Create)+len(changes.UpdateOld)+len(changes.UpdateNew)+len(changes.Delete) == 0
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateChangesAreDisjoint(t *testing.T) {
+	f := func(current, desired extIPs) bool {
+		changes := calculate(current, desired)
+		keys := map[string]bool{}
+		for _, list := range [][]*extip.ExtIP{changes.Create, changes.UpdateNew, changes.Delete} {
+			for _, e := range list {
+				if keys[key(e)] {
+					return false
+				}
+				keys[key(e)] = true
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
@@ -8,32 +8,102 @@ import (
 
 	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/extip/plan"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/util/flowcontrol"
 )
 
+var (
+	pendingUpdates = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "extip",
+			Name:      "pending_updates",
+			Help:      "Number of services whose external IPs are left to update by the ongoing synchronization.",
+		},
+	)
+	updatedServices = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "extip",
+			Name:      "updated_services_total",
+			Help:      "Number of services whose external IPs were updated.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(pendingUpdates)
+	prometheus.MustRegister(updatedServices)
+}
+
 // Provider defines the interface DNS providers should implement.
 type Provider interface {
 	ExtIPs() ([]*extip.ExtIP, error)
 	ApplyChanges(changes *plan.Changes) error
+	// Finalize adds the finalizer to the services whose external IPs are managed and
+	// removes it from the services being deleted, once they have been cleaned up.
+	Finalize(managed []*extip.ExtIP) error
+}
+
+// Finalizer delays the deletion of a service until its records and inbound rules are removed.
+const Finalizer = "external-ips.alpha.openfresh.github.io/cleanup"
+
+// ManagedByAnnotationKey marks the services whose external IPs were set by the
+// provider with its owner ID, so that they're only cleared once no longer desired
+// if so, and never touched by the controllers of other owners.
+const ManagedByAnnotationKey = "external-ips.alpha.openfresh.github.io/managed-by"
+
+// Config is the configuration of the provider.
+type Config struct {
+	// Limits the services to a namespace, all of them if empty
+	Namespace string
+	// Manages the Finalizer of the services
+	Finalizer bool
+	// The maximum number of services updated per second once a chunk has been updated, 0 doesn't limit them
+	UpdateQPS float32
+	// The number of services updated at once, 0 updates them all at once
+	UpdateChunkSize int
+	// Identifies the services managed by this instance among the ones of other controllers
+	OwnerID string
+	DryRun  bool
 }
 
 type ProviderImpl struct {
 	kubeClient kubernetes.Interface
 	namespace  string
-	dryRun     bool
+	finalizer  bool
+	chunkSize  int
+	ownerID    string
+	// limits the updates of the services, nil doesn't limit them
+	limiter flowcontrol.RateLimiter
+	dryRun  bool
 }
 
-func NewProvider(kubeClient kubernetes.Interface, namespace string, dryRun bool) (Provider, error) {
-	return &ProviderImpl{
+func NewProvider(kubeClient kubernetes.Interface, cfg Config) (Provider, error) {
+	p := &ProviderImpl{
 		kubeClient: kubeClient,
-		namespace:  namespace,
-		dryRun:     dryRun,
-	}, nil
+		namespace:  cfg.Namespace,
+		finalizer:  cfg.Finalizer,
+		chunkSize:  cfg.UpdateChunkSize,
+		ownerID:    cfg.OwnerID,
+		dryRun:     cfg.DryRun,
+	}
+	if cfg.UpdateQPS > 0 {
+		burst := cfg.UpdateChunkSize
+		if burst <= 0 {
+			burst = 1
+		}
+		p.limiter = flowcontrol.NewTokenBucketRateLimiter(cfg.UpdateQPS, burst)
+	}
+	return p, nil
 }
 
-// ExtIPs returns the current extips from the cluster
+// ExtIPs returns the current extips from the cluster, except for the services
+// managed by another owner.
 func (im *ProviderImpl) ExtIPs() ([]*extip.ExtIP, error) {
 	services, err := im.kubeClient.CoreV1().Services(im.namespace).List(metav1.ListOptions{})
 	if err != nil {
@@ -42,31 +112,186 @@ func (im *ProviderImpl) ExtIPs() ([]*extip.ExtIP, error) {
 
 	extips := make([]*extip.ExtIP, 0, len(services.Items))
 	for _, svc := range services.Items {
+		owner, managed := svc.Annotations[ManagedByAnnotationKey]
+		if managed && owner != im.ownerID {
+			log.Debugf("Skipping service %s/%s managed by %s", svc.Namespace, svc.Name, owner)
+			continue
+		}
 		extip := extip.ExtIP{
-			SvcName: svc.Name,
-			ExtIPs:  svc.Spec.ExternalIPs,
+			Namespace: svc.Namespace,
+			SvcName:   svc.Name,
+			ExtIPs:    svc.Spec.ExternalIPs,
+			Managed:   managed,
 		}
 		extips = append(extips, &extip)
 	}
 	return extips, nil
 }
 
-// ApplyChanges propagates changes to the cluster
+// serviceUpdate is the update of the external IPs of a service.
+type serviceUpdate struct {
+	action string
+	extip  *extip.ExtIP
+	// whether the external IPs are managed once updated
+	managed bool
+}
+
+// ApplyChanges propagates changes to the cluster, chunk by chunk so that a node
+// rotation updating every service doesn't flood the API server. The created and
+// updated services are marked as managed, the deleted ones have their external
+// IPs cleared and the mark removed.
 func (im *ProviderImpl) ApplyChanges(changes *plan.Changes) error {
+	updates := make([]serviceUpdate, 0, len(changes.Create)+len(changes.UpdateNew)+len(changes.Delete))
+	for _, e := range changes.Create {
+		updates = append(updates, serviceUpdate{"CREATE", e, true})
+	}
 	for _, e := range changes.UpdateNew {
-		svc, err := im.kubeClient.CoreV1().Services(e.Namespace).Get(e.SvcName, metav1.GetOptions{})
-		if err != nil {
-			return err
+		updates = append(updates, serviceUpdate{"UPDATE", e, true})
+	}
+	for _, e := range changes.Delete {
+		cleared := &extip.ExtIP{Namespace: e.Namespace, SvcName: e.SvcName}
+		updates = append(updates, serviceUpdate{"DELETE", cleared, false})
+	}
+
+	total := len(updates)
+	chunkSize := im.chunkSize
+	if chunkSize <= 0 || chunkSize > total {
+		chunkSize = total
+	}
+
+	pendingUpdates.Set(float64(total))
+	defer pendingUpdates.Set(0)
+
+	for start := 0; start < total; start += chunkSize {
+		end := start + chunkSize
+		if end > total {
+			end = total
+		}
+		for _, u := range updates[start:end] {
+			if err := im.updateExtIPs(u); err != nil {
+				return err
+			}
+			pendingUpdates.Dec()
+		}
+		if chunkSize < total {
+			log.Infof("Updated the external IPs of %d/%d services", end, total)
+		}
+	}
+	return nil
+}
+
+// updateExtIPs updates the external IPs of a service and its managed mark,
+// waiting for the rate limiter. A service taken over by another owner in the
+// meantime is left untouched.
+func (im *ProviderImpl) updateExtIPs(u serviceUpdate) error {
+	e := u.extip
+	svc, err := im.kubeClient.CoreV1().Services(e.Namespace).Get(e.SvcName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if owner, ok := svc.Annotations[ManagedByAnnotationKey]; ok && owner != im.ownerID {
+		log.Warnf("Not updating the external IPs of %s/%s, managed by %s", svc.Namespace, svc.Name, owner)
+		return nil
+	}
+	svc.Spec.ExternalIPs = e.ExtIPs
+	if u.managed {
+		if svc.Annotations == nil {
+			svc.Annotations = map[string]string{}
+		}
+		svc.Annotations[ManagedByAnnotationKey] = im.ownerID
+	} else if svc.DeletionTimestamp == nil {
+		// the mark of a service being deleted is kept until its finalizer is removed,
+		// so that the controllers of other owners keep leaving it alone
+		delete(svc.Annotations, ManagedByAnnotationKey)
+	}
+	log.Infof("Desired change: %s %s/%s %s", u.action+" ExternalIPs", svc.Namespace, svc.Name, strings.Join(e.ExtIPs, ";"))
+	if im.dryRun {
+		return nil
+	}
+
+	im.throttle()
+	newsvc, err := im.kubeClient.CoreV1().Services(svc.Namespace).Update(svc)
+	if err != nil {
+		return err
+	}
+	updatedServices.Inc()
+	log.Debugf("external IPs was updated at service: %s/%s", newsvc.Namespace, newsvc.Name)
+	return nil
+}
+
+// Finalize adds the finalizer to the services whose external IPs are managed and
+// removes it from the services being deleted. It must only be called once the
+// records and inbound rules of the deleted services have been removed. The services
+// managed by another owner are left to its controller, which may not have removed
+// their records and inbound rules yet.
+func (im *ProviderImpl) Finalize(managed []*extip.ExtIP) error {
+	if !im.finalizer {
+		return nil
+	}
+
+	keys := make(map[string]bool, len(managed))
+	for _, e := range managed {
+		if len(e.ExtIPs) > 0 {
+			keys[e.Namespace+"/"+e.SvcName] = true
+		}
+	}
+
+	services, err := im.kubeClient.CoreV1().Services(im.namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range services.Items {
+		svc := &services.Items[i]
+		if owner, ok := svc.Annotations[ManagedByAnnotationKey]; ok && owner != im.ownerID {
+			continue
+		}
+		finalized := hasFinalizer(svc)
+
+		var action string
+		switch {
+		case svc.DeletionTimestamp != nil && finalized:
+			action = "REMOVE"
+			svc.Finalizers = removeFinalizer(svc.Finalizers)
+		case svc.DeletionTimestamp == nil && !finalized && keys[svc.Namespace+"/"+svc.Name]:
+			action = "ADD"
+			svc.Finalizers = append(svc.Finalizers, Finalizer)
+		default:
+			continue
 		}
-		svc.Spec.ExternalIPs = e.ExtIPs
-		log.Infof("Desired change: %s %s/%s %s", "UPDATE ExternalIPs", svc.Namespace, svc.Name, strings.Join(e.ExtIPs, ";"))
+
+		log.Infof("Desired change: %s Finalizer %s/%s", action, svc.Namespace, svc.Name)
 		if !im.dryRun {
-			newsvc, err := im.kubeClient.CoreV1().Services(svc.Namespace).Update(svc)
-			if err != nil {
+			im.throttle()
+			if _, err := im.kubeClient.CoreV1().Services(svc.Namespace).Update(svc); err != nil {
 				return err
 			}
-			log.Debugf("external IPs was updated at service: %s/%s", newsvc.Namespace, newsvc.Name)
 		}
 	}
 	return nil
 }
+
+// throttle waits until the rate limiter allows another update of a service.
+func (im *ProviderImpl) throttle() {
+	if im.limiter != nil {
+		im.limiter.Accept()
+	}
+}
+
+func hasFinalizer(svc *v1.Service) bool {
+	for _, f := range svc.Finalizers {
+		if f == Finalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func removeFinalizer(finalizers []string) []string {
+	var result []string
+	for _, f := range finalizers {
+		if f != Finalizer {
+			result = append(result, f)
+		}
+	}
+	return result
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
+	"github.com/openfresh/external-ips/extip/plan"
+)
+
+func newService(name string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name},
+	}
+}
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, c.Write(m))
+	return m.GetCounter().GetValue()
+}
+
+func TestApplyChangesChunks(t *testing.T) {
+	client := fake.NewSimpleClientset(newService("foo"), newService("bar"), newService("baz"))
+	p, err := NewProvider(client, Config{UpdateQPS: 10, UpdateChunkSize: 2})
+	require.NoError(t, err)
+
+	changes := &plan.Changes{}
+	for _, name := range []string{"foo", "bar", "baz"} {
+		changes.UpdateNew = append(changes.UpdateNew, &extip.ExtIP{
+			Namespace: "default",
+			SvcName:   name,
+			ExtIPs:    endpoint.Targets{"1.2.3.4"},
+		})
+	}
+
+	before := counterValue(t, updatedServices)
+	start := time.Now()
+	require.NoError(t, p.ApplyChanges(changes))
+
+	// the first chunk is updated at once, the last service waits for the rate limiter
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+	assert.Equal(t, before+3, counterValue(t, updatedServices))
+
+	m := &dto.Metric{}
+	require.NoError(t, pendingUpdates.Write(m))
+	assert.Equal(t, float64(0), m.GetGauge().GetValue())
+
+	for _, name := range []string{"foo", "bar", "baz"} {
+		svc, err := client.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"1.2.3.4"}, svc.Spec.ExternalIPs)
+	}
+}
+
+func TestApplyChangesFailure(t *testing.T) {
+	client := fake.NewSimpleClientset(newService("foo"))
+	p, err := NewProvider(client, Config{UpdateChunkSize: 1})
+	require.NoError(t, err)
+
+	before := counterValue(t, updatedServices)
+	err = p.ApplyChanges(&plan.Changes{
+		UpdateNew: []*extip.ExtIP{
+			{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+			{Namespace: "default", SvcName: "missing", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+		},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, before+1, counterValue(t, updatedServices))
+}
+
+func TestApplyChangesManaged(t *testing.T) {
+	foo := newService("foo")
+	foo.Spec.ExternalIPs = []string{"10.0.0.1"}
+	bar := newService("bar")
+	bar.Spec.ExternalIPs = []string{"10.0.0.2"}
+	bar.Annotations = map[string]string{ManagedByAnnotationKey: "prod"}
+	client := fake.NewSimpleClientset(foo, bar, newService("baz"))
+	p, err := NewProvider(client, Config{OwnerID: "prod"})
+	require.NoError(t, err)
+
+	extips, err := p.ExtIPs()
+	require.NoError(t, err)
+	managed := map[string]bool{}
+	for _, e := range extips {
+		managed[e.SvcName] = e.Managed
+	}
+	assert.Equal(t, map[string]bool{"foo": false, "bar": true, "baz": false}, managed)
+
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*extip.ExtIP{{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}}},
+		Delete: []*extip.ExtIP{{Namespace: "default", SvcName: "bar", ExtIPs: endpoint.Targets{"10.0.0.2"}, Managed: true}},
+	}))
+
+	// the created service is marked as managed
+	svc, err := client.CoreV1().Services("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4"}, svc.Spec.ExternalIPs)
+	assert.Equal(t, "prod", svc.Annotations[ManagedByAnnotationKey])
+
+	// the deleted service is cleared and no longer marked
+	svc, err = client.CoreV1().Services("default").Get("bar", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, svc.Spec.ExternalIPs)
+	assert.NotContains(t, svc.Annotations, ManagedByAnnotationKey)
+}
+
+func TestOtherOwner(t *testing.T) {
+	foo := newService("foo")
+	foo.Spec.ExternalIPs = []string{"10.0.0.1"}
+	foo.Annotations = map[string]string{ManagedByAnnotationKey: "staging"}
+	client := fake.NewSimpleClientset(foo, newService("bar"))
+	p, err := NewProvider(client, Config{OwnerID: "prod"})
+	require.NoError(t, err)
+
+	// the services of the other owner aren't reported
+	extips, err := p.ExtIPs()
+	require.NoError(t, err)
+	require.Len(t, extips, 1)
+	assert.Equal(t, "bar", extips[0].SvcName)
+
+	// nor updated, e.g. if taken over after being planned
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create: []*extip.ExtIP{{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}}},
+	}))
+	svc, err := client.CoreV1().Services("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, svc.Spec.ExternalIPs)
+	assert.Equal(t, "staging", svc.Annotations[ManagedByAnnotationKey])
+}
+
+func TestFinalizeOwners(t *testing.T) {
+	now := metav1.Now()
+	newOwned := func(name, owner string, deleted bool) *v1.Service {
+		svc := newService(name)
+		svc.Spec.ExternalIPs = []string{"10.0.0.1"}
+		svc.Annotations = map[string]string{ManagedByAnnotationKey: owner}
+		if deleted {
+			svc.Finalizers = []string{Finalizer}
+			svc.DeletionTimestamp = &now
+		}
+		return svc
+	}
+	client := fake.NewSimpleClientset(
+		newOwned("prod-live", "prod", false),
+		newOwned("staging-live", "staging", false),
+		newOwned("prod-deleted", "prod", true),
+		newOwned("staging-deleted", "staging", true),
+	)
+	prod, err := NewProvider(client, Config{OwnerID: "prod", Finalizer: true})
+	require.NoError(t, err)
+
+	require.NoError(t, prod.Finalize([]*extip.ExtIP{
+		{Namespace: "default", SvcName: "prod-live", ExtIPs: endpoint.Targets{"10.0.0.1"}},
+		{Namespace: "default", SvcName: "staging-live", ExtIPs: endpoint.Targets{"10.0.0.1"}},
+	}))
+
+	finalizers := func(name string) []string {
+		svc, err := client.CoreV1().Services("default").Get(name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return svc.Finalizers
+	}
+	// the services of the other owner are neither finalized nor released, its
+	// controller may not have removed their records and inbound rules yet
+	assert.Equal(t, []string{Finalizer}, finalizers("prod-live"))
+	assert.Empty(t, finalizers("staging-live"))
+	assert.Empty(t, finalizers("prod-deleted"))
+	assert.Equal(t, []string{Finalizer}, finalizers("staging-deleted"))
+
+	// the deleted service keeps its mark once its external IPs are cleared
+	require.NoError(t, prod.ApplyChanges(&plan.Changes{
+		Delete: []*extip.ExtIP{{Namespace: "default", SvcName: "prod-deleted", ExtIPs: endpoint.Targets{"10.0.0.1"}, Managed: true}},
+	}))
+	svc, err := client.CoreV1().Services("default").Get("prod-deleted", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, svc.Spec.ExternalIPs)
+	assert.Equal(t, "prod", svc.Annotations[ManagedByAnnotationKey])
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+// Registration binds the configuration to a provider registered by name.
+type Registration struct {
+	// New creates the provider setting the external IPs of the services
+	New func(cfg *externalips.Config, kubeClient kubernetes.Interface) (Provider, error)
+}
+
+var (
+	registrationsMu sync.RWMutex
+	registrations   = map[string]Registration{}
+)
+
+func init() {
+	Register("kubernetes", Registration{
+		New: func(cfg *externalips.Config, kubeClient kubernetes.Interface) (Provider, error) {
+			return NewProvider(
+				kubeClient,
+				Config{
+					Namespace:       cfg.Namespace,
+					Finalizer:       cfg.ServiceFinalizer,
+					UpdateQPS:       cfg.ExtIPUpdateQPS,
+					UpdateChunkSize: cfg.ExtIPUpdateChunkSize,
+					OwnerID:         cfg.TXTOwnerID,
+					DryRun:          cfg.DryRun,
+				},
+			)
+		},
+	})
+}
+
+// Register makes a provider available by name to the external IPs provider
+// setting of the configuration. It panics if the name is already registered.
+func Register(name string, r Registration) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	if r.New == nil {
+		panic("provider: Register without New for " + name)
+	}
+	if _, dup := registrations[name]; dup {
+		panic("provider: Register called twice for " + name)
+	}
+	registrations[name] = r
+}
+
+// Lookup returns the registration of the provider of the name.
+func Lookup(name string) (Registration, bool) {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	r, ok := registrations[name]
+	return r, ok
+}
+
+// Names returns the sorted names of the registered providers.
+func Names() []string {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	names := make([]string, 0, len(registrations))
+	for name := range registrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
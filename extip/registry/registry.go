@@ -29,3 +29,8 @@ func (im *Registry) ExtIPs() ([]*extip.ExtIP, error) {
 func (im *Registry) ApplyChanges(changes *plan.Changes) error {
 	return im.provider.ApplyChanges(changes)
 }
+
+// Finalize manages the finalizer of the services, see Provider.Finalize
+func (im *Registry) Finalize(managed []*extip.ExtIP) error {
+	return im.provider.Finalize(managed)
+}
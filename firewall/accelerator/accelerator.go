@@ -0,0 +1,149 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package accelerator
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// Accelerator exposes the inbound rules of the services through the listeners of an
+// accelerator, whose static IPs are published in place of the IPs of the nodes.
+type Accelerator interface {
+	// IPs returns the static IPs of the accelerator.
+	IPs() ([]string, error)
+	// Sync brings the listeners of the accelerator to the accelerated rules among desired,
+	// leaving the listeners of the rules in dry-run as they are.
+	Sync(desired []*inbound.InboundRules) error
+}
+
+// PortRange is a range of ports of a listener, From and To included.
+type PortRange struct {
+	From int
+	To   int
+}
+
+// Listener forwards the ports of a protocol to the instances of the nodes.
+type Listener struct {
+	// inbound.ProtocolTCP or inbound.ProtocolUDP
+	Protocol string
+	// the merged port ranges, sorted
+	Ports []PortRange
+	// inbound.AcceleratorAffinityNone or inbound.AcceleratorAffinitySourceIP
+	ClientAffinity string
+	// the instances the traffic is forwarded to
+	ProviderIDs []string
+	// the name of the inbound rules the listener is desired for
+	Rules string
+}
+
+// Key identifies the listener by its protocol and ports, the port ranges of the
+// listeners of an accelerator never overlapping.
+func (l *Listener) Key() string {
+	ports := make([]string, 0, len(l.Ports))
+	for _, r := range l.Ports {
+		ports = append(ports, fmt.Sprintf("%d-%d", r.From, r.To))
+	}
+	return l.Protocol + ":" + strings.Join(ports, ",")
+}
+
+// Listeners returns the listeners desired for the accelerated rules, one per protocol
+// of each, and the keys of the listeners of the accelerated rules in dry-run. The
+// listeners overlapping the ports of the listener of other rules are left out.
+func Listeners(desired []*inbound.InboundRules) ([]*Listener, map[string]bool) {
+	rules := make([]*inbound.InboundRules, 0, len(desired))
+	for _, r := range desired {
+		if r.AcceleratorAffinity != "" {
+			rules = append(rules, r)
+		}
+	}
+	// the rules keep their listener whatever the order of the services
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+
+	listeners := []*Listener{}
+	dryRun := map[string]bool{}
+	taken := []*Listener{}
+	for _, r := range rules {
+		for _, l := range rulesListeners(r) {
+			if owner := overlapping(taken, l); owner != nil {
+				log.Warnf("Not accelerating %s of %s, the listener of %s already has these ports", l.Key(), r.Name, owner.Rules)
+				continue
+			}
+			taken = append(taken, l)
+			if r.DryRun {
+				dryRun[l.Key()] = true
+				continue
+			}
+			listeners = append(listeners, l)
+		}
+	}
+	return listeners, dryRun
+}
+
+// overlapping returns the first of the listeners with some of the ports of l, nil if none.
+func overlapping(listeners []*Listener, l *Listener) *Listener {
+	for _, o := range listeners {
+		if o.Protocol != l.Protocol {
+			continue
+		}
+		for _, a := range o.Ports {
+			for _, b := range l.Ports {
+				if a.From <= b.To && b.From <= a.To {
+					return o
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rulesListeners returns the listeners of the rules, one per protocol.
+func rulesListeners(r *inbound.InboundRules) []*Listener {
+	ports := map[string][]PortRange{}
+	for _, rule := range r.Rules {
+		if rule.Protocol != inbound.ProtocolTCP && rule.Protocol != inbound.ProtocolUDP {
+			log.Warnf("Not accelerating %s:%d of %s, the accelerator only forwards tcp and udp", rule.Protocol, rule.Port, r.Name)
+			continue
+		}
+		ports[rule.Protocol] = append(ports[rule.Protocol], PortRange{From: rule.Port, To: rule.LastPort()})
+	}
+
+	listeners := make([]*Listener, 0, len(ports))
+	for _, protocol := range []string{inbound.ProtocolTCP, inbound.ProtocolUDP} {
+		if len(ports[protocol]) == 0 {
+			continue
+		}
+		listeners = append(listeners, &Listener{
+			Protocol:       protocol,
+			Ports:          MergePortRanges(ports[protocol]),
+			ClientAffinity: r.AcceleratorAffinity,
+			ProviderIDs:    r.ProviderIDs.Canonical(),
+			Rules:          r.Name,
+		})
+	}
+	return listeners
+}
+
+// MergePortRanges returns the ranges sorted, the overlapping and adjacent ones merged.
+func MergePortRanges(ranges []PortRange) []PortRange {
+	sorted := append([]PortRange(nil), ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].From < sorted[j].From })
+
+	merged := make([]PortRange, 0, len(sorted))
+	for _, r := range sorted {
+		if n := len(merged); n > 0 && r.From <= merged[n-1].To+1 {
+			if r.To > merged[n-1].To {
+				merged[n-1].To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
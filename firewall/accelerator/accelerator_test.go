@@ -0,0 +1,82 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package accelerator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+func TestMergePortRanges(t *testing.T) {
+	assert.Equal(t, []PortRange{}, MergePortRanges(nil))
+	assert.Equal(t,
+		[]PortRange{{From: 80, To: 81}, {From: 443, To: 443}, {From: 8000, To: 8100}},
+		MergePortRanges([]PortRange{{From: 8000, To: 8080}, {From: 443, To: 443}, {From: 81, To: 81}, {From: 8050, To: 8100}, {From: 80, To: 80}}),
+	)
+}
+
+func TestListeners(t *testing.T) {
+	desired := []*inbound.InboundRules{
+		{
+			Name: "web.kube.openfresh.io",
+			Rules: []inbound.InboundRule{
+				{Protocol: inbound.ProtocolTCP, Port: 443},
+				{Protocol: inbound.ProtocolTCP, Port: 80},
+				{Protocol: inbound.ProtocolUDP, Port: 443},
+				{Protocol: inbound.ProtocolSCTP, Port: 9000},
+			},
+			ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1c/i-2", "aws:///ap-northeast-1a/i-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinitySourceIP,
+		},
+		{
+			Name:        "api.kube.openfresh.io",
+			Rules:       []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 8080}},
+			ProviderIDs: inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+		},
+		{
+			Name:                "game.kube.openfresh.io",
+			Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolUDP, Port: 7000, ToPort: 7100}},
+			ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+			DryRun:              true,
+		},
+		{
+			Name:                "copy.kube.openfresh.io",
+			Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 80}, {Protocol: inbound.ProtocolTCP, Port: 443}},
+			ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+		},
+		{
+			Name:                "voice.kube.openfresh.io",
+			Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolUDP, Port: 7050}, {Protocol: inbound.ProtocolUDP, Port: 5060}},
+			ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+		},
+	}
+
+	listeners, dryRun := Listeners(desired)
+	// the rules which aren't accelerated have no listener, the sctp ports are left out
+	// and the ports of the first rules by name win, even those of the rules in dry-run
+	assert.Equal(t, []*Listener{
+		{
+			Protocol:       inbound.ProtocolTCP,
+			Ports:          []PortRange{{From: 80, To: 80}, {From: 443, To: 443}},
+			ClientAffinity: inbound.AcceleratorAffinityNone,
+			ProviderIDs:    []string{"aws:///ap-northeast-1a/i-1"},
+			Rules:          "copy.kube.openfresh.io",
+		},
+		{
+			Protocol:       inbound.ProtocolUDP,
+			Ports:          []PortRange{{From: 443, To: 443}},
+			ClientAffinity: inbound.AcceleratorAffinitySourceIP,
+			ProviderIDs:    []string{"aws:///ap-northeast-1a/i-1", "aws:///ap-northeast-1c/i-2"},
+			Rules:          "web.kube.openfresh.io",
+		},
+	}, listeners)
+	assert.Equal(t, map[string]bool{"udp:7000-7100": true}, dryRun)
+	assert.Equal(t, "tcp:80-80,443-443", listeners[0].Key())
+}
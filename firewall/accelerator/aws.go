@@ -0,0 +1,415 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package accelerator
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/linki/instrumented_http"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/permissions"
+)
+
+// globalAcceleratorRegion is the region of the Global Accelerator API, whatever the
+// regions of the instances the accelerators forward to.
+const globalAcceleratorRegion = "us-west-2"
+
+// awsRegionRegMatch matches the region of an availability zone, e.g. ap-northeast-1 of ap-northeast-1a.
+var awsRegionRegMatch = regexp.MustCompile(`^[a-z]+(-[a-z]+)+-[0-9]+`)
+
+// the client affinities of the listeners by inbound.AcceleratorAffinity
+var awsClientAffinities = map[string]string{
+	inbound.AcceleratorAffinityNone:     globalaccelerator.ClientAffinityNone,
+	inbound.AcceleratorAffinitySourceIP: globalaccelerator.ClientAffinitySourceIp,
+}
+
+// GlobalAcceleratorAPI is the subset of the AWS Global Accelerator API that we actually use.  Add methods as required. Signatures must match exactly.
+// mostly taken from: https://github.com/aws/aws-sdk-go/blob/master/service/globalaccelerator/globalacceleratoriface/interface.go
+type GlobalAcceleratorAPI interface {
+	DescribeAccelerator(input *globalaccelerator.DescribeAcceleratorInput) (*globalaccelerator.DescribeAcceleratorOutput, error)
+	ListListeners(input *globalaccelerator.ListListenersInput) (*globalaccelerator.ListListenersOutput, error)
+	CreateListener(input *globalaccelerator.CreateListenerInput) (*globalaccelerator.CreateListenerOutput, error)
+	UpdateListener(input *globalaccelerator.UpdateListenerInput) (*globalaccelerator.UpdateListenerOutput, error)
+	DeleteListener(input *globalaccelerator.DeleteListenerInput) (*globalaccelerator.DeleteListenerOutput, error)
+	ListEndpointGroups(input *globalaccelerator.ListEndpointGroupsInput) (*globalaccelerator.ListEndpointGroupsOutput, error)
+	CreateEndpointGroup(input *globalaccelerator.CreateEndpointGroupInput) (*globalaccelerator.CreateEndpointGroupOutput, error)
+	UpdateEndpointGroup(input *globalaccelerator.UpdateEndpointGroupInput) (*globalaccelerator.UpdateEndpointGroupOutput, error)
+	DeleteEndpointGroup(input *globalaccelerator.DeleteEndpointGroupInput) (*globalaccelerator.DeleteEndpointGroupOutput, error)
+}
+
+// AWSPermissions returns the IAM policy statements required by the AWS accelerator,
+// restricted to the accelerator of the ARN and its listeners. Global Accelerator
+// creates its service-linked role along with the first endpoint group of an instance.
+func AWSPermissions(arn string) []permissions.Statement {
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   permissions.Actions("globalaccelerator", (*GlobalAcceleratorAPI)(nil)),
+			Resource: []string{arn, arn + "/*"},
+		},
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   []string{"iam:CreateServiceLinkedRole"},
+			Resource: []string{"arn:aws:iam::*:role/aws-service-role/globalaccelerator.amazonaws.com/*"},
+		},
+	}
+}
+
+// AWSConfig contains the settings of the AWS accelerator.
+type AWSConfig struct {
+	// The ARN of the accelerator, whose listeners are all managed
+	ARN        string
+	AssumeRole string
+	// Overrides the region of the AWS configuration, the region of the nodes whose providerID has no zone
+	Region string
+}
+
+// AWSAccelerator is an Accelerator managing the listeners of an AWS Global Accelerator,
+// which forward to the instances of the nodes, one endpoint group per region. The
+// accelerator is dedicated to the cluster: the listeners which aren't desired are deleted.
+type AWSAccelerator struct {
+	client GlobalAcceleratorAPI
+	arn    string
+	// the region of the nodes whose providerID has no zone
+	region string
+}
+
+// NewAWSAccelerator returns an AWSAccelerator managing the accelerator of the configured ARN.
+func NewAWSAccelerator(config AWSConfig) (*AWSAccelerator, error) {
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+
+	awsConfig.WithHTTPClient(
+		instrumented_http.NewClient(awsConfig.HTTPClient, &instrumented_http.Callbacks{
+			PathProcessor: func(path string) string {
+				parts := strings.Split(path, "/")
+				return parts[len(parts)-1]
+			},
+		}),
+	)
+
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRole != "" {
+		log.Infof("Assuming role: %s", config.AssumeRole)
+		session.Config.WithCredentials(stscreds.NewCredentials(session, config.AssumeRole))
+	}
+
+	client := globalaccelerator.New(session, aws.NewConfig().WithRegion(globalAcceleratorRegion))
+	return newAWSAccelerator(client, config.ARN, aws.StringValue(session.Config.Region)), nil
+}
+
+func newAWSAccelerator(client GlobalAcceleratorAPI, arn, region string) *AWSAccelerator {
+	return &AWSAccelerator{
+		client: client,
+		arn:    arn,
+		region: region,
+	}
+}
+
+// IPs returns the static IPs of the accelerator, of all its IP address sets.
+func (a *AWSAccelerator) IPs() ([]string, error) {
+	resp, err := a.client.DescribeAccelerator(&globalaccelerator.DescribeAcceleratorInput{
+		AcceleratorArn: aws.String(a.arn),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	if resp.Accelerator != nil {
+		for _, set := range resp.Accelerator.IpSets {
+			ips = append(ips, aws.StringValueSlice(set.IpAddresses)...)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("accelerator %s has no static IPs", a.arn)
+	}
+	return ips, nil
+}
+
+// awsListener is a listener of the accelerator along with its endpoint groups.
+type awsListener struct {
+	listener *globalaccelerator.Listener
+	groups   []*globalaccelerator.EndpointGroup
+}
+
+// Sync creates the listeners of the accelerated rules, updates their client affinity and
+// their endpoint groups, and deletes the listeners which aren't desired anymore. A failing
+// listener doesn't stop the others, the failures are reported once all were synchronized.
+func (a *AWSAccelerator) Sync(desired []*inbound.InboundRules) error {
+	listeners, dryRun := Listeners(desired)
+	current, err := a.listeners()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]*Listener, len(listeners))
+	for _, l := range listeners {
+		wanted[l.Key()] = l
+	}
+
+	failed := 0
+	for key, c := range current {
+		if wanted[key] != nil || dryRun[key] {
+			continue
+		}
+		log.Infof("Deleting listener %s of accelerator %s", key, a.arn)
+		if err := a.deleteListener(c); err != nil {
+			log.Errorf("Failed to delete listener %s of accelerator %s: %v", key, a.arn, err)
+			failed++
+		}
+	}
+	for _, l := range listeners {
+		if err := a.syncListener(l, current[l.Key()]); err != nil {
+			log.Errorf("Failed to synchronize listener %s of %s on accelerator %s: %v", l.Key(), l.Rules, a.arn, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to synchronize %d listeners of accelerator %s", failed, a.arn)
+	}
+	return nil
+}
+
+// listeners returns the listeners of the accelerator with their endpoint groups, by key.
+func (a *AWSAccelerator) listeners() (map[string]*awsListener, error) {
+	result := map[string]*awsListener{}
+	input := &globalaccelerator.ListListenersInput{AcceleratorArn: aws.String(a.arn)}
+	for {
+		resp, err := a.client.ListListeners(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range resp.Listeners {
+			groups, err := a.endpointGroups(l.ListenerArn)
+			if err != nil {
+				return nil, err
+			}
+			result[awsListenerKey(l)] = &awsListener{listener: l, groups: groups}
+		}
+		if aws.StringValue(resp.NextToken) == "" {
+			return result, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// endpointGroups returns the endpoint groups of the listener.
+func (a *AWSAccelerator) endpointGroups(listenerARN *string) ([]*globalaccelerator.EndpointGroup, error) {
+	var groups []*globalaccelerator.EndpointGroup
+	input := &globalaccelerator.ListEndpointGroupsInput{ListenerArn: listenerARN}
+	for {
+		resp, err := a.client.ListEndpointGroups(input)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, resp.EndpointGroups...)
+		if aws.StringValue(resp.NextToken) == "" {
+			return groups, nil
+		}
+		input.NextToken = resp.NextToken
+	}
+}
+
+// syncListener creates the listener if current is nil, or updates its client affinity,
+// then brings its endpoint groups to the instances of the listener.
+func (a *AWSAccelerator) syncListener(l *Listener, current *awsListener) error {
+	endpoints, err := a.endpointsByRegion(l.ProviderIDs)
+	if err != nil {
+		return err
+	}
+	affinity := awsClientAffinities[l.ClientAffinity]
+
+	if current == nil {
+		log.Infof("Creating listener %s of %s on accelerator %s", l.Key(), l.Rules, a.arn)
+		resp, err := a.client.CreateListener(&globalaccelerator.CreateListenerInput{
+			AcceleratorArn:   aws.String(a.arn),
+			IdempotencyToken: aws.String(idempotencyToken()),
+			Protocol:         aws.String(strings.ToUpper(l.Protocol)),
+			PortRanges:       awsPortRanges(l.Ports),
+			ClientAffinity:   aws.String(affinity),
+		})
+		if err != nil {
+			return err
+		}
+		current = &awsListener{listener: resp.Listener}
+	} else if aws.StringValue(current.listener.ClientAffinity) != affinity {
+		log.Infof("Updating the client affinity of listener %s of %s on accelerator %s to %s", l.Key(), l.Rules, a.arn, affinity)
+		_, err := a.client.UpdateListener(&globalaccelerator.UpdateListenerInput{
+			ListenerArn:    current.listener.ListenerArn,
+			ClientAffinity: aws.String(affinity),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return a.syncEndpointGroups(current, endpoints)
+}
+
+// syncEndpointGroups updates the endpoint groups of the listener whose instances changed,
+// deletes those of the regions without instances and creates those of the new regions.
+func (a *AWSAccelerator) syncEndpointGroups(l *awsListener, endpoints map[string][]string) error {
+	found := map[string]bool{}
+	for _, g := range l.groups {
+		region := aws.StringValue(g.EndpointGroupRegion)
+		found[region] = true
+		ids, ok := endpoints[region]
+		if !ok {
+			log.Infof("Deleting the endpoint group of listener %s in %s", aws.StringValue(l.listener.ListenerArn), region)
+			if _, err := a.client.DeleteEndpointGroup(&globalaccelerator.DeleteEndpointGroupInput{EndpointGroupArn: g.EndpointGroupArn}); err != nil {
+				return err
+			}
+			continue
+		}
+		if sameStrings(endpointIDs(g), ids) {
+			continue
+		}
+		log.Infof("Updating the endpoint group of listener %s in %s to %s", aws.StringValue(l.listener.ListenerArn), region, strings.Join(ids, ", "))
+		_, err := a.client.UpdateEndpointGroup(&globalaccelerator.UpdateEndpointGroupInput{
+			EndpointGroupArn:       g.EndpointGroupArn,
+			EndpointConfigurations: awsEndpointConfigurations(ids),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	regions := make([]string, 0, len(endpoints))
+	for region := range endpoints {
+		if !found[region] {
+			regions = append(regions, region)
+		}
+	}
+	sort.Strings(regions)
+	for _, region := range regions {
+		log.Infof("Creating the endpoint group of listener %s in %s with %s", aws.StringValue(l.listener.ListenerArn), region, strings.Join(endpoints[region], ", "))
+		_, err := a.client.CreateEndpointGroup(&globalaccelerator.CreateEndpointGroupInput{
+			ListenerArn:            l.listener.ListenerArn,
+			IdempotencyToken:       aws.String(idempotencyToken()),
+			EndpointGroupRegion:    aws.String(region),
+			EndpointConfigurations: awsEndpointConfigurations(endpoints[region]),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteListener deletes the endpoint groups of the listener, then the listener.
+func (a *AWSAccelerator) deleteListener(l *awsListener) error {
+	for _, g := range l.groups {
+		if _, err := a.client.DeleteEndpointGroup(&globalaccelerator.DeleteEndpointGroupInput{EndpointGroupArn: g.EndpointGroupArn}); err != nil {
+			return err
+		}
+	}
+	_, err := a.client.DeleteListener(&globalaccelerator.DeleteListenerInput{ListenerArn: l.listener.ListenerArn})
+	return err
+}
+
+// endpointsByRegion returns the sorted instance ids of the providerIDs by region, found
+// from their availability zone, the region of the accelerator if they have none.
+func (a *AWSAccelerator) endpointsByRegion(providerIDs []string) (map[string][]string, error) {
+	endpoints := map[string][]string{}
+	for _, providerID := range providerIDs {
+		id, err := node.ParseProviderID(providerID)
+		if err != nil {
+			return nil, err
+		}
+		if id.Scheme != node.SchemeAWS {
+			return nil, fmt.Errorf("the accelerator only forwards to AWS instances, not to %s", providerID)
+		}
+		region := awsRegionRegMatch.FindString(id.Zone)
+		if region == "" {
+			region = a.region
+		}
+		endpoints[region] = append(endpoints[region], id.InstanceID)
+	}
+	for _, ids := range endpoints {
+		sort.Strings(ids)
+	}
+	return endpoints, nil
+}
+
+// awsListenerKey returns the key of the listener, as Listener.Key.
+func awsListenerKey(l *globalaccelerator.Listener) string {
+	ports := make([]PortRange, 0, len(l.PortRanges))
+	for _, r := range l.PortRanges {
+		ports = append(ports, PortRange{From: int(aws.Int64Value(r.FromPort)), To: int(aws.Int64Value(r.ToPort))})
+	}
+	listener := &Listener{
+		Protocol: strings.ToLower(aws.StringValue(l.Protocol)),
+		Ports:    MergePortRanges(ports),
+	}
+	return listener.Key()
+}
+
+func awsPortRanges(ranges []PortRange) []*globalaccelerator.PortRange {
+	result := make([]*globalaccelerator.PortRange, 0, len(ranges))
+	for _, r := range ranges {
+		result = append(result, &globalaccelerator.PortRange{
+			FromPort: aws.Int64(int64(r.From)),
+			ToPort:   aws.Int64(int64(r.To)),
+		})
+	}
+	return result
+}
+
+func awsEndpointConfigurations(ids []string) []*globalaccelerator.EndpointConfiguration {
+	result := make([]*globalaccelerator.EndpointConfiguration, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, &globalaccelerator.EndpointConfiguration{EndpointId: aws.String(id)})
+	}
+	return result
+}
+
+// endpointIDs returns the sorted ids of the endpoints of the group.
+func endpointIDs(g *globalaccelerator.EndpointGroup) []string {
+	ids := make([]string, 0, len(g.EndpointDescriptions))
+	for _, e := range g.EndpointDescriptions {
+		ids = append(ids, aws.StringValue(e.EndpointId))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotencyToken returns a new token, the creations are never retried with the same one.
+func idempotencyToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,266 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package accelerator
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/globalaccelerator"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+const testAcceleratorARN = "arn:aws:globalaccelerator::123456789012:accelerator/1234abcd"
+
+// GlobalAcceleratorAPIStub keeps the listeners and endpoint groups of a single
+// accelerator in memory, listing them one per page.
+type GlobalAcceleratorAPIStub struct {
+	listeners []*globalaccelerator.Listener
+	groups    map[string][]*globalaccelerator.EndpointGroup
+	created   int
+}
+
+func newGlobalAcceleratorAPIStub() *GlobalAcceleratorAPIStub {
+	return &GlobalAcceleratorAPIStub{groups: map[string][]*globalaccelerator.EndpointGroup{}}
+}
+
+func (s *GlobalAcceleratorAPIStub) DescribeAccelerator(input *globalaccelerator.DescribeAcceleratorInput) (*globalaccelerator.DescribeAcceleratorOutput, error) {
+	return &globalaccelerator.DescribeAcceleratorOutput{
+		Accelerator: &globalaccelerator.Accelerator{
+			AcceleratorArn: input.AcceleratorArn,
+			IpSets: []*globalaccelerator.IpSet{
+				{IpFamily: aws.String("IPv4"), IpAddresses: aws.StringSlice([]string{"75.2.0.1", "99.83.0.1"})},
+			},
+		},
+	}, nil
+}
+
+// page returns the item of the page of token and the token of the next page.
+func page(token *string, n int) (int, *string) {
+	i := 0
+	if token != nil {
+		fmt.Sscanf(aws.StringValue(token), "%d", &i)
+	}
+	if i+1 < n {
+		return i, aws.String(fmt.Sprintf("%d", i+1))
+	}
+	return i, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) ListListeners(input *globalaccelerator.ListListenersInput) (*globalaccelerator.ListListenersOutput, error) {
+	if len(s.listeners) == 0 {
+		return &globalaccelerator.ListListenersOutput{}, nil
+	}
+	i, next := page(input.NextToken, len(s.listeners))
+	return &globalaccelerator.ListListenersOutput{Listeners: s.listeners[i : i+1], NextToken: next}, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) CreateListener(input *globalaccelerator.CreateListenerInput) (*globalaccelerator.CreateListenerOutput, error) {
+	s.created++
+	l := &globalaccelerator.Listener{
+		ListenerArn:    aws.String(fmt.Sprintf("%s/listener/%d", aws.StringValue(input.AcceleratorArn), s.created)),
+		Protocol:       input.Protocol,
+		PortRanges:     input.PortRanges,
+		ClientAffinity: input.ClientAffinity,
+	}
+	s.listeners = append(s.listeners, l)
+	return &globalaccelerator.CreateListenerOutput{Listener: l}, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) UpdateListener(input *globalaccelerator.UpdateListenerInput) (*globalaccelerator.UpdateListenerOutput, error) {
+	l := s.listener(input.ListenerArn)
+	if l == nil {
+		return nil, fmt.Errorf("no listener %s", aws.StringValue(input.ListenerArn))
+	}
+	l.ClientAffinity = input.ClientAffinity
+	return &globalaccelerator.UpdateListenerOutput{Listener: l}, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) DeleteListener(input *globalaccelerator.DeleteListenerInput) (*globalaccelerator.DeleteListenerOutput, error) {
+	arn := aws.StringValue(input.ListenerArn)
+	if len(s.groups[arn]) > 0 {
+		return nil, fmt.Errorf("listener %s has endpoint groups", arn)
+	}
+	for i, l := range s.listeners {
+		if aws.StringValue(l.ListenerArn) == arn {
+			s.listeners = append(s.listeners[:i], s.listeners[i+1:]...)
+			return &globalaccelerator.DeleteListenerOutput{}, nil
+		}
+	}
+	return nil, fmt.Errorf("no listener %s", arn)
+}
+
+func (s *GlobalAcceleratorAPIStub) ListEndpointGroups(input *globalaccelerator.ListEndpointGroupsInput) (*globalaccelerator.ListEndpointGroupsOutput, error) {
+	groups := s.groups[aws.StringValue(input.ListenerArn)]
+	if len(groups) == 0 {
+		return &globalaccelerator.ListEndpointGroupsOutput{}, nil
+	}
+	i, next := page(input.NextToken, len(groups))
+	return &globalaccelerator.ListEndpointGroupsOutput{EndpointGroups: groups[i : i+1], NextToken: next}, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) CreateEndpointGroup(input *globalaccelerator.CreateEndpointGroupInput) (*globalaccelerator.CreateEndpointGroupOutput, error) {
+	arn := aws.StringValue(input.ListenerArn)
+	g := &globalaccelerator.EndpointGroup{
+		EndpointGroupArn:     aws.String(arn + "/endpoint-group/" + aws.StringValue(input.EndpointGroupRegion)),
+		EndpointGroupRegion:  input.EndpointGroupRegion,
+		EndpointDescriptions: endpointDescriptions(input.EndpointConfigurations),
+	}
+	s.groups[arn] = append(s.groups[arn], g)
+	return &globalaccelerator.CreateEndpointGroupOutput{EndpointGroup: g}, nil
+}
+
+func (s *GlobalAcceleratorAPIStub) UpdateEndpointGroup(input *globalaccelerator.UpdateEndpointGroupInput) (*globalaccelerator.UpdateEndpointGroupOutput, error) {
+	for _, groups := range s.groups {
+		for _, g := range groups {
+			if aws.StringValue(g.EndpointGroupArn) == aws.StringValue(input.EndpointGroupArn) {
+				g.EndpointDescriptions = endpointDescriptions(input.EndpointConfigurations)
+				return &globalaccelerator.UpdateEndpointGroupOutput{EndpointGroup: g}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no endpoint group %s", aws.StringValue(input.EndpointGroupArn))
+}
+
+func (s *GlobalAcceleratorAPIStub) DeleteEndpointGroup(input *globalaccelerator.DeleteEndpointGroupInput) (*globalaccelerator.DeleteEndpointGroupOutput, error) {
+	for arn, groups := range s.groups {
+		for i, g := range groups {
+			if aws.StringValue(g.EndpointGroupArn) == aws.StringValue(input.EndpointGroupArn) {
+				s.groups[arn] = append(groups[:i], groups[i+1:]...)
+				return &globalaccelerator.DeleteEndpointGroupOutput{}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no endpoint group %s", aws.StringValue(input.EndpointGroupArn))
+}
+
+func (s *GlobalAcceleratorAPIStub) listener(arn *string) *globalaccelerator.Listener {
+	for _, l := range s.listeners {
+		if aws.StringValue(l.ListenerArn) == aws.StringValue(arn) {
+			return l
+		}
+	}
+	return nil
+}
+
+// state returns the client affinity and the endpoints by region of the listeners, by key.
+func (s *GlobalAcceleratorAPIStub) state() map[string]map[string][]string {
+	result := map[string]map[string][]string{}
+	for _, l := range s.listeners {
+		state := map[string][]string{"affinity": {aws.StringValue(l.ClientAffinity)}}
+		for _, g := range s.groups[aws.StringValue(l.ListenerArn)] {
+			state[aws.StringValue(g.EndpointGroupRegion)] = endpointIDs(g)
+		}
+		result[awsListenerKey(l)] = state
+	}
+	return result
+}
+
+func endpointDescriptions(configurations []*globalaccelerator.EndpointConfiguration) []*globalaccelerator.EndpointDescription {
+	result := []*globalaccelerator.EndpointDescription{}
+	for _, c := range configurations {
+		result = append(result, &globalaccelerator.EndpointDescription{EndpointId: c.EndpointId})
+	}
+	return result
+}
+
+func TestAWSAcceleratorIPs(t *testing.T) {
+	a := newAWSAccelerator(newGlobalAcceleratorAPIStub(), testAcceleratorARN, "ap-northeast-1")
+	ips, err := a.IPs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"75.2.0.1", "99.83.0.1"}, ips)
+}
+
+func TestAWSAcceleratorSync(t *testing.T) {
+	client := newGlobalAcceleratorAPIStub()
+	a := newAWSAccelerator(client, testAcceleratorARN, "ap-northeast-1")
+
+	web := &inbound.InboundRules{
+		Name:                "web.kube.openfresh.io",
+		Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 80}, {Protocol: inbound.ProtocolTCP, Port: 443}},
+		ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1", "aws:///us-east-1b/i-3", "i-2"),
+		AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+	}
+	game := &inbound.InboundRules{
+		Name:                "game.kube.openfresh.io",
+		Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolUDP, Port: 7000, ToPort: 7100}},
+		ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+		AcceleratorAffinity: inbound.AcceleratorAffinitySourceIP,
+	}
+	require.NoError(t, a.Sync([]*inbound.InboundRules{web, game}))
+	// the instances without a zone are in the region of the accelerator
+	assert.Equal(t, map[string]map[string][]string{
+		"tcp:80-80,443-443": {"affinity": {"NONE"}, "ap-northeast-1": {"i-1", "i-2"}, "us-east-1": {"i-3"}},
+		"udp:7000-7100":     {"affinity": {"SOURCE_IP"}, "ap-northeast-1": {"i-1"}},
+	}, client.state())
+	assert.Equal(t, 2, client.created)
+
+	// the instances and the client affinity are updated in place, the empty regions deleted
+	web.ProviderIDs = inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1", "aws:///ap-northeast-1c/i-4")
+	web.AcceleratorAffinity = inbound.AcceleratorAffinitySourceIP
+	require.NoError(t, a.Sync([]*inbound.InboundRules{web, game}))
+	assert.Equal(t, map[string]map[string][]string{
+		"tcp:80-80,443-443": {"affinity": {"SOURCE_IP"}, "ap-northeast-1": {"i-1", "i-4"}},
+		"udp:7000-7100":     {"affinity": {"SOURCE_IP"}, "ap-northeast-1": {"i-1"}},
+	}, client.state())
+	assert.Equal(t, 2, client.created)
+
+	// the listeners of the rules in dry-run are kept, the others which aren't desired are deleted
+	game.DryRun = true
+	require.NoError(t, a.Sync([]*inbound.InboundRules{game}))
+	assert.Equal(t, map[string]map[string][]string{
+		"udp:7000-7100": {"affinity": {"SOURCE_IP"}, "ap-northeast-1": {"i-1"}},
+	}, client.state())
+
+	// the ports changed replace the listener
+	game.DryRun = false
+	game.Rules[0].ToPort = 7200
+	require.NoError(t, a.Sync([]*inbound.InboundRules{game}))
+	assert.Equal(t, map[string]map[string][]string{
+		"udp:7000-7200": {"affinity": {"SOURCE_IP"}, "ap-northeast-1": {"i-1"}},
+	}, client.state())
+	assert.Equal(t, 3, client.created)
+}
+
+func TestAWSAcceleratorSyncFailures(t *testing.T) {
+	client := newGlobalAcceleratorAPIStub()
+	a := newAWSAccelerator(client, testAcceleratorARN, "ap-northeast-1")
+
+	desired := []*inbound.InboundRules{
+		{
+			Name:                "web.kube.openfresh.io",
+			Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 80}},
+			ProviderIDs:         inbound.NewProviderIDs("gce://project/asia-northeast1-a/web-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+		},
+		{
+			Name:                "api.kube.openfresh.io",
+			Rules:               []inbound.InboundRule{{Protocol: inbound.ProtocolTCP, Port: 8080}},
+			ProviderIDs:         inbound.NewProviderIDs("aws:///ap-northeast-1a/i-1"),
+			AcceleratorAffinity: inbound.AcceleratorAffinityNone,
+		},
+	}
+	// the listeners forwarding to other instances than EC2 ones fail, not the others
+	assert.Error(t, a.Sync(desired))
+	keys := []string{}
+	for key := range client.state() {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	assert.Equal(t, []string{"tcp:8080-8080"}, keys)
+}
+
+func TestAWSAcceleratorPermissions(t *testing.T) {
+	statements := AWSPermissions(testAcceleratorARN)
+	require.Len(t, statements, 2)
+	assert.Contains(t, statements[0].Action, "globalaccelerator:CreateListener")
+	assert.Contains(t, statements[0].Action, "globalaccelerator:DeleteEndpointGroup")
+	assert.Equal(t, []string{testAcceleratorARN, testAcceleratorARN + "/*"}, statements[0].Resource)
+	assert.Equal(t, []string{"iam:CreateServiceLinkedRole"}, statements[1].Action)
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package history
+
+import (
+	"encoding/json"
+	"sort"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// configMapKeyFormat names the keys of the snapshots, which sort by time and
+// only use the characters allowed in the keys of a ConfigMap.
+const configMapKeyFormat = "20060102T150405.000000000Z"
+
+// ConfigMapStore is a Store keeping the snapshots in the keys of a ConfigMap,
+// as JSON. A ConfigMap holding at most 1MB, it suits small clusters or short
+// retentions.
+type ConfigMapStore struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	retention time.Duration
+}
+
+// NewConfigMapStore returns a ConfigMapStore keeping the snapshots of the last
+// retention in the ConfigMap of the given namespace and name, created as needed.
+func NewConfigMapStore(client kubernetes.Interface, namespace, name string, retention time.Duration) *ConfigMapStore {
+	return &ConfigMapStore{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		retention: retention,
+	}
+}
+
+// Save adds the snapshot to the ConfigMap and drops the ones older than the retention.
+func (s *ConfigMapStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		cm = &v1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: s.namespace, Name: s.name},
+		}
+		cm.Data = map[string]string{configMapKey(snapshot.Time): string(data)}
+		_, err = s.client.CoreV1().ConfigMaps(s.namespace).Create(cm)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	cm.Data[configMapKey(snapshot.Time)] = string(data)
+	if s.retention > 0 {
+		oldest := configMapKey(snapshot.Time.Add(-s.retention))
+		for key := range cm.Data {
+			if key < oldest {
+				delete(cm.Data, key)
+			}
+		}
+	}
+	_, err = s.client.CoreV1().ConfigMaps(s.namespace).Update(cm)
+	return err
+}
+
+// At returns the last snapshot of the ConfigMap recorded at or before t.
+func (s *ConfigMapStore) At(t time.Time) (*Snapshot, error) {
+	cm, err := s.client.CoreV1().ConfigMaps(s.namespace).Get(s.name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, ErrNoSnapshot
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	at := configMapKey(t)
+	keys := make([]string, 0, len(cm.Data))
+	for key := range cm.Data {
+		if key <= at {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, ErrNoSnapshot
+	}
+	sort.Strings(keys)
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal([]byte(cm.Data[keys[len(keys)-1]]), snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func configMapKey(t time.Time) string {
+	return t.UTC().Format(configMapKeyFormat)
+}
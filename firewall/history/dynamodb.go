@@ -0,0 +1,147 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package history
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/openfresh/external-ips/permissions"
+)
+
+const (
+	// the attributes of the items of the history table, keyed by cluster and time
+	dynamoDBClusterAttribute   = "Cluster"
+	dynamoDBTimeAttribute      = "Time"
+	dynamoDBSnapshotAttribute  = "Snapshot"
+	dynamoDBExpiresAtAttribute = "ExpiresAt"
+)
+
+// DynamoDBAPI is the subset of the DynamoDB API that we actually use.  Add methods as required. Signatures must match exactly.
+// mostly taken from: https://github.com/aws/aws-sdk-go/blob/master/service/dynamodb/dynamodbiface/interface.go
+type DynamoDBAPI interface {
+	Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+}
+
+// DynamoDBPermissions returns the IAM policy statements required by the DynamoDB store, restricted to its table.
+func DynamoDBPermissions(table string) []permissions.Statement {
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   permissions.Actions("dynamodb", (*DynamoDBAPI)(nil)),
+			Resource: []string{"arn:aws:dynamodb:*:*:table/" + table},
+		},
+	}
+}
+
+// DynamoDBConfig contains the settings of the DynamoDB store.
+type DynamoDBConfig struct {
+	// The table holding the snapshots, with the string hash key Cluster and number range key Time
+	Table      string
+	Region     string
+	AssumeRole string
+	Cluster    string
+	// How long the snapshots are kept, through the ExpiresAt attribute, forever if 0
+	Retention time.Duration
+}
+
+// DynamoDBStore is a Store keeping the snapshots of a cluster in the items of
+// a DynamoDB table, one per snapshot. The expired snapshots are deleted by
+// DynamoDB itself once TTL is enabled on the ExpiresAt attribute of the table.
+type DynamoDBStore struct {
+	client    DynamoDBAPI
+	table     string
+	cluster   string
+	retention time.Duration
+}
+
+// NewDynamoDBStore returns a DynamoDBStore keeping the snapshots of the cluster in the configured table.
+func NewDynamoDBStore(config DynamoDBConfig) (*DynamoDBStore, error) {
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRole != "" {
+		log.Infof("Assuming role: %s", config.AssumeRole)
+		session.Config.WithCredentials(stscreds.NewCredentials(session, config.AssumeRole))
+	}
+
+	return newDynamoDBStore(dynamodb.New(session), config), nil
+}
+
+func newDynamoDBStore(client DynamoDBAPI, config DynamoDBConfig) *DynamoDBStore {
+	return &DynamoDBStore{
+		client:    client,
+		table:     config.Table,
+		cluster:   config.Cluster,
+		retention: config.Retention,
+	}
+}
+
+// Save puts the snapshot in the table, expiring after the retention.
+func (s *DynamoDBStore) Save(snapshot *Snapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	item := map[string]*dynamodb.AttributeValue{
+		dynamoDBClusterAttribute:  {S: aws.String(s.cluster)},
+		dynamoDBTimeAttribute:     {N: aws.String(strconv.FormatInt(snapshot.Time.UnixNano(), 10))},
+		dynamoDBSnapshotAttribute: {S: aws.String(string(data))},
+	}
+	if s.retention > 0 {
+		item[dynamoDBExpiresAtAttribute] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(snapshot.Time.Add(s.retention).Unix(), 10))}
+	}
+	_, err = s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+	return err
+}
+
+// At returns the last snapshot of the table recorded at or before t.
+func (s *DynamoDBStore) At(t time.Time) (*Snapshot, error) {
+	resp, err := s.client.Query(&dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("#cluster = :cluster AND #time <= :time"),
+		ExpressionAttributeNames: map[string]*string{
+			"#cluster": aws.String(dynamoDBClusterAttribute),
+			"#time":    aws.String(dynamoDBTimeAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":cluster": {S: aws.String(s.cluster)},
+			":time":    {N: aws.String(strconv.FormatInt(t.UnixNano(), 10))},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int64(1),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Items) == 0 || resp.Items[0][dynamoDBSnapshotAttribute] == nil {
+		return nil, ErrNoSnapshot
+	}
+
+	snapshot := &Snapshot{}
+	if err := json.Unmarshal([]byte(aws.StringValue(resp.Items[0][dynamoDBSnapshotAttribute].S)), snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package history
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+var _ Store = &DynamoDBStore{}
+
+// DynamoDBAPIStub keeps the items of a single table in memory.
+type DynamoDBAPIStub struct {
+	items []map[string]*dynamodb.AttributeValue
+}
+
+func (s *DynamoDBAPIStub) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	s.items = append(s.items, input.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+// Query supports the key condition of At only.
+func (s *DynamoDBAPIStub) Query(input *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	cluster := aws.StringValue(input.ExpressionAttributeValues[":cluster"].S)
+	at, _ := strconv.ParseInt(aws.StringValue(input.ExpressionAttributeValues[":time"].N), 10, 64)
+
+	output := &dynamodb.QueryOutput{}
+	for _, item := range s.items {
+		t, _ := strconv.ParseInt(aws.StringValue(item[dynamoDBTimeAttribute].N), 10, 64)
+		if aws.StringValue(item[dynamoDBClusterAttribute].S) == cluster && t <= at {
+			output.Items = append(output.Items, item)
+		}
+	}
+	sort.Slice(output.Items, func(i, j int) bool {
+		ti, _ := strconv.ParseInt(aws.StringValue(output.Items[i][dynamoDBTimeAttribute].N), 10, 64)
+		tj, _ := strconv.ParseInt(aws.StringValue(output.Items[j][dynamoDBTimeAttribute].N), 10, 64)
+		if aws.BoolValue(input.ScanIndexForward) {
+			return ti < tj
+		}
+		return ti > tj
+	})
+	if input.Limit != nil && int64(len(output.Items)) > *input.Limit {
+		output.Items = output.Items[:*input.Limit]
+	}
+	return output, nil
+}
+
+func TestDynamoDBStore(t *testing.T) {
+	stub := &DynamoDBAPIStub{}
+	s := newDynamoDBStore(stub, DynamoDBConfig{Table: "firewall-history", Cluster: "kube.openfresh.io", Retention: 24 * time.Hour})
+	other := newDynamoDBStore(stub, DynamoDBConfig{Table: "firewall-history", Cluster: "other.openfresh.io"})
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	require.NoError(t, s.Save(NewSnapshot(start, []*inbound.InboundRules{newRules("foo.kube.openfresh.io", 80)})))
+	require.NoError(t, s.Save(NewSnapshot(start.Add(time.Hour), []*inbound.InboundRules{newRules("foo.kube.openfresh.io", 443)})))
+	require.NoError(t, other.Save(NewSnapshot(start.Add(time.Minute), nil)))
+
+	// the snapshots expire after the retention, or never
+	assert.Equal(t, strconv.FormatInt(start.Add(24*time.Hour).Unix(), 10), aws.StringValue(stub.items[0][dynamoDBExpiresAtAttribute].N))
+	assert.Nil(t, stub.items[2][dynamoDBExpiresAtAttribute])
+
+	_, err := s.At(start.Add(-time.Minute))
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	snapshot, err := s.At(start.Add(30 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, start, snapshot.Time)
+	assert.Equal(t, 80, snapshot.Rules[0].Rules[0].Port)
+
+	snapshot, err = s.At(start.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 443, snapshot.Rules[0].Rules[0].Port)
+}
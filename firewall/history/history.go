@@ -0,0 +1,102 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package history
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// ErrNoSnapshot is returned when no snapshot was recorded at or before the requested time.
+var ErrNoSnapshot = errors.New("no firewall snapshot recorded at that time")
+
+// Store keeps the snapshots of the desired inbound rules, so that the ports
+// open at any point in time can be found afterwards.
+type Store interface {
+	// Save records the snapshot and drops the ones older than the retention of the store.
+	Save(snapshot *Snapshot) error
+	// At returns the last snapshot recorded at or before t, ErrNoSnapshot if none was.
+	At(t time.Time) (*Snapshot, error)
+}
+
+// Snapshot is the full set of the desired inbound rules of the cluster, in
+// effect from Time until the time of the next snapshot.
+type Snapshot struct {
+	Time  time.Time
+	Rules []Rules
+}
+
+// Rules are the inbound rules of a security group and the instances it's
+// assigned to, as recorded in a snapshot.
+type Rules struct {
+	Name        string
+	Rules       []inbound.InboundRule
+	ProviderIDs []string
+}
+
+// NewSnapshot returns the snapshot of the given rules at t, sorted so that
+// the snapshots of the same rules are equal.
+func NewSnapshot(t time.Time, rules []*inbound.InboundRules) *Snapshot {
+	snapshot := &Snapshot{
+		Time:  t.UTC(),
+		Rules: make([]Rules, 0, len(rules)),
+	}
+	for _, r := range rules {
+		providerIDs := append([]string(nil), r.ProviderIDs...)
+		sort.Strings(providerIDs)
+		rs := append([]inbound.InboundRule(nil), r.Rules...)
+		sort.Slice(rs, func(i, j int) bool {
+			if rs[i].Protocol != rs[j].Protocol {
+				return rs[i].Protocol < rs[j].Protocol
+			}
+			if rs[i].Port != rs[j].Port {
+				return rs[i].Port < rs[j].Port
+			}
+			if rs[i].Description != rs[j].Description {
+				return rs[i].Description < rs[j].Description
+			}
+			if rs[i].SourceSecurityGroup != rs[j].SourceSecurityGroup {
+				return rs[i].SourceSecurityGroup < rs[j].SourceSecurityGroup
+			}
+			return strings.Join(rs[i].CIDRs(), ",") < strings.Join(rs[j].CIDRs(), ",")
+		})
+		snapshot.Rules = append(snapshot.Rules, Rules{
+			Name:        r.Name,
+			Rules:       rs,
+			ProviderIDs: providerIDs,
+		})
+	}
+	sort.Slice(snapshot.Rules, func(i, j int) bool {
+		return snapshot.Rules[i].Name < snapshot.Rules[j].Name
+	})
+	return snapshot
+}
+
+// Same returns true if both snapshots hold the same rules, whatever their time.
+func (s *Snapshot) Same(o *Snapshot) bool {
+	if len(s.Rules) != len(o.Rules) {
+		return false
+	}
+	for i, r := range s.Rules {
+		other := o.Rules[i]
+		if r.Name != other.Name || len(r.Rules) != len(other.Rules) || len(r.ProviderIDs) != len(other.ProviderIDs) {
+			return false
+		}
+		for j, rule := range r.Rules {
+			if !rule.Equal(other.Rules[j]) {
+				return false
+			}
+		}
+		for j, id := range r.ProviderIDs {
+			if id != other.ProviderIDs[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package history
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+var _ Store = &ConfigMapStore{}
+
+func newRules(name string, port int, providerIDs ...string) *inbound.InboundRules {
+	return &inbound.InboundRules{
+		Name:        name,
+		Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: port, Description: "default/" + name}},
+		ProviderIDs: providerIDs,
+	}
+}
+
+func TestSnapshotSame(t *testing.T) {
+	now := time.Now()
+	snapshot := NewSnapshot(now, []*inbound.InboundRules{
+		newRules("foo.kube.openfresh.io", 80, "aws:///us-east-1a/i-2", "aws:///us-east-1a/i-1"),
+		newRules("bar.kube.openfresh.io", 443),
+	})
+	assert.Equal(t, "bar.kube.openfresh.io", snapshot.Rules[0].Name)
+	assert.Equal(t, []string{"aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"}, snapshot.Rules[1].ProviderIDs)
+
+	// the order of the rules and instances doesn't matter, nor the time
+	assert.True(t, snapshot.Same(NewSnapshot(now.Add(time.Hour), []*inbound.InboundRules{
+		newRules("bar.kube.openfresh.io", 443),
+		newRules("foo.kube.openfresh.io", 80, "aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"),
+	})))
+	assert.False(t, snapshot.Same(NewSnapshot(now, []*inbound.InboundRules{
+		newRules("bar.kube.openfresh.io", 443),
+		newRules("foo.kube.openfresh.io", 8080, "aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"),
+	})))
+	assert.False(t, snapshot.Same(NewSnapshot(now, []*inbound.InboundRules{
+		newRules("bar.kube.openfresh.io", 443),
+		newRules("foo.kube.openfresh.io", 80, "aws:///us-east-1a/i-1"),
+	})))
+}
+
+func TestConfigMapStore(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	s := NewConfigMapStore(client, "kube-system", "firewall-history", 24*time.Hour)
+	start := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	_, err := s.At(start)
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	require.NoError(t, s.Save(NewSnapshot(start, []*inbound.InboundRules{newRules("foo.kube.openfresh.io", 80)})))
+	require.NoError(t, s.Save(NewSnapshot(start.Add(time.Hour), []*inbound.InboundRules{newRules("foo.kube.openfresh.io", 443)})))
+
+	_, err = s.At(start.Add(-time.Minute))
+	assert.Equal(t, ErrNoSnapshot, err)
+
+	// a snapshot is in effect until the next one
+	snapshot, err := s.At(start.Add(30 * time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, start, snapshot.Time)
+	assert.Equal(t, 80, snapshot.Rules[0].Rules[0].Port)
+
+	snapshot, err = s.At(start.Add(2 * time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 443, snapshot.Rules[0].Rules[0].Port)
+
+	// the snapshots older than the retention are dropped
+	require.NoError(t, s.Save(NewSnapshot(start.Add(25*time.Hour), nil)))
+	cm, err := client.CoreV1().ConfigMaps("kube-system").Get("firewall-history", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Len(t, cm.Data, 2)
+}
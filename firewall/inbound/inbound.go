@@ -6,10 +6,54 @@ package inbound
 import (
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 )
 
+const (
+	// AnyCIDR is the source range of the rules opened to any address.
+	AnyCIDR = "0.0.0.0/0"
+	// SourceSecurityGroupSelf stands for the security group holding the rule, so
+	// that the port is opened to the nodes the rules apply to.
+	SourceSecurityGroupSelf = "self"
+)
+
+// The protocols of the rules, by their lowercase name.
+const (
+	ProtocolTCP  = "tcp"
+	ProtocolUDP  = "udp"
+	ProtocolSCTP = "sctp"
+)
+
+// DefaultProtocols are the protocols supported by the firewall providers which
+// don't tell theirs.
+var DefaultProtocols = []string{ProtocolTCP, ProtocolUDP}
+
+const (
+	// AcceleratorAffinityNone spreads the clients of the accelerated rules over the nodes.
+	AcceleratorAffinityNone = "none"
+	// AcceleratorAffinitySourceIP sends the clients of the accelerated rules to the same node.
+	AcceleratorAffinitySourceIP = "source-ip"
+)
+
+// protocolNumbers maps the IANA numbers of the protocols to their names.
+var protocolNumbers = map[string]string{
+	"6":   ProtocolTCP,
+	"17":  ProtocolUDP,
+	"132": ProtocolSCTP,
+}
+
 type ProviderIDs []string
 
+// NewProviderIDs returns the given ProviderIDs sorted, so that comparing them
+// doesn't need to sort them.
+func NewProviderIDs(ids ...string) ProviderIDs {
+	t := make(ProviderIDs, len(ids))
+	copy(t, ids)
+	sort.Sort(t)
+	return t
+}
+
 func (t ProviderIDs) Len() int {
 	return len(t)
 }
@@ -22,46 +66,89 @@ func (t ProviderIDs) Swap(i, j int) {
 	t[i], t[j] = t[j], t[i]
 }
 
-// Same compares to Targets and returns true if they are completely identical
+// Same compares to Targets and returns true if they are completely identical.
+// Neither of them is modified, the instances are compared in their canonical form.
 func (t ProviderIDs) Same(o ProviderIDs) bool {
 	if len(t) != len(o) {
 		return false
 	}
-	sort.Stable(t)
-	sort.Stable(o)
+	// most instances are listed in the same order, which spares sorting them
+	if sameStrings(t, o) {
+		return true
+	}
+	return sameStrings(t.Canonical(), o.Canonical())
+}
 
-	for i, e := range t {
-		if e != o[i] {
-			return false
-		}
+// Canonical returns the ProviderIDs sorted, as they are if already sorted and
+// copied otherwise, so that the ProviderIDs shared by several rules aren't
+// reordered under them.
+func (t ProviderIDs) Canonical() ProviderIDs {
+	if sort.IsSorted(t) {
+		return t
 	}
-	return true
+	return NewProviderIDs(t...)
 }
 
 type InboundRules struct {
 	Name        string
 	Rules       []InboundRule
 	ProviderIDs ProviderIDs
+	// the metadata of the current rules, e.g. the descriptions of their sources,
+	// drifted from what was applied, so that they're updated even if the same
+	Drifted bool
+	// the current rules lost their ownership tag, so that they're only updated,
+	// restoring it, if desired and left alone otherwise
+	Untagged bool
+	// the changes of the desired rules are computed and reported but not applied
+	DryRun bool
+	// the labels copied from the service requesting the rules, not stored by the providers
+	Labels map[string]string
+	// the name of the desired rules under the default naming scheme, whose current
+	// rules are kept under that name rather than replaced, empty if the same
+	LegacyName string
+	// the resource the rules belong to, as namespace/name, identifying their security
+	// group whatever its name, empty for the security groups created before
+	Resource string
+	// the unknown external-ips annotations of the service requesting the rules, by key
+	// without their prefix, for the providers to interpret or ignore, not stored by them
+	Extensions map[string]string
+	// the client affinity of the listeners exposing the rules through the accelerator of
+	// the cluster, empty if the rules aren't exposed through it, not stored by the providers
+	AcceleratorAffinity string
 }
 
 func (ir InboundRules) String() string {
 	result := ir.Name
 	for _, r := range ir.Rules {
 		result += fmt.Sprintf(" %s:%d", r.Protocol, r.Port)
+		if r.ToPort != 0 {
+			result += fmt.Sprintf("-%d", r.ToPort)
+		}
 	}
 	return result
 }
 
+// Same returns true if both have the same rules, in any order, including their descriptions
 func (ir *InboundRules) Same(o *InboundRules) bool {
 	if len(ir.Rules) != len(o.Rules) {
 		return false
 	}
 
+	// most rules are listed in the same order, which spares sorting them
+	same := true
 	for i, r := range ir.Rules {
-		if r.Protocol != o.Rules[i].Protocol {
-			return false
+		if !r.Equal(o.Rules[i]) {
+			same = false
+			break
 		}
-		if r.Port != o.Rules[i].Port {
+	}
+	if same {
+		return true
+	}
+
+	rules, other := sortedRules(ir.Rules), sortedRules(o.Rules)
+	for i, r := range rules {
+		if !r.Equal(other[i]) {
 			return false
 		}
 	}
@@ -71,6 +158,151 @@ func (ir *InboundRules) Same(o *InboundRules) bool {
 type InboundRule struct {
 	Protocol string
 	Port     int
+	// the last port of the range opened from Port, 0 when only Port is opened
+	ToPort int
+	// the workload the port is opened for, as namespace/name/port, so that it can be audited
+	Description string
+	// the source ranges the port is opened to, in addition to SourceSecurityGroup,
+	// any address if both are empty
+	SourceCIDRs []string
+	// the security group the port is opened to, SourceSecurityGroupSelf for the
+	// security group holding the rule
+	SourceSecurityGroup string
+}
+
+// LastPort returns the last port opened by the rule, Port unless it opens a range.
+func (r InboundRule) LastPort() int {
+	if r.ToPort == 0 {
+		return r.Port
+	}
+	return r.ToPort
+}
+
+// CIDRs returns the source ranges the port is opened to, sorted and without
+// duplicates, AnyCIDR if the rule has no source at all.
+func (r InboundRule) CIDRs() []string {
+	if len(r.SourceCIDRs) == 0 {
+		if r.SourceSecurityGroup == "" {
+			return []string{AnyCIDR}
+		}
+		return nil
+	}
+	seen := make(map[string]bool, len(r.SourceCIDRs))
+	cidrs := make([]string, 0, len(r.SourceCIDRs))
+	for _, cidr := range r.SourceCIDRs {
+		if !seen[cidr] {
+			seen[cidr] = true
+			cidrs = append(cidrs, cidr)
+		}
+	}
+	sort.Strings(cidrs)
+	return cidrs
+}
+
+// Equal returns true if both rules open the same port to the same sources for the same workload.
+// The sources are only normalized when they aren't listed the same way.
+func (r InboundRule) Equal(o InboundRule) bool {
+	if r.Protocol != o.Protocol || r.Port != o.Port || r.LastPort() != o.LastPort() || r.Description != o.Description || r.SourceSecurityGroup != o.SourceSecurityGroup {
+		return false
+	}
+	return sameStrings(r.SourceCIDRs, o.SourceCIDRs) || sameStrings(r.CIDRs(), o.CIDRs())
+}
+
+func sortedRules(rules []InboundRule) []InboundRule {
+	// the sources are normalized once rather than on each comparison
+	type keyedRule struct {
+		InboundRule
+		cidrs string
+	}
+	keyed := make([]keyedRule, len(rules))
+	for i, r := range rules {
+		keyed[i] = keyedRule{r, strings.Join(r.CIDRs(), ",")}
+	}
+	sort.Slice(keyed, func(i, j int) bool {
+		if keyed[i].Protocol != keyed[j].Protocol {
+			return keyed[i].Protocol < keyed[j].Protocol
+		}
+		if keyed[i].Port != keyed[j].Port {
+			return keyed[i].Port < keyed[j].Port
+		}
+		if keyed[i].LastPort() != keyed[j].LastPort() {
+			return keyed[i].LastPort() < keyed[j].LastPort()
+		}
+		if keyed[i].Description != keyed[j].Description {
+			return keyed[i].Description < keyed[j].Description
+		}
+		if keyed[i].SourceSecurityGroup != keyed[j].SourceSecurityGroup {
+			return keyed[i].SourceSecurityGroup < keyed[j].SourceSecurityGroup
+		}
+		return keyed[i].cidrs < keyed[j].cidrs
+	})
+	sorted := make([]InboundRule, len(keyed))
+	for i, k := range keyed {
+		sorted[i] = k.InboundRule
+	}
+	return sorted
+}
+
+// ParsePortRange parses a range of ports as first-last, or first+count like the
+// --service-node-port-range flag of the kube-apiserver.
+func ParsePortRange(s string) (int, int, error) {
+	sep := strings.IndexAny(s, "-+")
+	if sep < 0 {
+		return 0, 0, fmt.Errorf("invalid port range, expected first-last or first+count: %q", s)
+	}
+	first, err := strconv.Atoi(strings.TrimSpace(s[:sep]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(s[sep+1:]))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port range %q: %v", s, err)
+	}
+	last := n
+	if s[sep] == '+' {
+		last = first + n - 1
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, fmt.Errorf("invalid port range %q", s)
+	}
+	return first, last, nil
+}
+
+// ParseProtocol returns the protocol of a rule by its lowercase name, given by name in
+// any case, e.g. the protocol of a port of a service, or by its IANA number.
+func ParseProtocol(s string) (string, error) {
+	protocol := strings.ToLower(strings.TrimSpace(s))
+	if name, ok := protocolNumbers[protocol]; ok {
+		return name, nil
+	}
+	switch protocol {
+	case ProtocolTCP, ProtocolUDP, ProtocolSCTP:
+		return protocol, nil
+	}
+	return "", fmt.Errorf("unsupported protocol %q, expected tcp, udp or sctp", s)
+}
+
+// SupportsProtocol returns true if the protocol is among the given protocols.
+func SupportsProtocol(protocols []string, protocol string) bool {
+	for _, p := range protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// sameStrings returns true if both lists hold the same strings in the same order.
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, s := range a {
+		if s != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 func NewInboundRules() *InboundRules {
@@ -0,0 +1,175 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package inbound
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInboundRulesSame(t *testing.T) {
+	rules := &InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+			{Protocol: "udp", Port: 5000, Description: "default/foo/5000"},
+		},
+	}
+
+	// the order of the rules doesn't matter
+	assert.True(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "udp", Port: 5000, Description: "default/foo/5000"},
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+		},
+	}))
+	assert.Equal(t, "tcp", rules.Rules[0].Protocol)
+
+	// a rule opened for another workload is updated
+	assert.False(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80},
+			{Protocol: "udp", Port: 5000, Description: "default/foo/5000"},
+		},
+	}))
+
+	assert.False(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+		},
+	}))
+}
+
+func TestInboundRulesSameSources(t *testing.T) {
+	rules := &InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+			{Protocol: "tcp", Port: 8080, Description: "default/foo/admin", SourceCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+			{Protocol: "tcp", Port: 9090, Description: "default/foo/metrics", SourceSecurityGroup: SourceSecurityGroupSelf},
+		},
+	}
+
+	// a rule without source is opened to any address, the order of the ranges doesn't matter
+	assert.True(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 9090, Description: "default/foo/metrics", SourceSecurityGroup: SourceSecurityGroupSelf},
+			{Protocol: "tcp", Port: 8080, Description: "default/foo/admin", SourceCIDRs: []string{"192.168.0.0/16", "10.0.0.0/8"}},
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http", SourceCIDRs: []string{AnyCIDR}},
+		},
+	}))
+
+	// a rule opened to other sources is updated
+	assert.False(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+			{Protocol: "tcp", Port: 8080, Description: "default/foo/admin", SourceCIDRs: []string{"10.0.0.0/8"}},
+			{Protocol: "tcp", Port: 9090, Description: "default/foo/metrics", SourceSecurityGroup: SourceSecurityGroupSelf},
+		},
+	}))
+	assert.False(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/foo/http"},
+			{Protocol: "tcp", Port: 8080, Description: "default/foo/admin", SourceCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+			{Protocol: "tcp", Port: 9090, Description: "default/foo/metrics"},
+		},
+	}))
+}
+
+func TestInboundRulesSamePortRange(t *testing.T) {
+	rules := &InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 30000, ToPort: 32767, Description: "default/foo/node-ports"},
+		},
+	}
+	assert.Equal(t, " tcp:30000-32767", rules.String())
+
+	assert.True(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 30000, ToPort: 32767, Description: "default/foo/node-ports"},
+		},
+	}))
+	assert.False(t, rules.Same(&InboundRules{
+		Rules: []InboundRule{
+			{Protocol: "tcp", Port: 30000, Description: "default/foo/node-ports"},
+		},
+	}))
+	// a range of a single port is the port
+	assert.True(t, (&InboundRules{Rules: []InboundRule{{Protocol: "tcp", Port: 80}}}).Same(&InboundRules{
+		Rules: []InboundRule{{Protocol: "tcp", Port: 80, ToPort: 80}},
+	}))
+}
+
+func TestParsePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		s           string
+		first, last int
+		valid       bool
+	}{
+		{"30000-32767", 30000, 32767, true},
+		{"30000+2768", 30000, 32767, true},
+		{"80-80", 80, 80, true},
+		{"32767-30000", 0, 0, false},
+		{"0-100", 0, 0, false},
+		{"30000-70000", 0, 0, false},
+		{"30000", 0, 0, false},
+		{"a-b", 0, 0, false},
+	} {
+		first, last, err := ParsePortRange(tc.s)
+		if !tc.valid {
+			assert.Error(t, err, tc.s)
+			continue
+		}
+		assert.NoError(t, err, tc.s)
+		assert.Equal(t, tc.first, first, tc.s)
+		assert.Equal(t, tc.last, last, tc.s)
+	}
+}
+
+func TestParseProtocol(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		protocol string
+		valid    bool
+	}{
+		{"TCP", ProtocolTCP, true},
+		{"udp", ProtocolUDP, true},
+		{"SCTP", ProtocolSCTP, true},
+		{"132", ProtocolSCTP, true},
+		{"6", ProtocolTCP, true},
+		{"icmp", "", false},
+		{"", "", false},
+	} {
+		protocol, err := ParseProtocol(tc.s)
+		if !tc.valid {
+			assert.Error(t, err, tc.s)
+			continue
+		}
+		assert.NoError(t, err, tc.s)
+		assert.Equal(t, tc.protocol, protocol, tc.s)
+	}
+
+	assert.True(t, SupportsProtocol(DefaultProtocols, ProtocolUDP))
+	assert.False(t, SupportsProtocol(DefaultProtocols, ProtocolSCTP))
+}
+
+func TestProviderIDsSame(t *testing.T) {
+	ids := ProviderIDs{"aws:///us-east-1a/i-2", "aws:///us-east-1a/i-1"}
+	other := ProviderIDs{"aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"}
+
+	assert.True(t, ids.Same(other))
+	assert.True(t, other.Same(ids))
+	assert.False(t, ids.Same(ProviderIDs{"aws:///us-east-1a/i-1"}))
+	assert.False(t, ids.Same(ProviderIDs{"aws:///us-east-1a/i-1", "aws:///us-east-1a/i-3"}))
+
+	// the instances shared by the rules aren't reordered by comparing them
+	assert.Equal(t, ProviderIDs{"aws:///us-east-1a/i-2", "aws:///us-east-1a/i-1"}, ids)
+	assert.Equal(t, ProviderIDs{"aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"}, other)
+}
+
+func TestNewProviderIDs(t *testing.T) {
+	ids := []string{"aws:///us-east-1a/i-2", "aws:///us-east-1a/i-1"}
+
+	assert.Equal(t, ProviderIDs{"aws:///us-east-1a/i-1", "aws:///us-east-1a/i-2"}, NewProviderIDs(ids...))
+	assert.Equal(t, []string{"aws:///us-east-1a/i-2", "aws:///us-east-1a/i-1"}, ids)
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// benchmarkRules returns the current and desired rules of a sync where one rule
+// in a hundred opens another port and moves to another instance.
+func benchmarkRules(n int) (current, desired []*inbound.InboundRules) {
+	current = make([]*inbound.InboundRules, 0, n)
+	desired = make([]*inbound.InboundRules, 0, n)
+	newRules := func(i, port int, providerIDs ...string) *inbound.InboundRules {
+		return &inbound.InboundRules{
+			Name: fmt.Sprintf("svc-%d.default.kube.openfresh.io", i),
+			Rules: []inbound.InboundRule{
+				{Protocol: "tcp", Port: 443, Description: fmt.Sprintf("default/svc-%d/https", i)},
+				{Protocol: "tcp", Port: port, Description: fmt.Sprintf("default/svc-%d/admin", i), SourceCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+				{Protocol: "udp", Port: 5000, Description: fmt.Sprintf("default/svc-%d/game", i), SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+			},
+			ProviderIDs: providerIDs,
+		}
+	}
+	for i := 0; i < n; i++ {
+		a := fmt.Sprintf("aws:///us-east-1a/i-%08d", i%1000)
+		b := fmt.Sprintf("aws:///us-east-1c/i-%08d", (i+1)%1000)
+		current = append(current, newRules(i, 8080, a, b))
+		if i%100 == 0 {
+			desired = append(desired, newRules(i, 8081, a, fmt.Sprintf("aws:///us-east-1c/i-%08d", (i+2)%1000)))
+		} else {
+			desired = append(desired, newRules(i, 8080, a, b))
+		}
+	}
+	return current, desired
+}
+
+func benchmarkCalculate(b *testing.B, n int) {
+	current, desired := benchmarkRules(n)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		p := &Plan{
+			Current: current,
+			Desired: desired,
+		}
+		p.Calculate()
+	}
+}
+
+func BenchmarkCalculate10k(b *testing.B)  { benchmarkCalculate(b, 10000) }
+func BenchmarkCalculate100k(b *testing.B) { benchmarkCalculate(b, 100000) }
@@ -0,0 +1,42 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// Split separates the changes of the rules in dry-run, as told by dryRun from their
+// name, from the changes to apply. The assignments of the rules to the instances
+// follow their rules.
+func (c *Changes) Split(dryRun func(name string) bool) (apply, skipped *Changes) {
+	apply, skipped = &Changes{}, &Changes{}
+	split := func(rules []*inbound.InboundRules, apply, skipped *[]*inbound.InboundRules) {
+		for _, r := range rules {
+			if dryRun(r.Name) {
+				*skipped = append(*skipped, r)
+			} else {
+				*apply = append(*apply, r)
+			}
+		}
+	}
+	split(c.Create, &apply.Create, &skipped.Create)
+	split(c.Delete, &apply.Delete, &skipped.Delete)
+	// the updates are paired by name
+	split(c.UpdateOld, &apply.UpdateOld, &skipped.UpdateOld)
+	split(c.UpdateNew, &apply.UpdateNew, &skipped.UpdateNew)
+
+	splitInstances := func(rules []*InstanceRule, apply, skipped *[]*InstanceRule) {
+		for _, i := range rules {
+			if dryRun(i.RulesName) {
+				*skipped = append(*skipped, i)
+			} else {
+				*apply = append(*apply, i)
+			}
+		}
+	}
+	splitInstances(c.Set, &apply.Set, &skipped.Set)
+	splitInstances(c.Unset, &apply.Unset, &skipped.Unset)
+	return apply, skipped
+}
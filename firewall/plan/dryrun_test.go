@@ -0,0 +1,46 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+func TestChangesSplit(t *testing.T) {
+	rules := func(name string, port int) *inbound.InboundRules {
+		return &inbound.InboundRules{
+			Name:        name,
+			Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: port}},
+			ProviderIDs: inbound.ProviderIDs{"i-1"},
+		}
+	}
+
+	changes := (&Plan{
+		Current: []*inbound.InboundRules{rules("applied", 80), rules("dry", 80)},
+		Desired: []*inbound.InboundRules{rules("applied", 443), rules("dry", 443), rules("dry-created", 80)},
+	}).Calculate().Changes
+	apply, skipped := changes.Split(func(name string) bool {
+		return name == "dry" || name == "dry-created"
+	})
+
+	assert.Len(t, apply.Create, 0)
+	if assert.Len(t, apply.UpdateNew, 1) && assert.Len(t, apply.UpdateOld, 1) {
+		assert.Equal(t, "applied", apply.UpdateNew[0].Name)
+		assert.Equal(t, "applied", apply.UpdateOld[0].Name)
+	}
+	assert.Len(t, apply.Set, 0)
+
+	if assert.Len(t, skipped.Create, 1) {
+		assert.Equal(t, "dry-created", skipped.Create[0].Name)
+	}
+	if assert.Len(t, skipped.UpdateNew, 1) && assert.Len(t, skipped.UpdateOld, 1) {
+		assert.Equal(t, "dry", skipped.UpdateNew[0].Name)
+		assert.Equal(t, "dry", skipped.UpdateOld[0].Name)
+	}
+	assert.Equal(t, []*InstanceRule{{ProviderID: "i-1", RulesName: "dry-created"}}, skipped.Set)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+)
+
+// GroupError is the failure to apply the changes of a single security group,
+// returned by the providers telling which group failed so that the controller
+// can back off that group alone.
+type GroupError struct {
+	Group string
+	Err   error
+}
+
+func (e *GroupError) Error() string {
+	return fmt.Sprintf("security group %s: %v", e.Group, e.Err)
+}
+
+// WrapGroupError returns err as the failure of the given group, err itself if nil,
+// already a GroupError or if the group is unknown. The providers defer it over the
+// group being changed, so that any failure is reported with the group failing.
+func WrapGroupError(group string, err error) error {
+	if err == nil || group == "" {
+		return err
+	}
+	if _, ok := err.(*GroupError); ok {
+		return err
+	}
+	return &GroupError{Group: group, Err: err}
+}
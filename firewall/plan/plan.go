@@ -4,6 +4,8 @@
 package plan
 
 import (
+	log "github.com/sirupsen/logrus"
+
 	"github.com/openfresh/external-ips/firewall/inbound"
 )
 
@@ -12,6 +14,9 @@ type Plan struct {
 	Current []*inbound.InboundRules
 	// List of desired rules
 	Desired []*inbound.InboundRules
+	// The reason of the exclusion of the nodes never exposed, by providerID. Their
+	// rules are never set, whatever the desired rules, only unset.
+	Excluded map[string]string
 	// List of changes necessary to move towards desired state
 	// Populated after calling Calculate()
 	Changes *Changes
@@ -44,10 +49,15 @@ type Changes struct {
 
 type planTable struct {
 	rows map[string]*planTableRow
+	// the rows are allocated together rather than one by one
+	slab []planTableRow
 }
 
-func newPlanTable() planTable { //TODO: make resolver configurable
-	return planTable{map[string]*planTableRow{}}
+func newPlanTable(size int) *planTable { //TODO: make resolver configurable
+	return &planTable{
+		rows: make(map[string]*planTableRow, size),
+		slab: make([]planTableRow, 0, size),
+	}
 }
 
 type planTableRow struct {
@@ -55,51 +65,57 @@ type planTableRow struct {
 	candidate *inbound.InboundRules
 }
 
-func (t planTable) addCurrent(r *inbound.InboundRules) {
-	if _, ok := t.rows[r.Name]; !ok {
-		t.rows[r.Name] = &planTableRow{}
+func (t *planTable) row(name string) *planTableRow {
+	row, ok := t.rows[name]
+	if !ok {
+		t.slab = append(t.slab, planTableRow{})
+		row = &t.slab[len(t.slab)-1]
+		t.rows[name] = row
 	}
-	t.rows[r.Name].current = r
+	return row
 }
 
-func (t planTable) addCandidate(r *inbound.InboundRules) {
-	if _, ok := t.rows[r.Name]; !ok {
-		t.rows[r.Name] = &planTableRow{}
-	}
-	t.rows[r.Name].candidate = r
+func (t *planTable) addCurrent(r *inbound.InboundRules) {
+	t.row(r.Name).current = r
+}
+
+func (t *planTable) addCandidate(r *inbound.InboundRules) {
+	t.row(r.Name).candidate = r
 }
 
+// planTable2 is keyed by the assignment itself, concatenating the provider ID
+// and the rules name would mix up e.g. "a"+"bc" and "ab"+"c". The rows only
+// tell whether the assignment is current and desired, so that they're stored
+// in the map itself.
 type planTable2 struct {
-	rows map[string]*planTable2Row
+	rows map[InstanceRule]planTable2Row
 }
 
-func newPlanTable2() planTable2 { //TODO: make resolver configurable
-	return planTable2{map[string]*planTable2Row{}}
+func newPlanTable2(size int) planTable2 { //TODO: make resolver configurable
+	return planTable2{make(map[InstanceRule]planTable2Row, size)}
 }
 
 type planTable2Row struct {
-	current   *InstanceRule
-	candidate *InstanceRule
+	current   bool
+	candidate bool
 }
 
-func (t planTable2) addCurrent(i *InstanceRule) {
-	if _, ok := t.rows[i.ProviderID+i.RulesName]; !ok {
-		t.rows[i.ProviderID+i.RulesName] = &planTable2Row{}
-	}
-	t.rows[i.ProviderID+i.RulesName].current = i
+func (t planTable2) addCurrent(i InstanceRule) {
+	row := t.rows[i]
+	row.current = true
+	t.rows[i] = row
 }
 
-func (t planTable2) addCandidate(i *InstanceRule) {
-	if _, ok := t.rows[i.ProviderID+i.RulesName]; !ok {
-		t.rows[i.ProviderID+i.RulesName] = &planTable2Row{}
-	}
-	t.rows[i.ProviderID+i.RulesName].candidate = i
+func (t planTable2) addCandidate(i InstanceRule) {
+	row := t.rows[i]
+	row.candidate = true
+	t.rows[i] = row
 }
 
-func (t planTable) getUpdates() (updateNew []*inbound.InboundRules, updateOld []*inbound.InboundRules) {
+func (t *planTable) getUpdates() (updateNew []*inbound.InboundRules, updateOld []*inbound.InboundRules) {
 	for _, row := range t.rows {
 		if row.current != nil && row.candidate != nil {
-			if !row.current.Same(row.current) {
+			if row.current.Drifted || row.current.Untagged || !row.candidate.Same(row.current) {
 				updateNew = append(updateNew, row.candidate)
 				updateOld = append(updateOld, row.current)
 			}
@@ -109,7 +125,7 @@ func (t planTable) getUpdates() (updateNew []*inbound.InboundRules, updateOld []
 	return
 }
 
-func (t planTable) getCreates() (createList []*inbound.InboundRules) {
+func (t *planTable) getCreates() (createList []*inbound.InboundRules) {
 	for _, row := range t.rows {
 		if row.current == nil {
 			createList = append(createList, row.candidate)
@@ -118,7 +134,7 @@ func (t planTable) getCreates() (createList []*inbound.InboundRules) {
 	return
 }
 
-func (t planTable) getDeletes() (deleteList []*inbound.InboundRules) {
+func (t *planTable) getDeletes() (deleteList []*inbound.InboundRules) {
 	for _, row := range t.rows {
 		if row.current != nil && row.candidate == nil {
 			deleteList = append(deleteList, row.current)
@@ -128,18 +144,20 @@ func (t planTable) getDeletes() (deleteList []*inbound.InboundRules) {
 }
 
 func (t planTable2) getSets() (setList []*InstanceRule) {
-	for _, row := range t.rows {
-		if row.current == nil {
-			setList = append(setList, row.candidate)
+	for ir, row := range t.rows {
+		if !row.current {
+			ir := ir
+			setList = append(setList, &ir)
 		}
 	}
 	return
 }
 
 func (t planTable2) getUnsets() (unsetList []*InstanceRule) {
-	for _, row := range t.rows {
-		if row.current != nil && row.candidate == nil {
-			unsetList = append(unsetList, row.current)
+	for ir, row := range t.rows {
+		if row.current && !row.candidate {
+			ir := ir
+			unsetList = append(unsetList, &ir)
 		}
 	}
 	return
@@ -149,27 +167,36 @@ func (t planTable2) getUnsets() (unsetList []*InstanceRule) {
 // state. It then passes those changes to the current policy for further
 // processing. It returns a copy of Plan with the changes populated.
 func (p *Plan) Calculate() *Plan {
-	t := newPlanTable()
-	t2 := newPlanTable2()
+	// the security groups are matched by resource, then by name
+	desiredRules := AdoptCurrentNames(p.Current, p.Desired)
+	t := newPlanTable(len(p.Current) + len(p.Desired))
+	t2 := newPlanTable2(instanceRules(p.Current) + instanceRules(p.Desired))
+
+	desired := make(map[string]bool, len(desiredRules))
+	for _, r := range desiredRules {
+		desired[r.Name] = true
+	}
 
 	for _, current := range p.Current {
+		// the rules which lost their ownership tag are only taken back if desired
+		if current.Untagged && !desired[current.Name] {
+			continue
+		}
 		t.addCurrent(current)
 		for _, id := range current.ProviderIDs {
-			ir := InstanceRule{
+			t2.addCurrent(InstanceRule{
 				ProviderID: id,
 				RulesName:  current.Name,
-			}
-			t2.addCurrent(&ir)
+			})
 		}
 	}
-	for _, desired := range p.Desired {
+	for _, desired := range desiredRules {
 		t.addCandidate(desired)
 		for _, id := range desired.ProviderIDs {
-			ir := InstanceRule{
+			t2.addCandidate(InstanceRule{
 				ProviderID: id,
 				RulesName:  desired.Name,
-			}
-			t2.addCandidate(&ir)
+			})
 		}
 	}
 
@@ -177,14 +204,80 @@ func (p *Plan) Calculate() *Plan {
 	changes.Create = t.getCreates()
 	changes.Delete = t.getDeletes()
 	changes.UpdateNew, changes.UpdateOld = t.getUpdates()
-	changes.Set = t2.getSets()
+	changes.Set = p.allowedSets(t2.getSets())
 	changes.Unset = t2.getUnsets()
 
 	plan := &Plan{
-		Current: p.Current,
-		Desired: p.Desired,
-		Changes: changes,
+		Current:  p.Current,
+		Desired:  p.Desired,
+		Excluded: p.Excluded,
+		Changes:  changes,
 	}
 
 	return plan
 }
+
+// allowedSets returns the assignments of the rules but the ones to excluded nodes,
+// the safety net of a source which would select them anyway.
+func (p *Plan) allowedSets(sets []*InstanceRule) []*InstanceRule {
+	if len(p.Excluded) == 0 {
+		return sets
+	}
+	result := make([]*InstanceRule, 0, len(sets))
+	for _, ir := range sets {
+		if reason, ok := p.Excluded[ir.ProviderID]; ok {
+			log.Errorf("Not assigning security group %s to %s, excluded from the exposure by its %s", ir.RulesName, ir.ProviderID, reason)
+			continue
+		}
+		result = append(result, ir)
+	}
+	return result
+}
+
+// instanceRules returns the number of assignments of the rules to instances.
+func instanceRules(rules []*inbound.InboundRules) int {
+	n := 0
+	for _, r := range rules {
+		n += len(r.ProviderIDs)
+	}
+	return n
+}
+
+// AdoptCurrentNames returns the desired rules, the ones whose security group already
+// exists under another name being renamed after it, so that it's updated rather than
+// replaced. The security groups are identified by the resource they belong to, their
+// name only being displayed, and the ones created before they were tagged with their
+// resource by their name, or by their legacy name as long as the new one doesn't
+// exist. The desired rules aren't modified.
+func AdoptCurrentNames(current, desired []*inbound.InboundRules) []*inbound.InboundRules {
+	resources := make(map[string]string, len(current))
+	names := make(map[string]string, len(current))
+	for _, r := range current {
+		if _, ok := names[r.Name]; !ok {
+			names[r.Name] = r.Resource
+		}
+		if _, ok := resources[r.Resource]; !ok && r.Resource != "" {
+			resources[r.Resource] = r.Name
+		}
+	}
+
+	result := make([]*inbound.InboundRules, 0, len(desired))
+	for _, r := range desired {
+		name := r.Name
+		if current, ok := resources[r.Resource]; ok && r.Resource != "" {
+			name = current
+		} else if _, ok := names[r.Name]; !ok && r.LegacyName != "" {
+			if resource, ok := names[r.LegacyName]; ok && (resource == "" || resource == r.Resource) {
+				name = r.LegacyName
+			}
+		}
+		if name != r.Name {
+			log.Debugf("Keeping security group %s in place of %s", name, r.Name)
+			adopted := *r
+			adopted.Name = name
+			r = &adopted
+		}
+		result = append(result, r)
+	}
+	return result
+}
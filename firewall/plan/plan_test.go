@@ -0,0 +1,116 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+func TestCalculateDrift(t *testing.T) {
+	rules := func(name string) *inbound.InboundRules {
+		return &inbound.InboundRules{
+			Name:        name,
+			Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80, Description: "default/" + name + "/80"}},
+			ProviderIDs: inbound.ProviderIDs{"i-1"},
+		}
+	}
+	drifted, untagged, unwanted := rules("drifted"), rules("untagged"), rules("unwanted")
+	drifted.Drifted = true
+	untagged.Untagged = true
+	unwanted.Untagged = true
+
+	changes := (&Plan{
+		Current: []*inbound.InboundRules{drifted, untagged, unwanted},
+		Desired: []*inbound.InboundRules{rules("drifted"), rules("untagged")},
+	}).Calculate().Changes
+
+	// the drifted and untagged rules are updated even if the same, the untagged
+	// rules which aren't desired are left alone
+	assert.ElementsMatch(t, []*inbound.InboundRules{drifted, untagged}, changes.UpdateOld)
+	assert.Len(t, changes.UpdateNew, 2)
+	assert.Empty(t, changes.Create)
+	assert.Empty(t, changes.Delete)
+	assert.Empty(t, changes.Set)
+	assert.Empty(t, changes.Unset)
+}
+
+func TestCalculateExcluded(t *testing.T) {
+	current := &inbound.InboundRules{
+		Name:        "foo",
+		Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80}},
+		ProviderIDs: inbound.ProviderIDs{"i-1"},
+	}
+	desired := &inbound.InboundRules{
+		Name:        "foo",
+		Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80}},
+		ProviderIDs: inbound.ProviderIDs{"i-2", "i-3"},
+	}
+
+	changes := (&Plan{
+		Current:  []*inbound.InboundRules{current},
+		Desired:  []*inbound.InboundRules{desired},
+		Excluded: map[string]string{"i-1": "label dedicated=ci", "i-3": "label dedicated=ci"},
+	}).Calculate().Changes
+
+	// the rules are never set on the excluded nodes, but still unset
+	assert.Equal(t, []*InstanceRule{{ProviderID: "i-2", RulesName: "foo"}}, changes.Set)
+	assert.Equal(t, []*InstanceRule{{ProviderID: "i-1", RulesName: "foo"}}, changes.Unset)
+}
+
+func TestAdoptCurrentNames(t *testing.T) {
+	legacy := &inbound.InboundRules{Name: "foo.web.cluster"}
+	migrated := &inbound.InboundRules{Name: "web-bar.cluster"}
+	tagged := &inbound.InboundRules{Name: "qux.web.cluster", Resource: "web/qux"}
+	desired := []*inbound.InboundRules{
+		{Name: "web-foo.cluster", LegacyName: "foo.web.cluster", Resource: "web/foo"},
+		{Name: "web-bar.cluster", LegacyName: "bar.web.cluster", Resource: "web/bar"},
+		{Name: "web-baz.cluster", LegacyName: "baz.web.cluster", Resource: "web/baz"},
+		{Name: "web-qux.cluster", Resource: "web/qux"},
+		{Name: "quux.web.cluster"},
+	}
+
+	adopted := AdoptCurrentNames([]*inbound.InboundRules{legacy, migrated, tagged, {Name: "bar.web.cluster"}}, desired)
+	var names []string
+	for _, r := range adopted {
+		names = append(names, r.Name)
+	}
+	// the rules are renamed after the current rules of their resource, or of their
+	// legacy name when their name isn't current
+	assert.Equal(t, []string{"foo.web.cluster", "web-bar.cluster", "web-baz.cluster", "qux.web.cluster", "quux.web.cluster"}, names)
+	assert.Equal(t, "web-foo.cluster", desired[0].Name)
+
+	// the legacy name of another resource isn't taken over
+	adopted = AdoptCurrentNames([]*inbound.InboundRules{{Name: "foo.web.cluster", Resource: "web/other"}}, desired[:1])
+	assert.Equal(t, "web-foo.cluster", adopted[0].Name)
+}
+
+func TestCalculateResource(t *testing.T) {
+	current := &inbound.InboundRules{
+		Name:        "foo.web.cluster",
+		Resource:    "web/foo",
+		Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80}},
+		ProviderIDs: inbound.ProviderIDs{"i-1"},
+	}
+	desired := &inbound.InboundRules{
+		Name:        "web-foo.cluster",
+		Resource:    "web/foo",
+		Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 443}},
+		ProviderIDs: inbound.ProviderIDs{"i-1"},
+	}
+
+	// the security group of the resource is updated under its current name
+	changes := (&Plan{Current: []*inbound.InboundRules{current}, Desired: []*inbound.InboundRules{desired}}).Calculate().Changes
+	assert.Empty(t, changes.Create)
+	assert.Empty(t, changes.Delete)
+	assert.Empty(t, changes.Set)
+	assert.Empty(t, changes.Unset)
+	require.Len(t, changes.UpdateNew, 1)
+	assert.Equal(t, "foo.web.cluster", changes.UpdateNew[0].Name)
+	assert.Equal(t, "web-foo.cluster", desired.Name)
+}
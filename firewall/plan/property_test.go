@@ -0,0 +1,199 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package plan
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+)
+
+// rulesList is a list of inbound rules with distinct names, drawn from small
+// pools so that the current and desired rules and instances overlap. The names
+// and provider IDs are prefixes of each other so that their concatenations collide.
+type rulesList []*inbound.InboundRules
+
+func (rulesList) Generate(rand *rand.Rand, size int) reflect.Value {
+	var rs rulesList
+	for _, name := range []string{"a", "ab", "b", "bc"} {
+		if rand.Intn(3) == 0 {
+			continue
+		}
+		r := inbound.NewInboundRules()
+		r.Name = name
+		for i := rand.Intn(3); i > 0; i-- {
+			r.Rules = append(r.Rules, inbound.InboundRule{
+				Protocol:    []string{"tcp", "udp"}[rand.Intn(2)],
+				Port:        5000 + rand.Intn(3),
+				Description: "default/" + name,
+			})
+		}
+		for _, id := range []string{"i", "ia", "ib"} {
+			if rand.Intn(2) == 0 {
+				r.ProviderIDs = append(r.ProviderIDs, id)
+			}
+		}
+		rs = append(rs, r)
+	}
+	return reflect.ValueOf(rs)
+}
+
+func calculate(current, desired rulesList) *Changes {
+	p := &Plan{
+		Current: current,
+		Desired: desired,
+	}
+	return p.Calculate().Changes
+}
+
+// state is the security groups and their assignments to instances.
+type state struct {
+	rules       map[string]*inbound.InboundRules
+	assignments map[InstanceRule]bool
+}
+
+func newState(rs rulesList) *state {
+	s := &state{rules: map[string]*inbound.InboundRules{}, assignments: map[InstanceRule]bool{}}
+	for _, r := range rs {
+		s.rules[r.Name] = r
+		for _, id := range r.ProviderIDs {
+			s.assignments[InstanceRule{ProviderID: id, RulesName: r.Name}] = true
+		}
+	}
+	return s
+}
+
+// apply applies the changes to the state, failing on changes which don't match it.
+func (s *state) apply(changes *Changes) error {
+	for _, i := range changes.Unset {
+		if !s.assignments[*i] {
+			return fmt.Errorf("unsetting %v which isn't set", *i)
+		}
+		delete(s.assignments, *i)
+	}
+	for _, r := range changes.Delete {
+		if s.rules[r.Name] != r {
+			return fmt.Errorf("deleting %s which isn't current", r)
+		}
+		delete(s.rules, r.Name)
+	}
+	if len(changes.UpdateOld) != len(changes.UpdateNew) {
+		return fmt.Errorf("%d old rules for %d new ones", len(changes.UpdateOld), len(changes.UpdateNew))
+	}
+	for i, r := range changes.UpdateOld {
+		if s.rules[r.Name] != r {
+			return fmt.Errorf("updating %s which isn't current", r)
+		}
+		s.rules[r.Name] = changes.UpdateNew[i]
+	}
+	for _, r := range changes.Create {
+		if _, ok := s.rules[r.Name]; ok {
+			return fmt.Errorf("creating %s which already exists", r)
+		}
+		s.rules[r.Name] = r
+	}
+	for _, i := range changes.Set {
+		if s.assignments[*i] {
+			return fmt.Errorf("setting %v which is already set", *i)
+		}
+		if _, ok := s.rules[i.RulesName]; !ok {
+			return fmt.Errorf("setting %v whose rules don't exist", *i)
+		}
+		s.assignments[*i] = true
+	}
+	return nil
+}
+
+func (s *state) same(o *state) bool {
+	if len(s.rules) != len(o.rules) || !reflect.DeepEqual(s.assignments, o.assignments) {
+		return false
+	}
+	for name, r := range s.rules {
+		if other, ok := o.rules[name]; !ok || !r.Same(other) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *state) rulesList() (rs rulesList) {
+	for _, r := range s.rules {
+		rs = append(rs, r)
+	}
+	return rs
+}
+
+func TestCalculateReachesDesired(t *testing.T) {
+	f := func(current, desired rulesList) bool {
+		s := newState(current)
+		if err := s.apply(calculate(current, desired)); err != nil {
+			t.Log(err)
+			return false
+		}
+		return s.same(newState(desired))
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateIsIdempotent(t *testing.T) {
+	f := func(current, desired rulesList) bool {
+		s := newState(current)
+		if err := s.apply(calculate(current, desired)); err != nil {
+			t.Log(err)
+			return false
+		}
+		// the assignments of the state are carried by the provider IDs of its rules
+		var applied rulesList
+		for _, r := range s.rulesList() {
+			copied := *r
+			copied.ProviderIDs = nil
+			for i := range s.assignments {
+				if i.RulesName == r.Name {
+					copied.ProviderIDs = append(copied.ProviderIDs, i.ProviderID)
+				}
+			}
+			applied = append(applied, &copied)
+		}
+		changes := calculate(applied, desired)
+		return len(changes.Create)+len(changes.UpdateOld)+len(changes.UpdateNew)+len(changes.Delete)+
+			len(changes.Set)+len(changes.Unset) == 0
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCalculateChangesAreDisjoint(t *testing.T) {
+	f := func(current, desired rulesList) bool {
+		changes := calculate(current, desired)
+		names := map[string]bool{}
+		for _, list := range [][]*inbound.InboundRules{changes.Create, changes.UpdateNew, changes.Delete} {
+			for _, r := range list {
+				if names[r.Name] {
+					return false
+				}
+				names[r.Name] = true
+			}
+		}
+		assignments := map[InstanceRule]bool{}
+		for _, list := range [][]*InstanceRule{changes.Set, changes.Unset} {
+			for _, i := range list {
+				if assignments[*i] {
+					return false
+				}
+				assignments[*i] = true
+			}
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
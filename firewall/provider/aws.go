@@ -5,25 +5,83 @@ package provider
 
 import (
 	"fmt"
-	"net/url"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/linki/instrumented_http"
 	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
 )
 
 const TagNameExternalIPsPrefix = "external-ips/"
 const ResourceLifecycleOwned = "owned"
 
+// TagNameResource is the tag identifying the resource a security group belongs to,
+// as namespace/name, so that it's found whatever its name.
+const TagNameResource = TagNameExternalIPsPrefix + "resource"
+
+const (
+	// the description of the security groups created by the provider
+	securityGroupDescription = "Security group for External IPs"
+	// errCodeDependencyViolation is returned when deleting a security group still attached to a network interface
+	errCodeDependencyViolation = "DependencyViolation"
+	// errCodeInvalidGroupNotFound is returned by the calls on a security group EC2 doesn't know yet, right after its creation
+	errCodeInvalidGroupNotFound = "InvalidGroup.NotFound"
+	// errCodeInvalidGroupDuplicate is returned when creating a security group whose name is taken
+	errCodeInvalidGroupDuplicate = "InvalidGroup.Duplicate"
+	// the attempts of the calls on a security group just created, delayed by newGroupRetryDelay then doubled
+	newGroupAttempts   = 5
+	newGroupRetryDelay = 500 * time.Millisecond
+	// the backoff of the deletions of the security groups still in use, doubled on every attempt
+	minDeletionBackoff = 30 * time.Second
+	maxDeletionBackoff = 10 * time.Minute
+	// the number of security groups requested per page, the maximum allowed
+	describeSecurityGroupsPageSize = 1000
+)
+
+// awsRegionRegMatch matches the region of an availability zone, e.g. ap-northeast-1 of ap-northeast-1a.
+var awsRegionRegMatch = regexp.MustCompile(`^[a-z]+(-[a-z]+)+-[0-9]+`)
+
+var stuckDeletions = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "external_ips",
+		Subsystem: "firewall",
+		Name:      "stuck_deletions",
+		Help:      "Number of security groups whose deletion is postponed because they are still in use.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(stuckDeletions)
+
+	Register("aws", Registration{
+		New: func(cfg *externalips.Config, nodes Nodes) (Provider, error) {
+			return NewAWSProvider(
+				AWSConfig{
+					AssumeRole: cfg.FirewallAssumeRole(),
+					Region:     cfg.AWSRegion,
+					DryRun:     cfg.DryRun,
+				},
+				nodes.All,
+			)
+		},
+		Permissions: AWSPermissions,
+	})
+}
+
 // EC2API is the subset of the AWS EC2 API that we actually use.  Add methods as required. Signatures must match exactly.
 type EC2API interface {
 	DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error)
@@ -35,65 +93,136 @@ type EC2API interface {
 	CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error)
 	DescribeInstanceAttribute(input *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error)
 	ModifyInstanceAttribute(input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error)
+	DescribeNetworkInterfaceAttribute(input *ec2.DescribeNetworkInterfaceAttributeInput) (*ec2.DescribeNetworkInterfaceAttributeOutput, error)
+	ModifyNetworkInterfaceAttribute(input *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error)
 }
 
-// AWSProvider is an implementation of Provider for AWS EC2.
-type AWSProvider struct {
-	client                    EC2API
-	kubeClient                kubernetes.Interface
-	vpcID                     string
-	clusterName               string
-	mapInstanceIdToProviderId map[string]string
-	dryRun                    bool
+// AWSPermissions returns the IAM policy statements required by the AWS provider.
+// Changes to security groups are restricted to the groups owned by the given
+// cluster, and changes to instances to the instances of the cluster. The security
+// groups of the instances and of their network interfaces are replaced by any
+// groups, those of the cluster and those the nodes already had.
+func AWSPermissions(clusterName string) []permissions.Statement {
+	actions := permissions.Actions("ec2", (*EC2API)(nil))
+	groupActions, actions := permissions.Partition(actions, "ec2:AuthorizeSecurityGroupIngress", "ec2:RevokeSecurityGroupIngress", "ec2:DeleteSecurityGroup")
+	attachActions, otherActions := permissions.Partition(actions, "ec2:ModifyInstanceAttribute", "ec2:ModifyNetworkInterfaceAttribute")
+	instanceActions, _ := permissions.Partition(attachActions, "ec2:ModifyInstanceAttribute")
+
+	return []permissions.Statement{
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   groupActions,
+			Resource: []string{"arn:aws:ec2:*:*:security-group/*"},
+			Condition: map[string]map[string]string{
+				"StringEquals": {"ec2:ResourceTag/" + TagNameExternalIPsPrefix + clusterName: ResourceLifecycleOwned},
+			},
+		},
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   instanceActions,
+			Resource: []string{"arn:aws:ec2:*:*:instance/*"},
+			Condition: map[string]map[string]string{
+				"StringEquals": {"ec2:ResourceTag/KubernetesCluster": clusterName},
+			},
+		},
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   attachActions,
+			Resource: []string{"arn:aws:ec2:*:*:network-interface/*", "arn:aws:ec2:*:*:security-group/*"},
+		},
+		{
+			Effect:   permissions.EffectAllow,
+			Action:   otherActions,
+			Resource: []string{permissions.AnyResource},
+		},
+	}
 }
 
-// AWSConfig contains configuration to create a new AWS provider.
-type AWSConfig struct {
-	AssumeRole string
-	DryRun     bool
+// AWSProvider is an implementation of Provider for AWS EC2. It is safe for
+// concurrent use. The security groups being regional, the nodes spanning several
+// regions get a security group of the same name in each of their regions.
+type AWSProvider struct {
+	// the client of the region of the session
+	client EC2API
+	// the region of the session, the region of the nodes whose providerID has no zone
+	region string
+	// creates the clients of the other regions, nil to use client in all of them
+	newClient func(region string) EC2API
+	clientsMu sync.Mutex
+	clients   map[string]EC2API
+
+	nodeLister node.Lister
+	dryRun     bool
+	// the latest snapshot of the instances of the nodes
+	mu       sync.Mutex
+	snapshot *instanceSnapshot
+	// the deletions postponed because the security groups were still in use, by name
+	deletionsMu      sync.Mutex
+	pendingDeletions map[string]*pendingDeletion
+	// waits between the attempts of the calls on a security group just created, time.Sleep if nil
+	sleep func(time.Duration)
 }
 
-// awsInstanceRegMatch represents Regex Match for AWS instance.
-var awsInstanceRegMatch = regexp.MustCompile("^i-[^/]*$")
-
-func mapToAWSInstanceID(providerID string) (string, error) {
-	s := providerID
+// instanceSnapshot maps the nodes of the cluster to their instances at a point
+// in time. It is never updated once taken, a new one replaces it.
+type instanceSnapshot struct {
+	instances []*ec2.Instance
+	// the ProviderIDs of the nodes by instance ID
+	providerIDs map[string]string
+	// the external then internal addresses of the nodes by instance ID
+	addresses   map[string][]string
+	clusterName string
+	// the regions of the instances, in the order of the nodes
+	regions []*regionSnapshot
+}
 
-	if !strings.HasPrefix(s, "aws://") {
-		// Assume a bare aws volume id (vol-1234...)
-		// Build a URL with an empty host (AZ)
-		s = "aws://" + "/" + "/" + s
-	}
-	url, err := url.Parse(s)
-	if err != nil {
-		return "", fmt.Errorf("Invalid instance name (%s): %v", providerID, err)
-	}
-	if url.Scheme != "aws" {
-		return "", fmt.Errorf("Invalid scheme for AWS instance (%s)", providerID)
-	}
+// regionSnapshot is the part of a snapshot in a region of the nodes.
+type regionSnapshot struct {
+	name   string
+	client EC2API
+	// the VPC of the instances of the region
+	vpcID string
+}
 
-	awsID := ""
-	tokens := strings.Split(strings.Trim(url.Path, "/"), "/")
-	if len(tokens) == 1 {
-		// instanceId
-		awsID = tokens[0]
-	} else if len(tokens) == 2 {
-		// az/instanceId
-		awsID = tokens[1]
+// region returns the part of the snapshot in the region of the given name, nil if
+// no node is in it.
+func (s *instanceSnapshot) region(name string) *regionSnapshot {
+	for _, r := range s.regions {
+		if r.name == name {
+			return r
+		}
 	}
+	return nil
+}
 
-	// We sanity check the resulting volume; the two known formats are
-	// i-12345678 and i-12345678abcdef01
-	if awsID == "" || !awsInstanceRegMatch.MatchString(awsID) {
-		return "", fmt.Errorf("Invalid format for AWS instance (%s)", providerID)
-	}
+// pendingDeletion is the deletion of a security group which is retried with a
+// backoff, as the network interfaces take a while to release a group once it is
+// unset from their instance.
+type pendingDeletion struct {
+	since    time.Time
+	attempts int
+	next     time.Time
+}
 
-	return awsID, nil
+// AWSConfig contains configuration to create a new AWS provider.
+type AWSConfig struct {
+	AssumeRole string
+	// Overrides the region of the AWS configuration, the region of the nodes whose providerID has no zone
+	Region string
+	// Overrides the EC2 endpoint, e.g. to run against localstack
+	Endpoint string
+	DryRun   bool
 }
 
 // NewAWSProvider initializes a new AWS EC2 based Provider.
-func NewAWSProvider(awsConfig AWSConfig, kubeClient kubernetes.Interface) (*AWSProvider, error) {
+func NewAWSProvider(awsConfig AWSConfig, nodeLister node.Lister) (*AWSProvider, error) {
 	config := aws.NewConfig()
+	if awsConfig.Endpoint != "" {
+		config.WithEndpoint(awsConfig.Endpoint)
+	}
+	if awsConfig.Region != "" {
+		config.WithRegion(awsConfig.Region)
+	}
 
 	config.WithHTTPClient(
 		instrumented_http.NewClient(config.HTTPClient, &instrumented_http.Callbacks{
@@ -118,8 +247,12 @@ func NewAWSProvider(awsConfig AWSConfig, kubeClient kubernetes.Interface) (*AWSP
 	}
 
 	provider := &AWSProvider{
-		client:     ec2.New(session),
-		kubeClient: kubeClient,
+		client: ec2.New(session),
+		region: aws.StringValue(session.Config.Region),
+		newClient: func(region string) EC2API {
+			return ec2.New(session, aws.NewConfig().WithRegion(region))
+		},
+		nodeLister: nodeLister,
 		dryRun:     awsConfig.DryRun,
 	}
 
@@ -127,81 +260,259 @@ func NewAWSProvider(awsConfig AWSConfig, kubeClient kubernetes.Interface) (*AWSP
 }
 
 func (p *AWSProvider) GetClusterName() (string, error) {
-	if len(p.clusterName) == 0 {
-		_, err := p.getInstances()
-		if err != nil {
-			return "", err
-		}
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return "", err
+	}
+	return s.clusterName, nil
+}
+
+// GetVPCID returns the VPC of the instances of the cluster, in the region of the
+// first node when they span several regions.
+func (p *AWSProvider) GetVPCID() (string, error) {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return "", err
 	}
-	return p.clusterName, nil
+	return s.regions[0].vpcID, nil
 }
 
+// GetVPCIDs returns the VPCs of the instances of the cluster, one per region.
+func (p *AWSProvider) GetVPCIDs() ([]string, error) {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	vpcIDs := make([]string, 0, len(s.regions))
+	for _, r := range s.regions {
+		vpcIDs = append(vpcIDs, r.vpcID)
+	}
+	return vpcIDs, nil
+}
+
+// Rules returns the rules of the security groups of the cluster, the groups of the
+// same name in several regions being merged. The rules missing from a region of
+// the nodes, or differing from a region to another, are drifted so that they're
+// updated in all of them.
 func (p *AWSProvider) Rules() ([]*inbound.InboundRules, error) {
-	instances, err := p.getInstances()
+	s, err := p.refreshSnapshot()
 	if err != nil {
 		return nil, err
 	}
 
+	result := []*inbound.InboundRules{}
+	byName := map[string]*inbound.InboundRules{}
+	regions := map[string]int{}
+	var owned []*ec2.SecurityGroup
+	for _, r := range s.regions {
+		sgs, rules, err := p.regionRules(s, r)
+		if err != nil {
+			return nil, err
+		}
+		owned = append(owned, sgs...)
+		for _, rr := range rules {
+			regions[rr.Name]++
+			if merged, ok := byName[rr.Name]; ok {
+				mergeRules(merged, rr)
+				continue
+			}
+			byName[rr.Name] = rr
+			result = append(result, rr)
+		}
+	}
+
+	p.prunePendingDeletions(owned)
+
+	for _, rules := range result {
+		if regions[rules.Name] < len(s.regions) {
+			rules.Drifted = true
+		}
+	}
+	return result, nil
+}
+
+// regionRules returns the rules of the security groups of the cluster in the region,
+// along with its owned security groups.
+func (p *AWSProvider) regionRules(s *instanceSnapshot, r *regionSnapshot) ([]*ec2.SecurityGroup, []*inbound.InboundRules, error) {
 	describeRequest := &ec2.DescribeSecurityGroupsInput{}
 	filters := []*ec2.Filter{
-		newEc2Filter("tag:"+TagNameExternalIPsPrefix+p.clusterName, ResourceLifecycleOwned),
+		newEc2Filter("tag:"+TagNameExternalIPsPrefix+s.clusterName, ResourceLifecycleOwned),
+		newEc2Filter("vpc-id", r.vpcID),
 	}
 	describeRequest.Filters = filters
-	response, err := p.DescribeSecurityGroups(describeRequest)
+	response, err := p.describeSecurityGroups(r.client, describeRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	untagged, err := p.untaggedSecurityGroups(s, r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result := make([]*inbound.InboundRules, 0, len(response)+len(untagged))
+	for _, sg := range response {
+		rules, err := newInboundRules(s, sg)
+		if err != nil {
+			return nil, nil, err
+		}
+		result = append(result, rules)
+	}
+	for _, sg := range untagged {
+		rules, err := newInboundRules(s, sg)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Warnf("Security group %s lost its ownership tag", rules.Name)
+		rules.Untagged = true
+		result = append(result, rules)
+	}
+	return response, result, nil
+}
+
+// mergeRules merges the rules of the security group of the same name in another
+// region into the given ones, which are drifted if they aren't the same.
+func mergeRules(merged, other *inbound.InboundRules) {
+	if !merged.Same(other) || other.Drifted {
+		merged.Drifted = true
+	}
+	if other.Untagged {
+		merged.Untagged = true
+	}
+	if merged.Resource == "" {
+		merged.Resource = other.Resource
+	}
+	merged.ProviderIDs = inbound.NewProviderIDs(append(merged.ProviderIDs, other.ProviderIDs...)...)
+}
+
+// untaggedSecurityGroups returns the security groups of the cluster in the region
+// created by the provider whose ownership tag was removed or changed, found by their
+// description and the suffix of their name. The groups owned by another cluster are
+// left out, the name of a cluster possibly ending with the name of another.
+func (p *AWSProvider) untaggedSecurityGroups(s *instanceSnapshot, r *regionSnapshot) ([]*ec2.SecurityGroup, error) {
+	response, err := p.describeSecurityGroups(r.client, &ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{
+			newEc2Filter("description", securityGroupDescription),
+			newEc2Filter("vpc-id", r.vpcID),
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	result := []*inbound.InboundRules{}
+	var untagged []*ec2.SecurityGroup
 	for _, sg := range response {
-		rules := inbound.NewInboundRules()
-		rules.Name = aws.StringValue(sg.GroupName)
-		for i := range sg.IpPermissions {
-			rule := inbound.InboundRule{
-				Protocol: aws.StringValue(sg.IpPermissions[i].IpProtocol),
-				Port:     int(aws.Int64Value(sg.IpPermissions[i].ToPort)),
-			}
-			rules.Rules = append(rules.Rules, rule)
-			for _, instance := range instances {
-				for _, isg := range instance.SecurityGroups {
-					if aws.StringValue(isg.GroupId) == aws.StringValue(sg.GroupId) {
-						providerID, ok := p.mapInstanceIdToProviderId[aws.StringValue(instance.InstanceId)]
-						if !ok {
-							return nil, fmt.Errorf("no ProviderID correspond to %s", aws.StringValue(instance.InstanceId))
-						}
-						rules.ProviderIDs = append(rules.ProviderIDs, providerID)
-					}
+		if !strings.HasSuffix(aws.StringValue(sg.GroupName), "."+s.clusterName) || hasOwnershipTag(s, sg) || hasOtherOwnershipTag(s, sg) {
+			continue
+		}
+		untagged = append(untagged, sg)
+	}
+	return untagged, nil
+}
+
+func hasOwnershipTag(s *instanceSnapshot, sg *ec2.SecurityGroup) bool {
+	return tagValue(sg.Tags, TagNameExternalIPsPrefix+s.clusterName) == ResourceLifecycleOwned
+}
+
+// hasOtherOwnershipTag returns true if the security group carries the ownership tag
+// of another cluster.
+func hasOtherOwnershipTag(s *instanceSnapshot, sg *ec2.SecurityGroup) bool {
+	for _, tag := range sg.Tags {
+		key := aws.StringValue(tag.Key)
+		if !strings.HasPrefix(key, TagNameExternalIPsPrefix) || key == TagNameResource || key == TagNameExternalIPsPrefix+s.clusterName {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// tagValue returns the value of the tag of the given key, empty if none.
+func tagValue(tags []*ec2.Tag, key string) string {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return aws.StringValue(tag.Value)
+		}
+	}
+	return ""
+}
+
+// newInboundRules returns the rules of the security group, drifted when the
+// descriptions of the sources of a permission differ.
+func newInboundRules(s *instanceSnapshot, sg *ec2.SecurityGroup) (*inbound.InboundRules, error) {
+	rules := inbound.NewInboundRules()
+	rules.Name = aws.StringValue(sg.GroupName)
+	rules.Resource = tagValue(sg.Tags, TagNameResource)
+	// the security groups created before the resource tag are updated to get it
+	if rules.Resource == "" {
+		rules.Drifted = true
+	}
+	for i := range sg.IpPermissions {
+		rule := newInboundRule(sg, sg.IpPermissions[i])
+		if !sameDescriptions(sg.IpPermissions[i], rule.Description) {
+			rules.Drifted = true
+		}
+		rules.Rules = append(rules.Rules, rule)
+		for _, instance := range s.instances {
+			if instanceGroupIDs(instance)[aws.StringValue(sg.GroupId)] {
+				providerID, ok := s.providerIDs[aws.StringValue(instance.InstanceId)]
+				if !ok {
+					return nil, fmt.Errorf("no ProviderID correspond to %s", aws.StringValue(instance.InstanceId))
 				}
+				rules.ProviderIDs = append(rules.ProviderIDs, providerID)
 			}
 		}
-		result = append(result, rules)
 	}
-	return result, nil
+	rules.ProviderIDs = inbound.NewProviderIDs(rules.ProviderIDs...)
+	return rules, nil
 }
 
+// sameDescriptions returns true if all the sources of the permission have the given description.
+func sameDescriptions(perm *ec2.IpPermission, description string) bool {
+	for _, r := range perm.IpRanges {
+		if aws.StringValue(r.Description) != description {
+			return false
+		}
+	}
+	for _, pair := range perm.UserIdGroupPairs {
+		if aws.StringValue(pair.Description) != description {
+			return false
+		}
+	}
+	return true
+}
+
+// ApplyChanges applies the changes against a snapshot of the instances of its own,
+// taken anew rather than reused from the last call to Rules: the rules may be
+// cached by the registry, and the nodes may have joined or left the cluster since
+// they were listed, the changes being planned against the nodes of the sources.
 func (p *AWSProvider) ApplyChanges(changes *plan.Changes) error {
+	s, err := p.refreshSnapshot()
+	if err != nil {
+		return err
+	}
 
-	err := p.createSecurityGroups(changes)
+	err = p.createSecurityGroups(s, changes)
 	if err != nil {
 		return err
 	}
 
-	err = p.updateSecurityGroups(changes)
+	err = p.updateSecurityGroups(s, changes)
 	if err != nil {
 		return err
 	}
 
-	err = p.setSecurityGroups(changes)
+	err = p.setSecurityGroups(s, changes)
 	if err != nil {
 		return err
 	}
 
-	err = p.unsetSecurityGroups(changes)
+	err = p.unsetSecurityGroups(s, changes)
 	if err != nil {
 		return err
 	}
 
-	err = p.deleteSecurityGroups(changes)
+	err = p.deleteSecurityGroups(s, changes)
 	if err != nil {
 		return err
 	}
@@ -209,67 +520,282 @@ func (p *AWSProvider) ApplyChanges(changes *plan.Changes) error {
 	return nil
 }
 
-func (p *AWSProvider) getInstances() ([]*ec2.Instance, error) {
-	nodes, err := p.kubeClient.CoreV1().Nodes().List(metav1.ListOptions{})
+// currentSnapshot returns the latest snapshot of the instances, taking one if
+// none was taken yet.
+func (p *AWSProvider) currentSnapshot() (*instanceSnapshot, error) {
+	p.mu.Lock()
+	s := p.snapshot
+	p.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+	return p.refreshSnapshot()
+}
+
+// refreshSnapshot takes a new snapshot of the instances of the nodes, which
+// replaces the latest one. The instances are described in their own region.
+func (p *AWSProvider) refreshSnapshot() (*instanceSnapshot, error) {
+	nodes, err := p.nodeLister.List()
 	if err != nil {
 		return nil, err
 	}
 
-	instanceIds := make([]*string, 0, len(nodes.Items))
-	p.mapInstanceIdToProviderId = make(map[string]string, len(nodes.Items))
-	for _, node := range nodes.Items {
-		instanceId, err := mapToAWSInstanceID(node.Spec.ProviderID)
+	s := &instanceSnapshot{
+		providerIDs: make(map[string]string, len(nodes)),
+		addresses:   make(map[string][]string, len(nodes)),
+	}
+	// the instance IDs by region, the regions in the order of the nodes
+	instanceIds := map[string][]*string{}
+	var regions []string
+	for _, n := range nodes {
+		instanceId, err := node.InstanceID(n.Spec.ProviderID, node.SchemeAWS)
 		if err != nil {
 			return nil, err
 		}
-		instanceIds = append(instanceIds, aws.String(instanceId))
-		p.mapInstanceIdToProviderId[instanceId] = node.Spec.ProviderID
+		region, err := p.instanceRegion(n.Spec.ProviderID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := instanceIds[region]; !ok {
+			regions = append(regions, region)
+		}
+		instanceIds[region] = append(instanceIds[region], aws.String(instanceId))
+		s.providerIDs[instanceId] = n.Spec.ProviderID
+		for _, t := range []v1.NodeAddressType{v1.NodeExternalIP, v1.NodeInternalIP} {
+			for _, a := range n.Status.Addresses {
+				if a.Type == t {
+					s.addresses[instanceId] = append(s.addresses[instanceId], a.Address)
+				}
+			}
+		}
 	}
-
-	request := &ec2.DescribeInstancesInput{
-		InstanceIds: instanceIds,
+	// without any node, the instances of the region of the provider are described to find the cluster
+	if len(regions) == 0 {
+		regions = append(regions, p.region)
 	}
-	instances, err := p.DescribeInstances(request)
-	if err != nil {
-		return nil, err
+
+	for _, name := range regions {
+		r := &regionSnapshot{name: name, client: p.regionClient(name)}
+		request := &ec2.DescribeInstancesInput{
+			InstanceIds: instanceIds[name],
+		}
+		instances, err := p.describeInstances(r.client, request)
+		if err != nil {
+			return nil, err
+		}
+		if len(instances) == 0 {
+			continue
+		}
+		r.vpcID = aws.StringValue(instances[0].VpcId)
+		s.regions = append(s.regions, r)
+		s.instances = append(s.instances, instances...)
 	}
 
-	if len(instances) > 0 {
-		instance := instances[0]
+	if len(s.instances) > 0 {
+		instance := s.instances[0]
 		for _, tag := range instance.Tags {
 			if aws.StringValue(tag.Key) == "KubernetesCluster" {
-				p.clusterName = aws.StringValue(tag.Value)
+				s.clusterName = aws.StringValue(tag.Value)
 				break
 			}
 		}
-		p.vpcID = aws.StringValue(instance.VpcId)
 	} else {
 		return nil, fmt.Errorf("No instance was found")
 	}
 
-	return instances, nil
+	p.mu.Lock()
+	p.snapshot = s
+	p.mu.Unlock()
+	return s, nil
+}
+
+// instanceRegion returns the region of the instance of the providerID, found from
+// its availability zone, the region of the provider if it has none.
+func (p *AWSProvider) instanceRegion(providerID string) (string, error) {
+	id, err := node.ParseProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	if region := awsRegionRegMatch.FindString(id.Zone); region != "" {
+		return region, nil
+	}
+	return p.region, nil
+}
+
+// regionClient returns the client of the region, created on first use.
+func (p *AWSProvider) regionClient(region string) EC2API {
+	if region == p.region || p.newClient == nil {
+		return p.client
+	}
+
+	p.clientsMu.Lock()
+	defer p.clientsMu.Unlock()
+	client, ok := p.clients[region]
+	if !ok {
+		if p.clients == nil {
+			p.clients = map[string]EC2API{}
+		}
+		client = p.newClient(region)
+		p.clients[region] = client
+	}
+	return client
 }
 
-func (p *AWSProvider) findSecurityGroup(name string) (*ec2.SecurityGroup, error) {
+// nodeRegion returns the part of the snapshot in the region of the node of the providerID.
+func (p *AWSProvider) nodeRegion(s *instanceSnapshot, providerID string) (*regionSnapshot, error) {
+	name, err := p.instanceRegion(providerID)
+	if err != nil {
+		return nil, err
+	}
+	r := s.region(name)
+	if r == nil {
+		return nil, fmt.Errorf("no instance of the cluster was found in the region %s of %s", name, providerID)
+	}
+	return r, nil
+}
+
+// findSecurityGroup returns the security group of the resource in the region, found by
+// its resource tag whatever its name, or the security group of the given name for the
+// security groups created before the resource tag and when the resource is empty.
+func (p *AWSProvider) findSecurityGroup(s *instanceSnapshot, r *regionSnapshot, name, resource string) (*ec2.SecurityGroup, error) {
+	sg, err := p.lookupSecurityGroup(s, r, name, resource)
+	if err != nil {
+		return nil, err
+	}
+	if sg == nil {
+		return nil, fmt.Errorf("security group %s was not found in %s", groupName(name, resource), r.name)
+	}
+	return sg, nil
+}
+
+// groupName names a security group in the errors, along with its resource if known.
+func groupName(name, resource string) string {
+	if resource == "" {
+		return name
+	}
+	return name + " of " + resource
+}
+
+// lookupSecurityGroup returns the security group findSecurityGroup finds, nil if
+// there's none in the region.
+func (p *AWSProvider) lookupSecurityGroup(s *instanceSnapshot, r *regionSnapshot, name, resource string) (*ec2.SecurityGroup, error) {
+	if resource != "" {
+		securityGroups, err := p.describeSecurityGroups(r.client, &ec2.DescribeSecurityGroupsInput{
+			Filters: []*ec2.Filter{
+				newEc2Filter("tag:"+TagNameResource, resource),
+				newEc2Filter("tag:"+TagNameExternalIPsPrefix+s.clusterName, ResourceLifecycleOwned),
+				newEc2Filter("vpc-id", r.vpcID),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(securityGroups) > 1 {
+			return nil, fmt.Errorf("security group of %s is not unique", resource)
+		}
+		if len(securityGroups) == 1 {
+			return securityGroups[0], nil
+		}
+	}
+
 	request := &ec2.DescribeSecurityGroupsInput{}
 	filters := []*ec2.Filter{
 		newEc2Filter("group-name", name),
-		newEc2Filter("vpc-id", p.vpcID),
+		newEc2Filter("vpc-id", r.vpcID),
 	}
 	request.Filters = filters
 
-	securityGroups, err := p.client.DescribeSecurityGroups(request)
+	securityGroups, err := p.describeSecurityGroups(r.client, request)
 	if err != nil {
 		return nil, err
 	}
-	if len(securityGroups.SecurityGroups) > 1 || len(securityGroups.SecurityGroups) == 0 {
+	if len(securityGroups) > 1 {
 		return nil, fmt.Errorf("security group name is not unique %s", name)
 	}
-	sg := securityGroups.SecurityGroups[0]
-	return sg, nil
+	if len(securityGroups) == 0 {
+		return nil, nil
+	}
+	return securityGroups[0], nil
+}
+
+// newInboundRule returns the rule of a permission of the security group, its
+// source security group being SourceSecurityGroupSelf when it's the group itself.
+func newInboundRule(sg *ec2.SecurityGroup, perm *ec2.IpPermission) inbound.InboundRule {
+	rule := inbound.InboundRule{
+		Protocol: awsProtocolName(aws.StringValue(perm.IpProtocol)),
+		Port:     int(aws.Int64Value(perm.ToPort)),
+	}
+	// a range of ports opens the ports from FromPort to ToPort
+	if perm.FromPort != nil && int(*perm.FromPort) != rule.Port {
+		rule.Port, rule.ToPort = int(*perm.FromPort), rule.Port
+	}
+	for _, r := range perm.IpRanges {
+		rule.SourceCIDRs = append(rule.SourceCIDRs, aws.StringValue(r.CidrIp))
+		if rule.Description == "" {
+			rule.Description = aws.StringValue(r.Description)
+		}
+	}
+	if len(perm.UserIdGroupPairs) > 0 {
+		pair := perm.UserIdGroupPairs[0]
+		rule.SourceSecurityGroup = aws.StringValue(pair.GroupId)
+		if rule.SourceSecurityGroup == aws.StringValue(sg.GroupId) {
+			rule.SourceSecurityGroup = inbound.SourceSecurityGroupSelf
+		}
+		if rule.Description == "" {
+			rule.Description = aws.StringValue(pair.Description)
+		}
+	}
+	return rule
+}
+
+// awsIPProtocol returns the IpProtocol of the permissions of a protocol, EC2 only
+// naming tcp, udp and icmp, the other protocols being given by their IANA number.
+func awsIPProtocol(protocol string) string {
+	if protocol == inbound.ProtocolSCTP {
+		return "132"
+	}
+	return protocol
+}
+
+// awsProtocolName returns the protocol of a permission, by name for the protocols
+// given by number, so that the rules read back compare with the desired ones.
+func awsProtocolName(ipProtocol string) string {
+	if ipProtocol == "132" {
+		return inbound.ProtocolSCTP
+	}
+	return ipProtocol
+}
+
+// Protocols returns the protocols of the rules the provider opens, SCTP included.
+func (p *AWSProvider) Protocols() []string {
+	return []string{inbound.ProtocolTCP, inbound.ProtocolUDP, inbound.ProtocolSCTP}
+}
+
+// InstanceTags returns the tags of the instances of the nodes by providerID, as of
+// the latest snapshot of the instances, none before it's taken.
+func (p *AWSProvider) InstanceTags() map[string]map[string]string {
+	p.mu.Lock()
+	s := p.snapshot
+	p.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	result := make(map[string]map[string]string, len(s.instances))
+	for _, instance := range s.instances {
+		providerID, ok := s.providerIDs[aws.StringValue(instance.InstanceId)]
+		if !ok {
+			continue
+		}
+		tags := make(map[string]string, len(instance.Tags))
+		for _, tag := range instance.Tags {
+			tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+		result[providerID] = tags
+	}
+	return result
 }
 
-func (p *AWSProvider) addInboundRules(groupId *string, rules []inbound.InboundRule) error {
+func (p *AWSProvider) addInboundRules(client EC2API, groupId *string, rules []inbound.InboundRule) error {
 	authorizeRequest := &ec2.AuthorizeSecurityGroupIngressInput{
 		GroupId: groupId,
 	}
@@ -277,143 +803,380 @@ func (p *AWSProvider) addInboundRules(groupId *string, rules []inbound.InboundRu
 	for _, rule := range rules {
 		perm := ec2.IpPermission{
 			FromPort:   aws.Int64(int64(rule.Port)),
-			IpProtocol: aws.String(rule.Protocol),
-			IpRanges: []*ec2.IpRange{
+			IpProtocol: aws.String(awsIPProtocol(rule.Protocol)),
+			ToPort:     aws.Int64(int64(rule.LastPort())),
+		}
+		for _, cidr := range rule.CIDRs() {
+			perm.IpRanges = append(perm.IpRanges, &ec2.IpRange{
+				CidrIp:      aws.String(cidr),
+				Description: aws.String(rule.Description),
+			})
+		}
+		if rule.SourceSecurityGroup != "" {
+			source := rule.SourceSecurityGroup
+			if source == inbound.SourceSecurityGroupSelf {
+				source = aws.StringValue(groupId)
+			}
+			perm.UserIdGroupPairs = []*ec2.UserIdGroupPair{
 				{
-					CidrIp:      aws.String("0.0.0.0/0"),
-					Description: aws.String(""),
+					GroupId:     aws.String(source),
+					Description: aws.String(rule.Description),
 				},
-			},
-			ToPort: aws.Int64(int64(rule.Port)),
+			}
 		}
 		authorizeRequest.IpPermissions = append(authorizeRequest.IpPermissions, &perm)
 	}
 
-	_, err := p.client.AuthorizeSecurityGroupIngress(authorizeRequest)
+	_, err := client.AuthorizeSecurityGroupIngress(authorizeRequest)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func (p *AWSProvider) createSecurityGroups(changes *plan.Changes) error {
-	description := "Security group for External IPs"
-	resources := make([]*string, 0, len(changes.Create))
+func (p *AWSProvider) createSecurityGroups(s *instanceSnapshot, changes *plan.Changes) (err error) {
+	var group string
+	defer func() { err = plan.WrapGroupError(group, err) }()
+
 	for _, r := range changes.Create {
+		group = r.Name
 		log.Infof("Desired change: %s %s", "CREATE SG", r)
 		if !p.dryRun {
-			request := &ec2.CreateSecurityGroupInput{}
-			request.VpcId = &p.vpcID
-			request.GroupName = &r.Name
-			request.Description = &description
-
-			response, err := p.client.CreateSecurityGroup(request)
-			if err != nil {
-				return err
+			for _, region := range s.regions {
+				if err := p.createRegionSecurityGroup(s, region, r); err != nil {
+					return err
+				}
 			}
+		}
+	}
 
-			resources = append(resources, response.GroupId)
+	return nil
+}
 
-			err = p.addInboundRules(response.GroupId, r.Rules)
-			if err != nil {
-				return err
-			}
+// createRegionSecurityGroup creates the security group of the rules in the region.
+func (p *AWSProvider) createRegionSecurityGroup(s *instanceSnapshot, region *regionSnapshot, r *inbound.InboundRules) error {
+	description := securityGroupDescription
+	request := &ec2.CreateSecurityGroupInput{}
+	request.VpcId = aws.String(region.vpcID)
+	request.GroupName = &r.Name
+	request.Description = &description
+
+	groupID, permissions, err := p.createSecurityGroup(s, region, request)
+	if err != nil {
+		return err
+	}
+
+	// the security group is tagged with its resource along with its ownership, as they differ from a group to another
+	tags := []*ec2.Tag{ownershipTag(s)}
+	if r.Resource != "" {
+		tags = append(tags, resourceTag(r.Resource))
+	}
+	err = p.retryNewGroup(groupID, func() error {
+		return p.tagSecurityGroup(region.client, groupID, tags...)
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(permissions) > 0 {
+		_, err = region.client.RevokeSecurityGroupIngress(&ec2.RevokeSecurityGroupIngressInput{
+			GroupId:       groupID,
+			IpPermissions: permissions,
+		})
+		if err != nil {
+			return err
 		}
 	}
+	return p.retryNewGroup(groupID, func() error {
+		return p.addInboundRules(region.client, groupID, r.Rules)
+	})
+}
 
-	if len(resources) > 0 {
-		if !p.dryRun {
-			input := &ec2.CreateTagsInput{
-				Resources: resources,
-				Tags: []*ec2.Tag{
-					{
-						Key:   aws.String(TagNameExternalIPsPrefix + p.clusterName),
-						Value: aws.String(ResourceLifecycleOwned),
-					},
-				},
-			}
+// createSecurityGroup creates the security group in the region and returns its ID.
+// The security group of the same name a former attempt created, but failed to tag
+// or to authorize, is adopted rather than failing, along with its permissions to revoke.
+func (p *AWSProvider) createSecurityGroup(s *instanceSnapshot, region *regionSnapshot, request *ec2.CreateSecurityGroupInput) (*string, []*ec2.IpPermission, error) {
+	response, err := region.client.CreateSecurityGroup(request)
+	if err == nil {
+		return response.GroupId, nil, nil
+	}
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != errCodeInvalidGroupDuplicate {
+		return nil, nil, err
+	}
 
-			_, err := p.client.CreateTags(input)
-			if err != nil {
-				return err
-			}
+	name := aws.StringValue(request.GroupName)
+	sg, err := p.findSecurityGroup(s, region, name, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	if aws.StringValue(sg.Description) != securityGroupDescription {
+		return nil, nil, fmt.Errorf("security group %s already exists and wasn't created by External IPs", name)
+	}
+	log.Infof("Adopting SG %s, which already exists", name)
+	return sg.GroupId, sg.IpPermissions, nil
+}
+
+// retryNewGroup calls f until EC2 knows the security group just created, the
+// security groups being eventually consistent.
+func (p *AWSProvider) retryNewGroup(groupID *string, f func() error) error {
+	sleep := p.sleep
+	if sleep == nil {
+		sleep = time.Sleep
+	}
+	delay := newGroupRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != errCodeInvalidGroupNotFound || attempt == newGroupAttempts {
+			return err
 		}
+		log.Debugf("SG %s isn't known yet, retrying in %s", aws.StringValue(groupID), delay)
+		sleep(delay)
+		delay *= 2
 	}
+}
 
-	return nil
+// regionGroup is a security group of the cluster in a region of the nodes.
+type regionGroup struct {
+	region *regionSnapshot
+	sg     *ec2.SecurityGroup
 }
 
-func (p *AWSProvider) updateSecurityGroups(changes *plan.Changes) error {
-	for _, r := range changes.UpdateNew {
-		sg, err := p.findSecurityGroup(r.Name)
+// regionSecurityGroups returns the security groups findSecurityGroup finds in the
+// regions of the nodes, along with the regions missing them. It fails if none of
+// the regions has them.
+func (p *AWSProvider) regionSecurityGroups(s *instanceSnapshot, name, resource string) ([]regionGroup, []*regionSnapshot, error) {
+	var found []regionGroup
+	var missing []*regionSnapshot
+	for _, region := range s.regions {
+		sg, err := p.lookupSecurityGroup(s, region, name, resource)
+		if err != nil {
+			return nil, nil, err
+		}
+		if sg == nil {
+			missing = append(missing, region)
+			continue
+		}
+		found = append(found, regionGroup{region: region, sg: sg})
+	}
+	if len(found) == 0 {
+		names := make([]string, 0, len(missing))
+		for _, region := range missing {
+			names = append(names, region.name)
+		}
+		return nil, nil, fmt.Errorf("security group %s was not found in any region of the nodes: %s", groupName(name, resource), strings.Join(names, ", "))
+	}
+	return found, missing, nil
+}
+
+func (p *AWSProvider) updateSecurityGroups(s *instanceSnapshot, changes *plan.Changes) (err error) {
+	var group string
+	defer func() { err = plan.WrapGroupError(group, err) }()
+
+	for i, r := range changes.UpdateNew {
+		group = r.Name
+		sgs, missing, err := p.regionSecurityGroups(s, r.Name, r.Resource)
 		if err != nil {
 			return err
 		}
 
 		log.Infof("Desired change: %s %s", "UPDATE SG", r)
 		if !p.dryRun {
-			revokeRequest := &ec2.RevokeSecurityGroupIngressInput{}
-			revokeRequest.GroupId = sg.GroupId
-			revokeRequest.IpPermissions = sg.IpPermissions
-			_, err = p.client.RevokeSecurityGroupIngress(revokeRequest)
-			if err != nil {
-				return err
+			// the regions of the nodes missing the security group get it
+			for _, region := range missing {
+				if err := p.createRegionSecurityGroup(s, region, r); err != nil {
+					return err
+				}
 			}
 
-			err = p.addInboundRules(sg.GroupId, r.Rules)
-			if err != nil {
-				return err
+			for _, g := range sgs {
+				// the ownership tag is restored first, the changes of the rules being
+				// restricted to the owned security groups, along with the resource tag
+				// of the security groups created before it
+				var tags []*ec2.Tag
+				if i < len(changes.UpdateOld) && changes.UpdateOld[i].Untagged {
+					tags = append(tags, ownershipTag(s))
+				}
+				if r.Resource != "" && tagValue(g.sg.Tags, TagNameResource) != r.Resource {
+					tags = append(tags, resourceTag(r.Resource))
+				}
+				if len(tags) > 0 {
+					if err := p.tagSecurityGroup(g.region.client, g.sg.GroupId, tags...); err != nil {
+						return err
+					}
+				}
+
+				revokeRequest := &ec2.RevokeSecurityGroupIngressInput{}
+				revokeRequest.GroupId = g.sg.GroupId
+				revokeRequest.IpPermissions = g.sg.IpPermissions
+				_, err = g.region.client.RevokeSecurityGroupIngress(revokeRequest)
+				if err != nil {
+					return err
+				}
+
+				err = p.addInboundRules(g.region.client, g.sg.GroupId, r.Rules)
+				if err != nil {
+					return err
+				}
 			}
 		}
 	}
 	return nil
 }
 
-func (p *AWSProvider) deleteSecurityGroups(changes *plan.Changes) error {
+// tagSecurityGroup adds the tags to the security group.
+func (p *AWSProvider) tagSecurityGroup(client EC2API, groupID *string, tags ...*ec2.Tag) error {
+	_, err := client.CreateTags(&ec2.CreateTagsInput{
+		Resources: []*string{groupID},
+		Tags:      tags,
+	})
+	return err
+}
+
+// ownershipTag returns the tag of the security groups owned by the cluster.
+func ownershipTag(s *instanceSnapshot) *ec2.Tag {
+	return &ec2.Tag{
+		Key:   aws.String(TagNameExternalIPsPrefix + s.clusterName),
+		Value: aws.String(ResourceLifecycleOwned),
+	}
+}
+
+// resourceTag returns the tag identifying the security group of the resource.
+func resourceTag(resource string) *ec2.Tag {
+	return &ec2.Tag{
+		Key:   aws.String(TagNameResource),
+		Value: aws.String(resource),
+	}
+}
+
+func (p *AWSProvider) deleteSecurityGroups(s *instanceSnapshot, changes *plan.Changes) (err error) {
+	var group string
+	defer func() { err = plan.WrapGroupError(group, err) }()
+
+	p.deletionsMu.Lock()
+	defer p.deletionsMu.Unlock()
+
+	// the groups desired again are no longer to be deleted
+	for _, r := range changes.Create {
+		delete(p.pendingDeletions, r.Name)
+	}
+	for _, r := range changes.UpdateNew {
+		delete(p.pendingDeletions, r.Name)
+	}
+	defer func() {
+		stuckDeletions.Set(float64(len(p.pendingDeletions)))
+	}()
+
+	now := time.Now()
 	for _, r := range changes.Delete {
-		sg, err := p.findSecurityGroup(r.Name)
+		group = r.Name
+		if d, ok := p.pendingDeletions[r.Name]; ok && now.Before(d.next) {
+			log.Debugf("Postponing the deletion of SG %s until %s", r.Name, d.next.Format(time.RFC3339))
+			continue
+		}
+
+		sgs, _, err := p.regionSecurityGroups(s, r.Name, r.Resource)
 		if err != nil {
 			return err
 		}
 
 		log.Infof("Desired change: %s %s", "DELETE SG", r)
 		if !p.dryRun {
-			input := &ec2.DeleteSecurityGroupInput{
-				GroupId: sg.GroupId,
-			}
+			// the regions where the group is released are deleted anyway, the others are retried
+			inUse := false
+			for _, g := range sgs {
+				input := &ec2.DeleteSecurityGroupInput{
+					GroupId: g.sg.GroupId,
+				}
 
-			_, err = p.client.DeleteSecurityGroup(input)
-			if err != nil {
-				return err
+				_, err = g.region.client.DeleteSecurityGroup(input)
+				if aerr, ok := err.(awserr.Error); ok && aerr.Code() == errCodeDependencyViolation {
+					inUse = true
+					continue
+				}
+				if err != nil {
+					return err
+				}
+			}
+			if inUse {
+				p.postponeDeletion(r.Name, now)
+				continue
 			}
 		}
+		delete(p.pendingDeletions, r.Name)
 	}
 	return nil
 }
 
-func (p *AWSProvider) setSecurityGroups(changes *plan.Changes) error {
+// postponeDeletion queues the deletion of a security group still in use for a retry.
+// deletionsMu must be held.
+func (p *AWSProvider) postponeDeletion(name string, now time.Time) {
+	if p.pendingDeletions == nil {
+		p.pendingDeletions = map[string]*pendingDeletion{}
+	}
+	d, ok := p.pendingDeletions[name]
+	if !ok {
+		d = &pendingDeletion{since: now}
+		p.pendingDeletions[name] = d
+	}
+	d.attempts++
+
+	backoff := minDeletionBackoff
+	for i := 1; i < d.attempts && backoff < maxDeletionBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxDeletionBackoff {
+		backoff = maxDeletionBackoff
+	}
+	d.next = now.Add(backoff)
+
+	log.Warnf("SG %s is still in use, retrying its deletion in %s (attempt %d, pending since %s)", name, backoff, d.attempts, d.since.Format(time.RFC3339))
+}
+
+// prunePendingDeletions forgets the pending deletions of the groups which are gone.
+func (p *AWSProvider) prunePendingDeletions(sgs []*ec2.SecurityGroup) {
+	p.deletionsMu.Lock()
+	defer p.deletionsMu.Unlock()
+
+	if len(p.pendingDeletions) == 0 {
+		return
+	}
+	names := make(map[string]bool, len(sgs))
+	for _, sg := range sgs {
+		names[aws.StringValue(sg.GroupName)] = true
+	}
+	for name := range p.pendingDeletions {
+		if !names[name] {
+			delete(p.pendingDeletions, name)
+		}
+	}
+	stuckDeletions.Set(float64(len(p.pendingDeletions)))
+}
+
+func (p *AWSProvider) setSecurityGroups(s *instanceSnapshot, changes *plan.Changes) (err error) {
+	var group string
+	defer func() { err = plan.WrapGroupError(group, err) }()
+
 	for _, r := range changes.Set {
-		instanceID, err := mapToAWSInstanceID(r.ProviderID)
+		group = r.RulesName
+		instanceID, err := node.InstanceID(r.ProviderID, node.SchemeAWS)
 		if err != nil {
 			return err
 		}
-		input := &ec2.DescribeInstanceAttributeInput{
-			Attribute:  aws.String("groupSet"),
-			InstanceId: aws.String(instanceID),
+		region, err := p.nodeRegion(s, r.ProviderID)
+		if err != nil {
+			return err
 		}
-
-		result, err := p.client.DescribeInstanceAttribute(input)
+		eni, sgs, err := p.currentGroups(s, region, instanceID)
 		if err != nil {
 			return err
 		}
 
-		sgs := result.Groups
 		groups := make([]*string, 0, len(sgs)+1)
 		found := false
 
-		log.Infof("Desired change: %s %s %s", "ASSIGN SG", instanceID, r.RulesName)
+		log.Infof("Desired change: %s %s %s", "ASSIGN SG", interfaceName(instanceID, eni), r.RulesName)
 		if !p.dryRun {
-			sg, err := p.findSecurityGroup(r.RulesName)
+			sg, err := p.findSecurityGroup(s, region, r.RulesName, "")
 			if err != nil {
 				return err
 			}
@@ -428,11 +1191,7 @@ func (p *AWSProvider) setSecurityGroups(changes *plan.Changes) error {
 				groups = append(groups, sg.GroupId)
 			}
 
-			input := &ec2.ModifyInstanceAttributeInput{
-				InstanceId: aws.String(instanceID),
-				Groups:     groups,
-			}
-			_, err = p.client.ModifyInstanceAttribute(input)
+			err = p.modifyGroups(region.client, instanceID, eni, groups)
 			if err != nil {
 				return err
 			}
@@ -441,28 +1200,30 @@ func (p *AWSProvider) setSecurityGroups(changes *plan.Changes) error {
 	return nil
 }
 
-func (p *AWSProvider) unsetSecurityGroups(changes *plan.Changes) error {
+func (p *AWSProvider) unsetSecurityGroups(s *instanceSnapshot, changes *plan.Changes) (err error) {
+	var group string
+	defer func() { err = plan.WrapGroupError(group, err) }()
+
 	for _, r := range changes.Unset {
-		instanceID, err := mapToAWSInstanceID(r.ProviderID)
+		group = r.RulesName
+		instanceID, err := node.InstanceID(r.ProviderID, node.SchemeAWS)
 		if err != nil {
 			return err
 		}
-		input := &ec2.DescribeInstanceAttributeInput{
-			Attribute:  aws.String("groupSet"),
-			InstanceId: aws.String(instanceID),
+		region, err := p.nodeRegion(s, r.ProviderID)
+		if err != nil {
+			return err
 		}
-
-		result, err := p.client.DescribeInstanceAttribute(input)
+		eni, sgs, err := p.currentGroups(s, region, instanceID)
 		if err != nil {
 			return err
 		}
 
-		sgs := result.Groups
 		groups := make([]*string, 0, len(sgs)+1)
 
-		log.Infof("Desired change: %s %s %s", "UNASSIGN SG", instanceID, r.RulesName)
+		log.Infof("Desired change: %s %s %s", "UNASSIGN SG", interfaceName(instanceID, eni), r.RulesName)
 		if !p.dryRun {
-			sg, err := p.findSecurityGroup(r.RulesName)
+			sg, err := p.findSecurityGroup(s, region, r.RulesName, "")
 			if err != nil {
 				return err
 			}
@@ -474,11 +1235,7 @@ func (p *AWSProvider) unsetSecurityGroups(changes *plan.Changes) error {
 				groups = append(groups, csg.GroupId)
 			}
 
-			input := &ec2.ModifyInstanceAttributeInput{
-				InstanceId: aws.String(instanceID),
-				Groups:     groups,
-			}
-			_, err = p.client.ModifyInstanceAttribute(input)
+			err = p.modifyGroups(region.client, instanceID, eni, groups)
 			if err != nil {
 				return err
 			}
@@ -487,6 +1244,199 @@ func (p *AWSProvider) unsetSecurityGroups(changes *plan.Changes) error {
 	return nil
 }
 
+// nodeInterface returns the network interface of the instance carrying the
+// addresses of its node, preferably its external address, the primary one if
+// none does. It returns nil for the instances with a single network interface,
+// whose security groups are the groups of the instance.
+func nodeInterface(s *instanceSnapshot, instanceID string) *ec2.InstanceNetworkInterface {
+	var instance *ec2.Instance
+	for _, i := range s.instances {
+		if aws.StringValue(i.InstanceId) == instanceID {
+			instance = i
+		}
+	}
+	if instance == nil || len(instance.NetworkInterfaces) <= 1 {
+		return nil
+	}
+
+	for _, address := range s.addresses[instanceID] {
+		for _, eni := range instance.NetworkInterfaces {
+			if eni.Association != nil && aws.StringValue(eni.Association.PublicIp) == address {
+				return eni
+			}
+			for _, private := range eni.PrivateIpAddresses {
+				if aws.StringValue(private.PrivateIpAddress) == address {
+					return eni
+				}
+			}
+		}
+	}
+	for _, eni := range instance.NetworkInterfaces {
+		if eni.Attachment != nil && aws.Int64Value(eni.Attachment.DeviceIndex) == 0 {
+			return eni
+		}
+	}
+	return nil
+}
+
+// instanceGroupIDs returns the security groups of the instance and of all of its network interfaces.
+func instanceGroupIDs(instance *ec2.Instance) map[string]bool {
+	ids := map[string]bool{}
+	for _, isg := range instance.SecurityGroups {
+		ids[aws.StringValue(isg.GroupId)] = true
+	}
+	for _, eni := range instance.NetworkInterfaces {
+		for _, isg := range eni.Groups {
+			ids[aws.StringValue(isg.GroupId)] = true
+		}
+	}
+	return ids
+}
+
+// currentGroups returns the security groups of the network interface of the
+// instance carrying the addresses of its node, nil for the instances with a
+// single network interface, along with their groups.
+func (p *AWSProvider) currentGroups(s *instanceSnapshot, region *regionSnapshot, instanceID string) (*ec2.InstanceNetworkInterface, []*ec2.GroupIdentifier, error) {
+	eni := nodeInterface(s, instanceID)
+	if eni == nil {
+		result, err := region.client.DescribeInstanceAttribute(&ec2.DescribeInstanceAttributeInput{
+			Attribute:  aws.String("groupSet"),
+			InstanceId: aws.String(instanceID),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, result.Groups, nil
+	}
+
+	result, err := region.client.DescribeNetworkInterfaceAttribute(&ec2.DescribeNetworkInterfaceAttributeInput{
+		Attribute:          aws.String("groupSet"),
+		NetworkInterfaceId: eni.NetworkInterfaceId,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return eni, result.Groups, nil
+}
+
+// modifyGroups sets the security groups of the instance, of its network interface if not nil.
+func (p *AWSProvider) modifyGroups(client EC2API, instanceID string, eni *ec2.InstanceNetworkInterface, groups []*string) error {
+	if eni == nil {
+		_, err := client.ModifyInstanceAttribute(&ec2.ModifyInstanceAttributeInput{
+			InstanceId: aws.String(instanceID),
+			Groups:     groups,
+		})
+		return err
+	}
+	_, err := client.ModifyNetworkInterfaceAttribute(&ec2.ModifyNetworkInterfaceAttributeInput{
+		NetworkInterfaceId: eni.NetworkInterfaceId,
+		Groups:             groups,
+	})
+	return err
+}
+
+func interfaceName(instanceID string, eni *ec2.InstanceNetworkInterface) string {
+	if eni == nil {
+		return instanceID
+	}
+	return instanceID + "/" + aws.StringValue(eni.NetworkInterfaceId)
+}
+
+// Orphans returns the names of the owned security groups which aren't attached to
+// any instance, including the instances which aren't nodes of the cluster. The
+// groups of the same name in several regions are orphaned once detached in all of them.
+func (p *AWSProvider) Orphans() ([]string, error) {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	owned := map[string]bool{}
+	attachedNames := map[string]bool{}
+	for _, region := range s.regions {
+		sgs, err := p.describeSecurityGroups(region.client, &ec2.DescribeSecurityGroupsInput{
+			Filters: []*ec2.Filter{
+				newEc2Filter("tag:"+TagNameExternalIPsPrefix+s.clusterName, ResourceLifecycleOwned),
+				newEc2Filter("vpc-id", region.vpcID),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(sgs) == 0 {
+			continue
+		}
+
+		groupIds := make([]string, 0, len(sgs))
+		for _, sg := range sgs {
+			groupIds = append(groupIds, aws.StringValue(sg.GroupId))
+		}
+		// the groups of all the network interfaces, including the primary one carrying the groups of the instance
+		instances, err := p.describeInstances(region.client, &ec2.DescribeInstancesInput{
+			Filters: []*ec2.Filter{
+				newEc2Filter("network-interface.group-id", groupIds...),
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		attached := make(map[string]bool, len(sgs))
+		for _, instance := range instances {
+			for id := range instanceGroupIDs(instance) {
+				attached[id] = true
+			}
+		}
+
+		for _, sg := range sgs {
+			name := aws.StringValue(sg.GroupName)
+			if !owned[name] {
+				owned[name] = true
+				names = append(names, name)
+			}
+			if attached[aws.StringValue(sg.GroupId)] {
+				attachedNames[name] = true
+			}
+		}
+	}
+
+	var orphans []string
+	for _, name := range names {
+		if !attachedNames[name] {
+			orphans = append(orphans, name)
+		}
+	}
+	return orphans, nil
+}
+
+// DeleteOrphan deletes the owned security group of the given name, in all the
+// regions of the nodes.
+func (p *AWSProvider) DeleteOrphan(name string) error {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return err
+	}
+	sgs, _, err := p.regionSecurityGroups(s, name, "")
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Desired change: %s %s", "DELETE ORPHANED SG", name)
+	if p.dryRun {
+		return nil
+	}
+	for _, g := range sgs {
+		_, err = g.region.client.DeleteSecurityGroup(&ec2.DeleteSecurityGroupInput{
+			GroupId: g.sg.GroupId,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func newEc2Filter(name string, values ...string) *ec2.Filter {
 	filter := &ec2.Filter{
 		Name: aws.String(name),
@@ -499,11 +1449,16 @@ func newEc2Filter(name string, values ...string) *ec2.Filter {
 
 // Implementation of EC2.Instances
 func (p *AWSProvider) DescribeInstances(request *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
+	return p.describeInstances(p.client, request)
+}
+
+// describeInstances describes the instances with the client of a region.
+func (p *AWSProvider) describeInstances(client EC2API, request *ec2.DescribeInstancesInput) ([]*ec2.Instance, error) {
 	// Instances are paged
 	results := []*ec2.Instance{}
 	var nextToken *string
 	for {
-		response, err := p.client.DescribeInstances(request)
+		response, err := client.DescribeInstances(request)
 		if err != nil {
 			return nil, err
 		}
@@ -521,12 +1476,56 @@ func (p *AWSProvider) DescribeInstances(request *ec2.DescribeInstancesInput) ([]
 	return results, nil
 }
 
+// SecurityGroupCount returns the number of security groups of the VPC of the
+// cluster, including the ones managed by others, which share its quota. Each
+// region having its own VPC and quota, the largest count is returned when the
+// nodes span several regions.
+func (p *AWSProvider) SecurityGroupCount() (int, error) {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, region := range s.regions {
+		sgs, err := p.describeSecurityGroups(region.client, &ec2.DescribeSecurityGroupsInput{
+			Filters: []*ec2.Filter{newEc2Filter("vpc-id", region.vpcID)},
+		})
+		if err != nil {
+			return 0, err
+		}
+		if len(sgs) > count {
+			count = len(sgs)
+		}
+	}
+	return count, nil
+}
+
 // Implements EC2.DescribeSecurityGroups
 func (p *AWSProvider) DescribeSecurityGroups(request *ec2.DescribeSecurityGroupsInput) ([]*ec2.SecurityGroup, error) {
-	// Security groups are not paged
-	response, err := p.client.DescribeSecurityGroups(request)
-	if err != nil {
-		return nil, err
+	return p.describeSecurityGroups(p.client, request)
+}
+
+// describeSecurityGroups describes the security groups with the client of a region.
+func (p *AWSProvider) describeSecurityGroups(client EC2API, request *ec2.DescribeSecurityGroupsInput) ([]*ec2.SecurityGroup, error) {
+	// Security groups are paged, provided MaxResults is set, which excludes GroupIds
+	if len(request.GroupIds) == 0 && request.MaxResults == nil {
+		request.MaxResults = aws.Int64(describeSecurityGroupsPageSize)
 	}
-	return response.SecurityGroups, nil
+	results := []*ec2.SecurityGroup{}
+	var nextToken *string
+	for {
+		response, err := client.DescribeSecurityGroups(request)
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, response.SecurityGroups...)
+
+		nextToken = response.NextToken
+		if aws.StringValue(nextToken) == "" {
+			break
+		}
+		request.NextToken = nextToken
+	}
+	return results, nil
 }
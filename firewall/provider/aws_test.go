@@ -0,0 +1,828 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// EC2APIStub deletes the security groups which aren't in use and authorizes the
+// permissions of the security groups. The other calls aren't implemented.
+type EC2APIStub struct {
+	EC2API
+
+	groups  map[string]*ec2.SecurityGroup
+	inUse   map[string]bool
+	deletes int
+}
+
+func (s *EC2APIStub) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	for _, f := range input.Filters {
+		if aws.StringValue(f.Name) != "group-name" {
+			continue
+		}
+		for _, name := range f.Values {
+			if sg, ok := s.groups[aws.StringValue(name)]; ok {
+				output.SecurityGroups = append(output.SecurityGroups, sg)
+			}
+		}
+	}
+	return output, nil
+}
+
+func (s *EC2APIStub) DeleteSecurityGroup(input *ec2.DeleteSecurityGroupInput) (*ec2.DeleteSecurityGroupOutput, error) {
+	s.deletes++
+	for name, sg := range s.groups {
+		if aws.StringValue(sg.GroupId) != aws.StringValue(input.GroupId) {
+			continue
+		}
+		if s.inUse[name] {
+			return nil, awserr.New(errCodeDependencyViolation, "resource has a dependent object", nil)
+		}
+		delete(s.groups, name)
+	}
+	return &ec2.DeleteSecurityGroupOutput{}, nil
+}
+
+func (s *EC2APIStub) AuthorizeSecurityGroupIngress(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	for _, sg := range s.groups {
+		if aws.StringValue(sg.GroupId) == aws.StringValue(input.GroupId) {
+			sg.IpPermissions = append(sg.IpPermissions, input.IpPermissions...)
+			return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+		}
+	}
+	return nil, fmt.Errorf("no security group %s", aws.StringValue(input.GroupId))
+}
+
+func newEC2APIStub(names ...string) *EC2APIStub {
+	s := &EC2APIStub{
+		groups: map[string]*ec2.SecurityGroup{},
+		inUse:  map[string]bool{},
+	}
+	for _, name := range names {
+		s.groups[name] = &ec2.SecurityGroup{
+			GroupId:   aws.String("sg-" + name),
+			GroupName: aws.String(name),
+		}
+	}
+	return s
+}
+
+func TestAWSPermissions(t *testing.T) {
+	statements := AWSPermissions("kube.example.org")
+	resources := func(action string) [][]string {
+		result := [][]string{}
+		for _, s := range statements {
+			for _, a := range s.Action {
+				if a == action {
+					result = append(result, s.Resource)
+				}
+			}
+		}
+		return result
+	}
+
+	// the security groups are attached to the instances of the cluster and to network interfaces, never to other resources
+	assert.Equal(t, [][]string{
+		{"arn:aws:ec2:*:*:instance/*"},
+		{"arn:aws:ec2:*:*:network-interface/*", "arn:aws:ec2:*:*:security-group/*"},
+	}, resources("ec2:ModifyInstanceAttribute"))
+	assert.Equal(t, [][]string{
+		{"arn:aws:ec2:*:*:network-interface/*", "arn:aws:ec2:*:*:security-group/*"},
+	}, resources("ec2:ModifyNetworkInterfaceAttribute"))
+	assert.Equal(t, map[string]map[string]string{
+		"StringEquals": {"ec2:ResourceTag/KubernetesCluster": "kube.example.org"},
+	}, statements[1].Condition)
+
+	assert.Equal(t, [][]string{{"arn:aws:ec2:*:*:security-group/*"}}, resources("ec2:AuthorizeSecurityGroupIngress"))
+	assert.Equal(t, [][]string{{"*"}}, resources("ec2:DescribeInstances"))
+}
+
+func TestAWSDeleteSecurityGroupsInUse(t *testing.T) {
+	client := newEC2APIStub("foo.kube.openfresh.io", "bar.kube.openfresh.io")
+	client.inUse["foo.kube.openfresh.io"] = true
+	p := &AWSProvider{client: client}
+	s := &instanceSnapshot{regions: singleRegion(client)}
+
+	changes := &plan.Changes{
+		Delete: []*inbound.InboundRules{
+			{Name: "foo.kube.openfresh.io"},
+			{Name: "bar.kube.openfresh.io"},
+		},
+	}
+
+	// the group in use doesn't fail the others
+	require.NoError(t, p.deleteSecurityGroups(s, changes))
+	assert.NotContains(t, client.groups, "bar.kube.openfresh.io")
+	require.Contains(t, p.pendingDeletions, "foo.kube.openfresh.io")
+	assert.Equal(t, 1, p.pendingDeletions["foo.kube.openfresh.io"].attempts)
+	assert.Equal(t, 2, client.deletes)
+
+	// the deletion isn't retried before its backoff
+	changes.Delete = changes.Delete[:1]
+	require.NoError(t, p.deleteSecurityGroups(s, changes))
+	assert.Equal(t, 2, client.deletes)
+
+	// once released, the group is deleted on the next attempt
+	client.inUse["foo.kube.openfresh.io"] = false
+	p.pendingDeletions["foo.kube.openfresh.io"].next = time.Now()
+	require.NoError(t, p.deleteSecurityGroups(s, changes))
+	assert.Empty(t, client.groups)
+	assert.Empty(t, p.pendingDeletions)
+}
+
+func TestAWSDeleteSecurityGroupsDesiredAgain(t *testing.T) {
+	p := &AWSProvider{}
+	p.postponeDeletion("foo.kube.openfresh.io", time.Now())
+
+	require.NoError(t, p.deleteSecurityGroups(&instanceSnapshot{}, &plan.Changes{
+		UpdateNew: []*inbound.InboundRules{{Name: "foo.kube.openfresh.io"}},
+	}))
+	assert.Empty(t, p.pendingDeletions)
+}
+
+func TestAWSPostponeDeletion(t *testing.T) {
+	now := time.Now()
+	p := &AWSProvider{}
+
+	for _, expected := range []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute, 10 * time.Minute, 10 * time.Minute} {
+		p.postponeDeletion("foo.kube.openfresh.io", now)
+		assert.Equal(t, now.Add(expected), p.pendingDeletions["foo.kube.openfresh.io"].next)
+	}
+	assert.Equal(t, now, p.pendingDeletions["foo.kube.openfresh.io"].since)
+}
+
+func TestAWSPrunePendingDeletions(t *testing.T) {
+	p := &AWSProvider{}
+	p.postponeDeletion("foo.kube.openfresh.io", time.Now())
+	p.postponeDeletion("bar.kube.openfresh.io", time.Now())
+
+	p.prunePendingDeletions([]*ec2.SecurityGroup{{GroupName: aws.String("foo.kube.openfresh.io")}})
+	assert.Contains(t, p.pendingDeletions, "foo.kube.openfresh.io")
+	assert.NotContains(t, p.pendingDeletions, "bar.kube.openfresh.io")
+}
+
+// pagingEC2APIStub serves the security groups of the cluster matching the tag and
+// description filters a page at a time, recording the filters of the requests,
+// and the instances requested by ID. The security groups it creates aren't known
+// to the notFound next calls tagging or authorizing them.
+type pagingEC2APIStub struct {
+	EC2API
+
+	groups    []*ec2.SecurityGroup
+	instances []*ec2.Instance
+	pageSize  int
+	filters   [][]*ec2.Filter
+	notFound  int
+}
+
+func (s *pagingEC2APIStub) DescribeSecurityGroups(input *ec2.DescribeSecurityGroupsInput) (*ec2.DescribeSecurityGroupsOutput, error) {
+	s.filters = append(s.filters, input.Filters)
+	var groups []*ec2.SecurityGroup
+	for _, sg := range s.groups {
+		if matchFilters(sg, input.Filters) {
+			groups = append(groups, sg)
+		}
+	}
+
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(aws.StringValue(input.NextToken))
+	}
+	end := start + s.pageSize
+	output := &ec2.DescribeSecurityGroupsOutput{}
+	if end < len(groups) {
+		output.NextToken = aws.String(strconv.Itoa(end))
+	} else {
+		end = len(groups)
+	}
+	output.SecurityGroups = groups[start:end]
+	return output, nil
+}
+
+func matchFilters(sg *ec2.SecurityGroup, filters []*ec2.Filter) bool {
+	for _, f := range filters {
+		name, value := aws.StringValue(f.Name), aws.StringValue(f.Values[0])
+		switch {
+		case name == "description":
+			if aws.StringValue(sg.Description) != value {
+				return false
+			}
+		case name == "group-name":
+			if aws.StringValue(sg.GroupName) != value {
+				return false
+			}
+		case strings.HasPrefix(name, "tag:"):
+			tagged := false
+			for _, tag := range sg.Tags {
+				if aws.StringValue(tag.Key) == strings.TrimPrefix(name, "tag:") && aws.StringValue(tag.Value) == value {
+					tagged = true
+				}
+			}
+			if !tagged {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *pagingEC2APIStub) DescribeInstances(input *ec2.DescribeInstancesInput) (*ec2.DescribeInstancesOutput, error) {
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		for _, instance := range s.instances {
+			if aws.StringValue(instance.InstanceId) == aws.StringValue(id) {
+				reservation.Instances = append(reservation.Instances, instance)
+			}
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, nil
+}
+
+// CreateSecurityGroup adds the security group unless its name is taken.
+func (s *pagingEC2APIStub) CreateSecurityGroup(input *ec2.CreateSecurityGroupInput) (*ec2.CreateSecurityGroupOutput, error) {
+	for _, sg := range s.groups {
+		if aws.StringValue(sg.GroupName) == aws.StringValue(input.GroupName) {
+			return nil, awserr.New(errCodeInvalidGroupDuplicate, "security group already exists", nil)
+		}
+	}
+	id := aws.String(fmt.Sprintf("sg-%d", len(s.groups)))
+	s.groups = append(s.groups, &ec2.SecurityGroup{
+		GroupId:     id,
+		GroupName:   input.GroupName,
+		Description: input.Description,
+		VpcId:       input.VpcId,
+	})
+	return &ec2.CreateSecurityGroupOutput{GroupId: id}, nil
+}
+
+// known fails while the security groups just created aren't known yet.
+func (s *pagingEC2APIStub) known() error {
+	if s.notFound > 0 {
+		s.notFound--
+		return awserr.New(errCodeInvalidGroupNotFound, "security group does not exist", nil)
+	}
+	return nil
+}
+
+// CreateTags adds the tags to the security groups.
+func (s *pagingEC2APIStub) CreateTags(input *ec2.CreateTagsInput) (*ec2.CreateTagsOutput, error) {
+	if err := s.known(); err != nil {
+		return nil, err
+	}
+	for _, id := range input.Resources {
+		for _, sg := range s.groups {
+			if aws.StringValue(sg.GroupId) == aws.StringValue(id) {
+				sg.Tags = append(sg.Tags, input.Tags...)
+			}
+		}
+	}
+	return &ec2.CreateTagsOutput{}, nil
+}
+
+// RevokeSecurityGroupIngress revokes all the permissions of the security group.
+func (s *pagingEC2APIStub) RevokeSecurityGroupIngress(input *ec2.RevokeSecurityGroupIngressInput) (*ec2.RevokeSecurityGroupIngressOutput, error) {
+	for _, sg := range s.groups {
+		if aws.StringValue(sg.GroupId) == aws.StringValue(input.GroupId) {
+			sg.IpPermissions = nil
+		}
+	}
+	return &ec2.RevokeSecurityGroupIngressOutput{}, nil
+}
+
+// AuthorizeSecurityGroupIngress adds the permissions to the security group.
+func (s *pagingEC2APIStub) AuthorizeSecurityGroupIngress(input *ec2.AuthorizeSecurityGroupIngressInput) (*ec2.AuthorizeSecurityGroupIngressOutput, error) {
+	if err := s.known(); err != nil {
+		return nil, err
+	}
+	for _, sg := range s.groups {
+		if aws.StringValue(sg.GroupId) == aws.StringValue(input.GroupId) {
+			sg.IpPermissions = append(sg.IpPermissions, input.IpPermissions...)
+		}
+	}
+	return &ec2.AuthorizeSecurityGroupIngressOutput{}, nil
+}
+
+func newPagingEC2APIStub(count, pageSize int) *pagingEC2APIStub {
+	s := &pagingEC2APIStub{pageSize: pageSize}
+	for i := 0; i < count; i++ {
+		s.groups = append(s.groups, &ec2.SecurityGroup{
+			GroupId:     aws.String(fmt.Sprintf("sg-%d", i)),
+			GroupName:   aws.String(fmt.Sprintf("svc%d.kube.openfresh.io", i)),
+			Description: aws.String(securityGroupDescription),
+			Tags: []*ec2.Tag{
+				{Key: aws.String(TagNameExternalIPsPrefix + "kube.openfresh.io"), Value: aws.String(ResourceLifecycleOwned)},
+			},
+		})
+	}
+	return s
+}
+
+func TestAWSDescribeSecurityGroupsPaged(t *testing.T) {
+	client := newPagingEC2APIStub(2500, 1000)
+	p := &AWSProvider{client: client}
+
+	request := &ec2.DescribeSecurityGroupsInput{}
+	sgs, err := p.DescribeSecurityGroups(request)
+	require.NoError(t, err)
+	assert.Len(t, sgs, 2500)
+	assert.Len(t, client.filters, 3)
+	assert.Equal(t, int64(describeSecurityGroupsPageSize), aws.Int64Value(request.MaxResults))
+}
+
+func TestAWSOrphansScopedToVPC(t *testing.T) {
+	client := newPagingEC2APIStub(5, 2)
+	p := &AWSProvider{client: client, snapshot: &instanceSnapshot{clusterName: "kube.openfresh.io", regions: singleRegion(client)}}
+
+	orphans, err := p.Orphans()
+	require.NoError(t, err)
+	assert.Len(t, orphans, 5)
+
+	// every page is scoped to the groups of the cluster in its VPC
+	require.Len(t, client.filters, 3)
+	for _, filters := range client.filters {
+		assert.Equal(t, []*ec2.Filter{
+			newEc2Filter("tag:"+TagNameExternalIPsPrefix+"kube.openfresh.io", ResourceLifecycleOwned),
+			newEc2Filter("vpc-id", "vpc-1"),
+		}, filters)
+	}
+}
+
+func TestAWSSecurityGroupCount(t *testing.T) {
+	client := newPagingEC2APIStub(5, 2)
+	p := &AWSProvider{client: client, snapshot: &instanceSnapshot{clusterName: "kube.openfresh.io", regions: singleRegion(client)}}
+
+	count, err := p.SecurityGroupCount()
+	require.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	// the groups of every owner count, in the VPC of the cluster only
+	require.Len(t, client.filters, 3)
+	for _, filters := range client.filters {
+		assert.Equal(t, []*ec2.Filter{newEc2Filter("vpc-id", "vpc-1")}, filters)
+	}
+}
+
+// nodeListerStub lists the nodes of the given ProviderIDs.
+type nodeListerStub struct {
+	providerIDs []string
+}
+
+func (l *nodeListerStub) List() ([]*v1.Node, error) {
+	var nodes []*v1.Node
+	for _, id := range l.providerIDs {
+		nodes = append(nodes, &v1.Node{Spec: v1.NodeSpec{ProviderID: id}})
+	}
+	return nodes, nil
+}
+
+// singleRegion returns the regions of a snapshot of the nodes in ap-northeast-1 only.
+func singleRegion(client EC2API) []*regionSnapshot {
+	return []*regionSnapshot{{name: "ap-northeast-1", client: client, vpcID: "vpc-1"}}
+}
+
+func newInstance(id string, groupIDs ...string) *ec2.Instance {
+	instance := &ec2.Instance{
+		InstanceId: aws.String(id),
+		VpcId:      aws.String("vpc-1"),
+		Tags:       []*ec2.Tag{{Key: aws.String("KubernetesCluster"), Value: aws.String("kube.openfresh.io")}},
+	}
+	for _, id := range groupIDs {
+		instance.SecurityGroups = append(instance.SecurityGroups, &ec2.GroupIdentifier{GroupId: aws.String(id)})
+	}
+	return instance
+}
+
+func TestAWSRulesNodeChurn(t *testing.T) {
+	client := newPagingEC2APIStub(1, 10)
+	client.groups[0].IpPermissions = []*ec2.IpPermission{{IpProtocol: aws.String("tcp"), ToPort: aws.Int64(80)}}
+	client.instances = []*ec2.Instance{newInstance("i-1", "sg-0"), newInstance("i-2", "sg-0")}
+	nodes := &nodeListerStub{providerIDs: []string{"aws:///ap-northeast-1a/i-1"}}
+	p := &AWSProvider{client: client, nodeLister: nodes}
+
+	rules, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, []string{"aws:///ap-northeast-1a/i-1"}, rules[0].ProviderIDs)
+	first := p.snapshot
+
+	// the nodes replaced in between are mapped by the snapshot of the next call
+	nodes.providerIDs = []string{"aws:///ap-northeast-1c/i-2"}
+	rules, err = p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, []string{"aws:///ap-northeast-1c/i-2"}, rules[0].ProviderIDs)
+
+	// the earlier snapshot is left as taken
+	assert.Equal(t, map[string]string{"i-1": "aws:///ap-northeast-1a/i-1"}, first.providerIDs)
+	assert.Equal(t, map[string]string{"i-2": "aws:///ap-northeast-1c/i-2"}, p.snapshot.providerIDs)
+
+	// the other calls reuse the latest snapshot
+	vpcID, err := p.GetVPCID()
+	require.NoError(t, err)
+	assert.Equal(t, "vpc-1", vpcID)
+	clusterName, err := p.GetClusterName()
+	require.NoError(t, err)
+	assert.Equal(t, "kube.openfresh.io", clusterName)
+
+	// the changes are applied against a snapshot of their own, the nodes having
+	// changed since the rules were listed
+	nodes.providerIDs = []string{"aws:///ap-northeast-1a/i-1"}
+	require.NoError(t, p.ApplyChanges(&plan.Changes{}))
+	assert.Equal(t, map[string]string{"i-1": "aws:///ap-northeast-1a/i-1"}, p.snapshot.providerIDs)
+}
+
+func TestAWSRulesMultipleRegions(t *testing.T) {
+	tokyo := newPagingEC2APIStub(2, 10)
+	tokyo.instances = []*ec2.Instance{newInstance("i-1", "sg-0", "sg-1")}
+	// svc0 is in both regions, svc1 is missing from us-east-1
+	virginia := newPagingEC2APIStub(1, 10)
+	virginia.groups[0].GroupId = aws.String("sg-v0")
+	virginia.instances = []*ec2.Instance{newInstance("i-2", "sg-v0")}
+	virginia.instances[0].VpcId = aws.String("vpc-2")
+	for _, sg := range []*ec2.SecurityGroup{tokyo.groups[0], virginia.groups[0]} {
+		sg.Tags = append(sg.Tags, resourceTag("default/svc0"))
+	}
+	var regions []string
+	p := &AWSProvider{
+		client: tokyo,
+		region: "ap-northeast-1",
+		newClient: func(region string) EC2API {
+			regions = append(regions, region)
+			return virginia
+		},
+		nodeLister: &nodeListerStub{providerIDs: []string{"aws:///ap-northeast-1a/i-1", "aws:///us-east-1a/i-2"}},
+	}
+
+	rules, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "svc0.kube.openfresh.io", rules[0].Name)
+	assert.Equal(t, []string{"aws:///ap-northeast-1a/i-1", "aws:///us-east-1a/i-2"}, []string(rules[0].ProviderIDs))
+	assert.False(t, rules[0].Drifted)
+	assert.Equal(t, "svc1.kube.openfresh.io", rules[1].Name)
+	assert.True(t, rules[1].Drifted)
+
+	vpcIDs, err := p.GetVPCIDs()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"vpc-1", "vpc-2"}, vpcIDs)
+
+	// the groups are created in every region, the missing ones by their update
+	desired := []inbound.InboundRule{{Protocol: "tcp", Port: 80, Description: "default/svc/80"}}
+	require.NoError(t, p.ApplyChanges(&plan.Changes{
+		Create:    []*inbound.InboundRules{{Name: "svc2.kube.openfresh.io", Rules: desired}},
+		UpdateOld: rules[1:],
+		UpdateNew: []*inbound.InboundRules{{Name: "svc1.kube.openfresh.io", Rules: desired}},
+	}))
+	require.Len(t, tokyo.groups, 3)
+	require.Len(t, virginia.groups, 3)
+	for _, sg := range virginia.groups[1:] {
+		assert.Equal(t, "vpc-2", aws.StringValue(sg.VpcId))
+		assert.Len(t, sg.IpPermissions, 1)
+	}
+	// the client of the region is created once
+	assert.Equal(t, []string{"us-east-1"}, regions)
+}
+
+func TestAWSInstanceRegion(t *testing.T) {
+	p := &AWSProvider{region: "ap-northeast-1"}
+	for providerID, expected := range map[string]string{
+		"aws:///us-east-1a/i-1":       "us-east-1",
+		"aws:///us-gov-west-1b/i-1":   "us-gov-west-1",
+		"aws:///us-east-1-bos-1a/i-1": "us-east-1",
+		"aws:///eu-central-1c/i-1":    "eu-central-1",
+		"aws:////i-1":                 "ap-northeast-1",
+		"i-1":                         "ap-northeast-1",
+	} {
+		region, err := p.instanceRegion(providerID)
+		require.NoError(t, err)
+		assert.Equal(t, expected, region, providerID)
+	}
+}
+
+func TestAWSInboundRuleSources(t *testing.T) {
+	client := newEC2APIStub("svc")
+	p := &AWSProvider{client: client}
+	sg := client.groups["svc"]
+
+	rules := &inbound.InboundRules{Rules: []inbound.InboundRule{
+		{Protocol: "tcp", Port: 80, Description: "default/svc/http"},
+		{Protocol: "tcp", Port: 8080, Description: "default/svc/admin", SourceCIDRs: []string{"192.168.0.0/16", "10.0.0.0/8"}},
+		{Protocol: "tcp", Port: 9090, Description: "default/svc/metrics", SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+		{Protocol: "udp", Port: 5000, Description: "default/svc/5000", SourceCIDRs: []string{"10.0.0.0/8"}, SourceSecurityGroup: "sg-other"},
+		{Protocol: "tcp", Port: 30000, ToPort: 32767, Description: "default/svc/node-ports"},
+	}}
+	require.NoError(t, p.addInboundRules(client, sg.GroupId, rules.Rules))
+
+	// the ranges are authorized as IP ranges, the groups as group pairs, the group itself by its ID
+	require.Len(t, sg.IpPermissions, 5)
+	assert.Equal(t, "0.0.0.0/0", aws.StringValue(sg.IpPermissions[0].IpRanges[0].CidrIp))
+	assert.Len(t, sg.IpPermissions[1].IpRanges, 2)
+	assert.Empty(t, sg.IpPermissions[2].IpRanges)
+	assert.Equal(t, "sg-svc", aws.StringValue(sg.IpPermissions[2].UserIdGroupPairs[0].GroupId))
+	assert.Equal(t, "sg-other", aws.StringValue(sg.IpPermissions[3].UserIdGroupPairs[0].GroupId))
+	assert.Equal(t, int64(30000), aws.Int64Value(sg.IpPermissions[4].FromPort))
+	assert.Equal(t, int64(32767), aws.Int64Value(sg.IpPermissions[4].ToPort))
+
+	// and read back as the same rules
+	current := inbound.NewInboundRules()
+	for _, perm := range sg.IpPermissions {
+		current.Rules = append(current.Rules, newInboundRule(sg, perm))
+	}
+	assert.True(t, rules.Same(current))
+}
+
+func TestAWSInboundRuleSCTP(t *testing.T) {
+	client := newEC2APIStub("svc")
+	p := &AWSProvider{client: client}
+	sg := client.groups["svc"]
+
+	rules := &inbound.InboundRules{Rules: []inbound.InboundRule{
+		{Protocol: inbound.ProtocolSCTP, Port: 3868, Description: "default/svc/diameter"},
+	}}
+	require.NoError(t, p.addInboundRules(client, sg.GroupId, rules.Rules))
+
+	// EC2 takes SCTP by number, read back by name
+	require.Len(t, sg.IpPermissions, 1)
+	assert.Equal(t, "132", aws.StringValue(sg.IpPermissions[0].IpProtocol))
+	current := &inbound.InboundRules{Rules: []inbound.InboundRule{newInboundRule(sg, sg.IpPermissions[0])}}
+	assert.True(t, rules.Same(current))
+}
+
+func TestAWSInstanceTags(t *testing.T) {
+	p := &AWSProvider{}
+	assert.Nil(t, p.InstanceTags())
+
+	p.snapshot = &instanceSnapshot{
+		instances:   []*ec2.Instance{newInstance("i-1"), newInstance("i-2")},
+		providerIDs: map[string]string{"i-1": "aws:///ap-northeast-1a/i-1"},
+	}
+	// the instances which aren't nodes are left out
+	assert.Equal(t, map[string]map[string]string{
+		"aws:///ap-northeast-1a/i-1": {"KubernetesCluster": "kube.openfresh.io"},
+	}, p.InstanceTags())
+}
+
+func TestAWSRulesDrift(t *testing.T) {
+	client := newPagingEC2APIStub(3, 10)
+	// svc1 lost its ownership tag, svc2 was tagged for another cluster
+	client.groups[1].Tags = nil
+	client.groups[2].Tags[0].Value = aws.String("shared")
+	// a source of svc0 was described by hand
+	client.groups[0].IpPermissions = []*ec2.IpPermission{{
+		IpProtocol: aws.String("tcp"),
+		ToPort:     aws.Int64(80),
+		IpRanges: []*ec2.IpRange{
+			{CidrIp: aws.String("10.0.0.0/8"), Description: aws.String("default/svc0/80")},
+			{CidrIp: aws.String("192.168.0.0/16"), Description: aws.String("office")},
+		},
+	}}
+	client.instances = []*ec2.Instance{newInstance("i-1")}
+	p := &AWSProvider{client: client, nodeLister: &nodeListerStub{providerIDs: []string{"aws:///ap-northeast-1a/i-1"}}}
+
+	rules, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 3)
+	byName := map[string]*inbound.InboundRules{}
+	for _, r := range rules {
+		byName[r.Name] = r
+	}
+	assert.True(t, byName["svc0.kube.openfresh.io"].Drifted)
+	assert.False(t, byName["svc0.kube.openfresh.io"].Untagged)
+	assert.True(t, byName["svc1.kube.openfresh.io"].Untagged)
+	assert.True(t, byName["svc2.kube.openfresh.io"].Untagged)
+}
+
+func TestAWSRulesNestedClusterName(t *testing.T) {
+	client := newPagingEC2APIStub(3, 10)
+	// svc1 belongs to the b.kube.openfresh.io cluster, whose name ends with the name of
+	// the cluster, svc2 lost its ownership tag but kept its resource tag
+	client.groups[1].GroupName = aws.String("svc1.b.kube.openfresh.io")
+	client.groups[1].Tags[0].Key = aws.String(TagNameExternalIPsPrefix + "b.kube.openfresh.io")
+	client.groups[2].Tags = []*ec2.Tag{resourceTag("default/svc2")}
+	client.instances = []*ec2.Instance{newInstance("i-1")}
+	p := &AWSProvider{client: client, nodeLister: &nodeListerStub{providerIDs: []string{"aws:///ap-northeast-1a/i-1"}}}
+
+	rules, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "svc0.kube.openfresh.io", rules[0].Name)
+	assert.False(t, rules[0].Untagged)
+	assert.Equal(t, "svc2.kube.openfresh.io", rules[1].Name)
+	assert.True(t, rules[1].Untagged)
+}
+
+func TestAWSSecurityGroupResource(t *testing.T) {
+	client := newPagingEC2APIStub(2, 10)
+	// svc0 was renamed after its resource tag, svc1 was created before the resource tag
+	client.groups[0].GroupName = aws.String("default-svc0.kube.openfresh.io")
+	client.groups[0].Tags = append(client.groups[0].Tags, resourceTag("default/svc0"))
+	client.groups[1].IpPermissions = []*ec2.IpPermission{{IpProtocol: aws.String("tcp"), ToPort: aws.Int64(80)}}
+	client.instances = []*ec2.Instance{newInstance("i-1")}
+	p := &AWSProvider{client: client, nodeLister: &nodeListerStub{providerIDs: []string{"aws:///ap-northeast-1a/i-1"}}}
+
+	rules, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "default/svc0", rules[0].Resource)
+	assert.False(t, rules[0].Drifted)
+	// the rules without resource tag are updated to get it
+	assert.Empty(t, rules[1].Resource)
+	assert.True(t, rules[1].Drifted)
+
+	// the security group of a resource is found by its tag whatever its name
+	sg, err := p.findSecurityGroup(p.snapshot, p.snapshot.regions[0], "svc0.kube.openfresh.io", "default/svc0")
+	require.NoError(t, err)
+	assert.Equal(t, "sg-0", aws.StringValue(sg.GroupId))
+	// and by its name as long as it isn't tagged
+	sg, err = p.findSecurityGroup(p.snapshot, p.snapshot.regions[0], "svc1.kube.openfresh.io", "default/svc1")
+	require.NoError(t, err)
+	assert.Equal(t, "sg-1", aws.StringValue(sg.GroupId))
+	// a missing security group is reported as such rather than as a duplicate
+	_, err = p.findSecurityGroup(p.snapshot, p.snapshot.regions[0], "svc9.kube.openfresh.io", "default/svc9")
+	assert.EqualError(t, err, "security group svc9.kube.openfresh.io of default/svc9 was not found in ap-northeast-1")
+	_, _, err = p.regionSecurityGroups(p.snapshot, "svc9.kube.openfresh.io", "default/svc9")
+	assert.EqualError(t, err, "security group svc9.kube.openfresh.io of default/svc9 was not found in any region of the nodes: ap-northeast-1")
+
+	desired := &inbound.InboundRules{
+		Name:     "svc1.kube.openfresh.io",
+		Resource: "default/svc1",
+		Rules:    []inbound.InboundRule{{Protocol: "tcp", Port: 80, Description: "default/svc1/80"}},
+	}
+	require.NoError(t, p.updateSecurityGroups(p.snapshot, &plan.Changes{UpdateOld: rules[1:], UpdateNew: []*inbound.InboundRules{desired}}))
+	assert.Equal(t, "default/svc1", tagValue(client.groups[1].Tags, TagNameResource))
+
+	rules, err = p.Rules()
+	require.NoError(t, err)
+	assert.Equal(t, "default/svc1", rules[1].Resource)
+	assert.False(t, rules[1].Drifted)
+}
+
+func TestAWSCreateSecurityGroupsNotFound(t *testing.T) {
+	client := newPagingEC2APIStub(0, 10)
+	var delays []time.Duration
+	p := &AWSProvider{client: client, sleep: func(d time.Duration) { delays = append(delays, d) }}
+	s := &instanceSnapshot{clusterName: "kube.openfresh.io", regions: singleRegion(client)}
+	rules := &inbound.InboundRules{
+		Name:     "svc0.kube.openfresh.io",
+		Resource: "default/svc0",
+		Rules:    []inbound.InboundRule{{Protocol: "tcp", Port: 80, SourceCIDRs: []string{"0.0.0.0/0"}}},
+	}
+
+	// the calls on the new group are retried until EC2 knows it
+	client.notFound = 3
+	require.NoError(t, p.createSecurityGroups(s, &plan.Changes{Create: []*inbound.InboundRules{rules}}))
+	require.Len(t, client.groups, 1)
+	assert.Equal(t, "default/svc0", tagValue(client.groups[0].Tags, TagNameResource))
+	assert.Len(t, client.groups[0].IpPermissions, 1)
+	assert.Equal(t, []time.Duration{newGroupRetryDelay, 2 * newGroupRetryDelay, 4 * newGroupRetryDelay}, delays)
+
+	// until the attempts run out
+	client.notFound = newGroupAttempts
+	rules2 := &inbound.InboundRules{Name: "svc1.kube.openfresh.io", Resource: "default/svc1", Rules: rules.Rules}
+	err := p.createSecurityGroups(s, &plan.Changes{Create: []*inbound.InboundRules{rules2}})
+	require.Error(t, err)
+	assert.Equal(t, errCodeInvalidGroupNotFound, err.(awserr.Error).Code())
+}
+
+func TestAWSCreateSecurityGroupsAdopt(t *testing.T) {
+	client := newPagingEC2APIStub(1, 10)
+	// the group was created by a former attempt failing to tag and authorize it
+	client.groups[0].Tags = nil
+	client.groups[0].IpPermissions = []*ec2.IpPermission{{IpProtocol: aws.String("udp"), ToPort: aws.Int64(53)}}
+	p := &AWSProvider{client: client}
+	s := &instanceSnapshot{clusterName: "kube.openfresh.io", regions: singleRegion(client)}
+	rules := &inbound.InboundRules{
+		Name:     "svc0.kube.openfresh.io",
+		Resource: "default/svc0",
+		Rules:    []inbound.InboundRule{{Protocol: "tcp", Port: 80, SourceCIDRs: []string{"0.0.0.0/0"}}},
+	}
+
+	require.NoError(t, p.createSecurityGroups(s, &plan.Changes{Create: []*inbound.InboundRules{rules}}))
+	require.Len(t, client.groups, 1)
+	assert.Equal(t, ResourceLifecycleOwned, tagValue(client.groups[0].Tags, TagNameExternalIPsPrefix+"kube.openfresh.io"))
+	assert.Equal(t, "default/svc0", tagValue(client.groups[0].Tags, TagNameResource))
+	require.Len(t, client.groups[0].IpPermissions, 1)
+	assert.Equal(t, "tcp", aws.StringValue(client.groups[0].IpPermissions[0].IpProtocol))
+
+	// the groups of the same name created by others aren't adopted
+	client.groups[0].Description = aws.String("Someone else's group")
+	assert.Error(t, p.createSecurityGroups(s, &plan.Changes{Create: []*inbound.InboundRules{rules}}))
+}
+
+// interfaceEC2APIStub records the security groups set on the instances and
+// their network interfaces, all of them starting with sg-default.
+type interfaceEC2APIStub struct {
+	*EC2APIStub
+
+	instanceGroups  map[string][]string
+	interfaceGroups map[string][]string
+}
+
+func (s *interfaceEC2APIStub) DescribeInstanceAttribute(input *ec2.DescribeInstanceAttributeInput) (*ec2.DescribeInstanceAttributeOutput, error) {
+	return &ec2.DescribeInstanceAttributeOutput{Groups: groupIdentifiers(s.instanceGroups, aws.StringValue(input.InstanceId))}, nil
+}
+
+func (s *interfaceEC2APIStub) ModifyInstanceAttribute(input *ec2.ModifyInstanceAttributeInput) (*ec2.ModifyInstanceAttributeOutput, error) {
+	s.instanceGroups[aws.StringValue(input.InstanceId)] = aws.StringValueSlice(input.Groups)
+	return &ec2.ModifyInstanceAttributeOutput{}, nil
+}
+
+func (s *interfaceEC2APIStub) DescribeNetworkInterfaceAttribute(input *ec2.DescribeNetworkInterfaceAttributeInput) (*ec2.DescribeNetworkInterfaceAttributeOutput, error) {
+	return &ec2.DescribeNetworkInterfaceAttributeOutput{Groups: groupIdentifiers(s.interfaceGroups, aws.StringValue(input.NetworkInterfaceId))}, nil
+}
+
+func (s *interfaceEC2APIStub) ModifyNetworkInterfaceAttribute(input *ec2.ModifyNetworkInterfaceAttributeInput) (*ec2.ModifyNetworkInterfaceAttributeOutput, error) {
+	s.interfaceGroups[aws.StringValue(input.NetworkInterfaceId)] = aws.StringValueSlice(input.Groups)
+	return &ec2.ModifyNetworkInterfaceAttributeOutput{}, nil
+}
+
+func groupIdentifiers(groups map[string][]string, id string) []*ec2.GroupIdentifier {
+	ids, ok := groups[id]
+	if !ok {
+		ids = []string{"sg-default"}
+	}
+	var identifiers []*ec2.GroupIdentifier
+	for _, id := range ids {
+		identifiers = append(identifiers, &ec2.GroupIdentifier{GroupId: aws.String(id)})
+	}
+	return identifiers
+}
+
+func newNetworkInterface(id string, deviceIndex int64, privateIP, publicIP string) *ec2.InstanceNetworkInterface {
+	eni := &ec2.InstanceNetworkInterface{
+		NetworkInterfaceId: aws.String(id),
+		Attachment:         &ec2.InstanceNetworkInterfaceAttachment{DeviceIndex: aws.Int64(deviceIndex)},
+		PrivateIpAddresses: []*ec2.InstancePrivateIpAddress{{PrivateIpAddress: aws.String(privateIP)}},
+	}
+	if publicIP != "" {
+		eni.Association = &ec2.InstanceNetworkInterfaceAssociation{PublicIp: aws.String(publicIP)}
+	}
+	return eni
+}
+
+func TestAWSSetSecurityGroupsMultipleInterfaces(t *testing.T) {
+	client := &interfaceEC2APIStub{
+		EC2APIStub:      newEC2APIStub("svc"),
+		instanceGroups:  map[string][]string{},
+		interfaceGroups: map[string][]string{},
+	}
+	single := newInstance("i-1")
+	single.NetworkInterfaces = []*ec2.InstanceNetworkInterface{newNetworkInterface("eni-1", 0, "10.0.0.1", "1.1.1.1")}
+	multiple := newInstance("i-2")
+	multiple.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+		newNetworkInterface("eni-2a", 0, "10.0.0.2", ""),
+		newNetworkInterface("eni-2b", 1, "10.0.1.2", "2.2.2.2"),
+	}
+	unmatched := newInstance("i-3")
+	unmatched.NetworkInterfaces = []*ec2.InstanceNetworkInterface{
+		newNetworkInterface("eni-3b", 1, "10.0.1.3", ""),
+		newNetworkInterface("eni-3a", 0, "10.0.0.3", ""),
+	}
+	p := &AWSProvider{client: client}
+	s := &instanceSnapshot{
+		instances: []*ec2.Instance{single, multiple, unmatched},
+		addresses: map[string][]string{
+			"i-1": {"1.1.1.1", "10.0.0.1"},
+			"i-2": {"2.2.2.2", "10.0.1.2"},
+			"i-3": {"10.9.9.9"},
+		},
+		regions: singleRegion(client),
+	}
+
+	require.NoError(t, p.setSecurityGroups(s, &plan.Changes{Set: []*plan.InstanceRule{
+		{ProviderID: "aws:///ap-northeast-1a/i-1", RulesName: "svc"},
+		{ProviderID: "aws:///ap-northeast-1a/i-2", RulesName: "svc"},
+		{ProviderID: "aws:///ap-northeast-1a/i-3", RulesName: "svc"},
+	}}))
+
+	// the instances with a single network interface are changed as a whole, the
+	// others on the interface of the node's addresses, the primary one by default
+	assert.Equal(t, map[string][]string{"i-1": {"sg-default", "sg-svc"}}, client.instanceGroups)
+	assert.Equal(t, map[string][]string{
+		"eni-2b": {"sg-default", "sg-svc"},
+		"eni-3a": {"sg-default", "sg-svc"},
+	}, client.interfaceGroups)
+
+	require.NoError(t, p.unsetSecurityGroups(s, &plan.Changes{Unset: []*plan.InstanceRule{
+		{ProviderID: "aws:///ap-northeast-1a/i-2", RulesName: "svc"},
+	}}))
+	assert.Equal(t, []string{"sg-default"}, client.interfaceGroups["eni-2b"])
+}
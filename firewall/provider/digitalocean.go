@@ -0,0 +1,691 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	digitalOceanEndpoint = "https://api.digitalocean.com/v2"
+	// the tag of the droplets of a DigitalOcean Kubernetes cluster, followed by the cluster ID
+	digitalOceanClusterTagPrefix = "k8s:"
+	// the tag of the worker droplets of any DigitalOcean Kubernetes cluster
+	digitalOceanWorkerTag = "k8s:worker"
+	// the largest page of firewalls the API returns
+	digitalOceanPageSize = 200
+	// the ports of the rules opening all of them
+	digitalOceanAllPorts = "all"
+)
+
+func init() {
+	Register("digitalocean", Registration{
+		New: func(cfg *externalips.Config, nodes Nodes) (Provider, error) {
+			return NewDigitalOceanProvider(
+				DigitalOceanConfig{
+					DryRun: cfg.DryRun,
+				},
+				nodes.Cluster,
+			)
+		},
+	})
+}
+
+// DigitalOceanFirewall is a cloud firewall of the DigitalOcean API.
+type DigitalOceanFirewall struct {
+	ID            string                     `json:"id,omitempty"`
+	Name          string                     `json:"name"`
+	InboundRules  []DigitalOceanInboundRule  `json:"inbound_rules"`
+	OutboundRules []DigitalOceanOutboundRule `json:"outbound_rules"`
+	DropletIDs    []int                      `json:"droplet_ids"`
+	Tags          []string                   `json:"tags"`
+}
+
+// DigitalOceanInboundRule is an inbound rule of a cloud firewall.
+type DigitalOceanInboundRule struct {
+	Protocol  string               `json:"protocol"`
+	PortRange string               `json:"ports,omitempty"`
+	Sources   *DigitalOceanSources `json:"sources"`
+}
+
+// DigitalOceanOutboundRule is an outbound rule of a cloud firewall, kept as it is.
+type DigitalOceanOutboundRule struct {
+	Protocol     string               `json:"protocol"`
+	PortRange    string               `json:"ports,omitempty"`
+	Destinations *DigitalOceanSources `json:"destinations"`
+}
+
+// DigitalOceanSources are the sources of an inbound rule or the destinations of an outbound rule.
+type DigitalOceanSources struct {
+	Addresses        []string `json:"addresses,omitempty"`
+	Tags             []string `json:"tags,omitempty"`
+	DropletIDs       []int    `json:"droplet_ids,omitempty"`
+	LoadBalancerUIDs []string `json:"load_balancer_uids,omitempty"`
+	KubernetesIDs    []string `json:"kubernetes_ids,omitempty"`
+}
+
+// DigitalOceanAPI is the subset of the DigitalOcean API that we actually use. Add methods as required.
+type DigitalOceanAPI interface {
+	ListFirewalls() ([]DigitalOceanFirewall, error)
+	CreateFirewall(fw *DigitalOceanFirewall) (*DigitalOceanFirewall, error)
+	UpdateFirewall(id string, fw *DigitalOceanFirewall) (*DigitalOceanFirewall, error)
+	DeleteFirewall(id string) error
+	AddDroplets(id string, dropletIDs ...int) error
+	RemoveDroplets(id string, dropletIDs ...int) error
+	GetDropletTags(id int) ([]string, error)
+}
+
+// DigitalOceanService calls the DigitalOcean API and fulfills the DigitalOceanAPI interface.
+type DigitalOceanService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// ListFirewalls lists all the pages of the firewalls
+func (s DigitalOceanService) ListFirewalls() ([]DigitalOceanFirewall, error) {
+	result := []DigitalOceanFirewall{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Firewalls []DigitalOceanFirewall `json:"firewalls"`
+			Links     struct {
+				Pages struct {
+					Next string `json:"next"`
+				} `json:"pages"`
+			} `json:"links"`
+		}
+		query := url.Values{}
+		query.Set("page", fmt.Sprint(page))
+		query.Set("per_page", fmt.Sprint(digitalOceanPageSize))
+		if err := s.do(http.MethodGet, "/firewalls?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Firewalls...)
+		if resp.Links.Pages.Next == "" {
+			return result, nil
+		}
+	}
+}
+
+// CreateFirewall creates the firewall and returns it as created
+func (s DigitalOceanService) CreateFirewall(fw *DigitalOceanFirewall) (*DigitalOceanFirewall, error) {
+	var resp struct {
+		Firewall DigitalOceanFirewall `json:"firewall"`
+	}
+	if err := s.do(http.MethodPost, "/firewalls", fw, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Firewall, nil
+}
+
+// UpdateFirewall replaces the firewall of the given id as a whole and returns it as updated
+func (s DigitalOceanService) UpdateFirewall(id string, fw *DigitalOceanFirewall) (*DigitalOceanFirewall, error) {
+	var resp struct {
+		Firewall DigitalOceanFirewall `json:"firewall"`
+	}
+	if err := s.do(http.MethodPut, "/firewalls/"+url.PathEscape(id), fw, &resp); err != nil {
+		return nil, err
+	}
+	return &resp.Firewall, nil
+}
+
+// DeleteFirewall deletes the firewall of the given id
+func (s DigitalOceanService) DeleteFirewall(id string) error {
+	return s.do(http.MethodDelete, "/firewalls/"+url.PathEscape(id), nil, nil)
+}
+
+// AddDroplets assigns the firewall to the droplets
+func (s DigitalOceanService) AddDroplets(id string, dropletIDs ...int) error {
+	return s.do(http.MethodPost, "/firewalls/"+url.PathEscape(id)+"/droplets", digitalOceanDroplets{DropletIDs: dropletIDs}, nil)
+}
+
+// RemoveDroplets removes the droplets from the firewall
+func (s DigitalOceanService) RemoveDroplets(id string, dropletIDs ...int) error {
+	return s.do(http.MethodDelete, "/firewalls/"+url.PathEscape(id)+"/droplets", digitalOceanDroplets{DropletIDs: dropletIDs}, nil)
+}
+
+// GetDropletTags returns the tags of the droplet
+func (s DigitalOceanService) GetDropletTags(id int) ([]string, error) {
+	var resp struct {
+		Droplet struct {
+			Tags []string `json:"tags"`
+		} `json:"droplet"`
+	}
+	if err := s.do(http.MethodGet, fmt.Sprintf("/droplets/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Droplet.Tags, nil
+}
+
+type digitalOceanDroplets struct {
+	DropletIDs []int `json:"droplet_ids"`
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (s DigitalOceanService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("digitalocean: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// DigitalOceanProvider is an implementation of Provider for DigitalOcean cloud firewalls.
+//
+// The firewalls can't be tagged, so the ones of the cluster are told apart by
+// their names, ending with the cluster name like the default firewall name template.
+// Their rules have no description either: the ones applied are remembered so that
+// they aren't updated again as long as they don't change.
+type DigitalOceanProvider struct {
+	client     DigitalOceanAPI
+	nodeLister node.Lister
+	dryRun     bool
+
+	mu          sync.Mutex
+	clusterName string
+	// the rules last applied, with their descriptions, by firewall ID
+	applied map[string][]inbound.InboundRule
+}
+
+// DigitalOceanConfig contains configuration to create a new DigitalOcean provider.
+type DigitalOceanConfig struct {
+	DryRun bool
+}
+
+// NewDigitalOceanProvider initializes a new DigitalOcean cloud firewalls based Provider.
+// The API token is read from the DO_TOKEN environment variable.
+func NewDigitalOceanProvider(digitalOceanConfig DigitalOceanConfig, nodeLister node.Lister) (*DigitalOceanProvider, error) {
+	token, ok := os.LookupEnv("DO_TOKEN")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("No token found")
+	}
+	provider := &DigitalOceanProvider{
+		client:     DigitalOceanService{client: http.DefaultClient, endpoint: digitalOceanEndpoint, token: token},
+		nodeLister: nodeLister,
+		dryRun:     digitalOceanConfig.DryRun,
+		applied:    map[string][]inbound.InboundRule{},
+	}
+
+	return provider, nil
+}
+
+func (p *DigitalOceanProvider) GetClusterName() (string, error) {
+	p.mu.Lock()
+	clusterName := p.clusterName
+	p.mu.Unlock()
+	if len(clusterName) != 0 {
+		return clusterName, nil
+	}
+
+	droplets, err := p.getDroplets()
+	if err != nil {
+		return "", err
+	}
+	if len(droplets) == 0 {
+		return "", fmt.Errorf("No droplet was found")
+	}
+
+	// any droplet of the cluster tells its name
+	var dropletID int
+	for id := range droplets {
+		dropletID = id
+		break
+	}
+	tags, err := p.client.GetDropletTags(dropletID)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag == digitalOceanWorkerTag || !strings.HasPrefix(tag, digitalOceanClusterTagPrefix) {
+			continue
+		}
+		clusterName = strings.TrimPrefix(tag, digitalOceanClusterTagPrefix)
+	}
+	if len(clusterName) == 0 {
+		return "", fmt.Errorf("droplet %d has no %s<cluster> tag", dropletID, digitalOceanClusterTagPrefix)
+	}
+
+	p.mu.Lock()
+	p.clusterName = clusterName
+	p.mu.Unlock()
+	return clusterName, nil
+}
+
+func (p *DigitalOceanProvider) Rules() ([]*inbound.InboundRules, error) {
+	droplets, err := p.getDroplets()
+	if err != nil {
+		return nil, err
+	}
+
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*inbound.InboundRules{}
+	for _, fw := range firewalls {
+		rules, err := p.newInboundRules(fw, droplets)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rules)
+	}
+	return result, nil
+}
+
+func (p *DigitalOceanProvider) ApplyChanges(changes *plan.Changes) error {
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return err
+	}
+
+	err = p.createFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.setFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.unsetFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.deleteFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// getDroplets returns the providerIDs of the nodes, keyed by droplet id.
+func (p *DigitalOceanProvider) getDroplets() (map[int]string, error) {
+	nodes, err := p.nodeLister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	droplets := make(map[int]string, len(nodes))
+	for _, n := range nodes {
+		dropletID, err := digitalOceanDropletID(n.Spec.ProviderID)
+		if err != nil {
+			return nil, err
+		}
+		droplets[dropletID] = n.Spec.ProviderID
+	}
+	return droplets, nil
+}
+
+func digitalOceanDropletID(providerID string) (int, error) {
+	instanceID, err := node.InstanceID(providerID, node.SchemeDigitalOcean)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(instanceID)
+}
+
+// ownedFirewalls returns the firewalls of the cluster, keyed by name.
+func (p *DigitalOceanProvider) ownedFirewalls() (map[string]*DigitalOceanFirewall, error) {
+	clusterName, err := p.GetClusterName()
+	if err != nil {
+		return nil, err
+	}
+
+	firewalls, err := p.client.ListFirewalls()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*DigitalOceanFirewall{}
+	for i, fw := range firewalls {
+		if !strings.HasSuffix(fw.Name, "."+clusterName) {
+			continue
+		}
+		if _, ok := result[fw.Name]; ok {
+			return nil, fmt.Errorf("firewall name is not unique %s", fw.Name)
+		}
+		result[fw.Name] = &firewalls[i]
+	}
+	return result, nil
+}
+
+func (p *DigitalOceanProvider) newInboundRules(fw *DigitalOceanFirewall, droplets map[int]string) (*inbound.InboundRules, error) {
+	rules := inbound.NewInboundRules()
+	rules.Name = fw.Name
+
+	// the droplets which aren't nodes are left alone
+	nodeDroplets := make([]int, 0, len(fw.DropletIDs))
+	for _, dropletID := range fw.DropletIDs {
+		providerID, ok := droplets[dropletID]
+		if !ok {
+			continue
+		}
+		nodeDroplets = append(nodeDroplets, dropletID)
+		rules.ProviderIDs = append(rules.ProviderIDs, providerID)
+	}
+	rules.ProviderIDs = inbound.NewProviderIDs(rules.ProviderIDs...)
+
+	for _, r := range fw.InboundRules {
+		rule := inbound.InboundRule{
+			Protocol: r.Protocol,
+		}
+		switch r.PortRange {
+		case "", "0":
+		case digitalOceanAllPorts:
+			rule.Port, rule.ToPort = 1, 65535
+		default:
+			if !strings.Contains(r.PortRange, "-") {
+				port, err := strconv.Atoi(r.PortRange)
+				if err != nil {
+					return nil, fmt.Errorf("invalid ports %q of firewall %s: %v", r.PortRange, fw.Name, err)
+				}
+				rule.Port = port
+				break
+			}
+			first, last, err := inbound.ParsePortRange(r.PortRange)
+			if err != nil {
+				return nil, err
+			}
+			rule.Port, rule.ToPort = first, last
+		}
+		if r.Sources != nil {
+			rule.SourceCIDRs = r.Sources.Addresses
+			if len(r.Sources.Tags) > 0 {
+				rule.SourceSecurityGroup = r.Sources.Tags[0]
+			}
+			// the rules opened to the firewall itself list its droplets
+			if len(r.Sources.DropletIDs) > 0 {
+				rule.SourceSecurityGroup = inbound.SourceSecurityGroupSelf
+				if !sameDroplets(r.Sources.DropletIDs, nodeDroplets) {
+					rules.Drifted = true
+				}
+			}
+		}
+		rules.Rules = append(rules.Rules, rule)
+	}
+	rules.Rules = p.withDescriptions(fw.ID, rules.Rules)
+	return rules, nil
+}
+
+// withDescriptions returns the rules last applied to the firewall if they only differ
+// from the current rules by their descriptions, the current rules otherwise.
+func (p *DigitalOceanProvider) withDescriptions(id string, current []inbound.InboundRule) []inbound.InboundRule {
+	p.mu.Lock()
+	applied, ok := p.applied[id]
+	p.mu.Unlock()
+	if !ok {
+		return current
+	}
+
+	undescribed := make([]inbound.InboundRule, len(applied))
+	for i, r := range applied {
+		r.Description = ""
+		undescribed[i] = r
+	}
+	if !(&inbound.InboundRules{Rules: undescribed}).Same(&inbound.InboundRules{Rules: current}) {
+		return current
+	}
+	return applied
+}
+
+func (p *DigitalOceanProvider) setApplied(id string, rules []inbound.InboundRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if rules == nil {
+		delete(p.applied, id)
+		return
+	}
+	p.applied[id] = rules
+}
+
+// sameDroplets returns true if both lists hold the same droplets, in any order.
+func sameDroplets(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[int]bool, len(a))
+	for _, id := range a {
+		seen[id] = true
+	}
+	for _, id := range b {
+		if !seen[id] {
+			return false
+		}
+	}
+	return true
+}
+
+// digitalOceanInboundRules converts the rules, the ones opened to the firewall itself being opened to the droplets given.
+func digitalOceanInboundRules(rules []inbound.InboundRule, self []int) []DigitalOceanInboundRule {
+	result := make([]DigitalOceanInboundRule, 0, len(rules))
+	for _, rule := range rules {
+		r := DigitalOceanInboundRule{
+			Protocol:  rule.Protocol,
+			PortRange: strconv.Itoa(rule.Port),
+			Sources: &DigitalOceanSources{
+				Addresses: rule.CIDRs(),
+			},
+		}
+		if rule.ToPort != 0 {
+			r.PortRange = fmt.Sprintf("%d-%d", rule.Port, rule.ToPort)
+		}
+		switch rule.SourceSecurityGroup {
+		case "":
+		case inbound.SourceSecurityGroupSelf:
+			r.Sources.DropletIDs = self
+		default:
+			r.Sources.Tags = []string{rule.SourceSecurityGroup}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// dropletIDs returns the droplets of the providerIDs.
+func dropletIDs(providerIDs inbound.ProviderIDs) ([]int, error) {
+	result := make([]int, 0, len(providerIDs))
+	for _, providerID := range providerIDs {
+		dropletID, err := digitalOceanDropletID(providerID)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, dropletID)
+	}
+	return result, nil
+}
+
+func (p *DigitalOceanProvider) createFirewalls(changes *plan.Changes, firewalls map[string]*DigitalOceanFirewall) error {
+	for _, r := range changes.Create {
+		log.Infof("Desired change: %s %s", "CREATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		self, err := dropletIDs(r.ProviderIDs)
+		if err != nil {
+			return err
+		}
+		fw, err := p.client.CreateFirewall(&DigitalOceanFirewall{
+			Name:         r.Name,
+			InboundRules: digitalOceanInboundRules(r.Rules, self),
+		})
+		if err != nil {
+			return err
+		}
+		p.setApplied(fw.ID, r.Rules)
+		firewalls[fw.Name] = fw
+	}
+	return nil
+}
+
+func (p *DigitalOceanProvider) updateFirewalls(changes *plan.Changes, firewalls map[string]*DigitalOceanFirewall) error {
+	for _, r := range changes.UpdateNew {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "UPDATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		self, err := dropletIDs(r.ProviderIDs)
+		if err != nil {
+			return err
+		}
+		// the whole firewall is replaced, keeping what isn't managed
+		updated, err := p.client.UpdateFirewall(fw.ID, &DigitalOceanFirewall{
+			Name:          fw.Name,
+			InboundRules:  digitalOceanInboundRules(r.Rules, self),
+			OutboundRules: fw.OutboundRules,
+			DropletIDs:    fw.DropletIDs,
+			Tags:          fw.Tags,
+		})
+		if err != nil {
+			return err
+		}
+		p.setApplied(fw.ID, r.Rules)
+		firewalls[fw.Name] = updated
+	}
+	return nil
+}
+
+func (p *DigitalOceanProvider) deleteFirewalls(changes *plan.Changes, firewalls map[string]*DigitalOceanFirewall) error {
+	for _, r := range changes.Delete {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "DELETE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		err := p.client.DeleteFirewall(fw.ID)
+		if err != nil {
+			return err
+		}
+		p.setApplied(fw.ID, nil)
+		delete(firewalls, fw.Name)
+	}
+	return nil
+}
+
+func (p *DigitalOceanProvider) setFirewalls(changes *plan.Changes, firewalls map[string]*DigitalOceanFirewall) error {
+	for _, r := range changes.Set {
+		dropletID, err := digitalOceanDropletID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "ASSIGN FW", dropletID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		if containsID(fw.DropletIDs, dropletID) {
+			continue
+		}
+		err = p.client.AddDroplets(fw.ID, dropletID)
+		if err != nil {
+			return err
+		}
+		fw.DropletIDs = append(fw.DropletIDs, dropletID)
+	}
+	return nil
+}
+
+func (p *DigitalOceanProvider) unsetFirewalls(changes *plan.Changes, firewalls map[string]*DigitalOceanFirewall) error {
+	for _, r := range changes.Unset {
+		dropletID, err := digitalOceanDropletID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "UNASSIGN FW", dropletID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		if !containsID(fw.DropletIDs, dropletID) {
+			continue
+		}
+		err = p.client.RemoveDroplets(fw.ID, dropletID)
+		if err != nil {
+			return err
+		}
+		remaining := make([]int, 0, len(fw.DropletIDs))
+		for _, id := range fw.DropletIDs {
+			if id != dropletID {
+				remaining = append(remaining, id)
+			}
+		}
+		fw.DropletIDs = remaining
+	}
+	return nil
+}
+
+// containsID returns true if the ids hold the id.
+func containsID(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
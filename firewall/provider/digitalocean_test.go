@@ -0,0 +1,263 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+)
+
+// digitalOceanAPIStub keeps the firewalls in memory, the droplets all being tagged for the cluster.
+type digitalOceanAPIStub struct {
+	firewalls []*DigitalOceanFirewall
+	updates   int
+}
+
+func (s *digitalOceanAPIStub) ListFirewalls() ([]DigitalOceanFirewall, error) {
+	result := make([]DigitalOceanFirewall, 0, len(s.firewalls))
+	for _, fw := range s.firewalls {
+		result = append(result, *fw)
+	}
+	return result, nil
+}
+
+func (s *digitalOceanAPIStub) CreateFirewall(request *DigitalOceanFirewall) (*DigitalOceanFirewall, error) {
+	fw := &DigitalOceanFirewall{
+		ID:           fmt.Sprintf("fw-%d", len(s.firewalls)+1),
+		Name:         request.Name,
+		InboundRules: request.InboundRules,
+		DropletIDs:   request.DropletIDs,
+	}
+	s.firewalls = append(s.firewalls, fw)
+	return fw, nil
+}
+
+func (s *digitalOceanAPIStub) UpdateFirewall(id string, request *DigitalOceanFirewall) (*DigitalOceanFirewall, error) {
+	s.updates++
+	fw, err := s.find(id)
+	if err != nil {
+		return nil, err
+	}
+	fw.Name = request.Name
+	fw.InboundRules = request.InboundRules
+	fw.OutboundRules = request.OutboundRules
+	fw.DropletIDs = request.DropletIDs
+	fw.Tags = request.Tags
+	return fw, nil
+}
+
+func (s *digitalOceanAPIStub) DeleteFirewall(id string) error {
+	for i, fw := range s.firewalls {
+		if fw.ID == id {
+			s.firewalls = append(s.firewalls[:i], s.firewalls[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no firewall %s", id)
+}
+
+func (s *digitalOceanAPIStub) AddDroplets(id string, dropletIDs ...int) error {
+	fw, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	fw.DropletIDs = append(fw.DropletIDs, dropletIDs...)
+	return nil
+}
+
+func (s *digitalOceanAPIStub) RemoveDroplets(id string, dropletIDs ...int) error {
+	fw, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	remaining := []int{}
+	for _, d := range fw.DropletIDs {
+		if !containsID(dropletIDs, d) {
+			remaining = append(remaining, d)
+		}
+	}
+	fw.DropletIDs = remaining
+	return nil
+}
+
+func (s *digitalOceanAPIStub) GetDropletTags(id int) ([]string, error) {
+	return []string{"k8s", "k8s:cluster-1", digitalOceanWorkerTag}, nil
+}
+
+func (s *digitalOceanAPIStub) find(id string) (*DigitalOceanFirewall, error) {
+	for _, fw := range s.firewalls {
+		if fw.ID == id {
+			return fw, nil
+		}
+	}
+	return nil, fmt.Errorf("no firewall %s", id)
+}
+
+func newDigitalOceanProvider(client DigitalOceanAPI, providerIDs ...string) *DigitalOceanProvider {
+	return &DigitalOceanProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: providerIDs},
+		applied:    map[string][]inbound.InboundRule{},
+	}
+}
+
+func TestDigitalOceanClusterName(t *testing.T) {
+	p := newDigitalOceanProvider(&digitalOceanAPIStub{}, "digitalocean://1")
+
+	name, err := p.GetClusterName()
+	require.NoError(t, err)
+	assert.Equal(t, "cluster-1", name)
+}
+
+func TestDigitalOceanApplyChanges(t *testing.T) {
+	client := &digitalOceanAPIStub{
+		firewalls: []*DigitalOceanFirewall{
+			{ID: "other", Name: "web.cluster-2"},
+		},
+	}
+	p := newDigitalOceanProvider(client, "digitalocean://1", "digitalocean://2")
+
+	desired := &inbound.InboundRules{
+		Name: "svc0.cluster-1",
+		Rules: []inbound.InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/svc0/80"},
+			{Protocol: "udp", Port: 8000, ToPort: 8010, Description: "default/svc0/8000", SourceCIDRs: []string{"10.0.0.0/8"}},
+			{Protocol: "tcp", Port: 9000, Description: "default/svc0/9000", SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+		},
+		ProviderIDs: inbound.NewProviderIDs("digitalocean://1", "digitalocean://2"),
+	}
+	err := p.ApplyChanges(&plan.Changes{
+		Create: []*inbound.InboundRules{desired},
+		Set: []*plan.InstanceRule{
+			{ProviderID: "digitalocean://1", RulesName: desired.Name},
+			{ProviderID: "digitalocean://2", RulesName: desired.Name},
+		},
+	})
+	require.NoError(t, err)
+
+	fw, err := client.find("fw-2")
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2}, fw.DropletIDs)
+	assert.Equal(t, "8000-8010", fw.InboundRules[1].PortRange)
+	assert.Equal(t, []string{inbound.AnyCIDR}, fw.InboundRules[0].Sources.Addresses)
+	assert.Equal(t, []int{1, 2}, fw.InboundRules[2].Sources.DropletIDs)
+
+	// the firewalls of other clusters are left alone and the descriptions are remembered
+	current, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.True(t, current[0].Same(desired))
+	assert.False(t, current[0].Drifted)
+	assert.Equal(t, desired.ProviderIDs, current[0].ProviderIDs)
+
+	// a provider restarted doesn't know the descriptions
+	restarted := newDigitalOceanProvider(client, "digitalocean://1", "digitalocean://2")
+	current, err = restarted.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.False(t, current[0].Same(desired))
+
+	err = p.ApplyChanges(&plan.Changes{
+		Unset:  []*plan.InstanceRule{{ProviderID: "digitalocean://1", RulesName: desired.Name}, {ProviderID: "digitalocean://2", RulesName: desired.Name}},
+		Delete: []*inbound.InboundRules{desired},
+	})
+	require.NoError(t, err)
+	assert.Len(t, client.firewalls, 1)
+}
+
+func TestDigitalOceanRulesSelfDrift(t *testing.T) {
+	client := &digitalOceanAPIStub{
+		firewalls: []*DigitalOceanFirewall{
+			{
+				ID:   "fw-1",
+				Name: "svc0.cluster-1",
+				InboundRules: []DigitalOceanInboundRule{
+					{Protocol: "tcp", PortRange: "9000", Sources: &DigitalOceanSources{DropletIDs: []int{1}}},
+				},
+				// droplet 3 isn't a node
+				DropletIDs: []int{1, 2, 3},
+			},
+		},
+	}
+	p := newDigitalOceanProvider(client, "digitalocean://1", "digitalocean://2")
+
+	current, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.True(t, current[0].Drifted)
+	assert.Equal(t, inbound.SourceSecurityGroupSelf, current[0].Rules[0].SourceSecurityGroup)
+	assert.Equal(t, inbound.NewProviderIDs("digitalocean://1", "digitalocean://2"), current[0].ProviderIDs)
+
+	desired := &inbound.InboundRules{
+		Name:        "svc0.cluster-1",
+		Rules:       current[0].Rules,
+		ProviderIDs: current[0].ProviderIDs,
+	}
+	err = p.ApplyChanges(&plan.Changes{UpdateNew: []*inbound.InboundRules{desired}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, client.updates)
+	assert.Equal(t, []int{1, 2, 3}, client.firewalls[0].DropletIDs)
+
+	current, err = p.Rules()
+	require.NoError(t, err)
+	assert.False(t, current[0].Drifted)
+}
+
+func TestDigitalOceanService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /firewalls":
+			// the firewalls are listed page by page until there is no next page
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, `{"firewalls":[{"id":"fw-1","name":"svc0.cluster-1"}],"links":{"pages":{"next":"page=2"}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"firewalls":[{"id":"fw-2","name":"svc1.cluster-1","inbound_rules":[{"protocol":"tcp","ports":"80","sources":{"load_balancer_uids":["lb-1"]}}]}],"links":{}}`)
+		case "PUT /firewalls/fw-2":
+			var body map[string]interface{}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "svc1.cluster-1", body["name"])
+			fmt.Fprint(w, `{"firewall":{"id":"fw-2","name":"svc1.cluster-1"}}`)
+		case "POST /firewalls/fw-2/droplets":
+			var body digitalOceanDroplets
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, []int{1, 2}, body.DropletIDs)
+			w.WriteHeader(http.StatusNoContent)
+		case "GET /droplets/1":
+			fmt.Fprint(w, `{"droplet":{"id":1,"tags":["k8s","k8s:cluster-1"]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	s := DigitalOceanService{client: server.Client(), endpoint: server.URL, token: "token"}
+
+	firewalls, err := s.ListFirewalls()
+	require.NoError(t, err)
+	require.Len(t, firewalls, 2)
+	// the sources which aren't managed are kept for the updates
+	assert.Equal(t, []string{"lb-1"}, firewalls[1].InboundRules[0].Sources.LoadBalancerUIDs)
+
+	fw, err := s.UpdateFirewall("fw-2", &firewalls[1])
+	require.NoError(t, err)
+	assert.Equal(t, "svc1.cluster-1", fw.Name)
+
+	require.NoError(t, s.AddDroplets("fw-2", 1, 2))
+
+	tags, err := s.GetDropletTags(1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"k8s", "k8s:cluster-1"}, tags)
+
+	assert.EqualError(t, s.DeleteFirewall("fw-3"), "digitalocean: DELETE /firewalls/fw-3: 404 Not Found")
+}
@@ -0,0 +1,743 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	hetznerEndpoint = "https://api.hetzner.cloud/v1"
+	// the largest page of firewalls the API returns
+	hetznerPageSize        = 50
+	hetznerClusterLabelKey = "KubernetesCluster"
+	hetznerDirectionIn     = "in"
+	hetznerTypeServer      = "server"
+	// the suffix of the descriptions of the rules opened to the servers of their firewall, whose addresses they list
+	hetznerSelfSuffix = " (self)"
+)
+
+func init() {
+	Register("hetzner", Registration{
+		New: func(cfg *externalips.Config, nodes Nodes) (Provider, error) {
+			return NewHetznerProvider(
+				HetznerConfig{
+					DryRun: cfg.DryRun,
+				},
+				nodes.Cluster,
+			)
+		},
+	})
+}
+
+// HetznerFirewall is a firewall of the Hetzner Cloud API.
+type HetznerFirewall struct {
+	ID        int                       `json:"id,omitempty"`
+	Name      string                    `json:"name"`
+	Labels    map[string]string         `json:"labels"`
+	Rules     []HetznerFirewallRule     `json:"rules"`
+	AppliedTo []HetznerFirewallResource `json:"applied_to,omitempty"`
+}
+
+// HetznerFirewallRule is a rule of a firewall, without a port for the protocols which have none.
+type HetznerFirewallRule struct {
+	Direction      string   `json:"direction"`
+	Protocol       string   `json:"protocol"`
+	Port           string   `json:"port,omitempty"`
+	SourceIPs      []string `json:"source_ips,omitempty"`
+	DestinationIPs []string `json:"destination_ips,omitempty"`
+	Description    string   `json:"description,omitempty"`
+}
+
+// HetznerFirewallResource is a resource a firewall is applied to, a server or a label selector.
+type HetznerFirewallResource struct {
+	Type   string                 `json:"type"`
+	Server *HetznerResourceServer `json:"server,omitempty"`
+}
+
+// HetznerResourceServer is the server of a resource.
+type HetznerResourceServer struct {
+	ID int `json:"id"`
+}
+
+// HetznerServer is a server, of which only the labels and the addresses are used.
+type HetznerServer struct {
+	ID         int               `json:"id"`
+	Labels     map[string]string `json:"labels"`
+	PublicNet  HetznerPublicNet  `json:"public_net"`
+	PrivateNet []HetznerServerIP `json:"private_net"`
+}
+
+// HetznerPublicNet is the public network of a server.
+type HetznerPublicNet struct {
+	IPv4 HetznerServerIP `json:"ipv4"`
+}
+
+// HetznerServerIP is an address of a server, empty when the server has none.
+type HetznerServerIP struct {
+	IP string `json:"ip"`
+}
+
+// HetznerAPI is the subset of the Hetzner Cloud API that we actually use. Add methods as required.
+type HetznerAPI interface {
+	ListFirewalls(labelSelector string) ([]*HetznerFirewall, error)
+	CreateFirewall(fw *HetznerFirewall) (*HetznerFirewall, error)
+	SetFirewallRules(fw *HetznerFirewall, rules []HetznerFirewallRule) error
+	DeleteFirewall(fw *HetznerFirewall) error
+	ApplyFirewall(fw *HetznerFirewall, serverID int) error
+	RemoveFirewall(fw *HetznerFirewall, serverID int) error
+	GetServer(id int) (*HetznerServer, error)
+}
+
+// HetznerService calls the Hetzner Cloud API and fulfills the HetznerAPI interface.
+type HetznerService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// ListFirewalls lists all the pages of the firewalls matching the label selector
+func (s HetznerService) ListFirewalls(labelSelector string) ([]*HetznerFirewall, error) {
+	result := []*HetznerFirewall{}
+	for page := 1; page != 0; {
+		query := url.Values{}
+		query.Set("label_selector", labelSelector)
+		query.Set("page", fmt.Sprint(page))
+		query.Set("per_page", fmt.Sprint(hetznerPageSize))
+		var resp struct {
+			Firewalls []*HetznerFirewall `json:"firewalls"`
+			Meta      struct {
+				Pagination struct {
+					NextPage int `json:"next_page"`
+				} `json:"pagination"`
+			} `json:"meta"`
+		}
+		if err := s.do(http.MethodGet, "/firewalls?"+query.Encode(), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Firewalls...)
+		// the last page has no next page
+		page = resp.Meta.Pagination.NextPage
+	}
+	return result, nil
+}
+
+// CreateFirewall creates the firewall and returns it as created
+func (s HetznerService) CreateFirewall(fw *HetznerFirewall) (*HetznerFirewall, error) {
+	var resp struct {
+		Firewall *HetznerFirewall `json:"firewall"`
+	}
+	if err := s.do(http.MethodPost, "/firewalls", fw, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Firewall, nil
+}
+
+// SetFirewallRules replaces the rules of the firewall
+func (s HetznerService) SetFirewallRules(fw *HetznerFirewall, rules []HetznerFirewallRule) error {
+	in := struct {
+		Rules []HetznerFirewallRule `json:"rules"`
+	}{rules}
+	return s.do(http.MethodPost, fmt.Sprintf("/firewalls/%d/actions/set_rules", fw.ID), in, nil)
+}
+
+// DeleteFirewall deletes the firewall
+func (s HetznerService) DeleteFirewall(fw *HetznerFirewall) error {
+	return s.do(http.MethodDelete, fmt.Sprintf("/firewalls/%d", fw.ID), nil, nil)
+}
+
+// ApplyFirewall applies the firewall to the server
+func (s HetznerService) ApplyFirewall(fw *HetznerFirewall, serverID int) error {
+	in := struct {
+		ApplyTo []HetznerFirewallResource `json:"apply_to"`
+	}{[]HetznerFirewallResource{hetznerServerResource(serverID)}}
+	return s.do(http.MethodPost, fmt.Sprintf("/firewalls/%d/actions/apply_to_resources", fw.ID), in, nil)
+}
+
+// RemoveFirewall removes the firewall from the server
+func (s HetznerService) RemoveFirewall(fw *HetznerFirewall, serverID int) error {
+	in := struct {
+		RemoveFrom []HetznerFirewallResource `json:"remove_from"`
+	}{[]HetznerFirewallResource{hetznerServerResource(serverID)}}
+	return s.do(http.MethodPost, fmt.Sprintf("/firewalls/%d/actions/remove_from_resources", fw.ID), in, nil)
+}
+
+// GetServer returns the server of the given id
+func (s HetznerService) GetServer(id int) (*HetznerServer, error) {
+	var resp struct {
+		Server *HetznerServer `json:"server"`
+	}
+	if err := s.do(http.MethodGet, fmt.Sprintf("/servers/%d", id), nil, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Server == nil {
+		return nil, fmt.Errorf("server %d not found", id)
+	}
+	return resp.Server, nil
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (s HetznerService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("hetzner: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func hetznerServerResource(serverID int) HetznerFirewallResource {
+	return HetznerFirewallResource{
+		Type:   hetznerTypeServer,
+		Server: &HetznerResourceServer{ID: serverID},
+	}
+}
+
+// HetznerProvider is an implementation of Provider for Hetzner Cloud firewalls.
+//
+// Hetzner Cloud firewalls only open ports to addresses: the rules opened to the
+// security group itself list the addresses of the servers of the firewall, their
+// descriptions ending with hetznerSelfSuffix, and the rules opened to other security
+// groups aren't supported.
+type HetznerProvider struct {
+	client     HetznerAPI
+	nodeLister node.Lister
+	dryRun     bool
+
+	mu          sync.Mutex
+	clusterName string
+}
+
+// HetznerConfig contains configuration to create a new Hetzner provider.
+type HetznerConfig struct {
+	DryRun bool
+}
+
+// NewHetznerProvider initializes a new Hetzner Cloud firewalls based Provider.
+// The API token is read from the HCLOUD_TOKEN environment variable.
+func NewHetznerProvider(hetznerConfig HetznerConfig, nodeLister node.Lister) (*HetznerProvider, error) {
+	token, ok := os.LookupEnv("HCLOUD_TOKEN")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("No token found")
+	}
+
+	provider := &HetznerProvider{
+		client:     HetznerService{client: http.DefaultClient, endpoint: hetznerEndpoint, token: token},
+		nodeLister: nodeLister,
+		dryRun:     hetznerConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+func (p *HetznerProvider) GetClusterName() (string, error) {
+	p.mu.Lock()
+	clusterName := p.clusterName
+	p.mu.Unlock()
+	if len(clusterName) != 0 {
+		return clusterName, nil
+	}
+
+	servers, err := p.getServers()
+	if err != nil {
+		return "", err
+	}
+	if len(servers) == 0 {
+		return "", fmt.Errorf("No server was found")
+	}
+
+	// any server of the cluster tells its name
+	var serverID int
+	for id := range servers {
+		serverID = id
+		break
+	}
+	server, err := p.client.GetServer(serverID)
+	if err != nil {
+		return "", err
+	}
+	clusterName, ok := server.Labels[hetznerClusterLabelKey]
+	if !ok || clusterName == "" {
+		return "", fmt.Errorf("server %d has no %s label", serverID, hetznerClusterLabelKey)
+	}
+
+	p.mu.Lock()
+	p.clusterName = clusterName
+	p.mu.Unlock()
+	return clusterName, nil
+}
+
+func (p *HetznerProvider) Rules() ([]*inbound.InboundRules, error) {
+	servers, err := p.getServers()
+	if err != nil {
+		return nil, err
+	}
+
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*inbound.InboundRules{}
+	for _, fw := range firewalls {
+		rules, err := p.newInboundRules(fw, servers)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rules)
+	}
+	return result, nil
+}
+
+func (p *HetznerProvider) ApplyChanges(changes *plan.Changes) error {
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return err
+	}
+
+	err = p.createFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.setFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.unsetFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.deleteFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *HetznerProvider) ownerLabel(clusterName string) string {
+	return TagNameExternalIPsPrefix + clusterName
+}
+
+// getServers returns the providerIDs of the nodes, keyed by server id.
+func (p *HetznerProvider) getServers() (map[int]string, error) {
+	nodes, err := p.nodeLister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	servers := make(map[int]string, len(nodes))
+	for _, n := range nodes {
+		serverID, err := hetznerServerID(n.Spec.ProviderID)
+		if err != nil {
+			return nil, err
+		}
+		servers[serverID] = n.Spec.ProviderID
+	}
+	return servers, nil
+}
+
+func hetznerServerID(providerID string) (int, error) {
+	instanceID, err := node.InstanceID(providerID, node.SchemeHetzner)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(instanceID)
+}
+
+// ownedFirewalls returns the firewalls labeled for the cluster, keyed by name.
+func (p *HetznerProvider) ownedFirewalls() (map[string]*HetznerFirewall, error) {
+	clusterName, err := p.GetClusterName()
+	if err != nil {
+		return nil, err
+	}
+
+	firewalls, err := p.client.ListFirewalls(p.ownerLabel(clusterName) + "=" + ResourceLifecycleOwned)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*HetznerFirewall{}
+	for _, fw := range firewalls {
+		if _, ok := result[fw.Name]; ok {
+			return nil, fmt.Errorf("firewall name is not unique %s", fw.Name)
+		}
+		result[fw.Name] = fw
+	}
+	return result, nil
+}
+
+// hetznerServers returns the ids of the servers the firewall is applied to.
+func hetznerServers(fw *HetznerFirewall) []int {
+	result := []int{}
+	for _, r := range fw.AppliedTo {
+		if r.Type != hetznerTypeServer || r.Server == nil {
+			continue
+		}
+		result = append(result, r.Server.ID)
+	}
+	return result
+}
+
+// selfAddresses returns the addresses of the servers of the providerIDs, sorted.
+func (p *HetznerProvider) selfAddresses(providerIDs []string) ([]string, error) {
+	addresses := []string{}
+	for _, providerID := range providerIDs {
+		serverID, err := hetznerServerID(providerID)
+		if err != nil {
+			return nil, err
+		}
+		server, err := p.client.GetServer(serverID)
+		if err != nil {
+			return nil, err
+		}
+		if ip := server.PublicNet.IPv4.IP; ip != "" && ip != "0.0.0.0" {
+			addresses = append(addresses, ip+"/32")
+		}
+		for _, privateNet := range server.PrivateNet {
+			if privateNet.IP != "" {
+				addresses = append(addresses, privateNet.IP+"/32")
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+func (p *HetznerProvider) newInboundRules(fw *HetznerFirewall, servers map[int]string) (*inbound.InboundRules, error) {
+	rules := inbound.NewInboundRules()
+	rules.Name = fw.Name
+
+	// the servers which aren't nodes are left alone
+	for _, serverID := range hetznerServers(fw) {
+		providerID, ok := servers[serverID]
+		if !ok {
+			continue
+		}
+		rules.ProviderIDs = append(rules.ProviderIDs, providerID)
+	}
+	rules.ProviderIDs = inbound.NewProviderIDs(rules.ProviderIDs...)
+
+	var self []string
+	// a rule opened to addresses and to the servers of the firewall is made of two firewall rules
+	index := map[string]int{}
+	for _, r := range fw.Rules {
+		if r.Direction != hetznerDirectionIn {
+			continue
+		}
+		first, last, err := hetznerPorts(r.Port)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port of firewall %s: %v", fw.Name, err)
+		}
+		description := r.Description
+		isSelf := strings.HasSuffix(description, hetznerSelfSuffix)
+		description = strings.TrimSuffix(description, hetznerSelfSuffix)
+
+		key := fmt.Sprintf("%s/%d-%d/%s", r.Protocol, first, last, description)
+		i, ok := index[key]
+		if !ok {
+			i = len(rules.Rules)
+			index[key] = i
+			rule := inbound.InboundRule{
+				Protocol:    r.Protocol,
+				Port:        first,
+				Description: description,
+			}
+			if last != first {
+				rule.ToPort = last
+			}
+			rules.Rules = append(rules.Rules, rule)
+		}
+		addresses := append([]string{}, r.SourceIPs...)
+		if !isSelf {
+			rules.Rules[i].SourceCIDRs = append(rules.Rules[i].SourceCIDRs, addresses...)
+			continue
+		}
+		rules.Rules[i].SourceSecurityGroup = inbound.SourceSecurityGroupSelf
+		if self == nil {
+			self, err = p.selfAddresses(rules.ProviderIDs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		sort.Strings(addresses)
+		if strings.Join(addresses, ",") != strings.Join(self, ",") {
+			rules.Drifted = true
+		}
+	}
+	return rules, nil
+}
+
+// hetznerPorts parses the port of a rule, a single port or a range, empty for all the ports.
+func hetznerPorts(port string) (int, int, error) {
+	if port == "" {
+		return 0, 0, nil
+	}
+	if strings.Contains(port, "-") {
+		return inbound.ParsePortRange(port)
+	}
+	first, err := strconv.Atoi(port)
+	return first, first, err
+}
+
+// hetznerSourceIPs parses the source ranges of a rule, in the canonical form the API returns them.
+func hetznerSourceIPs(cidrs []string) ([]string, error) {
+	result := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet.String())
+	}
+	return result, nil
+}
+
+// hetznerInboundRules converts the rules, the ones opened to the security group itself being opened to the addresses given.
+func hetznerInboundRules(rules []inbound.InboundRule, self []string) ([]HetznerFirewallRule, error) {
+	result := make([]HetznerFirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		r := HetznerFirewallRule{
+			Direction:   hetznerDirectionIn,
+			Protocol:    rule.Protocol,
+			Description: rule.Description,
+		}
+		if rule.Port != 0 {
+			r.Port = strconv.Itoa(rule.Port)
+			if rule.ToPort != 0 {
+				r.Port = fmt.Sprintf("%d-%d", rule.Port, rule.ToPort)
+			}
+		}
+		if cidrs := rule.CIDRs(); len(cidrs) > 0 {
+			sourceIPs, err := hetznerSourceIPs(cidrs)
+			if err != nil {
+				return nil, err
+			}
+			sources := r
+			sources.SourceIPs = sourceIPs
+			result = append(result, sources)
+		}
+		switch rule.SourceSecurityGroup {
+		case "":
+		case inbound.SourceSecurityGroupSelf:
+			// the rule is applied again once the firewall has servers
+			if len(self) == 0 {
+				continue
+			}
+			sourceIPs, err := hetznerSourceIPs(self)
+			if err != nil {
+				return nil, err
+			}
+			sources := r
+			sources.Description = rule.Description + hetznerSelfSuffix
+			sources.SourceIPs = sourceIPs
+			result = append(result, sources)
+		default:
+			return nil, fmt.Errorf("hetzner firewalls can't open %s to the security group %s", rule.Description, rule.SourceSecurityGroup)
+		}
+	}
+	return result, nil
+}
+
+func (p *HetznerProvider) desiredRules(r *inbound.InboundRules) ([]HetznerFirewallRule, error) {
+	var self []string
+	for _, rule := range r.Rules {
+		if rule.SourceSecurityGroup == inbound.SourceSecurityGroupSelf {
+			var err error
+			self, err = p.selfAddresses(r.ProviderIDs)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return hetznerInboundRules(r.Rules, self)
+}
+
+func (p *HetznerProvider) createFirewalls(changes *plan.Changes, firewalls map[string]*HetznerFirewall) error {
+	for _, r := range changes.Create {
+		log.Infof("Desired change: %s %s", "CREATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		clusterName, err := p.GetClusterName()
+		if err != nil {
+			return err
+		}
+		rules, err := p.desiredRules(r)
+		if err != nil {
+			return err
+		}
+		fw, err := p.client.CreateFirewall(&HetznerFirewall{
+			Name:   r.Name,
+			Labels: map[string]string{p.ownerLabel(clusterName): ResourceLifecycleOwned},
+			Rules:  rules,
+		})
+		if err != nil {
+			return err
+		}
+		firewalls[fw.Name] = fw
+	}
+	return nil
+}
+
+func (p *HetznerProvider) updateFirewalls(changes *plan.Changes, firewalls map[string]*HetznerFirewall) error {
+	for _, r := range changes.UpdateNew {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "UPDATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		rules, err := p.desiredRules(r)
+		if err != nil {
+			return err
+		}
+		// the rules are replaced as a whole, keeping the outbound rules
+		for _, rule := range fw.Rules {
+			if rule.Direction != hetznerDirectionIn {
+				rules = append(rules, rule)
+			}
+		}
+		err = p.client.SetFirewallRules(fw, rules)
+		if err != nil {
+			return err
+		}
+		fw.Rules = rules
+	}
+	return nil
+}
+
+func (p *HetznerProvider) deleteFirewalls(changes *plan.Changes, firewalls map[string]*HetznerFirewall) error {
+	for _, r := range changes.Delete {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "DELETE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		err := p.client.DeleteFirewall(fw)
+		if err != nil {
+			return err
+		}
+		delete(firewalls, fw.Name)
+	}
+	return nil
+}
+
+func (p *HetznerProvider) setFirewalls(changes *plan.Changes, firewalls map[string]*HetznerFirewall) error {
+	for _, r := range changes.Set {
+		serverID, err := hetznerServerID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "ASSIGN FW", serverID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		if containsID(hetznerServers(fw), serverID) {
+			continue
+		}
+		err = p.client.ApplyFirewall(fw, serverID)
+		if err != nil {
+			return err
+		}
+		fw.AppliedTo = append(fw.AppliedTo, hetznerServerResource(serverID))
+	}
+	return nil
+}
+
+func (p *HetznerProvider) unsetFirewalls(changes *plan.Changes, firewalls map[string]*HetznerFirewall) error {
+	for _, r := range changes.Unset {
+		serverID, err := hetznerServerID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "UNASSIGN FW", serverID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		if !containsID(hetznerServers(fw), serverID) {
+			continue
+		}
+		err = p.client.RemoveFirewall(fw, serverID)
+		if err != nil {
+			return err
+		}
+		appliedTo := make([]HetznerFirewallResource, 0, len(fw.AppliedTo))
+		for _, resource := range fw.AppliedTo {
+			if resource.Server != nil && resource.Server.ID == serverID {
+				continue
+			}
+			appliedTo = append(appliedTo, resource)
+		}
+		fw.AppliedTo = appliedTo
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+)
+
+// hetznerAPIStub keeps the firewalls in memory, the server of id N being labeled
+// for the game cluster with the public address 10.0.0.N.
+type hetznerAPIStub struct {
+	firewalls []*HetznerFirewall
+	nextID    int
+}
+
+func (s *hetznerAPIStub) ListFirewalls(labelSelector string) ([]*HetznerFirewall, error) {
+	result := []*HetznerFirewall{}
+	for _, fw := range s.firewalls {
+		for key, value := range fw.Labels {
+			if key+"="+value == labelSelector {
+				copied := *fw
+				result = append(result, &copied)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *hetznerAPIStub) CreateFirewall(created *HetznerFirewall) (*HetznerFirewall, error) {
+	s.nextID++
+	fw := &HetznerFirewall{ID: s.nextID, Name: created.Name, Labels: created.Labels, Rules: created.Rules}
+	s.firewalls = append(s.firewalls, fw)
+	copied := *fw
+	return &copied, nil
+}
+
+func (s *hetznerAPIStub) SetFirewallRules(fw *HetznerFirewall, rules []HetznerFirewallRule) error {
+	stored, err := s.find(fw.ID)
+	if err != nil {
+		return err
+	}
+	stored.Rules = rules
+	return nil
+}
+
+func (s *hetznerAPIStub) DeleteFirewall(fw *HetznerFirewall) error {
+	for i, stored := range s.firewalls {
+		if stored.ID == fw.ID {
+			s.firewalls = append(s.firewalls[:i], s.firewalls[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no firewall %d", fw.ID)
+}
+
+func (s *hetznerAPIStub) ApplyFirewall(fw *HetznerFirewall, serverID int) error {
+	stored, err := s.find(fw.ID)
+	if err != nil {
+		return err
+	}
+	stored.AppliedTo = append(stored.AppliedTo, hetznerServerResource(serverID))
+	return nil
+}
+
+func (s *hetznerAPIStub) RemoveFirewall(fw *HetznerFirewall, serverID int) error {
+	stored, err := s.find(fw.ID)
+	if err != nil {
+		return err
+	}
+	appliedTo := []HetznerFirewallResource{}
+	for _, r := range stored.AppliedTo {
+		if r.Server.ID != serverID {
+			appliedTo = append(appliedTo, r)
+		}
+	}
+	stored.AppliedTo = appliedTo
+	return nil
+}
+
+func (s *hetznerAPIStub) GetServer(id int) (*HetznerServer, error) {
+	return &HetznerServer{
+		ID:        id,
+		Labels:    map[string]string{hetznerClusterLabelKey: "game"},
+		PublicNet: HetznerPublicNet{IPv4: HetznerServerIP{IP: fmt.Sprintf("10.0.0.%d", id)}},
+	}, nil
+}
+
+func (s *hetznerAPIStub) find(id int) (*HetznerFirewall, error) {
+	for _, fw := range s.firewalls {
+		if fw.ID == id {
+			return fw, nil
+		}
+	}
+	return nil, fmt.Errorf("no firewall %d", id)
+}
+
+func TestHetznerApplyChanges(t *testing.T) {
+	client := &hetznerAPIStub{
+		firewalls: []*HetznerFirewall{
+			{ID: 1, Name: "manual", Labels: map[string]string{}},
+		},
+		nextID: 100,
+	}
+	p := &HetznerProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: []string{"hcloud://1", "hcloud://2"}},
+	}
+
+	name, err := p.GetClusterName()
+	require.NoError(t, err)
+	assert.Equal(t, "game", name)
+
+	desired := &inbound.InboundRules{
+		Name: "svc0.game",
+		Rules: []inbound.InboundRule{
+			{Protocol: "udp", Port: 7777, ToPort: 7787, Description: "default/svc0/7777"},
+			{Protocol: "tcp", Port: 9000, Description: "default/svc0/9000", SourceCIDRs: []string{"192.168.0.0/16"}, SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+		},
+		ProviderIDs: inbound.NewProviderIDs("hcloud://1", "hcloud://2"),
+	}
+	err = p.ApplyChanges(&plan.Changes{
+		Create: []*inbound.InboundRules{desired},
+		Set: []*plan.InstanceRule{
+			{ProviderID: "hcloud://1", RulesName: desired.Name},
+			{ProviderID: "hcloud://2", RulesName: desired.Name},
+		},
+	})
+	require.NoError(t, err)
+
+	fw, err := client.find(101)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"external-ips/game": ResourceLifecycleOwned}, fw.Labels)
+	require.Len(t, fw.Rules, 3)
+	assert.Equal(t, "7777-7787", fw.Rules[0].Port)
+	assert.Equal(t, []string{"0.0.0.0/0"}, fw.Rules[0].SourceIPs)
+	assert.Equal(t, "default/svc0/9000"+hetznerSelfSuffix, fw.Rules[2].Description)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, fw.Rules[2].SourceIPs)
+	assert.Equal(t, []int{1, 2}, hetznerServers(fw))
+
+	current, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.True(t, current[0].Same(desired))
+	assert.False(t, current[0].Drifted)
+	assert.Equal(t, desired.ProviderIDs, current[0].ProviderIDs)
+
+	// a server leaving the firewall drifts the rules opened to the firewall itself
+	err = p.ApplyChanges(&plan.Changes{
+		Unset: []*plan.InstanceRule{{ProviderID: "hcloud://2", RulesName: desired.Name}},
+	})
+	require.NoError(t, err)
+	current, err = p.Rules()
+	require.NoError(t, err)
+	assert.True(t, current[0].Drifted)
+
+	err = p.ApplyChanges(&plan.Changes{
+		Unset:  []*plan.InstanceRule{{ProviderID: "hcloud://1", RulesName: desired.Name}},
+		Delete: []*inbound.InboundRules{desired},
+	})
+	require.NoError(t, err)
+	assert.Len(t, client.firewalls, 1)
+}
+
+func TestHetznerService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /firewalls":
+			assert.Equal(t, "external-ips/game=owned", r.URL.Query().Get("label_selector"))
+			if r.URL.Query().Get("page") == "1" {
+				fmt.Fprint(w, `{"firewalls":[{"id":1,"name":"svc0.game"}],"meta":{"pagination":{"page":1,"next_page":2}}}`)
+				return
+			}
+			fmt.Fprint(w, `{"firewalls":[{"id":2,"name":"svc1.game","applied_to":[{"type":"server","server":{"id":7}}]}],"meta":{"pagination":{"page":2,"next_page":null}}}`)
+		case "POST /firewalls/1/actions/set_rules":
+			var in map[string][]HetznerFirewallRule
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			assert.Equal(t, []HetznerFirewallRule{{Direction: "in", Protocol: "tcp", Port: "80", SourceIPs: []string{"0.0.0.0/0"}}}, in["rules"])
+			fmt.Fprint(w, `{"actions":[]}`)
+		case "POST /firewalls/1/actions/apply_to_resources":
+			var in map[string][]HetznerFirewallResource
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&in))
+			assert.Equal(t, []HetznerFirewallResource{hetznerServerResource(7)}, in["apply_to"])
+			fmt.Fprint(w, `{"actions":[]}`)
+		case "GET /servers/7":
+			fmt.Fprint(w, `{"server":{"id":7,"labels":{"KubernetesCluster":"game"},"public_net":{"ipv4":{"ip":"1.2.3.4"}},"private_net":[{"ip":"10.0.0.7"}]}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	s := HetznerService{client: server.Client(), endpoint: server.URL, token: "token"}
+
+	firewalls, err := s.ListFirewalls("external-ips/game=owned")
+	require.NoError(t, err)
+	require.Len(t, firewalls, 2)
+	assert.Equal(t, []int{7}, hetznerServers(firewalls[1]))
+
+	err = s.SetFirewallRules(firewalls[0], []HetznerFirewallRule{{Direction: "in", Protocol: "tcp", Port: "80", SourceIPs: []string{"0.0.0.0/0"}}})
+	require.NoError(t, err)
+	require.NoError(t, s.ApplyFirewall(firewalls[0], 7))
+
+	got, err := s.GetServer(7)
+	require.NoError(t, err)
+	assert.Equal(t, "game", got.Labels[hetznerClusterLabelKey])
+	assert.Equal(t, "1.2.3.4", got.PublicNet.IPv4.IP)
+	assert.Equal(t, []HetznerServerIP{{IP: "10.0.0.7"}}, got.PrivateNet)
+
+	assert.EqualError(t, s.DeleteFirewall(&HetznerFirewall{ID: 3}), "hetzner: DELETE /firewalls/3: 404 Not Found")
+}
@@ -0,0 +1,735 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	linodeEndpoint = "https://api.linode.com/v4"
+	// the largest page of firewalls and devices the API returns
+	linodePageSize = 500
+	// the label of the rules opened to the nodes of their firewall, whose addresses they list
+	linodeSelfRuleLabel = "external-ips-self"
+	linodeAccept        = "ACCEPT"
+	linodeDrop          = "DROP"
+	linodeDeviceLinode  = "linode"
+)
+
+// linodeClusterLabelRegMatch matches the labels of the instances of LKE clusters, lke<cluster id>-<pool id>-<suffix>
+var linodeClusterLabelRegMatch = regexp.MustCompile("^(lke[0-9]+)-")
+
+func init() {
+	Register("linode", Registration{
+		New: func(cfg *externalips.Config, nodes Nodes) (Provider, error) {
+			return NewLinodeProvider(
+				LinodeConfig{
+					DryRun: cfg.DryRun,
+				},
+				nodes.Cluster,
+			)
+		},
+	})
+}
+
+// LinodeFirewall is a Cloud Firewall of the Linode API.
+type LinodeFirewall struct {
+	ID    int                 `json:"id,omitempty"`
+	Label string              `json:"label"`
+	Tags  []string            `json:"tags"`
+	Rules LinodeFirewallRules `json:"rules"`
+}
+
+// LinodeFirewallRules is the rule set of a firewall, which is replaced as a whole.
+type LinodeFirewallRules struct {
+	Inbound        []LinodeFirewallRule `json:"inbound"`
+	InboundPolicy  string               `json:"inbound_policy"`
+	Outbound       []LinodeFirewallRule `json:"outbound"`
+	OutboundPolicy string               `json:"outbound_policy"`
+}
+
+// LinodeFirewallRule is a rule of a firewall, its protocol being upper case.
+type LinodeFirewallRule struct {
+	Action      string          `json:"action"`
+	Label       string          `json:"label,omitempty"`
+	Description string          `json:"description,omitempty"`
+	Ports       string          `json:"ports,omitempty"`
+	Protocol    string          `json:"protocol"`
+	Addresses   LinodeAddresses `json:"addresses"`
+}
+
+// LinodeAddresses are the sources of an inbound rule or the destinations of an outbound rule.
+type LinodeAddresses struct {
+	IPv4 []string `json:"ipv4,omitempty"`
+	IPv6 []string `json:"ipv6,omitempty"`
+}
+
+// LinodeFirewallDevice is the assignment of a firewall to an entity, a Linode or a NodeBalancer.
+type LinodeFirewallDevice struct {
+	ID     int          `json:"id"`
+	Entity LinodeEntity `json:"entity"`
+}
+
+// LinodeEntity is the entity a firewall is assigned to.
+type LinodeEntity struct {
+	ID   int    `json:"id"`
+	Type string `json:"type"`
+}
+
+// LinodeInstance is a Linode, of which only the label and the addresses are used.
+type LinodeInstance struct {
+	ID    int      `json:"id"`
+	Label string   `json:"label"`
+	IPv4  []string `json:"ipv4"`
+}
+
+// LinodeAPI is the subset of the Linode API that we actually use. Add methods as required.
+type LinodeAPI interface {
+	ListFirewalls() ([]LinodeFirewall, error)
+	CreateFirewall(fw *LinodeFirewall) (*LinodeFirewall, error)
+	UpdateFirewallRules(id int, rules LinodeFirewallRules) error
+	DeleteFirewall(id int) error
+	ListFirewallDevices(id int) ([]LinodeFirewallDevice, error)
+	AddFirewallDevice(id int, linodeID int) error
+	RemoveFirewallDevice(id int, deviceID int) error
+	GetInstance(id int) (*LinodeInstance, error)
+}
+
+// LinodeService calls the Linode API and fulfills the LinodeAPI interface.
+type LinodeService struct {
+	client   *http.Client
+	endpoint string
+	token    string
+}
+
+// ListFirewalls lists all the pages of the firewalls
+func (s LinodeService) ListFirewalls() ([]LinodeFirewall, error) {
+	result := []LinodeFirewall{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Data  []LinodeFirewall `json:"data"`
+			Pages int              `json:"pages"`
+		}
+		if err := s.do(http.MethodGet, "/networking/firewalls?"+linodePage(page), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Data...)
+		if page >= resp.Pages {
+			return result, nil
+		}
+	}
+}
+
+// CreateFirewall creates the firewall and returns it as created
+func (s LinodeService) CreateFirewall(fw *LinodeFirewall) (*LinodeFirewall, error) {
+	var created LinodeFirewall
+	if err := s.do(http.MethodPost, "/networking/firewalls", fw, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateFirewallRules replaces the rules of the firewall of the given id
+func (s LinodeService) UpdateFirewallRules(id int, rules LinodeFirewallRules) error {
+	return s.do(http.MethodPut, fmt.Sprintf("/networking/firewalls/%d/rules", id), rules, nil)
+}
+
+// DeleteFirewall deletes the firewall of the given id
+func (s LinodeService) DeleteFirewall(id int) error {
+	return s.do(http.MethodDelete, fmt.Sprintf("/networking/firewalls/%d", id), nil, nil)
+}
+
+// ListFirewallDevices lists all the pages of the devices of the firewall
+func (s LinodeService) ListFirewallDevices(id int) ([]LinodeFirewallDevice, error) {
+	result := []LinodeFirewallDevice{}
+	for page := 1; ; page++ {
+		var resp struct {
+			Data  []LinodeFirewallDevice `json:"data"`
+			Pages int                    `json:"pages"`
+		}
+		if err := s.do(http.MethodGet, fmt.Sprintf("/networking/firewalls/%d/devices?%s", id, linodePage(page)), nil, &resp); err != nil {
+			return nil, err
+		}
+		result = append(result, resp.Data...)
+		if page >= resp.Pages {
+			return result, nil
+		}
+	}
+}
+
+// AddFirewallDevice assigns the firewall to the Linode
+func (s LinodeService) AddFirewallDevice(id int, linodeID int) error {
+	return s.do(http.MethodPost, fmt.Sprintf("/networking/firewalls/%d/devices", id), LinodeEntity{ID: linodeID, Type: linodeDeviceLinode}, nil)
+}
+
+// RemoveFirewallDevice removes the device of the given id from the firewall
+func (s LinodeService) RemoveFirewallDevice(id int, deviceID int) error {
+	return s.do(http.MethodDelete, fmt.Sprintf("/networking/firewalls/%d/devices/%d", id, deviceID), nil, nil)
+}
+
+// GetInstance returns the Linode of the given id
+func (s LinodeService) GetInstance(id int) (*LinodeInstance, error) {
+	var instance LinodeInstance
+	if err := s.do(http.MethodGet, fmt.Sprintf("/linode/instances/%d", id), nil, &instance); err != nil {
+		return nil, err
+	}
+	return &instance, nil
+}
+
+func linodePage(page int) string {
+	query := url.Values{}
+	query.Set("page", fmt.Sprint(page))
+	query.Set("page_size", fmt.Sprint(linodePageSize))
+	return query.Encode()
+}
+
+// do sends a request to the API, encoding in and decoding the response into out when not nil.
+func (s LinodeService) do(method, path string, in, out interface{}) error {
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, s.endpoint+path, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("linode: %s %s: %s", method, path, resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// LinodeProvider is an implementation of Provider for Linode Cloud Firewalls.
+//
+// Linode firewalls only open ports to addresses: the rules opened to the security
+// group itself list the addresses of the nodes of the firewall, under a label of
+// their own, and the rules opened to other security groups aren't supported.
+type LinodeProvider struct {
+	client     LinodeAPI
+	nodeLister node.Lister
+	dryRun     bool
+
+	mu          sync.Mutex
+	clusterName string
+}
+
+// LinodeConfig contains configuration to create a new Linode provider.
+type LinodeConfig struct {
+	DryRun bool
+}
+
+// NewLinodeProvider initializes a new Linode Cloud Firewall based Provider.
+// The API token is read from the LINODE_TOKEN environment variable.
+func NewLinodeProvider(linodeConfig LinodeConfig, nodeLister node.Lister) (*LinodeProvider, error) {
+	token, ok := os.LookupEnv("LINODE_TOKEN")
+	if !ok || token == "" {
+		return nil, fmt.Errorf("No token found")
+	}
+	provider := &LinodeProvider{
+		client:     LinodeService{client: http.DefaultClient, endpoint: linodeEndpoint, token: token},
+		nodeLister: nodeLister,
+		dryRun:     linodeConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+func (p *LinodeProvider) GetClusterName() (string, error) {
+	p.mu.Lock()
+	clusterName := p.clusterName
+	p.mu.Unlock()
+	if len(clusterName) != 0 {
+		return clusterName, nil
+	}
+
+	instances, err := p.getInstances()
+	if err != nil {
+		return "", err
+	}
+	if len(instances) == 0 {
+		return "", fmt.Errorf("No instance was found")
+	}
+
+	// any instance of the cluster tells its name
+	var linodeID int
+	for id := range instances {
+		linodeID = id
+		break
+	}
+	instance, err := p.client.GetInstance(linodeID)
+	if err != nil {
+		return "", err
+	}
+	m := linodeClusterLabelRegMatch.FindStringSubmatch(instance.Label)
+	if m == nil {
+		return "", fmt.Errorf("instance %d has no LKE label lke<cluster id>-*: %s", linodeID, instance.Label)
+	}
+
+	p.mu.Lock()
+	p.clusterName = m[1]
+	p.mu.Unlock()
+	return m[1], nil
+}
+
+func (p *LinodeProvider) Rules() ([]*inbound.InboundRules, error) {
+	instances, err := p.getInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*inbound.InboundRules{}
+	for _, fw := range firewalls {
+		rules, err := p.newInboundRules(fw, instances)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, rules)
+	}
+	return result, nil
+}
+
+func (p *LinodeProvider) ApplyChanges(changes *plan.Changes) error {
+	firewalls, err := p.ownedFirewalls()
+	if err != nil {
+		return err
+	}
+
+	err = p.createFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.setFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.unsetFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	err = p.deleteFirewalls(changes, firewalls)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *LinodeProvider) ownerTag(clusterName string) string {
+	return TagNameExternalIPsPrefix + clusterName
+}
+
+// getInstances returns the providerIDs of the nodes, keyed by instance id.
+func (p *LinodeProvider) getInstances() (map[int]string, error) {
+	nodes, err := p.nodeLister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	instances := make(map[int]string, len(nodes))
+	for _, n := range nodes {
+		linodeID, err := linodeInstanceID(n.Spec.ProviderID)
+		if err != nil {
+			return nil, err
+		}
+		instances[linodeID] = n.Spec.ProviderID
+	}
+	return instances, nil
+}
+
+func linodeInstanceID(providerID string) (int, error) {
+	instanceID, err := node.InstanceID(providerID, node.SchemeLinode)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(instanceID)
+}
+
+// ownedFirewalls returns the firewalls tagged for the cluster, keyed by label.
+func (p *LinodeProvider) ownedFirewalls() (map[string]*LinodeFirewall, error) {
+	clusterName, err := p.GetClusterName()
+	if err != nil {
+		return nil, err
+	}
+	ownerTag := p.ownerTag(clusterName)
+
+	firewalls, err := p.client.ListFirewalls()
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]*LinodeFirewall{}
+	for i, fw := range firewalls {
+		if !hasTag(fw.Tags, ownerTag) {
+			continue
+		}
+		if _, ok := result[fw.Label]; ok {
+			return nil, fmt.Errorf("firewall label is not unique %s", fw.Label)
+		}
+		result[fw.Label] = &firewalls[i]
+	}
+	return result, nil
+}
+
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// linodeDevices returns the instances the firewall is assigned to, keyed by instance id.
+func (p *LinodeProvider) linodeDevices(fw *LinodeFirewall) (map[int]LinodeFirewallDevice, error) {
+	devices, err := p.client.ListFirewallDevices(fw.ID)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[int]LinodeFirewallDevice, len(devices))
+	for _, d := range devices {
+		if d.Entity.Type != linodeDeviceLinode {
+			continue
+		}
+		result[d.Entity.ID] = d
+	}
+	return result, nil
+}
+
+// selfAddresses returns the addresses of the instances of the providerIDs, sorted.
+func (p *LinodeProvider) selfAddresses(providerIDs []string) ([]string, error) {
+	addresses := []string{}
+	for _, providerID := range providerIDs {
+		linodeID, err := linodeInstanceID(providerID)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := p.client.GetInstance(linodeID)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range instance.IPv4 {
+			addresses = append(addresses, ip+"/32")
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+func (p *LinodeProvider) newInboundRules(fw *LinodeFirewall, instances map[int]string) (*inbound.InboundRules, error) {
+	rules := inbound.NewInboundRules()
+	rules.Name = fw.Label
+
+	devices, err := p.linodeDevices(fw)
+	if err != nil {
+		return nil, err
+	}
+	// the instances which aren't nodes are left alone
+	for linodeID := range devices {
+		providerID, ok := instances[linodeID]
+		if !ok {
+			continue
+		}
+		rules.ProviderIDs = append(rules.ProviderIDs, providerID)
+	}
+	rules.ProviderIDs = inbound.NewProviderIDs(rules.ProviderIDs...)
+
+	var self []string
+	// a rule opened to addresses and to the nodes of the firewall is made of two firewall rules
+	index := map[string]int{}
+	for _, r := range fw.Rules.Inbound {
+		if r.Action != linodeAccept {
+			continue
+		}
+		first, last, err := linodePorts(r.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ports %q of firewall %s: %v", r.Ports, fw.Label, err)
+		}
+		key := fmt.Sprintf("%s/%d-%d/%s", r.Protocol, first, last, r.Description)
+		i, ok := index[key]
+		if !ok {
+			i = len(rules.Rules)
+			index[key] = i
+			rule := inbound.InboundRule{
+				Protocol:    strings.ToLower(r.Protocol),
+				Port:        first,
+				Description: r.Description,
+			}
+			if last != first {
+				rule.ToPort = last
+			}
+			rules.Rules = append(rules.Rules, rule)
+		}
+		addresses := r.Addresses.IPv4
+		if r.Label != linodeSelfRuleLabel {
+			rules.Rules[i].SourceCIDRs = append(rules.Rules[i].SourceCIDRs, addresses...)
+			continue
+		}
+		rules.Rules[i].SourceSecurityGroup = inbound.SourceSecurityGroupSelf
+		if self == nil {
+			self, err = p.selfAddresses(rules.ProviderIDs)
+			if err != nil {
+				return nil, err
+			}
+		}
+		current := append([]string{}, addresses...)
+		sort.Strings(current)
+		if strings.Join(current, ",") != strings.Join(self, ",") {
+			rules.Drifted = true
+		}
+	}
+	return rules, nil
+}
+
+// linodePorts parses the ports of a rule, a single port or a range, empty for all the ports.
+func linodePorts(ports string) (int, int, error) {
+	if ports == "" {
+		return 0, 0, nil
+	}
+	if strings.Contains(ports, "-") {
+		return inbound.ParsePortRange(ports)
+	}
+	port, err := strconv.Atoi(ports)
+	return port, port, err
+}
+
+// linodeInboundRules converts the rules, the ones opened to the security group itself being opened to the addresses given.
+func linodeInboundRules(rules []inbound.InboundRule, self []string) ([]LinodeFirewallRule, error) {
+	result := make([]LinodeFirewallRule, 0, len(rules))
+	for _, rule := range rules {
+		r := LinodeFirewallRule{
+			Action:      linodeAccept,
+			Protocol:    strings.ToUpper(rule.Protocol),
+			Description: rule.Description,
+		}
+		if rule.Port != 0 {
+			r.Ports = strconv.Itoa(rule.Port)
+			if rule.ToPort != 0 {
+				r.Ports = fmt.Sprintf("%d-%d", rule.Port, rule.ToPort)
+			}
+		}
+		if cidrs := rule.CIDRs(); len(cidrs) > 0 {
+			sources := r
+			sources.Addresses.IPv4 = cidrs
+			result = append(result, sources)
+		}
+		switch rule.SourceSecurityGroup {
+		case "":
+		case inbound.SourceSecurityGroupSelf:
+			// the rule is applied again once the firewall has nodes
+			if len(self) == 0 {
+				continue
+			}
+			sources := r
+			sources.Label = linodeSelfRuleLabel
+			sources.Addresses.IPv4 = self
+			result = append(result, sources)
+		default:
+			return nil, fmt.Errorf("linode firewalls can't open %s to the security group %s", rule.Description, rule.SourceSecurityGroup)
+		}
+	}
+	return result, nil
+}
+
+func (p *LinodeProvider) desiredRules(r *inbound.InboundRules) ([]LinodeFirewallRule, error) {
+	var self []string
+	for _, rule := range r.Rules {
+		if rule.SourceSecurityGroup == inbound.SourceSecurityGroupSelf {
+			var err error
+			self, err = p.selfAddresses(r.ProviderIDs)
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return linodeInboundRules(r.Rules, self)
+}
+
+func (p *LinodeProvider) createFirewalls(changes *plan.Changes, firewalls map[string]*LinodeFirewall) error {
+	for _, r := range changes.Create {
+		log.Infof("Desired change: %s %s", "CREATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		clusterName, err := p.GetClusterName()
+		if err != nil {
+			return err
+		}
+		inboundRules, err := p.desiredRules(r)
+		if err != nil {
+			return err
+		}
+		fw, err := p.client.CreateFirewall(&LinodeFirewall{
+			Label: r.Name,
+			Tags:  []string{p.ownerTag(clusterName)},
+			Rules: LinodeFirewallRules{
+				Inbound:        inboundRules,
+				InboundPolicy:  linodeDrop,
+				OutboundPolicy: linodeAccept,
+			},
+		})
+		if err != nil {
+			return err
+		}
+		firewalls[fw.Label] = fw
+	}
+	return nil
+}
+
+func (p *LinodeProvider) updateFirewalls(changes *plan.Changes, firewalls map[string]*LinodeFirewall) error {
+	for _, r := range changes.UpdateNew {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "UPDATE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		inboundRules, err := p.desiredRules(r)
+		if err != nil {
+			return err
+		}
+		// the rules are replaced as a whole, keeping the policies and the outbound rules
+		ruleSet := fw.Rules
+		ruleSet.Inbound = inboundRules
+		err = p.client.UpdateFirewallRules(fw.ID, ruleSet)
+		if err != nil {
+			return err
+		}
+		fw.Rules = ruleSet
+	}
+	return nil
+}
+
+func (p *LinodeProvider) deleteFirewalls(changes *plan.Changes, firewalls map[string]*LinodeFirewall) error {
+	for _, r := range changes.Delete {
+		fw, ok := firewalls[r.Name]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.Name)
+		}
+
+		log.Infof("Desired change: %s %s", "DELETE FW", r)
+		if p.dryRun {
+			continue
+		}
+
+		err := p.client.DeleteFirewall(fw.ID)
+		if err != nil {
+			return err
+		}
+		delete(firewalls, fw.Label)
+	}
+	return nil
+}
+
+func (p *LinodeProvider) setFirewalls(changes *plan.Changes, firewalls map[string]*LinodeFirewall) error {
+	for _, r := range changes.Set {
+		linodeID, err := linodeInstanceID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "ASSIGN FW", linodeID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		devices, err := p.linodeDevices(fw)
+		if err != nil {
+			return err
+		}
+		if _, ok := devices[linodeID]; ok {
+			continue
+		}
+		err = p.client.AddFirewallDevice(fw.ID, linodeID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *LinodeProvider) unsetFirewalls(changes *plan.Changes, firewalls map[string]*LinodeFirewall) error {
+	for _, r := range changes.Unset {
+		linodeID, err := linodeInstanceID(r.ProviderID)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %d %s", "UNASSIGN FW", linodeID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		fw, ok := firewalls[r.RulesName]
+		if !ok {
+			return fmt.Errorf("firewall not found %s", r.RulesName)
+		}
+		devices, err := p.linodeDevices(fw)
+		if err != nil {
+			return err
+		}
+		device, ok := devices[linodeID]
+		if !ok {
+			continue
+		}
+		err = p.client.RemoveFirewallDevice(fw.ID, device.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+)
+
+// linodeAPIStub keeps the firewalls and their devices in memory, the instance
+// of id N being labeled for the lke1 cluster with the address 10.0.0.N.
+type linodeAPIStub struct {
+	firewalls []*LinodeFirewall
+	devices   map[int][]LinodeFirewallDevice
+	nextID    int
+}
+
+func newLinodeAPIStub() *linodeAPIStub {
+	return &linodeAPIStub{devices: map[int][]LinodeFirewallDevice{}, nextID: 100}
+}
+
+func (s *linodeAPIStub) ListFirewalls() ([]LinodeFirewall, error) {
+	result := make([]LinodeFirewall, 0, len(s.firewalls))
+	for _, fw := range s.firewalls {
+		result = append(result, *fw)
+	}
+	return result, nil
+}
+
+func (s *linodeAPIStub) CreateFirewall(created *LinodeFirewall) (*LinodeFirewall, error) {
+	s.nextID++
+	fw := &LinodeFirewall{ID: s.nextID, Label: created.Label, Tags: created.Tags, Rules: created.Rules}
+	s.firewalls = append(s.firewalls, fw)
+	return fw, nil
+}
+
+func (s *linodeAPIStub) UpdateFirewallRules(id int, rules LinodeFirewallRules) error {
+	fw, err := s.find(id)
+	if err != nil {
+		return err
+	}
+	fw.Rules = rules
+	return nil
+}
+
+func (s *linodeAPIStub) DeleteFirewall(id int) error {
+	for i, fw := range s.firewalls {
+		if fw.ID == id {
+			s.firewalls = append(s.firewalls[:i], s.firewalls[i+1:]...)
+			delete(s.devices, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("no firewall %d", id)
+}
+
+func (s *linodeAPIStub) ListFirewallDevices(id int) ([]LinodeFirewallDevice, error) {
+	return s.devices[id], nil
+}
+
+func (s *linodeAPIStub) AddFirewallDevice(id int, linodeID int) error {
+	s.nextID++
+	device := LinodeFirewallDevice{ID: s.nextID, Entity: LinodeEntity{ID: linodeID, Type: linodeDeviceLinode}}
+	s.devices[id] = append(s.devices[id], device)
+	return nil
+}
+
+func (s *linodeAPIStub) RemoveFirewallDevice(id int, deviceID int) error {
+	for i, d := range s.devices[id] {
+		if d.ID == deviceID {
+			s.devices[id] = append(s.devices[id][:i], s.devices[id][i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no device %d", deviceID)
+}
+
+func (s *linodeAPIStub) GetInstance(id int) (*LinodeInstance, error) {
+	return &LinodeInstance{ID: id, Label: fmt.Sprintf("lke1-1-%d", id), IPv4: []string{fmt.Sprintf("10.0.0.%d", id)}}, nil
+}
+
+func (s *linodeAPIStub) find(id int) (*LinodeFirewall, error) {
+	for _, fw := range s.firewalls {
+		if fw.ID == id {
+			return fw, nil
+		}
+	}
+	return nil, fmt.Errorf("no firewall %d", id)
+}
+
+func newLinodeProvider(client LinodeAPI, providerIDs ...string) *LinodeProvider {
+	return &LinodeProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: providerIDs},
+	}
+}
+
+func TestLinodeApplyChanges(t *testing.T) {
+	client := newLinodeAPIStub()
+	client.firewalls = append(client.firewalls, &LinodeFirewall{ID: 1, Label: "manual", Tags: []string{"other"}})
+	p := newLinodeProvider(client, "linode://1", "linode://2")
+
+	name, err := p.GetClusterName()
+	require.NoError(t, err)
+	assert.Equal(t, "lke1", name)
+
+	desired := &inbound.InboundRules{
+		Name: "svc0.lke1",
+		Rules: []inbound.InboundRule{
+			{Protocol: "tcp", Port: 80, Description: "default/svc0/80"},
+			{Protocol: "udp", Port: 8000, ToPort: 8010, Description: "default/svc0/8000", SourceCIDRs: []string{"192.168.0.0/16"}, SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+		},
+		ProviderIDs: inbound.NewProviderIDs("linode://1", "linode://2"),
+	}
+	err = p.ApplyChanges(&plan.Changes{
+		Create: []*inbound.InboundRules{desired},
+		Set: []*plan.InstanceRule{
+			{ProviderID: "linode://1", RulesName: desired.Name},
+			{ProviderID: "linode://2", RulesName: desired.Name},
+		},
+	})
+	require.NoError(t, err)
+
+	fw, err := client.find(101)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"external-ips/lke1"}, fw.Tags)
+	require.Len(t, fw.Rules.Inbound, 3)
+	assert.Equal(t, "UDP", fw.Rules.Inbound[2].Protocol)
+	assert.Equal(t, "8000-8010", fw.Rules.Inbound[2].Ports)
+	assert.Equal(t, linodeSelfRuleLabel, fw.Rules.Inbound[2].Label)
+	assert.Equal(t, []string{"10.0.0.1/32", "10.0.0.2/32"}, fw.Rules.Inbound[2].Addresses.IPv4)
+
+	current, err := p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.True(t, current[0].Same(desired))
+	assert.False(t, current[0].Drifted)
+	assert.Equal(t, desired.ProviderIDs, current[0].ProviderIDs)
+
+	// a node leaving the firewall drifts the rules opened to the firewall itself
+	err = p.ApplyChanges(&plan.Changes{
+		Unset: []*plan.InstanceRule{{ProviderID: "linode://2", RulesName: desired.Name}},
+	})
+	require.NoError(t, err)
+	current, err = p.Rules()
+	require.NoError(t, err)
+	assert.True(t, current[0].Drifted)
+
+	err = p.ApplyChanges(&plan.Changes{
+		Unset:  []*plan.InstanceRule{{ProviderID: "linode://1", RulesName: desired.Name}},
+		Delete: []*inbound.InboundRules{desired},
+	})
+	require.NoError(t, err)
+	assert.Len(t, client.firewalls, 1)
+}
+
+func TestLinodeInboundRulesSecurityGroup(t *testing.T) {
+	_, err := linodeInboundRules([]inbound.InboundRule{
+		{Protocol: "tcp", Port: 80, Description: "default/svc0/80", SourceSecurityGroup: "sg-1"},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestLinodeService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.Method + " " + r.URL.Path {
+		case "GET /networking/firewalls":
+			page := r.URL.Query().Get("page")
+			fmt.Fprintf(w, `{"data":[{"id":%s,"label":"svc%s.lke1","tags":["external-ips/lke1"]}],"page":%s,"pages":2}`, page, page, page)
+		case "PUT /networking/firewalls/1/rules":
+			var rules LinodeFirewallRules
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&rules))
+			assert.Equal(t, linodeDrop, rules.InboundPolicy)
+			assert.Equal(t, []string{inbound.AnyCIDR}, rules.Inbound[0].Addresses.IPv4)
+			fmt.Fprint(w, `{}`)
+		case "POST /networking/firewalls/1/devices":
+			var entity LinodeEntity
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&entity))
+			assert.Equal(t, LinodeEntity{ID: 7, Type: linodeDeviceLinode}, entity)
+			fmt.Fprint(w, `{"id":70,"entity":{"id":7,"type":"linode"}}`)
+		case "GET /linode/instances/7":
+			fmt.Fprint(w, `{"id":7,"label":"lke1-1-7","ipv4":["10.0.0.7","192.168.0.7"]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	s := LinodeService{client: server.Client(), endpoint: server.URL, token: "token"}
+
+	firewalls, err := s.ListFirewalls()
+	require.NoError(t, err)
+	require.Len(t, firewalls, 2)
+	assert.Equal(t, "svc2.lke1", firewalls[1].Label)
+
+	err = s.UpdateFirewallRules(1, LinodeFirewallRules{
+		Inbound:       []LinodeFirewallRule{{Action: linodeAccept, Protocol: "TCP", Ports: "80", Addresses: LinodeAddresses{IPv4: []string{inbound.AnyCIDR}}}},
+		InboundPolicy: linodeDrop,
+	})
+	require.NoError(t, err)
+	require.NoError(t, s.AddFirewallDevice(1, 7))
+
+	instance, err := s.GetInstance(7)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.7", "192.168.0.7"}, instance.IPv4)
+
+	assert.EqualError(t, s.DeleteFirewall(3), "linode: DELETE /networking/firewalls/3: 404 Not Found")
+}
@@ -0,0 +1,625 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/attributestags"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	secrules "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	openStackClusterMetadataKey = "KubernetesCluster"
+	openStackResourceTypeSG     = "security-groups"
+)
+
+func init() {
+	Register("openstack", Registration{
+		New: func(cfg *externalips.Config, nodes Nodes) (Provider, error) {
+			return NewOpenStackProvider(
+				OpenStackConfig{
+					Region: cfg.OpenStackRegion,
+					DryRun: cfg.DryRun,
+				},
+				nodes.Cluster,
+			)
+		},
+	})
+}
+
+// NeutronAPI is the subset of the OpenStack networking and compute APIs that we actually use. Add methods as required.
+type NeutronAPI interface {
+	ListSecurityGroups(opts groups.ListOpts) ([]groups.SecGroup, error)
+	CreateSecurityGroup(opts groups.CreateOpts) (*groups.SecGroup, error)
+	DeleteSecurityGroup(id string) error
+	ReplaceSecurityGroupTags(id string, tags []string) error
+	CreateSecurityGroupRule(opts secrules.CreateOpts) (*secrules.SecGroupRule, error)
+	DeleteSecurityGroupRule(id string) error
+	ListPorts(opts ports.ListOpts) ([]ports.Port, error)
+	UpdatePortSecurityGroups(id string, groups []string) error
+	GetServerMetadata(id string) (map[string]string, error)
+}
+
+// neutronClient implements NeutronAPI with the gophercloud service clients.
+type neutronClient struct {
+	network *gophercloud.ServiceClient
+	compute *gophercloud.ServiceClient
+}
+
+func (c *neutronClient) ListSecurityGroups(opts groups.ListOpts) ([]groups.SecGroup, error) {
+	pages, err := groups.List(c.network, opts).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return groups.ExtractGroups(pages)
+}
+
+func (c *neutronClient) CreateSecurityGroup(opts groups.CreateOpts) (*groups.SecGroup, error) {
+	return groups.Create(c.network, opts).Extract()
+}
+
+func (c *neutronClient) DeleteSecurityGroup(id string) error {
+	return groups.Delete(c.network, id).ExtractErr()
+}
+
+func (c *neutronClient) ReplaceSecurityGroupTags(id string, tags []string) error {
+	_, err := attributestags.ReplaceAll(c.network, openStackResourceTypeSG, id, attributestags.ReplaceAllOpts{Tags: tags}).Extract()
+	return err
+}
+
+func (c *neutronClient) CreateSecurityGroupRule(opts secrules.CreateOpts) (*secrules.SecGroupRule, error) {
+	return secrules.Create(c.network, opts).Extract()
+}
+
+func (c *neutronClient) DeleteSecurityGroupRule(id string) error {
+	return secrules.Delete(c.network, id).ExtractErr()
+}
+
+func (c *neutronClient) ListPorts(opts ports.ListOpts) ([]ports.Port, error) {
+	pages, err := ports.List(c.network, opts).AllPages()
+	if err != nil {
+		return nil, err
+	}
+	return ports.ExtractPorts(pages)
+}
+
+func (c *neutronClient) UpdatePortSecurityGroups(id string, groups []string) error {
+	_, err := ports.Update(c.network, id, ports.UpdateOpts{SecurityGroups: &groups}).Extract()
+	return err
+}
+
+func (c *neutronClient) GetServerMetadata(id string) (map[string]string, error) {
+	server, err := servers.Get(c.compute, id).Extract()
+	if err != nil {
+		return nil, err
+	}
+	return server.Metadata, nil
+}
+
+// OpenStackProvider is an implementation of Provider for OpenStack Neutron security groups.
+type OpenStackProvider struct {
+	client     NeutronAPI
+	nodeLister node.Lister
+	dryRun     bool
+	// the latest snapshot of the servers of the nodes
+	mu       sync.Mutex
+	snapshot *openStackSnapshot
+}
+
+// openStackSnapshot maps the nodes of the cluster to their servers at a point in
+// time. It is never updated once taken, a new one replaces it.
+type openStackSnapshot struct {
+	// the server IDs, in the order of the nodes
+	instanceIDs []string
+	// the ProviderIDs of the nodes by server ID
+	providerIDs map[string]string
+	clusterName string
+}
+
+// ownerTag returns the tag of the security groups owned by the cluster.
+func (s *openStackSnapshot) ownerTag() string {
+	return TagNameExternalIPsPrefix + s.clusterName
+}
+
+// OpenStackConfig contains configuration to create a new OpenStack provider.
+type OpenStackConfig struct {
+	Region string
+	DryRun bool
+}
+
+// NewOpenStackProvider initializes a new OpenStack Neutron based Provider.
+// The credentials are read from the usual OS_* environment variables.
+func NewOpenStackProvider(openStackConfig OpenStackConfig, nodeLister node.Lister) (*OpenStackProvider, error) {
+	authOptions, err := openstack.AuthOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	authOptions.AllowReauth = true
+
+	providerClient, err := openstack.AuthenticatedClient(authOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	endpointOpts := gophercloud.EndpointOpts{
+		Region: openStackConfig.Region,
+	}
+	network, err := openstack.NewNetworkV2(providerClient, endpointOpts)
+	if err != nil {
+		return nil, err
+	}
+	compute, err := openstack.NewComputeV2(providerClient, endpointOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := &OpenStackProvider{
+		client: &neutronClient{
+			network: network,
+			compute: compute,
+		},
+		nodeLister: nodeLister,
+		dryRun:     openStackConfig.DryRun,
+	}
+
+	return provider, nil
+}
+
+// Protocols returns the protocols of the rules the provider opens, Neutron naming SCTP.
+func (p *OpenStackProvider) Protocols() []string {
+	return []string{inbound.ProtocolTCP, inbound.ProtocolUDP, inbound.ProtocolSCTP}
+}
+
+func (p *OpenStackProvider) GetClusterName() (string, error) {
+	s, err := p.currentSnapshot()
+	if err != nil {
+		return "", err
+	}
+	return s.clusterName, nil
+}
+
+func (p *OpenStackProvider) Rules() ([]*inbound.InboundRules, error) {
+	s, err := p.refreshSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	instancePorts, err := p.getInstancePorts(s)
+	if err != nil {
+		return nil, err
+	}
+
+	sgs, err := p.client.ListSecurityGroups(groups.ListOpts{
+		Tags: s.ownerTag(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := []*inbound.InboundRules{}
+	for _, sg := range sgs {
+		rules := inbound.NewInboundRules()
+		rules.Name = sg.Name
+		// a rule opened to several sources is made of one security group rule per source
+		index := map[string]int{}
+		for _, r := range sg.Rules {
+			if r.Direction != string(secrules.DirIngress) {
+				continue
+			}
+			key := fmt.Sprintf("%s/%d-%d/%s", r.Protocol, r.PortRangeMin, r.PortRangeMax, r.Description)
+			i, ok := index[key]
+			if !ok {
+				i = len(rules.Rules)
+				index[key] = i
+				rule := inbound.InboundRule{
+					Protocol:    r.Protocol,
+					Port:        r.PortRangeMin,
+					Description: r.Description,
+				}
+				if r.PortRangeMax != r.PortRangeMin {
+					rule.ToPort = r.PortRangeMax
+				}
+				rules.Rules = append(rules.Rules, rule)
+			}
+			switch {
+			case r.RemoteGroupID == sg.ID:
+				rules.Rules[i].SourceSecurityGroup = inbound.SourceSecurityGroupSelf
+			case r.RemoteGroupID != "":
+				rules.Rules[i].SourceSecurityGroup = r.RemoteGroupID
+			case r.RemoteIPPrefix != "":
+				rules.Rules[i].SourceCIDRs = append(rules.Rules[i].SourceCIDRs, r.RemoteIPPrefix)
+			default:
+				rules.Rules[i].SourceCIDRs = append(rules.Rules[i].SourceCIDRs, inbound.AnyCIDR)
+			}
+		}
+		for instanceID, iports := range instancePorts {
+			if !portsHaveSecurityGroup(iports, sg.ID) {
+				continue
+			}
+			providerID, ok := s.providerIDs[instanceID]
+			if !ok {
+				return nil, fmt.Errorf("no ProviderID correspond to %s", instanceID)
+			}
+			rules.ProviderIDs = append(rules.ProviderIDs, providerID)
+		}
+		rules.ProviderIDs = inbound.NewProviderIDs(rules.ProviderIDs...)
+		result = append(result, rules)
+	}
+	return result, nil
+}
+
+// ApplyChanges applies the changes against a snapshot of the servers of its own,
+// taken anew rather than reused from the last call to Rules, like the AWS provider.
+func (p *OpenStackProvider) ApplyChanges(changes *plan.Changes) error {
+	s, err := p.refreshSnapshot()
+	if err != nil {
+		return err
+	}
+
+	err = p.createSecurityGroups(s, changes)
+	if err != nil {
+		return err
+	}
+
+	err = p.updateSecurityGroups(s, changes)
+	if err != nil {
+		return err
+	}
+
+	err = p.setSecurityGroups(s, changes)
+	if err != nil {
+		return err
+	}
+
+	err = p.unsetSecurityGroups(s, changes)
+	if err != nil {
+		return err
+	}
+
+	err = p.deleteSecurityGroups(s, changes)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// currentSnapshot returns the latest snapshot of the servers, taking one if none
+// was taken yet.
+func (p *OpenStackProvider) currentSnapshot() (*openStackSnapshot, error) {
+	p.mu.Lock()
+	s := p.snapshot
+	p.mu.Unlock()
+	if s != nil {
+		return s, nil
+	}
+	return p.refreshSnapshot()
+}
+
+// refreshSnapshot takes a new snapshot of the servers of the nodes, which replaces
+// the latest one. The cluster is found in the metadata of the server of the first node.
+func (p *OpenStackProvider) refreshSnapshot() (*openStackSnapshot, error) {
+	nodes, err := p.nodeLister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &openStackSnapshot{
+		instanceIDs: make([]string, 0, len(nodes)),
+		providerIDs: make(map[string]string, len(nodes)),
+	}
+	for _, n := range nodes {
+		instanceId, err := node.InstanceID(n.Spec.ProviderID, node.SchemeOpenStack)
+		if err != nil {
+			return nil, err
+		}
+		s.instanceIDs = append(s.instanceIDs, instanceId)
+		s.providerIDs[instanceId] = n.Spec.ProviderID
+	}
+
+	if len(s.instanceIDs) == 0 {
+		return nil, fmt.Errorf("No instance was found")
+	}
+
+	metadata, err := p.client.GetServerMetadata(s.instanceIDs[0])
+	if err != nil {
+		return nil, err
+	}
+	clusterName, ok := metadata[openStackClusterMetadataKey]
+	if !ok {
+		return nil, fmt.Errorf("instance %s has no %s metadata", s.instanceIDs[0], openStackClusterMetadataKey)
+	}
+	s.clusterName = clusterName
+
+	p.mu.Lock()
+	p.snapshot = s
+	p.mu.Unlock()
+	return s, nil
+}
+
+// getInstancePorts returns the Neutron ports attached to each node of the snapshot, keyed by instance id.
+func (p *OpenStackProvider) getInstancePorts(s *openStackSnapshot) (map[string][]ports.Port, error) {
+	result := make(map[string][]ports.Port, len(s.instanceIDs))
+	for _, id := range s.instanceIDs {
+		iports, err := p.client.ListPorts(ports.ListOpts{DeviceID: id})
+		if err != nil {
+			return nil, err
+		}
+		result[id] = iports
+	}
+	return result, nil
+}
+
+func portsHaveSecurityGroup(iports []ports.Port, groupID string) bool {
+	for _, port := range iports {
+		for _, sg := range port.SecurityGroups {
+			if sg == groupID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p *OpenStackProvider) findSecurityGroup(s *openStackSnapshot, name string) (*groups.SecGroup, error) {
+	sgs, err := p.client.ListSecurityGroups(groups.ListOpts{
+		Name: name,
+		Tags: s.ownerTag(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(sgs) == 0 {
+		return nil, fmt.Errorf("security group %s was not found", name)
+	}
+	if len(sgs) > 1 {
+		return nil, fmt.Errorf("security group name is not unique %s", name)
+	}
+	return &sgs[0], nil
+}
+
+// openStackRuleOpts returns the security group rules of the rules, one per source of each rule.
+func openStackRuleOpts(groupID string, rules []inbound.InboundRule) []secrules.CreateOpts {
+	result := []secrules.CreateOpts{}
+	for _, rule := range rules {
+		opts := secrules.CreateOpts{
+			Direction:    secrules.DirIngress,
+			EtherType:    secrules.EtherType4,
+			SecGroupID:   groupID,
+			PortRangeMin: rule.Port,
+			PortRangeMax: rule.LastPort(),
+			Protocol:     secrules.RuleProtocol(rule.Protocol),
+			Description:  rule.Description,
+		}
+		sources := make([]secrules.CreateOpts, 0, len(rule.SourceCIDRs)+1)
+		for _, cidr := range rule.CIDRs() {
+			source := opts
+			source.RemoteIPPrefix = cidr
+			sources = append(sources, source)
+		}
+		if rule.SourceSecurityGroup != "" {
+			source := opts
+			source.RemoteGroupID = rule.SourceSecurityGroup
+			if source.RemoteGroupID == inbound.SourceSecurityGroupSelf {
+				source.RemoteGroupID = groupID
+			}
+			sources = append(sources, source)
+		}
+		result = append(result, sources...)
+	}
+	return result
+}
+
+// openStackRuleKey identifies a security group rule by what it opens, the rules
+// without a remote being opened to any address.
+func openStackRuleKey(protocol string, first, last int, description, remoteGroupID, remoteIPPrefix string) string {
+	if remoteGroupID == "" && remoteIPPrefix == "" {
+		remoteIPPrefix = inbound.AnyCIDR
+	}
+	return fmt.Sprintf("%s/%d-%d/%s/%s/%s", protocol, first, last, description, remoteGroupID, remoteIPPrefix)
+}
+
+// addInboundRules creates a security group rule per source of each rule.
+func (p *OpenStackProvider) addInboundRules(groupID string, rules []inbound.InboundRule) error {
+	for _, opts := range openStackRuleOpts(groupID, rules) {
+		if _, err := p.client.CreateSecurityGroupRule(opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceInboundRules updates the ingress rules of the security group to the rules by
+// difference, the security group rules already opened being kept as they are.
+func (p *OpenStackProvider) replaceInboundRules(sg *groups.SecGroup, rules []inbound.InboundRule) error {
+	// the security group rules to create by key, the keys in the order of the rules
+	desired := map[string][]secrules.CreateOpts{}
+	var keys []string
+	for _, opts := range openStackRuleOpts(sg.ID, rules) {
+		key := openStackRuleKey(string(opts.Protocol), opts.PortRangeMin, opts.PortRangeMax, opts.Description, opts.RemoteGroupID, opts.RemoteIPPrefix)
+		if _, ok := desired[key]; !ok {
+			keys = append(keys, key)
+		}
+		desired[key] = append(desired[key], opts)
+	}
+
+	// the rules no longer desired are deleted first, Neutron refusing the rules
+	// which only differ from an existing one by their description
+	for _, rule := range sg.Rules {
+		if rule.Direction != string(secrules.DirIngress) {
+			continue
+		}
+		key := openStackRuleKey(rule.Protocol, rule.PortRangeMin, rule.PortRangeMax, rule.Description, rule.RemoteGroupID, rule.RemoteIPPrefix)
+		if len(desired[key]) > 0 {
+			desired[key] = desired[key][1:]
+			continue
+		}
+		if err := p.client.DeleteSecurityGroupRule(rule.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range keys {
+		for _, opts := range desired[key] {
+			if _, err := p.client.CreateSecurityGroupRule(opts); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *OpenStackProvider) createSecurityGroups(s *openStackSnapshot, changes *plan.Changes) error {
+	for _, r := range changes.Create {
+		log.Infof("Desired change: %s %s", "CREATE SG", r)
+		if p.dryRun {
+			continue
+		}
+
+		sg, err := p.client.CreateSecurityGroup(groups.CreateOpts{
+			Name:        r.Name,
+			Description: "Security group for External IPs",
+		})
+		if err != nil {
+			return err
+		}
+
+		err = p.client.ReplaceSecurityGroupTags(sg.ID, []string{s.ownerTag()})
+		if err != nil {
+			return err
+		}
+
+		err = p.addInboundRules(sg.ID, r.Rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *OpenStackProvider) updateSecurityGroups(s *openStackSnapshot, changes *plan.Changes) error {
+	for _, r := range changes.UpdateNew {
+		sg, err := p.findSecurityGroup(s, r.Name)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %s", "UPDATE SG", r)
+		if p.dryRun {
+			continue
+		}
+
+		err = p.replaceInboundRules(sg, r.Rules)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *OpenStackProvider) deleteSecurityGroups(s *openStackSnapshot, changes *plan.Changes) error {
+	for _, r := range changes.Delete {
+		sg, err := p.findSecurityGroup(s, r.Name)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %s", "DELETE SG", r)
+		if p.dryRun {
+			continue
+		}
+
+		err = p.client.DeleteSecurityGroup(sg.ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *OpenStackProvider) setSecurityGroups(s *openStackSnapshot, changes *plan.Changes) error {
+	for _, r := range changes.Set {
+		instanceID, err := node.InstanceID(r.ProviderID, node.SchemeOpenStack)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %s %s", "ASSIGN SG", instanceID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		sg, err := p.findSecurityGroup(s, r.RulesName)
+		if err != nil {
+			return err
+		}
+
+		iports, err := p.client.ListPorts(ports.ListOpts{DeviceID: instanceID})
+		if err != nil {
+			return err
+		}
+		for _, port := range iports {
+			if portsHaveSecurityGroup([]ports.Port{port}, sg.ID) {
+				continue
+			}
+			err = p.client.UpdatePortSecurityGroups(port.ID, append(port.SecurityGroups, sg.ID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *OpenStackProvider) unsetSecurityGroups(s *openStackSnapshot, changes *plan.Changes) error {
+	for _, r := range changes.Unset {
+		instanceID, err := node.InstanceID(r.ProviderID, node.SchemeOpenStack)
+		if err != nil {
+			return err
+		}
+
+		log.Infof("Desired change: %s %s %s", "UNASSIGN SG", instanceID, r.RulesName)
+		if p.dryRun {
+			continue
+		}
+
+		sg, err := p.findSecurityGroup(s, r.RulesName)
+		if err != nil {
+			return err
+		}
+
+		iports, err := p.client.ListPorts(ports.ListOpts{DeviceID: instanceID})
+		if err != nil {
+			return err
+		}
+		for _, port := range iports {
+			groups := make([]string, 0, len(port.SecurityGroups))
+			for _, id := range port.SecurityGroups {
+				if id == sg.ID {
+					continue
+				}
+				groups = append(groups, id)
+			}
+			if len(groups) == len(port.SecurityGroups) {
+				continue
+			}
+			err = p.client.UpdatePortSecurityGroups(port.ID, groups)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/groups"
+	secrules "github.com/gophercloud/gophercloud/openstack/networking/v2/extensions/security/rules"
+	"github.com/gophercloud/gophercloud/openstack/networking/v2/ports"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+)
+
+const (
+	openStackServer1 = "0e7a5a4c-4c8b-4f4e-9d0d-6f1b0b8e2c11"
+	openStackServer2 = "5b0f3c2e-9a1d-4e7b-8c6f-2d4a1e3b5c22"
+)
+
+// openStackAPIStub keeps the security groups and the ports of the servers in memory,
+// every server having a single port in the default security group and the metadata
+// of the game cluster.
+type openStackAPIStub struct {
+	groups   []*groups.SecGroup
+	tags     map[string][]string
+	ports    map[string][]ports.Port
+	metadata map[string]string
+	nextID   int
+}
+
+func newOpenStackAPIStub(servers ...string) *openStackAPIStub {
+	s := &openStackAPIStub{
+		tags:     map[string][]string{},
+		ports:    map[string][]ports.Port{},
+		metadata: map[string]string{openStackClusterMetadataKey: "game"},
+	}
+	for _, id := range servers {
+		s.ports[id] = []ports.Port{{ID: "port-" + id, DeviceID: id, SecurityGroups: []string{"sg-default"}}}
+	}
+	return s
+}
+
+func (s *openStackAPIStub) ListSecurityGroups(opts groups.ListOpts) ([]groups.SecGroup, error) {
+	result := []groups.SecGroup{}
+	for _, sg := range s.groups {
+		if opts.Name != "" && sg.Name != opts.Name {
+			continue
+		}
+		if opts.Tags != "" && !containsString(s.tags[sg.ID], opts.Tags) {
+			continue
+		}
+		copied := *sg
+		copied.Rules = append([]secrules.SecGroupRule(nil), sg.Rules...)
+		result = append(result, copied)
+	}
+	return result, nil
+}
+
+func (s *openStackAPIStub) CreateSecurityGroup(opts groups.CreateOpts) (*groups.SecGroup, error) {
+	s.nextID++
+	sg := &groups.SecGroup{ID: fmt.Sprintf("sg-%d", s.nextID), Name: opts.Name, Description: opts.Description}
+	s.groups = append(s.groups, sg)
+	copied := *sg
+	return &copied, nil
+}
+
+func (s *openStackAPIStub) DeleteSecurityGroup(id string) error {
+	for i, sg := range s.groups {
+		if sg.ID == id {
+			s.groups = append(s.groups[:i], s.groups[i+1:]...)
+			delete(s.tags, id)
+			return nil
+		}
+	}
+	return fmt.Errorf("no security group %s", id)
+}
+
+func (s *openStackAPIStub) ReplaceSecurityGroupTags(id string, tags []string) error {
+	if _, err := s.find(id); err != nil {
+		return err
+	}
+	s.tags[id] = tags
+	return nil
+}
+
+func (s *openStackAPIStub) CreateSecurityGroupRule(opts secrules.CreateOpts) (*secrules.SecGroupRule, error) {
+	sg, err := s.find(opts.SecGroupID)
+	if err != nil {
+		return nil, err
+	}
+	s.nextID++
+	rule := secrules.SecGroupRule{
+		ID:             fmt.Sprintf("rule-%d", s.nextID),
+		Direction:      string(opts.Direction),
+		EtherType:      string(opts.EtherType),
+		SecGroupID:     opts.SecGroupID,
+		PortRangeMin:   opts.PortRangeMin,
+		PortRangeMax:   opts.PortRangeMax,
+		Protocol:       string(opts.Protocol),
+		Description:    opts.Description,
+		RemoteGroupID:  opts.RemoteGroupID,
+		RemoteIPPrefix: opts.RemoteIPPrefix,
+	}
+	sg.Rules = append(sg.Rules, rule)
+	return &rule, nil
+}
+
+func (s *openStackAPIStub) DeleteSecurityGroupRule(id string) error {
+	for _, sg := range s.groups {
+		for i, rule := range sg.Rules {
+			if rule.ID == id {
+				sg.Rules = append(sg.Rules[:i], sg.Rules[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no security group rule %s", id)
+}
+
+func (s *openStackAPIStub) ListPorts(opts ports.ListOpts) ([]ports.Port, error) {
+	result := []ports.Port{}
+	for _, port := range s.ports[opts.DeviceID] {
+		port.SecurityGroups = append([]string(nil), port.SecurityGroups...)
+		result = append(result, port)
+	}
+	return result, nil
+}
+
+func (s *openStackAPIStub) UpdatePortSecurityGroups(id string, groups []string) error {
+	for _, iports := range s.ports {
+		for i := range iports {
+			if iports[i].ID == id {
+				iports[i].SecurityGroups = groups
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no port %s", id)
+}
+
+func (s *openStackAPIStub) GetServerMetadata(id string) (map[string]string, error) {
+	if _, ok := s.ports[id]; !ok {
+		return nil, fmt.Errorf("no server %s", id)
+	}
+	return s.metadata, nil
+}
+
+func (s *openStackAPIStub) find(id string) (*groups.SecGroup, error) {
+	for _, sg := range s.groups {
+		if sg.ID == id {
+			return sg, nil
+		}
+	}
+	return nil, fmt.Errorf("no security group %s", id)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOpenStackClusterName(t *testing.T) {
+	client := newOpenStackAPIStub(openStackServer1)
+	p := &OpenStackProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: []string{"openstack:///" + openStackServer1}},
+	}
+
+	// the cluster is found in the metadata of the server of the first node
+	name, err := p.GetClusterName()
+	require.NoError(t, err)
+	assert.Equal(t, "game", name)
+
+	p = &OpenStackProvider{
+		client:     newOpenStackAPIStub(openStackServer1),
+		nodeLister: &nodeListerStub{providerIDs: []string{"openstack:///" + openStackServer1}},
+	}
+	p.client.(*openStackAPIStub).metadata = map[string]string{}
+	_, err = p.GetClusterName()
+	assert.EqualError(t, err, "instance "+openStackServer1+" has no KubernetesCluster metadata")
+
+	p = &OpenStackProvider{client: client, nodeLister: &nodeListerStub{}}
+	_, err = p.GetClusterName()
+	assert.Error(t, err)
+}
+
+func TestOpenStackApplyChanges(t *testing.T) {
+	client := newOpenStackAPIStub(openStackServer1, openStackServer2)
+	// a security group of the same name created by hand isn't owned
+	client.groups = append(client.groups, &groups.SecGroup{ID: "sg-manual", Name: "svc0.game"})
+	first, second := "openstack:///"+openStackServer1, "openstack://RegionOne/"+openStackServer2
+	p := &OpenStackProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: []string{first, second}},
+	}
+	assert.Equal(t, []string{inbound.ProtocolTCP, inbound.ProtocolUDP, inbound.ProtocolSCTP}, p.Protocols())
+
+	current, err := p.Rules()
+	require.NoError(t, err)
+	assert.Empty(t, current)
+
+	desired := &inbound.InboundRules{
+		Name: "svc0.game",
+		Rules: []inbound.InboundRule{
+			{Protocol: "udp", Port: 7777, ToPort: 7787, Description: "default/svc0/7777"},
+			{Protocol: "tcp", Port: 9000, Description: "default/svc0/9000", SourceCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16"}, SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+			{Protocol: "sctp", Port: 3868, Description: "default/svc0/3868", SourceSecurityGroup: "sg-peer"},
+		},
+		ProviderIDs: inbound.NewProviderIDs(first, second),
+	}
+	err = p.ApplyChanges(&plan.Changes{
+		Create: []*inbound.InboundRules{desired},
+		Set: []*plan.InstanceRule{
+			{ProviderID: first, RulesName: desired.Name},
+			{ProviderID: second, RulesName: desired.Name},
+		},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, client.groups, 2)
+	sg := client.groups[1]
+	assert.Equal(t, []string{"external-ips/game"}, client.tags[sg.ID])
+	// one security group rule per source of each rule
+	require.Len(t, sg.Rules, 5)
+	assert.Equal(t, "udp", sg.Rules[0].Protocol)
+	assert.Equal(t, 7777, sg.Rules[0].PortRangeMin)
+	assert.Equal(t, 7787, sg.Rules[0].PortRangeMax)
+	assert.Equal(t, "0.0.0.0/0", sg.Rules[0].RemoteIPPrefix)
+	assert.Equal(t, "default/svc0/7777", sg.Rules[0].Description)
+	assert.Equal(t, "192.168.0.0/16", sg.Rules[2].RemoteIPPrefix)
+	assert.Equal(t, sg.ID, sg.Rules[3].RemoteGroupID)
+	assert.Equal(t, "sctp", sg.Rules[4].Protocol)
+	assert.Equal(t, "sg-peer", sg.Rules[4].RemoteGroupID)
+	for _, id := range []string{openStackServer1, openStackServer2} {
+		assert.Equal(t, []string{"sg-default", sg.ID}, client.ports[id][0].SecurityGroups)
+	}
+
+	// the security group rules are merged back by protocol, ports and description,
+	// and the servers mapped to the providerIDs of their nodes
+	current, err = p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.Equal(t, desired.Name, current[0].Name)
+	assert.True(t, current[0].Same(desired))
+	assert.Equal(t, []string{"10.0.0.0/8", "192.168.0.0/16"}, current[0].Rules[1].SourceCIDRs)
+	assert.Equal(t, inbound.SourceSecurityGroupSelf, current[0].Rules[1].SourceSecurityGroup)
+	assert.Equal(t, desired.ProviderIDs, current[0].ProviderIDs)
+
+	// the rules are updated by difference, and the servers left by an unset
+	kept := sg.Rules[0].ID
+	updated := &inbound.InboundRules{
+		Name: desired.Name,
+		Rules: []inbound.InboundRule{
+			{Protocol: "udp", Port: 7777, ToPort: 7787, Description: "default/svc0/7777"},
+			{Protocol: "tcp", Port: 80, Description: "default/svc0/80"},
+		},
+	}
+	err = p.ApplyChanges(&plan.Changes{
+		UpdateOld: current,
+		UpdateNew: []*inbound.InboundRules{updated},
+		Unset:     []*plan.InstanceRule{{ProviderID: second, RulesName: desired.Name}},
+	})
+	require.NoError(t, err)
+	require.Len(t, sg.Rules, 2)
+	assert.Equal(t, kept, sg.Rules[0].ID)
+	assert.Equal(t, 80, sg.Rules[1].PortRangeMin)
+	assert.Equal(t, []string{"sg-default"}, client.ports[openStackServer2][0].SecurityGroups)
+	current, err = p.Rules()
+	require.NoError(t, err)
+	require.Len(t, current, 1)
+	assert.True(t, current[0].Same(updated))
+	assert.Equal(t, inbound.ProviderIDs{first}, current[0].ProviderIDs)
+
+	// a missing security group is reported as such rather than as a duplicate
+	err = p.ApplyChanges(&plan.Changes{Delete: []*inbound.InboundRules{{Name: "svc9.game"}}})
+	assert.EqualError(t, err, "security group svc9.game was not found")
+
+	err = p.ApplyChanges(&plan.Changes{
+		Unset:  []*plan.InstanceRule{{ProviderID: first, RulesName: desired.Name}},
+		Delete: []*inbound.InboundRules{updated},
+	})
+	require.NoError(t, err)
+	require.Len(t, client.groups, 1)
+	assert.Equal(t, "sg-manual", client.groups[0].ID)
+	assert.Equal(t, []string{"sg-default"}, client.ports[openStackServer1][0].SecurityGroups)
+}
+
+func TestOpenStackDuplicateSecurityGroup(t *testing.T) {
+	client := newOpenStackAPIStub(openStackServer1)
+	p := &OpenStackProvider{
+		client:     client,
+		nodeLister: &nodeListerStub{providerIDs: []string{"openstack:///" + openStackServer1}},
+	}
+	// the changes are applied to the groups of the cluster without listing the rules first
+	for _, id := range []string{"sg-1", "sg-2"} {
+		client.groups = append(client.groups, &groups.SecGroup{ID: id, Name: "svc0.game"})
+		client.tags[id] = []string{"external-ips/game"}
+	}
+	err := p.ApplyChanges(&plan.Changes{Delete: []*inbound.InboundRules{{Name: "svc0.game"}}})
+	assert.EqualError(t, err, "security group name is not unique svc0.game")
+	assert.Len(t, client.groups, 2)
+}
@@ -25,8 +25,33 @@ import (
 )
 
 // Provider defines the interface DNS providers should implement.
+// Implementations must be safe for concurrent use.
 type Provider interface {
 	GetClusterName() (string, error)
 	Rules() ([]*inbound.InboundRules, error)
 	ApplyChanges(changes *plan.Changes) error
 }
+
+// Collector is implemented by the providers able to find the security groups
+// left behind, e.g. by a deletion which failed, and delete them.
+type Collector interface {
+	// Orphans returns the names of the owned security groups which aren't attached to any instance.
+	Orphans() ([]string, error)
+	// DeleteOrphan deletes the owned security group of the given name.
+	DeleteOrphan(name string) error
+}
+
+// ProtocolLimiter is implemented by the providers telling the protocols of the rules
+// they open, the providers which don't opening inbound.DefaultProtocols.
+type ProtocolLimiter interface {
+	// Protocols returns the protocols of the rules the provider opens, by lowercase name.
+	Protocols() []string
+}
+
+// InstanceTagger is implemented by the providers knowing the tags of the instances
+// of the nodes, which exclude the nodes from the exposure as their labels do.
+type InstanceTagger interface {
+	// InstanceTags returns the tags of the instances of the nodes by providerID, as of
+	// the latest snapshot of the instances, none before it's taken.
+	InstanceTags() map[string]map[string]string
+}
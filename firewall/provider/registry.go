@@ -0,0 +1,73 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package provider
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+// Nodes are the nodes a provider assigns the security groups to.
+type Nodes struct {
+	// The nodes of the cluster along with the instances of the tagged autoscaling groups
+	All node.Lister
+	// The nodes of the cluster only
+	Cluster node.Lister
+}
+
+// Registration binds the configuration to a provider registered by name.
+type Registration struct {
+	// New creates the provider managing the security groups of the nodes
+	New func(cfg *externalips.Config, nodes Nodes) (Provider, error)
+	// Permissions returns the IAM policy statements the provider requires for the
+	// cluster of the name. Nil if it doesn't need any.
+	Permissions func(clusterName string) []permissions.Statement
+}
+
+var (
+	registrationsMu sync.RWMutex
+	registrations   = map[string]Registration{}
+)
+
+// Register makes a provider available by name to the firewall provider setting
+// of the configuration, usually from the init function of its file. It panics if
+// the name is already registered.
+func Register(name string, r Registration) {
+	registrationsMu.Lock()
+	defer registrationsMu.Unlock()
+
+	if r.New == nil {
+		panic("provider: Register without New for " + name)
+	}
+	if _, dup := registrations[name]; dup {
+		panic("provider: Register called twice for " + name)
+	}
+	registrations[name] = r
+}
+
+// Lookup returns the registration of the provider of the name.
+func Lookup(name string) (Registration, bool) {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	r, ok := registrations[name]
+	return r, ok
+}
+
+// Names returns the sorted names of the registered providers.
+func Names() []string {
+	registrationsMu.RLock()
+	defer registrationsMu.RUnlock()
+
+	names := make([]string, 0, len(registrations))
+	for name := range registrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
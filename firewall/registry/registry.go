@@ -4,29 +4,154 @@
 package registry
 
 import (
+	"time"
+
+	"github.com/openfresh/external-ips/firewall/accelerator"
+	"github.com/openfresh/external-ips/firewall/history"
 	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/openfresh/external-ips/firewall/plan"
 	"github.com/openfresh/external-ips/firewall/provider"
+	log "github.com/sirupsen/logrus"
 )
 
 // RegistryImpl implements registry interface
 type Registry struct {
 	provider provider.Provider
+
+	// cache the rules in memory and update on an interval instead.
+	rulesCache            []*inbound.InboundRules
+	rulesCacheRefreshTime time.Time
+	cacheInterval         time.Duration
+
+	// the store of the snapshots of the desired rules, and the last one saved
+	history      history.Store
+	lastSnapshot *history.Snapshot
+
+	// the accelerator exposing the accelerated rules, if any
+	accelerator accelerator.Accelerator
+}
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithHistory records the snapshots of the desired rules in store.
+func WithHistory(store history.Store) Option {
+	return func(im *Registry) {
+		im.history = store
+	}
+}
+
+// WithAccelerator exposes the accelerated rules through the listeners of a.
+func WithAccelerator(a accelerator.Accelerator) Option {
+	return func(im *Registry) {
+		im.accelerator = a
+	}
 }
 
 // NewRegistry returns new Registry object
-func NewRegistry(provider provider.Provider) (*Registry, error) {
-	return &Registry{
-		provider: provider,
-	}, nil
+func NewRegistry(provider provider.Provider, cacheInterval time.Duration, opts ...Option) (*Registry, error) {
+	im := &Registry{
+		provider:      provider,
+		cacheInterval: cacheInterval,
+	}
+	for _, opt := range opts {
+		opt(im)
+	}
+	return im, nil
 }
 
 // Rules returns the current rules from the firewall provider
 func (im *Registry) Rules() ([]*inbound.InboundRules, error) {
-	return im.provider.Rules()
+	// If we have the rules cached AND we have refreshed the cache since the
+	// last given interval, then just use the cached results.
+	if im.rulesCache != nil && time.Since(im.rulesCacheRefreshTime) < im.cacheInterval {
+		log.Debug("Using cached rules.")
+		return im.rulesCache, nil
+	}
+
+	rules, err := im.provider.Rules()
+	if err != nil {
+		return nil, err
+	}
+
+	// Update the cache.
+	if im.cacheInterval > 0 {
+		im.rulesCache = rules
+		im.rulesCacheRefreshTime = time.Now()
+	}
+
+	return rules, nil
 }
 
 // ApplyChanges propagates changes to the firewall provider
 func (im *Registry) ApplyChanges(changes *plan.Changes) error {
+	// the rules and their assignments to the instances are about to change,
+	// read them from the provider on the next run.
+	if hasChanges(changes) {
+		im.rulesCache = nil
+	}
 	return im.provider.ApplyChanges(changes)
 }
+
+// Record saves the snapshot of the desired rules to the history, unless it
+// holds the same rules as the last one saved since they're still in effect.
+func (im *Registry) Record(desired []*inbound.InboundRules, t time.Time) error {
+	if im.history == nil {
+		return nil
+	}
+	snapshot := history.NewSnapshot(t, desired)
+	if im.lastSnapshot != nil && im.lastSnapshot.Same(snapshot) {
+		return nil
+	}
+	if err := im.history.Save(snapshot); err != nil {
+		return err
+	}
+	im.lastSnapshot = snapshot
+	return nil
+}
+
+// Accelerate brings the listeners of the accelerator to the accelerated rules
+// among desired, if the registry has an accelerator.
+func (im *Registry) Accelerate(desired []*inbound.InboundRules) error {
+	if im.accelerator == nil {
+		return nil
+	}
+	return im.accelerator.Sync(desired)
+}
+
+// Orphans returns the names of the owned rules which aren't attached to any
+// instance, nil if the provider can't find them.
+func (im *Registry) Orphans() ([]string, error) {
+	c, ok := im.provider.(provider.Collector)
+	if !ok {
+		return nil, nil
+	}
+	return c.Orphans()
+}
+
+// DeleteOrphan deletes the owned rules of the given name, found by Orphans.
+func (im *Registry) DeleteOrphan(name string) error {
+	c, ok := im.provider.(provider.Collector)
+	if !ok {
+		return nil
+	}
+	im.rulesCache = nil
+	return c.DeleteOrphan(name)
+}
+
+// Protocols returns the protocols of the rules the provider opens.
+func (im *Registry) Protocols() []string {
+	l, ok := im.provider.(provider.ProtocolLimiter)
+	if !ok {
+		return inbound.DefaultProtocols
+	}
+	return l.Protocols()
+}
+
+func hasChanges(changes *plan.Changes) bool {
+	return len(changes.Create) > 0 ||
+		len(changes.UpdateNew) > 0 ||
+		len(changes.Delete) > 0 ||
+		len(changes.Set) > 0 ||
+		len(changes.Unset) > 0
+}
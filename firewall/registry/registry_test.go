@@ -0,0 +1,139 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/openfresh/external-ips/firewall/history"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/firewall/plan"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type countingProvider struct {
+	rules      []*inbound.InboundRules
+	rulesCalls int
+}
+
+func (p *countingProvider) GetClusterName() (string, error) {
+	return "kube.openfresh.io", nil
+}
+
+func (p *countingProvider) Rules() ([]*inbound.InboundRules, error) {
+	p.rulesCalls++
+	return p.rules, nil
+}
+
+func (p *countingProvider) ApplyChanges(changes *plan.Changes) error {
+	return nil
+}
+
+func TestRulesCache(t *testing.T) {
+	p := &countingProvider{
+		rules: []*inbound.InboundRules{{Name: "foo.kube.openfresh.io"}},
+	}
+	r, err := NewRegistry(p, time.Hour)
+	require.NoError(t, err)
+
+	_, err = r.Rules()
+	require.NoError(t, err)
+	rules, err := r.Rules()
+	require.NoError(t, err)
+	assert.Equal(t, p.rules, rules)
+	assert.Equal(t, 1, p.rulesCalls)
+
+	// nothing to change keeps the cache
+	require.NoError(t, r.ApplyChanges(&plan.Changes{}))
+	_, err = r.Rules()
+	require.NoError(t, err)
+	assert.Equal(t, 1, p.rulesCalls)
+
+	// any change invalidates the cache
+	require.NoError(t, r.ApplyChanges(&plan.Changes{
+		Unset: []*plan.InstanceRule{{ProviderID: "aws:///us-east-1a/i-12345678", RulesName: "foo.kube.openfresh.io"}},
+	}))
+	_, err = r.Rules()
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.rulesCalls)
+}
+
+func TestRulesCacheDisabled(t *testing.T) {
+	p := &countingProvider{}
+	r, err := NewRegistry(p, 0)
+	require.NoError(t, err)
+
+	_, err = r.Rules()
+	require.NoError(t, err)
+	_, err = r.Rules()
+	require.NoError(t, err)
+	assert.Equal(t, 2, p.rulesCalls)
+}
+
+// savingStore counts the snapshots saved.
+type savingStore struct {
+	saved []*history.Snapshot
+}
+
+func (s *savingStore) Save(snapshot *history.Snapshot) error {
+	s.saved = append(s.saved, snapshot)
+	return nil
+}
+
+func (s *savingStore) At(t time.Time) (*history.Snapshot, error) {
+	return nil, history.ErrNoSnapshot
+}
+
+func TestRecordHistory(t *testing.T) {
+	store := &savingStore{}
+	r, err := NewRegistry(&countingProvider{}, 0, WithHistory(store))
+	require.NoError(t, err)
+
+	desired := []*inbound.InboundRules{{Name: "foo.kube.openfresh.io", Rules: []inbound.InboundRule{{Protocol: "tcp", Port: 80}}}}
+	require.NoError(t, r.Record(desired, time.Now()))
+	require.NoError(t, r.Record(desired, time.Now()))
+	assert.Len(t, store.saved, 1)
+
+	// a snapshot is only saved when the desired rules change
+	desired[0].Rules[0].Port = 443
+	require.NoError(t, r.Record(desired, time.Now()))
+	assert.Len(t, store.saved, 2)
+
+	// nothing is recorded without a history
+	r, err = NewRegistry(&countingProvider{}, 0)
+	require.NoError(t, err)
+	assert.NoError(t, r.Record(desired, time.Now()))
+}
+
+// syncingAccelerator records the rules synchronized.
+type syncingAccelerator struct {
+	synced [][]*inbound.InboundRules
+}
+
+func (a *syncingAccelerator) IPs() ([]string, error) {
+	return []string{"75.2.0.1"}, nil
+}
+
+func (a *syncingAccelerator) Sync(desired []*inbound.InboundRules) error {
+	a.synced = append(a.synced, desired)
+	return nil
+}
+
+func TestAccelerate(t *testing.T) {
+	a := &syncingAccelerator{}
+	r, err := NewRegistry(&countingProvider{}, 0, WithAccelerator(a))
+	require.NoError(t, err)
+
+	desired := []*inbound.InboundRules{{Name: "foo.kube.openfresh.io", AcceleratorAffinity: inbound.AcceleratorAffinityNone}}
+	require.NoError(t, r.Accelerate(desired))
+	assert.Equal(t, [][]*inbound.InboundRules{desired}, a.synced)
+
+	// nothing is accelerated without an accelerator
+	r, err = NewRegistry(&countingProvider{}, 0)
+	require.NoError(t, err)
+	assert.NoError(t, r.Accelerate(desired))
+}
@@ -0,0 +1,179 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/controller"
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	eipprovider "github.com/openfresh/external-ips/extip/provider"
+	eipregistry "github.com/openfresh/external-ips/extip/registry"
+	fwprovider "github.com/openfresh/external-ips/firewall/provider"
+	fwregistry "github.com/openfresh/external-ips/firewall/registry"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/source"
+)
+
+const (
+	zone        = "integration.example.org"
+	clusterName = "kube.integration.example.org"
+	externalIP  = "203.0.113.10"
+	internalIP  = "10.0.0.10"
+)
+
+// TestRunOnce tests that a full synchronization publishes the record, creates and
+// assigns the security group and sets the external IPs of an annotated service.
+func TestRunOnce(t *testing.T) {
+	api := startAPIServer(t)
+	defer api.Stop()
+	endpointURL, sess := localstack(t)
+
+	ec2Client := ec2.New(sess)
+	route53Client := route53.New(sess)
+
+	_, err := route53Client.CreateHostedZone(&route53.CreateHostedZoneInput{
+		Name:            aws.String(zone + "."),
+		CallerReference: aws.String(fmt.Sprintf("external-ips-%d", time.Now().UnixNano())),
+	})
+	require.NoError(t, err)
+
+	instanceID := runInstance(t, ec2Client)
+	_, err = api.Client.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "aws:///" + region + "a/" + instanceID},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: externalIP},
+				{Type: v1.NodeInternalIP, Address: internalIP},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = api.Client.CoreV1().Services("default").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Annotations: map[string]string{"external-ips.alpha.openfresh.github.io/hostname": "foo." + zone},
+		},
+		Spec: v1.ServiceSpec{
+			Type:  v1.ServiceTypeClusterIP,
+			Ports: []v1.ServicePort{{Name: "game", Protocol: v1.ProtocolUDP, Port: 5000}},
+		},
+	})
+	require.NoError(t, err)
+
+	ctrl, dnsProvider := newController(t, api, endpointURL)
+	require.NoError(t, ctrl.RunOnce())
+
+	records, err := dnsProvider.Records()
+	require.NoError(t, err)
+	var found *endpoint.Endpoint
+	for _, r := range records {
+		if r.DNSName == "foo."+zone && r.RecordType == endpoint.RecordTypeA {
+			found = r
+		}
+	}
+	require.NotNil(t, found, "no A record for foo.%s in %v", zone, records)
+	assert.Equal(t, endpoint.Targets{externalIP}, found.Targets)
+
+	groups, err := ec2Client.DescribeSecurityGroups(&ec2.DescribeSecurityGroupsInput{
+		Filters: []*ec2.Filter{{Name: aws.String("group-name"), Values: []*string{aws.String("foo." + clusterName)}}},
+	})
+	require.NoError(t, err)
+	require.Len(t, groups.SecurityGroups, 1)
+	require.Len(t, groups.SecurityGroups[0].IpPermissions, 1)
+	assert.Equal(t, "udp", aws.StringValue(groups.SecurityGroups[0].IpPermissions[0].IpProtocol))
+	assert.Equal(t, int64(5000), aws.Int64Value(groups.SecurityGroups[0].IpPermissions[0].FromPort))
+
+	svc, err := api.Client.CoreV1().Services("default").Get("foo", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{internalIP}, svc.Spec.ExternalIPs)
+
+	// a second synchronization has nothing left to do
+	require.NoError(t, ctrl.RunOnce())
+}
+
+// runInstance runs an instance of the cluster, with the first image localstack knows.
+func runInstance(t *testing.T, client *ec2.EC2) string {
+	images, err := client.DescribeImages(&ec2.DescribeImagesInput{})
+	require.NoError(t, err)
+	require.NotEmpty(t, images.Images, "localstack has no image to run an instance with")
+
+	reservation, err := client.RunInstances(&ec2.RunInstancesInput{
+		ImageId:  images.Images[0].ImageId,
+		MinCount: aws.Int64(1),
+		MaxCount: aws.Int64(1),
+		TagSpecifications: []*ec2.TagSpecification{
+			{
+				ResourceType: aws.String(ec2.ResourceTypeInstance),
+				Tags:         []*ec2.Tag{{Key: aws.String("KubernetesCluster"), Value: aws.String(clusterName)}},
+			},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, reservation.Instances, 1)
+	return aws.StringValue(reservation.Instances[0].InstanceId)
+}
+
+// newController wires the controller as main does, against the API server and localstack.
+func newController(t *testing.T, api *apiServer, endpointURL string) (*controller.Controller, provider.Provider) {
+	stopChan := make(chan struct{})
+	nodeCache := node.NewCache(api.Client, 0)
+	require.NoError(t, nodeCache.Run(stopChan))
+
+	fwp, err := fwprovider.NewAWSProvider(fwprovider.AWSConfig{Endpoint: endpointURL}, nodeCache)
+	require.NoError(t, err)
+	clusterName, err := fwp.GetClusterName()
+	require.NoError(t, err)
+
+	// the source is built from its config as main does, to follow the changes of its arguments
+	src, err := source.BuildWithConfig("service", api, &source.Config{DomainFilter: []string{zone}}, clusterName, nodeCache, nil)
+	require.NoError(t, err)
+
+	dnsProvider, err := provider.NewAWSProvider(provider.AWSConfig{
+		DomainFilter:   provider.NewDomainFilter([]string{zone}),
+		ZoneIDFilter:   provider.NewZoneIDFilter([]string{}),
+		ZoneTypeFilter: provider.NewZoneTypeFilter(""),
+		MaxChangeCount: 4000,
+		Endpoint:       endpointURL,
+	})
+	require.NoError(t, err)
+	r, err := registry.NewTXTRegistry(dnsProvider, "", "integration", nil, 0, nil, "")
+	require.NoError(t, err)
+
+	fwr, err := fwregistry.NewRegistry(fwp, 0)
+	require.NoError(t, err)
+
+	eipp, err := eipprovider.NewProvider(api.Client, eipprovider.Config{})
+	require.NoError(t, err)
+	eipr, err := eipregistry.NewRegistry(eipp)
+	require.NoError(t, err)
+
+	return &controller.Controller{
+		Source:      src,
+		Registry:    r,
+		FwRegistry:  fwr,
+		EipRegistry: eipr,
+		Nodes:       nodeCache,
+		Policy:      &plan.SyncPolicy{},
+	}, dnsProvider
+}
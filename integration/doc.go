@@ -0,0 +1,13 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package integration runs the controller against a real Kubernetes API server
+// and localstack, rather than the stubs of the unit tests. Its tests are only
+// built with the integration tag:
+//
+//	KUBEBUILDER_ASSETS=/usr/local/kubebuilder/bin LOCALSTACK_ENDPOINT=http://localhost:4566 go test -tags integration ./integration/...
+//
+// KUBEBUILDER_ASSETS must contain the etcd and kube-apiserver binaries, in a
+// version still serving the insecure port (1.19 at most), and localstack must
+// run the route53 and ec2 services.
+package integration
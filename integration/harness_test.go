@@ -0,0 +1,158 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+//go:build integration
+// +build integration
+
+package integration
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+const (
+	// how long etcd and the API server may take to become healthy
+	startTimeout = time.Minute
+	// the region of the localstack services
+	region = "us-east-1"
+)
+
+// apiServer is an etcd and a kube-apiserver run from the binaries of
+// $KUBEBUILDER_ASSETS, like envtest does.
+type apiServer struct {
+	dir       string
+	etcd      *exec.Cmd
+	apiserver *exec.Cmd
+
+	Client kubernetes.Interface
+}
+
+// KubeClient returns the client of the API server, for the sources to be built
+// with it as with the client of the command line.
+func (s *apiServer) KubeClient() (kubernetes.Interface, error) {
+	return s.Client, nil
+}
+
+// startAPIServer starts an API server backed by its own etcd, skipping the test
+// if $KUBEBUILDER_ASSETS isn't set.
+func startAPIServer(t *testing.T) *apiServer {
+	assets := os.Getenv("KUBEBUILDER_ASSETS")
+	if assets == "" {
+		t.Skip("KUBEBUILDER_ASSETS isn't set")
+	}
+
+	dir, err := ioutil.TempDir("", "external-ips-integration")
+	require.NoError(t, err)
+	s := &apiServer{dir: dir}
+
+	etcdURL := fmt.Sprintf("http://127.0.0.1:%d", freePort(t))
+	s.etcd = exec.Command(filepath.Join(assets, "etcd"),
+		"--data-dir="+filepath.Join(dir, "etcd"),
+		"--listen-client-urls="+etcdURL,
+		"--advertise-client-urls="+etcdURL,
+		fmt.Sprintf("--listen-peer-urls=http://127.0.0.1:%d", freePort(t)),
+	)
+	s.start(t, s.etcd, etcdURL+"/health")
+
+	apiPort := freePort(t)
+	apiURL := fmt.Sprintf("http://127.0.0.1:%d", apiPort)
+	s.apiserver = exec.Command(filepath.Join(assets, "kube-apiserver"),
+		"--etcd-servers="+etcdURL,
+		"--cert-dir="+filepath.Join(dir, "certs"),
+		"--insecure-bind-address=127.0.0.1",
+		fmt.Sprintf("--insecure-port=%d", apiPort),
+		fmt.Sprintf("--secure-port=%d", freePort(t)),
+		"--service-cluster-ip-range=10.0.0.0/24",
+		"--admission-control=AlwaysAdmit",
+	)
+	s.start(t, s.apiserver, apiURL+"/healthz")
+
+	s.Client, err = kubernetes.NewForConfig(&rest.Config{Host: apiURL})
+	if err != nil {
+		s.Stop()
+		require.NoError(t, err)
+	}
+	return s
+}
+
+// start runs the command until healthURL responds, stopping everything if it never does.
+func (s *apiServer) start(t *testing.T, cmd *exec.Cmd, healthURL string) {
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		s.Stop()
+		require.NoError(t, err)
+	}
+
+	deadline := time.Now().Add(startTimeout)
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(healthURL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	s.Stop()
+	t.Fatalf("%s didn't become healthy within %s", cmd.Path, startTimeout)
+}
+
+// Stop kills the API server and etcd and removes their data.
+func (s *apiServer) Stop() {
+	for _, cmd := range []*exec.Cmd{s.apiserver, s.etcd} {
+		if cmd == nil || cmd.Process == nil {
+			continue
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	os.RemoveAll(s.dir)
+}
+
+// freePort returns a local TCP port nothing listens on.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// localstack returns the endpoint of localstack and a session connected to it,
+// skipping the test if $LOCALSTACK_ENDPOINT isn't set.
+func localstack(t *testing.T) (string, *session.Session) {
+	endpoint := os.Getenv("LOCALSTACK_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("LOCALSTACK_ENDPOINT isn't set")
+	}
+
+	// localstack accepts any credentials, the providers read them from the environment
+	for key, value := range map[string]string{
+		"AWS_ACCESS_KEY_ID":     "test",
+		"AWS_SECRET_ACCESS_KEY": "test",
+		"AWS_REGION":            region,
+	} {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, value)
+		}
+	}
+
+	sess, err := session.NewSession(aws.NewConfig().WithEndpoint(endpoint).WithRegion(region))
+	require.NoError(t, err)
+	return endpoint, sess
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/permissions"
+)
+
+const (
+	// AutoScalingGroupLabelKey is the label holding the autoscaling group of the nodes listed from EC2
+	AutoScalingGroupLabelKey = "external-ips.alpha.openfresh.github.io/autoscaling-group"
+	// the number of instances described per request
+	describeInstancesBatchSize = 100
+)
+
+// AutoScalingAPI is the subset of the AWS Auto Scaling API that we actually use.  Add methods as required. Signatures must match exactly.
+type AutoScalingAPI interface {
+	DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error
+}
+
+// ASGEC2API is the subset of the AWS EC2 API used to describe the instances of the autoscaling groups.
+type ASGEC2API interface {
+	DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error
+}
+
+// ASGPermissions returns the IAM policy statements required by the autoscaling group lister.
+func ASGPermissions() []permissions.Statement {
+	return []permissions.Statement{
+		{
+			Effect: permissions.EffectAllow,
+			Action: append(
+				permissions.Actions("autoscaling", (*AutoScalingAPI)(nil)),
+				permissions.Actions("ec2", (*ASGEC2API)(nil))...,
+			),
+			Resource: []string{permissions.AnyResource},
+		},
+	}
+}
+
+// ASGConfig contains the settings of the autoscaling group lister.
+type ASGConfig struct {
+	// The tags of the autoscaling groups, as key=value or key for any value
+	Tags       []string
+	AssumeRole string
+	// Overrides the region of the AWS configuration
+	Region string
+	// How long the instances listed are reused
+	Interval time.Duration
+}
+
+// asgLister is a Lister listing the in service instances of the EC2 autoscaling
+// groups with the given tags as nodes, for the instances serving outside of
+// Kubernetes, e.g. game servers, or not joined to the cluster yet. The nodes are
+// named after the private DNS name of their instance and labelled with its tags.
+type asgLister struct {
+	autoscaling AutoScalingAPI
+	ec2         ASGEC2API
+	tags        map[string]string
+	interval    time.Duration
+	now         func() time.Time
+
+	mu       sync.Mutex
+	nodes    []*v1.Node
+	listedAt time.Time
+}
+
+// NewASGLister returns a Lister listing the instances of the autoscaling groups
+// with the configured tags as nodes.
+func NewASGLister(config ASGConfig) (Lister, error) {
+	tags, err := parseASGTags(config.Tags)
+	if err != nil {
+		return nil, err
+	}
+
+	awsConfig := aws.NewConfig()
+	if config.Region != "" {
+		awsConfig.WithRegion(config.Region)
+	}
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if config.AssumeRole != "" {
+		log.Infof("Assuming role: %s", config.AssumeRole)
+		session.Config.WithCredentials(stscreds.NewCredentials(session, config.AssumeRole))
+	}
+
+	return newASGLister(autoscaling.New(session), ec2.New(session), tags, config.Interval), nil
+}
+
+func newASGLister(autoscaling AutoScalingAPI, ec2 ASGEC2API, tags map[string]string, interval time.Duration) *asgLister {
+	return &asgLister{
+		autoscaling: autoscaling,
+		ec2:         ec2,
+		tags:        tags,
+		interval:    interval,
+		now:         time.Now,
+	}
+}
+
+// parseASGTags parses the key=value tags, an empty value matching any value.
+func parseASGTags(tags []string) (map[string]string, error) {
+	result := make(map[string]string, len(tags))
+	for _, t := range tags {
+		if t == "" {
+			continue
+		}
+		kv := strings.SplitN(t, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid autoscaling group tag %q, expected key=value or key", t)
+		}
+		if len(kv) == 1 {
+			result[kv[0]] = ""
+			continue
+		}
+		result[kv[0]] = kv[1]
+	}
+	if len(result) == 0 {
+		return nil, errors.New("no autoscaling group tag")
+	}
+	return result, nil
+}
+
+// List returns the instances of the autoscaling groups as nodes, listing them
+// again once the instances last listed are older than the interval.
+func (l *asgLister) List() ([]*v1.Node, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if l.nodes == nil || now.Sub(l.listedAt) >= l.interval {
+		nodes, err := l.list()
+		if err != nil {
+			return nil, err
+		}
+		l.nodes = nodes
+		l.listedAt = now
+	}
+
+	// callers may sort the result, keep the listed nodes intact
+	nodes := make([]*v1.Node, len(l.nodes))
+	copy(nodes, l.nodes)
+	return nodes, nil
+}
+
+func (l *asgLister) list() ([]*v1.Node, error) {
+	// the autoscaling group of the in service instances, by instance ID
+	groups := map[string]string{}
+	err := l.autoscaling.DescribeAutoScalingGroupsPages(&autoscaling.DescribeAutoScalingGroupsInput{},
+		func(page *autoscaling.DescribeAutoScalingGroupsOutput, lastPage bool) bool {
+			for _, g := range page.AutoScalingGroups {
+				if !l.matches(g.Tags) {
+					continue
+				}
+				for _, i := range g.Instances {
+					if aws.StringValue(i.LifecycleState) != autoscaling.LifecycleStateInService {
+						continue
+					}
+					groups[aws.StringValue(i.InstanceId)] = aws.StringValue(g.AutoScalingGroupName)
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the autoscaling groups: %v", err)
+	}
+
+	instanceIDs := make([]string, 0, len(groups))
+	for id := range groups {
+		instanceIDs = append(instanceIDs, id)
+	}
+	sort.Strings(instanceIDs)
+
+	nodes := make([]*v1.Node, 0, len(instanceIDs))
+	for start := 0; start < len(instanceIDs); start += describeInstancesBatchSize {
+		end := start + describeInstancesBatchSize
+		if end > len(instanceIDs) {
+			end = len(instanceIDs)
+		}
+		err := l.ec2.DescribeInstancesPages(&ec2.DescribeInstancesInput{InstanceIds: aws.StringSlice(instanceIDs[start:end])},
+			func(page *ec2.DescribeInstancesOutput, lastPage bool) bool {
+				for _, r := range page.Reservations {
+					for _, i := range r.Instances {
+						if i.State == nil || aws.StringValue(i.State.Name) != ec2.InstanceStateNameRunning {
+							continue
+						}
+						nodes = append(nodes, newASGNode(i, groups[aws.StringValue(i.InstanceId)]))
+					}
+				}
+				return true
+			})
+		if err != nil {
+			return nil, fmt.Errorf("failed to describe the instances of the autoscaling groups: %v", err)
+		}
+	}
+	log.Debugf("Listed %d instances of autoscaling groups", len(nodes))
+	return nodes, nil
+}
+
+// matches returns whether the tags of an autoscaling group hold all the configured tags.
+func (l *asgLister) matches(tags []*autoscaling.TagDescription) bool {
+	found := 0
+	for _, t := range tags {
+		value, ok := l.tags[aws.StringValue(t.Key)]
+		if !ok {
+			continue
+		}
+		if value == "" || value == aws.StringValue(t.Value) {
+			found++
+		}
+	}
+	return found == len(l.tags)
+}
+
+// newASGNode returns the node of an instance of the autoscaling group, labelled
+// with the tags of the instance which are valid labels.
+func newASGNode(i *ec2.Instance, group string) *v1.Node {
+	name := aws.StringValue(i.PrivateDnsName)
+	if name == "" {
+		name = aws.StringValue(i.InstanceId)
+	}
+	zone := ""
+	if i.Placement != nil {
+		zone = aws.StringValue(i.Placement.AvailabilityZone)
+	}
+	n := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              name,
+			Labels:            map[string]string{},
+			CreationTimestamp: metav1.NewTime(aws.TimeValue(i.LaunchTime)),
+		},
+		Spec: v1.NodeSpec{
+			ProviderID: fmt.Sprintf("aws:///%s/%s", zone, aws.StringValue(i.InstanceId)),
+		},
+	}
+	for _, t := range i.Tags {
+		key, value := aws.StringValue(t.Key), aws.StringValue(t.Value)
+		if len(validation.IsQualifiedName(key)) > 0 || len(validation.IsValidLabelValue(value)) > 0 {
+			continue
+		}
+		n.Labels[key] = value
+	}
+	if len(validation.IsValidLabelValue(group)) == 0 {
+		n.Labels[AutoScalingGroupLabelKey] = group
+	}
+	if ip := aws.StringValue(i.PublicIpAddress); ip != "" {
+		n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeExternalIP, Address: ip})
+	}
+	if ip := aws.StringValue(i.PrivateIpAddress); ip != "" {
+		n.Status.Addresses = append(n.Status.Addresses, v1.NodeAddress{Type: v1.NodeInternalIP, Address: ip})
+	}
+	return n
+}
+
+// multiLister is a Lister listing the nodes of several listers.
+type multiLister struct {
+	listers []Lister
+}
+
+// NewMultiLister returns a Lister listing the nodes of all the listers. The nodes
+// of the same instance are listed once, as listed by the first lister, so that
+// the instances joining the cluster are listed as the nodes of the cluster.
+func NewMultiLister(listers ...Lister) Lister {
+	return &multiLister{listers: listers}
+}
+
+// List returns the nodes of the listers without the duplicated instances.
+func (l *multiLister) List() ([]*v1.Node, error) {
+	seen := map[string]bool{}
+	result := []*v1.Node{}
+	for _, lister := range l.listers {
+		nodes, err := lister.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range nodes {
+			key := instanceKey(n)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			result = append(result, n)
+		}
+	}
+	return result, nil
+}
+
+// instanceKey identifies the instance of a node, whatever the format of its providerID.
+func instanceKey(n *v1.Node) string {
+	if n.Spec.ProviderID == "" {
+		return "node/" + n.Name
+	}
+	id, err := ParseProviderID(n.Spec.ProviderID)
+	if err != nil {
+		return n.Spec.ProviderID
+	}
+	return id.Scheme + "/" + id.InstanceID
+}
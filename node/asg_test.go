@@ -0,0 +1,136 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/autoscaling"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeAutoScaling struct {
+	groups []*autoscaling.Group
+	calls  int
+}
+
+func (f *fakeAutoScaling) DescribeAutoScalingGroupsPages(input *autoscaling.DescribeAutoScalingGroupsInput, fn func(*autoscaling.DescribeAutoScalingGroupsOutput, bool) bool) error {
+	f.calls++
+	fn(&autoscaling.DescribeAutoScalingGroupsOutput{AutoScalingGroups: f.groups}, true)
+	return nil
+}
+
+type fakeASGEC2 struct {
+	instances map[string]*ec2.Instance
+}
+
+func (f *fakeASGEC2) DescribeInstancesPages(input *ec2.DescribeInstancesInput, fn func(*ec2.DescribeInstancesOutput, bool) bool) error {
+	reservation := &ec2.Reservation{}
+	for _, id := range input.InstanceIds {
+		if i, ok := f.instances[aws.StringValue(id)]; ok {
+			reservation.Instances = append(reservation.Instances, i)
+		}
+	}
+	fn(&ec2.DescribeInstancesOutput{Reservations: []*ec2.Reservation{reservation}}, true)
+	return nil
+}
+
+func newASGInstance(id, state string) *ec2.Instance {
+	return &ec2.Instance{
+		InstanceId:       aws.String(id),
+		State:            &ec2.InstanceState{Name: aws.String(state)},
+		Placement:        &ec2.Placement{AvailabilityZone: aws.String("us-east-1a")},
+		PrivateDnsName:   aws.String(id + ".ec2.internal"),
+		PrivateIpAddress: aws.String("10.0.0.1"),
+		PublicIpAddress:  aws.String("1.2.3.4"),
+		LaunchTime:       aws.Time(time.Unix(1000, 0)),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("role"), Value: aws.String("game-server")},
+			{Key: aws.String("Name"), Value: aws.String("game server")},
+		},
+	}
+}
+
+func TestParseASGTags(t *testing.T) {
+	tags, err := parseASGTags([]string{"role=game-server", "external-ips", ""})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"role": "game-server", "external-ips": ""}, tags)
+
+	_, err = parseASGTags([]string{"=value"})
+	assert.Error(t, err)
+	_, err = parseASGTags([]string{""})
+	assert.Error(t, err)
+}
+
+func TestASGLister(t *testing.T) {
+	as := &fakeAutoScaling{groups: []*autoscaling.Group{
+		{
+			AutoScalingGroupName: aws.String("game-servers"),
+			Tags:                 []*autoscaling.TagDescription{{Key: aws.String("role"), Value: aws.String("game-server")}},
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("i-1"), LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+				{InstanceId: aws.String("i-2"), LifecycleState: aws.String(autoscaling.LifecycleStatePending)},
+				{InstanceId: aws.String("i-3"), LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+			},
+		},
+		{
+			AutoScalingGroupName: aws.String("web"),
+			Tags:                 []*autoscaling.TagDescription{{Key: aws.String("role"), Value: aws.String("web")}},
+			Instances: []*autoscaling.Instance{
+				{InstanceId: aws.String("i-4"), LifecycleState: aws.String(autoscaling.LifecycleStateInService)},
+			},
+		},
+	}}
+	client := &fakeASGEC2{instances: map[string]*ec2.Instance{
+		"i-1": newASGInstance("i-1", ec2.InstanceStateNameRunning),
+		"i-2": newASGInstance("i-2", ec2.InstanceStateNameRunning),
+		"i-3": newASGInstance("i-3", ec2.InstanceStateNameStopping),
+		"i-4": newASGInstance("i-4", ec2.InstanceStateNameRunning),
+	}}
+	l := newASGLister(as, client, map[string]string{"role": "game-server"}, time.Minute)
+	now := time.Unix(2000, 0)
+	l.now = func() time.Time { return now }
+
+	nodes, err := l.List()
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	n := nodes[0]
+	assert.Equal(t, "i-1.ec2.internal", n.Name)
+	assert.Equal(t, "aws:///us-east-1a/i-1", n.Spec.ProviderID)
+	assert.Equal(t, map[string]string{"role": "game-server", AutoScalingGroupLabelKey: "game-servers"}, n.Labels)
+	assert.Equal(t, []v1.NodeAddress{
+		{Type: v1.NodeExternalIP, Address: "1.2.3.4"},
+		{Type: v1.NodeInternalIP, Address: "10.0.0.1"},
+	}, n.Status.Addresses)
+	assert.Equal(t, time.Unix(1000, 0), n.CreationTimestamp.Time)
+
+	// the instances are reused within the interval
+	_, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, 1, as.calls)
+
+	now = now.Add(time.Minute)
+	_, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, 2, as.calls)
+}
+
+func TestMultiLister(t *testing.T) {
+	joined := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "joined"}, Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-1"}}
+	asgJoined := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "i-1.ec2.internal"}, Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-1"}}
+	asgOnly := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "i-2.ec2.internal"}, Spec: v1.NodeSpec{ProviderID: "aws:///us-east-1a/i-2"}}
+	// a bare instance id is the same instance
+	bare := &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "bare"}, Spec: v1.NodeSpec{ProviderID: "i-2"}}
+
+	nodes, err := NewMultiLister(&staticLister{nodes: []*v1.Node{joined}}, &staticLister{nodes: []*v1.Node{asgJoined, asgOnly, bare}}).List()
+	require.NoError(t, err)
+	assert.Equal(t, []*v1.Node{joined, asgOnly}, nodes)
+}
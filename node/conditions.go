@@ -0,0 +1,38 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// pressureConditions are the conditions of the nodes short of a resource, which
+// still serve their traffic but are better left out of the services when others can.
+var pressureConditions = []v1.NodeConditionType{v1.NodeDiskPressure, v1.NodeMemoryPressure}
+
+// hasCondition returns whether the condition of the given type is true on the node.
+func hasCondition(n *v1.Node, conditionType v1.NodeConditionType) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == conditionType {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// IsNetworkUnavailable returns whether the network of the node isn't configured,
+// in which case it can't be reached on its addresses.
+func IsNetworkUnavailable(n *v1.Node) bool {
+	return hasCondition(n, v1.NodeNetworkUnavailable)
+}
+
+// Pressure returns the first pressure condition true on the node, empty if none is.
+func Pressure(n *v1.Node) v1.NodeConditionType {
+	for _, conditionType := range pressureConditions {
+		if hasCondition(n, conditionType) {
+			return conditionType
+		}
+	}
+	return ""
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditions(t *testing.T) {
+	healthy := &v1.Node{Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+		{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionFalse},
+		{Type: v1.NodeDiskPressure, Status: v1.ConditionFalse},
+	}}}
+	assert.False(t, IsNetworkUnavailable(healthy))
+	assert.Empty(t, Pressure(healthy))
+	assert.False(t, IsNetworkUnavailable(&v1.Node{}))
+
+	unhealthy := &v1.Node{Status: v1.NodeStatus{Conditions: []v1.NodeCondition{
+		{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue},
+		{Type: v1.NodeMemoryPressure, Status: v1.ConditionTrue},
+	}}}
+	assert.True(t, IsNetworkUnavailable(unhealthy))
+	assert.Equal(t, v1.NodeMemoryPressure, Pressure(unhealthy))
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// DrainingKey is the annotation or taint key marking a node about to be removed,
+// e.g. by a node termination handler reacting to a spot interruption notice.
+const DrainingKey = "external-ips.alpha.openfresh.github.io/draining"
+
+// IsDraining returns whether the node is marked to be removed by the draining annotation or taint.
+func IsDraining(n *v1.Node) bool {
+	if _, ok := n.Annotations[DrainingKey]; ok {
+		return true
+	}
+	for _, taint := range n.Spec.Taints {
+		if taint.Key == DrainingKey {
+			return true
+		}
+	}
+	return false
+}
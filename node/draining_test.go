@@ -0,0 +1,23 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsDraining(t *testing.T) {
+	assert.False(t, IsDraining(&v1.Node{}))
+	assert.True(t, IsDraining(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{DrainingKey: "true"}},
+	}))
+	assert.True(t, IsDraining(&v1.Node{
+		Spec: v1.NodeSpec{Taints: []v1.Taint{{Key: DrainingKey, Effect: v1.TaintEffectNoSchedule}}},
+	}))
+}
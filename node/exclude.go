@@ -0,0 +1,126 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// Exclusions are the labels and instance tags of the nodes never exposed, e.g. the
+// nodes dedicated to CI, by key. An empty value matches any value.
+type Exclusions map[string]string
+
+// ParseExclusions parses the key=value exclusions, an empty value matching any
+// value. It returns nil if there is none.
+func ParseExclusions(values []string) (Exclusions, error) {
+	var result Exclusions
+	for _, v := range values {
+		if v == "" {
+			continue
+		}
+		kv := strings.SplitN(v, "=", 2)
+		if kv[0] == "" {
+			return nil, fmt.Errorf("invalid node exclusion %q, expected key=value or key", v)
+		}
+		if result == nil {
+			result = Exclusions{}
+		}
+		if len(kv) == 1 {
+			result[kv[0]] = ""
+		} else {
+			result[kv[0]] = kv[1]
+		}
+	}
+	return result, nil
+}
+
+// match returns the first exclusion, in the order of the keys, matched by the
+// labels or tags as key=value or key.
+func (e Exclusions) match(values map[string]string) (string, bool) {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := values[k]
+		if !ok || (e[k] != "" && e[k] != v) {
+			continue
+		}
+		if e[k] == "" {
+			return k, true
+		}
+		return k + "=" + v, true
+	}
+	return "", false
+}
+
+// Excludes returns whether the node is excluded by its labels or by the tags of
+// its instance, nil if unknown, along with the reason of its exclusion.
+func (e Exclusions) Excludes(n *v1.Node, tags map[string]string) (string, bool) {
+	if m, ok := e.match(n.Labels); ok {
+		return "label " + m, true
+	}
+	if m, ok := e.match(tags); ok {
+		return "instance tag " + m, true
+	}
+	return "", false
+}
+
+// Excluded returns the reason of the exclusion of the excluded nodes, by providerID.
+// The tags of the instances are given by providerID, nil if unknown.
+func (e Exclusions) Excluded(nodes []*v1.Node, tags map[string]map[string]string) map[string]string {
+	result := map[string]string{}
+	for _, n := range nodes {
+		if reason, ok := e.Excludes(n, tags[n.Spec.ProviderID]); ok {
+			result[n.Spec.ProviderID] = reason
+		}
+	}
+	return result
+}
+
+// excludingLister is a Lister leaving out the excluded nodes.
+type excludingLister struct {
+	lister     Lister
+	exclusions Exclusions
+	tags       func() map[string]map[string]string
+}
+
+// NewExcludingLister returns a Lister listing the nodes of lister but the ones excluded
+// by their labels or by the tags of their instance, given by providerID by tags, nil
+// if the tags of the instances aren't known.
+func NewExcludingLister(lister Lister, exclusions Exclusions, tags func() map[string]map[string]string) Lister {
+	return &excludingLister{
+		lister:     lister,
+		exclusions: exclusions,
+		tags:       tags,
+	}
+}
+
+// List returns the nodes of the lister which aren't excluded.
+func (l *excludingLister) List() ([]*v1.Node, error) {
+	nodes, err := l.lister.List()
+	if err != nil {
+		return nil, err
+	}
+	var tags map[string]map[string]string
+	if l.tags != nil {
+		tags = l.tags()
+	}
+	result := make([]*v1.Node, 0, len(nodes))
+	for _, n := range nodes {
+		if reason, ok := l.exclusions.Excludes(n, tags[n.Spec.ProviderID]); ok {
+			log.Debugf("Leaving out node %s excluded by its %s", n.Name, reason)
+			continue
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseExclusions(t *testing.T) {
+	exclusions, err := ParseExclusions([]string{"dedicated=ci", "spot", ""})
+	require.NoError(t, err)
+	assert.Equal(t, Exclusions{"dedicated": "ci", "spot": ""}, exclusions)
+
+	exclusions, err = ParseExclusions([]string{""})
+	require.NoError(t, err)
+	assert.Nil(t, exclusions)
+
+	_, err = ParseExclusions([]string{"=ci"})
+	assert.Error(t, err)
+}
+
+func TestExcludingLister(t *testing.T) {
+	exclusions := Exclusions{"dedicated": "ci", "spot": ""}
+
+	labeled := newNode("i-1")
+	labeled.Labels = map[string]string{"dedicated": "ci"}
+	other := newNode("i-2")
+	other.Labels = map[string]string{"dedicated": "game"}
+	tagged := newNode("i-3")
+	tags := map[string]map[string]string{tagged.Spec.ProviderID: {"spot": "true"}}
+
+	reason, ok := exclusions.Excludes(labeled, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "label dedicated=ci", reason)
+	_, ok = exclusions.Excludes(other, nil)
+	assert.False(t, ok)
+	reason, ok = exclusions.Excludes(tagged, tags[tagged.Spec.ProviderID])
+	assert.True(t, ok)
+	assert.Equal(t, "instance tag spot", reason)
+
+	assert.Equal(t, map[string]string{
+		labeled.Spec.ProviderID: "label dedicated=ci",
+		tagged.Spec.ProviderID:  "instance tag spot",
+	}, exclusions.Excluded([]*v1.Node{labeled, other, tagged}, tags))
+
+	inner := &staticLister{nodes: []*v1.Node{labeled, other, tagged}}
+	nodes, err := NewExcludingLister(inner, exclusions, func() map[string]map[string]string { return tags }).List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-2"}, names(nodes))
+
+	// the instance tags aren't known without the lookup
+	nodes, err = NewExcludingLister(inner, exclusions, nil).List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-2", "i-3"}, names(nodes))
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+// graceLister is a Lister which keeps listing the nodes gone from the API server
+// for a grace period, so that a node briefly missing, e.g. on an API server hiccup,
+// doesn't churn the external IPs and records published on it. The nodes being
+// deleted, with a deletion timestamp, are dropped at once.
+type graceLister struct {
+	lister Lister
+	grace  time.Duration
+	now    func() time.Time
+
+	mu sync.Mutex
+	// the last copy of the nodes listed and when they were last listed, by name
+	seen map[string]seenNode
+}
+
+type seenNode struct {
+	node *v1.Node
+	at   time.Time
+}
+
+// NewGraceLister returns a Lister listing the nodes of lister, and the nodes it
+// stopped listing for up to grace since it last listed them.
+func NewGraceLister(lister Lister, grace time.Duration) Lister {
+	return &graceLister{
+		lister: lister,
+		grace:  grace,
+		now:    time.Now,
+		seen:   map[string]seenNode{},
+	}
+}
+
+// List returns the nodes of the lister not being deleted, along with the nodes
+// missing from it within their grace period.
+func (l *graceLister) List() ([]*v1.Node, error) {
+	nodes, err := l.lister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	listed := make(map[string]bool, len(nodes))
+	result := make([]*v1.Node, 0, len(nodes))
+	for _, n := range nodes {
+		listed[n.Name] = true
+		if n.DeletionTimestamp != nil {
+			delete(l.seen, n.Name)
+			continue
+		}
+		l.seen[n.Name] = seenNode{node: n, at: now}
+		result = append(result, n)
+	}
+	var missing []string
+	for name := range l.seen {
+		if !listed[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		s := l.seen[name]
+		if now.Sub(s.at) >= l.grace {
+			log.Infof("Node %s is gone for %s, dropping it", name, l.grace)
+			delete(l.seen, name)
+			continue
+		}
+		log.Debugf("Node %s is missing since %s, keeping it for its grace period", name, s.at.Format(time.RFC3339))
+		result = append(result, s.node)
+	}
+	return result, nil
+}
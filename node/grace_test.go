@@ -0,0 +1,71 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// staticLister lists the given nodes.
+type staticLister struct {
+	nodes []*v1.Node
+}
+
+func (l *staticLister) List() ([]*v1.Node, error) {
+	return l.nodes, nil
+}
+
+func names(nodes []*v1.Node) []string {
+	result := []string{}
+	for _, n := range nodes {
+		result = append(result, n.Name)
+	}
+	return result
+}
+
+func TestGraceLister(t *testing.T) {
+	now := time.Now()
+	inner := &staticLister{nodes: []*v1.Node{newNode("i-1"), newNode("i-2"), newNode("i-3")}}
+	l := NewGraceLister(inner, time.Minute).(*graceLister)
+	l.now = func() time.Time { return now }
+
+	nodes, err := l.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-1", "i-2", "i-3"}, names(nodes))
+
+	// a node missing from the API server is kept for the grace period
+	deleting := newNode("i-3")
+	deleting.DeletionTimestamp = &metav1.Time{Time: now}
+	inner.nodes = []*v1.Node{newNode("i-1"), deleting}
+	now = now.Add(30 * time.Second)
+	nodes, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-1", "i-2"}, names(nodes), "the node being deleted should be dropped at once")
+
+	// it's back before the end of the grace period
+	inner.nodes = []*v1.Node{newNode("i-1"), newNode("i-2")}
+	now = now.Add(20 * time.Second)
+	nodes, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-1", "i-2"}, names(nodes))
+
+	// the grace period starts over from when it was last listed
+	inner.nodes = []*v1.Node{newNode("i-1")}
+	now = now.Add(59 * time.Second)
+	nodes, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-1", "i-2"}, names(nodes))
+
+	now = now.Add(time.Second)
+	nodes, err = l.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i-1"}, names(nodes))
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Lister lists the nodes of the cluster.
+type Lister interface {
+	List() ([]*v1.Node, error)
+}
+
+// clientLister is a Lister querying the API server on every call.
+type clientLister struct {
+	client kubernetes.Interface
+}
+
+// NewClientLister returns a Lister which lists the nodes from the API server on every call.
+func NewClientLister(client kubernetes.Interface) Lister {
+	return &clientLister{client: client}
+}
+
+// List returns the nodes currently known to the API server.
+func (l *clientLister) List() ([]*v1.Node, error) {
+	nodes, err := l.client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	result := make([]*v1.Node, 0, len(nodes.Items))
+	for i := range nodes.Items {
+		result = append(result, &nodes.Items[i])
+	}
+	return result, nil
+}
+
+// Cache is a Lister backed by a shared node informer.
+// List returns the snapshot taken by the last call to Refresh, so that every
+// consumer sees the same set of nodes within a synchronization.
+type Cache struct {
+	factory  informers.SharedInformerFactory
+	informer cache.SharedIndexInformer
+	lister   corelisters.NodeLister
+
+	mu       sync.RWMutex
+	snapshot []*v1.Node
+}
+
+// NewCache creates a node Cache using the given client. Run must be called
+// before the cache is used.
+func NewCache(client kubernetes.Interface, resync time.Duration) *Cache {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	nodes := factory.Core().V1().Nodes()
+
+	return &Cache{
+		factory:  factory,
+		informer: nodes.Informer(),
+		lister:   nodes.Lister(),
+	}
+}
+
+// OnDraining registers f to be called when a node starts draining, e.g. after a
+// spot interruption notice. It must be called before Run.
+func (c *Cache) OnDraining(f func(n *v1.Node)) {
+	c.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldNode, ok := oldObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			newNode, ok := newObj.(*v1.Node)
+			if !ok {
+				return
+			}
+			if !IsDraining(oldNode) && IsDraining(newNode) {
+				f(newNode)
+			}
+		},
+	})
+}
+
+// Run starts the informer, waits for it to fill and takes the first snapshot.
+func (c *Cache) Run(stopChan <-chan struct{}) error {
+	c.factory.Start(stopChan)
+
+	if !cache.WaitForCacheSync(stopChan, c.informer.HasSynced) {
+		return errors.New("timed out waiting for the node cache to sync")
+	}
+	log.Debug("Node cache synced")
+
+	return c.Refresh()
+}
+
+// Refresh replaces the snapshot with the nodes currently in the informer.
+func (c *Cache) Refresh() error {
+	nodes, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	c.snapshot = nodes
+	c.mu.Unlock()
+
+	return nil
+}
+
+// List returns the nodes of the current snapshot.
+func (c *Cache) List() ([]*v1.Node, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	// callers may sort the result, keep the snapshot intact
+	nodes := make([]*v1.Node, len(c.snapshot))
+	copy(nodes, c.snapshot)
+	return nodes, nil
+}
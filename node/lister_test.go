@@ -0,0 +1,50 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newNode(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec:       v1.NodeSpec{ProviderID: "aws:///us-east-1a/" + name},
+	}
+}
+
+func TestClientLister(t *testing.T) {
+	client := fake.NewSimpleClientset(newNode("i-1"), newNode("i-2"))
+
+	nodes, err := NewClientLister(client).List()
+	require.NoError(t, err)
+	assert.Len(t, nodes, 2)
+}
+
+func TestCacheSnapshot(t *testing.T) {
+	client := fake.NewSimpleClientset(newNode("i-1"))
+	stopChan := make(chan struct{})
+	defer close(stopChan)
+
+	c := NewCache(client, 0)
+	require.NoError(t, c.Run(stopChan))
+
+	nodes, err := c.List()
+	require.NoError(t, err)
+	require.Len(t, nodes, 1)
+	assert.Equal(t, "i-1", nodes[0].Name)
+
+	// modifying the result must not affect the snapshot
+	nodes[0] = newNode("i-2")
+	nodes, err = c.List()
+	require.NoError(t, err)
+	assert.Equal(t, "i-1", nodes[0].Name)
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	// SchemeAWS is the providerID scheme of AWS EC2 instances
+	SchemeAWS = "aws"
+	// SchemeGCE is the providerID scheme of Google Compute Engine instances
+	SchemeGCE = "gce"
+	// SchemeAzure is the providerID scheme of Azure virtual machines
+	SchemeAzure = "azure"
+	// SchemeOpenStack is the providerID scheme of OpenStack Nova instances
+	SchemeOpenStack = "openstack"
+	// SchemeDigitalOcean is the providerID scheme of DigitalOcean droplets
+	SchemeDigitalOcean = "digitalocean"
+	// SchemeLinode is the providerID scheme of Linode instances
+	SchemeLinode = "linode"
+	// SchemeHetzner is the providerID scheme of Hetzner Cloud servers
+	SchemeHetzner = "hcloud"
+)
+
+var (
+	// awsInstanceRegMatch represents Regex Match for AWS instance.
+	awsInstanceRegMatch = regexp.MustCompile("^i-[^/]*$")
+	// openStackInstanceRegMatch represents Regex Match for OpenStack instance UUIDs.
+	openStackInstanceRegMatch = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
+	// numericInstanceRegMatch represents Regex Match for the numeric ids of DigitalOcean droplets, Linode instances and Hetzner Cloud servers.
+	numericInstanceRegMatch = regexp.MustCompile("^[0-9]+$")
+	// azureResourceRegMatch represents Regex Match for Azure virtual machine resource ids.
+	azureResourceRegMatch = regexp.MustCompile("(?i)^/subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Compute/virtualMachines/([^/]+)$")
+)
+
+// ProviderID is the parsed form of the spec.providerID of a Kubernetes node.
+type ProviderID struct {
+	// Scheme identifies the cloud provider, e.g. aws or gce
+	Scheme string
+	// Project is the GCE project or the Azure subscription of the instance
+	Project string
+	// Zone is the availability zone (AWS, GCE) or the region (OpenStack) of the instance, if known
+	Zone string
+	// ResourceGroup is the Azure resource group of the instance
+	ResourceGroup string
+	// InstanceID is the identifier of the instance as used by the cloud provider API
+	InstanceID string
+	// Raw is the providerID as found on the node
+	Raw string
+}
+
+func (p *ProviderID) String() string {
+	return p.Raw
+}
+
+// UnknownSchemeError is returned when a providerID uses a scheme which is not supported.
+type UnknownSchemeError struct {
+	ProviderID string
+	Scheme     string
+}
+
+func (e *UnknownSchemeError) Error() string {
+	return fmt.Sprintf("unknown providerID scheme \"%s\" (%s), supported schemes: aws, gce, azure, openstack, digitalocean, linode, hcloud", e.Scheme, e.ProviderID)
+}
+
+// ParseProviderID parses the providerID of a node. A bare AWS instance id
+// (i-1234...) is accepted for backwards compatibility.
+func ParseProviderID(providerID string) (*ProviderID, error) {
+	s := providerID
+	if !strings.Contains(s, "://") {
+		if !awsInstanceRegMatch.MatchString(s) {
+			return nil, &UnknownSchemeError{ProviderID: providerID}
+		}
+		// Build a URL with an empty host (AZ)
+		s = "aws:///" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid providerID (%s): %v", providerID, err)
+	}
+
+	switch u.Scheme {
+	case SchemeAWS:
+		return parseAWS(providerID, u)
+	case SchemeGCE:
+		return parseGCE(providerID, u)
+	case SchemeAzure:
+		return parseAzure(providerID, u)
+	case SchemeOpenStack:
+		return parseOpenStack(providerID, u)
+	case SchemeDigitalOcean:
+		return parseNumericInstance(providerID, u, "DigitalOcean droplet")
+	case SchemeLinode:
+		return parseNumericInstance(providerID, u, "Linode instance")
+	case SchemeHetzner:
+		return parseNumericInstance(providerID, u, "Hetzner Cloud server")
+	}
+	return nil, &UnknownSchemeError{ProviderID: providerID, Scheme: u.Scheme}
+}
+
+// InstanceID parses the providerID and returns its instance id, making sure
+// the providerID belongs to the given scheme.
+func InstanceID(providerID, scheme string) (string, error) {
+	id, err := ParseProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	if id.Scheme != scheme {
+		return "", fmt.Errorf("Invalid scheme for %s instance (%s)", scheme, providerID)
+	}
+	return id.InstanceID, nil
+}
+
+// aws:///<zone>/<instance id>, aws:////<instance id> or aws:///<instance id>
+func parseAWS(providerID string, u *url.URL) (*ProviderID, error) {
+	id := &ProviderID{Scheme: SchemeAWS, Raw: providerID}
+
+	tokens := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(tokens) == 1 {
+		id.InstanceID = tokens[0]
+	} else if len(tokens) == 2 {
+		id.Zone = tokens[0]
+		id.InstanceID = tokens[1]
+	}
+
+	// the two known formats are i-12345678 and i-12345678abcdef01
+	if !awsInstanceRegMatch.MatchString(id.InstanceID) {
+		return nil, fmt.Errorf("Invalid format for AWS instance (%s)", providerID)
+	}
+	return id, nil
+}
+
+// gce://<project>/<zone>/<instance name>
+func parseGCE(providerID string, u *url.URL) (*ProviderID, error) {
+	tokens := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if u.Host == "" || len(tokens) != 2 || tokens[0] == "" || tokens[1] == "" {
+		return nil, fmt.Errorf("Invalid format for GCE instance (%s)", providerID)
+	}
+	return &ProviderID{
+		Scheme:     SchemeGCE,
+		Project:    u.Host,
+		Zone:       tokens[0],
+		InstanceID: tokens[1],
+		Raw:        providerID,
+	}, nil
+}
+
+// azure:///subscriptions/<subscription>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>
+func parseAzure(providerID string, u *url.URL) (*ProviderID, error) {
+	matches := azureResourceRegMatch.FindStringSubmatch(u.Path)
+	if matches == nil {
+		return nil, fmt.Errorf("Invalid format for Azure instance (%s)", providerID)
+	}
+	return &ProviderID{
+		Scheme:        SchemeAzure,
+		Project:       matches[1],
+		ResourceGroup: matches[2],
+		InstanceID:    matches[3],
+		Raw:           providerID,
+	}, nil
+}
+
+// openstack:///<instance uuid> or openstack://<region>/<instance uuid>
+func parseOpenStack(providerID string, u *url.URL) (*ProviderID, error) {
+	instanceID := strings.Trim(u.Path, "/")
+	if !openStackInstanceRegMatch.MatchString(instanceID) {
+		return nil, fmt.Errorf("Invalid format for OpenStack instance (%s)", providerID)
+	}
+	return &ProviderID{
+		Scheme:     SchemeOpenStack,
+		Zone:       u.Host,
+		InstanceID: instanceID,
+		Raw:        providerID,
+	}, nil
+}
+
+// digitalocean://<droplet id>, linode://<instance id>, hcloud://<server id>, or with the id as the path
+func parseNumericInstance(providerID string, u *url.URL, kind string) (*ProviderID, error) {
+	instanceID := u.Host
+	if instanceID == "" {
+		instanceID = strings.Trim(u.Path, "/")
+	} else if strings.Trim(u.Path, "/") != "" {
+		return nil, fmt.Errorf("Invalid format for %s (%s)", kind, providerID)
+	}
+	if !numericInstanceRegMatch.MatchString(instanceID) {
+		return nil, fmt.Errorf("Invalid format for %s (%s)", kind, providerID)
+	}
+	return &ProviderID{
+		Scheme:     u.Scheme,
+		InstanceID: instanceID,
+		Raw:        providerID,
+	}, nil
+}
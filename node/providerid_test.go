@@ -0,0 +1,134 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package node
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProviderID(t *testing.T) {
+	for _, ti := range []struct {
+		title      string
+		providerID string
+		expected   *ProviderID
+		expectErr  bool
+	}{
+		{
+			title:      "aws with zone",
+			providerID: "aws:///us-east-1a/i-0123456789abcdef0",
+			expected:   &ProviderID{Scheme: SchemeAWS, Zone: "us-east-1a", InstanceID: "i-0123456789abcdef0"},
+		},
+		{
+			title:      "aws without zone",
+			providerID: "aws:////i-12345678",
+			expected:   &ProviderID{Scheme: SchemeAWS, InstanceID: "i-12345678"},
+		},
+		{
+			title:      "bare aws instance id",
+			providerID: "i-12345678",
+			expected:   &ProviderID{Scheme: SchemeAWS, InstanceID: "i-12345678"},
+		},
+		{
+			title:      "invalid aws instance id",
+			providerID: "aws:///us-east-1a/vol-12345678",
+			expectErr:  true,
+		},
+		{
+			title:      "gce",
+			providerID: "gce://my-project/us-central1-a/node-1",
+			expected:   &ProviderID{Scheme: SchemeGCE, Project: "my-project", Zone: "us-central1-a", InstanceID: "node-1"},
+		},
+		{
+			title:      "gce without zone",
+			providerID: "gce://my-project/node-1",
+			expectErr:  true,
+		},
+		{
+			title:      "azure",
+			providerID: "azure:///subscriptions/sub-1/resourceGroups/group-1/providers/Microsoft.Compute/virtualMachines/vm-1",
+			expected:   &ProviderID{Scheme: SchemeAzure, Project: "sub-1", ResourceGroup: "group-1", InstanceID: "vm-1"},
+		},
+		{
+			title:      "azure scale set is not a virtual machine",
+			providerID: "azure:///subscriptions/sub-1/resourceGroups/group-1/providers/Microsoft.Compute/virtualMachineScaleSets/ss-1/virtualMachines/0",
+			expectErr:  true,
+		},
+		{
+			title:      "openstack",
+			providerID: "openstack:///0e7a5a4c-4c8b-4f4e-9d0d-6f1b0b8e2c11",
+			expected:   &ProviderID{Scheme: SchemeOpenStack, InstanceID: "0e7a5a4c-4c8b-4f4e-9d0d-6f1b0b8e2c11"},
+		},
+		{
+			title:      "openstack with region",
+			providerID: "openstack://RegionOne/0e7a5a4c-4c8b-4f4e-9d0d-6f1b0b8e2c11",
+			expected:   &ProviderID{Scheme: SchemeOpenStack, Zone: "RegionOne", InstanceID: "0e7a5a4c-4c8b-4f4e-9d0d-6f1b0b8e2c11"},
+		},
+		{
+			title:      "digitalocean",
+			providerID: "digitalocean://123456",
+			expected:   &ProviderID{Scheme: SchemeDigitalOcean, InstanceID: "123456"},
+		},
+		{
+			title:      "digitalocean with path",
+			providerID: "digitalocean:///123456",
+			expected:   &ProviderID{Scheme: SchemeDigitalOcean, InstanceID: "123456"},
+		},
+		{
+			title:      "invalid digitalocean droplet id",
+			providerID: "digitalocean://droplet-1",
+			expectErr:  true,
+		},
+		{
+			title:      "linode",
+			providerID: "linode://12345678",
+			expected:   &ProviderID{Scheme: SchemeLinode, InstanceID: "12345678"},
+		},
+		{
+			title:      "hcloud",
+			providerID: "hcloud://1234567",
+			expected:   &ProviderID{Scheme: SchemeHetzner, InstanceID: "1234567"},
+		},
+		{
+			title:      "unknown scheme",
+			providerID: "kind://docker/kind/kind-worker",
+			expectErr:  true,
+		},
+		{
+			title:      "empty",
+			providerID: "",
+			expectErr:  true,
+		},
+	} {
+		t.Run(ti.title, func(t *testing.T) {
+			id, err := ParseProviderID(ti.providerID)
+			if ti.expectErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			ti.expected.Raw = ti.providerID
+			assert.Equal(t, ti.expected, id)
+		})
+	}
+}
+
+func TestParseProviderIDUnknownScheme(t *testing.T) {
+	_, err := ParseProviderID("kind://docker/kind/kind-worker")
+	require.Error(t, err)
+	schemeErr, ok := err.(*UnknownSchemeError)
+	require.True(t, ok)
+	assert.Equal(t, "kind", schemeErr.Scheme)
+}
+
+func TestInstanceID(t *testing.T) {
+	id, err := InstanceID("aws:///us-east-1a/i-12345678", SchemeAWS)
+	require.NoError(t, err)
+	assert.Equal(t, "i-12345678", id)
+
+	_, err = InstanceID("gce://my-project/us-central1-a/node-1", SchemeAWS)
+	assert.Error(t, err)
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package notify tells the operators about the synchronizations which matter,
+// e.g. the records of a service which actually moved, without scraping the logs.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The kinds of events.
+const (
+	// KindApplied is a synchronization which applied changes
+	KindApplied = "applied"
+	// KindFailing is a subsystem paused after consecutive failures
+	KindFailing = "failing"
+	// KindLargePlan is a plan of at least the configured number of changes, before it's applied
+	KindLargePlan = "large-plan"
+)
+
+// The formats of the payloads sent by the webhooks.
+const (
+	// FormatJSON sends the event as a JSON object
+	FormatJSON = "json"
+	// FormatSlack sends the message of the event to a Slack incoming webhook
+	FormatSlack = "slack"
+)
+
+const (
+	// the number of changes listed by the message of an event, the others are counted
+	maxMessageChanges = 20
+	// how long a webhook may take to answer
+	webhookTimeout = 5 * time.Second
+)
+
+var failedNotifications = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "external_ips",
+		Subsystem: "notify",
+		Name:      "failed_notifications_total",
+		Help:      "Number of events which couldn't be notified, by kind.",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	prometheus.MustRegister(failedNotifications)
+}
+
+// templates are the payloads of the predefined formats.
+var templates = map[string]string{
+	FormatJSON:  `{{json .}}`,
+	FormatSlack: `{"text":{{json .Message}}}`,
+}
+
+// Event is something which happened to a subsystem of the controller.
+type Event struct {
+	Kind      string    `json:"kind"`
+	Subsystem string    `json:"subsystem"`
+	Time      time.Time `json:"time"`
+	// The number of changes by action, e.g. "2 CREATE, 1 DELETE"
+	Summary string `json:"summary,omitempty"`
+	// The descriptions of the changes, e.g. "CREATE foo.example.org 0 IN A [1.2.3.4]"
+	Changes []string `json:"changes,omitempty"`
+	// The last error of a failing subsystem and its number of consecutive failures
+	Error    string `json:"error,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+}
+
+// NewEvent returns the event of the given changes, summarized by action, the first word of their description.
+func NewEvent(kind, subsystem string, changes []string, t time.Time) *Event {
+	var actions []string
+	counts := map[string]int{}
+	for _, ch := range changes {
+		action := strings.SplitN(ch, " ", 2)[0]
+		if counts[action] == 0 {
+			actions = append(actions, action)
+		}
+		counts[action]++
+	}
+	summary := make([]string, 0, len(actions))
+	for _, action := range actions {
+		summary = append(summary, fmt.Sprintf("%d %s", counts[action], action))
+	}
+	return &Event{
+		Kind:      kind,
+		Subsystem: subsystem,
+		Time:      t,
+		Summary:   strings.Join(summary, ", "),
+		Changes:   changes,
+	}
+}
+
+// Message returns the event as a human readable text, listing the first changes.
+func (e *Event) Message() string {
+	var b bytes.Buffer
+	switch e.Kind {
+	case KindApplied:
+		fmt.Fprintf(&b, "external-ips applied %s changes: %s", e.Subsystem, e.Summary)
+	case KindLargePlan:
+		fmt.Fprintf(&b, "external-ips planned %d %s changes: %s", len(e.Changes), e.Subsystem, e.Summary)
+	case KindFailing:
+		fmt.Fprintf(&b, "external-ips paused the %s synchronization after %d consecutive failures: %s", e.Subsystem, e.Failures, e.Error)
+	default:
+		fmt.Fprintf(&b, "external-ips %s %s", e.Subsystem, e.Kind)
+	}
+	for i, ch := range e.Changes {
+		if i == maxMessageChanges {
+			fmt.Fprintf(&b, "\n... and %d more", len(e.Changes)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n%s", ch)
+	}
+	return b.String()
+}
+
+// Notifier sends the events somewhere the operators look at.
+// Implementations must be safe for concurrent use.
+type Notifier interface {
+	Notify(e *Event) error
+}
+
+// Webhook posts the events to a URL, rendered by a template.
+type Webhook struct {
+	url      string
+	template *template.Template
+	client   *http.Client
+}
+
+// NewWebhook returns a webhook posting the events to url in the given format,
+// or rendered by tmpl instead if not empty. The templates are given the *Event
+// and a json function encoding its argument as JSON, e.g. {{json .Message}}.
+func NewWebhook(url, format, tmpl string) (*Webhook, error) {
+	if tmpl == "" {
+		if format == "" {
+			format = FormatJSON
+		}
+		var ok bool
+		if tmpl, ok = templates[format]; !ok {
+			return nil, fmt.Errorf("unknown notification format: %s", format)
+		}
+	}
+	t, err := template.New("notification").Funcs(template.FuncMap{"json": toJSON}).Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid notification template: %v", err)
+	}
+	return &Webhook{
+		url:      url,
+		template: t,
+		client:   &http.Client{Timeout: webhookTimeout},
+	}, nil
+}
+
+// Notify posts the rendered event, failing unless the webhook answers with a 2xx status.
+func (w *Webhook) Notify(e *Event) (err error) {
+	defer func() {
+		if err != nil {
+			failedNotifications.WithLabelValues(e.Kind).Inc()
+		}
+	}()
+
+	var body bytes.Buffer
+	if err := w.template.Execute(&body, e); err != nil {
+		return fmt.Errorf("failed to render the notification: %v", err)
+	}
+	resp, err := w.client.Post(w.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// toJSON encodes v as JSON for the templates.
+func toJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	return string(data), err
+}
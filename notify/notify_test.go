@@ -0,0 +1,86 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewEvent(t *testing.T) {
+	e := NewEvent(KindApplied, "dns", []string{
+		"CREATE foo.example.org 0 IN A [1.2.3.4]",
+		"DELETE bar.example.org 0 IN A [1.2.3.5]",
+		"CREATE baz.example.org 0 IN A [1.2.3.6]",
+	}, time.Unix(0, 0))
+	assert.Equal(t, "2 CREATE, 1 DELETE", e.Summary)
+	assert.Equal(t, "external-ips applied dns changes: 2 CREATE, 1 DELETE\n"+
+		"CREATE foo.example.org 0 IN A [1.2.3.4]\n"+
+		"DELETE bar.example.org 0 IN A [1.2.3.5]\n"+
+		"CREATE baz.example.org 0 IN A [1.2.3.6]", e.Message())
+}
+
+func TestEventMessageTruncated(t *testing.T) {
+	var changes []string
+	for i := 0; i < maxMessageChanges+5; i++ {
+		changes = append(changes, fmt.Sprintf("CREATE foo-%d.example.org 0 IN A [1.2.3.4]", i))
+	}
+	e := NewEvent(KindLargePlan, "dns", changes, time.Unix(0, 0))
+	assert.Contains(t, e.Message(), "external-ips planned 25 dns changes: 25 CREATE\n")
+	assert.Contains(t, e.Message(), "foo-19.example.org")
+	assert.NotContains(t, e.Message(), "foo-20.example.org")
+	assert.Contains(t, e.Message(), "\n... and 5 more")
+}
+
+func TestWebhook(t *testing.T) {
+	var bodies []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	e := &Event{Kind: KindFailing, Subsystem: "firewall", Time: time.Unix(0, 0).UTC(), Error: "access denied", Failures: 5}
+
+	for _, tc := range []struct {
+		format, template string
+		expected         string
+	}{
+		{"", "", `{"kind":"failing","subsystem":"firewall","time":"1970-01-01T00:00:00Z","error":"access denied","failures":5}`},
+		{FormatSlack, "", `{"text":"external-ips paused the firewall synchronization after 5 consecutive failures: access denied"}`},
+		{FormatSlack, `{"content":{{json .Subsystem}}}`, `{"content":"firewall"}`},
+	} {
+		bodies = nil
+		w, err := NewWebhook(server.URL, tc.format, tc.template)
+		require.NoError(t, err)
+		require.NoError(t, w.Notify(e))
+		require.Len(t, bodies, 1)
+		assert.Equal(t, tc.expected, bodies[0])
+		assert.True(t, json.Valid([]byte(bodies[0])))
+	}
+
+	w, err := NewWebhook(server.URL, FormatJSON, "")
+	require.NoError(t, err)
+	status = http.StatusInternalServerError
+	assert.Error(t, w.Notify(e))
+}
+
+func TestNewWebhookInvalid(t *testing.T) {
+	_, err := NewWebhook("http://example.org", "xml", "")
+	assert.Error(t, err)
+	_, err = NewWebhook("http://example.org", "", "{{.Kind")
+	assert.Error(t, err)
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package permissions
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// PolicyVersion is the current version of the IAM policy language
+	PolicyVersion = "2012-10-17"
+	// EffectAllow is the effect of all statements generated by the providers
+	EffectAllow = "Allow"
+	// AnyResource matches all resources
+	AnyResource = "*"
+)
+
+// readOnlyPrefixes are the prefixes of the actions which don't modify anything.
+var readOnlyPrefixes = []string{"Describe", "Get", "List", "Query"}
+
+// Policy is an IAM policy document.
+type Policy struct {
+	Version   string
+	Statement []Statement
+}
+
+// Statement is a single statement of an IAM policy document.
+type Statement struct {
+	Effect    string
+	Action    []string
+	Resource  []string
+	Condition map[string]map[string]string `json:",omitempty"`
+}
+
+// NewPolicy returns a policy made of the given statements. Statements without
+// any action are dropped.
+func NewPolicy(statements ...Statement) *Policy {
+	policy := &Policy{
+		Version:   PolicyVersion,
+		Statement: []Statement{},
+	}
+	for _, s := range statements {
+		if len(s.Action) == 0 {
+			continue
+		}
+		policy.Statement = append(policy.Statement, s)
+	}
+	return policy
+}
+
+// JSON returns the policy document in its JSON representation.
+func (p *Policy) JSON() (string, error) {
+	b, err := json.MarshalIndent(p, "", " ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// Actions returns the IAM actions of service corresponding to the methods of
+// api, which must be a pointer to an interface such as (*EC2API)(nil). The
+// paginated variants of the SDK methods map to the action they page over.
+// Methods listed in ignore are not part of the result.
+func Actions(service string, api interface{}, ignore ...string) []string {
+	ignored := make(map[string]bool, len(ignore))
+	for _, m := range ignore {
+		ignored[m] = true
+	}
+
+	seen := map[string]bool{}
+	actions := []string{}
+	t := reflect.TypeOf(api).Elem()
+	for i := 0; i < t.NumMethod(); i++ {
+		name := t.Method(i).Name
+		if ignored[name] {
+			continue
+		}
+		action := service + ":" + strings.TrimSuffix(name, "Pages")
+		if seen[action] {
+			continue
+		}
+		seen[action] = true
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+	return actions
+}
+
+// Partition splits actions into the ones found in scoped and the remaining ones.
+func Partition(actions []string, scoped ...string) (matched []string, rest []string) {
+	scopedSet := make(map[string]bool, len(scoped))
+	for _, a := range scoped {
+		scopedSet[a] = true
+	}
+	for _, a := range actions {
+		if scopedSet[a] {
+			matched = append(matched, a)
+		} else {
+			rest = append(rest, a)
+		}
+	}
+	return
+}
+
+// ReadOnly returns the statements limited to their read-only actions, e.g. for
+// running in monitor-only mode. The statements left without any action are
+// dropped by NewPolicy.
+func ReadOnly(statements []Statement) []Statement {
+	result := make([]Statement, 0, len(statements))
+	for _, s := range statements {
+		readOnly := s
+		readOnly.Action = nil
+		for _, a := range s.Action {
+			if isReadOnly(a) {
+				readOnly.Action = append(readOnly.Action, a)
+			}
+		}
+		result = append(result, readOnly)
+	}
+	return result
+}
+
+func isReadOnly(action string) bool {
+	name := action[strings.Index(action, ":")+1:]
+	for _, prefix := range readOnlyPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package permissions
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testAPI interface {
+	DescribeThings(input string) (string, error)
+	ListThingsPages(input string, fn func(string, bool) bool) error
+	ListThings(input string) (string, error)
+	CreateThing(input string) (string, error)
+	SeedThing(input string) (string, error)
+}
+
+func TestActions(t *testing.T) {
+	actions := Actions("svc", (*testAPI)(nil), "SeedThing")
+	assert.Equal(t, []string{"svc:CreateThing", "svc:DescribeThings", "svc:ListThings"}, actions)
+}
+
+func TestPartition(t *testing.T) {
+	matched, rest := Partition([]string{"svc:A", "svc:B", "svc:C"}, "svc:B", "svc:D")
+	assert.Equal(t, []string{"svc:B"}, matched)
+	assert.Equal(t, []string{"svc:A", "svc:C"}, rest)
+}
+
+func TestReadOnly(t *testing.T) {
+	statements := ReadOnly([]Statement{
+		{
+			Effect:   EffectAllow,
+			Action:   []string{"svc:CreateThing", "svc:DescribeThings", "svc:GetThing", "svc:ListThings", "svc:QueryThings"},
+			Resource: []string{AnyResource},
+		},
+		{
+			Effect:   EffectAllow,
+			Action:   []string{"svc:DeleteThing"},
+			Resource: []string{AnyResource},
+		},
+	})
+	require.Len(t, statements, 2)
+	assert.Equal(t, []string{"svc:DescribeThings", "svc:GetThing", "svc:ListThings", "svc:QueryThings"}, statements[0].Action)
+	assert.Empty(t, statements[1].Action)
+
+	assert.Len(t, NewPolicy(statements...).Statement, 1)
+}
+
+func TestPolicyJSON(t *testing.T) {
+	policy := NewPolicy(
+		Statement{
+			Effect:   EffectAllow,
+			Action:   []string{"svc:A"},
+			Resource: []string{AnyResource},
+		},
+		Statement{
+			Effect:   EffectAllow,
+			Resource: []string{AnyResource},
+		},
+	)
+	require.Len(t, policy.Statement, 1)
+
+	s, err := policy.JSON()
+	require.NoError(t, err)
+	assert.Equal(t, `{
+ "Version": "2012-10-17",
+ "Statement": [
+  {
+   "Effect": "Allow",
+   "Action": [
+    "svc:A"
+   ],
+   "Resource": [
+    "*"
+   ]
+  }
+ ]
+}`, s)
+}
@@ -22,6 +22,7 @@ package externalips
 import (
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/alecthomas/kingpin"
@@ -39,8 +40,22 @@ var (
 
 // Config is a project-wide configuration
 type Config struct {
+	Command                  string
+	ClusterName              string
+	CanaryHostname           string
+	CanaryResolver           string
+	CanaryTimeout            time.Duration
+	FirewallHistoryAt        string
+	QuotaRecordsPerZone      int
+	QuotaSecurityGroups      int
+	QuotaRulesPerGroup       int
+	QuotaExtIPsPerService    int
+	SnapshotFile             string
+	PlanFormat               string
 	Master                   string
 	KubeConfig               string
+	KubeAPIQPS               float32
+	KubeAPIBurst             int
 	Sources                  []string
 	Namespace                string
 	AnnotationFilter         string
@@ -48,14 +63,54 @@ type Config struct {
 	CombineFQDNAndAnnotation bool
 	Compatibility            string
 	PublishInternal          bool
+	InternalFQDNTemplate     string
+	DrainPeriod              time.Duration
+	NodeGracePeriod          time.Duration
+	ExcludeNodes             []string
+	AWSASGNodeTags           []string
+	AWSASGNodeInterval       time.Duration
+	SpotPolicy               string
+	SpotNodeSelector         string
+	SubdomainPerCluster      bool
+	SplitHorizon             bool
+	ActiveSlot               string
+	ServiceLabels            []string
+	FirewallNameTemplate     string
+	FirewallNodePortRange    string
+	FakeEndpoints            int
+	FakeInboundRules         int
+	FakeExtIPs               int
+	FakeChurn                float64
+	FakeSeed                 int64
+	CRDSourceAPIVersion      string
+	CRDSourceKind            string
+	SourceErrors             string
 	Provider                 string
+	FirewallProvider         string
 	GoogleProject            string
 	DomainFilter             []string
+	ExcludeDomains           []string
 	ZoneIDFilter             []string
 	AWSZoneType              string
+	InternalProvider         string
+	ExtIPProvider            string
+	Manage                   string
+	ListProviders            bool
+	InternalDomainFilter     []string
+	InternalZoneIDFilter     []string
+	InternalAWSZoneType      string
 	AWSAssumeRole            string
+	AWSDNSAssumeRole         string
+	AWSFirewallAssumeRole    string
+	AWSRegion                string
+	PrivateZoneVPCFilter     []string
 	AWSMaxChangeCount        int
+	AWSBatchChangeStrategy   string
 	AWSEvaluateTargetHealth  bool
+	AWSRecordsPageSize       int
+	AWSZoneConcurrency       int
+	AWSRecordsCacheTTL       time.Duration
+	AWSGlobalAcceleratorARN  string
 	AzureConfigFile          string
 	AzureResourceGroup       string
 	CloudflareProxied        bool
@@ -80,22 +135,75 @@ type Config struct {
 	Policy                   string
 	Registry                 string
 	TXTOwnerID               string
+	TXTReadOwnerIDs          []string
+	TXTRepairOwnership       bool
+	TXTEncryptionKeyFile     string
+	TXTFormat                string
 	TXTPrefix                string
+	DynamoDBTable            string
+	DynamoDBRegion           string
+	DynamoDBMirrorTXT        bool
 	Interval                 time.Duration
+	FailureThreshold         int
+	FailurePause             time.Duration
+	StuckThreshold           int
+	StuckPause               time.Duration
+	CutoverDelay             time.Duration
+	PropagationTimeout       time.Duration
+	NotifyWebhookURL         string
+	NotifyFormat             string
+	NotifyTemplate           string
+	NotifyLargePlan          int
+	TraceOTLPEndpoint        string
+	TraceOTLPHeaders         []string
+	ConcurrentSync           bool
 	Once                     bool
 	DryRun                   bool
+	MonitorOnly              bool
+	ServiceFinalizer         bool
+	ExtIPUpdateQPS           float32
+	ExtIPUpdateChunkSize     int
 	LogFormat                string
 	MetricsAddress           string
+	MetricsTLS               bool
+	DebugState               bool
 	LogLevel                 string
 	TXTCacheInterval         time.Duration
+	TXTReplanStale           bool
+	DNSCacheInterval         time.Duration
+	FirewallCacheInterval    time.Duration
+	FirewallGCInterval       time.Duration
+	FirewallHistory          string
+	FirewallHistoryCM        string
+	FirewallHistoryTable     string
+	FirewallHistoryTTL       time.Duration
+	FirewallGCGracePeriod    time.Duration
 	ExoscaleEndpoint         string
 	ExoscaleAPIKey           string
 	ExoscaleAPISecret        string
+	NS1Endpoint              string
+	NS1IgnoreSSL             bool
+	NS1APIKey                string
+	OpenStackRegion          string
 }
 
 var defaultConfig = &Config{
+	Command:                  "run",
+	ClusterName:              "",
+	CanaryHostname:           "",
+	CanaryResolver:           "",
+	CanaryTimeout:            2 * time.Minute,
+	FirewallHistoryAt:        "",
+	QuotaRecordsPerZone:      10000,
+	QuotaSecurityGroups:      2500,
+	QuotaRulesPerGroup:       60,
+	QuotaExtIPsPerService:    0,
+	SnapshotFile:             "-",
+	PlanFormat:               "mermaid",
 	Master:                   "",
 	KubeConfig:               "",
+	KubeAPIQPS:               5,
+	KubeAPIBurst:             10,
 	Sources:                  nil,
 	Namespace:                "",
 	AnnotationFilter:         "",
@@ -103,13 +211,53 @@ var defaultConfig = &Config{
 	CombineFQDNAndAnnotation: false,
 	Compatibility:            "",
 	PublishInternal:          false,
+	InternalFQDNTemplate:     "internal.{{.Hostname}}",
+	DrainPeriod:              0,
+	NodeGracePeriod:          0,
+	ExcludeNodes:             []string{},
+	AWSASGNodeTags:           []string{},
+	AWSASGNodeInterval:       time.Minute,
+	SpotPolicy:               "",
+	SpotNodeSelector:         "lifecycle=Ec2Spot",
+	SubdomainPerCluster:      false,
+	SplitHorizon:             false,
+	ActiveSlot:               "blue",
+	ServiceLabels:            []string{},
+	FirewallNameTemplate:     "",
+	FirewallNodePortRange:    "",
+	FakeEndpoints:            10,
+	FakeInboundRules:         0,
+	FakeExtIPs:               0,
+	FakeChurn:                0,
+	FakeSeed:                 0,
+	CRDSourceAPIVersion:      "externaldns.k8s.io/v1alpha1",
+	CRDSourceKind:            "DNSEndpoint",
+	SourceErrors:             "fail-fast",
 	Provider:                 "",
+	FirewallProvider:         "aws",
 	GoogleProject:            "",
 	DomainFilter:             []string{},
+	ExcludeDomains:           []string{},
 	AWSZoneType:              "",
+	InternalProvider:         "",
+	ExtIPProvider:            "kubernetes",
+	Manage:                   strings.Join(Subsystems, ","),
+	ListProviders:            false,
+	InternalDomainFilter:     []string{},
+	InternalZoneIDFilter:     []string{},
+	InternalAWSZoneType:      "",
 	AWSAssumeRole:            "",
+	AWSDNSAssumeRole:         "",
+	AWSFirewallAssumeRole:    "",
+	AWSRegion:                "",
+	PrivateZoneVPCFilter:     []string{},
 	AWSMaxChangeCount:        4000,
+	AWSBatchChangeStrategy:   "by-name",
 	AWSEvaluateTargetHealth:  true,
+	AWSRecordsPageSize:       300,
+	AWSZoneConcurrency:       1,
+	AWSRecordsCacheTTL:       0,
+	AWSGlobalAcceleratorARN:  "",
 	AzureConfigFile:          "/etc/kubernetes/azure.json",
 	AzureResourceGroup:       "",
 	CloudflareProxied:        false,
@@ -130,17 +278,56 @@ var defaultConfig = &Config{
 	Policy:                   "sync",
 	Registry:                 "txt",
 	TXTOwnerID:               "default",
+	TXTReadOwnerIDs:          []string{},
+	TXTRepairOwnership:       false,
+	TXTEncryptionKeyFile:     "",
+	TXTFormat:                "v1",
 	TXTPrefix:                "",
+	DynamoDBTable:            "",
+	DynamoDBRegion:           "",
+	DynamoDBMirrorTXT:        false,
 	TXTCacheInterval:         0,
+	TXTReplanStale:           false,
+	DNSCacheInterval:         0,
+	FirewallCacheInterval:    0,
+	FirewallGCInterval:       0,
+	FirewallHistory:          "",
+	FirewallHistoryCM:        "kube-system/external-ips-firewall-history",
+	FirewallHistoryTable:     "",
+	FirewallHistoryTTL:       30 * 24 * time.Hour,
+	FirewallGCGracePeriod:    time.Hour,
 	Interval:                 time.Minute,
+	FailureThreshold:         5,
+	FailurePause:             5 * time.Minute,
+	StuckThreshold:           3,
+	StuckPause:               30 * time.Minute,
+	CutoverDelay:             0,
+	PropagationTimeout:       0,
+	NotifyWebhookURL:         "",
+	NotifyFormat:             "json",
+	NotifyTemplate:           "",
+	NotifyLargePlan:          0,
+	TraceOTLPEndpoint:        "",
+	TraceOTLPHeaders:         []string{},
+	ConcurrentSync:           false,
 	Once:                     false,
 	DryRun:                   false,
+	MonitorOnly:              false,
+	ServiceFinalizer:         false,
+	ExtIPUpdateQPS:           0,
+	ExtIPUpdateChunkSize:     10,
 	LogFormat:                "text",
 	MetricsAddress:           ":7979",
+	MetricsTLS:               false,
+	DebugState:               false,
 	LogLevel:                 logrus.InfoLevel.String(),
 	ExoscaleEndpoint:         "https://api.exoscale.ch/dns",
 	ExoscaleAPIKey:           "",
 	ExoscaleAPISecret:        "",
+	NS1Endpoint:              "",
+	NS1IgnoreSSL:             false,
+	NS1APIKey:                "",
+	OpenStackRegion:          "",
 }
 
 // NewConfig returns new Config object
@@ -148,6 +335,41 @@ func NewConfig() *Config {
 	return &Config{}
 }
 
+// Subsystems are the subsystems which may be managed.
+var Subsystems = []string{"dns", "firewall", "extip"}
+
+// Manages returns whether the subsystem is in the comma separated list of the
+// managed subsystems, an empty list managing all of them.
+func (cfg *Config) Manages(subsystem string) bool {
+	if cfg.Manage == "" {
+		return true
+	}
+	for _, s := range strings.Split(cfg.Manage, ",") {
+		if strings.TrimSpace(s) == subsystem {
+			return true
+		}
+	}
+	return false
+}
+
+// DNSAssumeRole returns the IAM role assumed by the AWS clients of the records, those
+// of the DNS providers and of their registry, --aws-assume-role unless overridden.
+func (cfg *Config) DNSAssumeRole() string {
+	if cfg.AWSDNSAssumeRole != "" {
+		return cfg.AWSDNSAssumeRole
+	}
+	return cfg.AWSAssumeRole
+}
+
+// FirewallAssumeRole returns the IAM role assumed by the AWS clients of the security
+// groups and of the instances, --aws-assume-role unless overridden.
+func (cfg *Config) FirewallAssumeRole() string {
+	if cfg.AWSFirewallAssumeRole != "" {
+		return cfg.AWSFirewallAssumeRole
+	}
+	return cfg.AWSAssumeRole
+}
+
 func (cfg *Config) String() string {
 	// prevent logging of sensitive information
 	temp := *cfg
@@ -160,6 +382,9 @@ func (cfg *Config) String() string {
 	if temp.PDNSAPIKey != "" {
 		temp.PDNSAPIKey = ""
 	}
+	if temp.NS1APIKey != "" {
+		temp.NS1APIKey = passwordMask
+	}
 
 	return fmt.Sprintf("%+v", temp)
 }
@@ -182,25 +407,65 @@ func (cfg *Config) ParseFlags(args []string) error {
 	// Flags related to Kubernetes
 	app.Flag("master", "The Kubernetes API server to connect to (default: auto-detect)").Default(defaultConfig.Master).StringVar(&cfg.Master)
 	app.Flag("kubeconfig", "Retrieve target cluster configuration from a Kubernetes configuration file (default: auto-detect)").Default(defaultConfig.KubeConfig).StringVar(&cfg.KubeConfig)
+	app.Flag("kube-api-qps", "The maximum number of queries per second to the Kubernetes API server (default: 5)").Default(strconv.FormatFloat(float64(defaultConfig.KubeAPIQPS), 'f', -1, 32)).Float32Var(&cfg.KubeAPIQPS)
+	app.Flag("kube-api-burst", "The maximum number of queries to the Kubernetes API server in a burst above --kube-api-qps (default: 10)").Default(strconv.Itoa(defaultConfig.KubeAPIBurst)).IntVar(&cfg.KubeAPIBurst)
 
 	// Flags related to processing sources
-	app.Flag("source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, fake)").Required().PlaceHolder("source").EnumsVar(&cfg.Sources, "service", "fake")
+	app.Flag("source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, istio-gateway, gateway-httproute, crd, fake)").PlaceHolder("source").EnumsVar(&cfg.Sources, "service", "istio-gateway", "gateway-httproute", "crd", "fake")
 	app.Flag("namespace", "Limit sources of endpoints to a specific namespace (default: all namespaces)").Default(defaultConfig.Namespace).StringVar(&cfg.Namespace)
 	app.Flag("annotation-filter", "Filter sources managed by external-dns via annotation using label selector semantics (default: all sources)").Default(defaultConfig.AnnotationFilter).StringVar(&cfg.AnnotationFilter)
 	app.Flag("fqdn-template", "A templated string that's used to generate DNS names from sources that don't define a hostname themselves, or to add a hostname suffix when paired with the fake source (optional). Accepts comma separated list for multiple global FQDN.").Default(defaultConfig.FQDNTemplate).StringVar(&cfg.FQDNTemplate)
 	app.Flag("combine-fqdn-annotation", "Combine FQDN template and Annotations instead of overwriting").BoolVar(&cfg.CombineFQDNAndAnnotation)
 	app.Flag("compatibility", "Process annotation semantics from legacy implementations (optional, options: mate, molecule)").Default(defaultConfig.Compatibility).EnumVar(&cfg.Compatibility, "", "mate", "molecule")
-	app.Flag("publish-internal-services", "Allow external-dns to publish DNS records for ClusterIP services (optional)").BoolVar(&cfg.PublishInternal)
+	app.Flag("publish-internal-services", "Additionally publish an internal DNS name for each hostname, pointing to the internal IPs of the nodes (optional)").BoolVar(&cfg.PublishInternal)
+	app.Flag("internal-fqdn-template", "When publishing internal services, a templated string generating the internal DNS name from the {{.Hostname}}, {{.Name}} and {{.Namespace}} of the service (default: internal.{{.Hostname}})").Default(defaultConfig.InternalFQDNTemplate).StringVar(&cfg.InternalFQDNTemplate)
+
+	app.Flag("drain-period", "How long a node marked with the external-ips.alpha.openfresh.github.io/draining annotation or taint is kept in the inbound rules after being removed from the DNS records and external IPs, in duration format (default: 0s)").Default(defaultConfig.DrainPeriod.String()).DurationVar(&cfg.DrainPeriod)
+	app.Flag("node-grace-period", "How long a node missing from the API server keeps its external IPs and DNS records, e.g. during an API server hiccup, in duration format; the nodes being deleted are dropped at once (default: disabled)").Default(defaultConfig.NodeGracePeriod.String()).DurationVar(&cfg.NodeGracePeriod)
+	app.Flag("exclude-node", "Never expose the nodes with this label or whose EC2 instance has this tag, e.g. the nodes dedicated to CI, as key=value or key for any value; specify multiple times for the nodes with any of them (optional)").Default("").StringsVar(&cfg.ExcludeNodes)
+	app.Flag("aws-asg-node-tag", "List the in service instances of the EC2 autoscaling groups with this tag as nodes along with the nodes of the cluster, e.g. for the instances serving outside of Kubernetes, as key=value or key for any value; specify multiple times for groups with all the tags (optional)").Default("").StringsVar(&cfg.AWSASGNodeTags)
+	app.Flag("aws-asg-node-interval", "How long the instances listed from the autoscaling groups are reused before being listed again, in duration format (default: 1m)").Default(defaultConfig.AWSASGNodeInterval.String()).DurationVar(&cfg.AWSASGNodeInterval)
+	app.Flag("spot-policy", "How the nodes backed by spot instances are selected (default: no difference, options: deprioritize, exclude)").Default(defaultConfig.SpotPolicy).EnumVar(&cfg.SpotPolicy, "", "deprioritize", "exclude")
+	app.Flag("spot-node-selector", "The label selector identifying the nodes backed by spot instances (default: lifecycle=Ec2Spot)").Default(defaultConfig.SpotNodeSelector).StringVar(&cfg.SpotNodeSelector)
+	app.Flag("subdomain-per-cluster", "When enabled, publishes the hostnames of the services beneath a subdomain named after the cluster, so that several clusters can share a zone (default: disabled)").BoolVar(&cfg.SubdomainPerCluster)
+	app.Flag("split-horizon", "When enabled, the hostnames of the services point to the internal IPs of the nodes in the private zones and to their external IPs in the public zones, only supported by the aws provider (default: disabled)").BoolVar(&cfg.SplitHorizon)
+	app.Flag("active-slot", "The slot of the blue/green pairs of services whose IPs are published, unless overridden by the external-ips.alpha.openfresh.github.io/active-slot annotation of their namespace (default: blue, options: blue, green)").Default(defaultConfig.ActiveSlot).EnumVar(&cfg.ActiveSlot, "blue", "green")
+	app.Flag("service-label", "The label of the services copied to the labels of their records and inbound rules, e.g. to filter them downstream; specify multiple times for multiple labels (optional)").Default("").StringsVar(&cfg.ServiceLabels)
+	app.Flag("firewall-name-template", "A templated string naming the security groups of the services from their {{.Service}}, {{.Namespace}}, {{.Cluster}} and a short {{.Hash}} of them; the existing security groups named after the default scheme are kept (default: the service, its namespace unless default and the cluster, separated by dots)").Default(defaultConfig.FirewallNameTemplate).StringVar(&cfg.FirewallNameTemplate)
+	app.Flag("firewall-node-port-range", "Open the node port range of the cluster, as first-last or auto to read it from the kube-apiserver pods of kube-system, by a single rule per protocol in the security groups of the NodePort services instead of their ports (default: disabled)").Default(defaultConfig.FirewallNodePortRange).StringVar(&cfg.FirewallNodePortRange)
+	app.Flag("fake-endpoints", "When using the fake source, the number of endpoints generated (default: 10)").Default(strconv.Itoa(defaultConfig.FakeEndpoints)).IntVar(&cfg.FakeEndpoints)
+	app.Flag("fake-inbound-rules", "When using the fake source, the number of inbound rules generated (default: 0)").Default(strconv.Itoa(defaultConfig.FakeInboundRules)).IntVar(&cfg.FakeInboundRules)
+	app.Flag("fake-extips", "When using the fake source, the number of services whose external IPs are generated (default: 0)").Default(strconv.Itoa(defaultConfig.FakeExtIPs)).IntVar(&cfg.FakeExtIPs)
+	app.Flag("fake-churn", "When using the fake source, the share of the targets, instances and external IPs changed on each synchronization, between 0 and 1 (default: 0)").Default(strconv.FormatFloat(defaultConfig.FakeChurn, 'f', -1, 64)).Float64Var(&cfg.FakeChurn)
+	app.Flag("fake-seed", "When using the fake source, the seed of the generated names and targets, so that runs can be repeated (default: random)").Default(strconv.FormatInt(defaultConfig.FakeSeed, 10)).Int64Var(&cfg.FakeSeed)
+	app.Flag("crd-source-apiversion", "When using the crd source, the API version of the resource holding the endpoints (default: externaldns.k8s.io/v1alpha1)").Default(defaultConfig.CRDSourceAPIVersion).StringVar(&cfg.CRDSourceAPIVersion)
+	app.Flag("crd-source-kind", "When using the crd source, the kind of the resource holding the endpoints (default: DNSEndpoint)").Default(defaultConfig.CRDSourceKind).StringVar(&cfg.CRDSourceKind)
+	app.Flag("source-errors", "How the failure of a source is handled: fail-fast fails the synchronization, best-effort synchronizes the other sources and keeps the previous setting of the failing source (default: fail-fast, options: fail-fast, best-effort)").Default(defaultConfig.SourceErrors).EnumVar(&cfg.SourceErrors, "fail-fast", "best-effort")
 
 	// Flags related to providers
-	app.Flag("provider", "The DNS provider where the DNS records will be created (required, options: aws, aws-sd, google, azure, cloudflare, digitalocean, dnsimple, infoblox, dyn, designate, coredns, skydns, inmemory, pdns, oci, exoscale)").Required().PlaceHolder("provider").EnumVar(&cfg.Provider, "aws", "aws-sd", "google", "azure", "cloudflare", "digitalocean", "dnsimple", "infoblox", "dyn", "designate", "coredns", "skydns", "inmemory", "pdns", "oci", "exoscale")
+	app.Flag("provider", "The DNS provider where the DNS records will be created (required, options: the DNS providers of --list-providers)").PlaceHolder("provider").StringVar(&cfg.Provider)
+	app.Flag("firewall-provider", "The firewall provider where the inbound rules for the exposed nodes will be managed (default: aws, options: the firewall providers of --list-providers)").Default(defaultConfig.FirewallProvider).StringVar(&cfg.FirewallProvider)
 	app.Flag("domain-filter", "Limit possible target zones by a domain suffix; specify multiple times for multiple domains (optional)").Default("").StringsVar(&cfg.DomainFilter)
+	app.Flag("exclude-domains", "Exclude a domain and its subdomains from the target zones and records, even when they match the domain filter; specify multiple times for multiple domains (optional)").Default("").StringsVar(&cfg.ExcludeDomains)
 	app.Flag("zone-id-filter", "Filter target zones by hosted zone id; specify multiple times for multiple zones (optional)").Default("").StringsVar(&cfg.ZoneIDFilter)
+	app.Flag("internal-provider", "The DNS provider where the records pointing to the internal IPs of the nodes will be created, for split-horizon DNS (optional, options: the DNS providers of --list-providers)").Default(defaultConfig.InternalProvider).StringVar(&cfg.InternalProvider)
+	app.Flag("internal-domain-filter", "Limit possible target zones of the internal provider by a domain suffix; specify multiple times for multiple domains (optional)").Default("").StringsVar(&cfg.InternalDomainFilter)
+	app.Flag("internal-zone-id-filter", "Filter target zones of the internal provider by hosted zone id; specify multiple times for multiple zones (optional)").Default("").StringsVar(&cfg.InternalZoneIDFilter)
+	app.Flag("internal-aws-zone-type", "When using the AWS internal provider, filter for zones of this type (optional, options: public, private)").Default(defaultConfig.InternalAWSZoneType).EnumVar(&cfg.InternalAWSZoneType, "", "public", "private")
 	app.Flag("google-project", "When using the Google provider, current project is auto-detected, when running on GCP. Specify other project with this. Must be specified when running outside GCP.").Default(defaultConfig.GoogleProject).StringVar(&cfg.GoogleProject)
 	app.Flag("aws-zone-type", "When using the AWS provider, filter for zones of this type (optional, options: public, private)").Default(defaultConfig.AWSZoneType).EnumVar(&cfg.AWSZoneType, "", "public", "private")
 	app.Flag("aws-assume-role", "When using the AWS provider, assume this IAM role. Useful for hosted zones in another AWS account. Specify the full ARN, e.g. `arn:aws:iam::123455567:role/external-dns` (optional)").Default(defaultConfig.AWSAssumeRole).StringVar(&cfg.AWSAssumeRole)
+	app.Flag("aws-dns-assume-role", "When using the AWS DNS provider, assume this IAM role rather than --aws-assume-role, e.g. for hosted zones in a shared DNS account while the instances are in the account of the cluster. Specify the full ARN (optional)").Default(defaultConfig.AWSDNSAssumeRole).StringVar(&cfg.AWSDNSAssumeRole)
+	app.Flag("aws-firewall-assume-role", "When using the AWS firewall provider, assume this IAM role rather than --aws-assume-role, e.g. for the security groups and instances of the cluster in another account than the hosted zones. Specify the full ARN (optional)").Default(defaultConfig.AWSFirewallAssumeRole).StringVar(&cfg.AWSFirewallAssumeRole)
+	app.Flag("aws-region", "The region of all the AWS clients, the security groups of the nodes being managed in the region of their availability zone (default: the region of the AWS configuration)").Default(defaultConfig.AWSRegion).StringVar(&cfg.AWSRegion)
+	app.Flag("private-zone-vpc-filter", "When using the AWS provider, only manage the private zones associated with one of these VPCs, auto standing for the VPC of the nodes; specify multiple times for multiple VPCs (optional)").Default("").StringsVar(&cfg.PrivateZoneVPCFilter)
 	app.Flag("aws-max-change-count", "When using the AWS provider, set the maximum number of changes that will be applied.").Default(strconv.Itoa(defaultConfig.AWSMaxChangeCount)).IntVar(&cfg.AWSMaxChangeCount)
+	app.Flag("aws-batch-change-strategy", "When using the AWS provider, how the changes of a hosted zone exceeding --aws-max-change-count are deferred to the next batches (default: by-name, options: by-name, deletes-last)").Default(defaultConfig.AWSBatchChangeStrategy).EnumVar(&cfg.AWSBatchChangeStrategy, "by-name", "deletes-last")
 	app.Flag("aws-evaluate-target-health", "When using the AWS provider, set whether to evaluate the health of a DNS target (default: enabled, disable with --no-aws-evaluate-target-health)").Default(strconv.FormatBool(defaultConfig.AWSEvaluateTargetHealth)).BoolVar(&cfg.AWSEvaluateTargetHealth)
+	app.Flag("aws-records-page-size", "When using the AWS provider, set the maximum number of records listed per request to Route53 (default: 300, the maximum allowed)").Default(strconv.Itoa(defaultConfig.AWSRecordsPageSize)).IntVar(&cfg.AWSRecordsPageSize)
+	app.Flag("aws-zone-concurrency", "When using the AWS provider, set the number of hosted zones whose records are listed at the same time (default: 1)").Default(strconv.Itoa(defaultConfig.AWSZoneConcurrency)).IntVar(&cfg.AWSZoneConcurrency)
+	app.Flag("aws-records-cache-ttl", "When using the AWS provider, reuse the records of a hosted zone for this duration as long as its number of records doesn't change and the zone isn't changed by external-ips, in duration format (default: disabled)").Default(defaultConfig.AWSRecordsCacheTTL.String()).DurationVar(&cfg.AWSRecordsCacheTTL)
+	app.Flag("aws-global-accelerator-arn", "Expose the services annotated with external-ips.alpha.openfresh.github.io/global-accelerator through the listeners of this AWS Global Accelerator, dedicated to the cluster, and publish its static IPs in place of those of the nodes (optional, requires --firewall-provider=aws)").Default(defaultConfig.AWSGlobalAcceleratorARN).StringVar(&cfg.AWSGlobalAcceleratorARN)
 	app.Flag("azure-config-file", "When using the Azure provider, specify the Azure configuration file (required when --provider=azure").Default(defaultConfig.AzureConfigFile).StringVar(&cfg.AzureConfigFile)
 	app.Flag("azure-resource-group", "When using the Azure provider, override the Azure resource group to use (optional)").Default(defaultConfig.AzureResourceGroup).StringVar(&cfg.AzureResourceGroup)
 	app.Flag("cloudflare-proxied", "When using the Cloudflare provider, specify if the proxy mode must be enabled (default: disabled)").BoolVar(&cfg.CloudflareProxied)
@@ -214,6 +479,7 @@ func (cfg *Config) ParseFlags(args []string) error {
 	app.Flag("dyn-username", "When using the Dyn provider, specify the Username").Default("").StringVar(&cfg.DynUsername)
 	app.Flag("dyn-password", "When using the Dyn provider, specify the pasword").Default("").StringVar(&cfg.DynPassword)
 	app.Flag("dyn-min-ttl", "Minimal TTL (in seconds) for records. This value will be used if the provided TTL for a service is lower than this.").IntVar(&cfg.DynMinTTLSeconds)
+	app.Flag("openstack-region", "When using the OpenStack firewall provider, specify the region of the networking and compute endpoints (optional)").Default(defaultConfig.OpenStackRegion).StringVar(&cfg.OpenStackRegion)
 	app.Flag("oci-config-file", "When using the OCI provider, specify the OCI configuration file (required when --provider=oci").Default(defaultConfig.OCIConfigFile).StringVar(&cfg.OCIConfigFile)
 
 	app.Flag("inmemory-zone", "Provide a list of pre-configured zones for the inmemory provider; specify multiple times for multiple zones (optional)").Default("").StringsVar(&cfg.InMemoryZones)
@@ -222,37 +488,102 @@ func (cfg *Config) ParseFlags(args []string) error {
 	app.Flag("pdns-tls-enabled", "When using the PowerDNS/PDNS provider, specify whether to use TLS (default: false, requires --tls-ca, optionally specify --tls-client-cert and --tls-client-cert-key)").Default(strconv.FormatBool(defaultConfig.PDNSTLSEnabled)).BoolVar(&cfg.PDNSTLSEnabled)
 
 	// Flags related to TLS communication
-	app.Flag("tls-ca", "When using TLS communication, the path to the certificate authority to verify server communications (optionally specify --tls-client-cert for two-way TLS)").Default(defaultConfig.TLSCA).StringVar(&cfg.TLSCA)
-	app.Flag("tls-client-cert", "When using TLS communication, the path to the certificate to present as a client (not required for TLS)").Default(defaultConfig.TLSClientCert).StringVar(&cfg.TLSClientCert)
+	app.Flag("tls-ca", "When using TLS communication, the path to the certificate authority to verify server communications (optionally specify --tls-client-cert for two-way TLS), or the clients of the metrics endpoint with --metrics-tls").Default(defaultConfig.TLSCA).StringVar(&cfg.TLSCA)
+	app.Flag("tls-client-cert", "When using TLS communication, the path to the certificate to present as a client (not required for TLS), or as the metrics endpoint with --metrics-tls").Default(defaultConfig.TLSClientCert).StringVar(&cfg.TLSClientCert)
 	app.Flag("tls-client-cert-key", "When using TLS communication, the path to the certificate key to use with the client certificate (not required for TLS)").Default(defaultConfig.TLSClientCertKey).StringVar(&cfg.TLSClientCertKey)
 
 	app.Flag("exoscale-endpoint", "Provide the endpoint for the Exoscale provider").Default(defaultConfig.ExoscaleEndpoint).StringVar(&cfg.ExoscaleEndpoint)
 	app.Flag("exoscale-apikey", "Provide your API Key for the Exoscale provider").Default(defaultConfig.ExoscaleAPIKey).StringVar(&cfg.ExoscaleAPIKey)
 	app.Flag("exoscale-apisecret", "Provide your API Secret for the Exoscale provider").Default(defaultConfig.ExoscaleAPISecret).StringVar(&cfg.ExoscaleAPISecret)
 
+	app.Flag("ns1-endpoint", "When using the NS1 provider, specify the URL of the API endpoint to target (default: https://api.nsone.net/v1/)").Default(defaultConfig.NS1Endpoint).StringVar(&cfg.NS1Endpoint)
+	app.Flag("ns1-ignoressl", "When using the NS1 provider, skip verification of the API endpoint SSL certificate (default: disabled)").Default(strconv.FormatBool(defaultConfig.NS1IgnoreSSL)).BoolVar(&cfg.NS1IgnoreSSL)
+	app.Flag("ns1-apikey", "When using the NS1 provider, specify the API key to use to authorize requests (required when --provider=ns1)").Default(defaultConfig.NS1APIKey).StringVar(&cfg.NS1APIKey)
+
 	// Flags related to policies
 	app.Flag("policy", "Modify how DNS records are sychronized between sources and providers (default: sync, options: sync, upsert-only)").Default(defaultConfig.Policy).EnumVar(&cfg.Policy, "sync", "upsert-only")
 
 	// Flags related to the registry
-	app.Flag("registry", "The registry implementation to use to keep track of DNS record ownership (default: txt, options: txt, noop, aws-sd)").Default(defaultConfig.Registry).EnumVar(&cfg.Registry, "txt", "noop", "aws-sd")
-	app.Flag("txt-owner-id", "When using the TXT registry, a name that identifies this instance of ExternalDNS (default: default)").Default(defaultConfig.TXTOwnerID).StringVar(&cfg.TXTOwnerID)
+	app.Flag("registry", "The registry implementation to use to keep track of DNS record ownership (default: txt, options: txt, noop, aws-sd, dynamodb)").Default(defaultConfig.Registry).EnumVar(&cfg.Registry, "txt", "noop", "aws-sd", "dynamodb")
+	app.Flag("txt-owner-id", "A name that identifies this instance of external-ips, recorded in the TXT records of the TXT registry and the managed-by annotation of the services whose external IPs it manages (default: default)").Default(defaultConfig.TXTOwnerID).StringVar(&cfg.TXTOwnerID)
+	app.Flag("txt-read-owner-id", "When using the TXT registry, another owner id whose records this instance manages as its own, e.g. its former owner id; the records are given the owner id of --txt-owner-id as they are updated; specify multiple times for multiple owner ids (optional)").Default("").StringsVar(&cfg.TXTReadOwnerIDs)
+	app.Flag("txt-repair-ownership", "When using the TXT registry, restores the TXT records of the unowned records desired by a single resource, e.g. after their TXT records were deleted (default: disabled)").BoolVar(&cfg.TXTRepairOwnership)
+	app.Flag("txt-encryption-key-file", "When using the TXT registry, a file holding the key encrypting the labels of the TXT records, e.g. mounted from a Secret; the TXT records in plain text are still read, and encrypted as they are updated (optional)").Default(defaultConfig.TXTEncryptionKeyFile).StringVar(&cfg.TXTEncryptionKeyFile)
+	app.Flag("txt-format", "When using the TXT registry, the format of the TXT records written: v1 names them after their record, v2 adds the record type to the name, both writes both; both formats are read whatever the format (default: v1, options: v1, v2, both)").Default(defaultConfig.TXTFormat).EnumVar(&cfg.TXTFormat, "v1", "v2", "both")
 	app.Flag("txt-prefix", "When using the TXT registry, a custom string that's prefixed to each ownership DNS record (optional)").Default(defaultConfig.TXTPrefix).StringVar(&cfg.TXTPrefix)
 
 	// Flags related to the main control loop
+	app.Flag("dynamodb-table", "When using the DynamoDB registry, the table holding the ownership of the records, with the string hash key Owner and range key Name (required when --registry=dynamodb)").Default(defaultConfig.DynamoDBTable).StringVar(&cfg.DynamoDBTable)
+	app.Flag("dynamodb-region", "The region of the DynamoDB tables of the DynamoDB registry and firewall history (default: the region of the AWS configuration)").Default(defaultConfig.DynamoDBRegion).StringVar(&cfg.DynamoDBRegion)
+	app.Flag("dynamodb-mirror-txt", "When using the DynamoDB registry, keep the TXT records of the TXT registry up to date as well, e.g. before switching back to it (default: disabled)").BoolVar(&cfg.DynamoDBMirrorTXT)
 	app.Flag("txt-cache-interval", "The interval between cache synchronizations in duration format (default: disabled)").Default(defaultConfig.TXTCacheInterval.String()).DurationVar(&cfg.TXTCacheInterval)
+	app.Flag("txt-replan-stale", "When using the TXT registry, read the records again and plan the changes once more when the DNS provider rejects them as the records changed since they were read, e.g. by another instance while they were cached, rather than failing the synchronization (default: disabled)").BoolVar(&cfg.TXTReplanStale)
+	app.Flag("dns-cache-interval", "The interval between reads of the records of the DNS providers, with any registry but aws-sd, in duration format; the records are read again after each change (default: disabled)").Default(defaultConfig.DNSCacheInterval.String()).DurationVar(&cfg.DNSCacheInterval)
+	app.Flag("firewall-cache-interval", "The interval between synchronizations of the cached firewall rules in duration format (default: disabled)").Default(defaultConfig.FirewallCacheInterval.String()).DurationVar(&cfg.FirewallCacheInterval)
+	app.Flag("firewall-gc-interval", "The interval between two searches for the owned security groups which are neither desired nor attached to any instance, in duration format (default: disabled)").Default(defaultConfig.FirewallGCInterval.String()).DurationVar(&cfg.FirewallGCInterval)
+	app.Flag("firewall-history", "Record a snapshot of the desired inbound rules whenever they change, for audits (optional, options: configmap, dynamodb)").Default(defaultConfig.FirewallHistory).EnumVar(&cfg.FirewallHistory, "", "configmap", "dynamodb")
+	app.Flag("firewall-history-configmap", "When using the configmap firewall history, the ConfigMap holding the snapshots as namespace/name (default: kube-system/external-ips-firewall-history)").Default(defaultConfig.FirewallHistoryCM).StringVar(&cfg.FirewallHistoryCM)
+	app.Flag("firewall-history-table", "When using the dynamodb firewall history, the table holding the snapshots, with the string hash key Cluster and number range key Time (required when --firewall-history=dynamodb)").Default(defaultConfig.FirewallHistoryTable).StringVar(&cfg.FirewallHistoryTable)
+	app.Flag("firewall-history-retention", "How long the snapshots of the firewall history are kept, in duration format (default: 720h)").Default(defaultConfig.FirewallHistoryTTL.String()).DurationVar(&cfg.FirewallHistoryTTL)
+	app.Flag("firewall-gc-grace-period", "How long an orphaned security group is kept before being deleted, in duration format (default: 1h)").Default(defaultConfig.FirewallGCGracePeriod.String()).DurationVar(&cfg.FirewallGCGracePeriod)
 	app.Flag("interval", "The interval between two consecutive synchronizations in duration format (default: 1m)").Default(defaultConfig.Interval.String()).DurationVar(&cfg.Interval)
+	app.Flag("failure-threshold", "The number of consecutive failures after which the synchronization of a subsystem is paused (default: 5, disable with 0)").Default(strconv.Itoa(defaultConfig.FailureThreshold)).IntVar(&cfg.FailureThreshold)
+	app.Flag("failure-pause", "How long the synchronization of a consistently failing subsystem is paused in duration format (default: 5m)").Default(defaultConfig.FailurePause.String()).DurationVar(&cfg.FailurePause)
+	app.Flag("stuck-threshold", "The number of consecutive failures with the same error after which the changes of a zone or a security group are backed off while the others are applied (default: 3, disable with 0)").Default(strconv.Itoa(defaultConfig.StuckThreshold)).IntVar(&cfg.StuckThreshold)
+	app.Flag("stuck-pause", "How long the changes of a stuck zone or security group are backed off in duration format (default: 30m)").Default(defaultConfig.StuckPause.String()).DurationVar(&cfg.StuckPause)
+	app.Flag("cutover-delay", "When the targets of a record are entirely replaced, how long the old targets are kept alongside the new ones, or the TTL of the record if longer, in duration format (default: disabled)").Default(defaultConfig.CutoverDelay.String()).DurationVar(&cfg.CutoverDelay)
+	app.Flag("propagation-timeout", "Verify that the created and updated records are served by their authoritative name servers within this duration, reporting a metric and an event on their service otherwise, in duration format (default: disabled)").Default(defaultConfig.PropagationTimeout.String()).DurationVar(&cfg.PropagationTimeout)
+	app.Flag("notify-webhook-url", "The URL the applied changes, the large plans and the subsystems paused after consecutive failures are posted to, e.g. a Slack incoming webhook (optional)").Default(defaultConfig.NotifyWebhookURL).StringVar(&cfg.NotifyWebhookURL)
+	app.Flag("notify-format", "The format of the notifications: json posts the event, slack its message (default: json, options: json, slack)").Default(defaultConfig.NotifyFormat).EnumVar(&cfg.NotifyFormat, "json", "slack")
+	app.Flag("notify-template", "A templated string rendering the notifications in place of --notify-format, given the event and a json function, e.g. {\"text\":{{json .Message}}} (optional)").Default(defaultConfig.NotifyTemplate).StringVar(&cfg.NotifyTemplate)
+	app.Flag("notify-large-plan", "The number of changes from which a plan is notified before being applied (default: disabled)").Default(strconv.Itoa(defaultConfig.NotifyLargePlan)).IntVar(&cfg.NotifyLargePlan)
+	app.Flag("trace-otlp-endpoint", "The OTLP/HTTP endpoint of an OpenTelemetry collector the spans of every synchronization, down to the provider calls, are exported to, e.g. http://localhost:4318 (optional)").Default(defaultConfig.TraceOTLPEndpoint).StringVar(&cfg.TraceOTLPEndpoint)
+	app.Flag("trace-otlp-header", "A header sent along with the exported spans as key=value, e.g. for the authentication to the collector; specify multiple times for multiple headers (optional)").Default("").StringsVar(&cfg.TraceOTLPHeaders)
+	app.Flag("concurrent-sync", "When enabled, synchronizes the external IPs, firewall and DNS subsystems in parallel rather than one after the other, shortening long synchronizations (default: disabled)").BoolVar(&cfg.ConcurrentSync)
 	app.Flag("once", "When enabled, exits the synchronization loop after the first iteration (default: disabled)").BoolVar(&cfg.Once)
-	app.Flag("dry-run", "When enabled, prints DNS record changes rather than actually performing them (default: disabled)").BoolVar(&cfg.DryRun)
+	app.Flag("dry-run", "When enabled, prints the DNS record, firewall rule and external IP changes, as sent to the providers, rather than actually performing them (default: disabled)").BoolVar(&cfg.DryRun)
+	app.Flag("monitor-only", "When enabled, computes the changes, exports them as drift metrics and records them as events on the services without ever applying them, e.g. before granting write permissions (default: disabled)").BoolVar(&cfg.MonitorOnly)
+	app.Flag("service-finalizer", "When enabled, adds a finalizer to the services whose external IPs are managed, so that their deletion waits until their records and inbound rules are removed (default: disabled)").BoolVar(&cfg.ServiceFinalizer)
+	app.Flag("manage", "The comma separated subsystems to manage, the others being neither read nor planned, e.g. firewall,extip when the records are managed by another controller (default: dns,firewall,extip, options: dns, firewall, extip)").Default(defaultConfig.Manage).StringVar(&cfg.Manage)
+	app.Flag("extip-provider", "The provider setting the external IPs of the services (default: kubernetes, options: the external IPs providers of --list-providers)").Default(defaultConfig.ExtIPProvider).StringVar(&cfg.ExtIPProvider)
+	app.Flag("extip-update-qps", "The maximum number of services whose external IPs are updated per second, once a chunk has been updated at once; 0 doesn't limit them (default: 0)").Default(strconv.FormatFloat(float64(defaultConfig.ExtIPUpdateQPS), 'f', -1, 32)).Float32Var(&cfg.ExtIPUpdateQPS)
+	app.Flag("extip-update-chunk-size", "The number of services whose external IPs are updated at once, after which the progress is reported; 0 updates them all at once (default: 10)").Default(strconv.Itoa(defaultConfig.ExtIPUpdateChunkSize)).IntVar(&cfg.ExtIPUpdateChunkSize)
 
 	// Miscellaneous flags
+	app.Flag("list-providers", "When enabled, prints the registered DNS, firewall and external IPs providers and exits (default: disabled)").BoolVar(&cfg.ListProviders)
 	app.Flag("log-format", "The format in which log messages are printed (default: text, options: text, json)").Default(defaultConfig.LogFormat).EnumVar(&cfg.LogFormat, "text", "json")
 	app.Flag("metrics-address", "Specify where to serve the metrics and health check endpoint (default: :7979)").Default(defaultConfig.MetricsAddress).StringVar(&cfg.MetricsAddress)
+	app.Flag("metrics-tls", "When enabled, serves the metrics and health check endpoint over TLS with the certificate of --tls-client-cert and --tls-client-cert-key, the metrics only to the clients presenting a certificate signed by --tls-ca if specified (default: disabled)").BoolVar(&cfg.MetricsTLS)
+	app.Flag("debug-state", "When enabled, serves the desired setting, the current records, rules and external IPs, and the plans of the latest full synchronization as JSON on /debug/state of the metrics endpoint (default: disabled)").BoolVar(&cfg.DebugState)
 	app.Flag("log-level", "Set the level of logging. (default: info, options: panic, debug, info, warn, error, fatal").Default(defaultConfig.LogLevel).EnumVar(&cfg.LogLevel, allLogLevelsAsStrings()...)
 
-	_, err := app.Parse(args)
+	// Commands
+	app.Command("run", "Synchronize the exposed Services with the providers (default)").Default()
+	permissions := app.Command("permissions", "Print the IAM policy required by the configured providers and exit")
+	permissions.Flag("cluster-name", "The name of the cluster found in the KubernetesCluster tag of the nodes, used to restrict the policy to the resources of the cluster (required when --firewall-provider=aws)").Default(defaultConfig.ClusterName).StringVar(&cfg.ClusterName)
+	canary := app.Command("canary", "Create, resolve and delete a canary record and security group with the configured providers, report the latency of every step and exit with an error if any failed")
+	canary.Flag("canary-hostname", "The DNS name of the canary record, in a zone managed by the DNS provider (required)").Default(defaultConfig.CanaryHostname).StringVar(&cfg.CanaryHostname)
+	canary.Flag("canary-resolver", "The name server the canary record is looked up with, as host:port (default: the system resolver)").Default(defaultConfig.CanaryResolver).StringVar(&cfg.CanaryResolver)
+	canary.Flag("canary-timeout", "How long the canary record may take to resolve in duration format (default: 2m)").Default(defaultConfig.CanaryTimeout.String()).DurationVar(&cfg.CanaryTimeout)
+	firewallHistory := app.Command("firewall-history", "Print the snapshot of the desired inbound rules in effect at a point in time from the --firewall-history store and exit")
+	firewallHistory.Flag("at", "The point in time in RFC3339 format, e.g. 2018-06-01T12:00:00Z (default: now)").Default(defaultConfig.FirewallHistoryAt).StringVar(&cfg.FirewallHistoryAt)
+	validate := app.Command("validate", "Project the usage of the cloud quotas once the desired setting is applied, report it and exit with an error if any quota would be exceeded, without applying anything")
+	validate.Flag("quota-records-per-zone", "The maximum number of record sets of a hosted zone, 0 disables the check (default: 10000)").Default(strconv.Itoa(defaultConfig.QuotaRecordsPerZone)).IntVar(&cfg.QuotaRecordsPerZone)
+	validate.Flag("quota-security-groups", "The maximum number of security groups of the VPC of the cluster, 0 disables the check (default: 2500)").Default(strconv.Itoa(defaultConfig.QuotaSecurityGroups)).IntVar(&cfg.QuotaSecurityGroups)
+	validate.Flag("quota-rules-per-group", "The maximum number of inbound rules of a security group, each source range or security group of a port counting as a rule, 0 disables the check (default: 60)").Default(strconv.Itoa(defaultConfig.QuotaRulesPerGroup)).IntVar(&cfg.QuotaRulesPerGroup)
+	validate.Flag("quota-external-ips-per-service", "The maximum number of external IPs of a service, 0 disables the check (default: 0)").Default(strconv.Itoa(defaultConfig.QuotaExtIPsPerService)).IntVar(&cfg.QuotaExtIPsPerService)
+	export := app.Command("export", "Write the snapshot of the records owned by --txt-owner-id, the inbound rules of the security groups and the managed external IPs as YAML and exit")
+	export.Flag("snapshot-file", "The file the snapshot is written to, - for the standard output (default: -)").Default(defaultConfig.SnapshotFile).StringVar(&cfg.SnapshotFile)
+	importCmd := app.Command("import", "Create or update the records, security groups and external IPs of a snapshot written by export under the ownership of --txt-owner-id, report the changes and exit, without deleting anything")
+	importCmd.Flag("snapshot-file", "The file the snapshot is read from, - for the standard input (default: -)").Default(defaultConfig.SnapshotFile).StringVar(&cfg.SnapshotFile)
+	planCmd := app.Command("plan", "Print the services, the nodes they're selected on, their security groups and DNS records, along with the changes pending on them, as a diagram and exit, without applying anything")
+	planCmd.Flag("format", "The format of the diagram (default: mermaid, options: mermaid, dot)").Default(defaultConfig.PlanFormat).EnumVar(&cfg.PlanFormat, "mermaid", "dot")
+
+	command, err := app.Parse(args)
 	if err != nil {
 		return err
 	}
+	cfg.Command = command
 
 	return nil
 }
@@ -32,20 +32,73 @@ import (
 
 var (
 	minimalConfig = &Config{
+		Command:                 "run",
+		ClusterName:             "",
+		CanaryHostname:          "",
+		CanaryResolver:          "",
+		CanaryTimeout:           2 * time.Minute,
+		FirewallHistoryAt:       "",
+		QuotaRecordsPerZone:     10000,
+		QuotaSecurityGroups:     2500,
+		QuotaRulesPerGroup:      60,
+		QuotaExtIPsPerService:   0,
+		SnapshotFile:            "-",
+		PlanFormat:              "mermaid",
 		Master:                  "",
 		KubeConfig:              "",
+		KubeAPIQPS:              5,
+		KubeAPIBurst:            10,
 		Sources:                 []string{"service"},
 		Namespace:               "",
 		FQDNTemplate:            "",
+		InternalFQDNTemplate:    "internal.{{.Hostname}}",
+		DrainPeriod:             0,
+		NodeGracePeriod:         0,
+		ExcludeNodes:            []string{""},
+		AWSASGNodeTags:          []string{""},
+		AWSASGNodeInterval:      time.Minute,
+		SpotPolicy:              "",
+		SpotNodeSelector:        "lifecycle=Ec2Spot",
+		SubdomainPerCluster:     false,
+		SplitHorizon:            false,
+		ActiveSlot:              "blue",
+		ServiceLabels:           []string{""},
+		FirewallNameTemplate:    "",
+		FirewallNodePortRange:   "",
+		FakeEndpoints:           10,
+		FakeInboundRules:        0,
+		FakeExtIPs:              0,
+		FakeChurn:               0,
+		FakeSeed:                0,
+		CRDSourceAPIVersion:     "externaldns.k8s.io/v1alpha1",
+		CRDSourceKind:           "DNSEndpoint",
+		SourceErrors:            "fail-fast",
 		Compatibility:           "",
 		Provider:                "google",
+		FirewallProvider:        "aws",
 		GoogleProject:           "",
 		DomainFilter:            []string{""},
+		ExcludeDomains:          []string{""},
 		ZoneIDFilter:            []string{""},
 		AWSZoneType:             "",
+		InternalProvider:        "",
+		ExtIPProvider:           "kubernetes",
+		Manage:                  "dns,firewall,extip",
+		ListProviders:           false,
+		InternalDomainFilter:    []string{""},
+		InternalZoneIDFilter:    []string{""},
+		InternalAWSZoneType:     "",
 		AWSAssumeRole:           "",
+		AWSDNSAssumeRole:        "",
+		AWSFirewallAssumeRole:   "",
+		AWSRegion:               "",
+		PrivateZoneVPCFilter:    []string{""},
 		AWSMaxChangeCount:       4000,
+		AWSBatchChangeStrategy:  "by-name",
 		AWSEvaluateTargetHealth: true,
+		AWSRecordsPageSize:      300,
+		AWSZoneConcurrency:      1,
+		AWSRecordsCacheTTL:      0,
 		AzureConfigFile:         "/etc/kubernetes/azure.json",
 		AzureResourceGroup:      "",
 		CloudflareProxied:       false,
@@ -62,34 +115,128 @@ var (
 		Policy:                  "sync",
 		Registry:                "txt",
 		TXTOwnerID:              "default",
+		TXTReadOwnerIDs:         []string{""},
+		TXTRepairOwnership:      false,
+		TXTEncryptionKeyFile:    "",
+		TXTFormat:               "v1",
 		TXTPrefix:               "",
+		DynamoDBTable:           "",
+		DynamoDBRegion:          "",
+		DynamoDBMirrorTXT:       false,
 		TXTCacheInterval:        0,
+		TXTReplanStale:          false,
+		DNSCacheInterval:        0,
+		FirewallCacheInterval:   0,
+		FirewallGCInterval:      0,
+		FirewallHistory:         "",
+		FirewallHistoryCM:       "kube-system/external-ips-firewall-history",
+		FirewallHistoryTable:    "",
+		FirewallHistoryTTL:      30 * 24 * time.Hour,
+		FirewallGCGracePeriod:   time.Hour,
 		Interval:                time.Minute,
+		FailureThreshold:        5,
+		FailurePause:            5 * time.Minute,
+		StuckThreshold:          3,
+		StuckPause:              30 * time.Minute,
+		CutoverDelay:            0,
+		PropagationTimeout:      0,
+		NotifyWebhookURL:        "",
+		NotifyFormat:            "json",
+		NotifyTemplate:          "",
+		NotifyLargePlan:         0,
+		TraceOTLPEndpoint:       "",
+		TraceOTLPHeaders:        []string{""},
+		ConcurrentSync:          false,
 		Once:                    false,
 		DryRun:                  false,
+		MonitorOnly:             false,
+		ServiceFinalizer:        false,
+		ExtIPUpdateQPS:          0,
+		ExtIPUpdateChunkSize:    10,
 		LogFormat:               "text",
 		MetricsAddress:          ":7979",
+		MetricsTLS:              false,
+		DebugState:              false,
 		LogLevel:                logrus.InfoLevel.String(),
 		ExoscaleEndpoint:        "https://api.exoscale.ch/dns",
 		ExoscaleAPIKey:          "",
 		ExoscaleAPISecret:       "",
+		NS1Endpoint:             "",
+		NS1IgnoreSSL:            false,
+		NS1APIKey:               "",
+		OpenStackRegion:         "",
 	}
 
 	overriddenConfig = &Config{
+		Command:                 "run",
+		ClusterName:             "",
+		CanaryHostname:          "",
+		CanaryResolver:          "",
+		CanaryTimeout:           2 * time.Minute,
+		FirewallHistoryAt:       "",
+		QuotaRecordsPerZone:     10000,
+		QuotaSecurityGroups:     2500,
+		QuotaRulesPerGroup:      60,
+		QuotaExtIPsPerService:   0,
+		SnapshotFile:            "-",
+		PlanFormat:              "mermaid",
 		Master:                  "http://127.0.0.1:8080",
 		KubeConfig:              "/some/path",
+		KubeAPIQPS:              20,
+		KubeAPIBurst:            40,
 		Sources:                 []string{"service"},
 		Namespace:               "namespace",
 		FQDNTemplate:            "{{.Name}}.service.example.com",
+		PublishInternal:         true,
+		InternalFQDNTemplate:    "{{.Name}}.vpn.example.com",
+		DrainPeriod:             2 * time.Minute,
+		NodeGracePeriod:         5 * time.Minute,
+		ExcludeNodes:            []string{"dedicated=ci", "spot"},
+		AWSASGNodeTags:          []string{"role=game-server", "external-ips"},
+		AWSASGNodeInterval:      30 * time.Second,
+		SpotPolicy:              "deprioritize",
+		SpotNodeSelector:        "node-role.kubernetes.io/spot-worker",
+		SubdomainPerCluster:     true,
+		SplitHorizon:            true,
+		ActiveSlot:              "green",
+		ServiceLabels:           []string{"tier", "app.kubernetes.io/team"},
+		FirewallNameTemplate:    "{{.Namespace}}-{{.Service}}-{{.Hash}}.{{.Cluster}}",
+		FirewallNodePortRange:   "auto",
+		FakeEndpoints:           10000,
+		FakeInboundRules:        500,
+		FakeExtIPs:              500,
+		FakeChurn:               0.05,
+		FakeSeed:                42,
+		CRDSourceAPIVersion:     "example.org/v1",
+		CRDSourceKind:           "Record",
+		SourceErrors:            "best-effort",
 		Compatibility:           "mate",
 		Provider:                "google",
+		FirewallProvider:        "aws",
 		GoogleProject:           "project",
 		DomainFilter:            []string{"example.org", "company.com"},
+		ExcludeDomains:          []string{"internal.example.org", "staging.company.com"},
 		ZoneIDFilter:            []string{"/hostedzone/ZTST1", "/hostedzone/ZTST2"},
-		AWSZoneType:             "private",
+		AWSZoneType:             "public",
+		InternalProvider:        "aws",
+		ExtIPProvider:           "custom",
+		Manage:                  "firewall,extip",
+		ListProviders:           true,
+		InternalDomainFilter:    []string{"example.internal"},
+		InternalZoneIDFilter:    []string{"/hostedzone/ZTST3"},
+		InternalAWSZoneType:     "private",
 		AWSAssumeRole:           "some-other-role",
+		AWSDNSAssumeRole:        "dns-role",
+		AWSFirewallAssumeRole:   "firewall-role",
+		AWSRegion:               "us-west-2",
+		PrivateZoneVPCFilter:    []string{"auto", "vpc-1"},
 		AWSMaxChangeCount:       100,
+		AWSBatchChangeStrategy:  "deletes-last",
 		AWSEvaluateTargetHealth: false,
+		AWSRecordsPageSize:      100,
+		AWSZoneConcurrency:      4,
+		AWSRecordsCacheTTL:      10 * time.Minute,
+		AWSGlobalAcceleratorARN: "arn:aws:globalaccelerator::123456789012:accelerator/1234abcd",
 		AzureConfigFile:         "azure.json",
 		AzureResourceGroup:      "arg",
 		CloudflareProxied:       true,
@@ -110,17 +257,56 @@ var (
 		Policy:                  "upsert-only",
 		Registry:                "noop",
 		TXTOwnerID:              "owner-1",
+		TXTReadOwnerIDs:         []string{"owner-0", "legacy"},
+		TXTRepairOwnership:      true,
+		TXTEncryptionKeyFile:    "/etc/external-ips/txt-key",
+		TXTFormat:               "v2",
 		TXTPrefix:               "associated-txt-record",
+		DynamoDBTable:           "ownership",
+		DynamoDBRegion:          "us-west-2",
+		DynamoDBMirrorTXT:       true,
 		TXTCacheInterval:        12 * time.Hour,
+		TXTReplanStale:          true,
+		DNSCacheInterval:        time.Minute,
+		FirewallCacheInterval:   5 * time.Minute,
+		FirewallGCInterval:      time.Hour,
+		FirewallHistory:         "dynamodb",
+		FirewallHistoryCM:       "external-ips/firewall-history",
+		FirewallHistoryTable:    "firewall-history",
+		FirewallHistoryTTL:      90 * 24 * time.Hour,
+		FirewallGCGracePeriod:   10 * time.Minute,
 		Interval:                10 * time.Minute,
+		FailureThreshold:        3,
+		FailurePause:            time.Hour,
+		StuckThreshold:          2,
+		StuckPause:              2 * time.Hour,
+		CutoverDelay:            10 * time.Minute,
+		PropagationTimeout:      5 * time.Minute,
+		NotifyWebhookURL:        "https://hooks.example.org/external-ips",
+		NotifyFormat:            "slack",
+		NotifyTemplate:          "{{json .}}",
+		NotifyLargePlan:         50,
+		TraceOTLPEndpoint:       "http://otel-collector:4318",
+		TraceOTLPHeaders:        []string{"Authorization=Bearer token", "x-tenant=dev"},
+		ConcurrentSync:          true,
 		Once:                    true,
 		DryRun:                  true,
+		MonitorOnly:             true,
+		ServiceFinalizer:        true,
+		ExtIPUpdateQPS:          2.5,
+		ExtIPUpdateChunkSize:    25,
 		LogFormat:               "json",
 		MetricsAddress:          "127.0.0.1:9099",
+		MetricsTLS:              true,
+		DebugState:              true,
 		LogLevel:                logrus.DebugLevel.String(),
 		ExoscaleEndpoint:        "https://api.foo.ch/dns",
 		ExoscaleAPIKey:          "1",
 		ExoscaleAPISecret:       "2",
+		NS1Endpoint:             "https://api.example.com/v1/",
+		NS1IgnoreSSL:            true,
+		NS1APIKey:               "ns1-secret-key",
+		OpenStackRegion:         "RegionOne",
 	}
 )
 
@@ -145,9 +331,37 @@ func TestParseFlags(t *testing.T) {
 			args: []string{
 				"--master=http://127.0.0.1:8080",
 				"--kubeconfig=/some/path",
+				"--kube-api-qps=20",
+				"--kube-api-burst=40",
 				"--source=service",
 				"--namespace=namespace",
 				"--fqdn-template={{.Name}}.service.example.com",
+				"--publish-internal-services",
+				"--internal-fqdn-template={{.Name}}.vpn.example.com",
+				"--drain-period=2m",
+				"--node-grace-period=5m",
+				"--exclude-node=dedicated=ci",
+				"--exclude-node=spot",
+				"--aws-asg-node-tag=role=game-server",
+				"--aws-asg-node-tag=external-ips",
+				"--aws-asg-node-interval=30s",
+				"--spot-policy=deprioritize",
+				"--spot-node-selector=node-role.kubernetes.io/spot-worker",
+				"--subdomain-per-cluster",
+				"--split-horizon",
+				"--active-slot=green",
+				"--service-label=tier",
+				"--service-label=app.kubernetes.io/team",
+				"--firewall-name-template={{.Namespace}}-{{.Service}}-{{.Hash}}.{{.Cluster}}",
+				"--firewall-node-port-range=auto",
+				"--fake-endpoints=10000",
+				"--fake-inbound-rules=500",
+				"--fake-extips=500",
+				"--fake-churn=0.05",
+				"--fake-seed=42",
+				"--crd-source-apiversion=example.org/v1",
+				"--crd-source-kind=Record",
+				"--source-errors=best-effort",
 				"--compatibility=mate",
 				"--provider=google",
 				"--google-project=project",
@@ -171,26 +385,87 @@ func TestParseFlags(t *testing.T) {
 				"--no-infoblox-ssl-verify",
 				"--domain-filter=example.org",
 				"--domain-filter=company.com",
+				"--exclude-domains=internal.example.org",
+				"--exclude-domains=staging.company.com",
 				"--zone-id-filter=/hostedzone/ZTST1",
 				"--zone-id-filter=/hostedzone/ZTST2",
-				"--aws-zone-type=private",
+				"--aws-zone-type=public",
+				"--internal-provider=aws",
+				"--extip-provider=custom",
+				"--manage=firewall,extip",
+				"--list-providers",
+				"--internal-domain-filter=example.internal",
+				"--internal-zone-id-filter=/hostedzone/ZTST3",
+				"--internal-aws-zone-type=private",
 				"--aws-assume-role=some-other-role",
+				"--aws-dns-assume-role=dns-role",
+				"--aws-firewall-assume-role=firewall-role",
+				"--aws-region=us-west-2",
+				"--private-zone-vpc-filter=auto",
+				"--private-zone-vpc-filter=vpc-1",
 				"--aws-max-change-count=100",
+				"--aws-batch-change-strategy=deletes-last",
 				"--no-aws-evaluate-target-health",
+				"--aws-records-page-size=100",
+				"--aws-zone-concurrency=4",
+				"--aws-records-cache-ttl=10m",
+				"--aws-global-accelerator-arn=arn:aws:globalaccelerator::123456789012:accelerator/1234abcd",
 				"--policy=upsert-only",
 				"--registry=noop",
 				"--txt-owner-id=owner-1",
+				"--txt-read-owner-id=owner-0",
+				"--txt-read-owner-id=legacy",
+				"--txt-repair-ownership",
+				"--txt-encryption-key-file=/etc/external-ips/txt-key",
+				"--txt-format=v2",
 				"--txt-prefix=associated-txt-record",
+				"--dynamodb-table=ownership",
+				"--dynamodb-region=us-west-2",
+				"--dynamodb-mirror-txt",
 				"--txt-cache-interval=12h",
+				"--txt-replan-stale",
+				"--dns-cache-interval=1m",
+				"--firewall-cache-interval=5m",
+				"--firewall-gc-interval=1h",
+				"--firewall-history=dynamodb",
+				"--firewall-history-configmap=external-ips/firewall-history",
+				"--firewall-history-table=firewall-history",
+				"--firewall-history-retention=2160h",
+				"--firewall-gc-grace-period=10m",
 				"--interval=10m",
+				"--failure-threshold=3",
+				"--failure-pause=1h",
+				"--stuck-threshold=2",
+				"--stuck-pause=2h",
+				"--cutover-delay=10m",
+				"--propagation-timeout=5m",
+				"--notify-webhook-url=https://hooks.example.org/external-ips",
+				"--notify-format=slack",
+				"--notify-template={{json .}}",
+				"--notify-large-plan=50",
+				"--trace-otlp-endpoint=http://otel-collector:4318",
+				"--trace-otlp-header=Authorization=Bearer token",
+				"--trace-otlp-header=x-tenant=dev",
+				"--concurrent-sync",
 				"--once",
 				"--dry-run",
+				"--monitor-only",
+				"--service-finalizer",
+				"--extip-update-qps=2.5",
+				"--extip-update-chunk-size=25",
 				"--log-format=json",
 				"--metrics-address=127.0.0.1:9099",
+				"--metrics-tls",
+				"--debug-state",
 				"--log-level=debug",
 				"--exoscale-endpoint=https://api.foo.ch/dns",
 				"--exoscale-apikey=1",
 				"--exoscale-apisecret=2",
+				"--firewall-provider=aws",
+				"--ns1-endpoint=https://api.example.com/v1/",
+				"--ns1-ignoressl",
+				"--ns1-apikey=ns1-secret-key",
+				"--openstack-region=RegionOne",
 			},
 			envVars:  map[string]string{},
 			expected: overriddenConfig,
@@ -201,9 +476,34 @@ func TestParseFlags(t *testing.T) {
 			envVars: map[string]string{
 				"EXTERNAL_IPS_MASTER":                     "http://127.0.0.1:8080",
 				"EXTERNAL_IPS_KUBECONFIG":                 "/some/path",
+				"EXTERNAL_IPS_KUBE_API_QPS":               "20",
+				"EXTERNAL_IPS_KUBE_API_BURST":             "40",
 				"EXTERNAL_IPS_SOURCE":                     "service",
 				"EXTERNAL_IPS_NAMESPACE":                  "namespace",
 				"EXTERNAL_IPS_FQDN_TEMPLATE":              "{{.Name}}.service.example.com",
+				"EXTERNAL_IPS_PUBLISH_INTERNAL_SERVICES":  "1",
+				"EXTERNAL_IPS_INTERNAL_FQDN_TEMPLATE":     "{{.Name}}.vpn.example.com",
+				"EXTERNAL_IPS_DRAIN_PERIOD":               "2m",
+				"EXTERNAL_IPS_NODE_GRACE_PERIOD":          "5m",
+				"EXTERNAL_IPS_EXCLUDE_NODE":               "dedicated=ci\nspot",
+				"EXTERNAL_IPS_AWS_ASG_NODE_TAG":           "role=game-server\nexternal-ips",
+				"EXTERNAL_IPS_AWS_ASG_NODE_INTERVAL":      "30s",
+				"EXTERNAL_IPS_SPOT_POLICY":                "deprioritize",
+				"EXTERNAL_IPS_SPOT_NODE_SELECTOR":         "node-role.kubernetes.io/spot-worker",
+				"EXTERNAL_IPS_SUBDOMAIN_PER_CLUSTER":      "1",
+				"EXTERNAL_IPS_SPLIT_HORIZON":              "1",
+				"EXTERNAL_IPS_ACTIVE_SLOT":                "green",
+				"EXTERNAL_IPS_SERVICE_LABEL":              "tier\napp.kubernetes.io/team",
+				"EXTERNAL_IPS_FIREWALL_NAME_TEMPLATE":     "{{.Namespace}}-{{.Service}}-{{.Hash}}.{{.Cluster}}",
+				"EXTERNAL_IPS_FIREWALL_NODE_PORT_RANGE":   "auto",
+				"EXTERNAL_IPS_FAKE_ENDPOINTS":             "10000",
+				"EXTERNAL_IPS_FAKE_INBOUND_RULES":         "500",
+				"EXTERNAL_IPS_FAKE_EXTIPS":                "500",
+				"EXTERNAL_IPS_FAKE_CHURN":                 "0.05",
+				"EXTERNAL_IPS_FAKE_SEED":                  "42",
+				"EXTERNAL_IPS_CRD_SOURCE_APIVERSION":      "example.org/v1",
+				"EXTERNAL_IPS_CRD_SOURCE_KIND":            "Record",
+				"EXTERNAL_IPS_SOURCE_ERRORS":              "best-effort",
 				"EXTERNAL_IPS_COMPATIBILITY":              "mate",
 				"EXTERNAL_IPS_PROVIDER":                   "google",
 				"EXTERNAL_IPS_GOOGLE_PROJECT":             "project",
@@ -219,6 +519,7 @@ func TestParseFlags(t *testing.T) {
 				"EXTERNAL_IPS_OCI_CONFIG_FILE":            "oci.yaml",
 				"EXTERNAL_IPS_INMEMORY_ZONE":              "example.org\ncompany.com",
 				"EXTERNAL_IPS_DOMAIN_FILTER":              "example.org\ncompany.com",
+				"EXTERNAL_IPS_EXCLUDE_DOMAINS":            "internal.example.org\nstaging.company.com",
 				"EXTERNAL_IPS_PDNS_SERVER":                "http://ns.example.com:8081",
 				"EXTERNAL_IPS_PDNS_API_KEY":               "some-secret-key",
 				"EXTERNAL_IPS_PDNS_TLS_ENABLED":           "1",
@@ -226,24 +527,80 @@ func TestParseFlags(t *testing.T) {
 				"EXTERNAL_IPS_TLS_CLIENT_CERT":            "/path/to/cert.pem",
 				"EXTERNAL_IPS_TLS_CLIENT_CERT_KEY":        "/path/to/key.pem",
 				"EXTERNAL_IPS_ZONE_ID_FILTER":             "/hostedzone/ZTST1\n/hostedzone/ZTST2",
-				"EXTERNAL_IPS_AWS_ZONE_TYPE":              "private",
+				"EXTERNAL_IPS_AWS_ZONE_TYPE":              "public",
+				"EXTERNAL_IPS_INTERNAL_PROVIDER":          "aws",
+				"EXTERNAL_IPS_EXTIP_PROVIDER":             "custom",
+				"EXTERNAL_IPS_MANAGE":                     "firewall,extip",
+				"EXTERNAL_IPS_LIST_PROVIDERS":             "1",
+				"EXTERNAL_IPS_INTERNAL_DOMAIN_FILTER":     "example.internal",
+				"EXTERNAL_IPS_INTERNAL_ZONE_ID_FILTER":    "/hostedzone/ZTST3",
+				"EXTERNAL_IPS_INTERNAL_AWS_ZONE_TYPE":     "private",
 				"EXTERNAL_IPS_AWS_ASSUME_ROLE":            "some-other-role",
+				"EXTERNAL_IPS_AWS_DNS_ASSUME_ROLE":        "dns-role",
+				"EXTERNAL_IPS_AWS_FIREWALL_ASSUME_ROLE":   "firewall-role",
+				"EXTERNAL_IPS_AWS_REGION":                 "us-west-2",
+				"EXTERNAL_IPS_PRIVATE_ZONE_VPC_FILTER":    "auto\nvpc-1",
 				"EXTERNAL_IPS_AWS_MAX_CHANGE_COUNT":       "100",
+				"EXTERNAL_IPS_AWS_BATCH_CHANGE_STRATEGY":  "deletes-last",
 				"EXTERNAL_IPS_AWS_EVALUATE_TARGET_HEALTH": "0",
+				"EXTERNAL_IPS_AWS_RECORDS_PAGE_SIZE":      "100",
+				"EXTERNAL_IPS_AWS_ZONE_CONCURRENCY":       "4",
+				"EXTERNAL_IPS_AWS_RECORDS_CACHE_TTL":      "10m",
+				"EXTERNAL_IPS_AWS_GLOBAL_ACCELERATOR_ARN": "arn:aws:globalaccelerator::123456789012:accelerator/1234abcd",
 				"EXTERNAL_IPS_POLICY":                     "upsert-only",
 				"EXTERNAL_IPS_REGISTRY":                   "noop",
 				"EXTERNAL_IPS_TXT_OWNER_ID":               "owner-1",
+				"EXTERNAL_IPS_TXT_READ_OWNER_ID":          "owner-0\nlegacy",
+				"EXTERNAL_IPS_TXT_REPAIR_OWNERSHIP":       "1",
+				"EXTERNAL_IPS_TXT_ENCRYPTION_KEY_FILE":    "/etc/external-ips/txt-key",
+				"EXTERNAL_IPS_TXT_FORMAT":                 "v2",
 				"EXTERNAL_IPS_TXT_PREFIX":                 "associated-txt-record",
+				"EXTERNAL_IPS_DYNAMODB_TABLE":             "ownership",
+				"EXTERNAL_IPS_DYNAMODB_REGION":            "us-west-2",
+				"EXTERNAL_IPS_DYNAMODB_MIRROR_TXT":        "1",
 				"EXTERNAL_IPS_TXT_CACHE_INTERVAL":         "12h",
+				"EXTERNAL_IPS_TXT_REPLAN_STALE":           "1",
+				"EXTERNAL_IPS_DNS_CACHE_INTERVAL":         "1m",
+				"EXTERNAL_IPS_FIREWALL_CACHE_INTERVAL":    "5m",
+				"EXTERNAL_IPS_FIREWALL_GC_INTERVAL":       "1h",
+				"EXTERNAL_IPS_FIREWALL_HISTORY":           "dynamodb",
+				"EXTERNAL_IPS_FIREWALL_HISTORY_CONFIGMAP": "external-ips/firewall-history",
+				"EXTERNAL_IPS_FIREWALL_HISTORY_TABLE":     "firewall-history",
+				"EXTERNAL_IPS_FIREWALL_HISTORY_RETENTION": "2160h",
+				"EXTERNAL_IPS_FIREWALL_GC_GRACE_PERIOD":   "10m",
 				"EXTERNAL_IPS_INTERVAL":                   "10m",
+				"EXTERNAL_IPS_FAILURE_THRESHOLD":          "3",
+				"EXTERNAL_IPS_FAILURE_PAUSE":              "1h",
+				"EXTERNAL_IPS_STUCK_THRESHOLD":            "2",
+				"EXTERNAL_IPS_STUCK_PAUSE":                "2h",
+				"EXTERNAL_IPS_CUTOVER_DELAY":              "10m",
+				"EXTERNAL_IPS_PROPAGATION_TIMEOUT":        "5m",
+				"EXTERNAL_IPS_NOTIFY_WEBHOOK_URL":         "https://hooks.example.org/external-ips",
+				"EXTERNAL_IPS_NOTIFY_FORMAT":              "slack",
+				"EXTERNAL_IPS_NOTIFY_TEMPLATE":            "{{json .}}",
+				"EXTERNAL_IPS_NOTIFY_LARGE_PLAN":          "50",
+				"EXTERNAL_IPS_TRACE_OTLP_ENDPOINT":        "http://otel-collector:4318",
+				"EXTERNAL_IPS_TRACE_OTLP_HEADER":          "Authorization=Bearer token\nx-tenant=dev",
+				"EXTERNAL_IPS_CONCURRENT_SYNC":            "1",
 				"EXTERNAL_IPS_ONCE":                       "1",
 				"EXTERNAL_IPS_DRY_RUN":                    "1",
+				"EXTERNAL_IPS_MONITOR_ONLY":               "1",
+				"EXTERNAL_IPS_SERVICE_FINALIZER":          "1",
+				"EXTERNAL_IPS_EXTIP_UPDATE_QPS":           "2.5",
+				"EXTERNAL_IPS_EXTIP_UPDATE_CHUNK_SIZE":    "25",
 				"EXTERNAL_IPS_LOG_FORMAT":                 "json",
 				"EXTERNAL_IPS_METRICS_ADDRESS":            "127.0.0.1:9099",
+				"EXTERNAL_IPS_METRICS_TLS":                "1",
+				"EXTERNAL_IPS_DEBUG_STATE":                "1",
 				"EXTERNAL_IPS_LOG_LEVEL":                  "debug",
 				"EXTERNAL_IPS_EXOSCALE_ENDPOINT":          "https://api.foo.ch/dns",
 				"EXTERNAL_IPS_EXOSCALE_APIKEY":            "1",
 				"EXTERNAL_IPS_EXOSCALE_APISECRET":         "2",
+				"EXTERNAL_IPS_FIREWALL_PROVIDER":          "aws",
+				"EXTERNAL_IPS_NS1_ENDPOINT":               "https://api.example.com/v1/",
+				"EXTERNAL_IPS_NS1_IGNORESSL":              "1",
+				"EXTERNAL_IPS_NS1_APIKEY":                 "ns1-secret-key",
+				"EXTERNAL_IPS_OPENSTACK_REGION":           "RegionOne",
 			},
 			expected: overriddenConfig,
 		},
@@ -259,6 +616,107 @@ func TestParseFlags(t *testing.T) {
 	}
 }
 
+func TestParseFlagsPermissionsCommand(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"permissions",
+		"--source=service",
+		"--provider=aws",
+		"--cluster-name=kube.example.org",
+	}))
+	assert.Equal(t, "permissions", cfg.Command)
+	assert.Equal(t, "kube.example.org", cfg.ClusterName)
+	assert.Equal(t, "aws", cfg.Provider)
+}
+
+func TestParseFlagsCanaryCommand(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"canary",
+		"--source=service",
+		"--provider=aws",
+		"--canary-hostname=canary.example.org",
+		"--canary-resolver=10.0.0.2:53",
+		"--canary-timeout=5m",
+	}))
+	assert.Equal(t, "canary", cfg.Command)
+	assert.Equal(t, "canary.example.org", cfg.CanaryHostname)
+	assert.Equal(t, "10.0.0.2:53", cfg.CanaryResolver)
+	assert.Equal(t, 5*time.Minute, cfg.CanaryTimeout)
+}
+
+func TestParseFlagsFirewallHistoryCommand(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"firewall-history",
+		"--source=service",
+		"--provider=aws",
+		"--firewall-history=configmap",
+		"--at=2018-06-01T12:00:00Z",
+	}))
+	assert.Equal(t, "firewall-history", cfg.Command)
+	assert.Equal(t, "configmap", cfg.FirewallHistory)
+	assert.Equal(t, "2018-06-01T12:00:00Z", cfg.FirewallHistoryAt)
+}
+
+func TestParseFlagsValidateCommand(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"validate",
+		"--source=service",
+		"--provider=aws",
+		"--quota-records-per-zone=5000",
+		"--quota-security-groups=0",
+		"--quota-rules-per-group=120",
+		"--quota-external-ips-per-service=8",
+	}))
+	assert.Equal(t, "validate", cfg.Command)
+	assert.Equal(t, 5000, cfg.QuotaRecordsPerZone)
+	assert.Equal(t, 0, cfg.QuotaSecurityGroups)
+	assert.Equal(t, 120, cfg.QuotaRulesPerGroup)
+	assert.Equal(t, 8, cfg.QuotaExtIPsPerService)
+}
+
+func TestParseFlagsExportImportCommands(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"export",
+		"--source=service",
+		"--provider=aws",
+		"--registry=txt",
+		"--txt-owner-id=old",
+	}))
+	assert.Equal(t, "export", cfg.Command)
+	assert.Equal(t, "-", cfg.SnapshotFile)
+
+	cfg = NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"import",
+		"--source=service",
+		"--provider=aws",
+		"--registry=txt",
+		"--txt-owner-id=new",
+		"--snapshot-file=/tmp/snapshot.yaml",
+	}))
+	assert.Equal(t, "import", cfg.Command)
+	assert.Equal(t, "/tmp/snapshot.yaml", cfg.SnapshotFile)
+}
+
+func TestParseFlagsPlanCommand(t *testing.T) {
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{
+		"plan",
+		"--source=service",
+		"--provider=aws",
+		"--format=dot",
+	}))
+	assert.Equal(t, "plan", cfg.Command)
+	assert.Equal(t, "dot", cfg.PlanFormat)
+
+	cfg = NewConfig()
+	assert.Error(t, cfg.ParseFlags([]string{"plan", "--source=service", "--provider=aws", "--format=svg"}))
+}
+
 // helper functions
 
 func setEnv(t *testing.T, env map[string]string) map[string]string {
@@ -283,6 +741,7 @@ func TestPasswordsNotLogged(t *testing.T) {
 		DynPassword:          "dyn-pass",
 		InfobloxWapiPassword: "infoblox-pass",
 		PDNSAPIKey:           "pdns-api-key",
+		NS1APIKey:            "ns1-api-key",
 	}
 
 	s := cfg.String()
@@ -290,4 +749,40 @@ func TestPasswordsNotLogged(t *testing.T) {
 	assert.False(t, strings.Contains(s, "dyn-pass"))
 	assert.False(t, strings.Contains(s, "infoblox-pass"))
 	assert.False(t, strings.Contains(s, "pdns-api-key"))
+	assert.False(t, strings.Contains(s, "ns1-api-key"))
+}
+
+func TestParseFlagsListProviders(t *testing.T) {
+	// the providers are listed without the otherwise required flags
+	cfg := NewConfig()
+	require.NoError(t, cfg.ParseFlags([]string{"--list-providers"}))
+	assert.True(t, cfg.ListProviders)
+	assert.Empty(t, cfg.Provider)
+}
+
+func TestConfigManages(t *testing.T) {
+	cfg := &Config{Manage: "firewall, extip"}
+	assert.False(t, cfg.Manages("dns"))
+	assert.True(t, cfg.Manages("firewall"))
+	assert.True(t, cfg.Manages("extip"))
+
+	// an empty list manages all the subsystems
+	cfg.Manage = ""
+	for _, s := range Subsystems {
+		assert.True(t, cfg.Manages(s), s)
+	}
+}
+
+func TestConfigAssumeRoles(t *testing.T) {
+	cfg := &Config{AWSAssumeRole: "arn:aws:iam::111111111111:role/external-ips"}
+	assert.Equal(t, "arn:aws:iam::111111111111:role/external-ips", cfg.DNSAssumeRole())
+	assert.Equal(t, "arn:aws:iam::111111111111:role/external-ips", cfg.FirewallAssumeRole())
+
+	// the DNS role overrides the shared role of the records only
+	cfg.AWSDNSAssumeRole = "arn:aws:iam::222222222222:role/dns"
+	assert.Equal(t, "arn:aws:iam::222222222222:role/dns", cfg.DNSAssumeRole())
+	assert.Equal(t, "arn:aws:iam::111111111111:role/external-ips", cfg.FirewallAssumeRole())
+
+	cfg.AWSFirewallAssumeRole = "arn:aws:iam::333333333333:role/firewall"
+	assert.Equal(t, "arn:aws:iam::333333333333:role/firewall", cfg.FirewallAssumeRole())
 }
@@ -22,8 +22,14 @@ package validation
 import (
 	"errors"
 	"fmt"
+	"strings"
+	"text/template"
+	"time"
 
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/notify"
 	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	"github.com/openfresh/external-ips/trace"
 )
 
 // ValidateConfig performs validation on the Config object
@@ -35,9 +41,183 @@ func ValidateConfig(cfg *externalips.Config) error {
 	if len(cfg.Sources) == 0 {
 		return errors.New("no sources specified")
 	}
-	if cfg.Provider == "" {
+	if contains(cfg.Sources, "service") && contains(cfg.Sources, "istio-gateway") {
+		return errors.New("the istio-gateway source includes the services, it can't be used along with the service source")
+	}
+	if contains(cfg.Sources, "crd") && (!strings.Contains(cfg.CRDSourceAPIVersion, "/") || cfg.CRDSourceKind == "") {
+		return fmt.Errorf("invalid crd source API version or kind: %s %s", cfg.CRDSourceAPIVersion, cfg.CRDSourceKind)
+	}
+	if cfg.Manage != "" {
+		for _, s := range strings.Split(cfg.Manage, ",") {
+			if !contains(externalips.Subsystems, strings.TrimSpace(s)) {
+				return fmt.Errorf("unknown subsystem to manage: %q", s)
+			}
+		}
+	}
+	if cfg.Provider == "" && cfg.Manages("dns") {
 		return errors.New("no provider specified")
 	}
+	if cfg.InternalProvider != "" && !cfg.Manages("dns") {
+		return errors.New("the internal records are only published when the dns subsystem is managed")
+	}
+	if cfg.ServiceFinalizer && !cfg.Manages("extip") {
+		return errors.New("the service finalizer requires the extip subsystem to be managed")
+	}
+	switch cfg.Command {
+	case "validate", "canary", "export", "import":
+		for _, s := range externalips.Subsystems {
+			if !cfg.Manages(s) {
+				return fmt.Errorf("the %s command requires all the subsystems to be managed", cfg.Command)
+			}
+		}
+	case "firewall-history":
+		if !cfg.Manages("firewall") {
+			return errors.New("the firewall-history command requires the firewall subsystem to be managed")
+		}
+	}
+
+	if cfg.KubeAPIQPS < 0 || cfg.KubeAPIBurst < 0 {
+		return errors.New("negative Kubernetes API QPS or burst specified")
+	}
+	if cfg.ExtIPUpdateQPS < 0 || cfg.ExtIPUpdateChunkSize < 0 {
+		return errors.New("negative external IPs update QPS or chunk size specified")
+	}
+
+	if cfg.MetricsTLS && (cfg.TLSClientCert == "" || cfg.TLSClientCertKey == "") {
+		return errors.New("no certificate specified to serve the metrics over TLS")
+	}
+
+	if cfg.Command == "permissions" && cfg.FirewallProvider == "aws" {
+		if cfg.ClusterName == "" {
+			return errors.New("no cluster name specified")
+		}
+	}
+
+	if cfg.Command == "canary" && cfg.CanaryHostname == "" {
+		return errors.New("no canary hostname specified")
+	}
+	if cfg.QuotaRecordsPerZone < 0 || cfg.QuotaSecurityGroups < 0 || cfg.QuotaRulesPerGroup < 0 || cfg.QuotaExtIPsPerService < 0 {
+		return errors.New("the quotas cannot be negative")
+	}
+
+	if cfg.Registry == "dynamodb" && cfg.DynamoDBTable == "" {
+		return errors.New("no DynamoDB table specified")
+	}
+
+	if cfg.FakeEndpoints < 0 || cfg.FakeInboundRules < 0 || cfg.FakeExtIPs < 0 {
+		return errors.New("the sizes of the fake source cannot be negative")
+	}
+	if cfg.FakeChurn < 0 || cfg.FakeChurn > 1 {
+		return fmt.Errorf("invalid fake source churn, expected between 0 and 1: %v", cfg.FakeChurn)
+	}
+
+	// the labels are serialized as comma separated key=value pairs in the registries
+	for _, label := range cfg.ServiceLabels {
+		if strings.ContainsAny(label, ",=\" ") {
+			return fmt.Errorf("invalid service label: %q", label)
+		}
+	}
+
+	if cfg.FirewallNameTemplate != "" {
+		if _, err := template.New("firewall").Parse(cfg.FirewallNameTemplate); err != nil {
+			return fmt.Errorf("invalid firewall name template: %v", err)
+		}
+	}
+
+	if cfg.FirewallNodePortRange != "" && cfg.FirewallNodePortRange != "auto" {
+		if _, _, err := inbound.ParsePortRange(cfg.FirewallNodePortRange); err != nil {
+			return fmt.Errorf("invalid node port range: %v", err)
+		}
+	}
+
+	for _, id := range cfg.TXTReadOwnerIDs {
+		if id != "" && cfg.Registry != "txt" {
+			return errors.New("read owner ids are only supported by the txt registry")
+		}
+	}
+	if cfg.TXTRepairOwnership && cfg.Registry != "txt" {
+		return errors.New("the ownership repair is only supported by the txt registry")
+	}
+	if cfg.TXTEncryptionKeyFile != "" && cfg.Registry != "txt" {
+		return errors.New("the TXT encryption is only supported by the txt registry")
+	}
+	if cfg.TXTFormat != "" && cfg.TXTFormat != "v1" && cfg.Registry != "txt" {
+		return errors.New("the TXT formats other than v1 are only supported by the txt registry")
+	}
+	if cfg.TXTReplanStale && cfg.Registry != "txt" {
+		return errors.New("planning the stale changes again is only supported by the txt registry")
+	}
+
+	if cfg.NotifyLargePlan < 0 {
+		return errors.New("the size of the large plans cannot be negative")
+	}
+	if cfg.NotifyWebhookURL == "" && (cfg.NotifyLargePlan > 0 || cfg.NotifyTemplate != "") {
+		return errors.New("no notification webhook URL specified")
+	}
+	if cfg.NotifyWebhookURL != "" {
+		if _, err := notify.NewWebhook(cfg.NotifyWebhookURL, cfg.NotifyFormat, cfg.NotifyTemplate); err != nil {
+			return err
+		}
+	}
+
+	headers, err := trace.ParseHeaders(cfg.TraceOTLPHeaders)
+	if err != nil {
+		return err
+	}
+	if cfg.TraceOTLPEndpoint == "" && len(headers) > 0 {
+		return errors.New("no OTLP endpoint specified")
+	}
+	if cfg.TraceOTLPEndpoint != "" {
+		if _, err := trace.NewTracer(cfg.TraceOTLPEndpoint, "external-ips", headers); err != nil {
+			return err
+		}
+	}
+
+	for _, tag := range cfg.AWSASGNodeTags {
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(tag, "=") {
+			return fmt.Errorf("invalid autoscaling group tag, expected key=value or key: %q", tag)
+		}
+		// the instances are only known to the AWS firewall provider
+		if cfg.FirewallProvider != "aws" {
+			return errors.New("the autoscaling group nodes are only supported by the aws firewall provider")
+		}
+		if cfg.AWSASGNodeInterval <= 0 {
+			return errors.New("the autoscaling group node interval must be positive")
+		}
+	}
+
+	if cfg.AWSGlobalAcceleratorARN != "" {
+		if !strings.HasPrefix(cfg.AWSGlobalAcceleratorARN, "arn:aws:globalaccelerator::") {
+			return fmt.Errorf("invalid Global Accelerator ARN: %s", cfg.AWSGlobalAcceleratorARN)
+		}
+		// the listeners forward to the instances found by the AWS firewall provider
+		if cfg.FirewallProvider != "aws" {
+			return errors.New("the Global Accelerator is only supported by the aws firewall provider")
+		}
+		if !cfg.Manages("firewall") {
+			return errors.New("the Global Accelerator requires the firewall subsystem to be managed")
+		}
+	}
+
+	if cfg.FirewallHistory == "dynamodb" && cfg.FirewallHistoryTable == "" {
+		return errors.New("no firewall history table specified")
+	}
+	if cfg.FirewallHistory == "configmap" && len(strings.Split(cfg.FirewallHistoryCM, "/")) != 2 {
+		return fmt.Errorf("invalid firewall history ConfigMap, expected namespace/name: %s", cfg.FirewallHistoryCM)
+	}
+	if cfg.Command == "firewall-history" {
+		if cfg.FirewallHistory == "" {
+			return errors.New("no firewall history specified")
+		}
+		if cfg.FirewallHistoryAt != "" {
+			if _, err := time.Parse(time.RFC3339, cfg.FirewallHistoryAt); err != nil {
+				return fmt.Errorf("invalid firewall history time: %v", err)
+			}
+		}
+	}
 
 	// Azure provider specific validations
 	if cfg.Provider == "azure" {
@@ -68,5 +248,21 @@ func ValidateConfig(cfg *externalips.Config) error {
 			return errors.New("TTL specified for Dyn is negative")
 		}
 	}
+
+	if cfg.Provider == "ns1" || cfg.InternalProvider == "ns1" {
+		if cfg.NS1APIKey == "" {
+			return errors.New("no NS1 API key specified")
+		}
+	}
 	return nil
 }
+
+// contains returns true if the values include the value.
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -119,3 +119,316 @@ func TestValidateGoodDynConfig(t *testing.T) {
 		assert.Nil(t, err, "Configuration should be valid, got this error instead", err)
 	}
 }
+
+func TestValidateNS1Config(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Provider = "ns1"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.NS1APIKey = "xxxxxxxxxxxxxxxxx"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.InternalProvider = "ns1"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidatePermissionsConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Command = "permissions"
+	cfg.FirewallProvider = "aws"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.ClusterName = "kube.example.org"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Command = "permissions"
+	cfg.FirewallProvider = "openstack"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateMetricsTLSConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.MetricsTLS = true
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.TLSClientCert = "/etc/external-ips/tls.crt"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.TLSClientCertKey = "/etc/external-ips/tls.key"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateCanaryConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Command = "canary"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.CanaryHostname = "canary.example.org"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateDynamoDBConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Registry = "dynamodb"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.DynamoDBTable = "ownership"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateFakeConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.FakeChurn = 1.5
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.FakeEndpoints = -1
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateIstioGatewaySource(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Sources = []string{"istio-gateway", "fake"}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Sources = []string{"service", "istio-gateway"}
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateCRDSource(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Sources = []string{"service", "crd"}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.CRDSourceAPIVersion = "v1alpha1"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Sources = []string{"crd"}
+	cfg.CRDSourceKind = ""
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateServiceLabels(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.ServiceLabels = []string{"tier", "app.kubernetes.io/team"}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.ServiceLabels = []string{"tier=edge"}
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateFirewallNameTemplate(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.FirewallNameTemplate = "{{.Service}}-{{.Hash}}.{{.Cluster}}"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.FirewallNameTemplate = "{{.Service"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateTXTReadOwnerIDs(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TXTReadOwnerIDs = []string{"former-owner"}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Registry = "noop"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateTXTRepairOwnership(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TXTRepairOwnership = true
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Registry = "noop"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateTXTEncryptionKeyFile(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TXTEncryptionKeyFile = "/etc/external-ips/txt-key"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Registry = "noop"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateTXTFormat(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TXTFormat = "v2"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Registry = "noop"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.TXTFormat = "v1"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateTXTReplanStale(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TXTReplanStale = true
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Registry = "noop"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateNotifyConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.NotifyLargePlan = 50
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.NotifyWebhookURL = "https://hooks.example.org/external-ips"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.NotifyLargePlan = -1
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.NotifyWebhookURL = "https://hooks.example.org/external-ips"
+	cfg.NotifyTemplate = "{{json .Message"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.NotifyTemplate = `{"text":{{json .Message}}}`
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateManage(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Manage = "firewall,extip"
+	cfg.Provider = ""
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.Manage = "firewall,records"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Manage = "firewall,extip"
+	cfg.InternalProvider = "aws"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Manage = "dns,firewall"
+	cfg.ServiceFinalizer = true
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Manage = "dns,firewall"
+	cfg.Command = "export"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.Manage = "dns,firewall,extip"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateTraceConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.TraceOTLPHeaders = []string{"x-tenant=dev"}
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.TraceOTLPEndpoint = "http://otel-collector:4318"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.TraceOTLPHeaders = []string{"x-tenant"}
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.TraceOTLPEndpoint = "otel-collector:4318"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateASGNodes(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.AWSASGNodeTags = []string{"role=game-server"}
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.AWSASGNodeInterval = 0
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.AWSASGNodeTags = []string{"=game-server"}
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg.AWSASGNodeTags = []string{"role"}
+	cfg.FirewallProvider = "openstack"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateFirewallNodePortRange(t *testing.T) {
+	cfg := newValidConfig(t)
+	for _, r := range []string{"auto", "30000-32767", "30000+2768"} {
+		cfg.FirewallNodePortRange = r
+		assert.NoError(t, ValidateConfig(cfg), r)
+	}
+	for _, r := range []string{"30000", "32767-30000", "detect"} {
+		cfg.FirewallNodePortRange = r
+		assert.Error(t, ValidateConfig(cfg), r)
+	}
+}
+
+func TestValidateFirewallHistoryConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.FirewallHistory = "dynamodb"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.FirewallHistoryTable = "firewall-history"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.FirewallHistory = "configmap"
+	cfg.FirewallHistoryCM = "firewall-history"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.FirewallHistoryCM = "kube-system/firewall-history"
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.Command = "firewall-history"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.FirewallHistory = "configmap"
+	cfg.FirewallHistoryCM = "kube-system/firewall-history"
+	cfg.FirewallHistoryAt = "yesterday"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.FirewallHistoryAt = "2018-06-01T12:00:00Z"
+	assert.NoError(t, ValidateConfig(cfg))
+}
+
+func TestValidateGlobalAcceleratorConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.AWSGlobalAcceleratorARN = "arn:aws:globalaccelerator::123456789012:accelerator/1234abcd-abcd-1234-abcd-1234abcdefgh"
+	assert.NoError(t, ValidateConfig(cfg))
+	cfg.Manage = "dns,extip"
+	assert.Error(t, ValidateConfig(cfg))
+	cfg.Manage = "dns,firewall,extip"
+	cfg.FirewallProvider = "openstack"
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.AWSGlobalAcceleratorARN = "1234abcd-abcd-1234-abcd-1234abcdefgh"
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateQuotas(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.Command = "validate"
+	cfg.QuotaSecurityGroups = 0
+	assert.NoError(t, ValidateConfig(cfg))
+
+	cfg.QuotaRulesPerGroup = -1
+	assert.Error(t, ValidateConfig(cfg))
+}
+
+func TestValidateRateLimitConfig(t *testing.T) {
+	cfg := newValidConfig(t)
+	cfg.KubeAPIQPS = -1
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.KubeAPIBurst = -1
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.ExtIPUpdateQPS = -1
+	assert.Error(t, ValidateConfig(cfg))
+
+	cfg = newValidConfig(t)
+	cfg.ExtIPUpdateChunkSize = -1
+	assert.Error(t, ValidateConfig(cfg))
+}
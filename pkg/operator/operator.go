@@ -0,0 +1,486 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package operator is the programmatic API of external-ips, for the operators
+// embedding it as a library rather than running its binary. NewController wires
+// the sources, registries and providers of a configuration into a controller as
+// the binary does, while RegisterDNSProvider, RegisterFirewallProvider and
+// RegisterExtIPProvider make further providers available to the configuration
+// by name:
+//
+//	operator.RegisterDNSProvider("example", operator.DNSProvider{New: newExampleProvider})
+//
+//	cfg := externalips.NewConfig()
+//	cfg.Provider = "example"
+//	c, err := operator.NewController(operator.WithConfig(cfg), operator.WithStop(stopChan))
+//	if err != nil {
+//		return err
+//	}
+//	c.Run(stopChan)
+//
+// The API of this package and of the packages it exposes follows semantic
+// versioning from the first tagged release on.
+package operator
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/kubernetes"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/pkg/api"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/controller"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/dns/verify"
+	eipregistry "github.com/openfresh/external-ips/extip/registry"
+	"github.com/openfresh/external-ips/firewall/accelerator"
+	"github.com/openfresh/external-ips/firewall/history"
+	fwprovider "github.com/openfresh/external-ips/firewall/provider"
+	fwregistry "github.com/openfresh/external-ips/firewall/registry"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/notify"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+	"github.com/openfresh/external-ips/source"
+	"github.com/openfresh/external-ips/trace"
+)
+
+// Option customizes the controller created by NewController.
+type Option func(*options)
+
+type options struct {
+	cfg             *externalips.Config
+	clientGenerator source.ClientGenerator
+	source          source.Source
+	stop            <-chan struct{}
+	recorder        record.EventRecorder
+	state           *controller.StateRecorder
+}
+
+// WithConfig sets the configuration of the controller, required.
+func WithConfig(cfg *externalips.Config) Option {
+	return func(o *options) { o.cfg = cfg }
+}
+
+// WithClientGenerator sets the generator of the Kubernetes client, by default the
+// one of the kubeconfig and master of the configuration.
+func WithClientGenerator(g source.ClientGenerator) Option {
+	return func(o *options) { o.clientGenerator = g }
+}
+
+// WithSource replaces the sources of the configuration with the given source of
+// the desired setting.
+func WithSource(s source.Source) Option {
+	return func(o *options) { o.source = s }
+}
+
+// WithStop sets the channel stopping the watches of the nodes and of the priority
+// services once closed, by default they run until the process exits.
+func WithStop(stop <-chan struct{}) Option {
+	return func(o *options) { o.stop = stop }
+}
+
+// WithEventRecorder sets the recorder of the events on the services, by default
+// one recording them to the API server.
+func WithEventRecorder(r record.EventRecorder) Option {
+	return func(o *options) { o.recorder = r }
+}
+
+// WithStateRecorder records the state and the plans of the full synchronizations
+// for debugging, nil by default.
+func WithStateRecorder(s *controller.StateRecorder) Option {
+	return func(o *options) { o.state = s }
+}
+
+// Controller synchronizes the exposed services with the providers of its configuration.
+// Its components are exposed for the operators running them on their own.
+type Controller struct {
+	// The Kubernetes client of the sources and of the external IPs provider
+	KubeClient kubernetes.Interface
+	// The source of the desired setting, combining the sources of the configuration
+	Source source.Source
+	// The DNS registry and the provider it wraps, before any cache, nil if dns isn't managed
+	Registry    registry.Registry
+	DNSProvider provider.Provider
+	// The registry of the records on the internal IPs of the nodes, nil if none is configured
+	InternalRegistry registry.Registry
+	// The firewall provider and the registry wrapping it, the registry nil if firewall isn't managed
+	Firewall   fwprovider.Provider
+	FwRegistry *fwregistry.Registry
+	// The store of the snapshots of the desired inbound rules, nil if none is configured
+	History     history.Store
+	EipRegistry *eipregistry.Registry
+	// The policy that defines which changes to DNS records are allowed
+	Policy plan.Policy
+	// The name of the cluster found in the tags of the nodes
+	ClusterName string
+
+	ctrl *controller.Controller
+}
+
+// NewController creates the controller of the given configuration, starting the
+// watches of the nodes and of the priority services.
+func NewController(opts ...Option) (*Controller, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	cfg := o.cfg
+	if cfg == nil {
+		return nil, errors.New("no configuration specified")
+	}
+	if o.clientGenerator == nil {
+		o.clientGenerator = &source.SingletonClientGenerator{
+			KubeConfig: cfg.KubeConfig,
+			KubeMaster: cfg.Master,
+			QPS:        cfg.KubeAPIQPS,
+			Burst:      cfg.KubeAPIBurst,
+		}
+	}
+	if o.stop == nil {
+		o.stop = make(chan struct{})
+	}
+
+	kubeClient, err := o.clientGenerator.KubeClient()
+	if err != nil {
+		return nil, err
+	}
+	c := &Controller{KubeClient: kubeClient}
+
+	sourceCfg := newSourceConfig(cfg)
+	if sourceCfg.NodePortRange == "auto" {
+		sourceCfg.NodePortRange, err = source.DetectNodePortRange(kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Detected the node port range: %s", sourceCfg.NodePortRange)
+	}
+
+	// Problems with the services and, in monitor-only mode, the planned changes are recorded as events.
+	recorder := o.recorder
+	if recorder == nil {
+		broadcaster := record.NewBroadcaster()
+		broadcaster.StartRecordingToSink(&corev1.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+		recorder = broadcaster.NewRecorder(api.Scheme, v1.EventSource{Component: "external-ips"})
+	}
+
+	// The source and the firewall provider share a single node snapshot per synchronization.
+	nodeCache := node.NewCache(kubeClient, 0)
+	// Resync right away when a node starts draining, e.g. after a spot interruption notice.
+	resyncChan := make(chan struct{}, 1)
+	nodeCache.OnDraining(func(n *v1.Node) {
+		log.Infof("Node %s started draining, triggering a synchronization", n.Name)
+		select {
+		case resyncChan <- struct{}{}:
+		default:
+		}
+	})
+	if err := nodeCache.Run(o.stop); err != nil {
+		return nil, err
+	}
+	// The instances of the tagged autoscaling groups are listed as nodes as well, until they join the cluster.
+	var nodes node.Lister = nodeCache
+	if asgTags := nonEmpty(cfg.AWSASGNodeTags); len(asgTags) > 0 {
+		asgNodes, err := node.NewASGLister(node.ASGConfig{
+			Tags:       asgTags,
+			AssumeRole: cfg.FirewallAssumeRole(),
+			Region:     cfg.AWSRegion,
+			Interval:   cfg.AWSASGNodeInterval,
+		})
+		if err != nil {
+			return nil, err
+		}
+		nodes = node.NewMultiLister(nodeCache, asgNodes)
+	}
+
+	// Services annotated with a high priority are synchronized on their own as soon as they change.
+	priorityChan := make(chan string, 100)
+	priorityWatcher := source.NewPriorityWatcher(kubeClient, cfg.Namespace)
+	priorityWatcher.OnChange(func(key string) {
+		select {
+		case priorityChan <- key:
+		default:
+			log.Warnf("Too many pending priority services, leaving %s to the next synchronization", key)
+		}
+	})
+	if err := priorityWatcher.Run(o.stop); err != nil {
+		return nil, err
+	}
+
+	c.Firewall, err = NewFirewallProvider(cfg, Nodes{All: nodes, Cluster: nodeCache})
+	if err != nil {
+		return nil, err
+	}
+	c.ClusterName, err = c.Firewall.GetClusterName()
+	if err != nil {
+		return nil, err
+	}
+	// The excluded nodes are left out of the sources and never assigned a security group,
+	// by their labels or by the tags of their instance when the firewall provider knows them.
+	exclusions, err := node.ParseExclusions(cfg.ExcludeNodes)
+	if err != nil {
+		return nil, err
+	}
+	var instanceTags func() map[string]map[string]string
+	if tagger, ok := c.Firewall.(fwprovider.InstanceTagger); ok {
+		instanceTags = tagger.InstanceTags
+	}
+	if cfg.Manages("firewall") {
+		c.History, err = NewFirewallHistory(cfg, kubeClient, c.ClusterName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// The services exposed through the accelerator publish its static IPs in place of those of the nodes.
+	var acc accelerator.Accelerator
+	if cfg.AWSGlobalAcceleratorARN != "" {
+		acc, err = accelerator.NewAWSAccelerator(accelerator.AWSConfig{
+			ARN:        cfg.AWSGlobalAcceleratorARN,
+			AssumeRole: cfg.FirewallAssumeRole(),
+			Region:     cfg.AWSRegion,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sourceCfg.AcceleratorIPs, err = acc.IPs()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Lookup all the selected sources by names and pass them the desired configuration.
+	// The sources keep the nodes briefly missing from the API server, the firewall provider only sees the nodes listed.
+	c.Source = o.source
+	if c.Source == nil {
+		sourceNodes := nodes
+		if cfg.NodeGracePeriod > 0 {
+			sourceNodes = node.NewGraceLister(nodes, cfg.NodeGracePeriod)
+		}
+		if exclusions != nil {
+			sourceNodes = node.NewExcludingLister(sourceNodes, exclusions, instanceTags)
+		}
+		sources, err := source.ByNames(o.clientGenerator, cfg.Sources, sourceCfg, c.ClusterName, sourceNodes, recorder)
+		if err != nil {
+			return nil, err
+		}
+		// Combine multiple sources into a single.
+		c.Source = source.NewMultiSource(cfg.Sources, sources, cfg.SourceErrors == "best-effort")
+	}
+
+	// The subsystems left out of the managed ones get no registry, the controller skips them entirely.
+	// The firewall provider is still created above, it finds the cluster name.
+	if cfg.Manages("dns") {
+		vpcIDs, err := privateZoneVPCs(cfg.PrivateZoneVPCFilter, c.Firewall)
+		if err != nil {
+			return nil, err
+		}
+		c.Registry, c.DNSProvider, err = NewDNSRegistry(cfg, cfg.Provider, cfg.DomainFilter, cfg.ZoneIDFilter, cfg.AWSZoneType, vpcIDs)
+		if err != nil {
+			return nil, err
+		}
+		// Records pointing to the internal IPs of the nodes are published by a second provider when configured.
+		if cfg.InternalProvider != "" {
+			c.InternalRegistry, _, err = NewDNSRegistry(cfg, cfg.InternalProvider, cfg.InternalDomainFilter, cfg.InternalZoneIDFilter, cfg.InternalAWSZoneType, vpcIDs)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var exists bool
+	c.Policy, exists = plan.Policies[cfg.Policy]
+	if !exists {
+		return nil, fmt.Errorf("unknown policy: %s", cfg.Policy)
+	}
+
+	if cfg.Manages("extip") {
+		eipp, err := NewExtIPProvider(cfg, kubeClient)
+		if err != nil {
+			return nil, err
+		}
+		c.EipRegistry, err = eipregistry.NewRegistry(eipp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Manages("firewall") {
+		fwOpts := []fwregistry.Option{}
+		if c.History != nil {
+			fwOpts = append(fwOpts, fwregistry.WithHistory(c.History))
+		}
+		if acc != nil {
+			fwOpts = append(fwOpts, fwregistry.WithAccelerator(acc))
+		}
+		c.FwRegistry, err = fwregistry.NewRegistry(c.Firewall, cfg.FirewallCacheInterval, fwOpts...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c.ctrl = &controller.Controller{
+		Source:                c.Source,
+		Registry:              c.Registry,
+		InternalRegistry:      c.InternalRegistry,
+		FwRegistry:            c.FwRegistry,
+		EipRegistry:           c.EipRegistry,
+		Nodes:                 nodeCache,
+		Policy:                c.Policy,
+		Interval:              cfg.Interval,
+		Resync:                resyncChan,
+		Priority:              priorityChan,
+		FailureThreshold:      cfg.FailureThreshold,
+		FailurePause:          cfg.FailurePause,
+		StuckThreshold:        cfg.StuckThreshold,
+		StuckPause:            cfg.StuckPause,
+		CutoverDelay:          cfg.CutoverDelay,
+		FirewallGCInterval:    cfg.FirewallGCInterval,
+		FirewallGCGracePeriod: cfg.FirewallGCGracePeriod,
+		RepairOwnership:       cfg.TXTRepairOwnership,
+		ReplanStale:           cfg.TXTReplanStale,
+		Concurrent:            cfg.ConcurrentSync,
+		MonitorOnly:           cfg.MonitorOnly,
+		DryRun:                cfg.DryRun,
+		Events:                recorder,
+		State:                 o.state,
+	}
+	if exclusions != nil {
+		c.ctrl.ExcludedNodes = func() (map[string]string, error) {
+			all, err := nodes.List()
+			if err != nil {
+				return nil, err
+			}
+			var tags map[string]map[string]string
+			if instanceTags != nil {
+				tags = instanceTags()
+			}
+			return exclusions.Excluded(all, tags), nil
+		}
+	}
+	if cfg.NotifyWebhookURL != "" {
+		notifier, err := notify.NewWebhook(cfg.NotifyWebhookURL, cfg.NotifyFormat, cfg.NotifyTemplate)
+		if err != nil {
+			return nil, err
+		}
+		c.ctrl.Notifier = notifier
+		c.ctrl.LargePlan = cfg.NotifyLargePlan
+	}
+	if cfg.TraceOTLPEndpoint != "" {
+		headers, err := trace.ParseHeaders(cfg.TraceOTLPHeaders)
+		if err != nil {
+			return nil, err
+		}
+		c.ctrl.Tracer, err = trace.NewTracer(cfg.TraceOTLPEndpoint, "external-ips", headers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.PropagationTimeout > 0 {
+		c.ctrl.Verifier = &verify.Verifier{
+			Timeout:      cfg.PropagationTimeout,
+			PollInterval: 10 * time.Second,
+		}
+	}
+	return c, nil
+}
+
+// Run synchronizes the services every interval until stopChan is closed.
+func (c *Controller) Run(stopChan <-chan struct{}) {
+	c.ctrl.Run(stopChan)
+}
+
+// RunOnce synchronizes the services once, waiting for the applied records to be
+// verified if the propagation timeout is set.
+func (c *Controller) RunOnce() error {
+	err := c.ctrl.RunOnce()
+	if c.ctrl.Verifier != nil {
+		c.ctrl.Verifier.Wait()
+	}
+	return err
+}
+
+// newSourceConfig returns the configuration of the sources.
+func newSourceConfig(cfg *externalips.Config) *source.Config {
+	return &source.Config{
+		Namespace:                cfg.Namespace,
+		AnnotationFilter:         cfg.AnnotationFilter,
+		FQDNTemplate:             cfg.FQDNTemplate,
+		CombineFQDNAndAnnotation: cfg.CombineFQDNAndAnnotation,
+		Compatibility:            cfg.Compatibility,
+		PublishInternal:          cfg.PublishInternal,
+		InternalFQDNTemplate:     cfg.InternalFQDNTemplate,
+		DrainPeriod:              cfg.DrainPeriod,
+		SpotPolicy:               cfg.SpotPolicy,
+		SpotNodeSelector:         cfg.SpotNodeSelector,
+		DomainFilter:             cfg.DomainFilter,
+		ExcludeDomains:           cfg.ExcludeDomains,
+		SubdomainPerCluster:      cfg.SubdomainPerCluster,
+		SplitHorizon:             cfg.SplitHorizon,
+		ActiveSlot:               cfg.ActiveSlot,
+		ServiceLabels:            cfg.ServiceLabels,
+		FirewallNameTemplate:     cfg.FirewallNameTemplate,
+		NodePortRange:            cfg.FirewallNodePortRange,
+		CRDSourceAPIVersion:      cfg.CRDSourceAPIVersion,
+		CRDSourceKind:            cfg.CRDSourceKind,
+		Fake: source.FakeConfig{
+			Endpoints:    cfg.FakeEndpoints,
+			InboundRules: cfg.FakeInboundRules,
+			ExtIPs:       cfg.FakeExtIPs,
+			Churn:        cfg.FakeChurn,
+			Seed:         cfg.FakeSeed,
+		},
+	}
+}
+
+// privateZoneVPCs returns the VPCs of the private zones to manage, replacing auto
+// with the VPCs of the nodes.
+func privateZoneVPCs(filter []string, fwp fwprovider.Provider) ([]string, error) {
+	vpcIDs := make([]string, 0, len(filter))
+	for _, id := range filter {
+		if id == "auto" {
+			awsProvider, ok := fwp.(*fwprovider.AWSProvider)
+			if !ok {
+				return nil, fmt.Errorf("the VPC of the nodes can only be detected by the aws firewall provider")
+			}
+			// the nodes spanning several regions have a VPC in each of them
+			nodeVPCs, err := awsProvider.GetVPCIDs()
+			if err != nil {
+				return nil, err
+			}
+			log.Infof("Only managing the private zones associated with the VPCs of the nodes: %s", strings.Join(nodeVPCs, ", "))
+			vpcIDs = append(vpcIDs, nodeVPCs...)
+			continue
+		}
+		vpcIDs = append(vpcIDs, id)
+	}
+	return vpcIDs, nil
+}
+
+// NewFirewallHistory creates the configured store of the snapshots of the desired
+// inbound rules, nil if none is.
+func NewFirewallHistory(cfg *externalips.Config, kubeClient kubernetes.Interface, clusterName string) (history.Store, error) {
+	switch cfg.FirewallHistory {
+	case "":
+		return nil, nil
+	case "configmap":
+		parts := strings.SplitN(cfg.FirewallHistoryCM, "/", 2)
+		return history.NewConfigMapStore(kubeClient, parts[0], parts[1], cfg.FirewallHistoryTTL), nil
+	case "dynamodb":
+		return history.NewDynamoDBStore(history.DynamoDBConfig{
+			Table:      cfg.FirewallHistoryTable,
+			Region:     dynamoDBRegion(cfg),
+			AssumeRole: cfg.FirewallAssumeRole(),
+			Cluster:    clusterName,
+			Retention:  cfg.FirewallHistoryTTL,
+		})
+	}
+	return nil, fmt.Errorf("unknown firewall history: %s", cfg.FirewallHistory)
+}
@@ -0,0 +1,270 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package operator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	eipprovider "github.com/openfresh/external-ips/extip/provider"
+	"github.com/openfresh/external-ips/firewall/accelerator"
+	"github.com/openfresh/external-ips/firewall/history"
+	fwprovider "github.com/openfresh/external-ips/firewall/provider"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+// Zones are the zones a DNS provider is limited to.
+type Zones = provider.Zones
+
+// DNSProvider binds the configuration to a DNS provider.
+type DNSProvider = provider.Registration
+
+// Nodes are the nodes the firewall provider assigns the security groups to.
+type Nodes = fwprovider.Nodes
+
+// FirewallProvider binds the configuration to a firewall provider.
+type FirewallProvider = fwprovider.Registration
+
+// ExtIPProvider binds the configuration to an external IPs provider.
+type ExtIPProvider = eipprovider.Registration
+
+// RegisterDNSProvider makes a DNS provider available by the name, e.g. to the
+// provider and internal-provider settings of the configuration. It panics if
+// the name is already registered.
+func RegisterDNSProvider(name string, p DNSProvider) {
+	provider.Register(name, p)
+}
+
+// RegisterFirewallProvider makes a firewall provider available by the name, e.g.
+// to the firewall-provider setting of the configuration. It panics if the name is
+// already registered.
+func RegisterFirewallProvider(name string, p FirewallProvider) {
+	fwprovider.Register(name, p)
+}
+
+// RegisterExtIPProvider makes an external IPs provider available by the name, e.g.
+// to the extip-provider setting of the configuration. It panics if the name is
+// already registered.
+func RegisterExtIPProvider(name string, p ExtIPProvider) {
+	eipprovider.Register(name, p)
+}
+
+// DNSProviders returns the sorted names of the registered DNS providers.
+func DNSProviders() []string {
+	return provider.Names()
+}
+
+// FirewallProviders returns the sorted names of the registered firewall providers.
+func FirewallProviders() []string {
+	return fwprovider.Names()
+}
+
+// ExtIPProviders returns the sorted names of the registered external IPs providers.
+func ExtIPProviders() []string {
+	return eipprovider.Names()
+}
+
+// NewFirewallProvider creates the firewall provider of the configuration.
+func NewFirewallProvider(cfg *externalips.Config, nodes Nodes) (fwprovider.Provider, error) {
+	r, ok := fwprovider.Lookup(cfg.FirewallProvider)
+	if !ok {
+		return nil, fmt.Errorf("unknown firewall provider: %s", cfg.FirewallProvider)
+	}
+	return r.New(cfg, nodes)
+}
+
+// NewExtIPProvider creates the external IPs provider of the configuration.
+func NewExtIPProvider(cfg *externalips.Config, kubeClient kubernetes.Interface) (eipprovider.Provider, error) {
+	r, ok := eipprovider.Lookup(cfg.ExtIPProvider)
+	if !ok {
+		return nil, fmt.Errorf("unknown external IPs provider: %s", cfg.ExtIPProvider)
+	}
+	return r.New(cfg, kubeClient)
+}
+
+// NewDNSRegistry creates the dns provider of the given name limited to the given zones,
+// and wraps it in the configured registry. The provider is returned too, before any cache.
+func NewDNSRegistry(cfg *externalips.Config, name string, domains, zoneIDs []string, zoneType string, vpcIDs []string) (registry.Registry, provider.Provider, error) {
+	registryName := cfg.Registry
+
+	dnsProvider, ok := provider.Lookup(name)
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown dns provider: %s", name)
+	}
+	// Check that only compatible Registry is used with AWS-SD
+	if name == "aws-sd" && registryName != "noop" && registryName != "aws-sd" {
+		log.Infof("Registry \"%s\" cannot be used with AWS ServiceDiscovery. Switching to \"aws-sd\".", registryName)
+		registryName = "aws-sd"
+	}
+	p, err := dnsProvider.New(cfg, Zones{
+		DomainFilter:   provider.NewDomainFilterWithExclusions(domains, cfg.ExcludeDomains),
+		ZoneIDFilter:   provider.NewZoneIDFilter(zoneIDs),
+		ZoneTypeFilter: provider.NewZoneTypeFilter(zoneType),
+		ZoneType:       zoneType,
+		VPCIDs:         vpcIDs,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the aws-sd registry needs the provider itself
+	cached := p
+	if cfg.DNSCacheInterval > 0 && registryName != "aws-sd" {
+		cached = provider.NewCachedProvider(p, cfg.DNSCacheInterval)
+	}
+
+	var r registry.Registry
+	switch registryName {
+	case "noop":
+		r, err = registry.NewNoopRegistry(cached)
+	case "txt":
+		var key []byte
+		if cfg.TXTEncryptionKeyFile != "" {
+			data, err := ioutil.ReadFile(cfg.TXTEncryptionKeyFile)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to read the TXT encryption key: %v", err)
+			}
+			// the keys of the Secrets mounted as files often end with a newline
+			key = []byte(strings.TrimSpace(string(data)))
+		}
+		r, err = registry.NewTXTRegistry(cached, cfg.TXTPrefix, cfg.TXTOwnerID, cfg.TXTReadOwnerIDs, cfg.TXTCacheInterval, key, cfg.TXTFormat)
+	case "aws-sd":
+		sd, ok := p.(*provider.AWSSDProvider)
+		if !ok {
+			return nil, nil, fmt.Errorf("the aws-sd registry requires the aws-sd dns provider, not %s", name)
+		}
+		r, err = registry.NewAWSSDRegistry(sd, cfg.TXTOwnerID)
+	case "dynamodb":
+		r, err = registry.NewDynamoDBRegistry(cached, registry.DynamoDBConfig{
+			Table:      cfg.DynamoDBTable,
+			Region:     dynamoDBRegion(cfg),
+			AssumeRole: cfg.DNSAssumeRole(),
+			OwnerID:    cfg.TXTOwnerID,
+			TXTPrefix:  cfg.TXTPrefix,
+			MirrorTXT:  cfg.DynamoDBMirrorTXT,
+			// the ownership is migrated when reading the records, which happens in monitor-only mode too
+			DryRun: cfg.DryRun || cfg.MonitorOnly,
+		})
+	default:
+		return nil, nil, fmt.Errorf("unknown registry: %s", registryName)
+	}
+	return r, p, err
+}
+
+// RolePermissions are the IAM policy statements required of a role, Role being
+// empty for the credentials of the pod.
+type RolePermissions struct {
+	Role       string
+	Statements []permissions.Statement
+}
+
+// Permissions returns the IAM policy statements required by the configured providers,
+// one set per role: the statements of the records are required of the DNS role and
+// those of the security groups and of the instances of the firewall role, which only
+// make separate sets when the roles differ.
+func Permissions(cfg *externalips.Config) []RolePermissions {
+	dns, firewall := dnsPermissions(cfg), firewallPermissions(cfg)
+
+	// nothing is ever modified in monitor-only mode
+	if cfg.MonitorOnly {
+		dns, firewall = permissions.ReadOnly(dns), permissions.ReadOnly(firewall)
+	}
+
+	if cfg.DNSAssumeRole() == cfg.FirewallAssumeRole() {
+		return []RolePermissions{{Role: cfg.DNSAssumeRole(), Statements: append(dns, firewall...)}}
+	}
+	return []RolePermissions{
+		{Role: cfg.DNSAssumeRole(), Statements: dns},
+		{Role: cfg.FirewallAssumeRole(), Statements: firewall},
+	}
+}
+
+// dnsPermissions returns the IAM policy statements required by the DNS providers and their
+// registry, none unless the records are managed.
+func dnsPermissions(cfg *externalips.Config) []permissions.Statement {
+	statements := []permissions.Statement{}
+	if !cfg.Manages("dns") {
+		return statements
+	}
+
+	dnsProviders := []struct {
+		name    string
+		zoneIDs []string
+	}{
+		{cfg.Provider, cfg.ZoneIDFilter},
+		{cfg.InternalProvider, cfg.InternalZoneIDFilter},
+	}
+	for _, dns := range dnsProviders {
+		if dns.name == "" {
+			continue
+		}
+		if r, ok := provider.Lookup(dns.name); ok && r.Permissions != nil {
+			statements = append(statements, r.Permissions(dns.zoneIDs)...)
+			continue
+		}
+		log.Infof("dns provider %s does not require IAM permissions", dns.name)
+	}
+
+	if cfg.Registry == "dynamodb" {
+		statements = append(statements, registry.DynamoDBPermissions(cfg.DynamoDBTable)...)
+	}
+	return statements
+}
+
+// firewallPermissions returns the IAM policy statements required by the listing of the nodes
+// and by the firewall provider and its history, only the read-only statements of the provider
+// when the firewall isn't managed, which it still needs to find the name of the cluster.
+func firewallPermissions(cfg *externalips.Config) []permissions.Statement {
+	statements := []permissions.Statement{}
+
+	if cfg.Manages("firewall") && cfg.FirewallHistory == "dynamodb" {
+		statements = append(statements, history.DynamoDBPermissions(cfg.FirewallHistoryTable)...)
+	}
+	if cfg.Manages("firewall") && cfg.AWSGlobalAcceleratorARN != "" {
+		statements = append(statements, accelerator.AWSPermissions(cfg.AWSGlobalAcceleratorARN)...)
+	}
+	if len(nonEmpty(cfg.AWSASGNodeTags)) > 0 {
+		statements = append(statements, node.ASGPermissions()...)
+	}
+
+	if r, ok := fwprovider.Lookup(cfg.FirewallProvider); ok && r.Permissions != nil {
+		if cfg.Manages("firewall") {
+			statements = append(statements, r.Permissions(cfg.ClusterName)...)
+		} else {
+			statements = append(statements, permissions.ReadOnly(r.Permissions(cfg.ClusterName))...)
+		}
+	} else {
+		log.Infof("firewall provider %s does not require IAM permissions", cfg.FirewallProvider)
+	}
+	return statements
+}
+
+// dynamoDBRegion returns the region of the DynamoDB tables, the AWS region when
+// none is configured, empty for the region of the AWS configuration.
+func dynamoDBRegion(cfg *externalips.Config) string {
+	if cfg.DynamoDBRegion != "" {
+		return cfg.DynamoDBRegion
+	}
+	return cfg.AWSRegion
+}
+
+// nonEmpty returns the values which aren't empty, the repeatable flags defaulting to a single empty value.
+func nonEmpty(values []string) []string {
+	result := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return result
+}
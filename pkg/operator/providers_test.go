@@ -0,0 +1,201 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package operator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/dns/registry"
+	eipprovider "github.com/openfresh/external-ips/extip/provider"
+	fwprovider "github.com/openfresh/external-ips/firewall/provider"
+	"github.com/openfresh/external-ips/permissions"
+	"github.com/openfresh/external-ips/pkg/apis/externalips"
+)
+
+func TestBuiltinProviders(t *testing.T) {
+	assert.Subset(t, DNSProviders(), []string{"aws", "aws-sd", "ns1"})
+	assert.Subset(t, FirewallProviders(), []string{"aws", "openstack"})
+}
+
+func TestRegisterDNSProvider(t *testing.T) {
+	var zones Zones
+	inMemory := provider.NewInMemoryProvider()
+	RegisterDNSProvider("test-dns", DNSProvider{
+		New: func(cfg *externalips.Config, z Zones) (provider.Provider, error) {
+			zones = z
+			return inMemory, nil
+		},
+		Permissions: func(zoneIDs []string) []permissions.Statement {
+			return []permissions.Statement{{Effect: permissions.EffectAllow, Action: []string{"test:ListZones"}, Resource: zoneIDs}}
+		},
+	})
+	assert.Contains(t, DNSProviders(), "test-dns")
+	assert.Panics(t, func() { RegisterDNSProvider("test-dns", DNSProvider{New: nil}) })
+	assert.Panics(t, func() {
+		RegisterDNSProvider("aws", DNSProvider{New: func(*externalips.Config, Zones) (provider.Provider, error) { return nil, nil }})
+	})
+
+	cfg := externalips.NewConfig()
+	cfg.Registry = "noop"
+	cfg.ExcludeDomains = []string{"internal.example.org"}
+	r, p, err := NewDNSRegistry(cfg, "test-dns", []string{"example.org"}, []string{"zone-1"}, "public", []string{"vpc-1"})
+	require.NoError(t, err)
+	assert.Equal(t, inMemory, p)
+	assert.IsType(t, &registry.NoopRegistry{}, r)
+	assert.True(t, zones.DomainFilter.Match("foo.example.org"))
+	assert.False(t, zones.DomainFilter.Match("foo.internal.example.org"))
+	assert.Equal(t, "public", zones.ZoneType)
+	assert.Equal(t, []string{"vpc-1"}, zones.VPCIDs)
+
+	_, _, err = NewDNSRegistry(cfg, "unknown", nil, nil, "", nil)
+	assert.Error(t, err)
+
+	// the aws-sd registry needs the aws-sd provider
+	cfg.Registry = "aws-sd"
+	_, _, err = NewDNSRegistry(cfg, "test-dns", nil, nil, "", nil)
+	assert.Error(t, err)
+
+	cfg = externalips.NewConfig()
+	cfg.Provider = "test-dns"
+	cfg.ZoneIDFilter = []string{"zone-1"}
+	cfg.FirewallProvider = "test-firewall"
+	assert.Equal(t, []RolePermissions{{Statements: []permissions.Statement{
+		{Effect: permissions.EffectAllow, Action: []string{"test:ListZones"}, Resource: []string{"zone-1"}},
+	}}}, Permissions(cfg))
+}
+
+func TestPermissionsByRole(t *testing.T) {
+	actions := func(statements []permissions.Statement) []string {
+		result := []string{}
+		for _, s := range statements {
+			result = append(result, s.Action...)
+		}
+		return result
+	}
+	resources := func(statements []permissions.Statement) []string {
+		result := []string{}
+		for _, s := range statements {
+			result = append(result, s.Resource...)
+		}
+		return result
+	}
+
+	cfg := externalips.NewConfig()
+	cfg.Provider = "aws"
+	cfg.FirewallProvider = "aws"
+	cfg.Registry = "dynamodb"
+	cfg.DynamoDBTable = "records"
+	cfg.FirewallHistory = "dynamodb"
+	cfg.FirewallHistoryTable = "snapshots"
+	cfg.AWSASGNodeTags = []string{"k8s.io/role/node"}
+	cfg.AWSAssumeRole = "arn:aws:iam::123456789012:role/external-ips"
+
+	roles := Permissions(cfg)
+	require.Len(t, roles, 1)
+	assert.Equal(t, cfg.AWSAssumeRole, roles[0].Role)
+	assert.Contains(t, actions(roles[0].Statements), "route53:ChangeResourceRecordSets")
+	assert.Contains(t, actions(roles[0].Statements), "ec2:AuthorizeSecurityGroupIngress")
+
+	// the statements of the records go to the DNS role, the others to the firewall role
+	cfg.AWSDNSAssumeRole = "arn:aws:iam::210987654321:role/external-ips-dns"
+	roles = Permissions(cfg)
+	require.Len(t, roles, 2)
+	assert.Equal(t, cfg.AWSDNSAssumeRole, roles[0].Role)
+	assert.Contains(t, actions(roles[0].Statements), "route53:ChangeResourceRecordSets")
+	assert.NotContains(t, actions(roles[0].Statements), "ec2:AuthorizeSecurityGroupIngress")
+	assert.NotContains(t, actions(roles[0].Statements), "autoscaling:DescribeAutoScalingGroups")
+	assert.Equal(t, cfg.AWSAssumeRole, roles[1].Role)
+	assert.Contains(t, actions(roles[1].Statements), "ec2:AuthorizeSecurityGroupIngress")
+	assert.Contains(t, actions(roles[1].Statements), "autoscaling:DescribeAutoScalingGroups")
+	assert.NotContains(t, actions(roles[1].Statements), "route53:ChangeResourceRecordSets")
+	assert.Contains(t, resources(roles[0].Statements), "arn:aws:dynamodb:*:*:table/records")
+	assert.NotContains(t, resources(roles[0].Statements), "arn:aws:dynamodb:*:*:table/snapshots")
+	assert.Contains(t, resources(roles[1].Statements), "arn:aws:dynamodb:*:*:table/snapshots")
+	assert.NotContains(t, resources(roles[1].Statements), "arn:aws:dynamodb:*:*:table/records")
+}
+
+func TestPermissionsOfManagedSubsystems(t *testing.T) {
+	actions := func(roles []RolePermissions) []string {
+		result := []string{}
+		for _, r := range roles {
+			for _, s := range r.Statements {
+				result = append(result, s.Action...)
+			}
+		}
+		return result
+	}
+
+	cfg := externalips.NewConfig()
+	cfg.Provider = "aws"
+	cfg.FirewallProvider = "aws"
+	cfg.FirewallHistory = "dynamodb"
+	cfg.FirewallHistoryTable = "snapshots"
+	cfg.AWSASGNodeTags = []string{"k8s.io/role/node"}
+
+	cfg.Manage = "dns"
+	assert.Contains(t, actions(Permissions(cfg)), "route53:ChangeResourceRecordSets")
+	assert.NotContains(t, actions(Permissions(cfg)), "ec2:AuthorizeSecurityGroupIngress")
+	assert.NotContains(t, actions(Permissions(cfg)), "dynamodb:PutItem")
+	// the nodes are listed and the cluster name found whatever the managed subsystems
+	assert.Contains(t, actions(Permissions(cfg)), "autoscaling:DescribeAutoScalingGroups")
+	assert.Contains(t, actions(Permissions(cfg)), "ec2:DescribeInstances")
+
+	cfg.Manage = "firewall,extip"
+	assert.NotContains(t, actions(Permissions(cfg)), "route53:ChangeResourceRecordSets")
+	assert.Contains(t, actions(Permissions(cfg)), "ec2:AuthorizeSecurityGroupIngress")
+	assert.Contains(t, actions(Permissions(cfg)), "dynamodb:PutItem")
+
+	cfg.Manage = "extip"
+	assert.Contains(t, actions(Permissions(cfg)), "autoscaling:DescribeAutoScalingGroups")
+	assert.Contains(t, actions(Permissions(cfg)), "ec2:DescribeSecurityGroups")
+	assert.NotContains(t, actions(Permissions(cfg)), "route53:ChangeResourceRecordSets")
+	assert.NotContains(t, actions(Permissions(cfg)), "ec2:AuthorizeSecurityGroupIngress")
+}
+
+func TestRegisterFirewallProvider(t *testing.T) {
+	var nodes Nodes
+	RegisterFirewallProvider("test-firewall", FirewallProvider{
+		New: func(cfg *externalips.Config, n Nodes) (fwprovider.Provider, error) {
+			nodes = n
+			return nil, nil
+		},
+	})
+	assert.Contains(t, FirewallProviders(), "test-firewall")
+	assert.Panics(t, func() { RegisterFirewallProvider("test-firewall", FirewallProvider{New: nil}) })
+
+	cfg := externalips.NewConfig()
+	cfg.FirewallProvider = "test-firewall"
+	_, err := NewFirewallProvider(cfg, Nodes{})
+	require.NoError(t, err)
+	assert.Equal(t, Nodes{}, nodes)
+
+	cfg.FirewallProvider = "unknown"
+	_, err = NewFirewallProvider(cfg, Nodes{})
+	assert.Error(t, err)
+}
+
+func TestRegisterExtIPProvider(t *testing.T) {
+	assert.Contains(t, ExtIPProviders(), "kubernetes")
+	RegisterExtIPProvider("test-extip", ExtIPProvider{
+		New: func(cfg *externalips.Config, kubeClient kubernetes.Interface) (eipprovider.Provider, error) {
+			return nil, nil
+		},
+	})
+	assert.Contains(t, ExtIPProviders(), "test-extip")
+
+	cfg := externalips.NewConfig()
+	cfg.ExtIPProvider = "test-extip"
+	_, err := NewExtIPProvider(cfg, nil)
+	require.NoError(t, err)
+
+	cfg.ExtIPProvider = "unknown"
+	_, err = NewExtIPProvider(cfg, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package preflight projects the usage of the cloud quotas once the desired
+// setting is applied, so that a rollout which would exceed them is caught
+// before any change is made.
+package preflight
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/dns/registry"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	fwplan "github.com/openfresh/external-ips/firewall/plan"
+	"github.com/openfresh/external-ips/source"
+)
+
+// The quotas checked by the preflight.
+const (
+	QuotaRecordsPerZone        = "records per zone"
+	QuotaSecurityGroups        = "security groups per VPC"
+	QuotaRulesPerGroup         = "rules per security group"
+	QuotaExternalIPsPerService = "external IPs per service"
+)
+
+// Quotas are the limits of the cloud resources, 0 disables a check.
+type Quotas struct {
+	RecordsPerZone        int
+	SecurityGroups        int
+	RulesPerGroup         int
+	ExternalIPsPerService int
+}
+
+// RecordProjector is a DNS provider telling the number of records of each of its
+// zones once the changes are applied.
+type RecordProjector interface {
+	ProjectRecords(changes *plan.Changes) (map[string]int, error)
+}
+
+// GroupCounter is a firewall provider telling the number of security groups
+// sharing the quota of the security groups of the cluster.
+type GroupCounter interface {
+	SecurityGroupCount() (int, error)
+}
+
+// RuleLister lists the current inbound rules, e.g. the firewall registry.
+type RuleLister interface {
+	Rules() ([]*inbound.InboundRules, error)
+}
+
+// Preflight compares the usage of the quotas once the desired setting is applied
+// with the quotas, without applying anything.
+type Preflight struct {
+	Source   source.Source
+	Registry registry.Registry
+	// The policy that defines which changes to DNS records are allowed
+	Policy plan.Policy
+	// The DNS provider, nil skips the records per zone
+	Records RecordProjector
+	Rules   RuleLister
+	// The firewall provider, nil skips the security groups per VPC
+	Groups GroupCounter
+	Quotas Quotas
+}
+
+// Usage is the projected usage of a quota by a resource.
+type Usage struct {
+	Quota     string
+	Resource  string
+	Projected int
+	Limit     int
+}
+
+// Exceeded returns whether the projected usage exceeds the quota.
+func (u Usage) Exceeded() bool {
+	return u.Limit > 0 && u.Projected > u.Limit
+}
+
+// Report is the outcome of a preflight.
+type Report struct {
+	Usages []Usage
+	// The quotas which couldn't be checked, with the reason
+	Skipped map[string]string
+}
+
+// Failed returns whether any quota would be exceeded.
+func (r *Report) Failed() bool {
+	return len(r.Violations()) > 0
+}
+
+// Violations returns the usages exceeding their quota.
+func (r *Report) Violations() []Usage {
+	var result []Usage
+	for _, u := range r.Usages {
+		if u.Exceeded() {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+// Print writes the highest usage of every quota, then every violation.
+func (r *Report) Print(w io.Writer) {
+	highest := map[string]Usage{}
+	for _, u := range r.Usages {
+		if h, ok := highest[u.Quota]; !ok || u.Projected > h.Projected {
+			highest[u.Quota] = u
+		}
+	}
+	for _, quota := range []string{QuotaRecordsPerZone, QuotaSecurityGroups, QuotaRulesPerGroup, QuotaExternalIPsPerService} {
+		if reason, ok := r.Skipped[quota]; ok {
+			fmt.Fprintf(w, "%-26s skipped: %s\n", quota, reason)
+			continue
+		}
+		u, ok := highest[quota]
+		if !ok {
+			fmt.Fprintf(w, "%-26s none\n", quota)
+			continue
+		}
+		fmt.Fprintf(w, "%-26s %6d / %-6d %s\n", quota, u.Projected, u.Limit, u.Resource)
+	}
+	for _, u := range r.Violations() {
+		fmt.Fprintf(w, "EXCEEDED %s: %s would have %d, above %d\n", u.Quota, u.Resource, u.Projected, u.Limit)
+	}
+}
+
+// Run projects the usage of every enabled quota.
+func (p *Preflight) Run() (*Report, error) {
+	desired, err := p.Source.ExternalIPSetting()
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{Skipped: map[string]string{}}
+
+	if p.Quotas.RecordsPerZone <= 0 {
+		report.Skipped[QuotaRecordsPerZone] = "disabled"
+	} else if p.Records == nil {
+		report.Skipped[QuotaRecordsPerZone] = "not supported by the DNS provider"
+	} else if err := p.projectRecords(report, desired.Endpoints); err != nil {
+		return nil, err
+	}
+
+	if p.Quotas.SecurityGroups <= 0 {
+		report.Skipped[QuotaSecurityGroups] = "disabled"
+	} else if p.Groups == nil {
+		report.Skipped[QuotaSecurityGroups] = "not supported by the firewall provider"
+	} else if err := p.projectGroups(report, desired.InboundRules); err != nil {
+		return nil, err
+	}
+
+	if p.Quotas.RulesPerGroup <= 0 {
+		report.Skipped[QuotaRulesPerGroup] = "disabled"
+	} else {
+		for _, r := range desired.InboundRules {
+			report.Usages = append(report.Usages, Usage{QuotaRulesPerGroup, r.Name, ruleCount(r), p.Quotas.RulesPerGroup})
+		}
+	}
+
+	if p.Quotas.ExternalIPsPerService <= 0 {
+		report.Skipped[QuotaExternalIPsPerService] = "disabled"
+	} else {
+		for _, e := range desired.ExtIPs {
+			report.Usages = append(report.Usages, Usage{QuotaExternalIPsPerService, e.Namespace + "/" + e.SvcName, len(e.ExtIPs), p.Quotas.ExternalIPsPerService})
+		}
+	}
+
+	sort.SliceStable(report.Usages, func(i, j int) bool {
+		if report.Usages[i].Quota != report.Usages[j].Quota {
+			return report.Usages[i].Quota < report.Usages[j].Quota
+		}
+		return report.Usages[i].Resource < report.Usages[j].Resource
+	})
+	return report, nil
+}
+
+// projectRecords adds the number of records of each zone once the records the
+// registry would send to the provider, e.g. along with their TXT records, are applied.
+func (p *Preflight) projectRecords(report *Report, desired []*endpoint.Endpoint) error {
+	current, err := p.Registry.Records()
+	if err != nil {
+		return err
+	}
+	changes := (&plan.Plan{
+		Policies: []plan.Policy{p.Policy},
+		Current:  current,
+		Desired:  desired,
+	}).Calculate().Changes
+	if previewer, ok := p.Registry.(registry.Previewer); ok {
+		changes = previewer.Preview(changes)
+	}
+
+	counts, err := p.Records.ProjectRecords(changes)
+	if err != nil {
+		return err
+	}
+	for zone, count := range counts {
+		report.Usages = append(report.Usages, Usage{QuotaRecordsPerZone, zone, count, p.Quotas.RecordsPerZone})
+	}
+	return nil
+}
+
+// projectGroups adds the number of security groups once the groups of the rules
+// are created and deleted.
+func (p *Preflight) projectGroups(report *Report, desired []*inbound.InboundRules) error {
+	current, err := p.Rules.Rules()
+	if err != nil {
+		return err
+	}
+	changes := (&fwplan.Plan{Current: current, Desired: desired}).Calculate().Changes
+
+	count, err := p.Groups.SecurityGroupCount()
+	if err != nil {
+		return err
+	}
+	report.Usages = append(report.Usages, Usage{QuotaSecurityGroups, "VPC", count + len(changes.Create) - len(changes.Delete), p.Quotas.SecurityGroups})
+	return nil
+}
+
+// ruleCount returns the number of rules of the security group of the inbound
+// rules, each source range or security group of a port being a rule.
+func ruleCount(r *inbound.InboundRules) int {
+	n := 0
+	for _, rule := range r.Rules {
+		n += len(rule.CIDRs())
+		if rule.SourceSecurityGroup != "" {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package preflight
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/plan"
+	"github.com/openfresh/external-ips/extip/extip"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/internal/testutils"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// fakeRegistry returns the given records.
+type fakeRegistry struct {
+	records []*endpoint.Endpoint
+}
+
+func (r *fakeRegistry) Records() ([]*endpoint.Endpoint, error) {
+	return r.records, nil
+}
+
+func (r *fakeRegistry) ApplyChanges(changes *plan.Changes) error {
+	panic("the preflight applies nothing")
+}
+
+// fakeZones holds the given number of records in a single zone.
+type fakeZones struct {
+	records int
+}
+
+func (z *fakeZones) ProjectRecords(changes *plan.Changes) (map[string]int, error) {
+	return map[string]int{"example.org.": z.records + len(changes.Create) - len(changes.Delete)}, nil
+}
+
+// fakeFirewall holds the given rules among the given number of security groups.
+type fakeFirewall struct {
+	rules  []*inbound.InboundRules
+	groups int
+}
+
+func (f *fakeFirewall) Rules() ([]*inbound.InboundRules, error) {
+	return f.rules, nil
+}
+
+func (f *fakeFirewall) SecurityGroupCount() (int, error) {
+	return f.groups, nil
+}
+
+func newPreflight(quotas Quotas) *Preflight {
+	src := new(testutils.MockSource)
+	src.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{
+		Endpoints: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+			endpoint.NewEndpoint("bar.example.org", endpoint.RecordTypeA, "1.2.3.4"),
+		},
+		InboundRules: []*inbound.InboundRules{
+			{
+				Name: "foo.kube.openfresh.io",
+				Rules: []inbound.InboundRule{
+					{Protocol: "tcp", Port: 80},
+					{Protocol: "tcp", Port: 443, SourceCIDRs: []string{"10.0.0.0/8", "192.168.0.0/16", "10.0.0.0/8"}, SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+				},
+			},
+			{Name: "bar.kube.openfresh.io", Rules: []inbound.InboundRule{{Protocol: "tcp", Port: 80}}},
+		},
+		ExtIPs: []*extip.ExtIP{
+			{Namespace: "default", SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4", "1.2.3.5"}},
+		},
+	}, nil)
+
+	firewall := &fakeFirewall{
+		rules:  []*inbound.InboundRules{{Name: "bar.kube.openfresh.io"}, {Name: "baz.kube.openfresh.io"}},
+		groups: 9,
+	}
+	return &Preflight{
+		Source:   src,
+		Registry: &fakeRegistry{records: []*endpoint.Endpoint{endpoint.NewEndpoint("foo.example.org", endpoint.RecordTypeA, "1.2.3.4")}},
+		Policy:   &plan.SyncPolicy{},
+		Records:  &fakeZones{records: 4},
+		Rules:    firewall,
+		Groups:   firewall,
+		Quotas:   quotas,
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	report, err := newPreflight(Quotas{RecordsPerZone: 5, SecurityGroups: 9, RulesPerGroup: 4, ExternalIPsPerService: 1}).Run()
+	require.NoError(t, err)
+
+	assert.Equal(t, []Usage{
+		// a group is created for foo, and the group of baz is deleted
+		{QuotaExternalIPsPerService, "default/foo", 2, 1},
+		{QuotaRecordsPerZone, "example.org.", 5, 5},
+		{QuotaRulesPerGroup, "bar.kube.openfresh.io", 1, 4},
+		{QuotaRulesPerGroup, "foo.kube.openfresh.io", 4, 4},
+		{QuotaSecurityGroups, "VPC", 9, 9},
+	}, report.Usages)
+	assert.Empty(t, report.Skipped)
+	assert.True(t, report.Failed())
+	assert.Equal(t, []Usage{{QuotaExternalIPsPerService, "default/foo", 2, 1}}, report.Violations())
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Contains(t, out.String(), "EXCEEDED external IPs per service: default/foo would have 2, above 1")
+}
+
+func TestPreflightSkipped(t *testing.T) {
+	p := newPreflight(Quotas{RecordsPerZone: 5, SecurityGroups: 9})
+	p.Groups = nil
+
+	report, err := p.Run()
+	require.NoError(t, err)
+	assert.False(t, report.Failed())
+	assert.Equal(t, map[string]string{
+		QuotaSecurityGroups:        "not supported by the firewall provider",
+		QuotaRulesPerGroup:         "disabled",
+		QuotaExternalIPsPerService: "disabled",
+	}, report.Skipped)
+
+	var out bytes.Buffer
+	report.Print(&out)
+	assert.Equal(t, `records per zone                5 / 5      example.org.
+security groups per VPC    skipped: not supported by the firewall provider
+rules per security group   skipped: disabled
+external IPs per service   skipped: disabled
+`, out.String())
+}
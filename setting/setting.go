@@ -1,13 +1,26 @@
 package setting
 
 import (
+	"time"
+
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/firewall/inbound"
 )
 
 type ExternalIPSetting struct {
-	Endpoints    []*endpoint.Endpoint
-	InboundRules []*inbound.InboundRules
-	ExtIPs       []*extip.ExtIP
+	Endpoints []*endpoint.Endpoint
+	// InternalEndpoints point to the internal IPs of the nodes, for split-horizon DNS
+	InternalEndpoints []*endpoint.Endpoint
+	InboundRules      []*inbound.InboundRules
+	ExtIPs            []*extip.ExtIP
+	// NextExpiry is the earliest deadline of the services exposed for a limited time, zero if none is
+	NextExpiry time.Time
+}
+
+// AddExpiry keeps the deadline as NextExpiry if it comes first.
+func (s *ExternalIPSetting) AddExpiry(deadline time.Time) {
+	if !deadline.IsZero() && (s.NextExpiry.IsZero() || deadline.Before(s.NextExpiry)) {
+		s.NextExpiry = deadline
+	}
 }
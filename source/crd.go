@@ -0,0 +1,139 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// DNSEndpoint is a resource holding DNS records, as the DNSEndpoint of external-dns.
+type DNSEndpoint struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              DNSEndpointSpec `json:"spec"`
+}
+
+// DNSEndpointSpec lists the records of a DNSEndpoint.
+type DNSEndpointSpec struct {
+	Endpoints []CRDEndpoint `json:"endpoints,omitempty"`
+}
+
+// CRDEndpoint is a record of a DNSEndpoint. The record type is A if its targets
+// are IPs, CNAME otherwise, when empty.
+type CRDEndpoint struct {
+	DNSName    string   `json:"dnsName,omitempty"`
+	Targets    []string `json:"targets,omitempty"`
+	RecordType string   `json:"recordType,omitempty"`
+	RecordTTL  int64    `json:"recordTTL,omitempty"`
+	// The properties of the record specific to the DNS provider
+	ProviderSpecific endpoint.ProviderSpecific `json:"providerSpecific,omitempty"`
+}
+
+// CRDClient lists the resources holding DNS records of a namespace, of all namespaces if empty.
+type CRDClient interface {
+	DNSEndpoints(namespace string) ([]DNSEndpoint, error)
+}
+
+// crdRESTClient is a CRDClient reading the resources of an API version and kind
+// from the API server as JSON.
+type crdRESTClient struct {
+	client   rest.Interface
+	api      string
+	resource string
+}
+
+// NewCRDClient returns a CRDClient reading the resources of the given API version,
+// e.g. externaldns.k8s.io/v1alpha1, and kind, e.g. DNSEndpoint, with the given
+// REST client. The resource of the kind is its lower cased plural.
+func NewCRDClient(client rest.Interface, apiVersion, kind string) CRDClient {
+	return &crdRESTClient{
+		client:   client,
+		api:      "/apis/" + apiVersion,
+		resource: strings.ToLower(kind) + "s",
+	}
+}
+
+func (c *crdRESTClient) DNSEndpoints(namespace string) ([]DNSEndpoint, error) {
+	var list struct {
+		Items []DNSEndpoint `json:"items"`
+	}
+	if err := listJSON(c.client, c.api, namespace, c.resource, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// crdSource is an implementation of Source for the DNSEndpoints of external-dns, so
+// that the records produced by other systems are published by the registry and the
+// provider of the controller. They only hold DNS records, neither inbound rules nor
+// external IPs.
+type crdSource struct {
+	client           CRDClient
+	namespace        string
+	annotationFilter string
+}
+
+// NewCRDSource returns a source for the DNSEndpoints of the namespace, of all
+// namespaces if empty, whose annotations match the filter.
+func NewCRDSource(client CRDClient, namespace, annotationFilter string) (Source, error) {
+	// fail at startup rather than on each synchronization
+	if _, err := metav1.ParseToLabelSelector(annotationFilter); err != nil {
+		return nil, err
+	}
+	return &crdSource{
+		client:           client,
+		namespace:        namespace,
+		annotationFilter: annotationFilter,
+	}, nil
+}
+
+func (cs *crdSource) ExternalIPSetting() (*setting.ExternalIPSetting, error) {
+	dnsEndpoints, err := cs.client.DNSEndpoints(cs.namespace)
+	if err != nil {
+		return nil, err
+	}
+	labelSelector, err := metav1.ParseToLabelSelector(cs.annotationFilter)
+	if err != nil {
+		return nil, err
+	}
+	selector, err := metav1.LabelSelectorAsSelector(labelSelector)
+	if err != nil {
+		return nil, err
+	}
+
+	setting := newSetting()
+	for _, dnsEndpoint := range dnsEndpoints {
+		if dnsEndpoint.DeletionTimestamp != nil || !selector.Matches(labels.Set(dnsEndpoint.Annotations)) {
+			continue
+		}
+		resource := "crd/" + dnsEndpoint.Namespace + "/" + dnsEndpoint.Name
+		for _, e := range dnsEndpoint.Spec.Endpoints {
+			if e.DNSName == "" || len(e.Targets) == 0 {
+				log.Warnf("Skipping the record %q of %s without name or target", e.DNSName, resource)
+				continue
+			}
+			if e.RecordTTL < 0 {
+				log.Warnf("Skipping the record %s of %s with a negative TTL", e.DNSName, resource)
+				continue
+			}
+			recordType := e.RecordType
+			if recordType == "" {
+				recordType = suitableType(e.Targets[0])
+			}
+			ep := endpoint.NewEndpointWithTTL(e.DNSName, recordType, endpoint.TTL(e.RecordTTL), e.Targets...)
+			ep.Labels[endpoint.ResourceLabelKey] = resource
+			ep.ProviderSpecific = e.ProviderSpecific
+			setting.Endpoints = append(setting.Endpoints, ep)
+		}
+	}
+	return setting, nil
+}
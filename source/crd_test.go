@@ -0,0 +1,79 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+)
+
+// fakeCRDClient returns the given DNSEndpoints whatever the namespace.
+type fakeCRDClient struct {
+	dnsEndpoints []DNSEndpoint
+	err          error
+}
+
+func (c *fakeCRDClient) DNSEndpoints(namespace string) ([]DNSEndpoint, error) {
+	return c.dnsEndpoints, c.err
+}
+
+func TestCRDSource(t *testing.T) {
+	client := &fakeCRDClient{
+		dnsEndpoints: []DNSEndpoint{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "records", Annotations: map[string]string{"team": "web"}},
+				Spec: DNSEndpointSpec{
+					Endpoints: []CRDEndpoint{
+						{DNSName: "foo.example.org.", Targets: []string{"1.2.3.4", "1.2.3.5"}, RecordTTL: 180, ProviderSpecific: endpoint.ProviderSpecific{{Name: "aws-health-check-id", Value: "abc"}}},
+						{DNSName: "bar.example.org", Targets: []string{"foo.example.org"}},
+						{DNSName: "txt.example.org", Targets: []string{"\"heritage=external-ips\""}, RecordType: endpoint.RecordTypeTXT},
+						// invalid records are skipped
+						{DNSName: "empty.example.org"},
+						{Targets: []string{"1.2.3.4"}},
+						{DNSName: "negative.example.org", Targets: []string{"1.2.3.4"}, RecordTTL: -1},
+					},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other-team", Annotations: map[string]string{"team": "db"}},
+				Spec: DNSEndpointSpec{
+					Endpoints: []CRDEndpoint{{DNSName: "db.example.org", Targets: []string{"1.2.3.6"}}},
+				},
+			},
+		},
+	}
+
+	source, err := NewCRDSource(client, "", "team=web")
+	require.NoError(t, err)
+
+	extipsetting, err := source.ExternalIPSetting()
+	require.NoError(t, err)
+
+	validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{
+		{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4", "1.2.3.5"}, RecordType: endpoint.RecordTypeA, RecordTTL: 180},
+		{DNSName: "bar.example.org", Targets: endpoint.Targets{"foo.example.org"}, RecordType: endpoint.RecordTypeCNAME},
+		{DNSName: "txt.example.org", Targets: endpoint.Targets{"\"heritage=external-ips\""}, RecordType: endpoint.RecordTypeTXT},
+	})
+	assert.Equal(t, "crd/default/records", extipsetting.Endpoints[0].Labels[endpoint.ResourceLabelKey])
+	assert.Equal(t, endpoint.ProviderSpecific{{Name: "aws-health-check-id", Value: "abc"}}, extipsetting.Endpoints[0].ProviderSpecific)
+	assert.Empty(t, extipsetting.InternalEndpoints)
+	assert.Empty(t, extipsetting.InboundRules)
+	assert.Empty(t, extipsetting.ExtIPs)
+}
+
+func TestCRDSourceErrors(t *testing.T) {
+	_, err := NewCRDSource(&fakeCRDClient{}, "", "team in (web")
+	assert.Error(t, err)
+
+	source, err := NewCRDSource(&fakeCRDClient{err: errors.New("the server could not find the requested resource")}, "", "")
+	require.NoError(t, err)
+	_, err = source.ExternalIPSetting()
+	assert.Error(t, err)
+}
@@ -25,87 +25,187 @@ package source
 
 import (
 	"fmt"
-	"github.com/openfresh/external-ips/extip/extip"
 	"math/rand"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/openfresh/external-ips/setting"
 )
 
+// FakeConfig controls the size and the changes of the setting of the fake
+// source, so that the controller and the plans can be load tested without a
+// cluster.
+type FakeConfig struct {
+	// The number of endpoints, defaultFakeEndpoints if 0
+	Endpoints int
+	// The number of inbound rules and external IPs, of as many fake services
+	InboundRules int
+	ExtIPs       int
+	// The share of the targets, external IPs and instances of the inbound rules
+	// changed on each call but the first one, between 0 and 1
+	Churn float64
+	// The seed of the generated names and targets, so that runs can be repeated, random if 0
+	Seed int64
+}
+
 // fakeSource is an implementation of Source that provides dummy endpoints for
 // testing/dry-running of dns providers without needing an attached Kubernetes cluster.
+// The names are generated once, the targets change by the configured churn.
 type fakeSource struct {
 	dnsName string
+	churn   float64
+
+	mu     sync.Mutex
+	rand   *rand.Rand
+	called bool
+	// the generated state, copied into each setting
+	names       []string
+	targets     []string
+	providerIDs []string
+	extIPs      []string
 }
 
 const (
-	defaultFQDNTemplate = "example.com"
+	defaultFQDNTemplate  = "example.com"
+	defaultFakeEndpoints = 10
+	// the number of fake instances the inbound rules are set to
+	fakeInstances = 16
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
-}
-
 // NewFakeSource creates a new fakeSource with the given config.
-func NewFakeSource(fqdnTemplate string) (Source, error) {
+func NewFakeSource(fqdnTemplate string, cfg FakeConfig) (Source, error) {
 	if fqdnTemplate == "" {
 		fqdnTemplate = defaultFQDNTemplate
 	}
+	if cfg.Endpoints == 0 {
+		cfg.Endpoints = defaultFakeEndpoints
+	}
+	if cfg.Endpoints < 0 || cfg.InboundRules < 0 || cfg.ExtIPs < 0 {
+		return nil, fmt.Errorf("invalid fake source size: %d endpoints, %d inbound rules, %d external IPs", cfg.Endpoints, cfg.InboundRules, cfg.ExtIPs)
+	}
+	if cfg.Churn < 0 || cfg.Churn > 1 {
+		return nil, fmt.Errorf("invalid fake source churn, expected between 0 and 1: %v", cfg.Churn)
+	}
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
 
-	return &fakeSource{
-		dnsName: fqdnTemplate,
-	}, nil
+	sc := &fakeSource{
+		dnsName:     fqdnTemplate,
+		churn:       cfg.Churn,
+		rand:        rand.New(rand.NewSource(seed)),
+		names:       make([]string, cfg.Endpoints),
+		targets:     make([]string, cfg.Endpoints),
+		providerIDs: make([]string, cfg.InboundRules),
+		extIPs:      make([]string, cfg.ExtIPs),
+	}
+
+	// the names are unique, longer prefixes are needed past a few hundred thousand
+	prefixLength := 4
+	for n := len(letterRunes) * len(letterRunes) * len(letterRunes) * len(letterRunes); n < 2*cfg.Endpoints; n *= len(letterRunes) {
+		prefixLength++
+	}
+	seen := make(map[string]bool, cfg.Endpoints)
+	for i := range sc.names {
+		name := sc.generateDNSName(prefixLength)
+		for seen[name] {
+			name = sc.generateDNSName(prefixLength)
+		}
+		seen[name] = true
+		sc.names[i] = name
+		sc.targets[i] = sc.generateIPAddress()
+	}
+	for i := range sc.providerIDs {
+		sc.providerIDs[i] = sc.generateProviderID()
+	}
+	for i := range sc.extIPs {
+		sc.extIPs[i] = sc.generateIPAddress()
+	}
+
+	return sc, nil
 }
 
 // Endpoints returns endpoint objects.
 func (sc *fakeSource) ExternalIPSetting() (*setting.ExternalIPSetting, error) {
-	result := setting.ExternalIPSetting{}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
 
-	endpoints := make([]*endpoint.Endpoint, 10)
+	if sc.called {
+		sc.change(sc.targets, sc.generateIPAddress)
+		sc.change(sc.providerIDs, sc.generateProviderID)
+		sc.change(sc.extIPs, sc.generateIPAddress)
+	}
+	sc.called = true
 
-	for i := 0; i < 10; i++ {
-		endpoints[i], _ = sc.generateEndpoint()
+	result := setting.ExternalIPSetting{
+		Endpoints:    make([]*endpoint.Endpoint, len(sc.names)),
+		InboundRules: make([]*inbound.InboundRules, len(sc.providerIDs)),
+		ExtIPs:       make([]*extip.ExtIP, len(sc.extIPs)),
+	}
+	// the endpoints are modified downstream, e.g. labeled by the plan, and copied on each call
+	for i, name := range sc.names {
+		result.Endpoints[i] = endpoint.NewEndpoint(name, endpoint.RecordTypeA, sc.targets[i])
+	}
+	for i, providerID := range sc.providerIDs {
+		result.InboundRules[i] = &inbound.InboundRules{
+			Name:        fmt.Sprintf("fake-%d.default.fake", i),
+			Resource:    fmt.Sprintf("default/fake-%d", i),
+			Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 443, Description: fmt.Sprintf("default/fake-%d/443", i)}},
+			ProviderIDs: inbound.ProviderIDs{providerID},
+		}
+	}
+	for i, ip := range sc.extIPs {
+		result.ExtIPs[i] = &extip.ExtIP{
+			Namespace: "default",
+			SvcName:   fmt.Sprintf("fake-%d", i),
+			ExtIPs:    endpoint.Targets{ip},
+		}
 	}
-	result.Endpoints = endpoints
-	result.InboundRules = []*inbound.InboundRules{}
-	result.ExtIPs = []*extip.ExtIP{}
 
 	return &result, nil
 }
 
-func (sc *fakeSource) generateEndpoint() (*endpoint.Endpoint, error) {
-	ep := endpoint.NewEndpoint(
-		generateDNSName(4, sc.dnsName),
-		endpoint.RecordTypeA,
-		generateIPAddress(),
-	)
-
-	return ep, nil
+// change replaces the churn share of the values with other generated ones.
+func (sc *fakeSource) change(values []string, generate func() string) {
+	count := int(sc.churn*float64(len(values)) + 0.5)
+	for _, i := range sc.rand.Perm(len(values))[:count] {
+		value := generate()
+		for value == values[i] {
+			value = generate()
+		}
+		values[i] = value
+	}
 }
 
-func generateIPAddress() string {
+func (sc *fakeSource) generateIPAddress() string {
 	// 192.0.2.[1-255] is reserved by RFC 5737 for documentation and examples
 	return net.IPv4(
 		byte(192),
 		byte(0),
 		byte(2),
-		byte(rand.Intn(253)+1),
+		byte(sc.rand.Intn(253)+1),
 	).String()
 }
 
+func (sc *fakeSource) generateProviderID() string {
+	return fmt.Sprintf("fake:///fake-zone/i-%08d", sc.rand.Intn(fakeInstances))
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyz")
 
-func generateDNSName(prefixLength int, dnsName string) string {
+func (sc *fakeSource) generateDNSName(prefixLength int) string {
 	prefixBytes := make([]rune, prefixLength)
 
 	for i := range prefixBytes {
-		prefixBytes[i] = letterRunes[rand.Intn(len(letterRunes))]
+		prefixBytes[i] = letterRunes[sc.rand.Intn(len(letterRunes))]
 	}
 
 	prefixStr := string(prefixBytes)
 
-	return fmt.Sprintf("%s.%s", prefixStr, dnsName)
+	return fmt.Sprintf("%s.%s", prefixStr, sc.dnsName)
 }
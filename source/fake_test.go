@@ -24,11 +24,14 @@ import (
 	"regexp"
 	"testing"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
 	"github.com/openfresh/external-ips/setting"
 )
 
 func generateTestSetting() *setting.ExternalIPSetting {
-	sc, _ := NewFakeSource("")
+	sc, _ := NewFakeSource("", FakeConfig{})
 
 	setting, _ := sc.ExternalIPSetting()
 
@@ -71,5 +74,69 @@ func TestFakeSettingsResolveToIPAddresses(t *testing.T) {
 	}
 }
 
+func TestFakeSourceSize(t *testing.T) {
+	sc, err := NewFakeSource("", FakeConfig{Endpoints: 20000, InboundRules: 30, ExtIPs: 40})
+	require.NoError(t, err)
+
+	setting, err := sc.ExternalIPSetting()
+	require.NoError(t, err)
+	assert.Len(t, setting.Endpoints, 20000)
+	assert.Len(t, setting.InboundRules, 30)
+	assert.Len(t, setting.ExtIPs, 40)
+
+	names := map[string]bool{}
+	for _, e := range setting.Endpoints {
+		names[e.DNSName] = true
+	}
+	assert.Len(t, names, 20000, "the names must be unique")
+
+	_, err = NewFakeSource("", FakeConfig{Churn: 1.5})
+	assert.Error(t, err)
+	_, err = NewFakeSource("", FakeConfig{ExtIPs: -1})
+	assert.Error(t, err)
+}
+
+func TestFakeSourceChurn(t *testing.T) {
+	targets := func(s *setting.ExternalIPSetting) map[string]string {
+		result := map[string]string{}
+		for _, e := range s.Endpoints {
+			result[e.DNSName] = e.Targets[0]
+		}
+		return result
+	}
+
+	cfg := FakeConfig{Endpoints: 100, InboundRules: 10, ExtIPs: 10, Churn: 0.1, Seed: 42}
+	sc, err := NewFakeSource("", cfg)
+	require.NoError(t, err)
+	first, err := sc.ExternalIPSetting()
+	require.NoError(t, err)
+	second, err := sc.ExternalIPSetting()
+	require.NoError(t, err)
+
+	// the names stay, a tenth of the targets change
+	before, after := targets(first), targets(second)
+	require.Len(t, after, 100)
+	changed := 0
+	for name, target := range before {
+		require.Contains(t, after, name)
+		if after[name] != target {
+			changed++
+		}
+	}
+	assert.Equal(t, 10, changed)
+
+	// the same seed generates the same settings
+	other, err := NewFakeSource("", cfg)
+	require.NoError(t, err)
+	otherFirst, err := other.ExternalIPSetting()
+	require.NoError(t, err)
+	otherSecond, err := other.ExternalIPSetting()
+	require.NoError(t, err)
+	assert.Equal(t, before, targets(otherFirst))
+	assert.Equal(t, after, targets(otherSecond))
+	assert.Equal(t, second.InboundRules, otherSecond.InboundRules)
+	assert.Equal(t, second.ExtIPs, otherSecond.ExtIPs)
+}
+
 // Validate that FakeSource is a source
 var _ Source = &fakeSource{}
@@ -0,0 +1,427 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/setting"
+)
+
+const (
+	// the API of the Gateway API objects
+	gatewayAPI = "/apis/gateway.networking.k8s.io/v1"
+	// the group and kind of the Gateways, the default of the parent references of the routes
+	gatewayGroup = "gateway.networking.k8s.io"
+	gatewayKind  = "Gateway"
+	// the default type of the addresses of the Gateways
+	gatewayAddressIP = "IPAddress"
+	// the namespaces whose routes a listener accepts
+	gatewayRoutesFromAll      = "All"
+	gatewayRoutesFromSame     = "Same"
+	gatewayRoutesFromSelector = "Selector"
+)
+
+// Gateway is the part of a Gateway of the Gateway API the source reads.
+type Gateway struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              GatewaySpec   `json:"spec"`
+	Status            GatewayStatus `json:"status,omitempty"`
+}
+
+// GatewaySpec lists the listeners of a Gateway and the addresses it requests.
+type GatewaySpec struct {
+	Listeners []GatewayListener `json:"listeners,omitempty"`
+	Addresses []GatewayAddress  `json:"addresses,omitempty"`
+}
+
+// GatewayStatus lists the addresses assigned to a Gateway.
+type GatewayStatus struct {
+	Addresses []GatewayAddress `json:"addresses,omitempty"`
+}
+
+// GatewayAddress is an address of a Gateway, an IP address if its type is empty.
+type GatewayAddress struct {
+	Type  string `json:"type,omitempty"`
+	Value string `json:"value"`
+}
+
+// GatewayListener is a port of a Gateway, with the hostname it's limited to,
+// empty for any, and the routes it accepts.
+type GatewayListener struct {
+	Name          string                `json:"name"`
+	Hostname      string                `json:"hostname,omitempty"`
+	Port          int                   `json:"port"`
+	Protocol      string                `json:"protocol"`
+	AllowedRoutes *GatewayAllowedRoutes `json:"allowedRoutes,omitempty"`
+}
+
+// GatewayAllowedRoutes are the namespaces whose routes a listener accepts.
+type GatewayAllowedRoutes struct {
+	Namespaces *GatewayRouteNamespaces `json:"namespaces,omitempty"`
+}
+
+// GatewayRouteNamespaces are the namespaces whose routes a listener accepts, the
+// namespace of the Gateway if From is empty.
+type GatewayRouteNamespaces struct {
+	From     string                `json:"from,omitempty"`
+	Selector *metav1.LabelSelector `json:"selector,omitempty"`
+}
+
+// HTTPRoute is the part of an HTTPRoute of the Gateway API the source reads.
+type HTTPRoute struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              HTTPRouteSpec `json:"spec"`
+}
+
+// HTTPRouteSpec lists the Gateways a route attaches to and the hostnames it
+// routes, the hostnames of the listeners if empty.
+type HTTPRouteSpec struct {
+	ParentRefs []ParentReference `json:"parentRefs,omitempty"`
+	Hostnames  []string          `json:"hostnames,omitempty"`
+}
+
+// ParentReference names the Gateway, and optionally the listener, a route attaches to.
+type ParentReference struct {
+	Group       *string `json:"group,omitempty"`
+	Kind        *string `json:"kind,omitempty"`
+	Namespace   *string `json:"namespace,omitempty"`
+	Name        string  `json:"name"`
+	SectionName *string `json:"sectionName,omitempty"`
+	Port        *int    `json:"port,omitempty"`
+}
+
+// GatewayClient lists the Gateway API objects of a namespace, of all namespaces if empty.
+type GatewayClient interface {
+	Gateways(namespace string) ([]Gateway, error)
+	HTTPRoutes(namespace string) ([]HTTPRoute, error)
+}
+
+// gatewayRESTClient is a GatewayClient reading the Gateway API objects from the
+// API server as JSON.
+type gatewayRESTClient struct {
+	client rest.Interface
+}
+
+// NewGatewayClient returns a GatewayClient reading the Gateway API objects with
+// the given REST client, e.g. the one of the discovery client of the Kubernetes client.
+func NewGatewayClient(client rest.Interface) GatewayClient {
+	return &gatewayRESTClient{client: client}
+}
+
+func (c *gatewayRESTClient) Gateways(namespace string) ([]Gateway, error) {
+	var list struct {
+		Items []Gateway `json:"items"`
+	}
+	if err := listJSON(c.client, gatewayAPI, namespace, "gateways", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *gatewayRESTClient) HTTPRoutes(namespace string) ([]HTTPRoute, error) {
+	var list struct {
+		Items []HTTPRoute `json:"items"`
+	}
+	if err := listJSON(c.client, gatewayAPI, namespace, "httproutes", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// gatewaySource is an implementation of Source for the Gateways of the Gateway
+// API. It publishes the hostnames of the listeners of each Gateway, and of the
+// HTTPRoutes attached to them, on the nodes holding the addresses of the Gateway,
+// and opens the ports of its listeners on those nodes.
+type gatewaySource struct {
+	client      kubernetes.Interface
+	gateways    GatewayClient
+	nodeLister  node.Lister
+	clusterName string
+	namespace   string
+}
+
+// NewGatewaySource returns a source for the Gateways of the namespace, of all
+// namespaces if empty, and of the HTTPRoutes attached to them.
+func NewGatewaySource(kubeClient kubernetes.Interface, gateways GatewayClient, nodeLister node.Lister, clusterName, namespace string) (Source, error) {
+	return &gatewaySource{
+		client:      kubeClient,
+		gateways:    gateways,
+		nodeLister:  nodeLister,
+		clusterName: clusterName,
+		namespace:   namespace,
+	}, nil
+}
+
+func (gs *gatewaySource) ExternalIPSetting() (*setting.ExternalIPSetting, error) {
+	gateways, err := gs.gateways.Gateways(gs.namespace)
+	if err != nil {
+		return nil, err
+	}
+	routes, err := gs.gateways.HTTPRoutes(gs.namespace)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := gs.nodeLister.List()
+	if err != nil {
+		return nil, err
+	}
+
+	setting := newSetting()
+	namespaces := map[string]labels.Set{}
+	for i := range gateways {
+		gw := &gateways[i]
+		if gw.DeletionTimestamp != nil {
+			continue
+		}
+		if err := gs.addGateway(setting, gw, routes, nodes, namespaces); err != nil {
+			return nil, err
+		}
+	}
+	return setting, nil
+}
+
+// addGateway adds the endpoints and inbound rules of the Gateway to the setting,
+// nothing if it has no hostname or none of its addresses is of a node.
+func (gs *gatewaySource) addGateway(setting *setting.ExternalIPSetting, gw *Gateway, routes []HTTPRoute, nodes []*v1.Node, namespaces map[string]labels.Set) error {
+	ttl, err := getTTLFromAnnotations(gw.Annotations)
+	if err != nil {
+		return err
+	}
+
+	hostnames := map[string]bool{}
+	for _, listener := range gw.Spec.Listeners {
+		if hostname := gatewayHostname(listener.Hostname); hostname != "" {
+			hostnames[hostname] = true
+		}
+		for i := range routes {
+			route := &routes[i]
+			attached, err := gs.attached(route, gw, &listener, namespaces)
+			if err != nil {
+				return err
+			}
+			if !attached {
+				continue
+			}
+			for _, hostname := range routeHostnames(route, &listener) {
+				hostnames[hostname] = true
+			}
+		}
+	}
+	if len(hostnames) == 0 {
+		return nil
+	}
+
+	externalIPs, internalIPs, providerIDs := gatewayNodes(gw, nodes)
+	if len(providerIDs) == 0 {
+		log.Debugf("No node holds the addresses of gateway %s/%s, not exposing it", gw.Namespace, gw.Name)
+		return nil
+	}
+
+	sorted := make([]string, 0, len(hostnames))
+	for hostname := range hostnames {
+		sorted = append(sorted, hostname)
+	}
+	sort.Strings(sorted)
+	resource := "gateway/" + gw.Namespace + "/" + gw.Name
+	for _, hostname := range sorted {
+		ep := endpoint.NewEndpointWithTTL(hostname, endpoint.RecordTypeA, ttl, externalIPs...)
+		ep.Labels[endpoint.ResourceLabelKey] = resource
+		setting.Endpoints = append(setting.Endpoints, ep)
+		internal := endpoint.NewEndpointWithTTL(hostname, endpoint.RecordTypeA, ttl, internalIPs...)
+		internal.Labels[endpoint.ResourceLabelKey] = resource
+		setting.InternalEndpoints = append(setting.InternalEndpoints, internal)
+	}
+	setting.InboundRules = append(setting.InboundRules, gs.inboundRules(gw, providerIDs))
+	return nil
+}
+
+// attached returns true if the route attaches to the listener of the Gateway, which
+// must accept the routes of its namespace.
+func (gs *gatewaySource) attached(route *HTTPRoute, gw *Gateway, listener *GatewayListener, namespaces map[string]labels.Set) (bool, error) {
+	referenced := false
+	for _, ref := range route.Spec.ParentRefs {
+		if ref.Group != nil && *ref.Group != gatewayGroup || ref.Kind != nil && *ref.Kind != gatewayKind {
+			continue
+		}
+		namespace := route.Namespace
+		if ref.Namespace != nil {
+			namespace = *ref.Namespace
+		}
+		if namespace != gw.Namespace || ref.Name != gw.Name {
+			continue
+		}
+		if ref.SectionName != nil && *ref.SectionName != listener.Name || ref.Port != nil && *ref.Port != listener.Port {
+			continue
+		}
+		referenced = true
+		break
+	}
+	if !referenced {
+		return false, nil
+	}
+
+	from := gatewayRoutesFromSame
+	var selector *metav1.LabelSelector
+	if listener.AllowedRoutes != nil && listener.AllowedRoutes.Namespaces != nil {
+		if listener.AllowedRoutes.Namespaces.From != "" {
+			from = listener.AllowedRoutes.Namespaces.From
+		}
+		selector = listener.AllowedRoutes.Namespaces.Selector
+	}
+	switch from {
+	case gatewayRoutesFromAll:
+		return true, nil
+	case gatewayRoutesFromSame:
+		return route.Namespace == gw.Namespace, nil
+	case gatewayRoutesFromSelector:
+		if selector == nil {
+			return false, nil
+		}
+		s, err := metav1.LabelSelectorAsSelector(selector)
+		if err != nil {
+			return false, err
+		}
+		namespaceLabels, ok := namespaces[route.Namespace]
+		if !ok {
+			ns, err := gs.client.CoreV1().Namespaces().Get(route.Namespace, metav1.GetOptions{})
+			switch {
+			case errors.IsNotFound(err):
+				// the namespace of the route is being deleted
+				namespaceLabels = labels.Set{}
+			case err != nil:
+				return false, err
+			default:
+				namespaceLabels = labels.Set(ns.Labels)
+			}
+			namespaces[route.Namespace] = namespaceLabels
+		}
+		return s.Matches(namespaceLabels), nil
+	}
+	return false, nil
+}
+
+// inboundRules opens the ports of the listeners of the Gateway on the given nodes.
+func (gs *gatewaySource) inboundRules(gw *Gateway, providerIDs []string) *inbound.InboundRules {
+	inboundRules := inbound.NewInboundRules()
+	inboundRules.ProviderIDs = inbound.NewProviderIDs(providerIDs...)
+	opened := map[string]bool{}
+	for _, listener := range gw.Spec.Listeners {
+		protocol := "tcp"
+		if strings.EqualFold(listener.Protocol, "UDP") {
+			protocol = "udp"
+		}
+		// the listeners of several hostnames may share a port
+		key := protocol + "/" + strconv.Itoa(listener.Port)
+		if opened[key] {
+			continue
+		}
+		opened[key] = true
+		inboundRules.Rules = append(inboundRules.Rules, inbound.InboundRule{
+			Protocol:    protocol,
+			Port:        listener.Port,
+			Description: gw.Namespace + "/" + gw.Name + "/" + listener.Name,
+		})
+	}
+	// the name of the rules of a Gateway doesn't collide with the one of a service of the same name
+	inboundRules.Name = inboundRulesName("gateway-"+gw.Name, gw.Namespace, gs.clusterName)
+	inboundRules.Resource = gw.Namespace + "/gateway-" + gw.Name
+	return inboundRules
+}
+
+// gatewayNodes returns the external and internal IPs and the ProviderIDs of the
+// nodes holding an IP address of the Gateway, requested or assigned.
+func gatewayNodes(gw *Gateway, nodes []*v1.Node) (endpoint.Targets, endpoint.Targets, []string) {
+	addresses := map[string]bool{}
+	for _, address := range append(append([]GatewayAddress{}, gw.Spec.Addresses...), gw.Status.Addresses...) {
+		if address.Type == "" || address.Type == gatewayAddressIP {
+			addresses[address.Value] = true
+		}
+	}
+
+	var externalIPs, internalIPs endpoint.Targets
+	var providerIDs []string
+	for _, n := range nodes {
+		if node.IsDraining(n) {
+			continue
+		}
+		held := false
+		for _, address := range n.Status.Addresses {
+			if addresses[address.Address] {
+				held = true
+				break
+			}
+		}
+		if !held {
+			continue
+		}
+		for _, address := range n.Status.Addresses {
+			switch address.Type {
+			case v1.NodeExternalIP:
+				externalIPs = append(externalIPs, address.Address)
+			case v1.NodeInternalIP:
+				internalIPs = append(internalIPs, address.Address)
+			}
+		}
+		providerIDs = append(providerIDs, n.Spec.ProviderID)
+	}
+	sort.Sort(externalIPs)
+	sort.Sort(internalIPs)
+	return externalIPs, internalIPs, providerIDs
+}
+
+// gatewayHostname returns the hostname to publish for a hostname of a listener or
+// of a route, empty if none.
+func gatewayHostname(hostname string) string {
+	return strings.TrimSuffix(strings.TrimSpace(hostname), ".")
+}
+
+// routeHostnames returns the hostnames the route serves on the listener: its
+// hostnames matching the one of the listener, or the one of the listener if it
+// has none, the more specific of both when either is a wildcard.
+func routeHostnames(route *HTTPRoute, listener *GatewayListener) []string {
+	listenerHostname := gatewayHostname(listener.Hostname)
+	if len(route.Spec.Hostnames) == 0 {
+		if listenerHostname == "" {
+			return nil
+		}
+		return []string{listenerHostname}
+	}
+
+	var hostnames []string
+	for _, hostname := range route.Spec.Hostnames {
+		hostname = gatewayHostname(hostname)
+		switch {
+		case hostname == "":
+		case listenerHostname == "" || hostnameMatches(hostname, listenerHostname):
+			hostnames = append(hostnames, hostname)
+		case hostnameMatches(listenerHostname, hostname):
+			hostnames = append(hostnames, listenerHostname)
+		}
+	}
+	return hostnames
+}
+
+// hostnameMatches returns true if the hostname is the pattern, or a subdomain of
+// the pattern if it's a wildcard.
+func hostnameMatches(hostname, pattern string) bool {
+	if hostname == pattern {
+		return true
+	}
+	return strings.HasPrefix(pattern, "*.") && strings.HasSuffix(hostname, pattern[1:])
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// fakeGatewayClient returns the given Gateways and HTTPRoutes whatever the namespace.
+type fakeGatewayClient struct {
+	gateways []Gateway
+	routes   []HTTPRoute
+}
+
+func (c *fakeGatewayClient) Gateways(namespace string) ([]Gateway, error) {
+	return c.gateways, nil
+}
+
+func (c *fakeGatewayClient) HTTPRoutes(namespace string) ([]HTTPRoute, error) {
+	return c.routes, nil
+}
+
+func newGatewaySource(t *testing.T, gateways GatewayClient, namespaces ...*v1.Namespace) Source {
+	kubernetes := fake.NewSimpleClientset()
+	for _, ns := range namespaces {
+		_, err := kubernetes.CoreV1().Namespaces().Create(ns)
+		require.NoError(t, err)
+	}
+	for _, n := range []*v1.Node{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+			Spec:       v1.NodeSpec{ProviderID: "abc"},
+			Status: v1.NodeStatus{
+				Addresses: []v1.NodeAddress{
+					{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+					{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "node2"},
+			Spec:       v1.NodeSpec{ProviderID: "def"},
+			Status: v1.NodeStatus{
+				Addresses: []v1.NodeAddress{
+					{Type: v1.NodeExternalIP, Address: "10.9.8.6"},
+					{Type: v1.NodeInternalIP, Address: "1.2.3.5"},
+				},
+			},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Nodes().Create(n)
+		require.NoError(t, err)
+	}
+
+	source, err := NewGatewaySource(kubernetes, gateways, node.NewClientLister(kubernetes), "cl.kube.io", "")
+	require.NoError(t, err)
+	return source
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// TestGatewaySource tests that the hostnames of the listeners and of the attached routes
+// are published on the nodes holding the addresses of the gateway.
+func TestGatewaySource(t *testing.T) {
+	source := newGatewaySource(t, &fakeGatewayClient{
+		gateways: []Gateway{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: GatewaySpec{
+					Listeners: []GatewayListener{
+						{Name: "http", Port: 80, Protocol: "HTTP"},
+						{
+							Name: "https", Hostname: "*.example.org", Port: 443, Protocol: "HTTPS",
+							AllowedRoutes: &GatewayAllowedRoutes{Namespaces: &GatewayRouteNamespaces{From: "All"}},
+						},
+						{Name: "https-foo", Hostname: "foo.example.net.", Port: 443, Protocol: "HTTPS"},
+					},
+				},
+				Status: GatewayStatus{
+					Addresses: []GatewayAddress{{Type: "IPAddress", Value: "10.9.8.7"}, {Type: "Hostname", Value: "10.9.8.6"}},
+				},
+			},
+			{
+				// no node holds the address of the gateway
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "unplaced"},
+				Spec: GatewaySpec{
+					Listeners: []GatewayListener{{Name: "http", Hostname: "unplaced.example.org", Port: 80, Protocol: "HTTP"}},
+					Addresses: []GatewayAddress{{Value: "192.0.2.1"}},
+				},
+			},
+		},
+		routes: []HTTPRoute{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "bar"},
+				Spec: HTTPRouteSpec{
+					ParentRefs: []ParentReference{{Name: "web"}},
+					Hostnames:  []string{"bar.example.org", "other.example.com"},
+				},
+			},
+			{
+				// only the https listener accepts the routes of other namespaces
+				ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "baz"},
+				Spec: HTTPRouteSpec{
+					ParentRefs: []ParentReference{{Namespace: stringPtr("default"), Name: "web"}},
+					Hostnames:  []string{"baz.example.org", "baz.example.com"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other-gateway"},
+				Spec: HTTPRouteSpec{
+					ParentRefs: []ParentReference{{Name: "other"}},
+					Hostnames:  []string{"other-gateway.example.org"},
+				},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other-kind"},
+				Spec: HTTPRouteSpec{
+					ParentRefs: []ParentReference{{Kind: stringPtr("Service"), Name: "web"}},
+					Hostnames:  []string{"other-kind.example.org"},
+				},
+			},
+		},
+	})
+
+	extipsetting, err := source.ExternalIPSetting()
+	require.NoError(t, err)
+
+	expected := &setting.ExternalIPSetting{
+		InboundRules: []*inbound.InboundRules{
+			{
+				Name: "gateway-web.cl.kube.io",
+				Rules: []inbound.InboundRule{
+					{Protocol: "tcp", Port: 80, Description: "default/web/http"},
+					{Protocol: "tcp", Port: 443, Description: "default/web/https"},
+				},
+				ProviderIDs: inbound.ProviderIDs{"abc"},
+			},
+		},
+	}
+	for _, hostname := range []string{"*.example.org", "bar.example.org", "baz.example.org", "foo.example.net", "other.example.com"} {
+		expected.Endpoints = append(expected.Endpoints, &endpoint.Endpoint{DNSName: hostname, Targets: endpoint.Targets{"10.9.8.7"}})
+		expected.InternalEndpoints = append(expected.InternalEndpoints, &endpoint.Endpoint{DNSName: hostname, Targets: endpoint.Targets{"1.2.3.4"}})
+	}
+	validateSetting(t, extipsetting, expected)
+	assert.Equal(t, "gateway/default/web", extipsetting.Endpoints[0].Labels[endpoint.ResourceLabelKey])
+}
+
+// TestGatewaySourceNamespaceSelector tests that the routes attach to the listeners selecting their namespace.
+func TestGatewaySourceNamespaceSelector(t *testing.T) {
+	source := newGatewaySource(t, &fakeGatewayClient{
+		gateways: []Gateway{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+				Spec: GatewaySpec{
+					Listeners: []GatewayListener{
+						{
+							Name: "http", Port: 80, Protocol: "HTTP",
+							AllowedRoutes: &GatewayAllowedRoutes{Namespaces: &GatewayRouteNamespaces{
+								From:     "Selector",
+								Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"expose": "true"}},
+							}},
+						},
+					},
+					Addresses: []GatewayAddress{{Value: "1.2.3.5"}},
+				},
+			},
+		},
+		routes: []HTTPRoute{
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "apps", Name: "foo"},
+				Spec:       HTTPRouteSpec{ParentRefs: []ParentReference{{Namespace: stringPtr("default"), Name: "web"}}, Hostnames: []string{"foo.example.org"}},
+			},
+			{
+				ObjectMeta: metav1.ObjectMeta{Namespace: "private", Name: "bar"},
+				Spec:       HTTPRouteSpec{ParentRefs: []ParentReference{{Namespace: stringPtr("default"), Name: "web"}}, Hostnames: []string{"bar.example.org"}},
+			},
+		},
+	},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "apps", Labels: map[string]string{"expose": "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "private"}},
+	)
+
+	extipsetting, err := source.ExternalIPSetting()
+	require.NoError(t, err)
+
+	validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{
+		{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.6"}},
+	})
+	validateInboundRules(t, extipsetting.InboundRules, []*inbound.InboundRules{
+		{
+			Name:        "gateway-web.cl.kube.io",
+			Rules:       []inbound.InboundRule{{Protocol: "tcp", Port: 80, Description: "default/web/http"}},
+			ProviderIDs: inbound.ProviderIDs{"def"},
+		},
+	})
+}
+
+func TestRouteHostnames(t *testing.T) {
+	for _, tc := range []struct {
+		title     string
+		listener  string
+		route     []string
+		hostnames []string
+	}{
+		{"route without hostname serves the listener hostname", "foo.example.org", nil, []string{"foo.example.org"}},
+		{"route and listener without hostname serve nothing", "", nil, nil},
+		{"listener without hostname accepts any route hostname", "", []string{"foo.example.org"}, []string{"foo.example.org"}},
+		{"wildcard listener accepts its subdomains", "*.example.org", []string{"foo.example.org", "foo.example.com"}, []string{"foo.example.org"}},
+		{"wildcard route serves the listener hostname", "foo.example.org", []string{"*.example.org"}, []string{"foo.example.org"}},
+		{"other route hostname is ignored", "foo.example.org", []string{"bar.example.org"}, nil},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			route := &HTTPRoute{Spec: HTTPRouteSpec{Hostnames: tc.route}}
+			assert.Equal(t, tc.hostnames, routeHostnames(route, &GatewayListener{Hostname: tc.listener}))
+		})
+	}
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/rest"
+
+	"github.com/openfresh/external-ips/setting"
+)
+
+// the API of the Istio networking objects
+const istioNetworkingAPI = "/apis/networking.istio.io/v1alpha3"
+
+// the gateway of the VirtualServices routing the traffic of the sidecars rather than of a gateway
+const istioMeshGateway = "mesh"
+
+// IstioGateway is the part of an Istio Gateway the source reads.
+type IstioGateway struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              IstioGatewaySpec `json:"spec"`
+}
+
+// IstioGatewaySpec selects the pods of the ingress gateway and lists the hosts
+// they serve on each port.
+type IstioGatewaySpec struct {
+	Selector map[string]string `json:"selector,omitempty"`
+	Servers  []IstioServer     `json:"servers,omitempty"`
+}
+
+// IstioServer is a port of a gateway and the hosts served on it.
+type IstioServer struct {
+	Port  IstioPort `json:"port"`
+	Hosts []string  `json:"hosts,omitempty"`
+}
+
+// IstioPort is the port a server of a gateway listens on.
+type IstioPort struct {
+	Number   int    `json:"number"`
+	Protocol string `json:"protocol,omitempty"`
+	Name     string `json:"name,omitempty"`
+}
+
+// IstioVirtualService is the part of an Istio VirtualService the source reads.
+type IstioVirtualService struct {
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              IstioVirtualServiceSpec `json:"spec"`
+}
+
+// IstioVirtualServiceSpec lists the hosts routed by a VirtualService and the
+// gateways they're routed from.
+type IstioVirtualServiceSpec struct {
+	Hosts    []string `json:"hosts,omitempty"`
+	Gateways []string `json:"gateways,omitempty"`
+}
+
+// IstioClient lists the Istio networking objects of a namespace, of all namespaces if empty.
+type IstioClient interface {
+	Gateways(namespace string) ([]IstioGateway, error)
+	VirtualServices(namespace string) ([]IstioVirtualService, error)
+}
+
+// istioRESTClient is an IstioClient reading the Istio objects from the API server
+// as JSON, without depending on the clients of Istio.
+type istioRESTClient struct {
+	client rest.Interface
+}
+
+// NewIstioClient returns an IstioClient reading the Istio objects with the given
+// REST client, e.g. the one of the discovery client of the Kubernetes client.
+func NewIstioClient(client rest.Interface) IstioClient {
+	return &istioRESTClient{client: client}
+}
+
+func (c *istioRESTClient) Gateways(namespace string) ([]IstioGateway, error) {
+	var list struct {
+		Items []IstioGateway `json:"items"`
+	}
+	if err := listJSON(c.client, istioNetworkingAPI, namespace, "gateways", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (c *istioRESTClient) VirtualServices(namespace string) ([]IstioVirtualService, error) {
+	var list struct {
+		Items []IstioVirtualService `json:"items"`
+	}
+	if err := listJSON(c.client, istioNetworkingAPI, namespace, "virtualservices", &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// listJSON decodes the list of the resource of the API in the namespace, of all
+// namespaces if empty, into list.
+func listJSON(client rest.Interface, api, namespace, resource string, list interface{}) error {
+	req := client.Get().AbsPath(api)
+	if namespace != "" {
+		req = req.Namespace(namespace)
+	}
+	body, err := req.Resource(resource).DoRaw()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, list)
+}
+
+// istioGatewaySource is a serviceSource which also publishes the hosts of the Istio
+// Gateways on the ingress gateway services they select, along with the hosts of
+// the VirtualServices bound to them, and limits the inbound rules of those services
+// to the ports of the servers of the Gateways. It includes the services of the
+// service source, which shouldn't be used along with it.
+type istioGatewaySource struct {
+	*serviceSource
+	istio IstioClient
+	// the Gateways and VirtualServices of the synchronization in progress
+	gateways        []IstioGateway
+	virtualServices []IstioVirtualService
+	// the routes of the services of the synchronization in progress, by service key
+	routes map[string]*routes
+}
+
+// NewIstioGatewaySource returns a source publishing the hosts of the Istio gateways
+// on the services of the given service source, as created by NewServiceSource.
+func NewIstioGatewaySource(services Source, istio IstioClient) (Source, error) {
+	sc, ok := services.(*serviceSource)
+	if !ok {
+		return nil, errors.New("the istio-gateway source requires a service source")
+	}
+	gs := &istioGatewaySource{serviceSource: sc, istio: istio}
+	sc.router = gs.route
+	return gs, nil
+}
+
+func (gs *istioGatewaySource) ExternalIPSetting() (*setting.ExternalIPSetting, error) {
+	if err := gs.refresh(); err != nil {
+		return nil, err
+	}
+	return gs.serviceSource.ExternalIPSetting()
+}
+
+// ServiceSetting returns the setting of a single service, along with the hosts of
+// the current Gateways and VirtualServices.
+func (gs *istioGatewaySource) ServiceSetting(namespace, name string) (*setting.ExternalIPSetting, error) {
+	if err := gs.refresh(); err != nil {
+		return nil, err
+	}
+	return gs.serviceSource.ServiceSetting(namespace, name)
+}
+
+// refresh lists the Gateways and VirtualServices the services are routed from.
+func (gs *istioGatewaySource) refresh() error {
+	gateways, err := gs.istio.Gateways(gs.namespace)
+	if err != nil {
+		return err
+	}
+	virtualServices, err := gs.istio.VirtualServices(gs.namespace)
+	if err != nil {
+		return err
+	}
+	gs.gateways = gateways
+	gs.virtualServices = virtualServices
+	gs.routes = map[string]*routes{}
+	return nil
+}
+
+// route returns the hosts and ports of the Gateways selecting the pods of the
+// service, nil if none does. A Gateway selects the pods of a service when its
+// selector matches the selector of the service.
+func (gs *istioGatewaySource) route(svc *v1.Service) *routes {
+	key := serviceKey(svc)
+	if r, ok := gs.routes[key]; ok {
+		return r
+	}
+
+	var r *routes
+	if len(svc.Spec.Selector) > 0 {
+		hostnames := map[string]bool{}
+		ports := map[int]bool{}
+		for i := range gs.gateways {
+			gw := &gs.gateways[i]
+			if len(gw.Spec.Selector) == 0 || !labels.SelectorFromSet(gw.Spec.Selector).Matches(labels.Set(svc.Spec.Selector)) {
+				continue
+			}
+			for _, server := range gw.Spec.Servers {
+				ports[server.Port.Number] = true
+				for _, host := range server.Hosts {
+					if hostname := istioHostname(host); hostname != "" {
+						hostnames[hostname] = true
+					}
+				}
+			}
+			for _, vs := range gs.virtualServices {
+				if !boundTo(&vs, gw) {
+					continue
+				}
+				for _, host := range vs.Spec.Hosts {
+					if hostname := istioHostname(host); hostname != "" && servedBy(hostname, gw) {
+						hostnames[hostname] = true
+					}
+				}
+			}
+		}
+		if len(ports) > 0 {
+			r = &routes{ports: ports}
+			for hostname := range hostnames {
+				r.hostnames = append(r.hostnames, hostname)
+			}
+			sort.Strings(r.hostnames)
+		}
+	}
+
+	if gs.routes != nil {
+		gs.routes[key] = r
+	}
+	return r
+}
+
+// istioHostname returns the hostname to publish for a host of a Gateway or of a
+// VirtualService, without its namespace, or empty if it can't be published: the
+// hosts matching any name and the short names of the services of the mesh.
+func istioHostname(host string) string {
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[i+1:]
+	}
+	host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+	if host == "*" || !strings.Contains(host, ".") {
+		return ""
+	}
+	return host
+}
+
+// boundTo returns true if the VirtualService routes the traffic of the Gateway,
+// named either by its name in the namespace of the VirtualService or by its
+// namespace and name.
+func boundTo(vs *IstioVirtualService, gw *IstioGateway) bool {
+	for _, name := range vs.Spec.Gateways {
+		if name == istioMeshGateway {
+			continue
+		}
+		namespace := vs.Namespace
+		if i := strings.Index(name, "/"); i >= 0 {
+			namespace, name = name[:i], name[i+1:]
+		}
+		if namespace == gw.Namespace && name == gw.Name {
+			return true
+		}
+	}
+	return false
+}
+
+// servedBy returns true if a server of the Gateway serves the hostname, as Istio
+// ignores the hosts of the VirtualServices not served by their gateways.
+func servedBy(hostname string, gw *IstioGateway) bool {
+	for _, server := range gw.Spec.Servers {
+		for _, host := range server.Hosts {
+			if i := strings.Index(host, "/"); i >= 0 {
+				host = host[i+1:]
+			}
+			host = strings.TrimSuffix(strings.TrimSpace(host), ".")
+			switch {
+			case host == "*" || host == hostname:
+				return true
+			case strings.HasPrefix(host, "*.") && strings.HasSuffix(hostname, host[1:]):
+				return true
+			}
+		}
+	}
+	return false
+}
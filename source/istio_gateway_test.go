@@ -0,0 +1,223 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+
+	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/extip/extip"
+	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
+	"github.com/openfresh/external-ips/setting"
+)
+
+// fakeIstioClient returns the given Gateways and VirtualServices whatever the namespace.
+type fakeIstioClient struct {
+	gateways        []IstioGateway
+	virtualServices []IstioVirtualService
+	err             error
+}
+
+func (c *fakeIstioClient) Gateways(namespace string) ([]IstioGateway, error) {
+	return c.gateways, c.err
+}
+
+func (c *fakeIstioClient) VirtualServices(namespace string) ([]IstioVirtualService, error) {
+	return c.virtualServices, c.err
+}
+
+func newIstioGatewaySource(t *testing.T, istio IstioClient, services ...*v1.Service) Source {
+	kubernetes := fake.NewSimpleClientset()
+	for _, svc := range services {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+	_, err := kubernetes.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "abc"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+				{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	services, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "", nil)
+	require.NoError(t, err)
+	source, err := NewIstioGatewaySource(services, istio)
+	require.NoError(t, err)
+	return source
+}
+
+func newIngressGatewayService(annotations map[string]string) *v1.Service {
+	return &v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "istio-system",
+			Name:        "istio-ingressgateway",
+			Annotations: annotations,
+		},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "istio-ingressgateway", "istio": "ingressgateway"},
+			Ports: []v1.ServicePort{
+				{Name: "http2", Protocol: "TCP", Port: 80},
+				{Name: "https", Protocol: "TCP", Port: 443},
+				{Name: "status-port", Protocol: "TCP", Port: 15020},
+			},
+		},
+	}
+}
+
+var testIstio = &fakeIstioClient{
+	gateways: []IstioGateway{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "gateway"},
+			Spec: IstioGatewaySpec{
+				Selector: map[string]string{"istio": "ingressgateway"},
+				Servers: []IstioServer{
+					{Port: IstioPort{Number: 80, Protocol: "HTTP", Name: "http"}, Hosts: []string{"foo.example.org."}},
+					{Port: IstioPort{Number: 443, Protocol: "HTTPS", Name: "https"}, Hosts: []string{"bookinfo/bar.example.org", "*.example.net"}},
+				},
+			},
+		},
+		{
+			// selects the pods of another gateway
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "egress"},
+			Spec: IstioGatewaySpec{
+				Selector: map[string]string{"istio": "egressgateway"},
+				Servers:  []IstioServer{{Port: IstioPort{Number: 8080}, Hosts: []string{"egress.example.org"}}},
+			},
+		},
+	},
+	virtualServices: []IstioVirtualService{
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "bookinfo", Name: "reviews"},
+			Spec: IstioVirtualServiceSpec{
+				// the short name is of the mesh, and the gateway doesn't serve example.com
+				Hosts:    []string{"baz.example.net", "reviews", "qux.example.com"},
+				Gateways: []string{"default/gateway", "mesh"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "ratings"},
+			Spec: IstioVirtualServiceSpec{
+				Hosts:    []string{"ratings.example.net"},
+				Gateways: []string{"gateway"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "bookinfo", Name: "details"},
+			Spec: IstioVirtualServiceSpec{
+				// the gateway of another namespace
+				Hosts:    []string{"details.example.net"},
+				Gateways: []string{"gateway", "mesh"},
+			},
+		},
+	},
+}
+
+// TestIstioGatewaySource tests that the hosts of the gateways are published on their ingress gateway services.
+func TestIstioGatewaySource(t *testing.T) {
+	for _, tc := range []struct {
+		title       string
+		annotations map[string]string
+		hostnames   []string
+		rules       []inbound.InboundRule
+	}{
+		{
+			"hosts of the gateway and its virtual services are published on the ports of its servers",
+			nil,
+			[]string{"*.example.net", "bar.example.org", "baz.example.net", "foo.example.org", "ratings.example.net"},
+			[]inbound.InboundRule{
+				{Protocol: "tcp", Port: 80, Description: "istio-system/istio-ingressgateway/http2"},
+				{Protocol: "tcp", Port: 443, Description: "istio-system/istio-ingressgateway/https"},
+			},
+		},
+		{
+			"hostnames and ports annotations are kept",
+			map[string]string{hostnameAnnotationKey: "status.example.org,foo.example.org", portsAnnotationKey: "status-port"},
+			[]string{"status.example.org", "foo.example.org", "*.example.net", "bar.example.org", "baz.example.net", "ratings.example.net"},
+			[]inbound.InboundRule{
+				{Protocol: "tcp", Port: 15020, Description: "istio-system/istio-ingressgateway/status-port"},
+			},
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			source := newIstioGatewaySource(t, testIstio,
+				newIngressGatewayService(tc.annotations),
+				// a service without hostname, not selected by the gateways
+				&v1.Service{
+					ObjectMeta: metav1.ObjectMeta{Namespace: "istio-system", Name: "istio-egressgateway"},
+					Spec: v1.ServiceSpec{
+						Selector: map[string]string{"app": "istio-egressgateway", "istio": "egressgateway-canary"},
+						Ports:    []v1.ServicePort{{Protocol: "TCP", Port: 80}},
+					},
+				},
+			)
+
+			extipsetting, err := source.ExternalIPSetting()
+			require.NoError(t, err)
+
+			expected := &setting.ExternalIPSetting{
+				Endpoints:         []*endpoint.Endpoint{},
+				InternalEndpoints: []*endpoint.Endpoint{},
+				InboundRules: []*inbound.InboundRules{
+					{Name: "istio-ingressgateway.istio-system.cl.kube.io", Rules: tc.rules, ProviderIDs: inbound.ProviderIDs{"abc"}},
+				},
+				ExtIPs: []*extip.ExtIP{
+					{Namespace: "istio-system", SvcName: "istio-ingressgateway", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+				},
+			}
+			for _, hostname := range tc.hostnames {
+				expected.Endpoints = append(expected.Endpoints, &endpoint.Endpoint{DNSName: hostname, Targets: endpoint.Targets{"10.9.8.7"}})
+				expected.InternalEndpoints = append(expected.InternalEndpoints, &endpoint.Endpoint{DNSName: hostname, Targets: endpoint.Targets{"1.2.3.4"}})
+			}
+			validateSetting(t, extipsetting, expected)
+		})
+	}
+}
+
+// TestIstioGatewaySourceServiceSetting tests that a single service is synchronized with the current gateways.
+func TestIstioGatewaySourceServiceSetting(t *testing.T) {
+	source := newIstioGatewaySource(t, testIstio, newIngressGatewayService(nil))
+
+	extipsetting, err := source.(TargetedSource).ServiceSetting("istio-system", "istio-ingressgateway")
+	require.NoError(t, err)
+	assert.Len(t, extipsetting.Endpoints, 5)
+	require.Len(t, extipsetting.InboundRules, 1)
+	assert.Len(t, extipsetting.InboundRules[0].Rules, 2)
+}
+
+// TestIstioGatewaySourceErrors tests that failing to list the Istio objects fails the synchronization.
+func TestIstioGatewaySourceErrors(t *testing.T) {
+	source := newIstioGatewaySource(t, &fakeIstioClient{err: errors.New("the server could not find the requested resource")}, newIngressGatewayService(nil))
+
+	_, err := source.ExternalIPSetting()
+	assert.Error(t, err)
+}
+
+func TestIstioHostname(t *testing.T) {
+	for host, expected := range map[string]string{
+		"foo.example.org":          "foo.example.org",
+		"foo.example.org.":         "foo.example.org",
+		"bookinfo/foo.example.org": "foo.example.org",
+		"*/foo.example.org":        "foo.example.org",
+		"./foo.example.org":        "foo.example.org",
+		"*.example.org":            "*.example.org",
+		"*":                        "",
+		"reviews":                  "",
+	} {
+		assert.Equal(t, expected, istioHostname(host), host)
+	}
+}
@@ -20,40 +20,159 @@ limitations under the License.
 package source
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
 	"github.com/openfresh/external-ips/dns/endpoint"
 	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/openfresh/external-ips/setting"
 )
 
+var (
+	sourceDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "duration_seconds",
+			Help:      "Duration of the extraction of the setting by source.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+		},
+		[]string{"source"},
+	)
+	sourceErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "errors_total",
+			Help:      "Number of failed extractions of the setting by source.",
+		},
+		[]string{"source"},
+	)
+	staleSources = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "stale",
+			Help:      "Whether the last synchronization kept the previous setting of the source because it failed, with --source-errors=best-effort.",
+		},
+		[]string{"source"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sourceDuration)
+	prometheus.MustRegister(sourceErrors)
+	prometheus.MustRegister(staleSources)
+}
+
 // multiSource is a Source that merges the endpoints of its nested Sources.
+// When bestEffort is set, a failing nested Source doesn't fail the others: its
+// setting of the last successful synchronization is used instead, so that its
+// records, inbound rules and external IPs aren't deleted meanwhile.
 type multiSource struct {
-	children []Source
+	names      []string
+	children   []Source
+	bestEffort bool
+	// the setting of the last successful synchronization of each child
+	last []*setting.ExternalIPSetting
 }
 
 // Endpoints collects endpoints of all nested Sources and returns them in a single slice.
 func (ms *multiSource) ExternalIPSetting() (*setting.ExternalIPSetting, error) {
-	result := setting.ExternalIPSetting{
-		Endpoints:    []*endpoint.Endpoint{},
-		InboundRules: []*inbound.InboundRules{},
-		ExtIPs:       []*extip.ExtIP{},
+	result := &setting.ExternalIPSetting{
+		Endpoints:         []*endpoint.Endpoint{},
+		InternalEndpoints: []*endpoint.Endpoint{},
+		InboundRules:      []*inbound.InboundRules{},
+		ExtIPs:            []*extip.ExtIP{},
 	}
 
-	for _, s := range ms.children {
-		setting, err := s.ExternalIPSetting()
+	var errs []string
+	for i, s := range ms.children {
+		start := time.Now()
+		extipsetting, err := s.ExternalIPSetting()
+		sourceDuration.WithLabelValues(ms.names[i]).Observe(time.Since(start).Seconds())
 		if err != nil {
-			return nil, err
+			sourceErrors.WithLabelValues(ms.names[i]).Inc()
+			err = fmt.Errorf("source %s: %v", ms.names[i], err)
+			if !ms.bestEffort || ms.last[i] == nil {
+				errs = append(errs, err.Error())
+				if !ms.bestEffort {
+					return nil, err
+				}
+				continue
+			}
+			log.Warnf("Keeping the previous setting: %v", err)
+			staleSources.WithLabelValues(ms.names[i]).Set(1)
+			// the expiries of the previous setting may have passed already
+			merge(result, &setting.ExternalIPSetting{
+				Endpoints:         ms.last[i].Endpoints,
+				InternalEndpoints: ms.last[i].InternalEndpoints,
+				InboundRules:      ms.last[i].InboundRules,
+				ExtIPs:            ms.last[i].ExtIPs,
+			})
+			continue
 		}
+		staleSources.WithLabelValues(ms.names[i]).Set(0)
+		ms.last[i] = extipsetting
+		merge(result, extipsetting)
+	}
+
+	// a failing source without previous setting would get its records deleted
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return result, nil
+}
 
-		result.Endpoints = append(result.Endpoints, setting.Endpoints...)
-		result.InboundRules = append(result.InboundRules, setting.InboundRules...)
-		result.ExtIPs = append(result.ExtIPs, setting.ExtIPs...)
+// ServiceSetting collects the setting of the service from the nested Sources supporting it.
+// Any error fails it, as no previous setting is known for a single service; the next full
+// synchronization applies the best-effort policy.
+func (ms *multiSource) ServiceSetting(namespace, name string) (*setting.ExternalIPSetting, error) {
+	result := &setting.ExternalIPSetting{
+		Endpoints:         []*endpoint.Endpoint{},
+		InternalEndpoints: []*endpoint.Endpoint{},
+		InboundRules:      []*inbound.InboundRules{},
+		ExtIPs:            []*extip.ExtIP{},
 	}
 
-	return &result, nil
+	for i, s := range ms.children {
+		ts, ok := s.(TargetedSource)
+		if !ok {
+			continue
+		}
+		setting, err := ts.ServiceSetting(namespace, name)
+		if err != nil {
+			sourceErrors.WithLabelValues(ms.names[i]).Inc()
+			return nil, fmt.Errorf("source %s: %v", ms.names[i], err)
+		}
+		merge(result, setting)
+	}
+
+	return result, nil
+}
+
+// merge appends the setting of a nested Source to the result.
+func merge(result, s *setting.ExternalIPSetting) {
+	result.Endpoints = append(result.Endpoints, s.Endpoints...)
+	result.InternalEndpoints = append(result.InternalEndpoints, s.InternalEndpoints...)
+	result.InboundRules = append(result.InboundRules, s.InboundRules...)
+	result.ExtIPs = append(result.ExtIPs, s.ExtIPs...)
+	result.AddExpiry(s.NextExpiry)
 }
 
-// NewMultiSource creates a new multiSource.
-func NewMultiSource(children []Source) Source {
-	return &multiSource{children: children}
+// NewMultiSource creates a new multiSource of the given Sources, named after the
+// given names in its errors and metrics. With bestEffort, the failing Sources keep
+// their previous setting rather than failing the synchronization.
+func NewMultiSource(names []string, children []Source, bestEffort bool) Source {
+	return &multiSource{
+		names:      names,
+		children:   children,
+		bestEffort: bestEffort,
+		last:       make([]*setting.ExternalIPSetting, len(children)),
+	}
 }
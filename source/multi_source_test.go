@@ -34,6 +34,8 @@ func TestMultiSource(t *testing.T) {
 	t.Run("Interface", testMultiSourceImplementsSource)
 	t.Run("Endpoints", testMultiSourceEndpoints)
 	t.Run("EndpointsWithError", testMultiSourceEndpointsWithError)
+	t.Run("FailFast", testMultiSourceFailFast)
+	t.Run("BestEffort", testMultiSourceBestEffort)
 }
 
 // testMultiSourceImplementsSource tests that multiSource is a valid Source.
@@ -87,7 +89,8 @@ func testMultiSourceEndpoints(t *testing.T) {
 			}
 
 			// Create our object under test and get the endpoints.
-			source := NewMultiSource(sources)
+			names := make([]string, len(sources))
+			source := NewMultiSource(names, sources, false)
 
 			// Get endpoints from the source.
 			extipsetting, err := source.ExternalIPSetting()
@@ -114,12 +117,58 @@ func testMultiSourceEndpointsWithError(t *testing.T) {
 	src.On("ExternalIPSetting").Return(nil, errSomeError)
 
 	// Create our object under test and get the endpoints.
-	source := NewMultiSource([]Source{src})
+	source := NewMultiSource([]string{"service"}, []Source{src}, false)
 
 	// Get endpoints from our source.
 	_, err := source.ExternalIPSetting()
-	assert.EqualError(t, err, "some error")
+	assert.EqualError(t, err, "source service: some error")
 
 	// Validate that the nested source was called.
 	src.AssertExpectations(t)
 }
+
+// testMultiSourceFailFast tests that the sources following a failing source aren't queried.
+func testMultiSourceFailFast(t *testing.T) {
+	failing := new(testutils.MockSource)
+	failing.On("ExternalIPSetting").Return(nil, errors.New("some error"))
+	other := new(testutils.MockSource)
+
+	source := NewMultiSource([]string{"crd", "service"}, []Source{failing, other}, false)
+
+	_, err := source.ExternalIPSetting()
+	assert.EqualError(t, err, "source crd: some error")
+	other.AssertNotCalled(t, "ExternalIPSetting")
+}
+
+// testMultiSourceBestEffort tests that a failing source keeps its previous setting
+// while the others are synchronized, and fails the synchronization without one.
+func testMultiSourceBestEffort(t *testing.T) {
+	foo := &endpoint.Endpoint{DNSName: "foo", Targets: endpoint.Targets{"8.8.8.8"}}
+	bar := &endpoint.Endpoint{DNSName: "bar", Targets: endpoint.Targets{"8.8.4.4"}}
+	baz := &endpoint.Endpoint{DNSName: "baz", Targets: endpoint.Targets{"8.8.4.4"}}
+
+	flaky := new(testutils.MockSource)
+	flaky.On("ExternalIPSetting").Return(nil, errors.New("some error")).Once()
+	flaky.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{Endpoints: []*endpoint.Endpoint{foo}}, nil).Once()
+	flaky.On("ExternalIPSetting").Return(nil, errors.New("other error")).Once()
+	other := new(testutils.MockSource)
+	other.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{Endpoints: []*endpoint.Endpoint{bar}}, nil).Twice()
+	other.On("ExternalIPSetting").Return(&setting.ExternalIPSetting{Endpoints: []*endpoint.Endpoint{baz}}, nil).Once()
+
+	source := NewMultiSource([]string{"crd", "service"}, []Source{flaky, other}, true)
+
+	// without previous setting, the records of the source would be deleted
+	_, err := source.ExternalIPSetting()
+	assert.EqualError(t, err, "source crd: some error")
+
+	extipsetting, err := source.ExternalIPSetting()
+	require.NoError(t, err)
+	validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{foo, bar})
+
+	extipsetting, err = source.ExternalIPSetting()
+	require.NoError(t, err)
+	validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{foo, baz})
+
+	flaky.AssertExpectations(t)
+	other.AssertExpectations(t)
+}
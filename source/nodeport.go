@@ -0,0 +1,50 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"errors"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// DefaultNodePortRange is the node port range of the kube-apiserver without --service-node-port-range
+	DefaultNodePortRange = "30000-32767"
+	nodePortRangeFlag    = "--service-node-port-range"
+)
+
+// the labels of the kube-apiserver static pods of kubeadm and kops
+var kubeAPIServerSelectors = []string{"component=kube-apiserver", "k8s-app=kube-apiserver"}
+
+// DetectNodePortRange returns the node port range of the cluster, read from the
+// --service-node-port-range flag of the kube-apiserver pods of kube-system, the
+// default range if they don't set it. The control planes whose kube-apiserver
+// doesn't run as a pod, e.g. the managed ones, can't be detected.
+func DetectNodePortRange(client kubernetes.Interface) (string, error) {
+	for _, selector := range kubeAPIServerSelectors {
+		pods, err := client.CoreV1().Pods(metav1.NamespaceSystem).List(metav1.ListOptions{LabelSelector: selector})
+		if err != nil {
+			return "", err
+		}
+		if len(pods.Items) == 0 {
+			continue
+		}
+		for _, c := range pods.Items[0].Spec.Containers {
+			args := append(append([]string{}, c.Command...), c.Args...)
+			for i, arg := range args {
+				if strings.HasPrefix(arg, nodePortRangeFlag+"=") {
+					return strings.TrimPrefix(arg, nodePortRangeFlag+"="), nil
+				}
+				if arg == nodePortRangeFlag && i+1 < len(args) {
+					return args[i+1], nil
+				}
+			}
+		}
+		return DefaultNodePortRange, nil
+	}
+	return "", errors.New("no kube-apiserver pod found in kube-system to detect the node port range from")
+}
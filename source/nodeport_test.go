@@ -0,0 +1,63 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/pkg/api/v1"
+)
+
+func newKubeAPIServerPod(labels map[string]string, command ...string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: metav1.NamespaceSystem, Name: "kube-apiserver-master", Labels: labels},
+		Spec:       v1.PodSpec{Containers: []v1.Container{{Name: "kube-apiserver", Command: command}}},
+	}
+}
+
+func TestDetectNodePortRange(t *testing.T) {
+	for _, tc := range []struct {
+		title    string
+		pod      *v1.Pod
+		expected string
+		err      bool
+	}{
+		{
+			title:    "kubeadm",
+			pod:      newKubeAPIServerPod(map[string]string{"component": "kube-apiserver"}, "kube-apiserver", "--secure-port=6443", "--service-node-port-range=20000-22767"),
+			expected: "20000-22767",
+		},
+		{
+			title:    "kops, flag and value apart",
+			pod:      newKubeAPIServerPod(map[string]string{"k8s-app": "kube-apiserver"}, "/usr/local/bin/kube-apiserver", "--service-node-port-range", "30000+1000"),
+			expected: "30000+1000",
+		},
+		{
+			title:    "default range",
+			pod:      newKubeAPIServerPod(map[string]string{"component": "kube-apiserver"}, "kube-apiserver", "--secure-port=6443"),
+			expected: DefaultNodePortRange,
+		},
+		{
+			title: "no kube-apiserver pod",
+			pod:   newKubeAPIServerPod(map[string]string{"component": "etcd"}, "etcd"),
+			err:   true,
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			client := fake.NewSimpleClientset(tc.pod)
+			nodePortRange, err := DetectNodePortRange(client)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, nodePortRange)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package source
+
+import (
+	"errors"
+
+	log "github.com/sirupsen/logrus"
+
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// PriorityWatcher watches the services annotated with a high priority, so that
+// they are synchronized as soon as they change rather than at the next interval.
+type PriorityWatcher struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewPriorityWatcher creates a PriorityWatcher for the services of the given
+// namespace, all namespaces if empty. Run must be called to start watching.
+func NewPriorityWatcher(client kubernetes.Interface, namespace string) *PriorityWatcher {
+	lw := cache.NewListWatchFromClient(client.CoreV1().RESTClient(), "services", namespace, fields.Everything())
+
+	return &PriorityWatcher{
+		informer: cache.NewSharedIndexInformer(lw, &v1.Service{}, 0, cache.Indexers{}),
+	}
+}
+
+// OnChange registers f to be called with the namespace/name key of a high priority
+// service when it is created, updated or deleted, or when it loses its priority.
+// The services listed at startup are left to the first full synchronization.
+// It must be called before Run.
+func (w *PriorityWatcher) OnChange(f func(key string)) {
+	w.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			svc, ok := obj.(*v1.Service)
+			if !ok || !w.informer.HasSynced() || !isPriority(svc) {
+				return
+			}
+			f(serviceKey(svc))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldSvc, ok := oldObj.(*v1.Service)
+			if !ok {
+				return
+			}
+			newSvc, ok := newObj.(*v1.Service)
+			if !ok || oldSvc.ResourceVersion == newSvc.ResourceVersion {
+				return
+			}
+			if isPriority(oldSvc) || isPriority(newSvc) {
+				f(serviceKey(newSvc))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			svc, ok := obj.(*v1.Service)
+			if !ok || !isPriority(svc) {
+				return
+			}
+			f(serviceKey(svc))
+		},
+	})
+}
+
+// Run starts watching the services and waits for the initial list.
+func (w *PriorityWatcher) Run(stopChan <-chan struct{}) error {
+	go w.informer.Run(stopChan)
+
+	if !cache.WaitForCacheSync(stopChan, w.informer.HasSynced) {
+		return errors.New("timed out waiting for the service watch to sync")
+	}
+	log.Debug("Priority service watch synced")
+
+	return nil
+}
+
+func isPriority(svc *v1.Service) bool {
+	return svc.Annotations[priorityAnnotationKey] == priorityAnnotationHigh
+}
+
+func serviceKey(svc *v1.Service) string {
+	return svc.Namespace + "/" + svc.Name
+}
@@ -20,28 +20,89 @@ limitations under the License.
 package source
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"sort"
+	"strconv"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/provider"
 	"github.com/openfresh/external-ips/extip/extip"
 	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
 	"github.com/openfresh/external-ips/setting"
 )
 
 const (
 	defaultTargetsCapacity = 10
+
+	// spotPolicyDeprioritize selects the spot nodes only when there are not enough other nodes
+	spotPolicyDeprioritize = "deprioritize"
+	// spotPolicyExclude never selects the spot nodes
+	spotPolicyExclude = "exclude"
+
+	// reasonUnpublishableHostname is the reason of the events warning about hostnames outside of the domain filter
+	reasonUnpublishableHostname = "UnpublishableHostname"
 )
 
+var (
+	belowMinIPsServices = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "services_below_min_ips",
+			Help:      "Number of services keeping their previous targets because too few nodes are selected.",
+		},
+	)
+	unpublishableHostnames = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "unpublishable_hostnames",
+			Help:      "Number of hostnames requested by the services which don't match the domain filter.",
+		},
+	)
+	filteredNodes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "external_ips",
+			Subsystem: "source",
+			Name:      "filtered_nodes",
+			Help:      "Number of nodes excluded from or deprioritized in the selection of the services by their conditions.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(belowMinIPsServices)
+	prometheus.MustRegister(unpublishableHostnames)
+	prometheus.MustRegister(filteredNodes)
+}
+
+// selectedNodes are the nodes selected for a service.
+type selectedNodes struct {
+	externalIPs endpoint.Targets
+	internalIPs endpoint.Targets
+	providerIDs []string
+	// the number of selected nodes, not counting the draining ones
+	count int
+}
+
 // serviceSource is an implementation of Source for Kubernetes service objects.
 // It will find all services that are under our jurisdiction, i.e. annotated
 // desired hostname and matching or no controller annotation. For each of the
@@ -49,6 +110,8 @@ const (
 // Endpoint object.
 type serviceSource struct {
 	client           kubernetes.Interface
+	nodeLister       node.Lister
+	recorder         record.EventRecorder
 	clusterName      string
 	namespace        string
 	annotationFilter string
@@ -57,14 +120,54 @@ type serviceSource struct {
 	fqdnTemplate          *template.Template
 	combineFQDNAnnotation bool
 	publishInternal       bool
-	dryRun                bool
+	internalFQDNTemplate  *template.Template
+	// how long draining nodes are kept in the inbound rules
+	drainPeriod   time.Duration
+	drainingSince map[string]time.Time
+	// how the nodes matching spotSelector are selected
+	spotPolicy   string
+	spotSelector labels.Selector
+	// the last nodes selected for each service with enough IPs
+	lastSelected map[string]*selectedNodes
+	// the domains the hostnames can be published in
+	domainFilter provider.DomainFilter
+	// moves the hostnames beneath a subdomain named after the cluster
+	subdomainPerCluster bool
+	// points the hostnames to the internal IPs of the nodes in the private zones
+	splitHorizon bool
+	// the slot of the blue/green pairs published in the namespaces without active slot annotation
+	activeSlot string
+	// the labels of the services copied to their endpoints and inbound rules
+	serviceLabels []string
+	// names the security groups of the services, nil for the default naming scheme
+	firewallNameTemplate *template.Template
+	// the node port range of the cluster opened as a single rule per protocol for
+	// the NodePort services, instead of their ports, none if 0
+	nodePortFirst, nodePortLast int
+	// the static IPs of the accelerator of the cluster, published for the services exposed through it
+	acceleratorIPs endpoint.Targets
+	// returns the hostnames and ports routed to a service by other resources than its annotations, nil if none
+	router func(svc *v1.Service) *routes
+}
+
+// routes are the hostnames and ports routed to a service by other resources, e.g.
+// the hosts and servers of the Istio gateways it implements.
+type routes struct {
+	hostnames []string
+	// the numbers of the ports of the service the hostnames are served on
+	ports map[int]bool
 }
 
 // NewServiceSource creates a new serviceSource with the given config.
-func NewServiceSource(kubeClient kubernetes.Interface, clusterName, namespace, annotationFilter string, fqdnTemplate string, combineFqdnAnnotation bool, compatibility string, publishInternal bool, dryRun bool) (Source, error) {
+// Hostnames outside of domainFilter are reported as events through recorder, unless it is nil.
+func NewServiceSource(kubeClient kubernetes.Interface, nodeLister node.Lister, recorder record.EventRecorder, clusterName, namespace, annotationFilter string, fqdnTemplate string, combineFqdnAnnotation bool, compatibility string, publishInternal bool, internalFQDNTemplate string, drainPeriod time.Duration, spotPolicy string, spotNodeSelector string, domainFilter provider.DomainFilter, subdomainPerCluster bool, splitHorizon bool, activeSlot string, serviceLabels []string, firewallNameTemplate string, nodePortRange string, acceleratorIPs []string) (Source, error) {
 	var (
-		tmpl *template.Template
-		err  error
+		tmpl         *template.Template
+		internalTmpl *template.Template
+		firewallTmpl *template.Template
+		spotSelector labels.Selector
+		nodePorts    [2]int
+		err          error
 	)
 	if fqdnTemplate != "" {
 		tmpl, err = template.New("endpoint").Funcs(template.FuncMap{
@@ -74,9 +177,44 @@ func NewServiceSource(kubeClient kubernetes.Interface, clusterName, namespace, a
 			return nil, err
 		}
 	}
+	if publishInternal {
+		internalTmpl, err = template.New("internal").Funcs(template.FuncMap{
+			"trimPrefix": strings.TrimPrefix,
+		}).Parse(internalFQDNTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if firewallNameTemplate != "" {
+		firewallTmpl, err = template.New("firewall").Parse(firewallNameTemplate)
+		if err != nil {
+			return nil, err
+		}
+		// the fields the template refers to are only checked when executed
+		if _, err := firewallName(firewallTmpl, "service", "namespace", clusterName); err != nil {
+			return nil, fmt.Errorf("invalid firewall name template: %v", err)
+		}
+	}
+
+	if spotPolicy != "" {
+		spotSelector, err = labels.Parse(spotNodeSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if nodePortRange != "" {
+		nodePorts[0], nodePorts[1], err = inbound.ParsePortRange(nodePortRange)
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	return &serviceSource{
 		client:                kubeClient,
+		nodeLister:            nodeLister,
+		recorder:              recorder,
 		clusterName:           clusterName,
 		namespace:             namespace,
 		annotationFilter:      annotationFilter,
@@ -84,7 +222,21 @@ func NewServiceSource(kubeClient kubernetes.Interface, clusterName, namespace, a
 		fqdnTemplate:          tmpl,
 		combineFQDNAnnotation: combineFqdnAnnotation,
 		publishInternal:       publishInternal,
-		dryRun:                dryRun,
+		internalFQDNTemplate:  internalTmpl,
+		drainPeriod:           drainPeriod,
+		drainingSince:         map[string]time.Time{},
+		spotPolicy:            spotPolicy,
+		spotSelector:          spotSelector,
+		lastSelected:          map[string]*selectedNodes{},
+		domainFilter:          domainFilter,
+		subdomainPerCluster:   subdomainPerCluster,
+		splitHorizon:          splitHorizon,
+		activeSlot:            activeSlot,
+		serviceLabels:         serviceLabels,
+		firewallNameTemplate:  firewallTmpl,
+		nodePortFirst:         nodePorts[0],
+		nodePortLast:          nodePorts[1],
+		acceleratorIPs:        endpoint.NewTargets(acceleratorIPs...),
 	}, nil
 }
 
@@ -99,55 +251,249 @@ func (sc *serviceSource) ExternalIPSetting() (*setting.ExternalIPSetting, error)
 		return nil, err
 	}
 
-	// get all the nodes and cache them for this run
-	nodes, err := sc.extractNodes()
+	nodes, err := sc.nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	setting := newSetting()
+	lastSelected := make(map[string]*selectedNodes, len(services.Items))
+	belowMinIPs := 0
+	unpublishable := 0
+
+	for _, svc := range services.Items {
+		added := len(setting.Endpoints)
+		selected, held, err := sc.addService(setting, &svc, nodes)
+		if err != nil {
+			return nil, err
+		}
+		if selected == nil {
+			continue
+		}
+		if held {
+			belowMinIPs++
+		}
+		lastSelected[serviceKey(&svc)] = selected
+		unpublishable += sc.checkDomains(&svc, setting.Endpoints[added:])
+	}
+
+	sc.lastSelected = lastSelected
+	belowMinIPsServices.Set(float64(belowMinIPs))
+	unpublishableHostnames.Set(float64(unpublishable))
+
+	return setting, nil
+}
+
+// ServiceSetting returns the setting of a single service, empty if the service
+// doesn't exist or isn't under our jurisdiction anymore.
+func (sc *serviceSource) ServiceSetting(namespace, name string) (*setting.ExternalIPSetting, error) {
+	setting := newSetting()
+	key := namespace + "/" + name
+
+	if sc.namespace != "" && namespace != sc.namespace {
+		return setting, nil
+	}
+
+	svc, err := sc.client.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		delete(sc.lastSelected, key)
+		return setting, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	services, err := sc.filterByAnnotations([]v1.Service{*svc})
+	if err != nil {
+		return nil, err
+	}
+
+	nodes, err := sc.nodes()
+	if err != nil {
+		return nil, err
+	}
+
+	delete(sc.lastSelected, key)
+	for i := range services {
+		selected, _, err := sc.addService(setting, &services[i], nodes)
+		if err != nil {
+			return nil, err
+		}
+		if selected != nil {
+			sc.lastSelected[key] = selected
+			sc.checkDomains(&services[i], setting.Endpoints)
+		}
+	}
+
+	return setting, nil
+}
+
+// newSetting returns an empty setting for the services to be added to.
+func newSetting() *setting.ExternalIPSetting {
+	return &setting.ExternalIPSetting{
+		Endpoints:         []*endpoint.Endpoint{},
+		InternalEndpoints: []*endpoint.Endpoint{},
+		InboundRules:      []*inbound.InboundRules{},
+	}
+}
+
+// nodes returns the nodes in the order they are selected for the services.
+func (sc *serviceSource) nodes() ([]*v1.Node, error) {
+	// get all the nodes from the snapshot shared with the firewall provider
+	nodes, err := sc.nodeLister.List()
 	if err != nil {
 		return nil, err
 	}
 
+	sc.trackDraining(nodes, time.Now())
+
 	// The result of next run will be same by sorting by creation time unless node is removed
 	sort.Slice(nodes, func(i, j int) bool {
 		return nodes[i].CreationTimestamp.Before(nodes[j].CreationTimestamp)
 	})
+	return applyNodeConditions(sc.applySpotPolicy(nodes)), nil
+}
 
-	setting := setting.ExternalIPSetting{
-		Endpoints:    []*endpoint.Endpoint{},
-		InboundRules: []*inbound.InboundRules{},
+// addService adds the endpoints, inbound rules and external IPs of the service to
+// the setting. It returns the nodes selected for the service, nil if it has no
+// hostname or is being deleted, and whether its previous selection was kept to
+// honour its minimum IPs.
+func (sc *serviceSource) addService(setting *setting.ExternalIPSetting, svc *v1.Service, nodes []*v1.Node) (*selectedNodes, bool, error) {
+	// a service held by its finalizer is cleaned up before being released
+	if svc.DeletionTimestamp != nil {
+		return nil, false, nil
 	}
 
-	for _, svc := range services.Items {
-		hostnameList := getHostnamesFromAnnotations(svc.Annotations)
-		if len(hostnameList) == 0 {
-			continue
+	hostnameList := sc.requestedHostnames(svc)
+	if len(hostnameList) == 0 {
+		return nil, false, nil
+	}
+
+	// a service exposed for a limited time is left out past its deadline, which removes its records and inbound rules
+	deadline, err := getExpiryFromAnnotations(svc.Annotations, svc.CreationTimestamp.Time)
+	if err != nil {
+		return nil, false, err
+	}
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		log.Debugf("Service %s/%s expired at %s, not exposing it", svc.Namespace, svc.Name, deadline)
+		return nil, false, nil
+	}
+	setting.AddExpiry(deadline)
+
+	selected, err := sc.extractNodeInfo(svc, nodes)
+	if err != nil {
+		return nil, false, err
+	}
+
+	selected, held, err := sc.enforceMinIPs(svc, selected, nodes)
+	if err != nil {
+		return nil, false, err
+	}
+	externalIPs, internalIPs := selected.externalIPs, selected.internalIPs
+
+	// the records of a service exposed through the accelerator point to its static IPs, which forward to the nodes
+	acceleratorAffinity, err := getAcceleratorAffinityFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, false, err
+	}
+	if acceleratorAffinity != "" && len(sc.acceleratorIPs) == 0 {
+		log.Warnf("Service %s/%s is annotated with %s but no accelerator is configured, publishing the IPs of its nodes", svc.Namespace, svc.Name, globalAcceleratorAnnotationKey)
+		acceleratorAffinity = ""
+	}
+	publishedIPs := externalIPs
+	if acceleratorAffinity != "" {
+		publishedIPs = sc.acceleratorIPs
+	}
+
+	svcEndpoints := sc.endpoints(svc, publishedIPs)
+	svcInternalEndpoints := sc.endpoints(svc, internalIPs)
+	if sc.splitHorizon {
+		for _, ep := range svcEndpoints {
+			ep.PrivateTargets = internalIPs.Normalize()
 		}
+	}
+	inboundRules, err := sc.inboundRules(svc, selected.providerIDs, sc.clusterName)
+	if err != nil {
+		return nil, false, err
+	}
+	inboundRules.AcceleratorAffinity = acceleratorAffinity
+	extIPs := sc.externalIPs(svc, internalIPs)
 
-		externalIPs, internalIPs, providerIDs, err := sc.extractNodeInfo(&svc, nodes)
+	log.Debugf("External IPs setting generated from service: %s/%s: %v", svc.Namespace, svc.Name, setting)
+	if sc.publishInternal {
+		internalNameEndpoints, err := sc.internalNameEndpoints(svc, internalIPs)
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+		svcEndpoints = append(svcEndpoints, internalNameEndpoints...)
+	}
+
+	// a service in maintenance keeps its external IPs and security group, its records are withdrawn or retargeted
+	maintenance, err := getMaintenanceFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, false, err
+	}
+	if maintenance {
+		log.Debugf("Service %s/%s is in maintenance", svc.Namespace, svc.Name)
+		svcEndpoints = sc.maintenanceEndpoints(svc, svcEndpoints)
+		svcInternalEndpoints = sc.maintenanceEndpoints(svc, svcInternalEndpoints)
+		if err := sc.maintenanceInboundRules(svc, inboundRules); err != nil {
+			return nil, false, err
 		}
+	}
 
-		svcEndpoints := sc.endpoints(&svc, externalIPs)
-		inboundRules := sc.inboundRules(&svc, providerIDs, sc.clusterName)
-		extIPs := sc.externalIPs(&svc, internalIPs)
+	// the aliases follow the record of the first hostname, in maintenance as well
+	svcEndpoints = append(svcEndpoints, sc.aliasEndpoints(svc, svcEndpoints)...)
 
-		log.Debugf("External IPs setting generated from service: %s/%s: %v", svc.Namespace, svc.Name, setting)
-		sc.setResourceLabel(svc, setting.Endpoints)
-		setting.Endpoints = append(setting.Endpoints, svcEndpoints...)
-		setting.InboundRules = append(setting.InboundRules, inboundRules)
-		setting.ExtIPs = append(setting.ExtIPs, extIPs)
+	sc.setResourceLabel(*svc, svcEndpoints)
+	sc.setResourceLabel(*svc, svcInternalEndpoints)
+	// the services of a blue/green pair share their hostnames, the plan picks the one in the active slot
+	if err := sc.setSlotLabels(svc, svcEndpoints, svcInternalEndpoints); err != nil {
+		return nil, false, err
+	}
+	sc.setServiceLabels(svc, inboundRules, svcEndpoints, svcInternalEndpoints)
+	sc.setExtensions(svc, inboundRules, svcEndpoints, svcInternalEndpoints)
+	// the visibility is set on every record, so that removing the annotation publishes it in all the zones again
+	zoneVisibility, err := getZoneVisibilityFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, ep := range svcEndpoints {
+		ep.WithProviderSpecific(provider.ZoneVisibilityProperty, zoneVisibility)
+	}
+	for _, ep := range svcInternalEndpoints {
+		ep.WithProviderSpecific(provider.ZoneVisibilityProperty, zoneVisibility)
+	}
+	// the changes of a service in dry-run are computed and reported by the controller, not applied
+	dryRun, err := getDryRunFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, false, err
 	}
+	if dryRun {
+		for _, ep := range svcEndpoints {
+			ep.DryRun = true
+		}
+		for _, ep := range svcInternalEndpoints {
+			ep.DryRun = true
+		}
+		inboundRules.DryRun = true
+		extIPs.DryRun = true
+	}
+	setting.Endpoints = append(setting.Endpoints, svcEndpoints...)
+	setting.InternalEndpoints = append(setting.InternalEndpoints, svcInternalEndpoints...)
+	setting.InboundRules = append(setting.InboundRules, inboundRules)
+	setting.ExtIPs = append(setting.ExtIPs, extIPs)
 
-	return &setting, nil
+	return selected, held, nil
 }
 
-func (sc *serviceSource) extractNodeInfo(svc *v1.Service, nodes []v1.Node) (endpoint.Targets, endpoint.Targets, []string, error) {
+func (sc *serviceSource) extractNodeInfo(svc *v1.Service, nodes []*v1.Node) (*selectedNodes, error) {
 	selector, err := getSelectorFromAnnotations(svc.Annotations)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 	maxips, err := getMaxIPsFromAnnotations(svc.Annotations)
 	if err != nil {
-		return nil, nil, nil, err
+		return nil, err
 	}
 
 	var externalIPs endpoint.Targets
@@ -159,6 +505,14 @@ func (sc *serviceSource) extractNodeInfo(svc *v1.Service, nodes []v1.Node) (endp
 		labels := labels.Set(node.Labels)
 
 		if selector == nil || selector.Matches(labels) {
+			if since, ok := sc.drainingSince[node.Name]; ok {
+				// keep the draining node in the inbound rules for the drain period,
+				// so that the clients still connected to it are not cut off abruptly
+				if time.Since(since) < sc.drainPeriod {
+					providerIDs = append(providerIDs, node.Spec.ProviderID)
+				}
+				continue
+			}
 			for _, address := range node.Status.Addresses {
 				switch address.Type {
 				case v1.NodeExternalIP:
@@ -176,7 +530,117 @@ func (sc *serviceSource) extractNodeInfo(svc *v1.Service, nodes []v1.Node) (endp
 	}
 	sort.Sort(externalIPs)
 	sort.Sort(internalIPs)
-	return externalIPs, internalIPs, providerIDs, nil
+	return &selectedNodes{
+		externalIPs: externalIPs,
+		internalIPs: internalIPs,
+		providerIDs: providerIDs,
+		count:       selectedNode,
+	}, nil
+}
+
+// enforceMinIPs returns the nodes previously selected for the service instead of the
+// given ones while fewer nodes than its min IPs are selected, so that its records
+// don't shrink to a few nodes taking all the traffic. The previous nodes are kept
+// until enough nodes are selected again.
+func (sc *serviceSource) enforceMinIPs(svc *v1.Service, selected *selectedNodes, nodes []*v1.Node) (*selectedNodes, bool, error) {
+	minips, err := getMinIPsFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, false, err
+	}
+
+	previous, ok := sc.lastSelected[serviceKey(svc)]
+	if minips <= 0 || selected.count >= minips || !ok {
+		return selected, false, nil
+	}
+
+	log.Warnf("Only %d nodes selected for service %s/%s, fewer than its min IPs %d. Keeping the previous targets.", selected.count, svc.Namespace, svc.Name, minips)
+
+	// keep the previous nodes in the inbound rules as long as they exist
+	existing := make(map[string]bool, len(nodes))
+	for _, n := range nodes {
+		existing[n.Spec.ProviderID] = true
+	}
+	kept := &selectedNodes{
+		externalIPs: previous.externalIPs,
+		internalIPs: previous.internalIPs,
+		count:       previous.count,
+	}
+	for _, providerID := range previous.providerIDs {
+		if existing[providerID] {
+			kept.providerIDs = append(kept.providerIDs, providerID)
+		}
+	}
+
+	return kept, true, nil
+}
+
+// applySpotPolicy removes the spot nodes, or moves them after the other nodes so
+// that they are only selected when there are not enough other nodes.
+func (sc *serviceSource) applySpotPolicy(nodes []*v1.Node) []*v1.Node {
+	if sc.spotSelector == nil {
+		return nodes
+	}
+
+	var others, spots []*v1.Node
+	for _, n := range nodes {
+		if sc.spotSelector.Matches(labels.Set(n.Labels)) {
+			spots = append(spots, n)
+		} else {
+			others = append(others, n)
+		}
+	}
+
+	switch sc.spotPolicy {
+	case spotPolicyExclude:
+		return others
+	case spotPolicyDeprioritize:
+		return append(others, spots...)
+	}
+	return nodes
+}
+
+// applyNodeConditions removes the nodes whose network is unavailable, and moves the
+// nodes under pressure after the other nodes so that they are only selected when
+// there are not enough other nodes.
+func applyNodeConditions(nodes []*v1.Node) []*v1.Node {
+	var healthy, pressured []*v1.Node
+	filtered := map[string]int{}
+	for _, n := range nodes {
+		if node.IsNetworkUnavailable(n) {
+			log.Debugf("Node %s has its network unavailable, not selecting it", n.Name)
+			filtered[string(v1.NodeNetworkUnavailable)]++
+			continue
+		}
+		if pressure := node.Pressure(n); pressure != "" {
+			log.Debugf("Node %s has %s, selecting it after the other nodes", n.Name, pressure)
+			filtered[string(pressure)]++
+			pressured = append(pressured, n)
+			continue
+		}
+		healthy = append(healthy, n)
+	}
+
+	for _, reason := range []v1.NodeConditionType{v1.NodeNetworkUnavailable, v1.NodeDiskPressure, v1.NodeMemoryPressure} {
+		filteredNodes.WithLabelValues(string(reason)).Set(float64(filtered[string(reason)]))
+	}
+	return append(healthy, pressured...)
+}
+
+// trackDraining records since when each of the nodes has been draining.
+func (sc *serviceSource) trackDraining(nodes []*v1.Node, now time.Time) {
+	draining := make(map[string]time.Time)
+	for _, n := range nodes {
+		if !node.IsDraining(n) {
+			continue
+		}
+		since, ok := sc.drainingSince[n.Name]
+		if !ok {
+			log.Infof("Node %s is draining, removing it from the DNS records and external IPs", n.Name)
+			since = now
+		}
+		draining[n.Name] = since
+	}
+	sc.drainingSince = draining
 }
 
 func (sc *serviceSource) externalIPs(svc *v1.Service, externalIPs endpoint.Targets) *extip.ExtIP {
@@ -191,7 +655,7 @@ func (sc *serviceSource) externalIPs(svc *v1.Service, externalIPs endpoint.Targe
 func (sc *serviceSource) endpoints(svc *v1.Service, nodeTargets endpoint.Targets) []*endpoint.Endpoint {
 	var endpoints []*endpoint.Endpoint
 
-	hostnameList := getHostnamesFromAnnotations(svc.Annotations)
+	hostnameList := sc.hostnames(svc)
 	for _, hostname := range hostnameList {
 		endpoints = append(endpoints, sc.generateEndpoint(svc, hostname, nodeTargets))
 	}
@@ -199,28 +663,299 @@ func (sc *serviceSource) endpoints(svc *v1.Service, nodeTargets endpoint.Targets
 	return endpoints
 }
 
-func (sc *serviceSource) inboundRules(svc *v1.Service, providerIDs []string, clusterName string) *inbound.InboundRules {
+// hostnames returns the hostnames requested by the service, beneath the subdomain
+// of the cluster if subdomainPerCluster is set.
+func (sc *serviceSource) hostnames(svc *v1.Service) []string {
+	hostnameList := sc.requestedHostnames(svc)
+	if !sc.subdomainPerCluster {
+		return hostnameList
+	}
+
+	result := make([]string, 0, len(hostnameList))
+	for _, hostname := range hostnameList {
+		result = append(result, clusterHostname(hostname, sc.clusterName, sc.domainFilter))
+	}
+	return result
+}
+
+// requestedHostnames returns the hostnames of the hostname annotation of the service,
+// followed by the ones routed to it, without duplicates.
+func (sc *serviceSource) requestedHostnames(svc *v1.Service) []string {
+	hostnameList := getHostnamesFromAnnotations(svc.Annotations)
+	if sc.router == nil {
+		return hostnameList
+	}
+	r := sc.router(svc)
+	if r == nil {
+		return hostnameList
+	}
+
+	seen := make(map[string]bool, len(hostnameList))
+	for _, hostname := range hostnameList {
+		seen[hostname] = true
+	}
+	for _, hostname := range r.hostnames {
+		if !seen[hostname] {
+			seen[hostname] = true
+			hostnameList = append(hostnameList, hostname)
+		}
+	}
+	return hostnameList
+}
+
+// routedPorts returns the numbers of the ports of the service routed to by other
+// resources, nil if none routes to it.
+func (sc *serviceSource) routedPorts(svc *v1.Service) map[int]bool {
+	if sc.router == nil {
+		return nil
+	}
+	if r := sc.router(svc); r != nil {
+		return r.ports
+	}
+	return nil
+}
+
+// internalNameEndpoints generates an additional endpoint per hostname, named after
+// the internal FQDN template and targeting the internal IPs of the nodes.
+func (sc *serviceSource) internalNameEndpoints(svc *v1.Service, internalIPs endpoint.Targets) ([]*endpoint.Endpoint, error) {
+	var endpoints []*endpoint.Endpoint
+
+	hostnameList := sc.hostnames(svc)
+	for _, hostname := range hostnameList {
+		var buf bytes.Buffer
+		err := sc.internalFQDNTemplate.Execute(&buf, internalFQDNTemplateData{
+			Hostname:  strings.TrimSuffix(hostname, "."),
+			Name:      svc.Name,
+			Namespace: svc.Namespace,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply internal template on service %s/%s: %v", svc.Namespace, svc.Name, err)
+		}
+		endpoints = append(endpoints, sc.generateEndpoint(svc, buf.String(), internalIPs))
+	}
+
+	return endpoints, nil
+}
+
+// internalFQDNTemplateData is passed to the internal FQDN template.
+type internalFQDNTemplateData struct {
+	Hostname  string
+	Name      string
+	Namespace string
+}
+
+// inboundRules opens the ports of the service listed by its ports annotation, all of them if absent,
+// to the sources of its source annotations, any address if absent. The NodePort services open the
+// node port range instead when configured, by a single rule per protocol of their ports.
+func (sc *serviceSource) inboundRules(svc *v1.Service, providerIDs []string, clusterName string) (*inbound.InboundRules, error) {
+	exposed := getPortsFromAnnotations(svc.Annotations)
+	routed := sc.routedPorts(svc)
+	sourceRanges, err := getSourceRangesFromAnnotations(svc.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	sourceSecurityGroup := strings.TrimSpace(svc.Annotations[sourceSecurityGroupAnnotationKey])
+	// the NodePort services are reached on their node ports, all opened by a rule per protocol
+	nodePorts := sc.nodePortFirst != 0 && svc.Spec.Type == v1.ServiceTypeNodePort
+	var nodePortProtocols []string
+	nodePortOpened := map[string]bool{}
+
 	inboundRules := inbound.NewInboundRules()
-	inboundRules.ProviderIDs = providerIDs
+	inboundRules.ProviderIDs = inbound.NewProviderIDs(providerIDs...)
 	for _, port := range svc.Spec.Ports {
-		// figure out the protocol
-		protocol := strings.ToLower(string(port.Protocol))
-		if protocol == "" {
-			protocol = "tcp"
+		// name the port after its number when it has no name
+		portName := port.Name
+		if portName == "" {
+			portName = strconv.Itoa(int(port.Port))
+		}
+
+		// figure out the protocol, tcp by default like Kubernetes
+		protocol := inbound.ProtocolTCP
+		if port.Protocol != "" {
+			protocol, err = inbound.ParseProtocol(string(port.Protocol))
+			if err != nil {
+				return nil, fmt.Errorf("port %s of service %s/%s: %v", portName, svc.Namespace, svc.Name, err)
+			}
+		}
+		if exposed != nil && !exposed[portName] {
+			log.Debugf("Not opening port %s of service %s/%s, not listed in its ports annotation", portName, svc.Namespace, svc.Name)
+			continue
+		}
+		// the ports annotation takes precedence over the ports of the routes
+		if exposed == nil && routed != nil && !routed[int(port.Port)] {
+			log.Debugf("Not opening port %s of service %s/%s, not routed to", portName, svc.Namespace, svc.Name)
+			continue
+		}
+
+		if nodePorts {
+			if !nodePortOpened[protocol] {
+				nodePortOpened[protocol] = true
+				nodePortProtocols = append(nodePortProtocols, protocol)
+			}
+			continue
 		}
 
 		rule := inbound.InboundRule{
-			Protocol: protocol,
-			Port:     int(port.Port),
+			Protocol:            protocol,
+			Port:                int(port.Port),
+			Description:         svc.Namespace + "/" + svc.Name + "/" + portName,
+			SourceCIDRs:         sourceRanges,
+			SourceSecurityGroup: sourceSecurityGroup,
 		}
 		inboundRules.Rules = append(inboundRules.Rules, rule)
 	}
-	inboundRules.Name = svc.Name
-	if svc.Namespace != "default" && len(svc.Namespace) > 0 {
-		inboundRules.Name += "." + svc.Namespace
+	for _, protocol := range nodePortProtocols {
+		inboundRules.Rules = append(inboundRules.Rules, inbound.InboundRule{
+			Protocol:            protocol,
+			Port:                sc.nodePortFirst,
+			ToPort:              sc.nodePortLast,
+			Description:         svc.Namespace + "/" + svc.Name + "/node-ports",
+			SourceCIDRs:         sourceRanges,
+			SourceSecurityGroup: sourceSecurityGroup,
+		})
+	}
+	inboundRules.Name = inboundRulesName(svc.Name, svc.Namespace, clusterName)
+	inboundRules.Resource = svc.Namespace + "/" + svc.Name
+	if sc.firewallNameTemplate != nil {
+		name, err := firewallName(sc.firewallNameTemplate, svc.Name, svc.Namespace, clusterName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to name the security group of service %s/%s: %v", svc.Namespace, svc.Name, err)
+		}
+		// the security group named after the default scheme is kept if it already exists
+		if name != inboundRules.Name {
+			inboundRules.LegacyName = inboundRules.Name
+			inboundRules.Name = name
+		}
 	}
-	inboundRules.Name += "." + clusterName
-	return inboundRules
+	return inboundRules, nil
+}
+
+// inboundRulesName returns the name of the inbound rules of a resource, which
+// leaves out the default namespace, shortened if too long for a security group.
+func inboundRulesName(name, namespace, clusterName string) string {
+	result := name
+	if namespace != "default" && len(namespace) > 0 {
+		result += "." + namespace
+	}
+	return shortenFirewallName(result+"."+clusterName, firewallNameHash(name, namespace, clusterName), clusterName)
+}
+
+const (
+	// the length limit of the names of the security groups of EC2
+	maxFirewallNameLength = 255
+	// the number of hexadecimal digits of the hash of the firewall names
+	firewallNameHashLength = 10
+)
+
+// firewallNameData is the data of the firewall name template.
+type firewallNameData struct {
+	Service   string
+	Namespace string
+	Cluster   string
+	// a short hash of the namespace, the name and the cluster of the service
+	Hash string
+}
+
+// firewallName returns the name of the inbound rules of a service given by the
+// firewall name template.
+func firewallName(tmpl *template.Template, name, namespace, clusterName string) (string, error) {
+	hash := firewallNameHash(name, namespace, clusterName)
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, firewallNameData{
+		Service:   name,
+		Namespace: namespace,
+		Cluster:   clusterName,
+		Hash:      hash,
+	}); err != nil {
+		return "", err
+	}
+	result := strings.TrimSpace(buf.String())
+	if result == "" {
+		return "", fmt.Errorf("the firewall name template gives an empty name")
+	}
+	return shortenFirewallName(result, hash, clusterName), nil
+}
+
+// firewallNameHash returns a short hash telling apart the resources whose names
+// are shortened to the same prefix.
+func firewallNameHash(name, namespace, clusterName string) string {
+	sum := sha256.Sum256([]byte(namespace + "/" + name + "/" + clusterName))
+	return hex.EncodeToString(sum[:])[:firewallNameHashLength]
+}
+
+// shortenFirewallName fits a name in the length of the names of the security groups,
+// replacing the end of the names too long with the hash. The cluster suffix the
+// provider recognizes its security groups by is kept.
+func shortenFirewallName(name, hash, clusterName string) string {
+	if len(name) <= maxFirewallNameLength {
+		return name
+	}
+	suffix := "-" + hash
+	if strings.HasSuffix(name, "."+clusterName) && len(suffix)+len(clusterName)+1 < maxFirewallNameLength {
+		suffix += "." + clusterName
+	}
+	return name[:maxFirewallNameLength-len(suffix)] + suffix
+}
+
+// aliasEndpoints returns the records of the alias hostnames of the service, CNAME
+// records flagged as aliases of the record of its first hostname. They're left out
+// unless this record is an A record with targets, as the alias of a missing record
+// or of a record of another type is refused.
+func (sc *serviceSource) aliasEndpoints(svc *v1.Service, endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	aliases := getAliasHostnamesFromAnnotations(svc.Annotations)
+	if len(aliases) == 0 {
+		return nil
+	}
+	if len(endpoints) == 0 || endpoints[0].RecordType != endpoint.RecordTypeA || len(endpoints[0].Targets) == 0 {
+		log.Debugf("Service %s/%s has no record to alias, skipping its alias hostnames", svc.Namespace, svc.Name)
+		return nil
+	}
+
+	target := endpoints[0].DNSName
+	aliasEndpoints := make([]*endpoint.Endpoint, 0, len(aliases))
+	for _, alias := range aliases {
+		ep := &endpoint.Endpoint{
+			RecordType:       endpoint.RecordTypeCNAME,
+			Labels:           endpoint.NewLabels(),
+			Targets:          endpoint.Targets{target},
+			DNSName:          alias,
+			ProviderSpecific: getProviderSpecificFromAnnotations(svc.Annotations),
+		}
+		ep.WithProviderSpecific(provider.AliasProperty, "true")
+		aliasEndpoints = append(aliasEndpoints, ep.Normalize())
+	}
+	return aliasEndpoints
+}
+
+// maintenanceEndpoints points the endpoints of a service in maintenance to its maintenance
+// target, and withdraws them if it has none.
+func (sc *serviceSource) maintenanceEndpoints(svc *v1.Service, endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	target := strings.TrimSpace(svc.Annotations[maintenanceTargetAnnotationKey])
+	if target == "" {
+		return nil
+	}
+	for _, ep := range endpoints {
+		ep.Targets = endpoint.Targets{target}
+		ep.RecordType = suitableType(target)
+		// the maintenance target is the same in the public and private zones
+		ep.PrivateTargets = nil
+		ep.Normalize()
+	}
+	return endpoints
+}
+
+// maintenanceInboundRules limits the inbound rules of a service in maintenance to its
+// maintenance source ranges, if any.
+func (sc *serviceSource) maintenanceInboundRules(svc *v1.Service, inboundRules *inbound.InboundRules) error {
+	sourceRanges, err := getMaintenanceSourceRangesFromAnnotations(svc.Annotations)
+	if err != nil || sourceRanges == nil {
+		return err
+	}
+	for i := range inboundRules.Rules {
+		inboundRules.Rules[i].SourceCIDRs = sourceRanges
+		inboundRules.Rules[i].SourceSecurityGroup = ""
+	}
+	return nil
 }
 
 // filterByAnnotations filters a list of services by a given annotation selector.
@@ -254,12 +989,29 @@ func (sc *serviceSource) filterByAnnotations(services []v1.Service) ([]v1.Servic
 	return filteredList, nil
 }
 
-func (sc *serviceSource) extractNodes() ([]v1.Node, error) {
-	nodes, err := sc.client.CoreV1().Nodes().List(metav1.ListOptions{})
-	if err != nil {
-		return nil, err
+// checkDomains warns about the endpoints of the service which don't match the domain
+// filter, as no zone would accept them, and returns their number.
+func (sc *serviceSource) checkDomains(svc *v1.Service, endpoints []*endpoint.Endpoint) int {
+	unpublishable := 0
+	for _, ep := range endpoints {
+		if sc.domainFilter.Match(ep.DNSName) {
+			continue
+		}
+		unpublishable++
+
+		log.Warnf("Hostname %s of service %s/%s doesn't match the domain filter and won't be published", ep.DNSName, svc.Namespace, svc.Name)
+		if sc.recorder == nil {
+			continue
+		}
+		ref := &v1.ObjectReference{
+			Kind:      "Service",
+			Namespace: svc.Namespace,
+			Name:      svc.Name,
+			UID:       svc.UID,
+		}
+		sc.recorder.Eventf(ref, v1.EventTypeWarning, reasonUnpublishableHostname, "Hostname %s doesn't match the domain filter and won't be published", ep.DNSName)
 	}
-	return nodes.Items, nil
+	return unpublishable
 }
 
 func (sc *serviceSource) setResourceLabel(service v1.Service, endpoints []*endpoint.Endpoint) {
@@ -268,24 +1020,98 @@ func (sc *serviceSource) setResourceLabel(service v1.Service, endpoints []*endpo
 	}
 }
 
+// setSlotLabels labels the endpoints of a service belonging to a blue/green pair with
+// its slot and the active slot of its namespace.
+func (sc *serviceSource) setSlotLabels(svc *v1.Service, endpoints ...[]*endpoint.Endpoint) error {
+	slot, err := getSlotFromAnnotations(svc.Annotations)
+	if err != nil || slot == "" {
+		return err
+	}
+	activeSlot, err := sc.namespaceActiveSlot(svc.Namespace)
+	if err != nil {
+		return err
+	}
+	for _, eps := range endpoints {
+		for _, ep := range eps {
+			ep.Labels[endpoint.SlotLabelKey] = slot
+			ep.Labels[endpoint.ActiveSlotLabelKey] = activeSlot
+		}
+	}
+	return nil
+}
+
+// setServiceLabels copies the allow-listed labels of a service to its endpoints, prefixed
+// with endpoint.ServiceLabelKeyPrefix, and to its inbound rules.
+func (sc *serviceSource) setServiceLabels(svc *v1.Service, inboundRules *inbound.InboundRules, endpoints ...[]*endpoint.Endpoint) {
+	for _, key := range sc.serviceLabels {
+		value, ok := svc.Labels[key]
+		if key == "" || !ok {
+			continue
+		}
+		for _, eps := range endpoints {
+			for _, ep := range eps {
+				ep.Labels[endpoint.ServiceLabelKeyPrefix+key] = value
+			}
+		}
+		if inboundRules.Labels == nil {
+			inboundRules.Labels = map[string]string{}
+		}
+		inboundRules.Labels[key] = value
+	}
+}
+
+// setExtensions passes the unknown external-ips annotations of a service on to the
+// providers, on its endpoints and its inbound rules, which share them read-only.
+func (sc *serviceSource) setExtensions(svc *v1.Service, inboundRules *inbound.InboundRules, endpoints ...[]*endpoint.Endpoint) {
+	extensions := getExtensionsFromAnnotations(svc.Annotations)
+	if extensions == nil {
+		return
+	}
+	log.Debugf("Passing extensions %v of service %s/%s on to the providers", extensions, svc.Namespace, svc.Name)
+	for _, eps := range endpoints {
+		for _, ep := range eps {
+			ep.Extensions = extensions
+		}
+	}
+	inboundRules.Extensions = extensions
+}
+
+// namespaceActiveSlot returns the slot of the blue/green pairs of the namespace whose
+// IPs are published, from the active slot annotation of the namespace if it has one.
+func (sc *serviceSource) namespaceActiveSlot(namespace string) (string, error) {
+	ns, err := sc.client.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	// the namespaces may not be readable, the active slot of the flag applies then
+	if errors.IsNotFound(err) || errors.IsForbidden(err) {
+		return sc.activeSlot, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	activeSlot, exists := ns.Annotations[activeSlotAnnotationKey]
+	if !exists {
+		return sc.activeSlot, nil
+	}
+	return parseSlot(activeSlot)
+}
+
 func (sc *serviceSource) generateEndpoint(svc *v1.Service, hostname string, nodeTargets endpoint.Targets) *endpoint.Endpoint {
-	hostname = strings.TrimSuffix(hostname, ".")
 	ttl, err := getTTLFromAnnotations(svc.Annotations)
 	if err != nil {
 		log.Warn(err)
 	}
 
 	ep := &endpoint.Endpoint{
-		RecordTTL:  ttl,
-		RecordType: endpoint.RecordTypeA,
-		Labels:     endpoint.NewLabels(),
-		Targets:    make(endpoint.Targets, 0, defaultTargetsCapacity),
-		DNSName:    hostname,
+		RecordTTL:        ttl,
+		RecordType:       endpoint.RecordTypeA,
+		Labels:           endpoint.NewLabels(),
+		Targets:          make(endpoint.Targets, 0, defaultTargetsCapacity),
+		DNSName:          hostname,
+		ProviderSpecific: getProviderSpecificFromAnnotations(svc.Annotations),
 	}
 
 	for _, t := range nodeTargets {
 		ep.Targets = append(ep.Targets, t)
 	}
 
-	return ep
+	return ep.Normalize()
 }
@@ -21,16 +21,22 @@ package source
 
 import (
 	"github.com/openfresh/external-ips/extip/extip"
+	"strings"
 	"testing"
+	"time"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/pkg/api/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/provider"
 	"github.com/openfresh/external-ips/firewall/inbound"
+	"github.com/openfresh/external-ips/node"
 	"github.com/openfresh/external-ips/setting"
 
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -48,6 +54,8 @@ func (suite *ServiceSuite) SetupTest() {
 
 	suite.sc, err = NewServiceSource(
 		fakeClient,
+		node.NewClientLister(fakeClient),
+		nil,
 		"",
 		"",
 		"",
@@ -55,7 +63,18 @@ func (suite *ServiceSuite) SetupTest() {
 		false,
 		"",
 		false,
+		"",
+		0,
+		"",
+		"",
+		provider.DomainFilter{},
+		false,
 		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
 	)
 	suite.fooWithTargets = &v1.Service{
 		Spec: v1.ServiceSpec{
@@ -99,6 +118,7 @@ type NodeInfo struct {
 }
 
 type PortInfo struct {
+	name     string
 	protocol string
 	port     int
 }
@@ -108,6 +128,22 @@ func TestServiceSource(t *testing.T) {
 	t.Run("Interface", testServiceSourceImplementsSource)
 	t.Run("NewServiceSource", testServiceSourceNewServiceSource)
 	t.Run("Endpoints", testServiceSourceEndpoints)
+	t.Run("PublishInternal", testServiceSourcePublishInternal)
+	t.Run("Draining", testServiceSourceDraining)
+	t.Run("SpotPolicy", testServiceSourceSpotPolicy)
+	t.Run("NodeConditions", testServiceSourceNodeConditions)
+	t.Run("MinIPs", testServiceSourceMinIPs)
+	t.Run("ServiceSetting", testServiceSourceServiceSetting)
+	t.Run("DomainFilter", testServiceSourceDomainFilter)
+	t.Run("Deleting", testServiceSourceDeleting)
+	t.Run("Expiry", testServiceSourceExpiry)
+	t.Run("Maintenance", testServiceSourceMaintenance)
+	t.Run("Slots", testServiceSourceSlots)
+	t.Run("DryRun", testServiceSourceDryRun)
+	t.Run("ServiceLabels", testServiceSourceServiceLabels)
+	t.Run("FirewallNameTemplate", testServiceSourceFirewallNameTemplate)
+	t.Run("AliasHostnames", testServiceSourceAliasHostnames)
+	t.Run("NodePortRange", testServiceSourceNodePortRange)
 }
 
 // testServiceSourceImplementsSource tests that serviceSource is a valid Source.
@@ -144,8 +180,11 @@ func testServiceSourceNewServiceSource(t *testing.T) {
 		},
 	} {
 		t.Run(ti.title, func(t *testing.T) {
+			client := fake.NewSimpleClientset()
 			_, err := NewServiceSource(
-				fake.NewSimpleClientset(),
+				client,
+				node.NewClientLister(client),
+				nil,
 				"",
 				"",
 				ti.annotationFilter,
@@ -153,7 +192,18 @@ func testServiceSourceNewServiceSource(t *testing.T) {
 				false,
 				"",
 				false,
+				"",
+				0,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
 				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
 			)
 
 			if ti.expectError {
@@ -239,11 +289,14 @@ func testServiceSourceEndpoints(t *testing.T) {
 				Endpoints: []*endpoint.Endpoint{
 					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
 				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+				},
 				InboundRules: []*inbound.InboundRules{
 					{
 						Name: "foo.testing.cl.kube.io",
 						Rules: []inbound.InboundRule{
-							{Protocol: "udp", Port: 5000},
+							{Protocol: "udp", Port: 5000, Description: "testing/foo/5000"},
 						},
 						ProviderIDs: inbound.ProviderIDs{"abc"},
 					},
@@ -310,13 +363,16 @@ func testServiceSourceEndpoints(t *testing.T) {
 				Endpoints: []*endpoint.Endpoint{
 					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7", "10.9.8.6"}},
 				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4", "1.2.3.5"}},
+				},
 				InboundRules: []*inbound.InboundRules{
 					{
 						Name: "foo.testing.cl.kube.io",
 						Rules: []inbound.InboundRule{
-							{Protocol: "udp", Port: 5000},
-							{Protocol: "tcp", Port: 80},
-							{Protocol: "tcp", Port: 443},
+							{Protocol: "udp", Port: 5000, Description: "testing/foo/5000"},
+							{Protocol: "tcp", Port: 80, Description: "testing/foo/80"},
+							{Protocol: "tcp", Port: 443, Description: "testing/foo/443"},
 						},
 						ProviderIDs: inbound.ProviderIDs{"abc", "def"},
 					},
@@ -327,6 +383,141 @@ func testServiceSourceEndpoints(t *testing.T) {
 			},
 			false,
 		},
+		{
+			"annotated services only open the ports listed by their ports annotation",
+			"cl.kube.io",
+			"",
+			"",
+			"testing",
+			"foo",
+			v1.ServiceTypeClusterIP,
+			"",
+			"",
+			false,
+			map[string]string{},
+			map[string]string{
+				hostnameAnnotationKey: "foo.example.org.",
+				portsAnnotationKey:    "game, 443",
+			},
+			"",
+			[]PortInfo{
+				{name: "game", protocol: "udp", port: 5000},
+				{name: "metrics", protocol: "tcp", port: 9100},
+				{protocol: "tcp", port: 443},
+			},
+			[]NodeInfo{
+				{
+					name:       "node1",
+					providerID: "abc",
+					internalIP: "1.2.3.4",
+					externalIP: "10.9.8.7",
+				},
+			},
+			setting.ExternalIPSetting{
+				Endpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+				},
+				InboundRules: []*inbound.InboundRules{
+					{
+						Name: "foo.testing.cl.kube.io",
+						Rules: []inbound.InboundRule{
+							{Protocol: "udp", Port: 5000, Description: "testing/foo/game"},
+							{Protocol: "tcp", Port: 443, Description: "testing/foo/443"},
+						},
+						ProviderIDs: inbound.ProviderIDs{"abc"},
+					},
+				},
+				ExtIPs: []*extip.ExtIP{
+					{SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+				},
+			},
+			false,
+		},
+		{
+			"annotated services open their ports to the sources of their source annotations",
+			"cl.kube.io",
+			"",
+			"",
+			"testing",
+			"foo",
+			v1.ServiceTypeClusterIP,
+			"",
+			"",
+			false,
+			map[string]string{},
+			map[string]string{
+				hostnameAnnotationKey:            "foo.example.org.",
+				sourceRangesAnnotationKey:        "10.0.0.0/8, 192.168.1.0/24",
+				sourceSecurityGroupAnnotationKey: "self",
+			},
+			"",
+			[]PortInfo{
+				{protocol: "tcp", port: 443},
+			},
+			[]NodeInfo{
+				{
+					name:       "node1",
+					providerID: "abc",
+					internalIP: "1.2.3.4",
+					externalIP: "10.9.8.7",
+				},
+			},
+			setting.ExternalIPSetting{
+				Endpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+				},
+				InboundRules: []*inbound.InboundRules{
+					{
+						Name: "foo.testing.cl.kube.io",
+						Rules: []inbound.InboundRule{
+							{Protocol: "tcp", Port: 443, Description: "testing/foo/443", SourceCIDRs: []string{"10.0.0.0/8", "192.168.1.0/24"}, SourceSecurityGroup: inbound.SourceSecurityGroupSelf},
+						},
+						ProviderIDs: inbound.ProviderIDs{"abc"},
+					},
+				},
+				ExtIPs: []*extip.ExtIP{
+					{SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+				},
+			},
+			false,
+		},
+		{
+			"services with an invalid source range fail",
+			"cl.kube.io",
+			"",
+			"",
+			"testing",
+			"foo",
+			v1.ServiceTypeClusterIP,
+			"",
+			"",
+			false,
+			map[string]string{},
+			map[string]string{
+				hostnameAnnotationKey:     "foo.example.org.",
+				sourceRangesAnnotationKey: "10.0.0.1",
+			},
+			"",
+			[]PortInfo{
+				{protocol: "tcp", port: 443},
+			},
+			[]NodeInfo{
+				{
+					name:       "node1",
+					providerID: "abc",
+					internalIP: "1.2.3.4",
+					externalIP: "10.9.8.7",
+				},
+			},
+			setting.ExternalIPSetting{},
+			true,
+		},
 		{
 			"annotated services return an setting with 1 external IP",
 			"cl.kube.io",
@@ -381,11 +572,14 @@ func testServiceSourceEndpoints(t *testing.T) {
 				Endpoints: []*endpoint.Endpoint{
 					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.5"}},
 				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.6"}},
+				},
 				InboundRules: []*inbound.InboundRules{
 					{
 						Name: "foo.testing.cl.kube.io",
 						Rules: []inbound.InboundRule{
-							{Protocol: "udp", Port: 5000},
+							{Protocol: "udp", Port: 5000, Description: "testing/foo/5000"},
 						},
 						ProviderIDs: inbound.ProviderIDs{"ghi"},
 					},
@@ -404,6 +598,7 @@ func testServiceSourceEndpoints(t *testing.T) {
 			ports := []v1.ServicePort{}
 			for _, port := range tc.ports {
 				ports = append(ports, v1.ServicePort{
+					Name:     port.name,
 					Protocol: v1.Protocol(port.protocol),
 					Port:     int32(port.port),
 				})
@@ -429,6 +624,8 @@ func testServiceSourceEndpoints(t *testing.T) {
 			// Create our object under test and get the endpoints.
 			client, _ := NewServiceSource(
 				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
 				tc.clusterName,
 				tc.targetNamespace,
 				tc.annotationFilter,
@@ -436,7 +633,18 @@ func testServiceSourceEndpoints(t *testing.T) {
 				tc.combineFQDNAndAnnotation,
 				tc.compatibility,
 				false,
+				"",
+				0,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
 				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
 			)
 			require.NoError(t, err)
 
@@ -472,3 +680,1229 @@ func testServiceSourceEndpoints(t *testing.T) {
 		})
 	}
 }
+
+// testServiceSourcePublishInternal tests that an internal name targeting the internal IPs is published.
+func testServiceSourcePublishInternal(t *testing.T) {
+	for _, tc := range []struct {
+		title                string
+		internalFQDNTemplate string
+		expected             []*endpoint.Endpoint
+		expectError          bool
+	}{
+		{
+			"default template prefixes the hostname",
+			"internal.{{.Hostname}}",
+			[]*endpoint.Endpoint{
+				{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+				{DNSName: "internal.foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+			},
+			false,
+		},
+		{
+			"template using the service",
+			"{{.Name}}.{{.Namespace}}.vpn.example.org",
+			[]*endpoint.Endpoint{
+				{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+				{DNSName: "foo.testing.vpn.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+			},
+			false,
+		},
+		{
+			"invalid template",
+			"{{.Name",
+			nil,
+			true,
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			kubernetes := fake.NewSimpleClientset()
+
+			_, err := kubernetes.CoreV1().Services("testing").Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "testing",
+					Name:      "foo",
+					Annotations: map[string]string{
+						hostnameAnnotationKey: "foo.example.org.",
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			_, err = kubernetes.CoreV1().Nodes().Create(&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       v1.NodeSpec{ProviderID: "abc"},
+				Status: v1.NodeStatus{
+					Addresses: []v1.NodeAddress{
+						{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+						{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			client, err := NewServiceSource(
+				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
+				"cl.kube.io",
+				"",
+				"",
+				"",
+				false,
+				"",
+				true,
+				tc.internalFQDNTemplate,
+				0,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
+				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
+			)
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			extipsetting, err := client.ExternalIPSetting()
+			require.NoError(t, err)
+
+			validateEndpoints(t, extipsetting.Endpoints, tc.expected)
+		})
+	}
+}
+
+// testServiceSourceDraining tests that draining nodes are removed from the DNS records and
+// external IPs, but kept in the inbound rules for the drain period.
+func testServiceSourceDraining(t *testing.T) {
+	for _, tc := range []struct {
+		title       string
+		drainPeriod time.Duration
+		annotations map[string]string
+		taints      []v1.Taint
+		providerIDs inbound.ProviderIDs
+	}{
+		{
+			"annotated node is kept in the inbound rules during the drain period",
+			time.Hour,
+			map[string]string{node.DrainingKey: ""},
+			nil,
+			inbound.ProviderIDs{"abc", "def"},
+		},
+		{
+			"tainted node is kept in the inbound rules during the drain period",
+			time.Hour,
+			nil,
+			[]v1.Taint{{Key: node.DrainingKey, Effect: v1.TaintEffectNoSchedule}},
+			inbound.ProviderIDs{"abc", "def"},
+		},
+		{
+			"draining node is removed from the inbound rules without drain period",
+			0,
+			map[string]string{node.DrainingKey: ""},
+			nil,
+			inbound.ProviderIDs{"abc"},
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			kubernetes := fake.NewSimpleClientset()
+
+			_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "foo",
+					Annotations: map[string]string{
+						hostnameAnnotationKey: "foo.example.org.",
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			for _, n := range []*v1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+					Spec:       v1.NodeSpec{ProviderID: "abc"},
+					Status: v1.NodeStatus{
+						Addresses: []v1.NodeAddress{
+							{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+							{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{Name: "node2", Annotations: tc.annotations},
+					Spec:       v1.NodeSpec{ProviderID: "def", Taints: tc.taints},
+					Status: v1.NodeStatus{
+						Addresses: []v1.NodeAddress{
+							{Type: v1.NodeExternalIP, Address: "10.9.8.6"},
+							{Type: v1.NodeInternalIP, Address: "1.2.3.5"},
+						},
+					},
+				},
+			} {
+				_, err := kubernetes.CoreV1().Nodes().Create(n)
+				require.NoError(t, err)
+			}
+
+			client, err := NewServiceSource(
+				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
+				"cl.kube.io",
+				"",
+				"",
+				"",
+				false,
+				"",
+				false,
+				"",
+				tc.drainPeriod,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
+				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
+			)
+			require.NoError(t, err)
+
+			extipsetting, err := client.ExternalIPSetting()
+			require.NoError(t, err)
+
+			validateSetting(t, extipsetting, &setting.ExternalIPSetting{
+				Endpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+				},
+				InternalEndpoints: []*endpoint.Endpoint{
+					{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}},
+				},
+				InboundRules: []*inbound.InboundRules{
+					{Name: "foo.cl.kube.io", ProviderIDs: tc.providerIDs},
+				},
+				ExtIPs: []*extip.ExtIP{
+					{SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+				},
+			})
+		})
+	}
+}
+
+// testServiceSourceSpotPolicy tests that the nodes backed by spot instances are selected according to the policy.
+func testServiceSourceSpotPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		title       string
+		spotPolicy  string
+		maxips      string
+		targets     endpoint.Targets
+		providerIDs inbound.ProviderIDs
+	}{
+		{
+			"spot nodes are selected like others without policy",
+			"",
+			"1",
+			endpoint.Targets{"10.9.8.7"},
+			inbound.ProviderIDs{"abc"},
+		},
+		{
+			"spot nodes are selected after others when deprioritized",
+			"deprioritize",
+			"1",
+			endpoint.Targets{"10.9.8.6"},
+			inbound.ProviderIDs{"def"},
+		},
+		{
+			"spot nodes are selected when there are not enough others",
+			"deprioritize",
+			"2",
+			endpoint.Targets{"10.9.8.6", "10.9.8.7"},
+			inbound.ProviderIDs{"def", "abc"},
+		},
+		{
+			"spot nodes are never selected when excluded",
+			"exclude",
+			"2",
+			endpoint.Targets{"10.9.8.6"},
+			inbound.ProviderIDs{"def"},
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			kubernetes := fake.NewSimpleClientset()
+
+			_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: "default",
+					Name:      "foo",
+					Annotations: map[string]string{
+						hostnameAnnotationKey: "foo.example.org.",
+						maxipsAnnotationKey:   tc.maxips,
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			for _, n := range []*v1.Node{
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "node1",
+						Labels:            map[string]string{"lifecycle": "Ec2Spot"},
+						CreationTimestamp: metav1.NewTime(time.Unix(1, 0)),
+					},
+					Spec: v1.NodeSpec{ProviderID: "abc"},
+					Status: v1.NodeStatus{
+						Addresses: []v1.NodeAddress{
+							{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+						},
+					},
+				},
+				{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:              "node2",
+						CreationTimestamp: metav1.NewTime(time.Unix(2, 0)),
+					},
+					Spec: v1.NodeSpec{ProviderID: "def"},
+					Status: v1.NodeStatus{
+						Addresses: []v1.NodeAddress{
+							{Type: v1.NodeExternalIP, Address: "10.9.8.6"},
+						},
+					},
+				},
+			} {
+				_, err := kubernetes.CoreV1().Nodes().Create(n)
+				require.NoError(t, err)
+			}
+
+			client, err := NewServiceSource(
+				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
+				"cl.kube.io",
+				"",
+				"",
+				"",
+				false,
+				"",
+				false,
+				"",
+				0,
+				tc.spotPolicy,
+				"lifecycle=Ec2Spot",
+				provider.DomainFilter{},
+				false,
+				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
+			)
+			require.NoError(t, err)
+
+			extipsetting, err := client.ExternalIPSetting()
+			require.NoError(t, err)
+
+			validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{
+				{DNSName: "foo.example.org", Targets: tc.targets},
+			})
+			validateInboundRules(t, extipsetting.InboundRules, []*inbound.InboundRules{
+				{Name: "foo.cl.kube.io", ProviderIDs: tc.providerIDs},
+			})
+		})
+	}
+}
+
+// testServiceSourceNodeConditions tests that the nodes whose network is unavailable are
+// never selected and the nodes under pressure are selected after the others.
+func testServiceSourceNodeConditions(t *testing.T) {
+	newNode := func(name string, conditions ...v1.NodeCondition) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Status:     v1.NodeStatus{Conditions: conditions},
+		}
+	}
+	nodes := applyNodeConditions([]*v1.Node{
+		newNode("pressured", v1.NodeCondition{Type: v1.NodeDiskPressure, Status: v1.ConditionTrue}),
+		newNode("unavailable", v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionTrue}),
+		newNode("healthy", v1.NodeCondition{Type: v1.NodeNetworkUnavailable, Status: v1.ConditionFalse}),
+	})
+
+	names := []string{}
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	assert.Equal(t, []string{"healthy", "pressured"}, names)
+}
+
+// testServiceSourceMinIPs tests that the previous targets are kept while fewer nodes than the min IPs are selected.
+func testServiceSourceMinIPs(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+
+	_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				hostnameAnnotationKey: "foo.example.org.",
+				minipsAnnotationKey:   "2",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	newNode := func(name, providerID, ip string) *v1.Node {
+		return &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec:       v1.NodeSpec{ProviderID: providerID},
+			Status: v1.NodeStatus{
+				Addresses: []v1.NodeAddress{
+					{Type: v1.NodeExternalIP, Address: ip},
+				},
+			},
+		}
+	}
+	for _, n := range []*v1.Node{
+		newNode("node1", "abc", "10.9.8.7"),
+		newNode("node2", "def", "10.9.8.6"),
+	} {
+		_, err := kubernetes.CoreV1().Nodes().Create(n)
+		require.NoError(t, err)
+	}
+
+	client, err := NewServiceSource(
+		kubernetes,
+		node.NewClientLister(kubernetes),
+		nil,
+		"cl.kube.io",
+		"",
+		"",
+		"",
+		false,
+		"",
+		false,
+		"",
+		0,
+		"",
+		"",
+		provider.DomainFilter{},
+		false,
+		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	validate := func(targets endpoint.Targets, providerIDs inbound.ProviderIDs) {
+		extipsetting, err := client.ExternalIPSetting()
+		require.NoError(t, err)
+
+		validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{
+			{DNSName: "foo.example.org", Targets: targets},
+		})
+		validateInboundRules(t, extipsetting.InboundRules, []*inbound.InboundRules{
+			{Name: "foo.cl.kube.io", ProviderIDs: providerIDs},
+		})
+	}
+
+	validate(endpoint.Targets{"10.9.8.6", "10.9.8.7"}, inbound.ProviderIDs{"abc", "def"})
+
+	// node2 draining leaves a single node, the previous targets are kept
+	drained := newNode("node2", "def", "10.9.8.6")
+	drained.Annotations = map[string]string{node.DrainingKey: ""}
+	_, err = kubernetes.CoreV1().Nodes().Update(drained)
+	require.NoError(t, err)
+
+	validate(endpoint.Targets{"10.9.8.6", "10.9.8.7"}, inbound.ProviderIDs{"abc", "def"})
+
+	// a new node brings the count back
+	_, err = kubernetes.CoreV1().Nodes().Create(newNode("node3", "ghi", "10.9.8.5"))
+	require.NoError(t, err)
+
+	validate(endpoint.Targets{"10.9.8.5", "10.9.8.7"}, inbound.ProviderIDs{"abc", "ghi"})
+}
+
+// testServiceSourceServiceSetting tests that the setting of a single service can be returned.
+func testServiceSourceServiceSetting(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+
+	for _, name := range []string{"foo", "bar"} {
+		_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+				Annotations: map[string]string{
+					hostnameAnnotationKey: name + ".example.org.",
+				},
+			},
+		})
+		require.NoError(t, err)
+	}
+	_, err := kubernetes.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "abc"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	client, err := NewServiceSource(
+		kubernetes,
+		node.NewClientLister(kubernetes),
+		nil,
+		"cl.kube.io",
+		"",
+		"",
+		"",
+		false,
+		"",
+		false,
+		"",
+		0,
+		"",
+		"",
+		provider.DomainFilter{},
+		false,
+		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	ts, ok := client.(TargetedSource)
+	require.True(t, ok)
+
+	extipsetting, err := ts.ServiceSetting("default", "foo")
+	require.NoError(t, err)
+	validateEndpoints(t, extipsetting.Endpoints, []*endpoint.Endpoint{
+		{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}},
+	})
+	validateInboundRules(t, extipsetting.InboundRules, []*inbound.InboundRules{
+		{Name: "foo.cl.kube.io", ProviderIDs: inbound.ProviderIDs{"abc"}},
+	})
+
+	// a deleted service has an empty setting
+	require.NoError(t, kubernetes.CoreV1().Services("default").Delete("foo", &metav1.DeleteOptions{}))
+
+	extipsetting, err = ts.ServiceSetting("default", "foo")
+	require.NoError(t, err)
+	assert.Empty(t, extipsetting.Endpoints)
+	assert.Empty(t, extipsetting.InboundRules)
+	assert.Empty(t, extipsetting.ExtIPs)
+}
+
+// testServiceSourceDomainFilter tests that the hostnames outside of the domain filter are reported.
+func testServiceSourceDomainFilter(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+
+	_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "foo",
+			Annotations: map[string]string{
+				hostnameAnnotationKey: "foo.example.org., foo.other.org.",
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	recorder := record.NewFakeRecorder(10)
+	client, err := NewServiceSource(
+		kubernetes,
+		node.NewClientLister(kubernetes),
+		recorder,
+		"cl.kube.io",
+		"",
+		"",
+		"",
+		false,
+		"",
+		false,
+		"",
+		0,
+		"",
+		"",
+		provider.NewDomainFilter([]string{"example.org"}),
+		false,
+		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	_, err = client.ExternalIPSetting()
+	require.NoError(t, err)
+
+	m := &dto.Metric{}
+	require.NoError(t, unpublishableHostnames.Write(m))
+	assert.Equal(t, float64(1), m.GetGauge().GetValue())
+
+	require.Len(t, recorder.Events, 1)
+	assert.Equal(t, "Warning UnpublishableHostname Hostname foo.other.org doesn't match the domain filter and won't be published", <-recorder.Events)
+}
+
+func testServiceSourceDeleting(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+
+	deleted := metav1.Now()
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "foo",
+				Annotations: map[string]string{hostnameAnnotationKey: "foo.example.org."},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:         "default",
+				Name:              "bar",
+				Annotations:       map[string]string{hostnameAnnotationKey: "bar.example.org."},
+				DeletionTimestamp: &deleted,
+			},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+
+	client, err := NewServiceSource(
+		kubernetes,
+		node.NewClientLister(kubernetes),
+		nil,
+		"cl.kube.io",
+		"",
+		"",
+		"",
+		false,
+		"",
+		false,
+		"",
+		0,
+		"",
+		"",
+		provider.DomainFilter{},
+		false,
+		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	// the service being deleted is left out, so that it gets cleaned up
+	setting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	require.Len(t, setting.ExtIPs, 1)
+	assert.Equal(t, "foo", setting.ExtIPs[0].SvcName)
+
+	setting, err = client.(TargetedSource).ServiceSetting("default", "bar")
+	require.NoError(t, err)
+	assert.Empty(t, setting.ExtIPs)
+}
+
+func testServiceSourceExpiry(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+
+	now := time.Now()
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "foo",
+				Annotations: map[string]string{
+					hostnameAnnotationKey:  "foo.example.org.",
+					expiresAtAnnotationKey: now.Add(time.Hour).Format(time.RFC3339),
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "bar",
+				Annotations: map[string]string{
+					hostnameAnnotationKey:    "bar.example.org.",
+					expireAfterAnnotationKey: "2h",
+				},
+				CreationTimestamp: metav1.NewTime(now.Add(-3 * time.Hour)),
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "baz",
+				Annotations: map[string]string{hostnameAnnotationKey: "baz.example.org."},
+			},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+
+	client, err := NewServiceSource(
+		kubernetes,
+		node.NewClientLister(kubernetes),
+		nil,
+		"cl.kube.io",
+		"",
+		"",
+		"",
+		false,
+		"",
+		false,
+		"",
+		0,
+		"",
+		"",
+		provider.DomainFilter{},
+		false,
+		false,
+		"",
+		nil,
+		"",
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	// the expired service is left out, so that its records and inbound rules are removed
+	setting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	names := []string{}
+	for _, e := range setting.ExtIPs {
+		names = append(names, e.SvcName)
+	}
+	assert.ElementsMatch(t, []string{"foo", "baz"}, names)
+	assert.Len(t, setting.InboundRules, 2)
+	assert.Equal(t, now.Add(time.Hour).Unix(), setting.NextExpiry.Unix())
+
+	setting, err = client.(TargetedSource).ServiceSetting("default", "bar")
+	require.NoError(t, err)
+	assert.Empty(t, setting.InboundRules)
+}
+
+// testServiceSourceMaintenance tests that the records of a service in maintenance are withdrawn or retargeted.
+func testServiceSourceMaintenance(t *testing.T) {
+	for _, tc := range []struct {
+		title             string
+		annotations       map[string]string
+		endpoints         []*endpoint.Endpoint
+		internalEndpoints []*endpoint.Endpoint
+		rules             []inbound.InboundRule
+		expectError       bool
+	}{
+		{
+			"service out of maintenance is published",
+			map[string]string{maintenanceAnnotationKey: "false"},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.9.8.7"}}},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"1.2.3.4"}}},
+			[]inbound.InboundRule{{Protocol: "tcp", Port: 443, Description: "default/foo/443"}},
+			false,
+		},
+		{
+			"service in maintenance is withdrawn from DNS and keeps its inbound rules",
+			map[string]string{maintenanceAnnotationKey: "true"},
+			[]*endpoint.Endpoint{},
+			[]*endpoint.Endpoint{},
+			[]inbound.InboundRule{{Protocol: "tcp", Port: 443, Description: "default/foo/443"}},
+			false,
+		},
+		{
+			"service in maintenance points to its maintenance target",
+			map[string]string{maintenanceAnnotationKey: "true", maintenanceTargetAnnotationKey: "Sorry.example.org."},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"sorry.example.org"}, RecordType: endpoint.RecordTypeCNAME}},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"sorry.example.org"}, RecordType: endpoint.RecordTypeCNAME}},
+			[]inbound.InboundRule{{Protocol: "tcp", Port: 443, Description: "default/foo/443"}},
+			false,
+		},
+		{
+			"service in maintenance opens its ports to its maintenance source ranges",
+			map[string]string{
+				maintenanceAnnotationKey:             "true",
+				maintenanceTargetAnnotationKey:       "10.1.1.1",
+				maintenanceSourceRangesAnnotationKey: "10.0.0.0/8",
+				sourceSecurityGroupAnnotationKey:     "self",
+			},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.1.1.1"}, RecordType: endpoint.RecordTypeA}},
+			[]*endpoint.Endpoint{{DNSName: "foo.example.org", Targets: endpoint.Targets{"10.1.1.1"}, RecordType: endpoint.RecordTypeA}},
+			[]inbound.InboundRule{{Protocol: "tcp", Port: 443, Description: "default/foo/443", SourceCIDRs: []string{"10.0.0.0/8"}}},
+			false,
+		},
+		{
+			"invalid maintenance annotation fails",
+			map[string]string{maintenanceAnnotationKey: "soon"},
+			[]*endpoint.Endpoint{},
+			[]*endpoint.Endpoint{},
+			nil,
+			true,
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			kubernetes := fake.NewSimpleClientset()
+
+			annotations := map[string]string{hostnameAnnotationKey: "foo.example.org."}
+			for k, v := range tc.annotations {
+				annotations[k] = v
+			}
+			_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+				Spec: v1.ServiceSpec{
+					Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}},
+				},
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "default",
+					Name:        "foo",
+					Annotations: annotations,
+				},
+			})
+			require.NoError(t, err)
+
+			_, err = kubernetes.CoreV1().Nodes().Create(&v1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       v1.NodeSpec{ProviderID: "abc"},
+				Status: v1.NodeStatus{
+					Addresses: []v1.NodeAddress{
+						{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+						{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			client, err := NewServiceSource(
+				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
+				"cl.kube.io",
+				"",
+				"",
+				"",
+				false,
+				"",
+				false,
+				"",
+				0,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
+				false,
+				"",
+				nil,
+				"",
+				"",
+				nil,
+			)
+			require.NoError(t, err)
+
+			extipsetting, err := client.ExternalIPSetting()
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// the external IPs are kept whatever the maintenance
+			validateSetting(t, extipsetting, &setting.ExternalIPSetting{
+				Endpoints:         tc.endpoints,
+				InternalEndpoints: tc.internalEndpoints,
+				InboundRules: []*inbound.InboundRules{
+					{Name: "foo.cl.kube.io", Rules: tc.rules, ProviderIDs: inbound.ProviderIDs{"abc"}},
+				},
+				ExtIPs: []*extip.ExtIP{
+					{SvcName: "foo", ExtIPs: endpoint.Targets{"1.2.3.4"}},
+				},
+			})
+		})
+	}
+}
+
+// testServiceSourceDryRun tests that the endpoints, inbound rules and external IPs of a service in dry-run are marked.
+func testServiceSourceDryRun(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "foo",
+				Annotations: map[string]string{hostnameAnnotationKey: "foo.example.org.", dryRunAnnotationKey: "true"},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "bar",
+				Annotations: map[string]string{hostnameAnnotationKey: "bar.example.org.", dryRunAnnotationKey: "false"},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+	_, err := kubernetes.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "abc"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+				{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	client, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "", nil)
+	require.NoError(t, err)
+
+	extipsetting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	require.Len(t, extipsetting.Endpoints, 2)
+	require.Len(t, extipsetting.InboundRules, 2)
+
+	for _, ep := range append(extipsetting.Endpoints, extipsetting.InternalEndpoints...) {
+		assert.Equal(t, ep.DNSName == "foo.example.org", ep.DryRun, ep.DNSName)
+	}
+	for _, r := range extipsetting.InboundRules {
+		assert.Equal(t, r.Name == "foo.cl.kube.io", r.DryRun, r.Name)
+	}
+	for _, e := range extipsetting.ExtIPs {
+		assert.Equal(t, e.SvcName == "foo", e.DryRun, e.SvcName)
+	}
+}
+
+// testServiceSourceSlots tests that the endpoints of a blue/green pair are labeled with their slot and the active slot.
+func testServiceSourceSlots(t *testing.T) {
+	for _, tc := range []struct {
+		title       string
+		namespace   *v1.Namespace
+		activeSlot  string
+		expectError bool
+	}{
+		{
+			"active slot of the flag",
+			nil,
+			"blue",
+			false,
+		},
+		{
+			"active slot of the namespace annotation",
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: map[string]string{activeSlotAnnotationKey: "green"}}},
+			"green",
+			false,
+		},
+		{
+			"invalid active slot of the namespace annotation",
+			&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: map[string]string{activeSlotAnnotationKey: "red"}}},
+			"",
+			true,
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			kubernetes := fake.NewSimpleClientset()
+			if tc.namespace != nil {
+				_, err := kubernetes.CoreV1().Namespaces().Create(tc.namespace)
+				require.NoError(t, err)
+			}
+
+			for _, slot := range []string{"blue", "green"} {
+				_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: "default",
+						Name:      "foo-" + slot,
+						Annotations: map[string]string{
+							hostnameAnnotationKey: "foo.example.org.",
+							slotAnnotationKey:     slot,
+						},
+					},
+				})
+				require.NoError(t, err)
+			}
+
+			client, err := NewServiceSource(
+				kubernetes,
+				node.NewClientLister(kubernetes),
+				nil,
+				"cl.kube.io",
+				"",
+				"",
+				"",
+				false,
+				"",
+				false,
+				"",
+				0,
+				"",
+				"",
+				provider.DomainFilter{},
+				false,
+				false,
+				"blue",
+				nil,
+				"",
+				"",
+				nil,
+			)
+			require.NoError(t, err)
+
+			extipsetting, err := client.ExternalIPSetting()
+			if tc.expectError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			// both slots are candidates, the plan picks the active one
+			require.Len(t, extipsetting.Endpoints, 2)
+			slots := map[string]string{}
+			for _, ep := range extipsetting.Endpoints {
+				assert.Equal(t, tc.activeSlot, ep.Labels[endpoint.ActiveSlotLabelKey])
+				slots[ep.Labels[endpoint.ResourceLabelKey]] = ep.Labels[endpoint.SlotLabelKey]
+			}
+			assert.Equal(t, map[string]string{"service/default/foo-blue": "blue", "service/default/foo-green": "green"}, slots)
+		})
+	}
+}
+
+// testServiceSourceServiceLabels tests that the allow-listed labels of a service are copied to its endpoints and inbound rules.
+func testServiceSourceServiceLabels(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	_, err := kubernetes.CoreV1().Services("default").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "foo",
+			Labels:      map[string]string{"tier": "edge", "app": "foo"},
+			Annotations: map[string]string{hostnameAnnotationKey: "foo.example.org."},
+		},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+	})
+	require.NoError(t, err)
+	_, err = kubernetes.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "abc"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+				{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	// the team label is allowed but missing, the app label present but not allowed
+	client, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", []string{"tier", "team", ""}, "", "", nil)
+	require.NoError(t, err)
+
+	extipsetting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	require.Len(t, extipsetting.Endpoints, 1)
+	require.Len(t, extipsetting.InboundRules, 1)
+
+	for _, ep := range append(extipsetting.Endpoints, extipsetting.InternalEndpoints...) {
+		assert.Equal(t, endpoint.Labels{
+			endpoint.ResourceLabelKey:               "service/default/foo",
+			endpoint.ServiceLabelKeyPrefix + "tier": "edge",
+		}, ep.Labels, ep.DNSName)
+	}
+	assert.Equal(t, map[string]string{"tier": "edge"}, extipsetting.InboundRules[0].Labels)
+}
+
+func testServiceSourceFirewallNameTemplate(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	_, err := kubernetes.CoreV1().Services("web").Create(&v1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "web",
+			Name:        "foo",
+			Annotations: map[string]string{hostnameAnnotationKey: "foo.example.org."},
+		},
+		Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+	})
+	require.NoError(t, err)
+
+	client, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "{{.Namespace}}-{{.Service}}-{{.Hash}}.{{.Cluster}}", "", nil)
+	require.NoError(t, err)
+
+	extipsetting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	require.Len(t, extipsetting.InboundRules, 1)
+	hash := firewallNameHash("foo", "web", "cl.kube.io")
+	assert.Len(t, hash, firewallNameHashLength)
+	assert.Equal(t, "web-foo-"+hash+".cl.kube.io", extipsetting.InboundRules[0].Name)
+	assert.Equal(t, "foo.web.cl.kube.io", extipsetting.InboundRules[0].LegacyName)
+
+	// the default naming scheme has no legacy name
+	client, err = NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "", nil)
+	require.NoError(t, err)
+	extipsetting, err = client.ExternalIPSetting()
+	require.NoError(t, err)
+	require.Len(t, extipsetting.InboundRules, 1)
+	assert.Equal(t, "foo.web.cl.kube.io", extipsetting.InboundRules[0].Name)
+	assert.Empty(t, extipsetting.InboundRules[0].LegacyName)
+
+	_, err = NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "{{.Service", "", nil)
+	assert.Error(t, err)
+	_, err = NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "{{.Name}}.{{.Cluster}}", "", nil)
+	assert.Error(t, err)
+}
+
+// testServiceSourceNodePortRange tests that the NodePort services open the node port range by a rule per protocol.
+func testServiceSourceNodePortRange(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "nodeport",
+				Annotations: map[string]string{
+					hostnameAnnotationKey:     "nodeport.example.org.",
+					sourceRangesAnnotationKey: "10.0.0.0/8",
+				},
+			},
+			Spec: v1.ServiceSpec{
+				Type: v1.ServiceTypeNodePort,
+				Ports: []v1.ServicePort{
+					{Name: "http", Protocol: "TCP", Port: 80, NodePort: 30080},
+					{Name: "https", Protocol: "TCP", Port: 443, NodePort: 30443},
+					{Name: "dns", Protocol: "UDP", Port: 53, NodePort: 30053},
+				},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        "clusterip",
+				Annotations: map[string]string{hostnameAnnotationKey: "clusterip.example.org."},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Name: "http", Protocol: "TCP", Port: 80}}},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+
+	client, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "30000-32767", nil)
+	require.NoError(t, err)
+
+	extipsetting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+	rules := map[string][]inbound.InboundRule{}
+	for _, r := range extipsetting.InboundRules {
+		rules[r.Resource] = r.Rules
+	}
+	assert.Equal(t, []inbound.InboundRule{
+		{Protocol: "tcp", Port: 30000, ToPort: 32767, Description: "default/nodeport/node-ports", SourceCIDRs: []string{"10.0.0.0/8"}},
+		{Protocol: "udp", Port: 30000, ToPort: 32767, Description: "default/nodeport/node-ports", SourceCIDRs: []string{"10.0.0.0/8"}},
+	}, rules["default/nodeport"])
+	// the other services open their ports
+	assert.Equal(t, []inbound.InboundRule{
+		{Protocol: "tcp", Port: 80, Description: "default/clusterip/http"},
+	}, rules["default/clusterip"])
+
+	_, err = NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "32767-30000", nil)
+	assert.Error(t, err)
+}
+
+// testServiceSourceAliasHostnames tests that the alias hostnames are aliases of the first hostname.
+func testServiceSourceAliasHostnames(t *testing.T) {
+	kubernetes := fake.NewSimpleClientset()
+	for _, svc := range []*v1.Service{
+		{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "foo",
+				Annotations: map[string]string{
+					hostnameAnnotationKey:      "foo.example.org., foo2.example.org.",
+					aliasHostnameAnnotationKey: "www.example.org, WWW2.example.org",
+					ttlAnnotationKey:           "60",
+				},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+		},
+		{
+			// withdrawn for maintenance along with its aliases
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "bar",
+				Annotations: map[string]string{
+					hostnameAnnotationKey:      "bar.example.org.",
+					aliasHostnameAnnotationKey: "vanity.example.org",
+					maintenanceAnnotationKey:   "true",
+				},
+			},
+			Spec: v1.ServiceSpec{Ports: []v1.ServicePort{{Protocol: "tcp", Port: 443}}},
+		},
+	} {
+		_, err := kubernetes.CoreV1().Services(svc.Namespace).Create(svc)
+		require.NoError(t, err)
+	}
+	_, err := kubernetes.CoreV1().Nodes().Create(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       v1.NodeSpec{ProviderID: "abc"},
+		Status: v1.NodeStatus{
+			Addresses: []v1.NodeAddress{
+				{Type: v1.NodeExternalIP, Address: "10.9.8.7"},
+				{Type: v1.NodeInternalIP, Address: "1.2.3.4"},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	client, err := NewServiceSource(kubernetes, node.NewClientLister(kubernetes), nil, "cl.kube.io", "", "", "", false, "", false, "", 0, "", "", provider.DomainFilter{}, false, false, "", nil, "", "", nil)
+	require.NoError(t, err)
+
+	extipsetting, err := client.ExternalIPSetting()
+	require.NoError(t, err)
+
+	aliases := map[string]*endpoint.Endpoint{}
+	for _, ep := range extipsetting.Endpoints {
+		if ep.RecordType == endpoint.RecordTypeCNAME {
+			aliases[ep.DNSName] = ep
+		}
+	}
+	require.Len(t, aliases, 2)
+	for _, name := range []string{"www.example.org", "www2.example.org"} {
+		ep := aliases[name]
+		require.NotNil(t, ep, name)
+		assert.Equal(t, endpoint.Targets{"foo.example.org"}, ep.Targets)
+		assert.Equal(t, "service/default/foo", ep.Labels[endpoint.ResourceLabelKey])
+		alias, _ := ep.ProviderSpecific.Get(provider.AliasProperty)
+		assert.Equal(t, "true", alias.Value)
+		// the aliases have no TTL of their own
+		assert.False(t, ep.RecordTTL.IsConfigured())
+	}
+	for _, ep := range extipsetting.InternalEndpoints {
+		assert.NotEqual(t, endpoint.RecordTypeCNAME, ep.RecordType, ep.DNSName)
+	}
+}
+
+func TestShortenFirewallName(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	name := inboundRulesName(long, "web", "cl.kube.io")
+	assert.Len(t, name, maxFirewallNameLength)
+	assert.True(t, strings.HasSuffix(name, "-"+firewallNameHash(long, "web", "cl.kube.io")+".cl.kube.io"), name)
+
+	// the names shortened to the same prefix keep apart
+	assert.NotEqual(t, name, inboundRulesName(long, "api", "cl.kube.io"))
+	assert.Equal(t, "foo.cl.kube.io", inboundRulesName("foo", "default", "cl.kube.io"))
+}
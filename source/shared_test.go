@@ -37,6 +37,7 @@ func validateIPs(t *testing.T, ips, expected endpoint.Targets) {
 
 func validateSetting(t *testing.T, setting, expected *setting.ExternalIPSetting) {
 	validateEndpoints(t, setting.Endpoints, expected.Endpoints)
+	validateEndpoints(t, setting.InternalEndpoints, expected.InternalEndpoints)
 	validateInboundRules(t, setting.InboundRules, expected.InboundRules)
 	validateExtIPs(t, setting.ExtIPs, expected.ExtIPs)
 }
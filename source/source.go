@@ -23,10 +23,14 @@ import (
 	"fmt"
 	"math"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/openfresh/external-ips/setting"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -34,6 +38,8 @@ import (
 )
 
 const (
+	// The prefix of the annotations of external-ips, the unknown ones being passed on to the providers as extensions
+	annotationPrefix = "external-ips.alpha.openfresh.github.io/"
 	// The annotation used for figuring out which controller is responsible
 	controllerAnnotationKey = "external-ips.alpha.openfresh.github.io/controller"
 	// The annotation used for defining the desired hostname
@@ -42,27 +48,106 @@ const (
 	selectorAnnotationKey = "external-ips.alpha.openfresh.github.io/selector"
 	// The annotation used for defining the desired maxips
 	maxipsAnnotationKey = "external-ips.alpha.openfresh.github.io/maxips"
+	// The annotation used for defining the minimum number of IPs kept in the records
+	minipsAnnotationKey = "external-ips.alpha.openfresh.github.io/minips"
 	// The annotation used for defining the desired DNS record TTL
 	ttlAnnotationKey = "external-ips.alpha.openfresh.github.io/ttl"
+	// The annotation used for limiting the inbound rules to some ports of the service, by name or number
+	portsAnnotationKey = "external-ips.alpha.openfresh.github.io/ports"
+	// The annotation used for limiting the inbound rules to some source ranges, as CIDRs
+	sourceRangesAnnotationKey = "external-ips.alpha.openfresh.github.io/source-ranges"
+	// The annotation used for opening the inbound rules to a security group, self for the nodes of the service
+	sourceSecurityGroupAnnotationKey = "external-ips.alpha.openfresh.github.io/source-security-group"
+	// The annotation used for removing the records and inbound rules of a service after a deadline, in RFC3339 format
+	expiresAtAnnotationKey = "external-ips.alpha.openfresh.github.io/expires-at"
+	// The annotation used for removing the records and inbound rules of a service some time after its creation, in duration format
+	expireAfterAnnotationKey = "external-ips.alpha.openfresh.github.io/expire-after"
+	// The annotation used for withdrawing a service from DNS during a maintenance window, true or false
+	maintenanceAnnotationKey = "external-ips.alpha.openfresh.github.io/maintenance"
+	// The annotation used for pointing the hostnames of a service in maintenance to another target, an IP or a hostname
+	maintenanceTargetAnnotationKey = "external-ips.alpha.openfresh.github.io/maintenance-target"
+	// The annotation used for limiting the inbound rules of a service in maintenance to some source ranges, as CIDRs
+	maintenanceSourceRangesAnnotationKey = "external-ips.alpha.openfresh.github.io/maintenance-source-ranges"
+	// The annotation used for sharing the hostnames of a service with the other slot of a blue/green pair, blue or green
+	slotAnnotationKey = "external-ips.alpha.openfresh.github.io/slot"
+	// The annotation of the namespaces used for choosing the slot of their blue/green pairs whose IPs are published
+	activeSlotAnnotationKey = "external-ips.alpha.openfresh.github.io/active-slot"
+	// The annotation used for synchronizing a service as soon as it changes
+	priorityAnnotationKey = "external-ips.alpha.openfresh.github.io/priority"
+	// The annotation used for computing and reporting the changes of a service without applying them, true or false
+	dryRunAnnotationKey = "external-ips.alpha.openfresh.github.io/dry-run"
+	// The prefix of the annotations setting a property of the records specific to the DNS provider, named after the rest of the key
+	providerSpecificAnnotationPrefix = "external-ips.alpha.openfresh.github.io/provider-"
+	// The annotation used for publishing the records in the public, private or both zones of their hostnames
+	zoneVisibilityAnnotationKey = "external-ips.alpha.openfresh.github.io/zone-visibility"
+	// The annotation used for defining the hostnames published as aliases of the first hostname, in the same zone
+	aliasHostnameAnnotationKey = "external-ips.alpha.openfresh.github.io/alias-hostname"
+	// The annotation used for exposing a service through the Global Accelerator of the cluster, true, source-ip or false
+	globalAcceleratorAnnotationKey = "external-ips.alpha.openfresh.github.io/global-accelerator"
 	// The value of the controller annotation so that we feel responsible
 	controllerAnnotationValue = "dns-controller"
+	// The value of the priority annotation for the services synchronized on their own
+	priorityAnnotationHigh = "high"
 )
 
+// knownAnnotationKeys lists the annotations interpreted by the sources and the controller,
+// the other annotations of external-ips being extensions.
+var knownAnnotationKeys = map[string]bool{
+	controllerAnnotationKey:              true,
+	hostnameAnnotationKey:                true,
+	selectorAnnotationKey:                true,
+	maxipsAnnotationKey:                  true,
+	minipsAnnotationKey:                  true,
+	ttlAnnotationKey:                     true,
+	portsAnnotationKey:                   true,
+	sourceRangesAnnotationKey:            true,
+	sourceSecurityGroupAnnotationKey:     true,
+	expiresAtAnnotationKey:               true,
+	expireAfterAnnotationKey:             true,
+	maintenanceAnnotationKey:             true,
+	maintenanceTargetAnnotationKey:       true,
+	maintenanceSourceRangesAnnotationKey: true,
+	slotAnnotationKey:                    true,
+	activeSlotAnnotationKey:              true,
+	priorityAnnotationKey:                true,
+	dryRunAnnotationKey:                  true,
+	zoneVisibilityAnnotationKey:          true,
+	aliasHostnameAnnotationKey:           true,
+	globalAcceleratorAnnotationKey:       true,
+	// set by the extip provider on the services whose external IPs it manages
+	annotationPrefix + "managed-by": true,
+}
+
 const (
 	ttlMinimum = 1
 	ttlMaximum = math.MaxUint32
 )
 
+const (
+	// the slots of a blue/green pair
+	slotBlue  = "blue"
+	slotGreen = "green"
+)
+
 type NodeIPs struct {
 	externalIPs []string
 	internalIPs []string
 }
 
 // Source defines the interface Endpoint sources should implement.
+// Sources only read the cluster, the external IPs of the services are
+// updated by the extip provider like any other change.
 type Source interface {
 	ExternalIPSetting() (*setting.ExternalIPSetting, error)
 }
 
+// TargetedSource is a Source which can also return the setting of a single service,
+// for the services synchronized on their own between the full synchronizations.
+type TargetedSource interface {
+	Source
+	ServiceSetting(namespace, name string) (*setting.ExternalIPSetting, error)
+}
+
 func getTTLFromAnnotations(annotations map[string]string) (endpoint.TTL, error) {
 	ttlNotConfigured := endpoint.TTL(0)
 	ttlAnnotation, exists := annotations[ttlAnnotationKey]
@@ -88,6 +173,232 @@ func getHostnamesFromAnnotations(annotations map[string]string) []string {
 	return strings.Split(strings.Replace(hostnameAnnotation, " ", "", -1), ",")
 }
 
+// getAliasHostnamesFromAnnotations returns the hostnames published as aliases of the
+// first hostname of the service.
+func getAliasHostnamesFromAnnotations(annotations map[string]string) []string {
+	aliasAnnotation, exists := annotations[aliasHostnameAnnotationKey]
+	if !exists {
+		return nil
+	}
+
+	return strings.Split(strings.Replace(aliasAnnotation, " ", "", -1), ",")
+}
+
+// clusterHostname inserts a subdomain named after the cluster in the hostname, right
+// beneath the domain of the filter it matches, or its parent domain if none, e.g.
+// foo.example.org becomes foo.kube-example-org.example.org in the kube.example.org
+// cluster. The dots of the cluster name are replaced so that it is a single label.
+func clusterHostname(hostname, clusterName string, domainFilter provider.DomainFilter) string {
+	hostname = strings.TrimSuffix(hostname, ".")
+	subdomain := strings.Replace(clusterName, ".", "-", -1)
+
+	domain := domainFilter.MatchingDomain(hostname)
+	if domain == hostname {
+		return subdomain + "." + domain
+	}
+	if domain == "" {
+		i := strings.Index(hostname, ".")
+		if i < 0 {
+			return hostname
+		}
+		domain = hostname[i+1:]
+	}
+	return strings.TrimSuffix(hostname, "."+domain) + "." + subdomain + "." + domain
+}
+
+// getPortsFromAnnotations returns the names of the ports to open, nil to open all of them.
+func getPortsFromAnnotations(annotations map[string]string) map[string]bool {
+	portsAnnotation, exists := annotations[portsAnnotationKey]
+	if !exists {
+		return nil
+	}
+
+	ports := map[string]bool{}
+	for _, name := range strings.Split(strings.Replace(portsAnnotation, " ", "", -1), ",") {
+		if name != "" {
+			ports[name] = true
+		}
+	}
+	return ports
+}
+
+// getSourceRangesFromAnnotations returns the source ranges the ports are opened to,
+// nil if absent.
+func getSourceRangesFromAnnotations(annotations map[string]string) ([]string, error) {
+	sourceRangesAnnotation, exists := annotations[sourceRangesAnnotationKey]
+	if !exists {
+		return nil, nil
+	}
+	return parseSourceRanges(sourceRangesAnnotation)
+}
+
+// getMaintenanceFromAnnotations returns whether the service is in maintenance.
+func getMaintenanceFromAnnotations(annotations map[string]string) (bool, error) {
+	maintenanceAnnotation, exists := annotations[maintenanceAnnotationKey]
+	if !exists {
+		return false, nil
+	}
+	maintenance, err := strconv.ParseBool(strings.TrimSpace(maintenanceAnnotation))
+	if err != nil {
+		return false, fmt.Errorf("\"%v\" is not a valid maintenance value", maintenanceAnnotation)
+	}
+	return maintenance, nil
+}
+
+func getDryRunFromAnnotations(annotations map[string]string) (bool, error) {
+	dryRunAnnotation, exists := annotations[dryRunAnnotationKey]
+	if !exists {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(strings.TrimSpace(dryRunAnnotation))
+	if err != nil {
+		return false, fmt.Errorf("\"%v\" is not a valid dry-run value", dryRunAnnotation)
+	}
+	return dryRun, nil
+}
+
+// getProviderSpecificFromAnnotations returns the properties specific to the DNS provider
+// of the annotations, sorted by name, nil if none.
+func getProviderSpecificFromAnnotations(annotations map[string]string) endpoint.ProviderSpecific {
+	var providerSpecific endpoint.ProviderSpecific
+	for key, value := range annotations {
+		name := strings.TrimPrefix(key, providerSpecificAnnotationPrefix)
+		if name == key || name == "" {
+			continue
+		}
+		providerSpecific = append(providerSpecific, endpoint.ProviderSpecificProperty{Name: name, Value: strings.TrimSpace(value)})
+	}
+	sort.Slice(providerSpecific, func(i, j int) bool {
+		return providerSpecific[i].Name < providerSpecific[j].Name
+	})
+	return providerSpecific
+}
+
+// getExtensionsFromAnnotations returns the annotations of external-ips which aren't
+// interpreted by the sources, by key without the prefix of external-ips, nil if none.
+// They're passed on to the providers, which interpret the ones they support and ignore
+// the others, so that a provider-specific feature doesn't need a new annotation of
+// the sources. The properties specific to the DNS provider aren't extensions.
+func getExtensionsFromAnnotations(annotations map[string]string) map[string]string {
+	var extensions map[string]string
+	for key, value := range annotations {
+		name := strings.TrimPrefix(key, annotationPrefix)
+		if name == key || name == "" || knownAnnotationKeys[key] || strings.HasPrefix(key, providerSpecificAnnotationPrefix) {
+			continue
+		}
+		if extensions == nil {
+			extensions = map[string]string{}
+		}
+		extensions[name] = strings.TrimSpace(value)
+	}
+	return extensions
+}
+
+// getAcceleratorAffinityFromAnnotations returns the client affinity of the listeners
+// exposing the service through the accelerator, empty if it isn't exposed through it.
+func getAcceleratorAffinityFromAnnotations(annotations map[string]string) (string, error) {
+	acceleratorAnnotation, exists := annotations[globalAcceleratorAnnotationKey]
+	if !exists {
+		return "", nil
+	}
+	v := strings.ToLower(strings.TrimSpace(acceleratorAnnotation))
+	if v == inbound.AcceleratorAffinitySourceIP {
+		return v, nil
+	}
+	accelerated, err := strconv.ParseBool(v)
+	if err != nil {
+		return "", fmt.Errorf("\"%v\" is not a valid global-accelerator value", acceleratorAnnotation)
+	}
+	if !accelerated {
+		return "", nil
+	}
+	return inbound.AcceleratorAffinityNone, nil
+}
+
+// getZoneVisibilityFromAnnotations returns the kinds of zones the records are
+// published in when their hostname matches both private and public zones.
+func getZoneVisibilityFromAnnotations(annotations map[string]string) (string, error) {
+	zoneVisibilityAnnotation, exists := annotations[zoneVisibilityAnnotationKey]
+	if !exists {
+		return provider.ZoneVisibilityBoth, nil
+	}
+	switch v := strings.ToLower(strings.TrimSpace(zoneVisibilityAnnotation)); v {
+	case provider.ZoneVisibilityPublic, provider.ZoneVisibilityPrivate, provider.ZoneVisibilityBoth:
+		return v, nil
+	}
+	return "", fmt.Errorf("\"%v\" is not a valid zone-visibility value", zoneVisibilityAnnotation)
+}
+
+// getMaintenanceSourceRangesFromAnnotations returns the source ranges the ports of a
+// service in maintenance are limited to, nil to leave its inbound rules as they are.
+func getMaintenanceSourceRangesFromAnnotations(annotations map[string]string) ([]string, error) {
+	sourceRangesAnnotation, exists := annotations[maintenanceSourceRangesAnnotationKey]
+	if !exists {
+		return nil, nil
+	}
+	return parseSourceRanges(sourceRangesAnnotation)
+}
+
+// getSlotFromAnnotations returns the slot of the blue/green pair the service belongs
+// to, empty if it doesn't belong to any.
+func getSlotFromAnnotations(annotations map[string]string) (string, error) {
+	slotAnnotation, exists := annotations[slotAnnotationKey]
+	if !exists {
+		return "", nil
+	}
+	return parseSlot(slotAnnotation)
+}
+
+// parseSlot parses the slot of a blue/green pair.
+func parseSlot(slot string) (string, error) {
+	switch s := strings.ToLower(strings.TrimSpace(slot)); s {
+	case slotBlue, slotGreen:
+		return s, nil
+	}
+	return "", fmt.Errorf("\"%v\" is not a valid slot", slot)
+}
+
+// parseSourceRanges parses a comma separated list of CIDRs.
+func parseSourceRanges(sourceRangesAnnotation string) ([]string, error) {
+	var ranges []string
+	for _, cidr := range strings.Split(strings.Replace(sourceRangesAnnotation, " ", "", -1), ",") {
+		if cidr == "" {
+			continue
+		}
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return nil, fmt.Errorf("\"%v\" is not a valid source range", cidr)
+		}
+		ranges = append(ranges, cidr)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("\"%v\" is not a valid list of source ranges", sourceRangesAnnotation)
+	}
+	return ranges, nil
+}
+
+// getExpiryFromAnnotations returns the deadline after which the service isn't
+// exposed anymore, the earliest if both annotations are set, zero if none is.
+func getExpiryFromAnnotations(annotations map[string]string, created time.Time) (time.Time, error) {
+	var deadline time.Time
+	if expiresAt, exists := annotations[expiresAtAnnotationKey]; exists {
+		t, err := time.Parse(time.RFC3339, strings.TrimSpace(expiresAt))
+		if err != nil {
+			return time.Time{}, fmt.Errorf("\"%v\" is not a valid expiry time", expiresAt)
+		}
+		deadline = t
+	}
+	if expireAfter, exists := annotations[expireAfterAnnotationKey]; exists {
+		d, err := time.ParseDuration(strings.TrimSpace(expireAfter))
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("\"%v\" is not a valid expiry duration", expireAfter)
+		}
+		if t := created.Add(d); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline, nil
+}
+
 func getSelectorFromAnnotations(annotations map[string]string) (labels.Selector, error) {
 	selectorAnnotation, exists := annotations[selectorAnnotationKey]
 	if !exists {
@@ -113,6 +424,18 @@ func getMaxIPsFromAnnotations(annotations map[string]string) (int, error) {
 	return int(maxips), nil
 }
 
+func getMinIPsFromAnnotations(annotations map[string]string) (int, error) {
+	minipsAnnotation, exists := annotations[minipsAnnotationKey]
+	if !exists {
+		return 0, nil
+	}
+	minips, err := strconv.ParseInt(minipsAnnotation, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("\"%v\" is not a valid Min IPs value", minipsAnnotation)
+	}
+	return int(minips), nil
+}
+
 // suitableType returns the DNS resource record type suitable for the target.
 // In this case type A for IPs and type CNAME for everything else.
 func suitableType(target string) string {
@@ -22,8 +22,11 @@ package source
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/openfresh/external-ips/dns/endpoint"
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/firewall/inbound"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -79,6 +82,249 @@ func TestGetTTLFromAnnotations(t *testing.T) {
 	}
 }
 
+func TestGetSourceRangesFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		title          string
+		annotations    map[string]string
+		expectedRanges []string
+		expectedErr    error
+	}{
+		{
+			title:       "source ranges annotation not present",
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			title:          "source ranges annotation value is set correctly",
+			annotations:    map[string]string{sourceRangesAnnotationKey: "10.0.0.0/8, 192.168.1.0/24"},
+			expectedRanges: []string{"10.0.0.0/8", "192.168.1.0/24"},
+		},
+		{
+			title:       "source ranges annotation value is not a CIDR",
+			annotations: map[string]string{sourceRangesAnnotationKey: "10.0.0.0/8,10.0.0.1"},
+			expectedErr: fmt.Errorf("\"10.0.0.1\" is not a valid source range"),
+		},
+		{
+			title:       "source ranges annotation value is empty",
+			annotations: map[string]string{sourceRangesAnnotationKey: ""},
+			expectedErr: fmt.Errorf("\"\" is not a valid list of source ranges"),
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			ranges, err := getSourceRangesFromAnnotations(tc.annotations)
+			assert.Equal(t, tc.expectedRanges, ranges)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestGetMaintenanceFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		title               string
+		annotations         map[string]string
+		expectedMaintenance bool
+		expectedErr         error
+	}{
+		{
+			title:       "maintenance annotation not present",
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			title:               "maintenance annotation value is true",
+			annotations:         map[string]string{maintenanceAnnotationKey: "true"},
+			expectedMaintenance: true,
+		},
+		{
+			title:       "maintenance annotation value is false",
+			annotations: map[string]string{maintenanceAnnotationKey: "false"},
+		},
+		{
+			title:       "maintenance annotation value is not a boolean",
+			annotations: map[string]string{maintenanceAnnotationKey: "soon"},
+			expectedErr: fmt.Errorf("\"soon\" is not a valid maintenance value"),
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			maintenance, err := getMaintenanceFromAnnotations(tc.annotations)
+			assert.Equal(t, tc.expectedMaintenance, maintenance)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestGetDryRunFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		title          string
+		annotations    map[string]string
+		expectedDryRun bool
+		expectedErr    error
+	}{
+		{
+			title:       "dry-run annotation not present",
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			title:          "dry-run annotation value is true",
+			annotations:    map[string]string{dryRunAnnotationKey: " true"},
+			expectedDryRun: true,
+		},
+		{
+			title:       "dry-run annotation value is not a boolean",
+			annotations: map[string]string{dryRunAnnotationKey: "maybe"},
+			expectedErr: fmt.Errorf("\"maybe\" is not a valid dry-run value"),
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			dryRun, err := getDryRunFromAnnotations(tc.annotations)
+			assert.Equal(t, tc.expectedDryRun, dryRun)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestGetProviderSpecificFromAnnotations(t *testing.T) {
+	assert.Nil(t, getProviderSpecificFromAnnotations(map[string]string{hostnameAnnotationKey: "foo.example.org"}))
+
+	assert.Equal(t, endpoint.ProviderSpecific{
+		{Name: "aws-alias", Value: "true"},
+		{Name: "aws-health-check-id", Value: "abc"},
+	}, getProviderSpecificFromAnnotations(map[string]string{
+		hostnameAnnotationKey: "foo.example.org",
+		providerSpecificAnnotationPrefix + "aws-health-check-id": "abc",
+		providerSpecificAnnotationPrefix + "aws-alias":           " true",
+		providerSpecificAnnotationPrefix:                         "nameless",
+	}))
+}
+
+func TestGetExtensionsFromAnnotations(t *testing.T) {
+	assert.Nil(t, getExtensionsFromAnnotations(map[string]string{
+		hostnameAnnotationKey:                               "foo.example.org",
+		providerSpecificAnnotationPrefix + "aws-alias":      "true",
+		annotationPrefix + "managed-by":                     "default",
+		"service.beta.kubernetes.io/aws-load-balancer-type": "nlb",
+	}))
+
+	assert.Equal(t, map[string]string{
+		"max-connections": "100",
+		"rate-limit":      "10/s",
+	}, getExtensionsFromAnnotations(map[string]string{
+		hostnameAnnotationKey:                "foo.example.org",
+		annotationPrefix + "max-connections": " 100",
+		annotationPrefix + "rate-limit":      "10/s",
+		annotationPrefix:                     "nameless",
+	}))
+}
+
+func TestGetZoneVisibilityFromAnnotations(t *testing.T) {
+	visibility, err := getZoneVisibilityFromAnnotations(map[string]string{hostnameAnnotationKey: "foo.example.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, provider.ZoneVisibilityBoth, visibility)
+
+	visibility, err = getZoneVisibilityFromAnnotations(map[string]string{zoneVisibilityAnnotationKey: " Private"})
+	assert.NoError(t, err)
+	assert.Equal(t, provider.ZoneVisibilityPrivate, visibility)
+
+	_, err = getZoneVisibilityFromAnnotations(map[string]string{zoneVisibilityAnnotationKey: "internal"})
+	assert.EqualError(t, err, `"internal" is not a valid zone-visibility value`)
+}
+
+func TestGetAcceleratorAffinityFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		annotation string
+		expected   string
+	}{
+		{annotation: "true", expected: inbound.AcceleratorAffinityNone},
+		{annotation: " Source-IP", expected: inbound.AcceleratorAffinitySourceIP},
+		{annotation: "false", expected: ""},
+	} {
+		affinity, err := getAcceleratorAffinityFromAnnotations(map[string]string{globalAcceleratorAnnotationKey: tc.annotation})
+		assert.NoError(t, err, tc.annotation)
+		assert.Equal(t, tc.expected, affinity, tc.annotation)
+	}
+
+	affinity, err := getAcceleratorAffinityFromAnnotations(map[string]string{hostnameAnnotationKey: "foo.example.org"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", affinity)
+
+	_, err = getAcceleratorAffinityFromAnnotations(map[string]string{globalAcceleratorAnnotationKey: "anycast"})
+	assert.EqualError(t, err, `"anycast" is not a valid global-accelerator value`)
+}
+
+func TestGetSlotFromAnnotations(t *testing.T) {
+	for _, tc := range []struct {
+		title        string
+		annotations  map[string]string
+		expectedSlot string
+		expectedErr  error
+	}{
+		{
+			title:       "slot annotation not present",
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			title:        "slot annotation value is set correctly",
+			annotations:  map[string]string{slotAnnotationKey: "Green"},
+			expectedSlot: "green",
+		},
+		{
+			title:       "slot annotation value is not a slot",
+			annotations: map[string]string{slotAnnotationKey: "red"},
+			expectedErr: fmt.Errorf("\"red\" is not a valid slot"),
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			slot, err := getSlotFromAnnotations(tc.annotations)
+			assert.Equal(t, tc.expectedSlot, slot)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
+func TestGetExpiryFromAnnotations(t *testing.T) {
+	created := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		title            string
+		annotations      map[string]string
+		expectedDeadline time.Time
+		expectedErr      error
+	}{
+		{
+			title:       "expiry annotations not present",
+			annotations: map[string]string{"foo": "bar"},
+		},
+		{
+			title:            "expires-at annotation value is set correctly",
+			annotations:      map[string]string{expiresAtAnnotationKey: "2018-06-02T00:00:00Z"},
+			expectedDeadline: time.Date(2018, 6, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			title:            "expire-after annotation counts from the creation",
+			annotations:      map[string]string{expireAfterAnnotationKey: "2h"},
+			expectedDeadline: created.Add(2 * time.Hour),
+		},
+		{
+			title:            "the earliest deadline wins",
+			annotations:      map[string]string{expiresAtAnnotationKey: "2018-06-02T00:00:00Z", expireAfterAnnotationKey: "2h"},
+			expectedDeadline: created.Add(2 * time.Hour),
+		},
+		{
+			title:       "expires-at annotation value is not a time",
+			annotations: map[string]string{expiresAtAnnotationKey: "tomorrow"},
+			expectedErr: fmt.Errorf("\"tomorrow\" is not a valid expiry time"),
+		},
+		{
+			title:       "expire-after annotation value is negative",
+			annotations: map[string]string{expireAfterAnnotationKey: "-2h"},
+			expectedErr: fmt.Errorf("\"-2h\" is not a valid expiry duration"),
+		},
+	} {
+		t.Run(tc.title, func(t *testing.T) {
+			deadline, err := getExpiryFromAnnotations(tc.annotations, created)
+			assert.True(t, tc.expectedDeadline.Equal(deadline), "expected %s, got %s", tc.expectedDeadline, deadline)
+			assert.Equal(t, tc.expectedErr, err)
+		})
+	}
+}
+
 func TestSuitableType(t *testing.T) {
 	for _, tc := range []struct {
 		target, recordType, expected string
@@ -95,3 +341,21 @@ func TestSuitableType(t *testing.T) {
 		}
 	}
 }
+
+func TestClusterHostname(t *testing.T) {
+	for _, tc := range []struct {
+		hostname     string
+		domainFilter []string
+		expected     string
+	}{
+		{"foo.example.org", nil, "foo.kube-openfresh-io.example.org"},
+		{"foo.bar.example.org.", nil, "foo.kube-openfresh-io.bar.example.org"},
+		{"foo.bar.example.org", []string{"example.org"}, "foo.bar.kube-openfresh-io.example.org"},
+		{"example.org", []string{"example.org"}, "kube-openfresh-io.example.org"},
+		{"foo.example.com", []string{"example.org"}, "foo.kube-openfresh-io.example.com"},
+		{"localhost", nil, "localhost"},
+	} {
+		hostname := clusterHostname(tc.hostname, "kube.openfresh.io", provider.NewDomainFilter(tc.domainFilter))
+		assert.Equal(t, tc.expected, hostname, "hostname %s", tc.hostname)
+	}
+}
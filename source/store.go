@@ -24,6 +24,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"sync"
 
@@ -31,6 +32,10 @@ import (
 	log "github.com/sirupsen/logrus"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/openfresh/external-ips/dns/provider"
+	"github.com/openfresh/external-ips/node"
 )
 
 // ErrSourceNotFound is returned when a requested source doesn't exist.
@@ -44,7 +49,24 @@ type Config struct {
 	CombineFQDNAndAnnotation bool
 	Compatibility            string
 	PublishInternal          bool
-	DryRun                   bool
+	InternalFQDNTemplate     string
+	DrainPeriod              time.Duration
+	SpotPolicy               string
+	SpotNodeSelector         string
+	DomainFilter             []string
+	ExcludeDomains           []string
+	SubdomainPerCluster      bool
+	SplitHorizon             bool
+	ActiveSlot               string
+	ServiceLabels            []string
+	FirewallNameTemplate     string
+	NodePortRange            string
+	CRDSourceAPIVersion      string
+	CRDSourceKind            string
+	// The static IPs of the accelerator of the cluster, published for the services exposed through it
+	AcceleratorIPs []string
+	// The size and the changes of the setting of the fake source
+	Fake FakeConfig
 }
 
 // ClientGenerator provides clients
@@ -57,7 +79,10 @@ type ClientGenerator interface {
 type SingletonClientGenerator struct {
 	KubeConfig string
 	KubeMaster string
-	client     kubernetes.Interface
+	// The rate limit of the requests to the API server, the client-go defaults if 0
+	QPS    float32
+	Burst  int
+	client kubernetes.Interface
 	sync.Once
 }
 
@@ -65,16 +90,18 @@ type SingletonClientGenerator struct {
 func (p *SingletonClientGenerator) KubeClient() (kubernetes.Interface, error) {
 	var err error
 	p.Once.Do(func() {
-		p.client, err = NewKubeClient(p.KubeConfig, p.KubeMaster)
+		p.client, err = NewKubeClient(p.KubeConfig, p.KubeMaster, p.QPS, p.Burst)
 	})
 	return p.client, err
 }
 
 // ByNames returns multiple Sources given multiple names.
-func ByNames(p ClientGenerator, names []string, cfg *Config, clusterName string) ([]Source, error) {
+// Sources listing nodes use nodeLister, or query the API server if it is nil.
+// Sources report problems with the resources as events through recorder, unless it is nil.
+func ByNames(p ClientGenerator, names []string, cfg *Config, clusterName string, nodeLister node.Lister, recorder record.EventRecorder) ([]Source, error) {
 	sources := []Source{}
 	for _, name := range names {
-		source, err := BuildWithConfig(name, p, cfg, clusterName)
+		source, err := BuildWithConfig(name, p, cfg, clusterName, nodeLister, recorder)
 		if err != nil {
 			return nil, err
 		}
@@ -85,16 +112,47 @@ func ByNames(p ClientGenerator, names []string, cfg *Config, clusterName string)
 }
 
 // BuildWithConfig allows to generate a Source implementation from the shared config
-func BuildWithConfig(source string, p ClientGenerator, cfg *Config, clusterName string) (Source, error) {
+func BuildWithConfig(source string, p ClientGenerator, cfg *Config, clusterName string, nodeLister node.Lister, recorder record.EventRecorder) (Source, error) {
 	switch source {
 	case "service":
 		client, err := p.KubeClient()
 		if err != nil {
 			return nil, err
 		}
-		return NewServiceSource(client, clusterName, cfg.Namespace, cfg.AnnotationFilter, cfg.FQDNTemplate, cfg.CombineFQDNAndAnnotation, cfg.Compatibility, cfg.PublishInternal, cfg.DryRun)
+		if nodeLister == nil {
+			nodeLister = node.NewClientLister(client)
+		}
+		return NewServiceSource(client, nodeLister, recorder, clusterName, cfg.Namespace, cfg.AnnotationFilter, cfg.FQDNTemplate, cfg.CombineFQDNAndAnnotation, cfg.Compatibility, cfg.PublishInternal, cfg.InternalFQDNTemplate, cfg.DrainPeriod, cfg.SpotPolicy, cfg.SpotNodeSelector, provider.NewDomainFilterWithExclusions(cfg.DomainFilter, cfg.ExcludeDomains), cfg.SubdomainPerCluster, cfg.SplitHorizon, cfg.ActiveSlot, cfg.ServiceLabels, cfg.FirewallNameTemplate, cfg.NodePortRange, cfg.AcceleratorIPs)
+	case "istio-gateway":
+		client, err := p.KubeClient()
+		if err != nil {
+			return nil, err
+		}
+		if nodeLister == nil {
+			nodeLister = node.NewClientLister(client)
+		}
+		services, err := NewServiceSource(client, nodeLister, recorder, clusterName, cfg.Namespace, cfg.AnnotationFilter, cfg.FQDNTemplate, cfg.CombineFQDNAndAnnotation, cfg.Compatibility, cfg.PublishInternal, cfg.InternalFQDNTemplate, cfg.DrainPeriod, cfg.SpotPolicy, cfg.SpotNodeSelector, provider.NewDomainFilterWithExclusions(cfg.DomainFilter, cfg.ExcludeDomains), cfg.SubdomainPerCluster, cfg.SplitHorizon, cfg.ActiveSlot, cfg.ServiceLabels, cfg.FirewallNameTemplate, cfg.NodePortRange, cfg.AcceleratorIPs)
+		if err != nil {
+			return nil, err
+		}
+		return NewIstioGatewaySource(services, NewIstioClient(client.Discovery().RESTClient()))
+	case "gateway-httproute":
+		client, err := p.KubeClient()
+		if err != nil {
+			return nil, err
+		}
+		if nodeLister == nil {
+			nodeLister = node.NewClientLister(client)
+		}
+		return NewGatewaySource(client, NewGatewayClient(client.Discovery().RESTClient()), nodeLister, clusterName, cfg.Namespace)
+	case "crd":
+		client, err := p.KubeClient()
+		if err != nil {
+			return nil, err
+		}
+		return NewCRDSource(NewCRDClient(client.Discovery().RESTClient(), cfg.CRDSourceAPIVersion, cfg.CRDSourceKind), cfg.Namespace, cfg.AnnotationFilter)
 	case "fake":
-		return NewFakeSource(cfg.FQDNTemplate)
+		return NewFakeSource(cfg.FQDNTemplate, cfg.Fake)
 	}
 	return nil, ErrSourceNotFound
 }
@@ -102,7 +160,9 @@ func BuildWithConfig(source string, p ClientGenerator, cfg *Config, clusterName
 // NewKubeClient returns a new Kubernetes client object. It takes a Config and
 // uses KubeMaster and KubeConfig attributes to connect to the cluster. If
 // KubeConfig isn't provided it defaults to using the recommended default.
-func NewKubeClient(kubeConfig, kubeMaster string) (*kubernetes.Clientset, error) {
+// The requests are limited to qps per second with bursts of burst, the client-go
+// defaults if 0.
+func NewKubeClient(kubeConfig, kubeMaster string, qps float32, burst int) (*kubernetes.Clientset, error) {
 	if kubeConfig == "" {
 		if _, err := os.Stat(clientcmd.RecommendedHomeFile); err == nil {
 			kubeConfig = clientcmd.RecommendedHomeFile
@@ -114,6 +174,9 @@ func NewKubeClient(kubeConfig, kubeMaster string) (*kubernetes.Clientset, error)
 		return nil, err
 	}
 
+	config.QPS = qps
+	config.Burst = burst
+
 	config.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
 		return instrumented_http.NewTransport(rt, &instrumented_http.Callbacks{
 			PathProcessor: func(path string) string {
@@ -52,7 +52,7 @@ func (suite *ByNamesTestSuite) TestAllInitialized() {
 	mockClientGenerator := new(MockClientGenerator)
 	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
 
-	sources, err := ByNames(mockClientGenerator, []string{"service", "fake"}, &Config{}, "")
+	sources, err := ByNames(mockClientGenerator, []string{"service", "fake"}, &Config{}, "", nil, nil)
 	suite.NoError(err, "should not generate errors")
 	suite.Len(sources, 2, "should generate all two sources")
 }
@@ -61,17 +61,45 @@ func (suite *ByNamesTestSuite) TestOnlyFake() {
 	mockClientGenerator := new(MockClientGenerator)
 	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
 
-	sources, err := ByNames(mockClientGenerator, []string{"fake"}, &Config{}, "")
+	sources, err := ByNames(mockClientGenerator, []string{"fake"}, &Config{}, "", nil, nil)
 	suite.NoError(err, "should not generate errors")
 	suite.Len(sources, 1, "should generate all three sources")
 	suite.Nil(mockClientGenerator.client, "client should not be created")
 }
 
+func (suite *ByNamesTestSuite) TestIstioGateway() {
+	mockClientGenerator := new(MockClientGenerator)
+	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
+
+	sources, err := ByNames(mockClientGenerator, []string{"istio-gateway"}, &Config{}, "", nil, nil)
+	suite.NoError(err, "should not generate errors")
+	suite.Len(sources, 1, "should generate the istio-gateway source")
+	suite.Implements((*TargetedSource)(nil), sources[0], "should synchronize the services on their own")
+}
+
+func (suite *ByNamesTestSuite) TestGatewayHTTPRoute() {
+	mockClientGenerator := new(MockClientGenerator)
+	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
+
+	sources, err := ByNames(mockClientGenerator, []string{"service", "gateway-httproute"}, &Config{}, "", nil, nil)
+	suite.NoError(err, "should not generate errors")
+	suite.Len(sources, 2, "should generate the service and gateway-httproute sources")
+}
+
+func (suite *ByNamesTestSuite) TestCRD() {
+	mockClientGenerator := new(MockClientGenerator)
+	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
+
+	sources, err := ByNames(mockClientGenerator, []string{"crd"}, &Config{CRDSourceAPIVersion: "externaldns.k8s.io/v1alpha1", CRDSourceKind: "DNSEndpoint"}, "", nil, nil)
+	suite.NoError(err, "should not generate errors")
+	suite.Len(sources, 1, "should generate the crd source")
+}
+
 func (suite *ByNamesTestSuite) TestSourceNotFound() {
 	mockClientGenerator := new(MockClientGenerator)
 	mockClientGenerator.On("KubeClient").Return(fake.NewSimpleClientset(), nil)
 
-	sources, err := ByNames(mockClientGenerator, []string{"foo"}, &Config{}, "")
+	sources, err := ByNames(mockClientGenerator, []string{"foo"}, &Config{}, "", nil, nil)
 	suite.Equal(err, ErrSourceNotFound, "should return sourcen not found")
 	suite.Len(sources, 0, "should not returns any source")
 }
@@ -80,7 +108,7 @@ func (suite *ByNamesTestSuite) TestKubeClientFails() {
 	mockClientGenerator := new(MockClientGenerator)
 	mockClientGenerator.On("KubeClient").Return(nil, errors.New("foo"))
 
-	_, err := ByNames(mockClientGenerator, []string{"service"}, &Config{}, "")
+	_, err := ByNames(mockClientGenerator, []string{"service"}, &Config{}, "", nil, nil)
 	suite.Error(err, "should return an error if client cannot be created")
 }
 
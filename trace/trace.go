@@ -0,0 +1,293 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+// Package trace records the spans of the synchronizations and exports them to an
+// OpenTelemetry collector over OTLP/HTTP, in its JSON encoding, so that a slow
+// synchronization can be followed down to the provider calls it's made of.
+package trace
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// the timeout of the exports of the traces
+	exportTimeout = 5 * time.Second
+	// the path of the traces of the OTLP/HTTP protocol
+	tracesPath = "/v1/traces"
+	// the name of the instrumentation scope of the spans
+	scopeName = "github.com/openfresh/external-ips"
+	// the kind and status codes of the spans of the OTLP protocol
+	spanKindInternal = 1
+	statusCodeError  = 2
+)
+
+var failedExports = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "external_ips",
+		Subsystem: "trace",
+		Name:      "failed_exports_total",
+		Help:      "Number of traces which failed to be exported.",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(failedExports)
+}
+
+// Tracer starts the traces and exports their spans once their root span ends.
+// A nil Tracer traces nothing.
+type Tracer struct {
+	url     string
+	service string
+	headers map[string]string
+	client  *http.Client
+}
+
+// NewTracer returns a Tracer exporting the traces of the service to the OTLP/HTTP
+// endpoint of a collector, e.g. http://localhost:4318, along with the given headers.
+func NewTracer(endpoint, service string, headers map[string]string) (*Tracer, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OTLP endpoint: %v", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint, expected an http or https URL: %s", endpoint)
+	}
+	return &Tracer{
+		url:     strings.TrimRight(endpoint, "/") + tracesPath,
+		service: service,
+		headers: headers,
+		client:  &http.Client{Timeout: exportTimeout},
+	}, nil
+}
+
+// ParseHeaders parses the headers given as key=value.
+func ParseHeaders(headers []string) (map[string]string, error) {
+	result := make(map[string]string, len(headers))
+	for _, h := range headers {
+		if h == "" {
+			continue
+		}
+		kv := strings.SplitN(h, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid OTLP header, expected key=value: %q", h)
+		}
+		result[kv[0]] = kv[1]
+	}
+	return result, nil
+}
+
+// Start starts the root span of a new trace, nil for a nil Tracer.
+func (t *Tracer) Start(name string, start time.Time) *Span {
+	if t == nil {
+		return nil
+	}
+	return &Span{
+		trace: &traceData{tracer: t, id: randomID(16)},
+		id:    randomID(8),
+		name:  name,
+		start: start,
+	}
+}
+
+// traceData holds the spans of a trace as they end.
+type traceData struct {
+	tracer *Tracer
+	id     string
+
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// Span is a step of a trace. The methods of a nil Span do nothing, so that the
+// steps are traced the same way whether a Tracer is configured or not.
+type Span struct {
+	trace  *traceData
+	id     string
+	parent string
+	name   string
+	start  time.Time
+
+	// set by the goroutine running the step, until it ends
+	attributes []attribute
+	end        time.Time
+	err        string
+}
+
+type attribute struct {
+	key, value string
+}
+
+// Child starts a span of the same trace under this span.
+func (s *Span) Child(name string, start time.Time) *Span {
+	if s == nil {
+		return nil
+	}
+	return &Span{
+		trace:  s.trace,
+		id:     randomID(8),
+		parent: s.id,
+		name:   name,
+		start:  start,
+	}
+}
+
+// SetAttribute sets an attribute of the span.
+func (s *Span) SetAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attributes = append(s.attributes, attribute{key, value})
+}
+
+// End ends the span, failed if err isn't nil. Ending the root span exports the
+// spans of the trace ended so far, a failed export being logged and counted.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+
+	s.trace.mu.Lock()
+	s.trace.spans = append(s.trace.spans, s)
+	spans := s.trace.spans
+	s.trace.mu.Unlock()
+
+	if s.parent != "" {
+		return
+	}
+	if err := s.trace.tracer.export(s.trace.id, spans); err != nil {
+		failedExports.Inc()
+		log.Warnf("Failed to export the trace of %s: %v", s.name, err)
+	}
+}
+
+// export posts the spans of a trace to the collector.
+func (t *Tracer) export(traceID string, spans []*Span) error {
+	request := exportRequest{ResourceSpans: []resourceSpans{{
+		Resource: resource{Attributes: []keyValue{newKeyValue("service.name", t.service)}},
+		ScopeSpans: []scopeSpans{{
+			Scope: scope{Name: scopeName},
+			Spans: make([]otlpSpan, 0, len(spans)),
+		}},
+	}}}
+	for _, s := range spans {
+		span := otlpSpan{
+			TraceID:           traceID,
+			SpanID:            s.id,
+			ParentSpanID:      s.parent,
+			Name:              s.name,
+			Kind:              spanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		for _, a := range s.attributes {
+			span.Attributes = append(span.Attributes, newKeyValue(a.key, a.value))
+		}
+		if s.err != "" {
+			span.Status = status{Code: statusCodeError, Message: s.err}
+		}
+		request.ResourceSpans[0].ScopeSpans[0].Spans = append(request.ResourceSpans[0].ScopeSpans[0].Spans, span)
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// randomID returns a random identifier of n bytes, hex encoded.
+func randomID(n int) string {
+	b := make([]byte, n)
+	// crypto/rand doesn't fail on the supported platforms
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// the JSON encoding of the ExportTraceServiceRequest of the OTLP protocol, the
+// identifiers being hex encoded and the 64 bits integers strings
+type exportRequest struct {
+	ResourceSpans []resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resource     `json:"resource"`
+	ScopeSpans []scopeSpans `json:"scopeSpans"`
+}
+
+type resource struct {
+	Attributes []keyValue `json:"attributes"`
+}
+
+type scopeSpans struct {
+	Scope scope      `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type scope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func newKeyValue(key, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: value}}
+}
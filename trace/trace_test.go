@@ -0,0 +1,106 @@
+// Copyright (c) 2018 CyberAgent, Inc. All rights reserved.
+// https://github.com/openfresh/external-ips
+
+package trace
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewTracer(t *testing.T) {
+	tracer, err := NewTracer("http://localhost:4318/", "external-ips", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:4318/v1/traces", tracer.url)
+
+	for _, endpoint := range []string{"localhost:4318", "ftp://localhost", "http://", "://localhost"} {
+		_, err := NewTracer(endpoint, "external-ips", nil)
+		assert.Error(t, err, endpoint)
+	}
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers, err := ParseHeaders([]string{"Authorization=Bearer a=b", "x-tenant=dev", ""})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"Authorization": "Bearer a=b", "x-tenant": "dev"}, headers)
+
+	_, err = ParseHeaders([]string{"x-tenant"})
+	assert.Error(t, err)
+	_, err = ParseHeaders([]string{"=dev"})
+	assert.Error(t, err)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+	span := tracer.Start("sync", time.Now())
+	assert.Nil(t, span)
+	child := span.Child("dns", time.Now())
+	child.SetAttribute("changes", "1")
+	child.End(nil)
+	span.End(nil)
+}
+
+func TestExport(t *testing.T) {
+	var requests []exportRequest
+	code := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/traces", r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "dev", r.Header.Get("x-tenant"))
+		var req exportRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		requests = append(requests, req)
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	tracer, err := NewTracer(server.URL, "external-ips", map[string]string{"x-tenant": "dev"})
+	require.NoError(t, err)
+
+	start := time.Unix(1000, 0)
+	root := tracer.Start("sync", start)
+	dns := root.Child("dns", start)
+	dns.SetAttribute("changes", "2")
+	dns.Child("dns.apply", start.Add(time.Second)).End(errors.New("throttled"))
+	dns.End(errors.New("throttled"))
+	assert.Empty(t, requests, "the trace is exported once its root span ends")
+	root.End(nil)
+
+	require.Len(t, requests, 1)
+	require.Len(t, requests[0].ResourceSpans, 1)
+	rs := requests[0].ResourceSpans[0]
+	assert.Equal(t, []keyValue{newKeyValue("service.name", "external-ips")}, rs.Resource.Attributes)
+	require.Len(t, rs.ScopeSpans, 1)
+	spans := rs.ScopeSpans[0].Spans
+	require.Len(t, spans, 3)
+
+	apply, dnsSpan, sync := spans[0], spans[1], spans[2]
+	assert.Equal(t, "dns.apply", apply.Name)
+	assert.Equal(t, "dns", dnsSpan.Name)
+	assert.Equal(t, "sync", sync.Name)
+	for _, s := range spans {
+		assert.Len(t, s.TraceID, 32)
+		assert.Equal(t, sync.TraceID, s.TraceID)
+		assert.Len(t, s.SpanID, 16)
+		assert.Equal(t, spanKindInternal, s.Kind)
+	}
+	assert.Empty(t, sync.ParentSpanID)
+	assert.Equal(t, sync.SpanID, dnsSpan.ParentSpanID)
+	assert.Equal(t, dnsSpan.SpanID, apply.ParentSpanID)
+	assert.Equal(t, "1001000000000", apply.StartTimeUnixNano)
+	assert.Equal(t, []keyValue{newKeyValue("changes", "2")}, dnsSpan.Attributes)
+	assert.Equal(t, status{Code: statusCodeError, Message: "throttled"}, apply.Status)
+	assert.Equal(t, status{}, sync.Status)
+
+	// a failed export doesn't fail the synchronization
+	code = http.StatusServiceUnavailable
+	tracer.Start("sync", start).End(nil)
+	assert.Len(t, requests, 2)
+}